@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/knakul853/shielder/internal/config"
+	"github.com/knakul853/shielder/internal/monitor"
+)
+
+// exportDashboards implements the export-dashboards command, which writes a
+// Grafana dashboard and Prometheus alerting rules for the metrics the given
+// configuration produces.
+func exportDashboards(args []string) error {
+	flags := flag.NewFlagSet("export-dashboards", flag.ContinueOnError)
+	configPath := flags.String("config", "configs/config.yaml", "configuration to export dashboards for")
+	out := flags.String("out", ".", "directory to write shielder-dashboard.json and shielder-alerts.yml to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	opts := dashboardOptions(cfg)
+	dashboard, err := monitor.Dashboard(opts)
+	if err != nil {
+		return err
+	}
+	alerts, err := monitor.AlertRules(opts)
+	if err != nil {
+		return err
+	}
+	for name, content := range map[string][]byte{"shielder-dashboard.json": dashboard, "shielder-alerts.yml": alerts} {
+		path := filepath.Join(*out, name)
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			return err
+		}
+		fmt.Println("Wrote", path)
+	}
+	return nil
+}
+
+func dashboardOptions(cfg *config.Config) monitor.DashboardOptions {
+	opts := monitor.DashboardOptions{
+		StoreBackend: storeBackend(cfg),
+		LocalCache:   cfg.Store.LocalCache.Enabled,
+		TLS:          cfg.Server.TLS.CertFile != "",
+		Authz:        cfg.Authz.Enabled,
+		Auth:         cfg.Auth.Enabled,
+		Replication:  cfg.Replication.Enabled,
+		Anomaly:      cfg.Anomaly.Enabled,
+		Fingerprints: cfg.Fingerprint.Enabled,
+		Greylist:     cfg.Greylist.Enabled,
+		Trusted:      len(cfg.Trusted) > 0,
+		GeoIP:        len(cfg.GeoIP.Databases) > 0,
+		Shadow:       cfg.RateLimit.ShadowAlgorithm != "",
+		Feedback:     cfg.Feedback.Enabled,
+		WAFSync:      len(cfg.WAFSync.Targets) > 0,
+		DecisionLog:  cfg.DecisionLog.Enabled,
+		Expensive:    cfg.Expensive.SlowThreshold > 0 || cfg.Expensive.LargeResponseBytes > 0,
+		Accounting:   cfg.Accounting.Enabled,
+		GeoBlocking:  cfg.Proxy.EnableGeoBlocking,
+		Bypass:       cfg.Bypass.Enabled,
+		HealthChecks: cfg.Proxy.HealthCheck.Enabled,
+		Review:       cfg.Review.Enabled,
+
+		ConditionalCache: cfg.Proxy.ConditionalCache.TTL > 0,
+		CircuitBreaker:   cfg.Proxy.CircuitBreaker.Enabled,
+	}
+	for _, route := range cfg.Routes {
+		opts.Routes = append(opts.Routes, route.Name)
+		opts.Idempotency = opts.Idempotency || route.Idempotency.Enabled
+	}
+	if len(cfg.Metrics.Routes) > 0 {
+		opts.Routes = cfg.Metrics.Routes
+		opts.AggregateRoutes = true
+	}
+	return opts
+}
@@ -2,19 +2,98 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/accounting"
+	"github.com/knakul853/shielder/internal/admin"
+	"github.com/knakul853/shielder/internal/anomaly"
+	"github.com/knakul853/shielder/internal/audit"
+	"github.com/knakul853/shielder/internal/auth"
+	"github.com/knakul853/shielder/internal/authz"
+	"github.com/knakul853/shielder/internal/bypass"
+	"github.com/knakul853/shielder/internal/challenge"
+	"github.com/knakul853/shielder/internal/clearance"
 	"github.com/knakul853/shielder/internal/config"
+	"github.com/knakul853/shielder/internal/connlimit"
+	"github.com/knakul853/shielder/internal/decisionlog"
+	"github.com/knakul853/shielder/internal/escalation"
+	"github.com/knakul853/shielder/internal/feedback"
+	"github.com/knakul853/shielder/internal/fingerprint"
+	"github.com/knakul853/shielder/internal/firewall"
+	"github.com/knakul853/shielder/internal/fleet"
+	"github.com/knakul853/shielder/internal/geoip"
+	"github.com/knakul853/shielder/internal/greylist"
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/knakul853/shielder/internal/idempotency"
+	"github.com/knakul853/shielder/internal/iplist"
 	"github.com/knakul853/shielder/internal/limiter"
 	"github.com/knakul853/shielder/internal/monitor"
+	"github.com/knakul853/shielder/internal/pathtemplate"
 	"github.com/knakul853/shielder/internal/proxy"
+	"github.com/knakul853/shielder/internal/replication"
+	"github.com/knakul853/shielder/internal/review"
+	"github.com/knakul853/shielder/internal/session"
+	"github.com/knakul853/shielder/internal/settings"
+	"github.com/knakul853/shielder/internal/signedtoken"
+	"github.com/knakul853/shielder/internal/signing"
+	"github.com/knakul853/shielder/internal/tap"
+	"github.com/knakul853/shielder/internal/tlsguard"
+	"github.com/knakul853/shielder/internal/tracing"
+	"github.com/knakul853/shielder/internal/trust"
+	"github.com/knakul853/shielder/internal/tuning"
+	"github.com/knakul853/shielder/internal/underattack"
+	"github.com/knakul853/shielder/internal/upgrade"
+	"github.com/knakul853/shielder/internal/upstream"
+	"github.com/knakul853/shielder/internal/wafsync"
+	"github.com/knakul853/shielder/plugin"
+	_ "github.com/knakul853/shielder/plugin/cors"
+	_ "github.com/knakul853/shielder/plugin/headers"
+	_ "github.com/knakul853/shielder/plugin/htmlinject"
+	_ "github.com/knakul853/shielder/plugin/jsonbody"
+	_ "github.com/knakul853/shielder/plugin/lua"
+	_ "github.com/knakul853/shielder/plugin/origin"
+	_ "github.com/knakul853/shielder/plugin/responsepolicy"
+	_ "github.com/knakul853/shielder/plugin/uploads"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export-dashboards" {
+		if err := exportDashboards(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "preflight" {
+		if err := runPreflight(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		if err := runPlan(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.JSONFormatter{})
 	logger.SetLevel(logrus.DebugLevel)
@@ -35,44 +114,1326 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	// Initialize Redis client
-	redisClient, err := limiter.NewRedisClient(*cfg.Redis.ToRedisOptions())
+	// Initialize metrics collector
+	metrics := monitor.NewMetricsCollector()
+	metrics.SetLabelOptions(monitor.LabelOptions{
+		Routes:       cfg.Metrics.Routes,
+		PathsByRoute: cfg.Metrics.PathLabel == "route",
+		Clients:      cfg.Metrics.ClientLabel,
+		IPv4Prefix:   cfg.Metrics.IPv4Prefix,
+		IPv6Prefix:   cfg.Metrics.IPv6Prefix,
+		MaxClients:   cfg.Metrics.MaxClientLabels,
+	})
+
+	// Initialize the limiter store
+	store, err := newStore(ctx, cfg, metrics, logger)
 	if err != nil {
-		logger.WithError(err).Fatalf("Failed to connect to Redis")
+		logger.WithError(err).Fatalf("Failed to connect to %s store", storeBackend(cfg))
 	}
-	defer redisClient.Close()
+	defer store.Close()
+
+	// Wait for the store to come up, but keep starting in degraded mode if it
+	// does not, so that a Redis outage does not also take the proxy down
+	startupCtx, cancelStartup := context.WithTimeout(ctx, cfg.Redis.StartupTimeout)
+	storeErr := limiter.WaitForStore(startupCtx, store, 5*time.Second, logger)
+	cancelStartup()
 
 	// Initialize rate limiter
 	limiterConfig := limiter.Config{
-		RequestsPerMinute: cfg.RateLimit.RequestsPerMinute,
-		BurstSize:         cfg.RateLimit.BurstSize,
-		BlockDuration:     cfg.RateLimit.BlockDuration,
+		RequestsPerMinute:    cfg.RateLimit.RequestsPerMinute,
+		BurstSize:            cfg.RateLimit.BurstSize,
+		BlockDuration:        cfg.RateLimit.BlockDuration,
+		FailurePolicy:        limiter.FailurePolicy(cfg.RateLimit.FailurePolicy),
+		Algorithm:            cfg.RateLimit.Algorithm,
+		Instance:             instanceName(),
+		ShadowAlgorithm:      cfg.RateLimit.ShadowAlgorithm,
+		ShadowRecorder:       metrics,
+		InstanceCeiling:      cfg.RateLimit.InstanceCeiling,
+		InstanceCeilingBurst: cfg.RateLimit.InstanceCeilingBurst,
 	}
-	rateLimiter := limiter.NewRateLimiter(redisClient, limiterConfig, logger)
+	rateLimiter := limiter.NewRateLimiter(store, limiterConfig, logger)
+	if storeErr != nil {
+		logger.WithError(storeErr).Error("Store unreachable at startup, starting in degraded mode")
+		rateLimiter.SetAvailable(false)
+	}
+	metrics.RegisterStoreUp(rateLimiter.Available)
+	go rateLimiter.MonitorStore(ctx, cfg.Redis.HealthCheckInterval)
 
-	// Initialize metrics collector
-	metrics := monitor.NewMetricsCollector()
+	// Profiles limit their clients on their own, in the same store
+	profileLimiters := make([]*limiter.RateLimiter, len(cfg.Profiles))
+	for i, profile := range cfg.Profiles {
+		profileConfig := limiterConfig
+		if profile.RequestsPerMinute > 0 {
+			profileConfig.RequestsPerMinute = profile.RequestsPerMinute
+		}
+		if profile.BlockDuration > 0 {
+			profileConfig.BlockDuration = profile.BlockDuration
+		}
+		profileLimiters[i] = limiter.NewRateLimiter(store, profileConfig, logger)
+		if storeErr != nil {
+			profileLimiters[i].SetAvailable(false)
+		}
+		go profileLimiters[i].MonitorStore(ctx, cfg.Redis.HealthCheckInterval)
+	}
+	// onEvent observes the blocks of the main proxy and every profile
+	onEvent := func(handler limiter.EventHandler) {
+		rateLimiter.OnEvent(handler)
+		for _, profileLimiter := range profileLimiters {
+			profileLimiter.OnEvent(handler)
+		}
+	}
+
+	// Record block events durably if enabled
+	var historyStore *history.Store
+	var historyWriter *history.Writer
+	if cfg.History.Enabled {
+		var err error
+		historyStore, err = history.Open(ctx, cfg.History.Driver, cfg.History.DSN)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to open history database")
+		}
+		defer historyStore.Close()
+
+		historyWriter = history.NewWriter(historyStore, instanceName(), cfg.History.BufferSize, logger)
+		defer historyWriter.Close()
+
+		onEvent(func(ctx context.Context, event limiter.Event) {
+			if event.Actor != "" {
+				// The admin API records what operators do as manual actions.
+				return
+			}
+			actor := "limiter"
+			if event.Origin != "" {
+				actor = "replication:" + event.Origin
+			}
+			historyWriter.Record(history.Event{
+				Type:      string(event.Type),
+				Subject:   event.IP,
+				Reason:    event.Reason,
+				Actor:     actor,
+				Duration:  event.Duration,
+				CreatedAt: event.Time,
+			})
+		})
+
+		if cfg.History.Retention > 0 {
+			go historyStore.PurgeLoop(ctx, cfg.History.Retention, time.Hour, logger)
+		}
+	}
+
+	// Pass blocks on to the host firewall if enabled
+	if cfg.Firewall.Enabled {
+		output := firewall.New(firewall.Options{
+			LogFile:    cfg.Firewall.LogFile,
+			Command:    cfg.Firewall.Command,
+			Timeout:    cfg.Firewall.Timeout,
+			BufferSize: cfg.Firewall.BufferSize,
+		}, logger)
+		defer output.Close()
+		onEvent(output.Observe)
+	}
+
+	// Replicate block events between regions if enabled
+	if cfg.Replication.Enabled {
+		// Like the other stores, the client connects lazily, so that the
+		// replicator retries while Redis is down instead of stopping Shielder.
+		localClient := redisClient(cfg.Redis)
+		defer localClient.Close()
+
+		var peers []replication.Peer
+		for _, peer := range cfg.Replication.Peers {
+			client := redis.NewClient(peer.ToRedisOptions())
+			defer client.Close()
+			peers = append(peers, replication.Peer{Region: peer.Region, Client: client})
+		}
+
+		replicator := replication.New(replication.Options{
+			Region:     cfg.Replication.Region,
+			Stream:     cfg.Replication.Stream,
+			MaxLen:     cfg.Replication.MaxLen,
+			Lookback:   cfg.RateLimit.BlockDuration,
+			BufferSize: cfg.Replication.BufferSize,
+		}, localClient, peers, rateLimiter, metrics, logger)
+		defer replicator.Close()
+		onEvent(replicator.Publish)
+		go replicator.Run(ctx)
+	}
 
 	// Create and start the proxy server
 	proxyCfg := proxy.Config{
-		ListenAddr:  cfg.Server.ListenAddr,
-		TargetURL:   cfg.Proxy.TargetURL,
-		ReadTimeout: cfg.Server.ReadTimeout,
+		ListenAddr:   cfg.Server.ListenAddr,
+		TargetURL:    cfg.Proxy.TargetURL,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+
+		ExemptStreams:     cfg.Server.Streaming.ExemptTimeouts,
+		MaxStreamDuration: cfg.Server.Streaming.MaxDuration,
+
+		EgressProxy:   cfg.Proxy.EgressProxy,
+		NormalizeURLs: cfg.Proxy.NormalizeURLs,
+		CheckBudget:   cfg.Server.CheckBudget,
+
+		MaxRequestBodyBytes: cfg.Proxy.MaxRequestBodyBytes,
+
+		KeyStrategy: proxy.KeyStrategy{
+			Kind: cfg.RateLimit.KeyStrategy,
+			Name: cfg.RateLimit.KeyName,
+		},
+		RequestCost:      cfg.RateLimit.RequestCost,
+		LightRequestCost: cfg.RateLimit.LightRequestCost,
+
+		UpstreamIPFamily:      cfg.Proxy.UpstreamDial.IPFamily,
+		UpstreamFallbackDelay: cfg.Proxy.UpstreamDial.FallbackDelay,
+
+		MaxUpstreamConns:          cfg.Proxy.UpstreamLimits.MaxConns,
+		MaxNewUpstreamConnsPerSec: cfg.Proxy.UpstreamLimits.MaxNewConnsPerSecond,
+		NewUpstreamConnBurst:      cfg.Proxy.UpstreamLimits.NewConnBurst,
+		UpstreamConnWait:          cfg.Proxy.UpstreamLimits.ConnWaitTimeout,
+
+		UpstreamMaxIdleConnsPerHost:   cfg.Proxy.UpstreamTransport.MaxIdleConnsPerHost,
+		UpstreamIdleConnTimeout:       cfg.Proxy.UpstreamTransport.IdleConnTimeout,
+		UpstreamDialTimeout:           cfg.Proxy.UpstreamTransport.DialTimeout,
+		UpstreamTLSHandshakeTimeout:   cfg.Proxy.UpstreamTransport.TLSHandshakeTimeout,
+		UpstreamResponseHeaderTimeout: cfg.Proxy.UpstreamTransport.ResponseHeaderTimeout,
+		UpstreamPrewarmConns:          cfg.Proxy.UpstreamTransport.Prewarm.Conns,
+		UpstreamPrewarmInterval:       cfg.Proxy.UpstreamTransport.Prewarm.Interval,
+		UpstreamPrewarmPath:           cfg.Proxy.UpstreamTransport.Prewarm.Path,
+
+		DropInformational:    cfg.Proxy.Informational.Drop,
+		InformationalHeaders: cfg.Proxy.Informational.Headers,
 	}
-	server := proxy.NewServer(proxyCfg, rateLimiter, metrics)
+	if cfg.Authz.Enabled {
+		authorizer, err := authz.New(authz.Options{
+			Mode:                   cfg.Authz.Mode,
+			Address:                cfg.Authz.Address,
+			PathPrefix:             cfg.Authz.PathPrefix,
+			Timeout:                cfg.Authz.Timeout,
+			FailOpen:               cfg.Authz.FailurePolicy == "open",
+			AllowedRequestHeaders:  cfg.Authz.AllowedRequestHeaders,
+			AllowedUpstreamHeaders: cfg.Authz.AllowedUpstreamHeaders,
+			CacheTTL:               cfg.Authz.Cache.TTL,
+			CacheMaxEntries:        cfg.Authz.Cache.MaxEntries,
+			CacheKeyHeaders:        cfg.Authz.Cache.KeyHeaders,
+			Recorder:               metrics,
+		}, logger)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to create authorization client")
+		}
+		defer authorizer.Close()
+		proxyCfg.Authz = authorizer
+	}
+	if cfg.Auth.Enabled {
+		authOpts := auth.Options{
+			Optional:       cfg.Auth.Optional,
+			IdentityHeader: cfg.Auth.IdentityHeader,
+			Timeout:        cfg.Auth.Timeout,
+			Recorder:       metrics,
+		}
+		if c := cfg.Auth.JWT; c.JWKSURL != "" {
+			authOpts.JWT = &auth.JWTOptions{
+				JWKSURL:    c.JWKSURL,
+				Issuer:     c.Issuer,
+				Audience:   c.Audience,
+				Algorithms: c.Algorithms,
+				JWKSTTL:    c.JWKSTTL,
+			}
+		}
+		if c := cfg.Auth.Introspection; c.URL != "" {
+			authOpts.Introspection = &auth.IntrospectionOptions{
+				URL:          c.URL,
+				ClientID:     c.ClientID,
+				ClientSecret: c.ClientSecret,
+				TTL:          c.TTL,
+				NegativeTTL:  c.NegativeTTL,
+				Service:      authService(c.Service),
+			}
+		}
+		if c := cfg.Auth.APIKey; c.LookupURL != "" {
+			authOpts.APIKey = &auth.APIKeyOptions{
+				Header:      c.Header,
+				LookupURL:   c.LookupURL,
+				TTL:         c.TTL,
+				NegativeTTL: c.NegativeTTL,
+				Service:     authService(c.Service),
+			}
+		}
+		authClient := redisClient(cfg.Redis)
+		defer authClient.Close()
+		authenticator, err := auth.New(authOpts, authClient, logger)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to create authenticator")
+		}
+		proxyCfg.Auth = authenticator
+	}
+	if d := cfg.DecisionLog; d.Enabled {
+		opts := decisionlog.Options{
+			Dir:          d.Dir,
+			Instance:     instanceName(),
+			MaxBytes:     d.MaxBytes,
+			MaxAge:       d.MaxAge,
+			MaxFiles:     d.MaxFiles,
+			Compress:     d.Compress,
+			KeepUploaded: d.Upload.KeepUploaded,
+			BufferSize:   d.BufferSize,
+			Recorder:     metrics,
+		}
+		if d.Upload.URL != "" {
+			client := &http.Client{}
+			signer, err := newSigner(ctx, d.Upload.Signing)
+			if err != nil {
+				logger.WithError(err).Fatalf("Failed to create decision log upload signer")
+			}
+			if d.Upload.Signing.Type != "" {
+				client.Transport = signing.Transport(http.DefaultTransport, signer)
+			}
+			opts.Uploader = &decisionlog.HTTPUploader{BaseURL: d.Upload.URL, Client: client}
+		}
+		decisionLog, err := decisionlog.New(opts, logger)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to create decision log")
+		}
+		defer decisionLog.Close()
+		proxyCfg.DecisionLog = decisionLog
+	}
+	if a := cfg.Audit; a.Enabled {
+		client := &http.Client{}
+		signer, err := newSigner(ctx, a.Upload.Signing)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to create audit upload signer")
+		}
+		if a.Upload.Signing.Type != "" {
+			client.Transport = signing.Transport(http.DefaultTransport, signer)
+		}
+		sampler := audit.New(audit.Options{
+			Rate:          a.SampleRate,
+			Instance:      instanceName(),
+			BatchRecords:  a.BatchRecords,
+			BatchAge:      a.BatchAge,
+			RedactHeaders: a.RedactHeaders,
+			Uploader:      &decisionlog.HTTPUploader{BaseURL: a.Upload.URL, Client: client},
+			BufferSize:    a.BufferSize,
+			Recorder:      metrics,
+		}, logger)
+		defer sampler.Close()
+		proxyCfg.Audit = sampler
+	}
+	if t := cfg.PathTemplates; len(t.Patterns) > 0 || t.CollapseIDs {
+		templates, err := pathtemplate.New(pathtemplate.Options{Patterns: t.Patterns, CollapseIDs: t.CollapseIDs})
+		if err != nil {
+			logger.WithError(err).Fatalf("Invalid path templates")
+		}
+		proxyCfg.PathTemplates = templates
+	}
+	if e := cfg.Expensive; e.SlowThreshold > 0 || e.LargeResponseBytes > 0 {
+		policy := &proxy.ExpensivePolicy{SlowThreshold: e.SlowThreshold, LargeResponseBytes: e.LargeResponseBytes}
+		if e.LogFile != "" {
+			file, err := os.OpenFile(e.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+			if err != nil {
+				logger.WithError(err).Fatalf("Failed to open expensive request log")
+			}
+			defer file.Close()
+			policy.Log = logrus.New()
+			policy.Log.SetFormatter(&logrus.JSONFormatter{})
+			policy.Log.SetOutput(file)
+		}
+		proxyCfg.Expensive = policy
+	}
+	if a := cfg.AccessLog; a.Enabled {
+		var out io.Writer = os.Stdout
+		if a.File != "" {
+			file, err := os.OpenFile(a.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+			if err != nil {
+				logger.WithError(err).Fatalf("Failed to open access log")
+			}
+			defer file.Close()
+			out = file
+		}
+		proxyCfg.AccessLog = proxy.NewAccessLog(out, a.Format)
+	}
+	if b := cfg.Proxy.CircuitBreaker; b.Enabled {
+		proxyCfg.Breaker = &proxy.BreakerPolicy{
+			Window:         b.Window,
+			MinRequests:    b.MinRequests,
+			FailureRatio:   b.FailureRatio,
+			OpenDuration:   b.OpenDuration,
+			HalfOpenProbes: b.HalfOpenProbes,
+		}
+		if b.FallbackBody != "" {
+			proxyCfg.Breaker.FallbackBody = []byte(b.FallbackBody)
+			proxyCfg.Breaker.FallbackContentType = b.FallbackContentType
+			if proxyCfg.Breaker.FallbackContentType == "" {
+				proxyCfg.Breaker.FallbackContentType = "text/plain; charset=utf-8"
+			}
+		}
+	}
+	if c := cfg.Proxy.ConditionalCache; c.TTL > 0 {
+		proxyCfg.ConditionalCache = proxy.NewConditionalCache(c.TTL, c.MaxEntries)
+	}
+	if len(cfg.Proxy.Targets) > 0 || cfg.Proxy.Discovery.Type != "" {
+		targets := make([]*url.URL, 0, len(cfg.Proxy.Targets))
+		for _, target := range cfg.Proxy.Targets {
+			u, _ := url.Parse(target) // validated with the config
+			targets = append(targets, u)
+		}
+		pool := upstream.NewPool(upstream.Options{SlowStart: cfg.Proxy.SlowStart}, targets)
+		if d := cfg.Proxy.Discovery; d.Type != "" {
+			discovery, err := newDiscovery(d, pool, logger)
+			if err != nil {
+				logger.WithError(err).Fatal("Failed to set up upstream discovery")
+			}
+			// The first lookup completes before requests are served.
+			if err := discovery.Refresh(ctx); err != nil {
+				logger.WithError(err).Warn("Initial upstream discovery failed")
+			}
+			go discovery.Run(ctx)
+		}
+		if h := cfg.Proxy.HealthCheck; h.Enabled {
+			checker := upstream.NewHealthChecker(upstream.HealthOptions{
+				Path:               h.Path,
+				Interval:           h.Interval,
+				Timeout:            h.Timeout,
+				HealthyThreshold:   h.HealthyThreshold,
+				UnhealthyThreshold: h.UnhealthyThreshold,
+				Recorder:           metrics,
+			}, pool, logger)
+			go checker.Run(ctx)
+		}
+		proxyCfg.Upstream = pool
+	}
+	if len(cfg.Proxy.TrustedProxies) > 0 {
+		trusted, err := proxy.ParseTrustedProxies(cfg.Proxy.TrustedProxies)
+		if err != nil {
+			logger.WithError(err).Fatalf("Invalid trusted proxies")
+		}
+		proxyCfg.ClientIPs = &proxy.ClientIPResolver{TrustedProxies: trusted, Headers: cfg.Proxy.ClientIPHeaders}
+	}
+	if a := cfg.Accounting; a.Enabled {
+		var sink accounting.Sink
+		switch a.Sink {
+		case "stream":
+			accountingClient := redisClient(cfg.Redis)
+			defer accountingClient.Close()
+			sink = &accounting.StreamSink{Client: accountingClient, Stream: a.Stream, MaxLen: a.MaxLen}
+		case "csv":
+			sink = &accounting.CSVSink{Path: a.File}
+		case "webhook":
+			sink = &accounting.WebhookSink{URL: a.WebhookURL, Token: a.WebhookToken, Client: &http.Client{Timeout: 30 * time.Second}}
+		}
+		accountant := accounting.New(accounting.Options{
+			Interval:   a.Interval,
+			Instance:   instanceName(),
+			MaxPending: a.MaxPending,
+			Recorder:   metrics,
+		}, sink, logger)
+		accountingDone := make(chan struct{})
+		go func() {
+			accountant.Run(ctx)
+			close(accountingDone)
+		}()
+		// Runs after the server shut down, exporting the last period.
+		defer func() {
+			<-accountingDone
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			accountant.Flush(flushCtx)
+		}()
+		proxyCfg.Accountant = accountant
+	}
+	if q := cfg.Quota; q.Enabled {
+		proxyCfg.Quota = &proxy.QuotaEndpoint{Path: q.Path, RequireAuth: q.RequireAuth, RequestsPerMinute: q.RequestsPerMinute}
+	}
+	if st := cfg.Status; st.Enabled {
+		proxyCfg.Status = &proxy.StatusEndpoint{Path: st.Path, RequestsPerMinute: st.RequestsPerMinute, MaxAge: st.MaxAge}
+	}
+	var adminServer *admin.Server
+	if cfg.Admin.Enabled {
+		adminServer = admin.NewServer(cfg.Admin.ListenAddr, cfg.Admin.Token, logger)
+		if oidcCfg := cfg.Admin.OIDC; oidcCfg.Enabled {
+			if err := adminServer.EnableOIDC(ctx, admin.OIDCOptions{
+				Issuer:        oidcCfg.Issuer,
+				ClientID:      oidcCfg.ClientID,
+				ClientSecret:  oidcCfg.ClientSecret,
+				RedirectURL:   oidcCfg.RedirectURL,
+				Scopes:        oidcCfg.Scopes,
+				GroupsClaim:   oidcCfg.GroupsClaim,
+				AdminGroups:   oidcCfg.AdminGroups,
+				ViewerGroups:  oidcCfg.ViewerGroups,
+				SessionSecret: oidcCfg.SessionSecret,
+				SessionTTL:    oidcCfg.SessionTTL,
+				SecureCookie:  oidcCfg.SecureCookie,
+			}); err != nil {
+				logger.WithError(err).Fatalf("Failed to set up the admin OIDC login")
+			}
+		}
+	}
+	if b := cfg.Bypass; b.Enabled {
+		bypassClient := redisClient(cfg.Redis)
+		defer bypassClient.Close()
+
+		keys := make([]signedtoken.Key, 0, len(b.Keys))
+		for _, key := range b.Keys {
+			keys = append(keys, signedtoken.Key{ID: key.ID, Secret: []byte(key.Secret)})
+		}
+		bypassManager, err := bypass.NewManager(bypass.Options{
+			Header:     b.Header,
+			DefaultTTL: b.DefaultTTL,
+			MaxTTL:     b.MaxTTL,
+			Keys:       keys,
+		}, bypassClient)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to set up bypass tokens")
+		}
+		proxyCfg.Bypass = bypassManager
+		adminServer.RegisterBypass(bypassManager, historyWriter)
+	}
+	if cfg.Clearance.Enabled {
+		clearanceClient := redisClient(cfg.Redis)
+		defer clearanceClient.Close()
+
+		keys := make([]signedtoken.Key, 0, len(cfg.Clearance.Keys))
+		for _, key := range cfg.Clearance.Keys {
+			keys = append(keys, signedtoken.Key{ID: key.ID, Secret: []byte(key.Secret)})
+		}
+		clearanceManager, err := clearance.NewManager(clearance.Options{
+			CookieName: cfg.Clearance.CookieName,
+			TTL:        cfg.Clearance.TTL,
+			Keys:       keys,
+			Secure:     cfg.Clearance.Secure,
+			Domain:     cfg.Clearance.Domain,
+		}, clearanceClient)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to set up clearance tokens")
+		}
+		proxyCfg.Clearance = clearanceManager
+		if adminServer != nil {
+			adminServer.RegisterClearance(clearanceManager)
+		}
+		if cfg.UnderAttack.Challenge {
+			proxyCfg.Challenger = challenge.New(challenge.Options{
+				Difficulty: cfg.UnderAttack.ChallengeDifficulty,
+			}, clearanceManager, logger)
+		}
+	}
+	if cfg.Sessions.Enabled {
+		sessions, err := session.NewManager(session.Options{
+			CookieName:          cfg.Sessions.CookieName,
+			Secret:              []byte(cfg.Sessions.Secret),
+			TTL:                 cfg.Sessions.TTL,
+			Secure:              cfg.Sessions.Secure,
+			Domain:              cfg.Sessions.Domain,
+			RequestsPerMinute:   cfg.Sessions.RequestsPerMinute,
+			IPRequestsPerMinute: cfg.Sessions.IPRequestsPerMinute,
+		})
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to set up session tracking")
+		}
+		proxyCfg.Sessions = sessions
+	}
+	if cfg.Anomaly.Enabled {
+		anomalyClient := redisClient(cfg.Redis)
+		defer anomalyClient.Close()
 
-	go func() {
-		if err := server.Start(); err != nil {
-			logger.WithError(err).Error("Server error")
+		analyzer := anomaly.New(anomaly.Options{
+			Interval:            cfg.Anomaly.Interval,
+			Alpha:               cfg.Anomaly.Alpha,
+			Seasonal:            cfg.Anomaly.Seasonal,
+			MinSamples:          cfg.Anomaly.MinSamples,
+			RateThreshold:       cfg.Anomaly.RateThreshold,
+			ErrorRatioThreshold: cfg.Anomaly.ErrorRatioThreshold,
+			MinRate:             cfg.Anomaly.MinRate,
+			TightenFactor:       cfg.Anomaly.TightenFactor,
+			TightenDuration:     cfg.Anomaly.TightenDuration,
+			Recorder:            metrics,
+		}, anomalyClient, logger)
+		// Anomalies are logged and counted by the analyzer, which the
+		// ShielderTrafficAnomaly alert rule fires on.
+		if historyWriter != nil {
+			analyzer.OnAnomaly(analyzer.HistoryHandler(historyWriter))
+		}
+		go analyzer.Run(ctx)
+		proxyCfg.Anomaly = analyzer
+	}
+	if cfg.Tuning.Enabled {
+		tuningClient := redisClient(cfg.Redis)
+		defer tuningClient.Close()
+
+		tuner := tuning.New(tuning.Options{
+			Quantile:       cfg.Tuning.Quantile,
+			Headroom:       cfg.Tuning.Headroom,
+			MinObservation: cfg.Tuning.MinObservation,
+		}, tuningClient, logger)
+		go tuner.Run(ctx)
+		proxyCfg.Tuner = tuner
+		if adminServer != nil {
+			adminServer.RegisterTuning(tuner)
+		}
+	}
+	if len(cfg.WAFSync.Targets) > 0 {
+		wafClient := redisClient(cfg.Redis)
+		defer wafClient.Close()
+
+		opts := wafsync.Options{Interval: cfg.WAFSync.Interval, Recorder: metrics}
+		for _, target := range cfg.WAFSync.Targets {
+			provider, err := newWAFProvider(ctx, target)
+			if err != nil {
+				logger.WithError(err).Fatalf("Failed to set up WAF sync target %s", target.Name)
+			}
+			if target.Direction == wafsync.DirectionExport {
+				opts.Exports = append(opts.Exports, wafsync.Target{Name: target.Name, Provider: provider})
+			} else {
+				opts.Imports = append(opts.Imports, wafsync.Target{Name: target.Name, Provider: provider})
+			}
+		}
+		syncer := wafsync.New(opts, wafClient, logger)
+		onEvent(syncer.Observe)
+		go syncer.Run(ctx)
+		proxyCfg.WAFSync = syncer
+	}
+	if cfg.Feedback.Enabled {
+		feedbackClient := redisClient(cfg.Redis)
+		defer feedbackClient.Close()
+
+		collector := feedback.New(feedback.Options{
+			AutoUnblock: cfg.Feedback.AutoUnblock,
+			MaxCases:    cfg.Feedback.MaxCases,
+			Unblocker:   rateLimiter,
+			Recorder:    metrics,
+		}, feedbackClient, logger)
+		proxyCfg.Feedback = collector
+		if adminServer != nil {
+			adminServer.RegisterFeedback(collector)
+		}
+	}
+	if len(cfg.Trusted) > 0 {
+		identities := make([]trust.Identity, 0, len(cfg.Trusted))
+		for _, id := range cfg.Trusted {
+			identities = append(identities, trust.Identity{
+				Name:       id.Name,
+				CIDRs:      id.CIDRs,
+				UserAgents: id.UserAgents,
+				Header:     id.Header,
+				Token:      id.Token,
+			})
+		}
+		matcher, err := trust.New(identities)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to set up trusted identities")
+		}
+		proxyCfg.Trusted = matcher
+	}
+	if cfg.Fingerprint.Enabled {
+		proxyCfg.Fingerprints = fingerprint.New(fingerprint.Options{
+			TLSHeader: cfg.Fingerprint.TLSHeader,
+			Headers:   cfg.Fingerprint.Headers,
+			CarryOver: cfg.Fingerprint.CarryOver,
+			Window:    cfg.Fingerprint.Window,
+		}, store)
+	}
+	if cfg.Greylist.Enabled {
+		greylisted, err := greylist.New(greylist.Options{
+			Duration:      cfg.Greylist.Duration,
+			Memory:        cfg.Greylist.Memory,
+			TightenFactor: cfg.Greylist.TightenFactor,
+			Challenge:     cfg.Greylist.Challenge,
+		}, store)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to create greylist")
+		}
+		proxyCfg.Greylist = greylisted
+	}
+	if e := cfg.Escalation; e.Enabled {
+		escalator := escalation.New(escalation.Options{
+			Threshold: e.Threshold,
+			Window:    e.Window,
+			Duration:  e.Duration,
+		}, store, rateLimiter)
+		escalator.OnEscalate(func(ctx context.Context, escalated escalation.Escalation) {
+			metrics.IncEscalation(escalated.Kind)
+			logger.WithFields(logrus.Fields{
+				"kind":     escalated.Kind,
+				"subject":  escalated.Subject,
+				"scopes":   escalated.Scopes,
+				"duration": escalated.Duration,
+			}).Warn("Client escalated to the global block list")
+			if historyWriter != nil {
+				subject := escalated.Subject
+				if escalated.Kind != escalation.KindIP {
+					subject = escalated.Kind + ":" + subject
+				}
+				historyWriter.Record(history.Event{
+					Type:      history.EventEscalate,
+					Subject:   subject,
+					Reason:    fmt.Sprintf("offended on %d routes or keys", escalated.Scopes),
+					Actor:     "escalation",
+					Duration:  escalated.Duration,
+					CreatedAt: escalated.Time,
+				})
+			}
+		})
+		proxyCfg.Escalator = escalator
+		if adminServer != nil {
+			adminServer.RegisterEscalation(escalator)
+		}
+	}
+	if d := cfg.DebugTrace; d.Enabled {
+		tracingClient := redisClient(cfg.Redis)
+		defer tracingClient.Close()
+
+		tracer, err := tracing.New(tracing.Options{
+			Header: d.Header,
+			Key:    []byte(d.Key),
+			MaxTTL: d.MaxTTL,
+		}, tracingClient)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to set up debug traces")
+		}
+		proxyCfg.Tracer = tracer
+		if adminServer != nil {
+			adminServer.RegisterTracing(tracer)
+		}
+	}
+	// The IP lists can be reloaded through the admin API and the fleet. They
+	// are the only part of the configuration file read again, other settings
+	// take a restart or the settings API.
+	var ipLists *iplist.Lists
+	loadIPLists := func() ([]string, []string, error) {
+		reloaded, err := config.Load(configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reloaded.IPLists.Allow, reloaded.IPLists.Deny, nil
+	}
+	if l := cfg.IPLists; len(l.Allow) > 0 || len(l.Deny) > 0 || adminServer != nil || cfg.Fleet.Enabled {
+		var err error
+		ipLists, err = iplist.New(l.Allow, l.Deny)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to compile IP lists")
+		}
+		proxyCfg.IPLists = ipLists
+		if adminServer != nil {
+			adminServer.RegisterIPLists(ipLists, loadIPLists)
+		}
+	}
+	if rv := cfg.Review; rv.Enabled {
+		reviewClient := redisClient(cfg.Redis)
+		defer reviewClient.Close()
+
+		queue := review.New(review.Options{
+			MinScore:      rv.MinScore,
+			MaxScore:      rv.MaxScore,
+			TightenFactor: rv.TightenFactor,
+			Challenge:     rv.Challenge,
+			TTL:           rv.TTL,
+			BlockDuration: rv.BlockDuration,
+			AllowDuration: rv.AllowDuration,
+			Recorder:      metrics,
+		}, reviewClient, rateLimiter)
+		proxyCfg.Review = queue
+		if adminServer != nil {
+			adminServer.RegisterReview(queue)
+		}
+	}
+	var geoDatabases *geoip.Manager
+	if len(cfg.GeoIP.Databases) > 0 {
+		sources := make([]geoip.Source, 0, len(cfg.GeoIP.Databases))
+		for _, db := range cfg.GeoIP.Databases {
+			sources = append(sources, geoip.Source{
+				Name:        db.Name,
+				Type:        db.Type,
+				URL:         strings.ReplaceAll(db.URL, "{licenseKey}", cfg.GeoIP.LicenseKey),
+				ChecksumURL: strings.ReplaceAll(db.ChecksumURL, "{licenseKey}", cfg.GeoIP.LicenseKey),
+				Path:        db.Path,
+			})
+		}
+		geoDatabases, err = geoip.New(geoip.Options{
+			Sources:         sources,
+			RefreshInterval: cfg.GeoIP.RefreshInterval,
+			StaleAfter:      cfg.GeoIP.StaleAfter,
+			Recorder:        metrics,
+		}, logger)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to load GeoIP databases")
+		}
+		go geoDatabases.Run(ctx)
+		if adminServer != nil {
+			adminServer.RegisterGeoIP(geoDatabases)
+		}
+	}
+	var geoLocator *geoip.Locator
+	if geoDatabases != nil || len(cfg.GeoIP.Overrides) > 0 {
+		overrides := make([]geoip.Override, 0, len(cfg.GeoIP.Overrides))
+		for _, o := range cfg.GeoIP.Overrides {
+			overrides = append(overrides, geoip.Override{
+				Prefix:       netip.MustParsePrefix(o.CIDR),
+				Country:      o.Country,
+				ASN:          o.ASN,
+				Organization: o.Organization,
+			})
+		}
+		geoLocator = geoip.NewLocator(geoDatabases, geoip.LocatorOptions{
+			CountryDatabase: cfg.GeoIP.CountryDatabase,
+			ASNDatabase:     cfg.GeoIP.ASNDatabase,
+			Overrides:       overrides,
+		})
+		if adminServer != nil {
+			adminServer.RegisterGeoIPLookup(geoLocator)
+		}
+	}
+	proxyCfg.Locator = geoLocator
+	if proxyCfg.Upstream != nil && adminServer != nil {
+		adminServer.RegisterUpstream(proxyCfg.Upstream)
+	}
+	if cfg.Proxy.EnableGeoBlocking {
+		proxyCfg.BlockedCountries = cfg.Proxy.BlockedCountries
+	}
+	if id := cfg.IdentityHeaders; id.Enabled {
+		identity := &proxy.IdentityHeaders{ClientIP: id.ClientIP, Country: id.Country, ASN: id.ASN, Subject: cfg.Auth.IdentityHeader}
+		if id.Signing.Format != "" {
+			var headers []string
+			for _, name := range []string{id.ClientIP, id.Country, id.ASN, cfg.Auth.IdentityHeader} {
+				if name != "" && (name != cfg.Auth.IdentityHeader || cfg.Auth.Enabled) {
+					headers = append(headers, name)
+				}
+			}
+			signer, err := signing.NewIdentitySigner(signing.IdentityOptions{
+				Headers: headers,
+				Format:  id.Signing.Format,
+				Key:     []byte(id.Signing.Key),
+				KeyID:   id.Signing.KeyID,
+				Header:  id.Signing.Header,
+				TTL:     id.Signing.TTL,
+			})
+			if err != nil {
+				logger.WithError(err).Fatalf("Failed to create identity signer")
+			}
+			identity.Signer = signer
+		}
+		proxyCfg.Identity = identity
+	}
+	if cfg.Tap.Enabled {
+		tapper := tap.New(tap.Options{
+			Dir:           cfg.Tap.Dir,
+			MaxDuration:   cfg.Tap.MaxDuration,
+			MaxBodyBytes:  cfg.Tap.MaxBodyBytes,
+			RedactHeaders: cfg.Tap.RedactHeaders,
+			RedactQuery:   cfg.Tap.RedactQuery,
+		}, logger)
+		proxyCfg.Tapper = tapper
+		adminServer.RegisterTap(tapper)
+	}
+	if cfg.UnderAttack.Enabled {
+		underAttackClient := redisClient(cfg.Redis)
+		defer underAttackClient.Close()
+
+		var schedule []underattack.Window
+		for _, window := range cfg.UnderAttack.Schedule {
+			schedule = append(schedule, underattack.Window{Start: window.Start, End: window.End})
+		}
+		mode := underattack.New(underattack.Options{
+			AlwaysOn:              cfg.UnderAttack.Active,
+			Schedule:              schedule,
+			TightenFactor:         cfg.UnderAttack.TightenFactor,
+			Challenge:             cfg.UnderAttack.Challenge,
+			AutoRequestsPerSecond: cfg.UnderAttack.Auto.RequestsPerSecond,
+			AutoBlocksPerSecond:   cfg.UnderAttack.Auto.BlocksPerSecond,
+			AutoDuration:          cfg.UnderAttack.Auto.Duration,
+		}, underAttackClient, logger)
+		go mode.Run(ctx)
+		proxyCfg.UnderAttack = mode
+		if adminServer != nil {
+			adminServer.RegisterUnderAttack(mode)
+		}
+	}
+	var idempotencyClient redis.UniversalClient
+	defer func() {
+		if idempotencyClient != nil {
+			idempotencyClient.Close()
 		}
 	}()
+	// newRoutes creates the routes of the main proxy or a profile
+	newRoutes := func(routeCfgs []config.RouteConfig) []proxy.Route {
+		var routes []proxy.Route
+		for _, routeCfg := range routeCfgs {
+			route := proxy.Route{
+				Name:       routeCfg.Name,
+				PathPrefix: routeCfg.PathPrefix,
+				Methods:    routeCfg.Methods,
+				SkipAuthz:  routeCfg.SkipAuthz,
+				SkipAuth:   routeCfg.SkipAuth,
+
+				RequestsPerMinute: routeCfg.RequestsPerMinute,
+				Preflight:         routeCfg.Preflight,
+				Tag:               routeCfg.Tag,
+				PerEndpoint:       routeCfg.PerEndpoint,
+				Streaming:         routeCfg.Streaming,
+				Body: proxy.BodyPolicy{
+					Buffer:         routeCfg.Body.Mode == "buffer",
+					MaxBufferBytes: routeCfg.Body.MaxBufferBytes,
+					Timeout:        routeCfg.Body.Timeout,
+					MinRate:        routeCfg.Body.MinUploadRate,
+					Grace:          routeCfg.Body.UploadGrace,
+				},
+			}
+			signer, err := newSigner(ctx, routeCfg.Signing)
+			if err != nil {
+				logger.WithError(err).WithField("route", routeCfg.Name).Fatalf("Failed to create request signer")
+			}
+			route.Signer = signer
+			if i := routeCfg.Idempotency; i.Enabled {
+				if idempotencyClient == nil {
+					idempotencyClient = redisClient(cfg.Redis)
+				}
+				route.Idempotency = idempotency.New(idempotency.Options{
+					Route:        routeCfg.Name,
+					Mode:         i.Mode,
+					Window:       i.Window,
+					PendingTTL:   i.PendingTTL,
+					Methods:      i.Methods,
+					Required:     i.Required,
+					MaxBodyBytes: i.MaxBodyBytes,
+					Recorder:     metrics,
+				}, idempotencyClient, logger)
+			}
+			for _, pluginCfg := range routeCfg.Plugins {
+				p, err := plugin.New(pluginCfg.Name, pluginCfg.Config)
+				if err != nil {
+					logger.WithError(err).WithField("route", routeCfg.Name).Fatalf("Failed to create plugin")
+				}
+				route.Plugins = append(route.Plugins, p)
+			}
+			routes = append(routes, route)
+		}
+		return routes
+	}
+	proxyCfg.Routes = newRoutes(cfg.Routes)
+	var metricsServer *http.Server
+	if m := cfg.Metrics; m.Enabled {
+		if m.ListenAddr == "" {
+			proxyCfg.MetricsPath = m.Path
+			proxyCfg.MetricsHandler = promhttp.Handler()
+		} else {
+			mux := http.NewServeMux()
+			mux.Handle(m.Path, promhttp.Handler())
+			metricsServer = &http.Server{Addr: m.ListenAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		}
+	}
+	server := proxy.NewServer(proxyCfg, rateLimiter, metrics)
+	// Profiles share every protection of the main proxy, with their own
+	// listener, upstream, limits and routes
+	profileServers := make([]*proxy.Server, len(cfg.Profiles))
+	for i, profile := range cfg.Profiles {
+		profileCfg := proxyCfg
+		profileCfg.ListenAddr = profile.ListenAddr
+		profileCfg.TargetURL = profile.TargetURL
+		profileCfg.Upstream = nil
+		if len(profile.Targets) > 0 {
+			targets := make([]*url.URL, 0, len(profile.Targets))
+			for _, target := range profile.Targets {
+				u, _ := url.Parse(target) // validated with the config
+				targets = append(targets, u)
+			}
+			profileCfg.Upstream = upstream.NewPool(upstream.Options{SlowStart: cfg.Proxy.SlowStart}, targets)
+		}
+		profileCfg.KeyStrategy = proxy.KeyStrategy{Kind: profile.KeyStrategy, Name: profile.KeyName}
+		profileCfg.KeyNamespace = "profile:" + profile.Name + ":"
+		profileCfg.Routes = newRoutes(profile.Routes)
+		if c := cfg.Proxy.ConditionalCache; c.TTL > 0 {
+			profileCfg.ConditionalCache = proxy.NewConditionalCache(c.TTL, c.MaxEntries)
+		}
+		// Metrics are scraped from the main proxy only.
+		profileCfg.MetricsPath, profileCfg.MetricsHandler = "", nil
+		profileServers[i] = proxy.NewServer(profileCfg, profileLimiters[i], metrics)
+	}
+	if adminServer != nil {
+		adminServer.RegisterDiagnostics(server, historyStore, instanceName())
+		if historyStore != nil {
+			adminServer.RegisterHistory(historyStore)
+		}
+		adminServer.RegisterBlocks(rateLimiter, historyWriter)
+		if cfg.Proxy.CircuitBreaker.Enabled {
+			adminServer.RegisterBreakers(server)
+		}
+	}
+	if cfg.Proxy.UpstreamTransport.Prewarm.Conns > 0 {
+		go server.Prewarm(ctx)
+		for _, profileServer := range profileServers {
+			go profileServer.Prewarm(ctx)
+		}
+	}
+	if cfg.Settings.Enabled {
+		settingsClient := redisClient(cfg.Redis)
+		defer settingsClient.Close()
+
+		routeNames := make([]string, 0, len(cfg.Routes))
+		for _, routeCfg := range cfg.Routes {
+			routeNames = append(routeNames, routeCfg.Name)
+		}
+		for _, profile := range cfg.Profiles {
+			for _, routeCfg := range profile.Routes {
+				routeNames = append(routeNames, routeCfg.Name)
+			}
+		}
+		settingsStore := settings.New(settings.Options{
+			Instance:     instanceName(),
+			Routes:       routeNames,
+			PollInterval: cfg.Settings.PollInterval,
+		}, settingsClient, logger)
+		// Settings that are not set fall back to the configuration file
+		settingsStore.OnChange(func(s settings.Snapshot) {
+			requestsPerMinute, blockDuration := s.RequestsPerMinute, s.BlockDuration
+			if requestsPerMinute == 0 {
+				requestsPerMinute = cfg.RateLimit.RequestsPerMinute
+			}
+			if blockDuration == 0 {
+				blockDuration = cfg.RateLimit.BlockDuration
+			}
+			rateLimiter.SetLimits(requestsPerMinute, blockDuration)
+			server.SetRouteLimits(s.Routes)
+			for _, profileServer := range profileServers {
+				profileServer.SetRouteLimits(s.Routes)
+			}
+		})
+		go settingsStore.Run(ctx)
+		if adminServer != nil {
+			adminServer.RegisterSettings(settingsStore)
+		}
+	}
+
+	upgrader, err := upgrade.New(upgrade.Options{
+		Mode:         cfg.Upgrade.Mode,
+		ReadyTimeout: cfg.Upgrade.ReadyTimeout,
+	}, logger)
+	if err != nil {
+		logger.WithError(err).Fatalf("Failed to create upgrader")
+	}
+	// upgradeBinary starts the new binary and drains this one once it serves
+	upgradeBinary := func(context.Context) error {
+		logger.Info("Upgrading binary")
+		if err := upgrader.Upgrade(); err != nil {
+			return err
+		}
+		stop()
+		return nil
+	}
+
+	if cfg.Fleet.Enabled {
+		fleetClient := redisClient(cfg.Redis)
+		defer fleetClient.Close()
+
+		registry := fleet.New(fleet.Options{
+			Instance:          instanceName(),
+			Version:           version,
+			ConfigHash:        cfg.Hash(),
+			HeartbeatInterval: cfg.Fleet.HeartbeatInterval,
+		}, fleetClient, logger)
+		if cfg.Upgrade.Enabled {
+			registry.Handle(fleet.CommandUpgrade, upgradeBinary)
+		}
+		registry.Handle(fleet.CommandReload, func(ctx context.Context) error {
+			allow, deny, err := loadIPLists()
+			if err != nil {
+				return err
+			}
+			if err := ipLists.Replace(allow, deny); err != nil {
+				return err
+			}
+			logger.WithFields(logrus.Fields{"allow": len(allow), "deny": len(deny)}).Warn("IP lists reloaded from the configuration")
+			return nil
+		})
+		go registry.Run(ctx)
+		if adminServer != nil {
+			adminServer.RegisterFleet(registry)
+		}
+	}
+
+	var certs []tls.Certificate
+	if tlsCfg := cfg.Server.TLS; tlsCfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to load TLS certificate")
+		}
+		certs = []tls.Certificate{cert}
+	}
+	// serve binds a proxy listener, or takes it over from the process being
+	// upgraded, and serves it with the connection limits and TLS of the
+	// server configuration
+	serve := func(name, addr string, server *proxy.Server) {
+		listener, err := upgrader.Listen(name, addr)
+		if err != nil {
+			logger.WithError(err).WithField("listener", name).Fatalf("Failed to listen")
+		}
+		listener = connlimit.NewListener(listener, connlimit.Options{
+			MaxConns:       cfg.Server.Connections.MaxConns,
+			PerIPPerSecond: cfg.Server.Connections.PerIPPerSecond,
+			PerIPBurst:     cfg.Server.Connections.PerIPBurst,
+			Recorder:       metrics,
+		})
+		if tlsCfg := cfg.Server.TLS; certs != nil {
+			listener = tlsguard.NewListener(listener, &tls.Config{
+				Certificates: certs,
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, tlsguard.Options{
+				HandshakesPerSecond: tlsCfg.HandshakesPerSecond,
+				HandshakeBurst:      tlsCfg.HandshakeBurst,
+				MaxFailures:         tlsCfg.MaxFailures,
+				FailureWindow:       tlsCfg.FailureWindow,
+				BlockDuration:       tlsCfg.BlockDuration,
+				Recorder:            metrics,
+			}, logger)
+		}
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logger.WithError(err).WithField("listener", name).Error("Server error")
+			}
+		}()
+	}
+
+	// Bind the listeners, or take them over from the process being upgraded
+	serve("proxy", cfg.Server.ListenAddr, server)
+	for i, profile := range cfg.Profiles {
+		serve("profile:"+profile.Name, profile.ListenAddr, profileServers[i])
+	}
+	if adminServer != nil {
+		adminListener, err := upgrader.Listen("admin", cfg.Admin.ListenAddr)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to listen for the admin API")
+		}
+		go func() {
+			if err := adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				logger.WithError(err).Error("Admin server error")
+			}
+		}()
+	}
+	if metricsServer != nil {
+		metricsListener, err := upgrader.Listen("metrics", cfg.Metrics.ListenAddr)
+		if err != nil {
+			logger.WithError(err).Fatalf("Failed to listen for metrics")
+		}
+		go func() {
+			if err := metricsServer.Serve(metricsListener); err != nil && err != http.ErrServerClosed {
+				logger.WithError(err).Error("Metrics server error")
+			}
+		}()
+	}
+	if err := upgrader.Ready(); err != nil {
+		logger.WithError(err).Error("Failed to tell the previous process that this one is ready")
+	}
+
+	if cfg.Upgrade.Enabled && upgrade.Signal != nil {
+		upgradeSignals := make(chan os.Signal, 1)
+		signal.Notify(upgradeSignals, upgrade.Signal)
+		go func() {
+			for range upgradeSignals {
+				if err := upgradeBinary(ctx); err != nil {
+					logger.WithError(err).Error("Upgrade failed, continuing to serve")
+				}
+			}
+		}()
+	}
 
 	// Wait for interrupt signal
 	<-ctx.Done()
 	logger.Info("Shutting down gracefully...")
 
-	// Shutdown the server
-	if err := server.Shutdown(context.Background()); err != nil {
-		logger.WithError(err).Error("Error during shutdown")
+	// Drain the servers together, requests still in flight at the deadline
+	// are aborted
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.Server.DrainTimeout)
+	defer cancelDrain()
+	var drained sync.WaitGroup
+	for i, s := range append([]*proxy.Server{server}, profileServers...) {
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			if err := s.Shutdown(drainCtx); err != nil {
+				entry := logger.WithError(err)
+				if i > 0 {
+					entry = entry.WithField("profile", cfg.Profiles[i-1].Name)
+				}
+				entry.Error("Error during shutdown")
+			}
+		}()
+	}
+	drained.Wait()
+	if adminServer != nil {
+		if err := adminServer.Shutdown(context.Background()); err != nil {
+			logger.WithError(err).Error("Error shutting down admin server")
+		}
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(context.Background()); err != nil {
+			logger.WithError(err).Error("Error shutting down metrics server")
+		}
+	}
+}
+
+// storeBackend returns the configured store backend name
+func storeBackend(cfg *config.Config) string {
+	if cfg.Store.Backend == "" {
+		return "redis"
+	}
+	return cfg.Store.Backend
+}
+
+// authService maps the protection of an identity service
+func authService(cfg config.AuthServiceConfig) auth.ServiceOptions {
+	return auth.ServiceOptions{
+		Timeout:          cfg.Timeout,
+		StaleTTL:         cfg.StaleTTL,
+		FailureThreshold: cfg.FailureThreshold,
+		OpenDuration:     cfg.OpenDuration,
+	}
+}
+
+// newSigner creates the signer for requests of a route, nil if the route does
+// not sign them.
+func newSigner(ctx context.Context, cfg config.RouteSigningConfig) (signing.Signer, error) {
+	switch cfg.Type {
+	case "sigv4":
+		return signing.NewSigV4(ctx, signing.SigV4Options{
+			Region:          cfg.SigV4.Region,
+			Service:         cfg.SigV4.Service,
+			AccessKeyID:     cfg.SigV4.AccessKeyID,
+			SecretAccessKey: cfg.SigV4.SecretAccessKey,
+			SessionToken:    cfg.SigV4.SessionToken,
+			UnsignedPayload: cfg.SigV4.UnsignedPayload,
+		})
+	case "hmac":
+		return signing.NewHMAC(signing.HMACOptions{
+			Key:             []byte(cfg.HMAC.Key),
+			KeyID:           cfg.HMAC.KeyID,
+			Algorithm:       cfg.HMAC.Algorithm,
+			Header:          cfg.HMAC.Header,
+			TimestampHeader: cfg.HMAC.TimestampHeader,
+		})
+	}
+	return nil, nil
+}
+
+// newWAFProvider creates the provider of a WAF sync target.
+func newWAFProvider(ctx context.Context, cfg config.WAFSyncTargetConfig) (wafsync.Provider, error) {
+	if cfg.Type == "cloudflare" {
+		return wafsync.NewCloudflare(wafsync.CloudflareOptions{
+			AccountID: cfg.Cloudflare.AccountID,
+			ListID:    cfg.Cloudflare.ListID,
+			APIToken:  cfg.Cloudflare.APIToken,
+		}), nil
+	}
+	signer, err := signing.NewSigV4(ctx, signing.SigV4Options{
+		Region:          cfg.AWS.Region,
+		Service:         "wafv2",
+		AccessKeyID:     cfg.AWS.AccessKeyID,
+		SecretAccessKey: cfg.AWS.SecretAccessKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wafsync.NewAWSWAF(wafsync.AWSWAFOptions{
+		Region: cfg.AWS.Region,
+		Scope:  cfg.AWS.Scope,
+		Name:   cfg.AWS.Name,
+		ID:     cfg.AWS.ID,
+		Signer: signer,
+	}), nil
+}
+
+// newDiscovery creates the discovery keeping the targets of pool up to date.
+func newDiscovery(d config.DiscoveryConfig, pool *upstream.Pool, logger *logrus.Logger) (upstream.Discovery, error) {
+	switch d.Type {
+	case "consul":
+		return upstream.NewConsulDiscovery(upstream.ConsulOptions{
+			Address:    d.Consul.Address,
+			Token:      d.Consul.Token,
+			Datacenter: d.Consul.Datacenter,
+			Service:    d.Name,
+			Tag:        d.Consul.Tag,
+			Scheme:     d.Scheme,
+		}, pool, logger), nil
+	case "kubernetes":
+		return upstream.NewKubernetesDiscovery(upstream.KubernetesOptions{
+			APIServer: d.Kubernetes.APIServer,
+			Namespace: d.Kubernetes.Namespace,
+			Service:   d.Name,
+			PortName:  d.Kubernetes.PortName,
+			Scheme:    d.Scheme,
+		}, pool, logger)
+	default:
+		return upstream.NewDNSDiscovery(upstream.DNSOptions{
+			Type:     d.Type,
+			Name:     d.Name,
+			Port:     d.Port,
+			Scheme:   d.Scheme,
+			Interval: d.Interval,
+		}, pool, logger), nil
+	}
+}
+
+// newStore connects to the store backend selected in the configuration
+func newStore(ctx context.Context, cfg *config.Config, metrics *monitor.MetricsCollector, logger *logrus.Logger) (limiter.Store, error) {
+	switch storeBackend(cfg) {
+	case "dynamodb":
+		return limiter.NewDynamoDBStore(ctx, limiter.DynamoDBOptions{
+			Table:       cfg.Store.DynamoDB.Table,
+			Region:      cfg.Store.DynamoDB.Region,
+			Endpoint:    cfg.Store.DynamoDB.Endpoint,
+			MaxRetries:  cfg.Store.DynamoDB.MaxRetries,
+			BaseBackoff: cfg.Store.DynamoDB.BaseBackoff,
+			MaxBackoff:  cfg.Store.DynamoDB.MaxBackoff,
+			Capacity:    metrics,
+		})
+	case "etcd":
+		return limiter.NewEtcdStore(ctx, limiter.EtcdOptions{
+			Endpoints:   cfg.Store.Etcd.Endpoints,
+			Username:    cfg.Store.Etcd.Username,
+			Password:    cfg.Store.Etcd.Password,
+			DialTimeout: cfg.Store.Etcd.DialTimeout,
+			Prefix:      cfg.Store.Etcd.Prefix,
+		})
+	case "memcached":
+		return limiter.NewMemcachedStore(limiter.MemcachedOptions{
+			Servers:      cfg.Store.Memcached.Servers,
+			Timeout:      cfg.Store.Memcached.Timeout,
+			MaxIdleConns: cfg.Store.Memcached.MaxIdleConns,
+		})
+	default:
+		// The client connects lazily and reconnects on its own, startup waits
+		// for it separately
+		store := limiter.NewRedisStore(redisClient(cfg.Redis))
+		if cfg.Store.LocalCache.Enabled {
+			return limiter.NewTieredStore(store, limiter.TieredOptions{
+				Channel:     cfg.Store.LocalCache.Channel,
+				NegativeTTL: cfg.Store.LocalCache.NegativeTTL,
+				MaxEntries:  cfg.Store.LocalCache.MaxEntries,
+				Recorder:    metrics,
+			}, logger), nil
+		}
+		return store, nil
+	}
+}
+
+// redisClient connects the rate limiter store and every other feature
+// keeping state in Redis to a Redis Cluster, to the master of a Sentinel
+// setup or to a single Redis server.
+func redisClient(cfg config.RedisConfig) redis.UniversalClient {
+	if opts := cfg.ToRedisClusterOptions(); opts != nil {
+		return redis.NewClusterClient(opts)
+	}
+	if opts := cfg.ToRedisSentinelOptions(); opts != nil {
+		return redis.NewFailoverClient(opts)
+	}
+	return redis.NewClient(cfg.ToRedisOptions())
+}
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// instanceName identifies this process in shared history, events and the
+// fleet. The pid keeps apart instances that share a hostname, such as
+// processes on one machine or containers on the host network.
+func instanceName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
 	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
 }
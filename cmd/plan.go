@@ -0,0 +1,168 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/knakul853/shielder/internal/config"
+	"github.com/knakul853/shielder/internal/plan"
+)
+
+// runPlan implements the plan command, which replays a decision log against
+// the current and a proposed configuration and reports the requests whose
+// outcome would change.
+func runPlan(args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	oldPath := flags.String("old", "configs/config.yaml", "configuration in effect")
+	newPath := flags.String("new", "", "proposed configuration")
+	traffic := flags.String("traffic", "", "decision log file, or directory of them, to replay; .gz files are decompressed")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *newPath == "" || *traffic == "" {
+		return errors.New("plan needs -new and -traffic")
+	}
+
+	old, err := config.Load(*oldPath)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", *oldPath, err)
+	}
+	proposed, err := config.Load(*newPath)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", *newPath, err)
+	}
+	files, err := trafficFiles(*traffic)
+	if err != nil {
+		return err
+	}
+
+	replay := plan.NewReplay(planPolicy(old), planPolicy(proposed))
+	for _, file := range files {
+		if err := replayFile(file, replay); err != nil {
+			return fmt.Errorf("reading %s: %w", file, err)
+		}
+	}
+	report := replay.Report()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	printPlan(os.Stdout, report)
+	return nil
+}
+
+func planPolicy(cfg *config.Config) plan.Policy {
+	policy := plan.Policy{
+		RequestsPerMinute: cfg.RateLimit.RequestsPerMinute,
+		BlockDuration:     cfg.RateLimit.BlockDuration,
+	}
+	for _, route := range cfg.Routes {
+		policy.Routes = append(policy.Routes, plan.Route{
+			Name:              route.Name,
+			PathPrefix:        route.PathPrefix,
+			Methods:           route.Methods,
+			RequestsPerMinute: route.RequestsPerMinute,
+			Preflight:         route.Preflight,
+			PerEndpoint:       route.PerEndpoint,
+			Tag:               route.Tag,
+		})
+	}
+	return policy
+}
+
+// trafficFiles returns path, or the decision log files in it sorted by name,
+// which sorts them by time. Files still being written are skipped.
+func trafficFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".part") {
+			continue
+		}
+		files = append(files, filepath.Join(path, entry.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func replayFile(path string, replay *plan.Replay) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return plan.Read(r, replay.Add)
+}
+
+func printPlan(w io.Writer, report *plan.Report) {
+	fmt.Fprintf(w, "%d requests, %d decided by routes and rate limits\n", report.Requests, report.Replayed)
+	share := 0.0
+	if report.Replayed > 0 {
+		share = 100 * float64(report.Changed) / float64(report.Replayed)
+	}
+	fmt.Fprintf(w, "%d would change outcome (%.2f%%), %d would match another route\n", report.Changed, share, report.Rerouted)
+	if report.Changed == 0 && report.Rerouted == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nCHANGE\tREQUESTS")
+	for _, transition := range sortedKeys(report.Transitions) {
+		fmt.Fprintf(tw, "%s\t%d\n", transition, report.Transitions[transition])
+	}
+	fmt.Fprintln(tw, "\nROUTE\tREQUESTS\tCHANGED")
+	routes := make([]string, 0, len(report.Routes))
+	for name := range report.Routes {
+		routes = append(routes, name)
+	}
+	sort.Strings(routes)
+	for _, name := range routes {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", name, report.Routes[name].Requests, report.Routes[name].Changed)
+	}
+	if len(report.Keys) > 0 {
+		fmt.Fprintln(tw, "\nCLIENT KEY\tCHANGED")
+		for _, key := range report.Keys {
+			fmt.Fprintf(tw, "%s\t%d\n", key.Key, key.Changed)
+		}
+	}
+	tw.Flush()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
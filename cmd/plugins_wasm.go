@@ -0,0 +1,6 @@
+//go:build shielder_wasm
+
+package main
+
+// Compiles the WebAssembly filter plugin into the binary, see plugin/wasm.
+import _ "github.com/knakul853/shielder/plugin/wasm"
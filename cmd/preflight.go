@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/config"
+	"github.com/knakul853/shielder/internal/geoip"
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/knakul853/shielder/internal/monitor"
+	"github.com/knakul853/shielder/internal/preflight"
+	"github.com/knakul853/shielder/internal/upstream"
+	"github.com/sirupsen/logrus"
+)
+
+// runPreflight implements the preflight command, which checks that the
+// process can start with a configuration: the store and Redis peers answer,
+// upstream targets resolve and accept connections, GeoIP databases and WAF
+// lists load and TLS certificates are valid. It fails if any check does, so
+// that it can run as an init container.
+func runPreflight(args []string) error {
+	flags := flag.NewFlagSet("preflight", flag.ContinueOnError)
+	configPath := flags.String("config", "configs/config.yaml", "configuration to check")
+	timeout := flags.Duration("timeout", 10*time.Second, "time allowed for each check")
+	asJSON := flags.Bool("json", false, "print the results as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	results := []preflight.Result{{Component: "config", Name: *configPath, Passed: true}}
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		results[0].Passed, results[0].Error = false, err.Error()
+	} else {
+		logger := logrus.New()
+		logger.SetOutput(io.Discard)
+		checks, cleanup := preflightChecks(cfg, logger)
+		defer cleanup()
+		results = append(results, preflight.Run(context.Background(), checks, *timeout)...)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		preflight.Print(os.Stdout, results)
+	}
+	if failed := preflight.Failed(results); failed > 0 {
+		return fmt.Errorf("preflight failed: %d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
+
+// preflightChecks returns the checks for the features cfg enables, and a
+// function releasing what they opened.
+func preflightChecks(cfg *config.Config, logger *logrus.Logger) ([]preflight.Check, func()) {
+	var checks []preflight.Check
+	var closers []func() error
+	add := func(component, name string, run func(ctx context.Context) error) {
+		checks = append(checks, preflight.Check{Component: component, Name: name, Run: run})
+	}
+
+	add("store", storeBackend(cfg), func(ctx context.Context) error {
+		store, err := newStore(ctx, cfg, monitor.NewMetricsCollector(), logger)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, store.Close)
+		return store.Ping(ctx)
+	})
+	if storeBackend(cfg) != "redis" && cfg.Redis.Addr != "" {
+		// Features other than the limiter keep their state in Redis.
+		add("redis", cfg.Redis.Addr, func(ctx context.Context) error {
+			client := redisClient(cfg.Redis)
+			defer client.Close()
+			return client.Ping(ctx).Err()
+		})
+	}
+	if cfg.Replication.Enabled {
+		for _, peer := range cfg.Replication.Peers {
+			add("replication", peer.Region, func(ctx context.Context) error {
+				client := redis.NewClient(peer.ToRedisOptions())
+				defer client.Close()
+				return client.Ping(ctx).Err()
+			})
+		}
+	}
+	if cfg.History.Enabled {
+		add("history", cfg.History.Driver, func(ctx context.Context) error {
+			store, err := history.Open(ctx, cfg.History.Driver, cfg.History.DSN)
+			if err != nil {
+				return err
+			}
+			return store.Close()
+		})
+	}
+
+	var targets []string
+	if cfg.Proxy.TargetURL != "" {
+		targets = append(targets, cfg.Proxy.TargetURL)
+	}
+	targets = append(targets, cfg.Proxy.Targets...)
+	for _, profile := range cfg.Profiles {
+		if profile.TargetURL != "" {
+			targets = append(targets, profile.TargetURL)
+		}
+		targets = append(targets, profile.Targets...)
+	}
+	for _, target := range targets {
+		add("upstream", target, func(ctx context.Context) error {
+			return preflight.ProbeTarget(ctx, target)
+		})
+	}
+	if d := cfg.Proxy.Discovery; d.Type != "" {
+		add("discovery", d.Type+" "+d.Name, func(ctx context.Context) error {
+			pool := upstream.NewPool(upstream.Options{}, nil)
+			discovery, err := newDiscovery(d, pool, logger)
+			if err != nil {
+				return err
+			}
+			if err := discovery.Refresh(ctx); err != nil {
+				return err
+			}
+			discovered := pool.Targets()
+			if len(discovered) == 0 {
+				return fmt.Errorf("no targets discovered")
+			}
+			for _, target := range discovered {
+				if err := preflight.ProbeTarget(ctx, target.Address); err != nil {
+					return fmt.Errorf("%s: %w", target.Address, err)
+				}
+			}
+			return nil
+		})
+	}
+
+	if len(cfg.GeoIP.Databases) > 0 {
+		sources := make([]geoip.Source, 0, len(cfg.GeoIP.Databases))
+		for _, db := range cfg.GeoIP.Databases {
+			sources = append(sources, geoip.Source{
+				Name:        db.Name,
+				Type:        db.Type,
+				URL:         strings.ReplaceAll(db.URL, "{licenseKey}", cfg.GeoIP.LicenseKey),
+				ChecksumURL: strings.ReplaceAll(db.ChecksumURL, "{licenseKey}", cfg.GeoIP.LicenseKey),
+				Path:        db.Path,
+			})
+		}
+		// Databases are downloaded once for all checks, which leaves them
+		// on disk for the process started next.
+		var databases *geoip.Manager
+		var loadErr error
+		loaded := make(chan struct{})
+		load := func(ctx context.Context) {
+			defer close(loaded)
+			if databases, loadErr = geoip.New(geoip.Options{Sources: sources}, logger); loadErr == nil {
+				databases.RefreshAll(ctx)
+			}
+		}
+		for i, source := range sources {
+			add("geoip", source.Name, func(ctx context.Context) error {
+				if i == 0 {
+					load(ctx)
+				}
+				select {
+				case <-loaded:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				if loadErr != nil {
+					return loadErr
+				}
+				status := databases.Status()[i]
+				if !status.Loaded {
+					return fmt.Errorf("not loaded: %s", status.LastError)
+				}
+				return nil
+			})
+		}
+	}
+	for _, target := range cfg.WAFSync.Targets {
+		add("waf", target.Name, func(ctx context.Context) error {
+			provider, err := newWAFProvider(ctx, target)
+			if err != nil {
+				return err
+			}
+			_, err = provider.List(ctx)
+			return err
+		})
+	}
+
+	if t := cfg.Server.TLS; t.CertFile != "" {
+		add("tls", t.CertFile, func(context.Context) error {
+			return preflight.CheckCertificate(t.CertFile, t.KeyFile, time.Now())
+		})
+	}
+	for _, target := range []string{cfg.Auth.JWT.JWKSURL, cfg.Auth.Introspection.URL, cfg.Auth.APIKey.LookupURL} {
+		if cfg.Auth.Enabled && target != "" {
+			if u, err := url.Parse(target); err == nil {
+				add("auth", u.Host, func(ctx context.Context) error {
+					return preflight.ProbeTarget(ctx, target)
+				})
+			}
+		}
+	}
+
+	return checks, func() {
+		for _, closer := range closers {
+			closer()
+		}
+	}
+}
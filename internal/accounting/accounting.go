@@ -0,0 +1,170 @@
+// Package accounting aggregates the usage of every API key, such as request
+// counts and bytes transferred, into periodic records that are exported to a
+// Redis stream, a CSV file or a webhook, so that usage-based billing can be
+// driven from what Shielder forwarded.
+package accounting
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Record is the usage of one key during one period.
+type Record struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Instance string    `json:"instance,omitempty"`
+	Key      string    `json:"key"`
+	Requests int64     `json:"requests"`
+	// Errors counts responses with a 4xx or 5xx status.
+	Errors   int64 `json:"errors"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// Sink receives the records of every period.
+type Sink interface {
+	Export(ctx context.Context, records []Record) error
+}
+
+// Recorder counts exports by result: exported, failed or dropped.
+type Recorder interface {
+	IncAccountingExport(result string)
+}
+
+// Options configures an Accountant.
+type Options struct {
+	// Interval is the length of a period, one minute by default.
+	Interval time.Duration
+	// Instance names the instance in records.
+	Instance string
+	// MaxPending bounds the records kept for another attempt after an
+	// export failed, 100000 by default. The oldest records are dropped
+	// beyond it.
+	MaxPending int
+	Recorder   Recorder
+}
+
+type usage struct {
+	requests, errors, bytesIn, bytesOut int64
+}
+
+// Accountant aggregates usage in memory and exports it once per period.
+type Accountant struct {
+	opts   Options
+	sink   Sink
+	logger *logrus.Logger
+
+	mu    sync.Mutex
+	start time.Time
+	usage map[string]*usage
+
+	// pending are records whose export failed, owned by Run.
+	pending []Record
+}
+
+// New creates an accountant exporting to sink. Call Run to start exporting.
+func New(opts Options, sink Sink, logger *logrus.Logger) *Accountant {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 100000
+	}
+	return &Accountant{
+		opts:   opts,
+		sink:   sink,
+		logger: logger,
+		start:  time.Now(),
+		usage:  make(map[string]*usage),
+	}
+}
+
+// Add accounts one request of key.
+func (a *Accountant) Add(key string, status int, bytesIn, bytesOut int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.usage[key]
+	if u == nil {
+		u = &usage{}
+		a.usage[key] = u
+	}
+	u.requests++
+	if status >= 400 {
+		u.errors++
+	}
+	u.bytesIn += bytesIn
+	u.bytesOut += bytesOut
+}
+
+// Run exports the usage of every period until ctx is done. Call Flush once
+// it returned and requests have drained to export the last period.
+func (a *Accountant) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.Flush(ctx)
+		}
+	}
+}
+
+// Flush ends the current period and exports its records, together with
+// those of earlier periods that failed to export. It must not be called
+// concurrently with Run.
+func (a *Accountant) Flush(ctx context.Context) {
+	records := append(a.pending, a.collect(time.Now())...)
+	a.pending = nil
+	if len(records) == 0 {
+		return
+	}
+	if err := a.sink.Export(ctx, records); err != nil {
+		a.logger.WithError(err).WithField("records", len(records)).Warn("Failed to export accounting records, retrying next period")
+		a.record("failed")
+		if dropped := len(records) - a.opts.MaxPending; dropped > 0 {
+			a.logger.WithField("records", dropped).Error("Dropped accounting records that could not be exported")
+			a.record("dropped")
+			records = records[dropped:]
+		}
+		a.pending = records
+		return
+	}
+	a.record("exported")
+}
+
+// collect returns the records of the current period and starts the next.
+func (a *Accountant) collect(now time.Time) []Record {
+	a.mu.Lock()
+	start, current := a.start, a.usage
+	a.start, a.usage = now, make(map[string]*usage, len(current))
+	a.mu.Unlock()
+
+	records := make([]Record, 0, len(current))
+	for key, u := range current {
+		records = append(records, Record{
+			Start:    start,
+			End:      now,
+			Instance: a.opts.Instance,
+			Key:      key,
+			Requests: u.requests,
+			Errors:   u.errors,
+			BytesIn:  u.bytesIn,
+			BytesOut: u.bytesOut,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+func (a *Accountant) record(result string) {
+	if a.opts.Recorder != nil {
+		a.opts.Recorder.IncAccountingExport(result)
+	}
+}
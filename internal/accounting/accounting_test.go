@@ -0,0 +1,133 @@
+package accounting
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+type memorySink struct {
+	fail    bool
+	exports [][]Record
+}
+
+func (s *memorySink) Export(ctx context.Context, records []Record) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	s.exports = append(s.exports, records)
+	return nil
+}
+
+func TestAccountant(t *testing.T) {
+	sink := &memorySink{}
+	a := New(Options{Instance: "edge/1"}, sink, testLogger())
+	a.Add("alice", http.StatusOK, 100, 2000)
+	a.Add("alice", http.StatusTooManyRequests, 50, 10)
+	a.Add("bob", http.StatusInternalServerError, 0, 20)
+	a.Flush(context.Background())
+
+	if len(sink.exports) != 1 || len(sink.exports[0]) != 2 {
+		t.Fatalf("Expected one export of two records, got %+v", sink.exports)
+	}
+	alice := sink.exports[0][0]
+	if alice.Key != "alice" || alice.Requests != 2 || alice.Errors != 1 || alice.BytesIn != 150 || alice.BytesOut != 2010 || alice.Instance != "edge/1" {
+		t.Errorf("Unexpected record %+v", alice)
+	}
+
+	// Empty periods export nothing.
+	a.Flush(context.Background())
+	if len(sink.exports) != 1 {
+		t.Errorf("Expected no export for an empty period, got %d exports", len(sink.exports))
+	}
+
+	// Failed records are exported with the next period.
+	sink.fail = true
+	a.Add("alice", http.StatusOK, 0, 0)
+	a.Flush(context.Background())
+	sink.fail = false
+	a.Add("alice", http.StatusOK, 0, 0)
+	a.Flush(context.Background())
+	if len(sink.exports) != 2 || len(sink.exports[1]) != 2 {
+		t.Fatalf("Expected the failed period to be retried, got %+v", sink.exports)
+	}
+	if !sink.exports[1][0].End.Equal(sink.exports[1][1].Start) {
+		t.Error("Expected consecutive periods")
+	}
+}
+
+func TestAccountantDropsBeyondMaxPending(t *testing.T) {
+	sink := &memorySink{fail: true}
+	a := New(Options{MaxPending: 2}, sink, testLogger())
+	for _, key := range []string{"a", "b", "c"} {
+		a.Add(key, http.StatusOK, 0, 0)
+	}
+	a.Flush(context.Background())
+	if len(a.pending) != 2 || a.pending[0].Key != "b" {
+		t.Errorf("Expected the oldest record to be dropped, got %+v", a.pending)
+	}
+}
+
+func TestCSVSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.csv")
+	sink := &CSVSink{Path: path}
+	for i := 0; i < 2; i++ {
+		if err := sink.Export(context.Background(), []Record{{Key: "alice", Requests: 3}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][3] != "key" || rows[2][3] != "alice" || rows[2][4] != "3" {
+		t.Errorf("Expected a header and two rows, got %v", rows)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got struct {
+		Records []Record `json:"records"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{URL: server.URL, Token: "secret"}
+	if err := sink.Export(context.Background(), []Record{{Key: "alice", Requests: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Records) != 1 || got.Records[0].Requests != 3 {
+		t.Errorf("Unexpected records %+v", got.Records)
+	}
+
+	sink.Token = ""
+	if err := sink.Export(context.Background(), []Record{{Key: "alice"}}); err == nil {
+		t.Error("Expected an error for a rejected export")
+	}
+}
@@ -0,0 +1,138 @@
+package accounting
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// StreamSink appends one entry per record to a Redis stream.
+type StreamSink struct {
+	Client redis.UniversalClient
+	// Stream is shielder:accounting by default.
+	Stream string
+	// MaxLen approximately caps the length of the stream, 0 leaves it
+	// uncapped.
+	MaxLen int64
+}
+
+// Export adds the records to the stream in one pipeline.
+func (s *StreamSink) Export(ctx context.Context, records []Record) error {
+	stream := s.Stream
+	if stream == "" {
+		stream = "shielder:accounting"
+	}
+	pipe := s.Client.Pipeline()
+	for _, rec := range records {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: stream,
+			MaxLen: s.MaxLen,
+			Approx: s.MaxLen > 0,
+			Values: map[string]interface{}{
+				"start":     rec.Start.Unix(),
+				"end":       rec.End.Unix(),
+				"instance":  rec.Instance,
+				"key":       rec.Key,
+				"requests":  rec.Requests,
+				"errors":    rec.Errors,
+				"bytes_in":  rec.BytesIn,
+				"bytes_out": rec.BytesOut,
+			},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// csvHeader names the columns of CSV files.
+var csvHeader = []string{"start", "end", "instance", "key", "requests", "errors", "bytes_in", "bytes_out"}
+
+// CSVSink appends records to a CSV file, writing the header when the file
+// is created. Times are RFC 3339 in UTC.
+type CSVSink struct {
+	Path string
+}
+
+// Export appends the records to the file.
+func (s *CSVSink) Export(ctx context.Context, records []Record) error {
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	if info.Size() == 0 {
+		w.Write(csvHeader)
+	}
+	for _, rec := range records {
+		w.Write([]string{
+			rec.Start.UTC().Format(time.RFC3339),
+			rec.End.UTC().Format(time.RFC3339),
+			rec.Instance,
+			rec.Key,
+			strconv.FormatInt(rec.Requests, 10),
+			strconv.FormatInt(rec.Errors, 10),
+			strconv.FormatInt(rec.BytesIn, 10),
+			strconv.FormatInt(rec.BytesOut, 10),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// WebhookSink posts the records of a period as {"records": [...]}.
+type WebhookSink struct {
+	URL string
+	// Token, when set, is sent as a bearer token.
+	Token  string
+	Client *http.Client
+}
+
+// Export posts the records, any status but 2xx fails the export.
+func (s *WebhookSink) Export(ctx context.Context, records []Record) error {
+	payload, err := json.Marshal(struct {
+		Records []Record `json:"records"`
+	}{records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("accounting webhook: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
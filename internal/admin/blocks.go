@@ -0,0 +1,218 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBlockPageSize = 100
+	maxBlockPageSize     = 1000
+)
+
+type blockRequest struct {
+	// Target is an IP, a CIDR range or any other client key.
+	Target   string `json:"target"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// RegisterBlocks adds endpoints to manage blocks by hand and to inspect the
+// limiter:
+//
+//	GET    /blocks?cursor=&limit=&reason=&minAge=&maxAge=&cidr=&q=
+//	POST   /blocks             {"target", "duration", "reason"} blocks a client
+//	DELETE /blocks/{target}    lifts the block on a client key, IP or network
+//	GET    /blocks/networks    blocked networks
+//	GET    /counters/{key}     counter and block of a client key
+//
+// minAge and maxAge are Go durations, cidr is a CIDR range or a single IP and
+// q searches client keys. Pages are read with SCAN, so the listing stays
+// cheap for block lists of any size. Follow the returned cursor until it is
+// empty; pages may be shorter than limit before the last one.
+//
+// Blocking an IP or a CIDR range applies to the client address whatever the
+// clients are limited by, see limiter.BlockNetwork. Any other target is
+// blocked as a client key. The duration defaults to the block duration of
+// the limiter.
+//
+// Blocks and unblocks are recorded in the history as manual actions of the
+// caller if the history writer is not nil.
+func (s *Server) RegisterBlocks(l *limiter.RateLimiter, h *history.Writer) {
+	s.Handle("GET /blocks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := limiter.BlockFilter{Reason: query.Get("reason"), Search: query.Get("q")}
+
+		limit := defaultBlockPageSize
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, "limit must be a positive number")
+				return
+			}
+			limit = min(n, maxBlockPageSize)
+		}
+		for name, dest := range map[string]*time.Duration{"minAge": &filter.MinAge, "maxAge": &filter.MaxAge} {
+			if v := query.Get(name); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil || d < 0 {
+					writeError(w, http.StatusBadRequest, "invalid "+name)
+					return
+				}
+				*dest = d
+			}
+		}
+		if v := query.Get("cidr"); v != "" {
+			prefix, err := netip.ParsePrefix(v)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(v)
+				if addrErr != nil {
+					writeError(w, http.StatusBadRequest, "invalid cidr")
+					return
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			filter.Prefix = prefix.Masked()
+		}
+
+		page, err := l.ListBlocks(r.Context(), filter, query.Get("cursor"), limit)
+		switch {
+		case errors.Is(err, limiter.ErrInvalidCursor):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, limiter.ErrListUnsupported):
+			writeError(w, http.StatusNotImplemented, err.Error())
+		case err != nil:
+			s.logger.WithError(err).Error("Error listing blocks")
+			writeError(w, http.StatusInternalServerError, "could not list blocks")
+		default:
+			writeJSON(w, http.StatusOK, page)
+		}
+	}))
+
+	s.Handle("POST /blocks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req blockRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Target == "" {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object with a target")
+			return
+		}
+		duration := l.BlockDuration()
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, "duration must be a positive Go duration")
+				return
+			}
+			duration = d
+		}
+		if req.Reason == "" {
+			req.Reason = limiter.ReasonManual
+		}
+
+		ctx := limiter.ContextWithActor(r.Context(), actor(r))
+		var err error
+		if prefix, ok := parseNetwork(req.Target); ok {
+			err = l.BlockNetwork(ctx, prefix, duration, req.Reason)
+		} else {
+			err = l.Block(ctx, req.Target, duration, req.Reason)
+		}
+		if errors.Is(err, limiter.ErrInspectUnsupported) {
+			writeError(w, http.StatusNotImplemented, "the store does not support network blocks")
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error blocking client")
+			writeError(w, http.StatusInternalServerError, "could not block the client")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"target": req.Target, "duration": duration, "by": actor(r)}).Info("Client blocked by hand")
+		if h != nil {
+			h.Record(history.Event{
+				Type:     history.EventManualBlock,
+				Subject:  req.Target,
+				Reason:   req.Reason,
+				Actor:    actor(r),
+				Duration: duration,
+			})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	s.Handle("DELETE /blocks/{target...}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.PathValue("target")
+		ctx := limiter.ContextWithActor(r.Context(), actor(r))
+		var err error
+		if prefix, ok := parseNetwork(target); ok {
+			err = l.UnblockNetwork(ctx, prefix)
+			if errors.Is(err, limiter.ErrInspectUnsupported) {
+				err = nil
+			}
+		}
+		// Single IPs are also client keys when clients are limited by IP.
+		if err == nil {
+			err = l.UnblockIP(ctx, target)
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error unblocking client")
+			writeError(w, http.StatusInternalServerError, "could not unblock the client")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"target": target, "by": actor(r)}).Info("Client unblocked by hand")
+		if h != nil {
+			h.Record(history.Event{
+				Type:    history.EventManualUnblock,
+				Subject: target,
+				Reason:  limiter.ReasonManual,
+				Actor:   actor(r),
+			})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	s.Handle("GET /blocks/networks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		networks, err := l.Networks(r.Context())
+		if errors.Is(err, limiter.ErrInspectUnsupported) {
+			writeError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error listing blocked networks")
+			writeError(w, http.StatusInternalServerError, "could not list blocked networks")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"networks": networks})
+	}))
+
+	s.Handle("GET /counters/{key...}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, err := l.Inspect(r.Context(), r.PathValue("key"))
+		if errors.Is(err, limiter.ErrInspectUnsupported) {
+			writeError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error inspecting client")
+			writeError(w, http.StatusInternalServerError, "could not read limiter state")
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+	}))
+}
+
+// parseNetwork parses a CIDR range or a single IP, which is a network of one.
+func parseNetwork(target string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(target); err == nil {
+		return prefix.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(target); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/sirupsen/logrus"
+)
+
+func TestBlocksRecordManualHistory(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	l := limiter.NewRateLimiter(limiter.NewRedisStore(client), limiter.Config{RequestsPerMinute: 10, BlockDuration: time.Hour}, logger)
+	var events []limiter.Event
+	l.OnEvent(func(ctx context.Context, event limiter.Event) {
+		events = append(events, event)
+	})
+
+	ctx := context.Background()
+	store, err := history.Open(ctx, "sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	writer := history.NewWriter(store, "test", 0, logger)
+
+	s := NewServer("", "admin-token", logger)
+	s.RegisterBlocks(l, writer)
+	do := func(method, path, body string) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, r)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s %s: expected 204, got %d: %s", method, path, rec.Code, rec.Body)
+		}
+	}
+	do(http.MethodPost, "/blocks", `{"target":"203.0.113.0/24","duration":"10m","reason":"scraping"}`)
+	do(http.MethodPost, "/blocks", `{"target":"api-key:abc"}`)
+	do(http.MethodDelete, "/blocks/api-key:abc", "")
+	writer.Close()
+
+	recorded, err := store.Events(ctx, history.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]history.Event)
+	for _, event := range recorded {
+		if event.Actor != "token" {
+			t.Errorf("Expected the caller as the actor, got %+v", event)
+		}
+		got[event.Type+" "+event.Subject] = event
+	}
+	if len(recorded) != 3 {
+		t.Fatalf("Expected three manual events, got %+v", recorded)
+	}
+	if event, ok := got[history.EventManualBlock+" 203.0.113.0/24"]; !ok || event.Reason != "scraping" || event.Duration != 10*time.Minute {
+		t.Errorf("Expected the network block recorded, got %+v", recorded)
+	}
+	if event, ok := got[history.EventManualBlock+" api-key:abc"]; !ok || event.Duration != time.Hour {
+		t.Errorf("Expected the key block recorded with the default duration, got %+v", recorded)
+	}
+	if _, ok := got[history.EventManualUnblock+" api-key:abc"]; !ok {
+		t.Errorf("Expected the unblock recorded, got %+v", recorded)
+	}
+
+	// Limiter events carry the operator, so that their observers can tell
+	// them from the limiter's own decisions.
+	if len(events) != 2 || events[0].Actor != "token" || events[1].Actor != "token" {
+		t.Errorf("Expected limiter events attributed to the caller, got %+v", events)
+	}
+}
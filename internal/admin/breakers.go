@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+// RegisterBreakers adds endpoints to inspect and reset the circuit breakers
+// of the routes:
+//
+//	GET  /breakers                state of every route's circuit
+//	POST /breakers/{route}/reset  close the circuit of a route
+func (s *Server) RegisterBreakers(p *proxy.Server) {
+	s.Handle("GET /breakers", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, p.Breakers())
+	}))
+
+	s.Handle("POST /breakers/{route}/reset", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.PathValue("route")
+		status, ok := p.ResetBreaker(route)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such route")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"route": route, "actor": actor(r)}).Warn("Circuit breaker reset")
+		writeJSON(w, http.StatusOK, status)
+	}))
+}
@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/knakul853/shielder/internal/bypass"
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/sirupsen/logrus"
+)
+
+type issueBypassRequest struct {
+	// Subject is the partner or tool the token is issued to.
+	Subject string `json:"subject"`
+	Reason  string `json:"reason"`
+	// TTL such as "30m", the configured default if empty.
+	TTL string `json:"ttl"`
+}
+
+type issueBypassResponse struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"`
+	Header    string    `json:"header"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// RegisterBypass adds endpoints to mint, list and revoke emergency bypass
+// tokens. Every change is logged with the operator who made it:
+//
+//	POST   /bypass       issue a token for {"subject": ..., "reason": ..., "ttl": "30m"}
+//	GET    /bypass       active tokens and how often they were used
+//	DELETE /bypass/{id}  revoke a token
+//
+// Issued and revoked tokens are recorded in the history as manual actions of
+// the caller if the history writer is not nil.
+func (s *Server) RegisterBypass(m *bypass.Manager, h *history.Writer) {
+	s.Handle("POST /bypass", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req issueBypassRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Subject == "" || req.Reason == "" {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object with a subject and a reason")
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, "ttl must be a positive duration")
+				return
+			}
+		}
+		issuedBy := actor(r)
+		token, claims, err := m.Issue(r.Context(), req.Subject, req.Reason, issuedBy, ttl)
+		if errors.Is(err, bypass.ErrTTL) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error issuing bypass token")
+			writeError(w, http.StatusInternalServerError, "could not issue token")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{
+			"id":        claims.ID,
+			"subject":   claims.Subject,
+			"reason":    claims.Reason,
+			"issued_by": issuedBy,
+			"expires":   time.Unix(claims.ExpiresAt, 0).UTC(),
+		}).Warn("Bypass token issued")
+		if h != nil {
+			h.Record(history.Event{
+				Type:     history.EventBypassIssue,
+				Subject:  claims.Subject,
+				Reason:   "token " + claims.ID + ": " + claims.Reason,
+				Actor:    issuedBy,
+				Duration: time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second,
+			})
+		}
+		writeJSON(w, http.StatusCreated, issueBypassResponse{
+			ID:        claims.ID,
+			Token:     token,
+			Header:    m.Header(),
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+		})
+	}))
+
+	s.Handle("GET /bypass", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grants, err := m.Grants(r.Context())
+		if err != nil {
+			s.logger.WithError(err).Error("Error listing bypass tokens")
+			writeError(w, http.StatusInternalServerError, "could not list tokens")
+			return
+		}
+		if grants == nil {
+			grants = []bypass.Grant{}
+		}
+		writeJSON(w, http.StatusOK, grants)
+	}))
+
+	s.Handle("DELETE /bypass/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		claims, err := m.Revoke(r.Context(), id)
+		if err != nil {
+			s.logger.WithError(err).Error("Error revoking bypass token")
+			writeError(w, http.StatusInternalServerError, "could not revoke token")
+			return
+		}
+		if claims == nil {
+			writeError(w, http.StatusNotFound, "no active token with this id")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"id": id, "subject": claims.Subject, "revoked_by": actor(r)}).Warn("Bypass token revoked")
+		if h != nil {
+			h.Record(history.Event{
+				Type:    history.EventBypassRevoke,
+				Subject: claims.Subject,
+				Reason:  "token " + id,
+				Actor:   actor(r),
+			})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
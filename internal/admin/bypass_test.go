@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/bypass"
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/knakul853/shielder/internal/signedtoken"
+	"github.com/sirupsen/logrus"
+)
+
+func TestBypassRecordsManualHistory(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	m, err := bypass.NewManager(bypass.Options{Keys: []signedtoken.Key{{ID: "k1", Secret: []byte("0123456789abcdef")}}}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	store, err := history.Open(ctx, "sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	writer := history.NewWriter(store, "test", 0, logger)
+
+	s := NewServer("", "admin-token", logger)
+	s.RegisterBypass(m, writer)
+	do := func(method, path, body string, want int) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, r)
+		if rec.Code != want {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, path, want, rec.Code, rec.Body)
+		}
+		return rec
+	}
+	var issued issueBypassResponse
+	rec := do(http.MethodPost, "/bypass", `{"subject":"partner-a","reason":"incident 42","ttl":"30m"}`, http.StatusCreated)
+	if err := json.NewDecoder(rec.Body).Decode(&issued); err != nil {
+		t.Fatal(err)
+	}
+	do(http.MethodDelete, "/bypass/"+issued.ID, "", http.StatusNoContent)
+	do(http.MethodDelete, "/bypass/"+issued.ID, "", http.StatusNotFound)
+	writer.Close()
+
+	recorded, err := store.Events(ctx, history.Query{Subject: "partner-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]history.Event)
+	for _, event := range recorded {
+		if event.Actor != "token" || !strings.Contains(event.Reason, issued.ID) {
+			t.Errorf("Expected the caller as the actor and the token in the reason, got %+v", event)
+		}
+		got[event.Type] = event
+	}
+	if len(recorded) != 2 {
+		t.Fatalf("Expected the issue and the revocation, got %+v", recorded)
+	}
+	if event, ok := got[history.EventBypassIssue]; !ok || event.Duration != 30*time.Minute || !strings.Contains(event.Reason, "incident 42") {
+		t.Errorf("Expected the issue recorded with its TTL and reason, got %+v", recorded)
+	}
+	if _, ok := got[history.EventBypassRevoke]; !ok {
+		t.Errorf("Expected the revocation recorded, got %+v", recorded)
+	}
+}
@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/knakul853/shielder/internal/clearance"
+	"github.com/sirupsen/logrus"
+)
+
+type issueClearanceRequest struct {
+	// Client is the client key the token is bound to, usually an IP address.
+	Client string `json:"client"`
+	Reason string `json:"reason"`
+}
+
+type issueClearanceResponse struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"`
+	Cookie    string    `json:"cookie"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// RegisterClearance adds endpoints to trust clients manually and to revoke
+// clearance tokens:
+//
+//	POST   /clearance               issue a token for {"client": ..., "reason": ...}
+//	DELETE /clearance/{id}          revoke a single token
+//	POST   /clearance/keys/{id}/revoke  revoke every token signed with a key
+func (s *Server) RegisterClearance(m *clearance.Manager) {
+	s.Handle("POST /clearance", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req issueClearanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Client == "" {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object with a client")
+			return
+		}
+		reason := req.Reason
+		if reason == "" {
+			reason = "manual"
+		}
+		token, claims, err := m.Issue(req.Client, reason)
+		if err != nil {
+			s.logger.WithError(err).Error("Error issuing clearance token")
+			writeError(w, http.StatusInternalServerError, "could not issue token")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"client": req.Client, "id": claims.ID, "reason": reason}).Info("Clearance issued")
+		writeJSON(w, http.StatusCreated, issueClearanceResponse{
+			ID:        claims.ID,
+			Token:     token,
+			Cookie:    m.Cookie(token, claims).String(),
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+		})
+	}))
+
+	s.Handle("DELETE /clearance/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := m.Revoke(r.Context(), id); err != nil {
+			s.logger.WithError(err).Error("Error revoking clearance token")
+			writeError(w, http.StatusInternalServerError, "could not revoke token")
+			return
+		}
+		s.logger.WithField("id", id).Info("Clearance revoked")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	s.Handle("POST /clearance/keys/{id}/revoke", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		err := m.RevokeKey(r.Context(), id)
+		if errors.Is(err, clearance.ErrUnknownKey) {
+			writeError(w, http.StatusNotFound, "unknown key")
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error revoking clearance key")
+			writeError(w, http.StatusInternalServerError, "could not revoke key")
+			return
+		}
+		s.logger.WithField("key", id).Warn("Clearance key revoked")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,60 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/knakul853/shielder/internal/proxy"
+)
+
+// offenseWindow is how far back the offense history of a client reaches.
+const offenseWindow = 30 * 24 * time.Hour
+
+type diagnosisResponse struct {
+	*proxy.Diagnosis
+	// Instance is the instance that answered, counters are shared by all
+	// instances unless the store is local.
+	Instance string `json:"instance"`
+	// Offenses and History are only set when history is enabled.
+	Offenses *int            `json:"offenses,omitempty"`
+	History  []history.Event `json:"history,omitempty"`
+}
+
+// RegisterDiagnostics adds an endpoint that explains why a client is blocked:
+//
+//	GET /diagnose/{client}  counters, limits, block and offense history of a client
+//
+// The history store is optional.
+func (s *Server) RegisterDiagnostics(p *proxy.Server, h *history.Store, instance string) {
+	s.Handle("GET /diagnose/{client}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := r.PathValue("client")
+		diagnosis, err := p.Diagnose(r.Context(), client)
+		if errors.Is(err, limiter.ErrInspectUnsupported) {
+			writeError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error diagnosing client")
+			writeError(w, http.StatusInternalServerError, "could not read limiter state")
+			return
+		}
+
+		resp := diagnosisResponse{Diagnosis: diagnosis, Instance: instance}
+		if h != nil {
+			offenses, err := h.OffenseCount(r.Context(), client, time.Now().Add(-offenseWindow))
+			if err == nil {
+				resp.Offenses = &offenses
+				resp.History, err = h.Events(r.Context(), history.Query{Subject: client, Limit: 20})
+			}
+			if err != nil {
+				s.logger.WithError(err).Error("Error reading block history")
+				writeError(w, http.StatusInternalServerError, "could not read block history")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}))
+}
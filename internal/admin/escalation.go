@@ -0,0 +1,32 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/escalation"
+	"github.com/sirupsen/logrus"
+)
+
+// RegisterEscalation adds an endpoint to lift global blocks placed by
+// escalation before they expire:
+//
+//	DELETE /escalations/{kind}/{subject}  kind is ip or fingerprint
+//
+// The offenses of the subject are forgotten as well. Escalated IPs are also
+// listed with the blocked networks and can be lifted there.
+func (s *Server) RegisterEscalation(e *escalation.Escalator) {
+	s.Handle("DELETE /escalations/{kind}/{subject}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind, subject := r.PathValue("kind"), r.PathValue("subject")
+		if kind != escalation.KindIP && kind != escalation.KindFingerprint {
+			writeError(w, http.StatusBadRequest, "kind must be ip or fingerprint")
+			return
+		}
+		if err := e.Lift(r.Context(), kind, subject); err != nil {
+			s.logger.WithError(err).Error("Error lifting escalation")
+			writeError(w, http.StatusInternalServerError, "could not lift escalation")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"kind": kind, "subject": subject, "lifted_by": actor(r)}).Warn("Escalation lifted")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
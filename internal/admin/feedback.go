@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/knakul853/shielder/internal/feedback"
+)
+
+type falsePositiveRequest struct {
+	// Client is the client key that was wrongly limited, usually an IP.
+	Client string   `json:"client"`
+	Rules  []string `json:"rules"`
+	Route  string   `json:"route"`
+	Note   string   `json:"note"`
+	// Unblock overrides whether the client is unblocked, which defaults to
+	// the configured behavior.
+	Unblock *bool `json:"unblock"`
+}
+
+// RegisterFeedback adds endpoints to report false positives and to see which
+// rules cause them:
+//
+//	POST /false-positives            report {"client": ..., "rules": [...], "note": ..., "unblock": ...}
+//	GET  /false-positives?limit=     recent cases, newest first
+//	GET  /tuning/false-positives     false positive count per rule
+func (s *Server) RegisterFeedback(c *feedback.Collector) {
+	s.Handle("POST /false-positives", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req falsePositiveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Client == "" {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object with a client")
+			return
+		}
+		unblock := c.AutoUnblock()
+		if req.Unblock != nil {
+			unblock = *req.Unblock
+		}
+		fp := feedback.Case{
+			Client: req.Client,
+			Rules:  req.Rules,
+			Route:  req.Route,
+			Note:   req.Note,
+			Source: feedback.SourceAPI,
+		}
+		fp.Actor = actor(r)
+		fp, err := c.Report(r.Context(), fp, unblock)
+		if err != nil {
+			s.logger.WithError(err).Error("Error recording false positive")
+			writeError(w, http.StatusInternalServerError, "could not record false positive")
+			return
+		}
+		writeJSON(w, http.StatusCreated, fp)
+	}))
+
+	s.Handle("GET /false-positives", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		cases, err := c.Cases(r.Context(), limit)
+		if err != nil {
+			s.logger.WithError(err).Error("Error reading false positives")
+			writeError(w, http.StatusInternalServerError, "could not read false positives")
+			return
+		}
+		writeJSON(w, http.StatusOK, cases)
+	}))
+
+	s.Handle("GET /tuning/false-positives", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules, err := c.Rules(r.Context())
+		if err != nil {
+			s.logger.WithError(err).Error("Error reading false positive counts")
+			writeError(w, http.StatusInternalServerError, "could not read false positive counts")
+			return
+		}
+		writeJSON(w, http.StatusOK, rules)
+	}))
+}
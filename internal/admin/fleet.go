@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/fleet"
+	"github.com/sirupsen/logrus"
+)
+
+type commandRequest struct {
+	Command string `json:"command"`
+}
+
+type broadcastResponse struct {
+	Command   string   `json:"command"`
+	Instances []string `json:"instances"`
+}
+
+// RegisterFleet adds endpoints to inspect the fleet and to target commands
+// at single instances or all of them:
+//
+//	GET  /fleet/instances                 registered instances and config drift
+//	POST /fleet/instances/{id}/commands   queue {"command": "upgrade"} for an instance
+//	POST /fleet/commands                  queue {"command": "reload"} for every instance
+//
+// Commands run with the next heartbeat of their instance. reload only reads
+// the IP lists again, other configuration changes take a restart.
+func (s *Server) RegisterFleet(registry *fleet.Registry) {
+	s.Handle("GET /fleet/instances", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instances, err := registry.Instances(r.Context())
+		if err != nil {
+			s.logger.WithError(err).Error("Error listing instances")
+			writeError(w, http.StatusInternalServerError, "could not read instance registry")
+			return
+		}
+		writeJSON(w, http.StatusOK, instances)
+	}))
+
+	s.Handle("POST /fleet/instances/{id}/commands", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req commandRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object")
+			return
+		}
+		err := registry.Send(r.Context(), r.PathValue("id"), req.Command)
+		switch {
+		case errors.Is(err, fleet.ErrUnknownCommand):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, fleet.ErrUnknownInstance):
+			writeError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			s.logger.WithError(err).Error("Error queueing instance command")
+			writeError(w, http.StatusInternalServerError, "could not queue command")
+		default:
+			writeJSON(w, http.StatusAccepted, req)
+		}
+	}))
+
+	s.Handle("POST /fleet/commands", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req commandRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object")
+			return
+		}
+		ids, err := registry.Broadcast(r.Context(), req.Command)
+		switch {
+		case errors.Is(err, fleet.ErrUnknownCommand):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case err != nil:
+			s.logger.WithError(err).Error("Error queueing fleet command")
+			writeError(w, http.StatusInternalServerError, "could not queue command")
+		default:
+			s.logger.WithFields(logrus.Fields{"command": req.Command, "instances": len(ids), "changed_by": actor(r)}).Warn("Command queued for the fleet")
+			writeJSON(w, http.StatusAccepted, broadcastResponse{Command: req.Command, Instances: ids})
+		}
+	}))
+}
@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/fleet"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFleetReload(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	registry := fleet.New(fleet.Options{Instance: "a", HeartbeatInterval: 10 * time.Millisecond}, client, logger)
+	var reloads atomic.Int32
+	registry.Handle(fleet.CommandReload, func(ctx context.Context) error {
+		reloads.Add(1)
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		registry.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	s := NewServer("", "admin-token", logger)
+	s.RegisterFleet(registry)
+	send := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/fleet/commands", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && !mr.Exists("shielder:instance:a") {
+		time.Sleep(5 * time.Millisecond)
+	}
+	rec := send(`{"command":"reload"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp broadcastResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Command != fleet.CommandReload || len(resp.Instances) != 1 || resp.Instances[0] != "a" {
+		t.Errorf("Expected reload queued for instance a, got %+v", resp)
+	}
+	for time.Now().Before(deadline) && reloads.Load() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := reloads.Load(); n != 1 {
+		t.Errorf("Expected the instance to reload once, got %d", n)
+	}
+
+	if rec := send(`{"command":"format"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown command to be rejected, got %d", rec.Code)
+	}
+}
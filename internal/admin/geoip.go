@@ -0,0 +1,42 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+
+	"github.com/knakul853/shielder/internal/geoip"
+)
+
+// RegisterGeoIP adds endpoints to inspect and refresh the GeoIP and
+// reputation databases:
+//
+//	GET  /geoip/databases          age, freshness and last error of every database
+//	POST /geoip/databases/refresh  download all databases now
+func (s *Server) RegisterGeoIP(m *geoip.Manager) {
+	s.Handle("GET /geoip/databases", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.Status())
+	}))
+
+	s.Handle("POST /geoip/databases/refresh", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Downloads can take longer than the caller waits, so they are not
+		// tied to the request.
+		m.RefreshAll(context.WithoutCancel(r.Context()))
+		writeJSON(w, http.StatusOK, m.Status())
+	}))
+}
+
+// RegisterGeoIPLookup adds an endpoint that shows where an address is
+// located, after overrides, to check corrections before relying on them:
+//
+//	GET /geoip/lookup?ip=
+func (s *Server) RegisterGeoIPLookup(l *geoip.Locator) {
+	s.Handle("GET /geoip/lookup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid ip")
+			return
+		}
+		writeJSON(w, http.StatusOK, l.Locate(ip))
+	}))
+}
@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/knakul853/shielder/internal/history"
+)
+
+const (
+	defaultHistoryPageSize = 100
+	maxHistoryPageSize     = 1000
+)
+
+// RegisterHistory adds endpoints to read the block history:
+//
+//	GET /history?subject=&type=&window=&limit=   events, newest first
+//	GET /history/offenders?window=&limit=        subjects blocked most often
+//
+// window is a Go duration reaching back from now. Events are not limited in
+// time unless it is set, offenders are counted over the offense window of
+// /diagnose.
+func (s *Server) RegisterHistory(h *history.Store) {
+	s.Handle("GET /history", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, window, ok := historyParams(w, r, 0)
+		if !ok {
+			return
+		}
+		q := history.Query{Subject: query.Get("subject"), Type: query.Get("type"), Limit: limit}
+		if window > 0 {
+			q.Since = time.Now().Add(-window)
+		}
+		events, err := h.Events(r.Context(), q)
+		if err != nil {
+			s.logger.WithError(err).Error("Error reading block history")
+			writeError(w, http.StatusInternalServerError, "could not read block history")
+			return
+		}
+		if events == nil {
+			events = []history.Event{}
+		}
+		writeJSON(w, http.StatusOK, events)
+	}))
+
+	s.Handle("GET /history/offenders", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, window, ok := historyParams(w, r, offenseWindow)
+		if !ok {
+			return
+		}
+		offenders, err := h.TopOffenders(r.Context(), time.Now().Add(-window), limit)
+		if err != nil {
+			s.logger.WithError(err).Error("Error reading top offenders")
+			writeError(w, http.StatusInternalServerError, "could not read block history")
+			return
+		}
+		if offenders == nil {
+			offenders = []history.Offender{}
+		}
+		writeJSON(w, http.StatusOK, offenders)
+	}))
+}
+
+// historyParams parses the limit and window query parameters, answering 400
+// when they are invalid.
+func historyParams(w http.ResponseWriter, r *http.Request, window time.Duration) (int, time.Duration, bool) {
+	query := r.URL.Query()
+	limit := defaultHistoryPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive number")
+			return 0, 0, false
+		}
+		limit = min(n, maxHistoryPageSize)
+	}
+	if v := query.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid window")
+			return 0, 0, false
+		}
+		window = d
+	}
+	return limit, window, true
+}
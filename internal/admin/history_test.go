@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/sirupsen/logrus"
+)
+
+func TestHistoryEndpoints(t *testing.T) {
+	ctx := context.Background()
+	store, err := history.Open(ctx, "sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	now := time.Now()
+	for _, event := range []history.Event{
+		{Type: history.EventBlock, Subject: "10.0.0.1", Reason: "rate_limit_exceeded", CreatedAt: now.Add(-48 * time.Hour)},
+		{Type: history.EventBlock, Subject: "10.0.0.1", Reason: "rate_limit_exceeded", CreatedAt: now.Add(-time.Hour)},
+		{Type: history.EventUnblock, Subject: "10.0.0.1", Actor: "admin", CreatedAt: now.Add(-30 * time.Minute)},
+		{Type: history.EventBlock, Subject: "10.0.0.1", Reason: "rate_limit_exceeded", CreatedAt: now.Add(-time.Minute)},
+		{Type: history.EventManualBlock, Subject: "10.0.0.2", Reason: "manual", CreatedAt: now.Add(-2 * time.Minute)},
+	} {
+		if err := store.Record(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s := NewServer("", "admin-token", logger)
+	s.RegisterHistory(store)
+	get := func(path string, wantCode int, v any) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, r)
+		if rec.Code != wantCode {
+			t.Fatalf("GET %s: expected %d, got %d: %s", path, wantCode, rec.Code, rec.Body)
+		}
+		if v != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+		}
+	}
+
+	var events []history.Event
+	get("/history?subject=10.0.0.1&type=block&window=24h", http.StatusOK, &events)
+	if len(events) != 2 || !events[0].CreatedAt.After(events[1].CreatedAt) {
+		t.Errorf("Expected the 2 recent blocks of 10.0.0.1, newest first, got %+v", events)
+	}
+	get("/history?subject=10.0.0.1&limit=1", http.StatusOK, &events)
+	if len(events) != 1 || events[0].Type != history.EventBlock {
+		t.Errorf("Expected the latest block only, got %+v", events)
+	}
+	get("/history?subject=10.0.0.9", http.StatusOK, &events)
+	if events == nil || len(events) != 0 {
+		t.Errorf("Expected an empty list, got %+v", events)
+	}
+
+	var offenders []history.Offender
+	get("/history/offenders", http.StatusOK, &offenders)
+	if len(offenders) != 2 || offenders[0].Subject != "10.0.0.1" || offenders[0].Blocks != 3 || offenders[1].Blocks != 1 {
+		t.Errorf("Expected 10.0.0.1 with 3 blocks before 10.0.0.2, got %+v", offenders)
+	}
+	get("/history/offenders?window=10m&limit=1", http.StatusOK, &offenders)
+	if len(offenders) != 1 || offenders[0].Subject != "10.0.0.1" || offenders[0].Blocks != 1 {
+		t.Errorf("Expected 10.0.0.1 with 1 block in the last 10 minutes, got %+v", offenders)
+	}
+
+	get("/history?limit=0", http.StatusBadRequest, nil)
+	get("/history/offenders?window=soon", http.StatusBadRequest, nil)
+}
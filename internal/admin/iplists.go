@@ -0,0 +1,65 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/iplist"
+	"github.com/sirupsen/logrus"
+)
+
+type ipListsBody struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// RegisterIPLists adds endpoints to change the static IP lists of this
+// instance at runtime:
+//
+//	GET  /ip-lists         lists in effect
+//	PUT  /ip-lists         replace with {"allow": ["10.0.0.0/8"], "deny": ["192.0.2.1"]}
+//	POST /ip-lists/reload  read the lists from the configuration file again
+//
+// Lists replaced with PUT last until the next reload or restart. reload
+// returns the lists of the configuration file.
+func (s *Server) RegisterIPLists(lists *iplist.Lists, reload func() (allow, deny []string, err error)) {
+	s.Handle("GET /ip-lists", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allow, deny := lists.Entries()
+		writeJSON(w, http.StatusOK, ipListsBody{Allow: allow, Deny: deny})
+	}))
+
+	s.Handle("PUT /ip-lists", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ipListsBody
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object")
+			return
+		}
+		if err := lists.Replace(req.Allow, req.Deny); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.logIPLists(r, lists, "IP lists replaced via admin API")
+		allow, deny := lists.Entries()
+		writeJSON(w, http.StatusOK, ipListsBody{Allow: allow, Deny: deny})
+	}))
+
+	s.Handle("POST /ip-lists/reload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allow, deny, err := reload()
+		if err == nil {
+			err = lists.Replace(allow, deny)
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error reloading IP lists")
+			writeError(w, http.StatusInternalServerError, "could not reload IP lists: "+err.Error())
+			return
+		}
+		s.logIPLists(r, lists, "IP lists reloaded from the configuration")
+		allow, deny = lists.Entries()
+		writeJSON(w, http.StatusOK, ipListsBody{Allow: allow, Deny: deny})
+	}))
+}
+
+func (s *Server) logIPLists(r *http.Request, lists *iplist.Lists, msg string) {
+	allow, deny := lists.Entries()
+	s.logger.WithFields(logrus.Fields{"allow": len(allow), "deny": len(deny), "changed_by": actor(r)}).Warn(msg)
+}
@@ -0,0 +1,339 @@
+package admin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Roles of admin API callers. Viewers may only read.
+const (
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+const (
+	sessionCookie = "shielder_admin_session"
+	loginCookie   = "shielder_admin_login"
+	loginTimeout  = 10 * time.Minute
+)
+
+// Identity is the authenticated caller of the admin API.
+type Identity struct {
+	Subject string    `json:"subject"`
+	Email   string    `json:"email,omitempty"`
+	Role    string    `json:"role"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the caller of an admin request.
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// actor names the caller of an admin request for logs and audit records.
+func actor(r *http.Request) string {
+	identity := IdentityFromContext(r.Context())
+	switch {
+	case identity == nil:
+		return ""
+	case identity.Email != "":
+		return identity.Email
+	}
+	return identity.Subject
+}
+
+// OIDCOptions configures the OpenID Connect login.
+type OIDCOptions struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the externally reachable URL of /auth/callback.
+	RedirectURL string
+	// Scopes are requested in addition to openid.
+	Scopes []string
+	// GroupsClaim names the ID token claim listing the user's groups.
+	GroupsClaim string
+	// Members of AdminGroups get the admin role, members of ViewerGroups the
+	// viewer role. Users in neither are refused.
+	AdminGroups  []string
+	ViewerGroups []string
+	// SessionSecret signs session cookies and must be shared by all
+	// instances behind the same address.
+	SessionSecret string
+	SessionTTL    time.Duration
+	SecureCookie  bool
+}
+
+type oidcLogin struct {
+	opts     OIDCOptions
+	verifier *oidc.IDTokenVerifier
+	oauth    oauth2.Config
+}
+
+// loginState is kept in a signed cookie between login and callback.
+type loginState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	ReturnTo string    `json:"returnTo"`
+	Expires  time.Time `json:"expires"`
+}
+
+// EnableOIDC lets operators log in with an OpenID Connect provider instead of
+// presenting the admin token. It discovers the provider and adds:
+//
+//	GET  /auth/login     redirect to the provider, ?returnTo=/path afterwards
+//	GET  /auth/callback  provider redirect target, sets the session cookie
+//	POST /auth/logout    clear the session cookie
+//	GET  /auth/me        identity of the caller
+//
+// The admin token keeps working and grants the admin role.
+func (s *Server) EnableOIDC(ctx context.Context, opts OIDCOptions) error {
+	if opts.SessionSecret == "" {
+		return errors.New("oidc: session secret is required")
+	}
+	if opts.GroupsClaim == "" {
+		opts.GroupsClaim = "groups"
+	}
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = 8 * time.Hour
+	}
+	provider, err := oidc.NewProvider(ctx, opts.Issuer)
+	if err != nil {
+		return err
+	}
+	login := &oidcLogin{
+		opts:     opts,
+		verifier: provider.Verifier(&oidc.Config{ClientID: opts.ClientID}),
+		oauth: oauth2.Config{
+			ClientID:     opts.ClientID,
+			ClientSecret: opts.ClientSecret,
+			RedirectURL:  opts.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, opts.Scopes...),
+		},
+	}
+	s.oidc = login
+
+	s.Handle("GET /auth/login", http.HandlerFunc(login.start))
+	s.Handle("GET /auth/callback", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login.callback(w, r, s.logger)
+	}))
+	s.Handle("POST /auth/logout", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, login.cookie(sessionCookie, "", -1))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	s.Handle("GET /auth/me", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, IdentityFromContext(r.Context()))
+	}))
+	return nil
+}
+
+// public reports whether r belongs to the login flow itself.
+func (l *oidcLogin) public(r *http.Request) bool {
+	return r.Method == http.MethodGet && (r.URL.Path == "/auth/login" || r.URL.Path == "/auth/callback")
+}
+
+func (l *oidcLogin) start(w http.ResponseWriter, r *http.Request) {
+	returnTo := r.URL.Query().Get("returnTo")
+	// Only local paths, so that the login cannot be used as an open redirect.
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		returnTo = "/auth/me"
+	}
+	state := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		ReturnTo: returnTo,
+		Expires:  time.Now().Add(loginTimeout),
+	}
+	value, err := l.seal(state)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "could not start login")
+		return
+	}
+	http.SetCookie(w, l.cookie(loginCookie, value, int(loginTimeout.Seconds())))
+	http.Redirect(w, r, l.oauth.AuthCodeURL(state.State, oidc.Nonce(state.Nonce)), http.StatusFound)
+}
+
+func (l *oidcLogin) callback(w http.ResponseWriter, r *http.Request, logger *logrus.Logger) {
+	var state loginState
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil || l.open(cookie.Value, &state) != nil || time.Now().After(state.Expires) ||
+		!hmac.Equal([]byte(state.State), []byte(r.URL.Query().Get("state"))) {
+		writeError(w, http.StatusBadRequest, "invalid or expired login, start again")
+		return
+	}
+	http.SetCookie(w, l.cookie(loginCookie, "", -1))
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		writeError(w, http.StatusUnauthorized, "login failed: "+msg)
+		return
+	}
+
+	token, err := l.oauth.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		logger.WithError(err).Warn("Error exchanging OIDC authorization code")
+		writeError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+	rawID, ok := token.Extra("id_token").(string)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "login failed: no id token")
+		return
+	}
+	idToken, err := l.verifier.Verify(r.Context(), rawID)
+	if err != nil || idToken.Nonce != state.Nonce {
+		logger.WithError(err).Warn("Invalid OIDC id token")
+		writeError(w, http.StatusUnauthorized, "login failed: invalid id token")
+		return
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		writeError(w, http.StatusUnauthorized, "login failed: invalid claims")
+		return
+	}
+	email, _ := claims["email"].(string)
+	role := l.role(claims[l.opts.GroupsClaim])
+	if role == "" {
+		logger.WithFields(logrus.Fields{"subject": idToken.Subject, "email": email}).Warn("Refused admin login without a mapped group")
+		writeError(w, http.StatusForbidden, "not a member of an admin or viewer group")
+		return
+	}
+
+	identity := Identity{
+		Subject: idToken.Subject,
+		Email:   email,
+		Role:    role,
+		Expires: time.Now().Add(l.opts.SessionTTL).UTC(),
+	}
+	value, err := l.seal(identity)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "could not create session")
+		return
+	}
+	http.SetCookie(w, l.cookie(sessionCookie, value, int(l.opts.SessionTTL.Seconds())))
+	logger.WithFields(logrus.Fields{"subject": identity.Subject, "email": email, "role": role}).Info("Admin logged in")
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+}
+
+// role maps the groups claim to a role, preferring admin.
+func (l *oidcLogin) role(claim any) string {
+	var groups []string
+	switch v := claim.(type) {
+	case string:
+		groups = []string{v}
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	role := ""
+	for _, group := range groups {
+		for _, g := range l.opts.AdminGroups {
+			if g == group {
+				return RoleAdmin
+			}
+		}
+		for _, g := range l.opts.ViewerGroups {
+			if g == group {
+				role = RoleViewer
+			}
+		}
+	}
+	return role
+}
+
+// session returns the identity carried by the session cookie of r, if any.
+func (l *oidcLogin) session(r *http.Request) *Identity {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var identity Identity
+	if l.open(cookie.Value, &identity) != nil || time.Now().After(identity.Expires) {
+		return nil
+	}
+	return &identity
+}
+
+func (l *oidcLogin) cookie(name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   l.opts.SecureCookie,
+		// The provider redirects back with a top-level navigation, which Lax
+		// cookies survive, and so does the redirect on to returnTo. They are
+		// not sent along with cross-site POSTs, see also crossSite.
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// crossSite reports whether the browser says r comes from another site.
+// Requests changing something are refused then, so that other sites cannot
+// act on behalf of a logged in operator even where Lax cookies are sent.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err != nil || u.Host != r.Host
+	}
+	return false
+}
+
+// seal encodes v as payload.signature, both base64url.
+func (l *oidcLogin) seal(v any) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + l.sign(encoded), nil
+}
+
+func (l *oidcLogin) open(value string, v any) error {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(l.sign(encoded))) {
+		return errors.New("invalid signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func (l *oidcLogin) sign(encoded string) string {
+	mac := hmac.New(sha256.New, []byte(l.opts.SessionSecret))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,353 @@
+package admin
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testProvider is an OpenID Connect provider that issues an ID token with
+// the claims set on it for any authorization code.
+type testProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.idToken(t),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProvider) idToken(t *testing.T) string {
+	claims := map[string]any{
+		"iss": p.URL,
+		"aud": "shielder",
+		"sub": "user-1",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	encode := func(v any) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newOIDCServer(t *testing.T, p *testProvider) *Server {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s := NewServer("", "admin-token", logger)
+	err := s.EnableOIDC(context.Background(), OIDCOptions{
+		Issuer:        p.URL,
+		ClientID:      "shielder",
+		ClientSecret:  "secret",
+		RedirectURL:   "https://shielder.example/auth/callback",
+		AdminGroups:   []string{"sre"},
+		ViewerGroups:  []string{"support"},
+		SessionSecret: "session-secret",
+	})
+	if err != nil {
+		t.Fatalf("EnableOIDC failed: %v", err)
+	}
+	s.Handle("GET /blocks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.Handle("POST /blocks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	return s
+}
+
+func serve(s *Server, r *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, cookie := range cookies {
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// startLogin starts a login and returns the login cookie and the state and
+// nonce sent to the provider.
+func startLogin(t *testing.T, s *Server, returnTo string) (*http.Cookie, string, string) {
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/auth/login?returnTo="+url.QueryEscape(returnTo), nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, got %d", rec.Code)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := responseCookie(rec, loginCookie)
+	if cookie == nil {
+		t.Fatal("Expected a login cookie")
+	}
+	return cookie, location.Query().Get("state"), location.Query().Get("nonce")
+}
+
+func callback(s *Server, cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+	return serve(s, httptest.NewRequest(http.MethodGet, "/auth/callback?code=code&state="+url.QueryEscape(state), nil), cookie)
+}
+
+func TestOIDCGroupsMapToRoles(t *testing.T) {
+	p := newTestProvider(t)
+	s := newOIDCServer(t, p)
+
+	tests := []struct {
+		name   string
+		groups any
+		role   string
+	}{
+		{"admin group", []string{"support", "sre"}, RoleAdmin},
+		{"viewer group", []string{"support"}, RoleViewer},
+		{"single group as a string", "sre", RoleAdmin},
+		{"no mapped group", []string{"sales"}, ""},
+		{"no groups", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cookie, state, nonce := startLogin(t, s, "/blocks")
+			p.claims = map[string]any{"nonce": nonce, "email": "ops@example.com", "groups": tt.groups}
+			rec := callback(s, cookie, state)
+			if tt.role == "" {
+				if rec.Code != http.StatusForbidden || responseCookie(rec, sessionCookie) != nil {
+					t.Fatalf("Expected the login to be refused, got %d", rec.Code)
+				}
+				return
+			}
+			if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/blocks" {
+				t.Fatalf("Expected a redirect to /blocks, got %d to %q", rec.Code, rec.Header().Get("Location"))
+			}
+			session := responseCookie(rec, sessionCookie)
+			if session == nil {
+				t.Fatal("Expected a session cookie")
+			}
+			rec = serve(s, httptest.NewRequest(http.MethodGet, "/auth/me", nil), session)
+			var identity Identity
+			if err := json.NewDecoder(rec.Body).Decode(&identity); err != nil {
+				t.Fatal(err)
+			}
+			if identity.Role != tt.role || identity.Email != "ops@example.com" || identity.Subject != "user-1" {
+				t.Errorf("Expected role %q, got %+v", tt.role, identity)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsMismatches(t *testing.T) {
+	p := newTestProvider(t)
+	s := newOIDCServer(t, p)
+
+	cookie, state, _ := startLogin(t, s, "/blocks")
+	if rec := callback(s, cookie, state+"x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a state mismatch to be rejected, got %d", rec.Code)
+	}
+	if rec := callback(s, nil, state); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a callback without the login cookie to be rejected, got %d", rec.Code)
+	}
+
+	cookie, state, _ = startLogin(t, s, "/blocks")
+	p.claims = map[string]any{"nonce": "replayed", "groups": []string{"sre"}}
+	if rec := callback(s, cookie, state); rec.Code != http.StatusUnauthorized || responseCookie(rec, sessionCookie) != nil {
+		t.Errorf("Expected a nonce mismatch to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestOIDCSessionCookie(t *testing.T) {
+	s := newOIDCServer(t, newTestProvider(t))
+	me := func(cookie *http.Cookie) int {
+		return serve(s, httptest.NewRequest(http.MethodGet, "/auth/me", nil), cookie).Code
+	}
+	seal := func(identity Identity) *http.Cookie {
+		value, err := s.oidc.seal(identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: sessionCookie, Value: value}
+	}
+
+	valid := seal(Identity{Subject: "user-1", Role: RoleViewer, Expires: time.Now().Add(time.Hour)})
+	if code := me(valid); code != http.StatusOK {
+		t.Fatalf("Expected a valid session to be accepted, got %d", code)
+	}
+
+	// Raising the role in the payload invalidates the signature.
+	encoded, signature, _ := strings.Cut(valid.Value, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+	payload = []byte(strings.Replace(string(payload), RoleViewer, RoleAdmin, 1))
+	tampered := &http.Cookie{Name: sessionCookie, Value: base64.RawURLEncoding.EncodeToString(payload) + "." + signature}
+	if code := me(tampered); code != http.StatusUnauthorized {
+		t.Errorf("Expected a tampered session to be rejected, got %d", code)
+	}
+	if code := me(&http.Cookie{Name: sessionCookie, Value: encoded}); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned session to be rejected, got %d", code)
+	}
+
+	expired := seal(Identity{Subject: "user-1", Role: RoleAdmin, Expires: time.Now().Add(-time.Minute)})
+	if code := me(expired); code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired session to be rejected, got %d", code)
+	}
+}
+
+func TestOIDCViewerIsReadOnly(t *testing.T) {
+	s := newOIDCServer(t, newTestProvider(t))
+	value, err := s.oidc.seal(Identity{Subject: "user-1", Role: RoleViewer, Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &http.Cookie{Name: sessionCookie, Value: value}
+
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, "/blocks", nil), session); rec.Code != http.StatusOK {
+		t.Errorf("Expected a viewer to read blocks, got %d", rec.Code)
+	}
+	if rec := serve(s, httptest.NewRequest(http.MethodPost, "/blocks", nil), session); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused a block, got %d", rec.Code)
+	}
+	if rec := serve(s, httptest.NewRequest(http.MethodPost, "/auth/logout", nil), session); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected a viewer to log out, got %d", rec.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/blocks", nil)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	if rec := serve(s, r); rec.Code != http.StatusCreated {
+		t.Errorf("Expected the admin token to keep working, got %d", rec.Code)
+	}
+}
+
+func TestOIDCCrossSiteRequests(t *testing.T) {
+	p := newTestProvider(t)
+	s := newOIDCServer(t, p)
+	cookie, state, nonce := startLogin(t, s, "/blocks")
+	if cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected a Lax login cookie, got %v", cookie.SameSite)
+	}
+	p.claims = map[string]any{"nonce": nonce, "groups": []string{"sre"}}
+	session := responseCookie(callback(s, cookie, state), sessionCookie)
+	if session == nil {
+		t.Fatal("Expected a session cookie")
+	}
+	// The redirect on to returnTo is a top-level navigation from the
+	// provider, which Strict cookies would not survive.
+	if session.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected a Lax session cookie, got %v", session.SameSite)
+	}
+
+	send := func(method string, header map[string]string) int {
+		r := httptest.NewRequest(method, "/blocks", nil)
+		r.Host = "shielder.example"
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		return serve(s, r, session).Code
+	}
+	if code := send(http.MethodGet, map[string]string{"Sec-Fetch-Site": "cross-site"}); code != http.StatusOK {
+		t.Errorf("Expected cross-site reads to pass, got %d", code)
+	}
+	for _, header := range []map[string]string{
+		{"Sec-Fetch-Site": "cross-site"},
+		{"Sec-Fetch-Site": "same-site"},
+		{"Origin": "https://evil.example"},
+	} {
+		if code := send(http.MethodPost, header); code != http.StatusForbidden {
+			t.Errorf("Expected a cross-site POST with %v to be refused, got %d", header, code)
+		}
+	}
+	same := map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "https://shielder.example"}
+	if code := send(http.MethodPost, same); code != http.StatusCreated {
+		t.Errorf("Expected a same-origin POST to pass, got %d", code)
+	}
+}
+
+func TestOIDCReturnTo(t *testing.T) {
+	s := newOIDCServer(t, newTestProvider(t))
+	tests := []struct {
+		returnTo string
+		want     string
+	}{
+		{"/blocks?limit=10", "/blocks?limit=10"},
+		{"", "/auth/me"},
+		{"https://evil.example/", "/auth/me"},
+		{"//evil.example/", "/auth/me"},
+		{"/\\evil.example/", "/auth/me"},
+		{"blocks", "/auth/me"},
+	}
+	for _, tt := range tests {
+		cookie, _, _ := startLogin(t, s, tt.returnTo)
+		var state loginState
+		if err := s.oidc.open(cookie.Value, &state); err != nil {
+			t.Fatal(err)
+		}
+		if state.ReturnTo != tt.want {
+			t.Errorf("returnTo %q: expected %q, got %q", tt.returnTo, tt.want, state.ReturnTo)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/review"
+	"github.com/sirupsen/logrus"
+)
+
+type resolveReviewRequest struct {
+	// Verdict is block or allow.
+	Verdict string `json:"verdict"`
+}
+
+// RegisterReview adds endpoints to work through the clients suspended
+// pending review. Every verdict is logged with the operator who reached it:
+//
+//	GET  /review             suspended clients, oldest first
+//	POST /review/{client}    {"verdict": "block"} or {"verdict": "allow"}
+func (s *Server) RegisterReview(q *review.Queue) {
+	s.Handle("GET /review", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries, err := q.Pending(r.Context())
+		if err != nil {
+			s.logger.WithError(err).Error("Error listing review queue")
+			writeError(w, http.StatusInternalServerError, "could not list review queue")
+			return
+		}
+		if entries == nil {
+			entries = []review.Entry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}))
+	s.Handle("POST /review/{client...}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req resolveReviewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Verdict != review.VerdictBlock && req.Verdict != review.VerdictAllow) {
+			writeError(w, http.StatusBadRequest, `body must be {"verdict": "block"} or {"verdict": "allow"}`)
+			return
+		}
+		client := r.PathValue("client")
+		err := q.Resolve(r.Context(), client, req.Verdict)
+		if errors.Is(err, review.ErrNotPending) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error resolving review")
+			writeError(w, http.StatusInternalServerError, "could not resolve review")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"client": client, "verdict": req.Verdict, "reviewed_by": actor(r)}).Warn("Suspended client reviewed")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,103 @@
+// Package admin serves the operator API on a separate listen address. Every
+// endpoint requires the configured bearer token, or a session from the
+// OpenID Connect login if it is enabled, see EnableOIDC.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server is the admin HTTP server.
+type Server struct {
+	server *http.Server
+	mux    *http.ServeMux
+	token  string
+	oidc   *oidcLogin
+	logger *logrus.Logger
+}
+
+// NewServer creates an admin server listening on addr. Endpoints are added
+// with Handle and the Register methods before Start is called.
+func NewServer(addr, token string, logger *logrus.Logger) *Server {
+	s := &Server{
+		mux:    http.NewServeMux(),
+		token:  token,
+		logger: logger,
+	}
+	s.server = &http.Server{
+		Addr:    addr,
+		Handler: s.authenticate(s.mux),
+	}
+	return s
+}
+
+// Handle registers handler for pattern, see http.ServeMux for the syntax.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) Start() error {
+	s.logger.WithField("address", s.server.Addr).Info("Starting admin server")
+	return s.server.ListenAndServe()
+}
+
+// Serve serves on l, such as a listener inherited during an upgrade.
+func (s *Server) Serve(l net.Listener) error {
+	s.logger.WithField("address", l.Addr().String()).Info("Starting admin server")
+	return s.server.Serve(l)
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// authenticate rejects requests without the admin bearer token or, with the
+// OIDC login enabled, a valid session. Viewers may only read.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var identity *Identity
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+				identity = &Identity{Subject: "token", Role: RoleAdmin}
+			}
+		} else if s.oidc != nil {
+			if s.oidc.public(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			identity = s.oidc.session(r)
+			// Only sessions ride along with requests other sites make.
+			if identity != nil && r.Method != http.MethodGet && r.Method != http.MethodHead && crossSite(r) {
+				writeError(w, http.StatusForbidden, "cross-site requests are refused")
+				return
+			}
+		}
+		if identity == nil {
+			writeError(w, http.StatusUnauthorized, "missing or invalid admin token")
+			return
+		}
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead || r.URL.Path == "/auth/logout"
+		if identity.Role != RoleAdmin && !readOnly {
+			writeError(w, http.StatusForbidden, "the viewer role is read-only")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
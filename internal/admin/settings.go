@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/knakul853/shielder/internal/settings"
+)
+
+// settingsBody is the JSON form of the settings, with the block duration as
+// a Go duration such as "2h".
+type settingsBody struct {
+	RequestsPerMinute int            `json:"requestsPerMinute,omitempty"`
+	BlockDuration     string         `json:"blockDuration,omitempty"`
+	Routes            map[string]int `json:"routes,omitempty"`
+}
+
+type settingsResponse struct {
+	settingsBody
+	Revision  int64     `json:"revision"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+}
+
+func newSettingsResponse(s settings.Snapshot) settingsResponse {
+	resp := settingsResponse{
+		settingsBody: settingsBody{RequestsPerMinute: s.RequestsPerMinute, Routes: s.Routes},
+		Revision:     s.Revision,
+		UpdatedAt:    s.UpdatedAt,
+		UpdatedBy:    s.UpdatedBy,
+	}
+	if s.BlockDuration > 0 {
+		resp.BlockDuration = s.BlockDuration.String()
+	}
+	return resp
+}
+
+// RegisterSettings adds endpoints to change settings for the whole fleet at
+// runtime. Settings that are left out fall back to the configuration file:
+//
+//	GET /settings  settings in effect on this instance
+//	PUT /settings  replace with {"requestsPerMinute": 100, "blockDuration": "2h", "routes": {"login": 5}}
+func (s *Server) RegisterSettings(store *settings.Store) {
+	s.Handle("GET /settings", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newSettingsResponse(store.Current()))
+	}))
+
+	s.Handle("PUT /settings", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req settingsBody
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object")
+			return
+		}
+		update := settings.Settings{RequestsPerMinute: req.RequestsPerMinute, Routes: req.Routes}
+		if req.BlockDuration != "" {
+			d, err := time.ParseDuration(req.BlockDuration)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid block duration")
+				return
+			}
+			update.BlockDuration = d
+		}
+
+		snapshot, err := store.Update(r.Context(), update)
+		if errors.Is(err, settings.ErrInvalid) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error updating settings")
+			writeError(w, http.StatusInternalServerError, "could not store settings")
+			return
+		}
+		s.logger.WithField("revision", snapshot.Revision).Warn("Settings changed via admin API")
+		writeJSON(w, http.StatusOK, newSettingsResponse(snapshot))
+	}))
+}
@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/knakul853/shielder/internal/tap"
+	"github.com/sirupsen/logrus"
+)
+
+type startTapRequest struct {
+	tap.Filter
+	// Duration is a Go duration such as "10m", capped at the configured
+	// maximum.
+	Duration string `json:"duration"`
+	// File also writes the records to a file on the instance.
+	File bool `json:"file"`
+}
+
+// RegisterTap adds endpoints to capture the traffic of a single client on
+// this instance:
+//
+//	POST   /taps              start a tap for {"clientIP": ...} or {"header": ..., "value": ...}
+//	GET    /taps              list running taps
+//	DELETE /taps/{id}         stop a tap
+//	GET    /taps/{id}/stream  stream captured records as JSON lines
+func (s *Server) RegisterTap(t *tap.Tapper) {
+	s.Handle("POST /taps", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req startTapRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object")
+			return
+		}
+		var d time.Duration
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil || d < 0 {
+				writeError(w, http.StatusBadRequest, "invalid duration")
+				return
+			}
+		}
+		info, err := t.Start(req.Filter, d, req.File)
+		if errors.Is(err, tap.ErrNoFilter) || errors.Is(err, tap.ErrNoDir) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error starting tap")
+			writeError(w, http.StatusInternalServerError, "could not start tap")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"tap": info.ID, "client_ip": req.ClientIP, "header": req.Header}).Info("Tap requested")
+		writeJSON(w, http.StatusCreated, info)
+	}))
+
+	s.Handle("GET /taps", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, t.List())
+	}))
+
+	s.Handle("DELETE /taps/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.Stop(r.PathValue("id")) {
+			writeError(w, http.StatusNotFound, "unknown tap")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	s.Handle("GET /taps/{id}/stream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		records, cancel, ok := t.Subscribe(r.PathValue("id"))
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown tap")
+			return
+		}
+		defer cancel()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case record, ok := <-records:
+				if !ok {
+					return
+				}
+				if err := enc.Encode(record); err != nil {
+					return
+				}
+				rc.Flush()
+			}
+		}
+	}))
+}
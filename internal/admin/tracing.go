@@ -0,0 +1,118 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/knakul853/shielder/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+type debugTokenRequest struct {
+	// TTL such as "15m".
+	TTL string `json:"ttl"`
+}
+
+type debugTokenResponse struct {
+	Token     string    `json:"token"`
+	Header    string    `json:"header"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type debugClientRequest struct {
+	IP  string `json:"ip"`
+	TTL string `json:"ttl"`
+}
+
+// RegisterTracing adds endpoints to trace the protection decisions of
+// requests, see package tracing:
+//
+//	POST   /debug/tokens       {"ttl": "15m"} mints a token for the debug header
+//	GET    /debug/clients      traced IPs
+//	POST   /debug/clients      {"ip": ..., "ttl": "15m"} traces the requests of an IP
+//	DELETE /debug/clients/{ip} stops tracing an IP
+//
+// The TTL defaults to 15 minutes.
+func (s *Server) RegisterTracing(t *tracing.Tracer) {
+	s.Handle("POST /debug/tokens", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req debugTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object")
+			return
+		}
+		ttl, ok := debugTTL(w, req.TTL)
+		if !ok {
+			return
+		}
+		token, expires, err := t.Issue(ttl)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"expires_at": expires, "issued_by": actor(r)}).Info("Debug trace token issued")
+		writeJSON(w, http.StatusCreated, debugTokenResponse{Token: token, Header: t.Header(), ExpiresAt: expires.UTC()})
+	}))
+	s.Handle("GET /debug/clients", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients, err := t.Clients(r.Context())
+		if err != nil {
+			s.logger.WithError(err).Error("Error listing traced clients")
+			writeError(w, http.StatusInternalServerError, "could not list traced clients")
+			return
+		}
+		writeJSON(w, http.StatusOK, clients)
+	}))
+	s.Handle("POST /debug/clients", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req debugClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object with an ip")
+			return
+		}
+		ip, err := netip.ParseAddr(req.IP)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid ip")
+			return
+		}
+		ttl, ok := debugTTL(w, req.TTL)
+		if !ok {
+			return
+		}
+		until, err := t.Trace(r.Context(), ip.String(), ttl)
+		if errors.Is(err, tracing.ErrTTL) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Error tracing client")
+			writeError(w, http.StatusInternalServerError, "could not trace client")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"ip": ip, "until": until, "traced_by": actor(r)}).Info("Tracing client")
+		writeJSON(w, http.StatusCreated, tracing.Client{IP: ip.String(), Until: until.UTC()})
+	}))
+	s.Handle("DELETE /debug/clients/{ip}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := t.Untrace(r.Context(), r.PathValue("ip")); err != nil {
+			s.logger.WithError(err).Error("Error untracing client")
+			writeError(w, http.StatusInternalServerError, "could not stop tracing client")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// debugTTL parses the TTL of a debug request, writing an error if it is
+// invalid.
+func debugTTL(w http.ResponseWriter, value string) (time.Duration, bool) {
+	if value == "" {
+		return 15 * time.Minute, true
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		writeError(w, http.StatusBadRequest, "ttl must be a positive duration")
+		return 0, false
+	}
+	return ttl, true
+}
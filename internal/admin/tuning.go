@@ -0,0 +1,54 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/tuning"
+	"gopkg.in/yaml.v3"
+)
+
+type routeLimit struct {
+	Name              string `yaml:"name"`
+	RequestsPerMinute int64  `yaml:"requestsPerMinute"`
+}
+
+type recommendedConfig struct {
+	RateLimit struct {
+		RequestsPerMinute int64 `yaml:"requestsPerMinute,omitempty"`
+	} `yaml:"rateLimit"`
+	Routes []routeLimit `yaml:"routes,omitempty"`
+}
+
+// RegisterTuning adds the rate limit recommendation endpoint:
+//
+//	GET /tuning/recommendations              recommendations as JSON
+//	GET /tuning/recommendations?format=yaml  recommendations as a config snippet
+func (s *Server) RegisterTuning(t *tuning.Tuner) {
+	s.Handle("GET /tuning/recommendations", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := t.Recommend(r.Context())
+		if err != nil {
+			s.logger.WithError(err).Error("Error computing rate limit recommendations")
+			writeError(w, http.StatusInternalServerError, "could not compute recommendations")
+			return
+		}
+		if r.URL.Query().Get("format") != "yaml" {
+			writeJSON(w, http.StatusOK, report)
+			return
+		}
+
+		// Requests matching no configured route fall under the global limit.
+		var cfg recommendedConfig
+		for _, rec := range report.Routes {
+			if rec.Route == "default" {
+				cfg.RateLimit.RequestsPerMinute = rec.RequestsPerMinute
+				continue
+			}
+			cfg.Routes = append(cfg.Routes, routeLimit{Name: rec.Route, RequestsPerMinute: rec.RequestsPerMinute})
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		if !report.Ready {
+			w.Write([]byte("# Observation period not complete yet, recommendations may be inaccurate\n"))
+		}
+		yaml.NewEncoder(w).Encode(cfg)
+	}))
+}
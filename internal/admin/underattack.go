@@ -0,0 +1,65 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/knakul853/shielder/internal/underattack"
+	"github.com/sirupsen/logrus"
+)
+
+type activateRequest struct {
+	Reason string `json:"reason"`
+	// Duration is a Go duration such as "30m", empty keeps the mode on until
+	// it is deactivated.
+	Duration string `json:"duration"`
+}
+
+// RegisterUnderAttack adds endpoints to inspect and switch under attack mode
+// for the whole fleet:
+//
+//	GET    /under-attack  current state
+//	PUT    /under-attack  activate with {"reason": ..., "duration": "30m"}
+//	DELETE /under-attack  deactivate
+func (s *Server) RegisterUnderAttack(m *underattack.Mode) {
+	s.Handle("GET /under-attack", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.Status())
+	}))
+
+	s.Handle("PUT /under-attack", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req activateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a JSON object")
+			return
+		}
+		var d time.Duration
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil || d < 0 {
+				writeError(w, http.StatusBadRequest, "invalid duration")
+				return
+			}
+		}
+		if req.Reason == "" {
+			req.Reason = "manual"
+		}
+		if err := m.Activate(r.Context(), req.Reason, d); err != nil {
+			s.logger.WithError(err).Error("Error activating under attack mode")
+			writeError(w, http.StatusInternalServerError, "could not activate under attack mode")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"reason": req.Reason, "duration": d}).Warn("Under attack mode activated")
+		writeJSON(w, http.StatusOK, m.Status())
+	}))
+
+	s.Handle("DELETE /under-attack", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Deactivate(r.Context()); err != nil {
+			s.logger.WithError(err).Error("Error deactivating under attack mode")
+			writeError(w, http.StatusInternalServerError, "could not deactivate under attack mode")
+			return
+		}
+		s.logger.Warn("Under attack mode deactivated")
+		writeJSON(w, http.StatusOK, m.Status())
+	}))
+}
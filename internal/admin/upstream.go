@@ -0,0 +1,17 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/upstream"
+)
+
+// RegisterUpstream adds an endpoint that shows the upstream targets, their
+// health and their current traffic share:
+//
+//	GET /upstream/targets
+func (s *Server) RegisterUpstream(p *upstream.Pool) {
+	s.Handle("GET /upstream/targets", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, p.Targets())
+	}))
+}
@@ -0,0 +1,302 @@
+// Package anomaly learns per-route traffic baselines and flags routes whose
+// request rate or error ratio deviates strongly from them, catching attacks
+// that stay below static per-client limits.
+//
+// Baselines are exponentially weighted moving averages of the request rate,
+// its variance, and the error ratio. They are kept in Redis so that the whole
+// fleet learns, and survives restarts, together. With Seasonal set, a
+// separate baseline is kept for every hour of the day.
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of anomalies.
+const (
+	KindRate       = "rate"
+	KindErrorRatio = "error_ratio"
+)
+
+// Anomaly describes a route whose traffic deviated from its baseline.
+type Anomaly struct {
+	Route string
+	Kind  string
+	// Observed and Expected are requests per second for KindRate and
+	// error ratios for KindErrorRatio.
+	Observed float64
+	Expected float64
+	Time     time.Time
+}
+
+// Handler is called for every detected anomaly.
+type Handler func(ctx context.Context, anomaly Anomaly)
+
+// Recorder receives detected anomalies as metrics.
+type Recorder interface {
+	IncAnomaly(route, kind string)
+}
+
+// Options configures the analyzer.
+type Options struct {
+	// Interval is the length of an observation window.
+	Interval time.Duration
+	// Alpha is the EWMA smoothing factor, higher values adapt faster.
+	Alpha float64
+	// Seasonal keeps a separate baseline per hour of the day.
+	Seasonal bool
+	// MinSamples is the number of windows a baseline needs before it is
+	// used to flag anomalies.
+	MinSamples int
+	// RateThreshold is how many standard deviations above the baseline a
+	// request rate has to be to count as an anomaly.
+	RateThreshold float64
+	// ErrorRatioThreshold is how far the share of 4xx and 5xx responses has
+	// to rise above the baseline to count as an anomaly.
+	ErrorRatioThreshold float64
+	// MinRate ignores windows with fewer requests per second, where ratios
+	// and deviations are mostly noise.
+	MinRate float64
+	// TightenFactor scales the rate limits of an anomalous route for
+	// TightenDuration. A factor of 1 or more disables tightening.
+	TightenFactor   float64
+	TightenDuration time.Duration
+
+	Recorder Recorder
+}
+
+// counts are the observations of one route in the current window.
+type counts struct {
+	requests int64
+	errors   int64
+}
+
+// Analyzer collects per-route observations and compares each window
+// against the learned baselines.
+type Analyzer struct {
+	opts     Options
+	client   redis.UniversalClient
+	logger   *logrus.Logger
+	handlers []Handler
+
+	mu        sync.Mutex
+	window    map[string]*counts
+	tightened map[string]time.Time
+}
+
+// New creates an Analyzer that keeps its baselines in Redis.
+func New(opts Options, client redis.UniversalClient, logger *logrus.Logger) *Analyzer {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	if opts.Alpha <= 0 || opts.Alpha >= 1 {
+		opts.Alpha = 0.05
+	}
+	if opts.MinSamples <= 0 {
+		opts.MinSamples = 60
+	}
+	if opts.RateThreshold <= 0 {
+		opts.RateThreshold = 4
+	}
+	if opts.ErrorRatioThreshold <= 0 {
+		opts.ErrorRatioThreshold = 0.25
+	}
+	if opts.TightenDuration <= 0 {
+		opts.TightenDuration = 10 * time.Minute
+	}
+	return &Analyzer{
+		opts:      opts,
+		client:    client,
+		logger:    logger,
+		window:    make(map[string]*counts),
+		tightened: make(map[string]time.Time),
+	}
+}
+
+// OnAnomaly registers a handler that is notified of detected anomalies.
+// Handlers must be registered before Run is called.
+func (a *Analyzer) OnAnomaly(handler Handler) {
+	a.handlers = append(a.handlers, handler)
+}
+
+// HistoryHandler returns a handler that records anomalies in the block
+// history, with how long their route is tightened as the duration.
+func (a *Analyzer) HistoryHandler(w *history.Writer) Handler {
+	var duration time.Duration
+	if a.opts.TightenFactor > 0 && a.opts.TightenFactor < 1 {
+		duration = a.opts.TightenDuration
+	}
+	return func(ctx context.Context, anomaly Anomaly) {
+		w.Record(history.Event{
+			Type:      history.EventAnomaly,
+			Subject:   "route:" + anomaly.Route,
+			Reason:    fmt.Sprintf("%s %.2f, expected %.2f", anomaly.Kind, anomaly.Observed, anomaly.Expected),
+			Actor:     "anomaly",
+			Duration:  duration,
+			CreatedAt: anomaly.Time,
+		})
+	}
+}
+
+// Observe records a response on route. Statuses of 400 and above count as
+// errors.
+func (a *Analyzer) Observe(route string, status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.window[route]
+	if !ok {
+		c = &counts{}
+		a.window[route] = c
+	}
+	c.requests++
+	if status >= 400 {
+		c.errors++
+	}
+}
+
+// LimitFactor returns the factor the rate limits of route are scaled by,
+// which is below 1 while the route is tightened after an anomaly.
+func (a *Analyzer) LimitFactor(route string) float64 {
+	if a.opts.TightenFactor <= 0 || a.opts.TightenFactor >= 1 {
+		return 1
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if until, ok := a.tightened[route]; ok && time.Now().Before(until) {
+		return a.opts.TightenFactor
+	}
+	return 1
+}
+
+// Run evaluates a window every interval until ctx is done.
+func (a *Analyzer) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// Routes stay in the window once seen, so that quiet windows are
+			// learned as well.
+			a.mu.Lock()
+			window := a.window
+			a.window = make(map[string]*counts, len(window))
+			for route := range window {
+				a.window[route] = &counts{}
+			}
+			a.mu.Unlock()
+
+			for route, c := range window {
+				if err := a.evaluate(ctx, route, c, now); err != nil {
+					a.logger.WithError(err).WithField("route", route).Warn("Error updating traffic baseline")
+				}
+			}
+		}
+	}
+}
+
+// updateScript folds a sample into a baseline hash atomically, so that
+// instances updating the same baseline do not lose each other's samples.
+var updateScript = redis.NewScript(`
+local alpha = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local ratio = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'mean', 'var', 'errors', 'samples')
+local samples = tonumber(b[4]) or 0
+if samples == 0 then
+  redis.call('HSET', KEYS[1], 'mean', tostring(rate), 'var', '0', 'errors', tostring(ratio), 'samples', '1')
+  return 1
+end
+local mean = tonumber(b[1])
+local var = tonumber(b[2])
+local errors = tonumber(b[3])
+local diff = rate - mean
+redis.call('HSET', KEYS[1],
+  'mean', tostring(mean + alpha * diff),
+  'var', tostring((1 - alpha) * (var + alpha * diff * diff)),
+  'errors', tostring(errors + alpha * (ratio - errors)),
+  'samples', tostring(samples + 1))
+return samples + 1
+`)
+
+// evaluate compares a window against the baseline of its route and folds it
+// into the baseline unless it is anomalous, so that an attack does not
+// teach the baseline that attack traffic is normal.
+func (a *Analyzer) evaluate(ctx context.Context, route string, c *counts, now time.Time) error {
+	rate := float64(c.requests) / a.opts.Interval.Seconds()
+	ratio := 0.0
+	if c.requests > 0 {
+		ratio = float64(c.errors) / float64(c.requests)
+	}
+
+	key := a.baselineKey(route, now)
+	values, err := a.client.HMGet(ctx, key, "mean", "var", "errors", "samples").Result()
+	if err != nil {
+		return err
+	}
+	mean, variance, errorRatio, samples := parse(values[0]), parse(values[1]), parse(values[2]), parse(values[3])
+
+	var anomalies []Anomaly
+	if int(samples) >= a.opts.MinSamples && rate >= a.opts.MinRate {
+		// A floor on the deviation keeps perfectly flat baselines from
+		// flagging every small fluctuation.
+		std := math.Max(math.Sqrt(variance), math.Max(0.1*mean, 1/a.opts.Interval.Seconds()))
+		if (rate-mean)/std > a.opts.RateThreshold {
+			anomalies = append(anomalies, Anomaly{Route: route, Kind: KindRate, Observed: rate, Expected: mean, Time: now})
+		}
+		if ratio-errorRatio > a.opts.ErrorRatioThreshold {
+			anomalies = append(anomalies, Anomaly{Route: route, Kind: KindErrorRatio, Observed: ratio, Expected: errorRatio, Time: now})
+		}
+	}
+
+	if len(anomalies) == 0 {
+		return updateScript.Run(ctx, a.client, []string{key}, a.opts.Alpha, rate, ratio).Err()
+	}
+
+	a.mu.Lock()
+	a.tightened[route] = now.Add(a.opts.TightenDuration)
+	a.mu.Unlock()
+	for _, anomaly := range anomalies {
+		a.logger.WithFields(logrus.Fields{
+			"route":    anomaly.Route,
+			"kind":     anomaly.Kind,
+			"observed": anomaly.Observed,
+			"expected": anomaly.Expected,
+		}).Warn("Traffic anomaly detected")
+		if a.opts.Recorder != nil {
+			a.opts.Recorder.IncAnomaly(anomaly.Route, anomaly.Kind)
+		}
+		for _, handler := range a.handlers {
+			handler(ctx, anomaly)
+		}
+	}
+	return nil
+}
+
+func (a *Analyzer) baselineKey(route string, now time.Time) string {
+	if a.opts.Seasonal {
+		return fmt.Sprintf("anomaly:baseline:%s:%02d", route, now.UTC().Hour())
+	}
+	return "anomaly:baseline:" + route
+}
+
+func parse(value interface{}) float64 {
+	s, ok := value.(string)
+	if !ok {
+		return 0
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
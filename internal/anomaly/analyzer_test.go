@@ -0,0 +1,109 @@
+package anomaly
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/history"
+	"github.com/sirupsen/logrus"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests int64
+		errors   int64
+		wantKind string
+	}{
+		{name: "Normal traffic", requests: 110, errors: 6},
+		{name: "Rate spike", requests: 1000, errors: 50, wantKind: KindRate},
+		{name: "Error spike", requests: 100, errors: 60, wantKind: KindErrorRatio},
+		{name: "Quiet route", requests: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			ctx := context.Background()
+
+			a := New(Options{Interval: 10 * time.Second, MinSamples: 20, TightenFactor: 0.5}, client, logrus.New())
+			var got []Anomaly
+			a.OnAnomaly(func(ctx context.Context, anomaly Anomaly) {
+				got = append(got, anomaly)
+			})
+
+			// Learn a baseline of about 10 requests per second with 5% errors.
+			now := time.Now()
+			for i := 0; i < 30; i++ {
+				requests := int64(95 + i%10)
+				if err := a.evaluate(ctx, "api", &counts{requests: requests, errors: requests / 20}, now); err != nil {
+					t.Fatalf("Failed to evaluate window: %v", err)
+				}
+			}
+			if len(got) != 0 {
+				t.Fatalf("Expected no anomalies while learning, got %v", got)
+			}
+
+			if err := a.evaluate(ctx, "api", &counts{requests: tt.requests, errors: tt.errors}, now); err != nil {
+				t.Fatalf("Failed to evaluate window: %v", err)
+			}
+			if tt.wantKind == "" {
+				if len(got) != 0 {
+					t.Errorf("Expected no anomaly, got %v", got)
+				}
+				if factor := a.LimitFactor("api"); factor != 1 {
+					t.Errorf("Expected limit factor 1, got %v", factor)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Kind != tt.wantKind {
+				t.Fatalf("Expected one %s anomaly, got %v", tt.wantKind, got)
+			}
+			if factor := a.LimitFactor("api"); factor != 0.5 {
+				t.Errorf("Expected limit factor 0.5, got %v", factor)
+			}
+		})
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	logger := logrus.New()
+
+	store, err := history.Open(ctx, "sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	writer := history.NewWriter(store, "test", 0, logger)
+
+	a := New(Options{Interval: 10 * time.Second, MinSamples: 5, TightenFactor: 0.5, TightenDuration: time.Minute}, client, logger)
+	a.OnAnomaly(a.HistoryHandler(writer))
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := a.evaluate(ctx, "api", &counts{requests: 100}, now); err != nil {
+			t.Fatalf("Failed to evaluate window: %v", err)
+		}
+	}
+	if err := a.evaluate(ctx, "api", &counts{requests: 1000}, now); err != nil {
+		t.Fatalf("Failed to evaluate window: %v", err)
+	}
+	writer.Close()
+
+	events, err := store.Events(ctx, history.Query{Type: history.EventAnomaly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected one recorded anomaly, got %+v", events)
+	}
+	if got := events[0]; got.Subject != "route:api" || got.Actor != "anomaly" || got.Duration != time.Minute || got.Reason != "rate 100.00, expected 10.00" {
+		t.Errorf("Expected the rate anomaly of route api, got %+v", got)
+	}
+}
@@ -0,0 +1,261 @@
+// Package audit samples a fraction of requests with their full metadata,
+// request and response headers, sizes, timing and Shielder's decision, into
+// compressed batches uploaded to object storage. The batches are an
+// inexpensive long-term corpus for tuning WAF rules and limits against real
+// traffic.
+//
+// Batches are gzipped JSON lines, one record per sampled request, kept in
+// memory until they are full or old enough and then uploaded. Sampling never
+// slows down requests: records are handed to a background writer and dropped
+// when its buffer is full, and batches that fail to upload are dropped too.
+package audit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Record is the metadata of one sampled request.
+type Record struct {
+	Time     time.Time `json:"ts"`
+	Instance string    `json:"instance,omitempty"`
+	ClientIP string    `json:"client_ip"`
+	// Key is the client key the request was limited by.
+	Key   string `json:"key,omitempty"`
+	Route string `json:"route"`
+	// Endpoint is the path template, such as /users/{id}.
+	Endpoint string      `json:"endpoint,omitempty"`
+	Method   string      `json:"method"`
+	Host     string      `json:"host"`
+	Path     string      `json:"path"`
+	Query    string      `json:"query,omitempty"`
+	Proto    string      `json:"proto"`
+	Request  http.Header `json:"request_headers,omitempty"`
+	// RequestBytes is the announced body length, -1 when unknown.
+	RequestBytes  int64       `json:"request_bytes"`
+	Status        int         `json:"status"`
+	Response      http.Header `json:"response_headers,omitempty"`
+	ResponseBytes int64       `json:"response_bytes"`
+	DurationMicro int64       `json:"duration_us"`
+	// Outcome, Rule, Rules and Score are Shielder's decision, see
+	// plugin.Decision.
+	Outcome string   `json:"outcome,omitempty"`
+	Rule    string   `json:"rule,omitempty"`
+	Rules   []string `json:"rules,omitempty"`
+	Score   float64  `json:"score"`
+}
+
+// Uploader receives completed batches, see decisionlog.HTTPUploader.
+type Uploader interface {
+	Upload(ctx context.Context, name string, body io.Reader) error
+}
+
+// Recorder counts records by result: uploaded, dropped when the buffer was
+// full, or failed when their batch could not be uploaded.
+type Recorder interface {
+	IncAuditRecords(result string, n int)
+}
+
+// Options configures the sampler.
+type Options struct {
+	// Rate is the fraction of requests sampled, from 0 to 1.
+	Rate float64
+	// Instance names the instance in records and batch names.
+	Instance string
+	// BatchRecords and BatchAge complete the current batch, 10000 records
+	// and 5 minutes by default.
+	BatchRecords int
+	BatchAge     time.Duration
+	// RedactHeaders are request and response headers whose values are
+	// replaced, Authorization, Proxy-Authorization, Cookie and Set-Cookie
+	// by default.
+	RedactHeaders []string
+	Uploader      Uploader
+	// BufferSize is the number of records queued for the writer, 4096 by
+	// default.
+	BufferSize int
+	Recorder   Recorder
+}
+
+// redacted replaces the values of redacted headers.
+const redacted = "[redacted]"
+
+// Sampler samples requests into batches in the background.
+type Sampler struct {
+	opts    Options
+	logger  *logrus.Logger
+	redact  map[string]bool
+	records chan Record
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	// Owned by the writer goroutine.
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+	count  int
+	opened time.Time
+	seq    int
+}
+
+// New starts the writer of a sampler.
+func New(opts Options, logger *logrus.Logger) *Sampler {
+	if opts.BatchRecords <= 0 {
+		opts.BatchRecords = 10000
+	}
+	if opts.BatchAge <= 0 {
+		opts.BatchAge = 5 * time.Minute
+	}
+	if len(opts.RedactHeaders) == 0 {
+		opts.RedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 4096
+	}
+	s := &Sampler{
+		opts:    opts,
+		logger:  logger,
+		redact:  make(map[string]bool, len(opts.RedactHeaders)),
+		records: make(chan Record, opts.BufferSize),
+		done:    make(chan struct{}),
+	}
+	for _, name := range opts.RedactHeaders {
+		s.redact[http.CanonicalHeaderKey(name)] = true
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Sample reports whether a request is to be sampled.
+func (s *Sampler) Sample() bool {
+	return s.opts.Rate >= 1 || rand.Float64() < s.opts.Rate
+}
+
+// Write queues a record. The headers are copied with redacted values, so
+// that the caller may keep using them. It does not block.
+func (s *Sampler) Write(record Record) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Instance = s.opts.Instance
+	record.Request = s.copyHeader(record.Request)
+	record.Response = s.copyHeader(record.Response)
+	select {
+	case s.records <- record:
+	default:
+		s.record("dropped", 1)
+	}
+}
+
+// Close uploads the queued records.
+func (s *Sampler) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Sampler) copyHeader(h http.Header) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	c := make(http.Header, len(h))
+	for name, values := range h {
+		if s.redact[name] {
+			c[name] = []string{redacted}
+			continue
+		}
+		c[name] = append([]string(nil), values...)
+	}
+	return c
+}
+
+func (s *Sampler) run() {
+	defer s.wg.Done()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case record := <-s.records:
+			s.write(record)
+		case <-tick.C:
+			if s.gz != nil && time.Since(s.opened) >= s.opts.BatchAge {
+				s.complete()
+			}
+		case <-s.done:
+			for {
+				select {
+				case record := <-s.records:
+					s.write(record)
+				default:
+					s.complete()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Sampler) write(record Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		s.record("dropped", 1)
+		return
+	}
+	if s.gz == nil {
+		s.buf.Reset()
+		s.gz = gzip.NewWriter(&s.buf)
+		s.count, s.opened = 0, time.Now()
+	}
+	s.gz.Write(append(line, '\n'))
+	if s.count++; s.count >= s.opts.BatchRecords {
+		s.complete()
+	}
+}
+
+// complete uploads the current batch.
+func (s *Sampler) complete() {
+	if s.gz == nil {
+		return
+	}
+	s.gz.Close()
+	s.gz = nil
+	// The sequence number keeps names unique when batches fill up quickly.
+	s.seq++
+	name := fmt.Sprintf("audit-%s-%06d-%s.jsonl.gz", s.opened.UTC().Format("20060102T150405.000Z"), s.seq%1000000, sanitize(s.opts.Instance))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if err := s.opts.Uploader.Upload(ctx, name, bytes.NewReader(s.buf.Bytes())); err != nil {
+		s.logger.WithError(err).WithFields(logrus.Fields{"batch": name, "records": s.count}).Error("Error uploading audit batch")
+		s.record("failed", s.count)
+		return
+	}
+	s.record("uploaded", s.count)
+}
+
+func (s *Sampler) record(result string, n int) {
+	if s.opts.Recorder != nil {
+		s.opts.Recorder.IncAuditRecords(result, n)
+	}
+}
+
+// sanitize makes an instance name safe for object names.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, name)
+}
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// memoryUploader keeps the records of uploaded batches by name.
+type memoryUploader struct {
+	mu      sync.Mutex
+	batches map[string][]Record
+	err     error
+}
+
+func (u *memoryUploader) Upload(_ context.Context, name string, body io.Reader) error {
+	if u.err != nil {
+		return u.err
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+	var records []Record
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.batches[name] = records
+	return nil
+}
+
+type counts map[string]int
+
+func (c counts) IncAuditRecords(result string, n int) { c[result] += n }
+
+func TestSamplerUploadsBatches(t *testing.T) {
+	uploader := &memoryUploader{batches: map[string][]Record{}}
+	s := New(Options{Rate: 1, Instance: "edge/1", BatchRecords: 3, Uploader: uploader}, testLogger())
+	if !s.Sample() {
+		t.Fatal("Expected a rate of 1 to sample every request")
+	}
+
+	request := http.Header{"Authorization": {"Bearer secret"}, "User-Agent": {"curl/8.0"}}
+	for i := 0; i < 5; i++ {
+		s.Write(Record{ClientIP: "10.0.0.1", Route: "api", Method: http.MethodGet, Path: "/users/1", Request: request, Status: http.StatusOK})
+	}
+	request.Set("User-Agent", "changed")
+	s.Close()
+
+	if len(uploader.batches) != 2 {
+		t.Fatalf("Expected a full batch and the rest on close, got %d batches", len(uploader.batches))
+	}
+	total := 0
+	for name, records := range uploader.batches {
+		if !strings.HasPrefix(name, "audit-") || !strings.HasSuffix(name, "-edge-1.jsonl.gz") {
+			t.Errorf("Unexpected batch name %s", name)
+		}
+		total += len(records)
+		for _, record := range records {
+			if record.Instance != "edge/1" || record.Path != "/users/1" {
+				t.Errorf("Unexpected record %+v", record)
+			}
+			if got := record.Request.Get("Authorization"); got != redacted {
+				t.Errorf("Expected credentials to be redacted, got %q", got)
+			}
+			if got := record.Request.Get("User-Agent"); got != "curl/8.0" {
+				t.Errorf("Expected headers to be copied when written, got %q", got)
+			}
+		}
+	}
+	if total != 5 {
+		t.Errorf("Expected 5 records uploaded, got %d", total)
+	}
+}
+
+func TestSamplerCountsFailedUploads(t *testing.T) {
+	recorded := counts{}
+	uploader := &memoryUploader{err: errors.New("bucket unavailable")}
+	s := New(Options{Rate: 0.5, BatchRecords: 10, Uploader: uploader, Recorder: recorded}, testLogger())
+	for i := 0; i < 4; i++ {
+		s.Write(Record{Route: "api"})
+	}
+	s.Close()
+	if recorded["failed"] != 4 || recorded["uploaded"] != 0 {
+		t.Errorf("Expected the records of the failed batch to be counted, got %v", recorded)
+	}
+
+	if (&Sampler{}).Sample() {
+		t.Error("Expected a rate of 0 to sample nothing")
+	}
+}
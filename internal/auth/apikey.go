@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// APIKeyOptions configures lookups of API keys. The key is sent to LookupURL
+// in the same header it arrived in. The service answers 200 with the subject
+// and scopes of a valid key, and 401, 403 or 404 for an unknown one.
+type APIKeyOptions struct {
+	// Header carries the key, X-API-Key by default.
+	Header    string
+	LookupURL string
+	// TTL is how long a valid key is cached, 5 minutes by default.
+	TTL time.Duration
+	// NegativeTTL is how long an unknown key is cached. Zero does not cache
+	// unknown keys.
+	NegativeTTL time.Duration
+	// Service protects the calls to the lookup service.
+	Service ServiceOptions
+}
+
+type apiKeyResponse struct {
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+}
+
+func (a *Authenticator) callAPIKeyLookup(ctx context.Context, key string) (*Identity, error) {
+	opts := a.opts.APIKey
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.LookupURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(opts.Header, key)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return nil, ErrInvalidCredentials
+	default:
+		return nil, fmt.Errorf("looking up API key: unexpected status %d", resp.StatusCode)
+	}
+	var body apiKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("looking up API key: %w", err)
+	}
+	if body.Subject == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Subject: body.Subject, Method: MethodAPIKey, Scopes: body.Scopes}, nil
+}
@@ -0,0 +1,291 @@
+// Package auth authenticates clients by JWT, OAuth 2.0 token introspection
+// or API key before their requests are forwarded, and passes the resolved
+// identity on to the upstream.
+//
+// Everything that needs a network call is cached in Redis and shared by the
+// fleet: JWKS documents, introspection responses and API key lookups, with
+// separate TTLs for valid and invalid credentials, so that authentication
+// does not add a call to the identity provider to every request. Tokens and
+// keys are only stored as hashes. Calls to the introspection endpoint and
+// the key service go through a circuit breaker each, and valid lookups can
+// outlive their TTL to answer from while the service is down.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Methods by which a client can be authenticated.
+const (
+	MethodJWT           = "jwt"
+	MethodIntrospection = "introspection"
+	MethodAPIKey        = "api_key"
+)
+
+var (
+	// ErrNoCredentials is returned for requests without credentials.
+	ErrNoCredentials = errors.New("auth: no credentials")
+	// ErrInvalidCredentials is returned for credentials that were rejected.
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+)
+
+// Identity is an authenticated client.
+type Identity struct {
+	Subject   string    `json:"subject"`
+	Method    string    `json:"method"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// Recorder receives the outcome of every credential check.
+type Recorder interface {
+	// IncAuthCheck counts a check by method, where the answer came from
+	// (cache, service, stale, circuit or local) and its result (valid,
+	// invalid or error). Stale answers are cached lookups used while the
+	// service fails, circuit errors are calls skipped while its circuit is
+	// open.
+	IncAuthCheck(method, source, result string)
+}
+
+// Options configures the authenticator. At least one method must be set.
+type Options struct {
+	JWT           *JWTOptions
+	Introspection *IntrospectionOptions
+	APIKey        *APIKeyOptions
+
+	// Optional lets requests without credentials through unauthenticated.
+	// Invalid credentials are rejected either way.
+	Optional bool
+	// IdentityHeader carries the subject to the upstream. It is removed
+	// from incoming requests. Empty does not send the subject.
+	IdentityHeader string
+	// Timeout bounds calls to the identity provider, 2 seconds by default.
+	// The services looked up in can have their own.
+	Timeout  time.Duration
+	Client   *http.Client
+	Recorder Recorder
+}
+
+// Authenticator checks the credentials of requests.
+type Authenticator struct {
+	opts   Options
+	cache  redis.UniversalClient
+	logger *logrus.Logger
+	jwt    *jwtVerifier
+
+	introspection, apiKeys *service
+}
+
+// New creates an authenticator that caches lookups in Redis.
+func New(opts Options, cache redis.UniversalClient, logger *logrus.Logger) (*Authenticator, error) {
+	if opts.JWT == nil && opts.Introspection == nil && opts.APIKey == nil {
+		return nil, errors.New("auth: no authentication method configured")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{}
+	}
+	a := &Authenticator{opts: opts, cache: cache, logger: logger}
+	if opts.JWT != nil {
+		a.jwt = newJWTVerifier(a, *opts.JWT)
+	}
+	if opts.Introspection != nil {
+		o := a.opts.Introspection
+		if o.TTL <= 0 {
+			o.TTL = 5 * time.Minute
+		}
+		if o.Service.Timeout <= 0 {
+			o.Service.Timeout = opts.Timeout
+		}
+		a.introspection = &service{
+			method:      MethodIntrospection,
+			kind:        "introspect",
+			ttl:         func(identity *Identity) time.Duration { return positiveTTL(identity, o.TTL) },
+			negativeTTL: o.NegativeTTL,
+			call:        a.callIntrospection,
+			circuit:     newCircuit(MethodIntrospection, o.Service, logger),
+		}
+	}
+	if opts.APIKey != nil {
+		o := a.opts.APIKey
+		if o.Header == "" {
+			o.Header = "X-API-Key"
+		}
+		if o.TTL <= 0 {
+			o.TTL = 5 * time.Minute
+		}
+		if o.Service.Timeout <= 0 {
+			o.Service.Timeout = opts.Timeout
+		}
+		a.apiKeys = &service{
+			method:      MethodAPIKey,
+			kind:        "apikey",
+			ttl:         func(*Identity) time.Duration { return o.TTL },
+			negativeTTL: o.NegativeTTL,
+			call:        a.callAPIKeyLookup,
+			circuit:     newCircuit(MethodAPIKey, o.Service, logger),
+		}
+	}
+	return a, nil
+}
+
+type identityKey struct{}
+
+// FromContext returns the identity of an authenticated request, nil if the
+// request was not authenticated.
+func FromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// ContextWithIdentity attaches identity to ctx.
+func ContextWithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Authenticate checks the credentials of r. Bearer tokens are verified as
+// JWTs when they look like one and JWT is configured, and introspected
+// otherwise. API keys are looked up when no bearer token was sent.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	ctx := r.Context()
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && (a.jwt != nil || a.opts.Introspection != nil) {
+		token = strings.TrimSpace(token)
+		if a.jwt != nil && (a.opts.Introspection == nil || strings.Count(token, ".") == 2) {
+			return a.jwt.verify(ctx, token)
+		}
+		return a.lookupWith(ctx, a.introspection, token)
+	}
+	if a.opts.APIKey != nil {
+		if key := r.Header.Get(a.opts.APIKey.Header); key != "" {
+			return a.lookupWith(ctx, a.apiKeys, key)
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// Middleware rejects requests with invalid credentials with 401, and without
+// credentials unless authentication is optional. Requests are rejected with
+// 503 while the identity provider cannot be reached.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.opts.IdentityHeader != "" {
+			r.Header.Del(a.opts.IdentityHeader)
+		}
+		identity, err := a.Authenticate(r)
+		switch {
+		case errors.Is(err, ErrNoCredentials) && a.opts.Optional:
+			next.ServeHTTP(w, r)
+			return
+		case errors.Is(err, ErrNoCredentials), errors.Is(err, ErrInvalidCredentials):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="shielder"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		case err != nil:
+			a.logger.WithError(err).Error("Error authenticating request")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if a.opts.IdentityHeader != "" {
+			r.Header.Set(a.opts.IdentityHeader, identity.Subject)
+		}
+		next.ServeHTTP(w, r.WithContext(ContextWithIdentity(r.Context(), identity)))
+	})
+}
+
+// lookup is a cached answer of the identity provider. Identity is nil for
+// invalid credentials.
+type lookup struct {
+	Identity *Identity `json:"identity,omitempty"`
+	// FreshUntil is when a valid lookup turns stale, see
+	// ServiceOptions.StaleTTL. Lookups without it are fresh while cached.
+	FreshUntil time.Time `json:"freshUntil,omitempty"`
+}
+
+func (l *lookup) stale(now time.Time) bool {
+	return !l.FreshUntil.IsZero() && now.After(l.FreshUntil)
+}
+
+func cacheKey(kind, secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "auth:" + kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// cached returns the cached lookup of secret. Cache errors are treated as
+// misses, the provider is asked instead.
+func (a *Authenticator) cached(ctx context.Context, kind, secret string) (*lookup, bool) {
+	value, err := a.cache.Get(ctx, cacheKey(kind, secret)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			a.logger.WithError(err).Debug("Error reading auth cache")
+		}
+		return nil, false
+	}
+	var l lookup
+	if err := json.Unmarshal(value, &l); err != nil {
+		return nil, false
+	}
+	return &l, true
+}
+
+func (a *Authenticator) store(ctx context.Context, kind, secret string, l lookup, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	value, err := json.Marshal(l)
+	if err != nil {
+		return
+	}
+	if err := a.cache.Set(ctx, cacheKey(kind, secret), value, ttl).Err(); err != nil {
+		a.logger.WithError(err).Debug("Error writing auth cache")
+	}
+}
+
+// resolve turns a lookup into the result of Authenticate.
+func resolve(l *lookup) (*Identity, error) {
+	if l.Identity == nil {
+		return nil, ErrInvalidCredentials
+	}
+	if !l.Identity.ExpiresAt.IsZero() && time.Now().After(l.Identity.ExpiresAt) {
+		return nil, ErrInvalidCredentials
+	}
+	return l.Identity, nil
+}
+
+func (a *Authenticator) record(method, source string, err error) {
+	if a.opts.Recorder == nil {
+		return
+	}
+	result := "valid"
+	switch {
+	case errors.Is(err, ErrInvalidCredentials):
+		result = "invalid"
+	case err != nil:
+		result = "error"
+	}
+	a.opts.Recorder.IncAuthCheck(method, source, result)
+}
+
+// positiveTTL caps ttl at the expiry of identity.
+func positiveTTL(identity *Identity, ttl time.Duration) time.Duration {
+	if !identity.ExpiresAt.IsZero() {
+		ttl = min(ttl, time.Until(identity.ExpiresAt))
+	}
+	return ttl
+}
+
+// scopes splits a space-separated scope claim.
+func scopes(scope string) []string {
+	return strings.Fields(scope)
+}
@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestAuthenticator(t *testing.T, opts Options) (*Authenticator, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	a, err := New(opts, client, logger)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return a, mr
+}
+
+func request(header, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+	return r
+}
+
+func TestJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: "k1", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	}))
+	defer jwks.Close()
+
+	sign := func(kid string, claims jwt.Claims) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+			(&jose.SignerOptions{}).WithHeader("kid", kid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jwt.Signed(signer).Claims(claims).Claims(jwtClaims{Scope: "read write"}).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := jwt.Claims{Subject: "alice", Issuer: "https://idp", Audience: jwt.Audience{"api"},
+		Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	a, mr := newTestAuthenticator(t, Options{JWT: &JWTOptions{JWKSURL: jwks.URL, Issuer: "https://idp", Audience: []string{"api"}}})
+
+	identity, err := a.Authenticate(request("Authorization", "Bearer "+sign("k1", valid)))
+	if err != nil || identity.Subject != "alice" || len(identity.Scopes) != 2 {
+		t.Fatalf("Expected alice with two scopes, got %+v (%v)", identity, err)
+	}
+	if !mr.Exists(cacheKey("jwks", jwks.URL)) {
+		t.Error("Expected the JWKS document to be cached")
+	}
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	wrongAudience := valid
+	wrongAudience.Audience = jwt.Audience{"other"}
+	for name, token := range map[string]string{
+		"expired":        sign("k1", expired),
+		"wrong audience": sign("k1", wrongAudience),
+		"unknown key":    sign("k2", valid),
+		"garbage":        "not.a.jwt",
+	} {
+		if _, err := a.Authenticate(request("Authorization", "Bearer "+token)); err != ErrInvalidCredentials {
+			t.Errorf("%s: expected invalid credentials, got %v", name, err)
+		}
+	}
+	// The unknown key refreshed the document once, later ones are limited.
+	a.Authenticate(request("Authorization", "Bearer "+sign("k3", valid)))
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected 2 JWKS fetches, got %d", n)
+	}
+
+	// Another instance picks the document up from Redis.
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b, _ := New(a.opts, client, a.logger)
+	if _, err := b.Authenticate(request("Authorization", "Bearer "+sign("k1", valid))); err != nil {
+		t.Fatalf("Expected the token to be valid, got %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected the cached JWKS document to be used, got %d fetches", n)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	var calls atomic.Int32
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if id, secret, _ := r.BasicAuth(); id != "shielder" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.PostFormValue("token") != "good" {
+			json.NewEncoder(w).Encode(map[string]any{"active": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"active": true, "sub": "bob", "scope": "read", "exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	defer idp.Close()
+
+	a, mr := newTestAuthenticator(t, Options{Introspection: &IntrospectionOptions{
+		URL: idp.URL, ClientID: "shielder", ClientSecret: "s3cret", TTL: time.Minute, NegativeTTL: 10 * time.Second,
+	}})
+
+	for range 3 {
+		identity, err := a.Authenticate(request("Authorization", "Bearer good"))
+		if err != nil || identity.Subject != "bob" {
+			t.Fatalf("Expected bob, got %+v (%v)", identity, err)
+		}
+		if _, err := a.Authenticate(request("Authorization", "Bearer bad")); err != ErrInvalidCredentials {
+			t.Fatalf("Expected invalid credentials, got %v", err)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected one call per token, got %d", n)
+	}
+	if ttl := mr.TTL(cacheKey("introspect", "bad")); ttl != 10*time.Second {
+		t.Errorf("Expected the negative TTL, got %v", ttl)
+	}
+
+	mr.FastForward(11 * time.Second)
+	a.Authenticate(request("Authorization", "Bearer bad"))
+	if n := calls.Load(); n != 3 {
+		t.Errorf("Expected the expired negative entry to be looked up again, got %d calls", n)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	var calls atomic.Int32
+	status := http.StatusOK
+	lookupService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch {
+		case status != http.StatusOK:
+			w.WriteHeader(status)
+		case r.Header.Get("X-API-Key") == "key-1":
+			json.NewEncoder(w).Encode(apiKeyResponse{Subject: "tenant-1", Scopes: []string{"read"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer lookupService.Close()
+
+	a, _ := newTestAuthenticator(t, Options{APIKey: &APIKeyOptions{LookupURL: lookupService.URL, NegativeTTL: time.Minute}})
+
+	if _, err := a.Authenticate(request("", "")); err != ErrNoCredentials {
+		t.Errorf("Expected no credentials, got %v", err)
+	}
+	for range 2 {
+		identity, err := a.Authenticate(request("X-API-Key", "key-1"))
+		if err != nil || identity.Subject != "tenant-1" || identity.Method != MethodAPIKey {
+			t.Fatalf("Expected tenant-1, got %+v (%v)", identity, err)
+		}
+		if _, err := a.Authenticate(request("X-API-Key", "unknown")); err != ErrInvalidCredentials {
+			t.Fatalf("Expected invalid credentials, got %v", err)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected one call per key, got %d", n)
+	}
+
+	status = http.StatusInternalServerError
+	if _, err := a.Authenticate(request("X-API-Key", "key-2")); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("Expected a lookup error, got %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	lookupService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "key-1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(apiKeyResponse{Subject: "tenant-1"})
+	}))
+	defer lookupService.Close()
+
+	var seen string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-Shielder-Subject")
+		if identity := FromContext(r.Context()); identity != nil && identity.Subject != seen {
+			t.Errorf("Expected the identity in the context, got %+v", identity)
+		}
+	})
+
+	for _, tc := range []struct {
+		name     string
+		optional bool
+		key      string
+		spoofed  string
+		status   int
+		subject  string
+	}{
+		{name: "valid", key: "key-1", spoofed: "admin", status: http.StatusOK, subject: "tenant-1"},
+		{name: "invalid", key: "key-2", status: http.StatusUnauthorized},
+		{name: "missing", status: http.StatusUnauthorized},
+		{name: "missing optional", optional: true, spoofed: "admin", status: http.StatusOK},
+		{name: "invalid optional", optional: true, key: "key-2", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, _ := newTestAuthenticator(t, Options{
+				APIKey:         &APIKeyOptions{LookupURL: lookupService.URL},
+				Optional:       tc.optional,
+				IdentityHeader: "X-Shielder-Subject",
+			})
+			seen = ""
+			r := request("X-API-Key", tc.key)
+			if tc.key == "" {
+				r.Header.Del("X-API-Key")
+			}
+			if tc.spoofed != "" {
+				r.Header.Set("X-Shielder-Subject", tc.spoofed)
+			}
+			w := httptest.NewRecorder()
+			a.Middleware(next).ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("Expected status %d, got %d", tc.status, w.Code)
+			}
+			if seen != tc.subject {
+				t.Errorf("Expected subject %q upstream, got %q", tc.subject, seen)
+			}
+		})
+	}
+}
+
+func TestServiceOutage(t *testing.T) {
+	var calls atomic.Int32
+	var failing atomic.Bool
+	lookupService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch {
+		case failing.Load():
+			w.WriteHeader(http.StatusBadGateway)
+		case r.Header.Get("X-API-Key") == "key-1":
+			json.NewEncoder(w).Encode(apiKeyResponse{Subject: "tenant-1"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer lookupService.Close()
+
+	a, _ := newTestAuthenticator(t, Options{APIKey: &APIKeyOptions{
+		LookupURL: lookupService.URL,
+		TTL:       20 * time.Millisecond,
+		Service:   ServiceOptions{StaleTTL: time.Hour, FailureThreshold: 2, OpenDuration: 100 * time.Millisecond},
+	}})
+
+	if _, err := a.Authenticate(request("X-API-Key", "key-1")); err != nil {
+		t.Fatalf("Expected key-1 to be valid, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	failing.Store(true)
+
+	// The stale lookup answers while the service fails.
+	if identity, err := a.Authenticate(request("X-API-Key", "key-1")); err != nil || identity.Subject != "tenant-1" {
+		t.Fatalf("Expected the stale lookup, got %+v (%v)", identity, err)
+	}
+	if _, err := a.Authenticate(request("X-API-Key", "key-2")); err == nil || err == ErrInvalidCredentials {
+		t.Fatalf("Expected a lookup error without a cached lookup, got %v", err)
+	}
+
+	// Two failures opened the circuit, the service is left alone.
+	before := calls.Load()
+	if _, err := a.Authenticate(request("X-API-Key", "key-1")); err != nil {
+		t.Errorf("Expected the stale lookup with the circuit open, got %v", err)
+	}
+	if _, err := a.Authenticate(request("X-API-Key", "key-2")); err != errCircuitOpen {
+		t.Errorf("Expected the open circuit, got %v", err)
+	}
+	if n := calls.Load() - before; n != 0 {
+		t.Errorf("Expected no calls while the circuit is open, got %d", n)
+	}
+
+	// After the open duration, a probe closes the circuit again.
+	time.Sleep(120 * time.Millisecond)
+	failing.Store(false)
+	if _, err := a.Authenticate(request("X-API-Key", "key-2")); err != ErrInvalidCredentials {
+		t.Errorf("Expected the probe to reach the service, got %v", err)
+	}
+	if _, err := a.Authenticate(request("X-API-Key", "key-3")); err != ErrInvalidCredentials {
+		t.Errorf("Expected the circuit to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// IntrospectionOptions configures OAuth 2.0 token introspection (RFC 7662)
+// of opaque bearer tokens.
+type IntrospectionOptions struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+	// TTL is how long an active token is cached, capped at its expiry.
+	// 5 minutes by default.
+	TTL time.Duration
+	// NegativeTTL is how long an inactive token is cached. Zero does not
+	// cache inactive tokens.
+	NegativeTTL time.Duration
+	// Service protects the calls to the introspection endpoint.
+	Service ServiceOptions
+}
+
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Subject  string `json:"sub"`
+	Username string `json:"username"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+	Expiry   int64  `json:"exp"`
+}
+
+func (a *Authenticator) callIntrospection(ctx context.Context, token string) (*Identity, error) {
+	opts := a.opts.Introspection
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if opts.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(opts.ClientID), url.QueryEscape(opts.ClientSecret))
+	}
+	resp, err := a.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspecting token: unexpected status %d", resp.StatusCode)
+	}
+	var body introspectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("introspecting token: %w", err)
+	}
+	if !body.Active {
+		return nil, ErrInvalidCredentials
+	}
+	identity := &Identity{Method: MethodIntrospection, Scopes: scopes(body.Scope)}
+	switch {
+	case body.Subject != "":
+		identity.Subject = body.Subject
+	case body.Username != "":
+		identity.Subject = body.Username
+	default:
+		identity.Subject = body.ClientID
+	}
+	if body.Expiry > 0 {
+		identity.ExpiresAt = time.Unix(body.Expiry, 0)
+		if time.Now().After(identity.ExpiresAt) {
+			return nil, ErrInvalidCredentials
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/go-redis/redis/v8"
+)
+
+// JWTOptions configures local verification of JWTs against a JWKS document.
+type JWTOptions struct {
+	JWKSURL  string
+	Issuer   string
+	Audience []string
+	// Algorithms that are accepted, RS256 and ES256 by default.
+	Algorithms []string
+	// JWKSTTL is how long a fetched JWKS document is cached, 1 hour by
+	// default. A token signed with an unknown key refreshes it sooner.
+	JWKSTTL time.Duration
+}
+
+// jwksRefreshInterval limits refreshes triggered by unknown key IDs, so that
+// tokens with made up key IDs cannot flood the identity provider.
+const jwksRefreshInterval = time.Minute
+
+// jwtLeeway is the clock skew tolerated when checking expiry.
+const jwtLeeway = 30 * time.Second
+
+type jwtVerifier struct {
+	a          *Authenticator
+	opts       JWTOptions
+	algorithms []jose.SignatureAlgorithm
+
+	mu        sync.Mutex
+	keys      *jose.JSONWebKeySet
+	checked   time.Time
+	refreshed time.Time
+}
+
+func newJWTVerifier(a *Authenticator, opts JWTOptions) *jwtVerifier {
+	if opts.JWKSTTL <= 0 {
+		opts.JWKSTTL = time.Hour
+	}
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{string(jose.RS256), string(jose.ES256)}
+	}
+	v := &jwtVerifier{a: a, opts: opts}
+	for _, alg := range opts.Algorithms {
+		v.algorithms = append(v.algorithms, jose.SignatureAlgorithm(alg))
+	}
+	return v
+}
+
+type jwtClaims struct {
+	Scope string `json:"scope"`
+}
+
+func (v *jwtVerifier) verify(ctx context.Context, token string) (*Identity, error) {
+	identity, source, err := v.check(ctx, token)
+	v.a.record(MethodJWT, source, err)
+	return identity, err
+}
+
+func (v *jwtVerifier) check(ctx context.Context, token string) (*Identity, string, error) {
+	parsed, err := jwt.ParseSigned(token, v.algorithms)
+	if err != nil || len(parsed.Headers) == 0 {
+		return nil, "local", ErrInvalidCredentials
+	}
+	kid := parsed.Headers[0].KeyID
+
+	source := "cache"
+	keys, fetched, err := v.keySet(ctx, false)
+	if err != nil {
+		return nil, "service", err
+	}
+	if fetched {
+		source = "service"
+	}
+	if len(keys.Key(kid)) == 0 {
+		if keys, fetched, err = v.keySet(ctx, true); err != nil {
+			return nil, "service", err
+		}
+		if fetched {
+			source = "service"
+		}
+	}
+	candidates := keys.Key(kid)
+	if len(candidates) == 0 {
+		return nil, source, ErrInvalidCredentials
+	}
+
+	var claims jwt.Claims
+	var extra jwtClaims
+	if err := parsed.Claims(candidates[0].Public().Key, &claims, &extra); err != nil {
+		return nil, source, ErrInvalidCredentials
+	}
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      v.opts.Issuer,
+		AnyAudience: v.opts.Audience,
+		Time:        time.Now(),
+	}, jwtLeeway)
+	if err != nil || claims.Subject == "" {
+		return nil, source, ErrInvalidCredentials
+	}
+	identity := &Identity{Subject: claims.Subject, Method: MethodJWT, Scopes: scopes(extra.Scope)}
+	if claims.Expiry != nil {
+		identity.ExpiresAt = claims.Expiry.Time()
+	}
+	return identity, source, nil
+}
+
+// keySet returns the JWKS document. The copy held in process is checked
+// against Redis every refresh interval, and the document is fetched when
+// Redis does not have it or force is set and the last forced refresh is long
+// enough ago. If fetching fails the previous document stays in use.
+func (v *jwtVerifier) keySet(ctx context.Context, force bool) (*jose.JSONWebKeySet, bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if force {
+		if now.Sub(v.refreshed) < jwksRefreshInterval {
+			return v.keys, false, nil
+		}
+		v.refreshed = now
+	} else {
+		if v.keys != nil && now.Sub(v.checked) < min(v.opts.JWKSTTL, jwksRefreshInterval) {
+			return v.keys, false, nil
+		}
+		if keys, err := v.cachedKeySet(ctx); err == nil {
+			v.keys, v.checked = keys, now
+			return keys, false, nil
+		}
+	}
+
+	keys, raw, err := v.fetch(ctx)
+	if err != nil {
+		if v.keys != nil {
+			v.a.logger.WithError(err).Warn("Error fetching JWKS, using the previous keys")
+			return v.keys, false, nil
+		}
+		return nil, false, err
+	}
+	if err := v.a.cache.Set(ctx, cacheKey("jwks", v.opts.JWKSURL), raw, v.opts.JWKSTTL).Err(); err != nil {
+		v.a.logger.WithError(err).Debug("Error writing auth cache")
+	}
+	v.keys, v.checked = keys, now
+	return keys, true, nil
+}
+
+func (v *jwtVerifier) cachedKeySet(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	raw, err := v.a.cache.Get(ctx, cacheKey("jwks", v.opts.JWKSURL)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			v.a.logger.WithError(err).Debug("Error reading auth cache")
+		}
+		return nil, err
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+func (v *jwtVerifier) fetch(ctx context.Context) (*jose.JSONWebKeySet, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.a.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.opts.JWKSURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := v.a.opts.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("fetching JWKS: unexpected status %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil, nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+	if len(keys.Keys) == 0 {
+		return nil, nil, errors.New("parsing JWKS: no keys")
+	}
+	return &keys, raw, nil
+}
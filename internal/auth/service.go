@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errCircuitOpen is returned instead of calling a service whose circuit is
+// open.
+var errCircuitOpen = errors.New("auth: identity service circuit open")
+
+// ServiceOptions protects the calls to an identity service, so that an
+// outage degrades to cached decisions instead of failing every request.
+type ServiceOptions struct {
+	// Timeout bounds a call, Options.Timeout by default.
+	Timeout time.Duration
+	// StaleTTL keeps valid lookups this much longer than their TTL. Stale
+	// lookups are only used while the service fails. Zero disables it.
+	StaleTTL time.Duration
+	// FailureThreshold consecutive failures open the circuit, 5 by default.
+	// The service is not called for OpenDuration then, 30 seconds by
+	// default, after which a single call probes it.
+	FailureThreshold int
+	OpenDuration     time.Duration
+}
+
+// circuit stops calls to a failing service. Invalid credentials are answers,
+// not failures.
+type circuit struct {
+	name   string
+	opts   ServiceOptions
+	logger *logrus.Logger
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuit(name string, opts ServiceOptions, logger *logrus.Logger) *circuit {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 5
+	}
+	if opts.OpenDuration <= 0 {
+		opts.OpenDuration = 30 * time.Second
+	}
+	return &circuit{name: name, opts: opts, logger: logger}
+}
+
+// call runs fn with the timeout of the service unless the circuit is open.
+func (c *circuit) call(ctx context.Context, fn func(ctx context.Context) (*Identity, error)) (*Identity, error) {
+	if !c.allow(time.Now()) {
+		return nil, errCircuitOpen
+	}
+	callCtx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	identity, err := fn(callCtx)
+	switch {
+	case err == nil, errors.Is(err, ErrInvalidCredentials):
+		c.done(time.Now(), false)
+	case ctx.Err() != nil:
+		// The request was abandoned, which says nothing about the service.
+		c.release()
+	default:
+		c.done(time.Now(), true)
+	}
+	return identity, err
+}
+
+func (c *circuit) allow(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(c.openUntil) || c.probing {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+func (c *circuit) done(now time.Time, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !failed {
+		if !c.openUntil.IsZero() {
+			c.logger.WithField("service", c.name).Warn("Identity service recovered, circuit closed")
+		}
+		c.failures, c.openUntil, c.probing = 0, time.Time{}, false
+		return
+	}
+	c.failures++
+	if c.probing || c.failures >= c.opts.FailureThreshold {
+		if c.openUntil.IsZero() {
+			c.logger.WithFields(logrus.Fields{"service": c.name, "failures": c.failures}).Warn("Identity service failing, circuit opened")
+		}
+		c.openUntil = now.Add(c.opts.OpenDuration)
+		c.probing = false
+	}
+}
+
+func (c *circuit) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+}
+
+// service is an identity service credentials of one method are looked up
+// in.
+type service struct {
+	// method is the authentication method, kind prefixes cache keys
+	method, kind string
+	// ttl is how long a valid lookup is fresh, negativeTTL how long an
+	// invalid one is cached
+	ttl         func(*Identity) time.Duration
+	negativeTTL time.Duration
+	call        func(ctx context.Context, secret string) (*Identity, error)
+	circuit     *circuit
+}
+
+// lookupWith answers a lookup of secret from the cache while it is fresh,
+// and from the service otherwise. When the service fails, a stale lookup is
+// used if there is one.
+func (a *Authenticator) lookupWith(ctx context.Context, s *service, secret string) (*Identity, error) {
+	cached, ok := a.cached(ctx, s.kind, secret)
+	if ok && !cached.stale(time.Now()) {
+		identity, err := resolve(cached)
+		a.record(s.method, "cache", err)
+		return identity, err
+	}
+
+	identity, err := s.circuit.call(ctx, func(ctx context.Context) (*Identity, error) {
+		return s.call(ctx, secret)
+	})
+	switch {
+	case err == nil:
+		fresh := s.ttl(identity)
+		a.store(ctx, s.kind, secret, lookup{Identity: identity, FreshUntil: time.Now().Add(fresh)},
+			positiveTTL(identity, fresh+s.circuit.opts.StaleTTL))
+	case errors.Is(err, ErrInvalidCredentials):
+		a.store(ctx, s.kind, secret, lookup{}, s.negativeTTL)
+	case ok:
+		staleIdentity, staleErr := resolve(cached)
+		a.record(s.method, "stale", staleErr)
+		a.logger.WithError(err).WithField("method", s.method).Debug("Identity service failing, using stale lookup")
+		return staleIdentity, staleErr
+	}
+	source := "service"
+	if errors.Is(err, errCircuitOpen) {
+		source = "circuit"
+	}
+	a.record(s.method, source, err)
+	return identity, err
+}
@@ -0,0 +1,214 @@
+// Package authz delegates authorization decisions to an external service,
+// following the HTTP and gRPC protocols of Envoy's ext_authz filter so that
+// existing authorization services can be reused behind Shielder.
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Modes select the protocol spoken with the authorization service.
+const (
+	ModeHTTP = "http"
+	ModeGRPC = "grpc"
+)
+
+// Verdict is the decision of the authorization service for one request.
+type Verdict struct {
+	Allowed bool
+
+	// UpstreamHeaders are set on the request before it is forwarded, and
+	// RemoveHeaders are removed from it. Both only apply to allowed requests.
+	UpstreamHeaders http.Header
+	RemoveHeaders   []string
+
+	// Status, ResponseHeaders and Body make up the response sent to the
+	// client for denied requests.
+	Status          int
+	ResponseHeaders http.Header
+	Body            []byte
+}
+
+// checker asks the authorization service about a request.
+type checker interface {
+	check(ctx context.Context, r *http.Request) (*Verdict, error)
+	close() error
+}
+
+// Recorder receives the outcome of authorization checks.
+type Recorder interface {
+	IncAuthzCheck(result, source string)
+}
+
+// Options configures the external authorization client.
+type Options struct {
+	// Mode is ModeHTTP or ModeGRPC.
+	Mode string
+	// Address is the base URL of the service in HTTP mode and its host:port
+	// in gRPC mode.
+	Address string
+	// PathPrefix is prepended to the request path in HTTP mode.
+	PathPrefix string
+	Timeout    time.Duration
+	// FailOpen allows requests when the service cannot be reached or answers
+	// with an error, instead of rejecting them with 503.
+	FailOpen bool
+
+	// AllowedRequestHeaders are copied from the client request to the check
+	// request in HTTP mode. gRPC mode always sends all headers.
+	AllowedRequestHeaders []string
+	// AllowedUpstreamHeaders are copied from an allowing HTTP response to
+	// the upstream request.
+	AllowedUpstreamHeaders []string
+
+	// CacheTTL enables caching of verdicts when positive. Cached verdicts
+	// are keyed by method, host, path and the CacheKeyHeaders, so caching is
+	// only correct if the service decides based on those alone.
+	CacheTTL        time.Duration
+	CacheMaxEntries int
+	CacheKeyHeaders []string
+
+	Recorder Recorder
+}
+
+// Authorizer checks requests against the external authorization service
+// before they are forwarded.
+type Authorizer struct {
+	checker checker
+	cache   *cache
+	opts    Options
+	logger  *logrus.Logger
+}
+
+// New creates an Authorizer for the configured service. In gRPC mode the
+// connection is established lazily.
+func New(opts Options, logger *logrus.Logger) (*Authorizer, error) {
+	if opts.Address == "" {
+		return nil, errors.New("authz: address is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 200 * time.Millisecond
+	}
+
+	a := &Authorizer{opts: opts, logger: logger}
+	switch opts.Mode {
+	case "", ModeHTTP:
+		a.checker = newHTTPChecker(opts)
+	case ModeGRPC:
+		c, err := newGRPCChecker(opts)
+		if err != nil {
+			return nil, err
+		}
+		a.checker = c
+	default:
+		return nil, fmt.Errorf("authz: unknown mode %q", opts.Mode)
+	}
+
+	if opts.CacheTTL > 0 {
+		a.cache = newCache(opts.CacheMaxEntries)
+	}
+	return a, nil
+}
+
+// Close releases the connection to the authorization service.
+func (a *Authorizer) Close() error {
+	return a.checker.close()
+}
+
+// Middleware rejects requests the authorization service denies and applies
+// the header changes of allowed requests before calling next.
+func (a *Authorizer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verdict, err := a.authorize(r)
+		if err != nil {
+			a.logger.WithError(err).WithField("url", r.URL.String()).Error("Error checking authorization")
+			a.record("error", "service")
+			if a.opts.FailOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !verdict.Allowed {
+			for name, values := range verdict.ResponseHeaders {
+				w.Header()[name] = append([]string(nil), values...)
+			}
+			status := verdict.Status
+			if status < 400 || status > 599 {
+				status = http.StatusForbidden
+			}
+			w.WriteHeader(status)
+			w.Write(verdict.Body)
+			return
+		}
+
+		for _, name := range verdict.RemoveHeaders {
+			r.Header.Del(name)
+		}
+		for name, values := range verdict.UpstreamHeaders {
+			r.Header[name] = append([]string(nil), values...)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize returns the verdict for r, from the cache if possible.
+func (a *Authorizer) authorize(r *http.Request) (*Verdict, error) {
+	var key string
+	if a.cache != nil {
+		key = a.cacheKey(r)
+		if verdict, ok := a.cache.get(key); ok {
+			a.record(result(verdict), "cache")
+			return verdict, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.opts.Timeout)
+	defer cancel()
+	verdict, err := a.checker.check(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	a.record(result(verdict), "service")
+
+	if a.cache != nil {
+		a.cache.put(key, verdict, a.opts.CacheTTL)
+	}
+	return verdict, nil
+}
+
+func (a *Authorizer) cacheKey(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(0)
+	b.WriteString(r.Host)
+	b.WriteByte(0)
+	b.WriteString(r.URL.RequestURI())
+	for _, name := range a.opts.CacheKeyHeaders {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (a *Authorizer) record(result, source string) {
+	if a.opts.Recorder != nil {
+		a.opts.Recorder.IncAuthzCheck(result, source)
+	}
+}
+
+func result(verdict *Verdict) string {
+	if verdict.Allowed {
+		return "allowed"
+	}
+	return "denied"
+}
@@ -0,0 +1,181 @@
+package authz
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// serve runs a request through the authorizer and returns the response and
+// the request that reached the upstream, if any.
+func serve(t *testing.T, a *Authorizer, token string) (*httptest.ResponseRecorder, *http.Request) {
+	t.Helper()
+	var upstream *http.Request
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/items?page=2", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, upstream
+}
+
+func TestHTTPMode(t *testing.T) {
+	var calls atomic.Int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path != "/check/api/items" || r.URL.RawQuery != "page=2" {
+			t.Errorf("Expected check for /check/api/items?page=2, got %s", r.URL.RequestURI())
+		}
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("denied"))
+			return
+		}
+		w.Header().Set("X-User-Id", "42")
+		w.Header().Set("X-Internal", "secret")
+	}))
+	defer service.Close()
+
+	a, err := New(Options{
+		Address:                service.URL,
+		PathPrefix:             "/check",
+		AllowedUpstreamHeaders: []string{"X-User-Id"},
+		CacheTTL:               time.Minute,
+		CacheKeyHeaders:        []string{"Authorization"},
+	}, logrus.New())
+	if err != nil {
+		t.Fatalf("Failed to create authorizer: %v", err)
+	}
+	defer a.Close()
+
+	rec, upstream := serve(t, a, "good")
+	if upstream == nil {
+		t.Fatal("Expected allowed request to reach the upstream")
+	}
+	if got := upstream.Header.Get("X-User-Id"); got != "42" {
+		t.Errorf("Expected X-User-Id 42, got %q", got)
+	}
+	if got := upstream.Header.Get("X-Internal"); got != "" {
+		t.Errorf("Expected X-Internal to be filtered, got %q", got)
+	}
+
+	rec, upstream = serve(t, a, "bad")
+	if upstream != nil {
+		t.Error("Expected denied request not to reach the upstream")
+	}
+	if rec.Code != http.StatusUnauthorized || rec.Body.String() != "denied" {
+		t.Errorf("Expected 401 denied, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); got != "Bearer" {
+		t.Errorf("Expected WWW-Authenticate to be relayed, got %q", got)
+	}
+
+	// Both verdicts are cached now.
+	serve(t, a, "good")
+	serve(t, a, "bad")
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Expected 2 calls to the service, got %d", got)
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		failOpen   bool
+		wantStatus int
+	}{
+		{name: "Closed", failOpen: false, wantStatus: http.StatusServiceUnavailable},
+		{name: "Open", failOpen: true, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := New(Options{Address: "http://127.0.0.1:1", FailOpen: tt.failOpen}, logrus.New())
+			if err != nil {
+				t.Fatalf("Failed to create authorizer: %v", err)
+			}
+			rec, _ := serve(t, a, "good")
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+type authServer struct {
+	authv3.UnimplementedAuthorizationServer
+}
+
+func (authServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	if req.GetAttributes().GetRequest().GetHttp().GetHeaders()["authorization"] != "Bearer good" {
+		return &authv3.CheckResponse{
+			Status: &status.Status{Code: int32(codes.PermissionDenied)},
+			HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+				Status: &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+				Body:   "forbidden",
+			}},
+		}, nil
+	}
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{
+			Headers: []*corev3.HeaderValueOption{
+				{Header: &corev3.HeaderValue{Key: "x-user-id", Value: "42"}},
+			},
+			HeadersToRemove: []string{"authorization"},
+		}},
+	}, nil
+}
+
+func TestGRPCMode(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(server, authServer{})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	a, err := New(Options{Mode: ModeGRPC, Address: lis.Addr().String(), Timeout: time.Second}, logrus.New())
+	if err != nil {
+		t.Fatalf("Failed to create authorizer: %v", err)
+	}
+	defer a.Close()
+
+	_, upstream := serve(t, a, "good")
+	if upstream == nil {
+		t.Fatal("Expected allowed request to reach the upstream")
+	}
+	if got := upstream.Header.Get("X-User-Id"); got != "42" {
+		t.Errorf("Expected X-User-Id 42, got %q", got)
+	}
+	if got := upstream.Header.Get("Authorization"); got != "" {
+		t.Errorf("Expected Authorization to be removed, got %q", got)
+	}
+
+	rec, upstream := serve(t, a, "bad")
+	if upstream != nil {
+		t.Error("Expected denied request not to reach the upstream")
+	}
+	if rec.Code != http.StatusForbidden || rec.Body.String() != "forbidden" {
+		t.Errorf("Expected 403 forbidden, got %d %q", rec.Code, rec.Body.String())
+	}
+}
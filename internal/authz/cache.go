@@ -0,0 +1,67 @@
+package authz
+
+import (
+	"sync"
+	"time"
+)
+
+// cache holds verdicts in process memory for a limited time.
+type cache struct {
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	maxEntries int
+}
+
+type cacheEntry struct {
+	verdict   *Verdict
+	expiresAt time.Time
+}
+
+func newCache(maxEntries int) *cache {
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	return &cache{entries: make(map[string]cacheEntry), maxEntries: maxEntries}
+}
+
+func (c *cache) get(key string) (*Verdict, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.verdict, true
+}
+
+func (c *cache) put(key string, verdict *Verdict, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.maxEntries {
+		c.evictLocked()
+	}
+	c.entries[key] = cacheEntry{verdict: verdict, expiresAt: time.Now().Add(ttl)}
+}
+
+// evictLocked drops expired entries and, if the cache is still full, an
+// arbitrary tenth of it. Callers must hold the lock.
+func (c *cache) evictLocked() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.maxEntries*9/10 {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,117 @@
+package authz
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcChecker implements the envoy.service.auth.v3.Authorization gRPC API.
+// Header mutations returned by the service always replace existing values,
+// the append options are not supported.
+type grpcChecker struct {
+	conn   *grpc.ClientConn
+	client authv3.AuthorizationClient
+}
+
+func newGRPCChecker(opts Options) (*grpcChecker, error) {
+	conn, err := grpc.NewClient(opts.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcChecker{conn: conn, client: authv3.NewAuthorizationClient(conn)}, nil
+}
+
+func (c *grpcChecker) check(ctx context.Context, r *http.Request) (*Verdict, error) {
+	resp, err := c.client.Check(ctx, checkRequest(r))
+	if err != nil {
+		return nil, err
+	}
+
+	if codes.Code(resp.GetStatus().GetCode()) == codes.OK {
+		ok := resp.GetOkResponse()
+		return &Verdict{
+			Allowed:         true,
+			UpstreamHeaders: headerOptions(ok.GetHeaders()),
+			RemoveHeaders:   ok.GetHeadersToRemove(),
+		}, nil
+	}
+
+	denied := resp.GetDeniedResponse()
+	return &Verdict{
+		Status:          int(denied.GetStatus().GetCode()),
+		ResponseHeaders: headerOptions(denied.GetHeaders()),
+		Body:            []byte(denied.GetBody()),
+	}, nil
+}
+
+func (c *grpcChecker) close() error {
+	return c.conn.Close()
+}
+
+// checkRequest describes r the way Envoy does, with lower-cased header names
+// and repeated headers joined by commas.
+func checkRequest(r *http.Request) *authv3.CheckRequest {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{Address: socketAddress(r.RemoteAddr)},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:   r.Method,
+					Headers:  headers,
+					Path:     r.URL.RequestURI(),
+					Host:     r.Host,
+					Scheme:   scheme,
+					Query:    r.URL.RawQuery,
+					Size:     r.ContentLength,
+					Protocol: r.Proto,
+				},
+			},
+		},
+	}
+}
+
+func socketAddress(addr string) *corev3.Address {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 32)
+	return &corev3.Address{
+		Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{
+				Address:       host,
+				PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(port)},
+			},
+		},
+	}
+}
+
+func headerOptions(options []*corev3.HeaderValueOption) http.Header {
+	headers := make(http.Header, len(options))
+	for _, option := range options {
+		value := option.GetHeader().GetValue()
+		if value == "" {
+			value = string(option.GetHeader().GetRawValue())
+		}
+		headers.Set(option.GetHeader().GetKey(), value)
+	}
+	return headers
+}
@@ -0,0 +1,83 @@
+package authz
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxDeniedBody bounds how much of a denying response is relayed to the client.
+const maxDeniedBody = 64 << 10
+
+// httpChecker implements the HTTP protocol of Envoy's ext_authz filter: the
+// request line and selected headers are sent to the service without a body.
+// A 200 response allows the request, any other status denies it and is
+// relayed to the client.
+type httpChecker struct {
+	client          *http.Client
+	baseURL         string
+	requestHeaders  []string
+	upstreamHeaders []string
+}
+
+func newHTTPChecker(opts Options) *httpChecker {
+	requestHeaders := opts.AllowedRequestHeaders
+	if len(requestHeaders) == 0 {
+		requestHeaders = []string{"Authorization"}
+	}
+	return &httpChecker{
+		client:          &http.Client{},
+		baseURL:         strings.TrimSuffix(opts.Address, "/") + opts.PathPrefix,
+		requestHeaders:  requestHeaders,
+		upstreamHeaders: opts.AllowedUpstreamHeaders,
+	}
+}
+
+func (c *httpChecker) check(ctx context.Context, r *http.Request) (*Verdict, error) {
+	req, err := http.NewRequestWithContext(ctx, r.Method, c.baseURL+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = r.Host
+	for _, name := range c.requestHeaders {
+		for _, value := range r.Header.Values(name) {
+			req.Header.Add(name, value)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		verdict := &Verdict{Allowed: true, UpstreamHeaders: make(http.Header)}
+		for _, name := range c.upstreamHeaders {
+			if values := resp.Header.Values(name); len(values) > 0 {
+				verdict.UpstreamHeaders[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		return verdict, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDeniedBody))
+	if err != nil {
+		return nil, err
+	}
+	headers := resp.Header.Clone()
+	for _, name := range []string{"Connection", "Content-Length", "Transfer-Encoding", "Keep-Alive"} {
+		headers.Del(name)
+	}
+	return &Verdict{
+		Status:          resp.StatusCode,
+		ResponseHeaders: headers,
+		Body:            body,
+	}, nil
+}
+
+func (c *httpChecker) close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
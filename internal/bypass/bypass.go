@@ -0,0 +1,220 @@
+// Package bypass issues short-lived signed tokens that let a partner or an
+// internal tool skip rate limits and challenges during an incident.
+//
+// Tokens are minted by operators through the admin API, carry who they were
+// issued to and by whom, and expire on their own. Every issued token has a
+// grant in Redis that counts its uses and expires with it; deleting the grant
+// revokes the token on all instances. Tokens are signed with rotatable keys
+// like clearance tokens, see signedtoken.
+package bypass
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/signedtoken"
+)
+
+// Errors returned by Verify and Issue.
+var (
+	ErrNoToken      = errors.New("bypass: no token")
+	ErrInvalidToken = errors.New("bypass: invalid token")
+	ErrExpired      = errors.New("bypass: token expired")
+	ErrRevoked      = errors.New("bypass: token revoked")
+	ErrTTL          = errors.New("bypass: ttl exceeds the maximum")
+)
+
+// grantPrefix prefixes the Redis hashes of issued tokens.
+const grantPrefix = "bypass:grant:"
+
+// useScript counts a use of a grant and returns the uses so far, or 0 if the
+// grant was revoked or has expired.
+var useScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+return redis.call("HINCRBY", KEYS[1], "uses", 1)
+`)
+
+// Options configures bypass tokens.
+type Options struct {
+	// Header carries tokens, X-Shielder-Bypass by default. It is removed
+	// before requests are forwarded.
+	Header string
+	// DefaultTTL applies to tokens issued without a TTL, 15 minutes by
+	// default. MaxTTL bounds the TTL of every token, 4 hours by default.
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+	Keys       []signedtoken.Key
+}
+
+// Claims are the contents of a bypass token.
+type Claims struct {
+	ID string `json:"jti"`
+	// Subject is the partner or tool the token was issued to.
+	Subject string `json:"sub"`
+	Reason  string `json:"rsn,omitempty"`
+	// IssuedBy is the operator who minted the token.
+	IssuedBy  string `json:"iby,omitempty"`
+	KeyID     string `json:"kid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Grant is an issued token that has neither expired nor been revoked.
+type Grant struct {
+	Claims
+	Uses int64 `json:"uses"`
+}
+
+// Manager issues, verifies and revokes bypass tokens.
+type Manager struct {
+	opts   Options
+	signer *signedtoken.Signer
+	client redis.UniversalClient
+}
+
+// NewManager creates a Manager that keeps grants in Redis.
+func NewManager(opts Options, client redis.UniversalClient) (*Manager, error) {
+	if opts.Header == "" {
+		opts.Header = "X-Shielder-Bypass"
+	}
+	if opts.DefaultTTL <= 0 {
+		opts.DefaultTTL = 15 * time.Minute
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = 4 * time.Hour
+	}
+	signer, err := signedtoken.New("bypass", opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{opts: opts, signer: signer, client: client}, nil
+}
+
+// Header returns the header tokens are presented in.
+func (m *Manager) Header() string {
+	return m.opts.Header
+}
+
+// Issue creates a token for subject valid for ttl, or the default TTL if
+// ttl is zero, and records its grant.
+func (m *Manager) Issue(ctx context.Context, subject, reason, issuedBy string, ttl time.Duration) (string, Claims, error) {
+	if ttl <= 0 {
+		ttl = m.opts.DefaultTTL
+	}
+	if ttl > m.opts.MaxTTL {
+		return "", Claims{}, ErrTTL
+	}
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", Claims{}, err
+	}
+	now := time.Now()
+	claims := Claims{
+		ID:        hex.EncodeToString(id),
+		Subject:   subject,
+		Reason:    reason,
+		IssuedBy:  issuedBy,
+		KeyID:     m.signer.KeyID(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	token, err := m.signer.Sign(claims)
+	if err != nil {
+		return "", Claims{}, err
+	}
+
+	key := grantPrefix + claims.ID
+	pipe := m.client.TxPipeline()
+	pipe.HSet(ctx, key, "claims", payload, "uses", 0)
+	pipe.ExpireAt(ctx, key, time.Unix(claims.ExpiresAt, 0))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", Claims{}, err
+	}
+	return token, claims, nil
+}
+
+// Verify checks the token in the header of r and counts a use of it. The
+// header is removed from r whether the token is valid or not. The signature
+// and expiry are checked locally, the grant with a single Redis round trip.
+func (m *Manager) Verify(ctx context.Context, r *http.Request) (*Claims, error) {
+	token := r.Header.Get(m.opts.Header)
+	r.Header.Del(m.opts.Header)
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	var claims Claims
+	if err := m.signer.Parse(token, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+
+	uses, err := useScript.Run(ctx, m.client, []string{grantPrefix + claims.ID}).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if uses == 0 {
+		return nil, ErrRevoked
+	}
+	return &claims, nil
+}
+
+// Revoke invalidates the token with the given ID on all instances. It
+// returns the claims of the token, or nil if it was no longer active.
+func (m *Manager) Revoke(ctx context.Context, id string) (*Claims, error) {
+	key := grantPrefix + id
+	pipe := m.client.TxPipeline()
+	get := pipe.HGet(ctx, key, "claims")
+	del := pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if del.Val() == 0 {
+		return nil, nil
+	}
+	var claims Claims
+	if err := json.Unmarshal([]byte(get.Val()), &claims); err != nil {
+		// Revoked all the same.
+		claims = Claims{ID: id}
+	}
+	return &claims, nil
+}
+
+// Grants returns the active tokens, those expiring first first.
+func (m *Manager) Grants(ctx context.Context) ([]Grant, error) {
+	var grants []Grant
+	iter := m.client.Scan(ctx, 0, grantPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		values, err := m.client.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		var grant Grant
+		if err := json.Unmarshal([]byte(values["claims"]), &grant.Claims); err != nil {
+			// Expired between the scan and the read.
+			continue
+		}
+		grant.Uses, _ = strconv.ParseInt(values["uses"], 10, 64)
+		grants = append(grants, grant)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].ExpiresAt < grants[j].ExpiresAt })
+	return grants, nil
+}
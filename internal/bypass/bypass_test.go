@@ -0,0 +1,101 @@
+package bypass
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/signedtoken"
+)
+
+var testKey = signedtoken.Key{ID: "k1", Secret: []byte("0123456789abcdef")}
+
+func newTestManager(t *testing.T, client *redis.Client) *Manager {
+	t.Helper()
+	m, err := NewManager(Options{Keys: []signedtoken.Key{testKey}}, client)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	return m
+}
+
+func requestWith(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if token != "" {
+		req.Header.Set("X-Shielder-Bypass", token)
+	}
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	m := newTestManager(t, client)
+
+	token, claims, err := m.Issue(ctx, "partner-a", "incident 42", "alice@example.com", 0)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if claims.ExpiresAt-claims.IssuedAt != int64((15 * time.Minute).Seconds()) {
+		t.Errorf("Expected the default TTL, got %ds", claims.ExpiresAt-claims.IssuedAt)
+	}
+
+	req := requestWith(token)
+	got, err := m.Verify(ctx, req)
+	if err != nil {
+		t.Fatalf("Expected a valid token, got %v", err)
+	}
+	if got.Subject != "partner-a" || got.IssuedBy != "alice@example.com" {
+		t.Errorf("Unexpected claims %+v", got)
+	}
+	if req.Header.Get("X-Shielder-Bypass") != "" {
+		t.Error("Expected the token header to be removed")
+	}
+	m.Verify(ctx, requestWith(token))
+
+	grants, err := m.Grants(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].ID != claims.ID || grants[0].Uses != 2 {
+		t.Errorf("Expected one grant used twice, got %+v", grants)
+	}
+
+	for name, tc := range map[string]struct {
+		token   string
+		wantErr error
+	}{
+		"missing":  {"", ErrNoToken},
+		"tampered": {token + "x", ErrInvalidToken},
+		"garbage":  {"nonsense", ErrInvalidToken},
+	} {
+		if _, err := m.Verify(ctx, requestWith(tc.token)); !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: expected %v, got %v", name, tc.wantErr, err)
+		}
+	}
+
+	revoked, err := m.Revoke(ctx, claims.ID)
+	if err != nil || revoked == nil || revoked.Subject != "partner-a" {
+		t.Fatalf("Expected the token of partner-a to be revoked, got %+v %v", revoked, err)
+	}
+	if _, err := m.Verify(ctx, requestWith(token)); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected ErrRevoked, got %v", err)
+	}
+	if revoked, err := m.Revoke(ctx, claims.ID); err != nil || revoked != nil {
+		t.Errorf("Expected a revoked token not to be revoked again, got %+v %v", revoked, err)
+	}
+}
+
+func TestIssueRejectsLongTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	m := newTestManager(t, redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	if _, _, err := m.Issue(context.Background(), "partner-a", "", "", 5*time.Hour); !errors.Is(err, ErrTTL) {
+		t.Errorf("Expected ErrTTL, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Package challenge implements a JavaScript proof-of-work challenge. Browsers
+// solve it automatically within a second or two and receive a clearance
+// cookie, while simple scripts and flood tools never get past it.
+//
+// Challenges are stateless: the nonce is sealed with the clearance signing
+// keys and bound to the client and an expiry, so any instance can verify a
+// solution to a challenge issued by another.
+package challenge
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knakul853/shielder/internal/clearance"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultPath is where solutions are submitted.
+const DefaultPath = "/.shielder/challenge"
+
+// Options configures the challenge.
+type Options struct {
+	// Path is where the challenge page submits its solution.
+	Path string
+	// Difficulty is the number of leading zero bits the SHA-256 hash of
+	// nonce and solution must have. Every additional bit doubles the work.
+	Difficulty int
+	// TTL is how long a challenge can be solved.
+	TTL time.Duration
+}
+
+// Challenger serves challenges and verifies their solutions.
+type Challenger struct {
+	opts      Options
+	clearance *clearance.Manager
+	logger    *logrus.Logger
+}
+
+// New creates a Challenger that issues clearance tokens for solved challenges.
+func New(opts Options, clearance *clearance.Manager, logger *logrus.Logger) *Challenger {
+	if opts.Path == "" {
+		opts.Path = DefaultPath
+	}
+	if opts.Difficulty <= 0 {
+		opts.Difficulty = 16
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 5 * time.Minute
+	}
+	return &Challenger{opts: opts, clearance: clearance, logger: logger}
+}
+
+// Path returns the path solutions are submitted to.
+func (c *Challenger) Path() string {
+	return c.opts.Path
+}
+
+var page = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="robots" content="noindex">
+<title>Checking your browser</title></head>
+<body style="font-family:sans-serif;text-align:center;padding-top:15%">
+<h1>Checking your browser&hellip;</h1>
+<p>This takes a moment and happens only once.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<form id="f" method="POST" action="{{.Path}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="solution" id="s">
+<input type="hidden" name="return" value="{{.Return}}">
+</form>
+<script>
+(async function () {
+  const nonce = {{.Nonce}}, difficulty = {{.Difficulty}};
+  const enc = new TextEncoder();
+  for (let i = 0; ; i++) {
+    const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", enc.encode(nonce + ":" + i)));
+    let zeros = 0;
+    for (const b of hash) {
+      if (b === 0) { zeros += 8; continue; }
+      zeros += Math.clz32(b) - 24;
+      break;
+    }
+    if (zeros >= difficulty) {
+      document.getElementById("s").value = i;
+      document.getElementById("f").submit();
+      return;
+    }
+  }
+})();
+</script>
+</body></html>
+`))
+
+// Serve answers r with a challenge page for subject. The client returns to
+// the requested URL after solving it.
+func (c *Challenger) Serve(w http.ResponseWriter, r *http.Request, subject string) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	expires := strconv.FormatInt(time.Now().Add(c.opts.TTL).Unix(), 10)
+	nonce := c.clearance.Seal(hex.EncodeToString(raw) + "." + expires + "." + url.QueryEscape(subject))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	page.Execute(w, struct {
+		Path       string
+		Nonce      string
+		Difficulty int
+		Return     string
+	}{c.opts.Path, nonce, c.opts.Difficulty, r.URL.RequestURI()})
+}
+
+// Verify handles a submitted solution. Correct solutions receive a clearance
+// cookie and are redirected back to the page they came from.
+func (c *Challenger) Verify(w http.ResponseWriter, r *http.Request, subject string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nonce := r.PostFormValue("nonce")
+	if !c.valid(nonce, r.PostFormValue("solution"), subject) {
+		c.logger.WithField("client_ip", subject).Info("Challenge failed")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	token, claims, err := c.clearance.Issue(subject, "challenge")
+	if err != nil {
+		c.logger.WithError(err).Error("Error issuing clearance token")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.SetCookie(w, c.clearance.Cookie(token, claims))
+	c.logger.WithField("client_ip", subject).Info("Challenge passed")
+
+	// Only redirect to local paths, never to other sites.
+	target := r.PostFormValue("return")
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		target = "/"
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func (c *Challenger) valid(nonce, solution, subject string) bool {
+	value, ok := c.clearance.Open(nonce)
+	if !ok {
+		return false
+	}
+	parts := strings.SplitN(value, ".", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	if boundTo, err := url.QueryUnescape(parts[2]); err != nil || boundTo != subject {
+		return false
+	}
+	if _, err := strconv.ParseUint(solution, 10, 64); err != nil {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256([]byte(nonce+":"+solution))) >= c.opts.Difficulty
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
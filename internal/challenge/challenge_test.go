@@ -0,0 +1,123 @@
+package challenge
+
+import (
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/clearance"
+	"github.com/knakul853/shielder/internal/signedtoken"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestChallenger(t *testing.T) (*Challenger, *clearance.Manager) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	manager, err := clearance.NewManager(clearance.Options{
+		Keys: []signedtoken.Key{{ID: "k1", Secret: []byte("0123456789abcdef")}},
+	}, client)
+	if err != nil {
+		t.Fatalf("Failed to create clearance manager: %v", err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(Options{Difficulty: 8}, manager, logger), manager
+}
+
+var noncePattern = regexp.MustCompile(`name="nonce" value="([^"]+)"`)
+
+// issue serves a challenge and returns its nonce.
+func issue(t *testing.T, c *Challenger, subject string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c.Serve(rec, httptest.NewRequest(http.MethodGet, "/account?tab=1", nil), subject)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, got %d", rec.Code)
+	}
+	match := noncePattern.FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		t.Fatalf("Expected challenge page to contain a nonce")
+	}
+	return match[1]
+}
+
+func solve(nonce string, difficulty int) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(nonce+":"+solution))) >= difficulty {
+			return solution
+		}
+	}
+}
+
+func submit(c *Challenger, nonce, solution, returnTo, subject string) *httptest.ResponseRecorder {
+	form := url.Values{"nonce": {nonce}, "solution": {solution}, "return": {returnTo}}
+	req := httptest.NewRequest(http.MethodPost, DefaultPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	c.Verify(rec, req, subject)
+	return rec
+}
+
+func TestVerify(t *testing.T) {
+	c, manager := newTestChallenger(t)
+	nonce := issue(t, c, "192.0.2.1")
+	solution := solve(nonce, 8)
+
+	tests := []struct {
+		name     string
+		nonce    string
+		solution string
+		returnTo string
+		subject  string
+		status   int
+		location string
+	}{
+		{"solved", nonce, solution, "/account?tab=1", "192.0.2.1", http.StatusSeeOther, "/account?tab=1"},
+		{"other client", nonce, solution, "/", "192.0.2.2", http.StatusForbidden, ""},
+		{"tampered nonce", nonce + "x", solution, "/", "192.0.2.1", http.StatusForbidden, ""},
+		{"no solution", nonce, "", "/", "192.0.2.1", http.StatusForbidden, ""},
+		{"external redirect", nonce, solution, "//evil.example", "192.0.2.1", http.StatusSeeOther, "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := submit(c, tt.nonce, tt.solution, tt.returnTo, tt.subject)
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+			if tt.location == "" {
+				return
+			}
+			if got := rec.Header().Get("Location"); got != tt.location {
+				t.Errorf("Expected redirect to %q, got %q", tt.location, got)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, cookie := range rec.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			if _, err := manager.Verify(req.Context(), req, tt.subject); err != nil {
+				t.Errorf("Expected valid clearance cookie, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRequiresPost(t *testing.T) {
+	c, _ := newTestChallenger(t)
+	rec := httptest.NewRecorder()
+	c.Verify(rec, httptest.NewRequest(http.MethodGet, DefaultPath, nil), "192.0.2.1")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,185 @@
+// Package clearance issues and verifies signed, expiring clearance cookies.
+// A client receives one after passing a challenge or being trusted by an
+// operator, and presents it on subsequent requests to skip challenges without
+// solving them again.
+//
+// Tokens are signed with rotatable keys, see signedtoken. Individual tokens
+// and whole keys can be revoked through Redis, which every instance checks.
+package clearance
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/signedtoken"
+)
+
+// Errors returned by Verify.
+var (
+	ErrNoToken      = errors.New("clearance: no token")
+	ErrInvalidToken = errors.New("clearance: invalid token")
+	ErrExpired      = errors.New("clearance: token expired")
+	ErrWrongSubject = errors.New("clearance: token issued to another client")
+	ErrRevoked      = errors.New("clearance: token revoked")
+	// ErrUnknownKey is returned by RevokeKey for keys that are not configured.
+	ErrUnknownKey = errors.New("clearance: unknown key")
+)
+
+// Redis key prefixes for revocations.
+const (
+	revokedTokenPrefix = "clearance:revoked:"
+	revokedKeyPrefix   = "clearance:revoked-key:"
+)
+
+// Options configures clearance tokens.
+type Options struct {
+	CookieName string
+	TTL        time.Duration
+	Keys       []signedtoken.Key
+	// Secure and Domain are applied to the issued cookie.
+	Secure bool
+	Domain string
+}
+
+// Claims are the contents of a clearance token. Tokens are bound to the
+// client key they were issued to, so a leaked cookie is useless elsewhere.
+type Claims struct {
+	ID        string `json:"jti"`
+	Subject   string `json:"sub"`
+	KeyID     string `json:"kid"`
+	Reason    string `json:"rsn,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Manager issues, verifies and revokes clearance tokens.
+type Manager struct {
+	opts   Options
+	signer *signedtoken.Signer
+	client redis.UniversalClient
+}
+
+// NewManager creates a Manager that keeps revocations in Redis.
+func NewManager(opts Options, client redis.UniversalClient) (*Manager, error) {
+	if opts.CookieName == "" {
+		opts.CookieName = "shielder_clearance"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Hour
+	}
+	signer, err := signedtoken.New("clearance", opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{opts: opts, signer: signer, client: client}, nil
+}
+
+// Issue creates a token for subject, signed with the active key.
+func (m *Manager) Issue(subject, reason string) (string, Claims, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", Claims{}, err
+	}
+	now := time.Now()
+	claims := Claims{
+		ID:        hex.EncodeToString(id),
+		Subject:   subject,
+		KeyID:     m.signer.KeyID(),
+		Reason:    reason,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(m.opts.TTL).Unix(),
+	}
+	token, err := m.signer.Sign(claims)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	return token, claims, nil
+}
+
+// Cookie returns the cookie that carries token to the client.
+func (m *Manager) Cookie(token string, claims Claims) *http.Cookie {
+	return &http.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   m.opts.Domain,
+		Expires:  time.Unix(claims.ExpiresAt, 0),
+		Secure:   m.opts.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Verify checks the clearance cookie of r for subject. The signature and
+// expiry are checked locally, revocations with a single Redis round trip.
+func (m *Manager) Verify(ctx context.Context, r *http.Request, subject string) (*Claims, error) {
+	cookie, err := r.Cookie(m.opts.CookieName)
+	if err != nil {
+		return nil, ErrNoToken
+	}
+	var claims Claims
+	if err := m.signer.Parse(cookie.Value, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if claims.Subject != subject {
+		return nil, ErrWrongSubject
+	}
+
+	revoked, err := m.client.Exists(ctx, revokedTokenPrefix+claims.ID, revokedKeyPrefix+claims.KeyID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if revoked > 0 {
+		return nil, ErrRevoked
+	}
+	return &claims, nil
+}
+
+// Revoke invalidates the token with the given ID on all instances. The
+// revocation is kept for the token lifetime, after which the token has
+// expired anyway.
+func (m *Manager) Revoke(ctx context.Context, id string) error {
+	return m.client.Set(ctx, revokedTokenPrefix+id, "1", m.opts.TTL).Err()
+}
+
+// RevokeKey invalidates every token signed with the given key, for when a key
+// is compromised. The revocation does not expire.
+func (m *Manager) RevokeKey(ctx context.Context, keyID string) error {
+	if !m.signer.Known(keyID) {
+		return ErrUnknownKey
+	}
+	return m.client.Set(ctx, revokedKeyPrefix+keyID, "1", 0).Err()
+}
+
+// Seal signs value with the active key, so that other components can hand
+// out tamper-proof values, such as challenges, that any instance can check.
+func (m *Manager) Seal(value string) string {
+	return m.signer.Seal(value)
+}
+
+// Open verifies a value sealed by Seal with any configured key and returns it.
+func (m *Manager) Open(sealed string) (string, bool) {
+	return m.signer.Open(sealed)
+}
+
+type claimsKey struct{}
+
+// ContextWithClaims returns a copy of ctx marking the request as cleared.
+func ContextWithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// FromContext returns the verified clearance of the request, or nil if the
+// client has none.
+func FromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
@@ -0,0 +1,107 @@
+package clearance
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/signedtoken"
+)
+
+var (
+	oldKey = signedtoken.Key{ID: "k1", Secret: []byte("0123456789abcdef-old")}
+	newKey = signedtoken.Key{ID: "k2", Secret: []byte("0123456789abcdef-new")}
+)
+
+func newTestManager(t *testing.T, client *redis.Client, keys ...signedtoken.Key) *Manager {
+	t.Helper()
+	m, err := NewManager(Options{Keys: keys}, client)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	return m
+}
+
+func requestWith(m *Manager, token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: m.opts.CookieName, Value: token})
+	}
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+
+	issuer := newTestManager(t, client, oldKey)
+	token, _, err := issuer.Issue("192.0.2.1", "challenge")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	// After rotation new tokens are signed with k2, k1 tokens stay valid.
+	rotated := newTestManager(t, client, newKey, oldKey)
+	unknown := newTestManager(t, client, newKey)
+
+	tests := []struct {
+		name    string
+		m       *Manager
+		token   string
+		subject string
+		wantErr error
+	}{
+		{name: "Valid", m: issuer, token: token, subject: "192.0.2.1"},
+		{name: "Valid after rotation", m: rotated, token: token, subject: "192.0.2.1"},
+		{name: "Key removed", m: unknown, token: token, subject: "192.0.2.1", wantErr: ErrInvalidToken},
+		{name: "Missing", m: issuer, token: "", subject: "192.0.2.1", wantErr: ErrNoToken},
+		{name: "Tampered", m: issuer, token: token + "x", subject: "192.0.2.1", wantErr: ErrInvalidToken},
+		{name: "Other client", m: issuer, token: token, subject: "192.0.2.2", wantErr: ErrWrongSubject},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tt.m.Verify(ctx, requestWith(tt.m, tt.token), tt.subject)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && claims.Reason != "challenge" {
+				t.Errorf("Expected reason challenge, got %q", claims.Reason)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	m := newTestManager(t, client, newKey, oldKey)
+
+	first, claims, _ := m.Issue("192.0.2.1", "manual")
+	second, _, _ := m.Issue("192.0.2.1", "manual")
+
+	if err := m.Revoke(ctx, claims.ID); err != nil {
+		t.Fatalf("Failed to revoke token: %v", err)
+	}
+	if _, err := m.Verify(ctx, requestWith(m, first), "192.0.2.1"); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected revoked token to be rejected, got %v", err)
+	}
+	if _, err := m.Verify(ctx, requestWith(m, second), "192.0.2.1"); err != nil {
+		t.Errorf("Expected other token to stay valid, got %v", err)
+	}
+
+	if err := m.RevokeKey(ctx, newKey.ID); err != nil {
+		t.Fatalf("Failed to revoke key: %v", err)
+	}
+	if _, err := m.Verify(ctx, requestWith(m, second), "192.0.2.1"); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected tokens of a revoked key to be rejected, got %v", err)
+	}
+	if err := m.RevokeKey(ctx, "k9"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
@@ -2,11 +2,19 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
 	"gopkg.in/yaml.v3"
 )
 
@@ -14,9 +22,93 @@ import (
 type Config struct {
 	Server    ServerConfig    `yaml:"server"`
 	Redis     RedisConfig     `yaml:"redis"`
+	Store     StoreConfig     `yaml:"store"`
 	RateLimit RateLimitConfig `yaml:"rateLimit"`
 	Metrics   MetricsConfig   `yaml:"metrics"`
 	Proxy     ProxyConfig     `yaml:"proxy"`
+	Routes    []RouteConfig   `yaml:"routes"`
+	History   HistoryConfig   `yaml:"history"`
+	// Replication copies block events between regions
+	Replication ReplicationConfig `yaml:"replication"`
+	// Authz asks an external service whether requests may pass
+	Authz AuthzConfig `yaml:"authz"`
+	// Admin serves the operator API
+	Admin     AdminConfig     `yaml:"admin"`
+	Clearance ClearanceConfig `yaml:"clearance"`
+	// Sessions rate limits browsers by Shielder-issued session cookie
+	Sessions SessionConfig `yaml:"sessions"`
+	// Anomaly learns per-route traffic baselines and reacts to deviations
+	Anomaly AnomalyConfig `yaml:"anomaly"`
+	// Tuning observes client rates to recommend rate limits
+	Tuning TuningConfig `yaml:"tuning"`
+	// UnderAttack is a fleet-wide heightened security mode
+	UnderAttack UnderAttackConfig `yaml:"underAttack"`
+	// Tap captures the traffic of single clients on request of the admin API
+	Tap TapConfig `yaml:"tap"`
+	// Trusted identifies health checks and monitoring that bypass protection
+	Trusted []TrustedIdentity `yaml:"trusted"`
+	// Upgrade replaces the binary on SIGUSR2 without dropping connections
+	Upgrade UpgradeConfig `yaml:"upgrade"`
+	// Fleet registers the instance in Redis so the fleet can be inspected
+	Fleet FleetConfig `yaml:"fleet"`
+	// Settings shares limits changed via the admin API across the fleet
+	Settings SettingsConfig `yaml:"settings"`
+	// Fingerprint carries penalties over to clients that switch IPs
+	Fingerprint FingerprintConfig `yaml:"fingerprint"`
+	// Greylist tightens limits for clients during their first minutes
+	Greylist GreylistConfig `yaml:"greylist"`
+	// GeoIP keeps GeoIP and IP reputation databases up to date
+	GeoIP GeoIPConfig `yaml:"geoip"`
+	// Feedback records false positives reported by support tooling and the
+	// upstream
+	Feedback FeedbackConfig `yaml:"feedback"`
+	// WAFSync exports blocks to and imports blocks from cloud WAF lists
+	WAFSync WAFSyncConfig `yaml:"wafSync"`
+	// Firewall passes blocks on to the host firewall through fail2ban or a
+	// hook command
+	Firewall FirewallConfig `yaml:"firewall"`
+	// Auth authenticates clients by JWT, token introspection or API key
+	Auth AuthConfig `yaml:"auth"`
+	// DecisionLog writes a record of every protection decision for offline
+	// analysis
+	DecisionLog DecisionLogConfig `yaml:"decisionLog"`
+	// Audit samples requests with their headers and outcome into batches
+	// uploaded to object storage
+	Audit AuditConfig `yaml:"audit"`
+	// PathTemplates maps request paths to endpoints such as /users/{id}
+	// for metrics, per endpoint limits and logs
+	PathTemplates PathTemplatesConfig `yaml:"pathTemplates"`
+	// Expensive flags slow requests and large responses
+	Expensive ExpensiveConfig `yaml:"expensive"`
+	// Quota serves callers their remaining budget
+	Quota QuotaConfig `yaml:"quota"`
+	// Status tells callers whether they are limited or blocked
+	Status StatusConfig `yaml:"status"`
+	// IdentityHeaders passes the resolved client identity to the upstream
+	IdentityHeaders IdentityHeadersConfig `yaml:"identityHeaders"`
+	// Accounting exports the usage of every authenticated client for
+	// billing
+	Accounting AccountingConfig `yaml:"accounting"`
+	// Bypass lets holders of tokens minted through the admin API skip
+	// limits and challenges during incidents
+	Bypass BypassConfig `yaml:"bypass"`
+	// Escalation blocks clients everywhere that are limited on several
+	// routes or under several keys
+	Escalation EscalationConfig `yaml:"escalation"`
+	// Review suspends borderline clients until an operator blocks or
+	// allows them
+	Review ReviewConfig `yaml:"review"`
+	// DebugTrace explains the protection decisions of single requests in
+	// their responses
+	DebugTrace DebugTraceConfig `yaml:"debugTrace"`
+	// AccessLog writes one line per request with the status and bytes sent
+	AccessLog AccessLogConfig `yaml:"accessLog"`
+	// IPLists reject denied clients outright and exempt allowed ones from
+	// rate limits
+	IPLists IPListsConfig `yaml:"ipLists"`
+	// Profiles are further proxies served by this process, each with its
+	// own listener, upstream, rate limit and routes
+	Profiles []ProfileConfig `yaml:"profiles"`
 }
 
 type ServerConfig struct {
@@ -24,6 +116,52 @@ type ServerConfig struct {
 	ReadTimeout    time.Duration `yaml:"readTimeout"`
 	WriteTimeout   time.Duration `yaml:"writeTimeout"`
 	MaxHeaderBytes int           `yaml:"maxHeaderBytes"`
+	// DrainTimeout is how long shutdown waits for requests in flight before
+	// aborting them, 30 seconds by default
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+	// CheckBudget bounds the time spent on Shielder's own checks per request,
+	// after which the failure policies decide. 0 disables the budget
+	CheckBudget time.Duration `yaml:"checkBudget"`
+	// Connections limits client connections at the listener, before any
+	// request is parsed
+	Connections ConnectionLimitConfig `yaml:"connections"`
+	// TLS terminates TLS on the listen address when a certificate is set
+	TLS ServerTLSConfig `yaml:"tls"`
+	// Streaming applies to WebSocket upgrades, Server-Sent Events and
+	// requests on streaming routes
+	Streaming StreamingConfig `yaml:"streaming"`
+}
+
+// StreamingConfig exempts long-lived requests from ReadTimeout and
+// WriteTimeout, which would cut them off, and caps their duration instead.
+// Zero MaxDuration leaves them open until either side closes
+type StreamingConfig struct {
+	ExemptTimeouts bool          `yaml:"exemptTimeouts"`
+	MaxDuration    time.Duration `yaml:"maxDuration"`
+}
+
+// ConnectionLimitConfig blunts connection floods. Zero disables a limit
+type ConnectionLimitConfig struct {
+	MaxConns int `yaml:"maxConns"`
+	// PerIPPerSecond is how many new connections a source IP may open per
+	// second, with bursts of up to PerIPBurst
+	PerIPPerSecond float64 `yaml:"perIPPerSecond"`
+	PerIPBurst     int     `yaml:"perIPBurst"`
+}
+
+// ServerTLSConfig configures TLS termination and the handshake limits
+type ServerTLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// HandshakesPerSecond is how many handshakes a source IP may start per
+	// second, with bursts of up to HandshakeBurst. 0 disables the limit
+	HandshakesPerSecond float64 `yaml:"handshakesPerSecond"`
+	HandshakeBurst      int     `yaml:"handshakeBurst"`
+	// MaxFailures failed handshakes within FailureWindow block the source
+	// for BlockDuration. 0 disables blocking
+	MaxFailures   int           `yaml:"maxFailures"`
+	FailureWindow time.Duration `yaml:"failureWindow"`
+	BlockDuration time.Duration `yaml:"blockDuration"`
 }
 
 type RedisConfig struct {
@@ -34,25 +172,1020 @@ type RedisConfig struct {
 	UseSentinel   bool     `yaml:"useSentinel"`
 	MasterName    string   `yaml:"masterName"`
 	SentinelAddrs []string `yaml:"sentinelAddrs"`
+	// ClusterAddrs are seed nodes of a Redis Cluster that the rate limiter
+	// store and the state of other features are spread over instead of Addr
+	ClusterAddrs []string `yaml:"clusterAddrs"`
+	// StartupTimeout is how long startup waits for Redis before continuing
+	// in degraded mode
+	StartupTimeout time.Duration `yaml:"startupTimeout"`
+	// HealthCheckInterval controls how often the store is pinged to detect
+	// outages and recovery
+	HealthCheckInterval time.Duration `yaml:"healthCheckInterval"`
+}
+
+// StoreConfig selects the backend the rate limiter keeps its state in
+type StoreConfig struct {
+	// Backend is one of "redis" (default), "memcached", "dynamodb" or "etcd"
+	Backend   string          `yaml:"backend"`
+	Memcached MemcachedConfig `yaml:"memcached"`
+	DynamoDB  DynamoDBConfig  `yaml:"dynamodb"`
+	Etcd      EtcdConfig      `yaml:"etcd"`
+	// LocalCache puts an in-process cache in front of the redis backend
+	LocalCache LocalCacheConfig `yaml:"localCache"`
+}
+
+// LocalCacheConfig caches block lookups locally, kept in sync across
+// instances through Redis pub/sub
+type LocalCacheConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Channel     string        `yaml:"channel"`
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
+	MaxEntries  int           `yaml:"maxEntries"`
+}
+
+type MemcachedConfig struct {
+	Servers      []string      `yaml:"servers"`
+	Timeout      time.Duration `yaml:"timeout"`
+	MaxIdleConns int           `yaml:"maxIdleConns"`
+}
+
+type DynamoDBConfig struct {
+	Table    string `yaml:"table"`
+	Region   string `yaml:"region"`
+	Endpoint string `yaml:"endpoint"`
+	// Throttled requests are retried with exponential backoff
+	MaxRetries  int           `yaml:"maxRetries"`
+	BaseBackoff time.Duration `yaml:"baseBackoff"`
+	MaxBackoff  time.Duration `yaml:"maxBackoff"`
+}
+
+type EtcdConfig struct {
+	Endpoints   []string      `yaml:"endpoints"`
+	Username    string        `yaml:"username"`
+	Password    string        `yaml:"password"`
+	DialTimeout time.Duration `yaml:"dialTimeout"`
+	Prefix      string        `yaml:"prefix"`
 }
 
 type RateLimitConfig struct {
 	RequestsPerMinute int           `yaml:"requestsPerMinute"`
 	BurstSize         int           `yaml:"burstSize"`
 	BlockDuration     time.Duration `yaml:"blockDuration"`
+	// FailurePolicy is "closed" (reject requests), "open" (allow requests) or
+	// "local" (limit each client in memory, per instance) while the store is
+	// unavailable
+	FailurePolicy string `yaml:"failurePolicy"`
+	// Algorithm is fixed_window (default), sliding_window, sliding_log or
+	// token_bucket, the last two need the redis store backend, or an
+	// algorithm compiled in with plugin.RegisterAlgorithm. Token buckets
+	// hold BurstSize tokens and refill at RequestsPerMinute
+	Algorithm string `yaml:"algorithm"`
+	// ShadowAlgorithm is evaluated next to the enforcing algorithm and only
+	// reported on, empty disables the comparison
+	ShadowAlgorithm string `yaml:"shadowAlgorithm"`
+	// KeyStrategy is what clients are limited by: ip (default), header,
+	// jwt (the subject of tokens verified by auth) or cookie. Requests
+	// without the header, token or cookie are limited by IP
+	KeyStrategy string `yaml:"keyStrategy"`
+	// KeyName is the header or cookie holding the key
+	KeyName string `yaml:"keyName"`
+	// InstanceCeiling caps the requests per second a single instance lets
+	// through regardless of the store, zero disables it
+	InstanceCeiling      float64 `yaml:"instanceCeiling"`
+	InstanceCeilingBurst int     `yaml:"instanceCeilingBurst"`
+	// RequestCost is what a request counts as against the limits, one by
+	// default. HEAD requests and conditional GETs count as LightRequestCost,
+	// RequestCost by default
+	RequestCost      int `yaml:"requestCost"`
+	LightRequestCost int `yaml:"lightRequestCost"`
+}
+
+// DiscoveryConfig finds the upstream targets in DNS, the Consul catalog or
+// the Endpoints of a Kubernetes service. Targets, if any, are used until the
+// first lookup
+type DiscoveryConfig struct {
+	// Type is srv for SRV records, a for the A and AAAA records of a
+	// headless service, consul or kubernetes; empty disables discovery
+	Type string `yaml:"type"`
+	// Name is the record name, or the service name in Consul and Kubernetes
+	Name string `yaml:"name"`
+	// Port is the target port of a records
+	Port   int    `yaml:"port"`
+	Scheme string `yaml:"scheme"`
+	// Interval between DNS lookups, Consul and Kubernetes are watched
+	Interval   time.Duration             `yaml:"interval"`
+	Consul     ConsulDiscoveryConfig     `yaml:"consul"`
+	Kubernetes KubernetesDiscoveryConfig `yaml:"kubernetes"`
+}
+
+// ConsulDiscoveryConfig watches the passing instances of a Consul service
+type ConsulDiscoveryConfig struct {
+	// Address of the Consul agent, http://127.0.0.1:8500 by default
+	Address string `yaml:"address"`
+	// Token is read from CONSUL_HTTP_TOKEN when empty
+	Token      string `yaml:"token"`
+	Datacenter string `yaml:"datacenter"`
+	Tag        string `yaml:"tag"`
+}
+
+// KubernetesDiscoveryConfig watches the ready endpoints of a Kubernetes
+// service. Empty fields are taken from the pod's service account
+type KubernetesDiscoveryConfig struct {
+	APIServer string `yaml:"apiServer"`
+	Namespace string `yaml:"namespace"`
+	// PortName picks the endpoint port, the first one by default
+	PortName string `yaml:"portName"`
+}
+
+// HealthCheckConfig requests Path on every target each Interval. A target
+// is ejected after UnhealthyThreshold consecutive failures and re-added
+// after HealthyThreshold consecutive 2xx responses
+type HealthCheckConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthyThreshold"`
+	UnhealthyThreshold int           `yaml:"unhealthyThreshold"`
 }
 
 type MetricsConfig struct {
 	Enabled bool   `yaml:"enabled"`
 	Path    string `yaml:"path"`
+	// ListenAddr serves metrics on a listener of their own, empty serves
+	// them at Path on the proxy listener
+	ListenAddr string `yaml:"listenAddr"`
+	// Routes lists the routes reported as their own series, the others are
+	// reported as "other". Empty reports every route
+	Routes []string `yaml:"routes"`
+	// PathLabel is "path" (default) to label request durations with the
+	// request path, or its template when PathTemplates are configured, or
+	// "route" to label them with the route
+	PathLabel string `yaml:"pathLabel"`
+	// ClientLabel is how per client counters are labeled: "ip" (default)
+	// with the client key, "subnet" with the /IPv4Prefix or /IPv6Prefix
+	// subnet of its address, 24 and 48 by default, or "none" to leave the
+	// label out
+	ClientLabel string `yaml:"clientLabel"`
+	IPv4Prefix  int    `yaml:"ipv4Prefix"`
+	IPv6Prefix  int    `yaml:"ipv6Prefix"`
+	// MaxClientLabels bounds the distinct client label values, the others
+	// are reported as "other". 0 uses the default of 1000
+	MaxClientLabels int `yaml:"maxClientLabels"`
 }
 
 type ProxyConfig struct {
-	TargetURL         string   `yaml:"targetURL"`
-	TrustedProxies    []string `yaml:"trustedProxies"`
-	AllowedDomains    []string `yaml:"allowedDomains"`
+	TargetURL string `yaml:"targetURL"`
+	// Targets balances requests over several upstream URLs instead of
+	// TargetURL
+	Targets []string `yaml:"targets"`
+	// SlowStart ramps the traffic share of targets that were added or
+	// recovered up to full over this window, 0 disables it
+	SlowStart time.Duration `yaml:"slowStart"`
+	// Discovery keeps the targets in sync with a service registry
+	Discovery DiscoveryConfig `yaml:"discovery"`
+	// HealthCheck ejects targets failing active health checks
+	HealthCheck HealthCheckConfig `yaml:"healthCheck"`
+	// TrustedProxies are CIDRs or addresses of proxies in front of
+	// Shielder, whose forwarding headers name the client
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// ClientIPHeaders are read in order for the client address of requests
+	// from trusted proxies: X-Forwarded-For, Forwarded or X-Real-IP.
+	// Defaults to X-Forwarded-For and X-Real-IP
+	ClientIPHeaders []string `yaml:"clientIPHeaders"`
+	AllowedDomains  []string `yaml:"allowedDomains"`
+	// BlockedCountries are ISO 3166 alpha-2 codes whose clients are
+	// rejected with 403 when EnableGeoBlocking is set. Clients are located
+	// with the geoip country database and overrides
 	BlockedCountries  []string `yaml:"blockedCountries"`
 	EnableGeoBlocking bool     `yaml:"enableGeoBlocking"`
+	// NormalizeURLs canonicalizes paths and hosts before routing, filtering
+	// and caching, and forwards the canonical form
+	NormalizeURLs bool `yaml:"normalizeURLs"`
+	// MaxRequestBodyBytes rejects requests with larger bodies with 413
+	// before they reach the target, 0 disables the limit
+	MaxRequestBodyBytes int64 `yaml:"maxRequestBodyBytes"`
+	// EgressProxy is an http(s) or socks5 proxy URL the target is reached
+	// through, empty falls back to the HTTP_PROXY environment variables
+	EgressProxy string `yaml:"egressProxy"`
+	// UpstreamDial selects the address family used to reach the target
+	UpstreamDial UpstreamDialConfig `yaml:"upstreamDial"`
+	// UpstreamLimits caps connections opened towards every target address
+	UpstreamLimits UpstreamLimitsConfig `yaml:"upstreamLimits"`
+	// UpstreamTransport tunes connection reuse and timeouts towards the
+	// target
+	UpstreamTransport UpstreamTransportConfig `yaml:"upstreamTransport"`
+	// Informational controls how 1xx responses of the target, such as 103
+	// Early Hints, are passed on to clients
+	Informational InformationalConfig `yaml:"informational"`
+	// ConditionalCache answers HEAD requests and conditional GETs from the
+	// headers of recent responses
+	ConditionalCache ConditionalCacheConfig `yaml:"conditionalCache"`
+	// CircuitBreaker stops forwarding the requests of a route while the
+	// target fails them
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker"`
+}
+
+// CircuitBreakerConfig opens the circuit of a route once FailureRatio of at
+// least MinRequests within Window failed, rejecting requests with 503 for
+// OpenDuration, and lets HalfOpenProbes requests through before closing it
+// again. Zero values use the defaults
+type CircuitBreakerConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	Window         time.Duration `yaml:"window"`
+	MinRequests    int           `yaml:"minRequests"`
+	FailureRatio   float64       `yaml:"failureRatio"`
+	OpenDuration   time.Duration `yaml:"openDuration"`
+	HalfOpenProbes int           `yaml:"halfOpenProbes"`
+	// FallbackBody, when set, is sent with the 503 responses instead of
+	// the default text, with FallbackContentType
+	FallbackBody        string `yaml:"fallbackBody"`
+	FallbackContentType string `yaml:"fallbackContentType"`
+}
+
+// ConditionalCacheConfig keeps the headers of up to MaxEntries responses,
+// 10000 by default, for TTL at most; zero TTL disables the cache
+type ConditionalCacheConfig struct {
+	TTL        time.Duration `yaml:"ttl"`
+	MaxEntries int           `yaml:"maxEntries"`
+}
+
+type InformationalConfig struct {
+	// Drop discards 1xx responses instead of forwarding them
+	Drop bool `yaml:"drop"`
+	// Headers limits the headers forwarded with 1xx responses, empty
+	// forwards all of them
+	Headers []string `yaml:"headers"`
+}
+
+type UpstreamDialConfig struct {
+	// IPFamily is dualStack, preferIPv4, preferIPv6, ipv4 or ipv6
+	IPFamily string `yaml:"ipFamily"`
+	// FallbackDelay is how long the first family gets before the other one
+	// is raced, negative waits for the first family to fail
+	FallbackDelay time.Duration `yaml:"fallbackDelay"`
+}
+
+type UpstreamLimitsConfig struct {
+	MaxConns             int           `yaml:"maxConns"`
+	MaxNewConnsPerSecond float64       `yaml:"maxNewConnsPerSecond"`
+	NewConnBurst         int           `yaml:"newConnBurst"`
+	ConnWaitTimeout      time.Duration `yaml:"connWaitTimeout"`
+}
+
+// UpstreamTransportConfig tunes the connections to the target, zero values
+// use the defaults
+type UpstreamTransportConfig struct {
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost"`
+	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout"`
+	DialTimeout         time.Duration `yaml:"dialTimeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tlsHandshakeTimeout"`
+	// ResponseHeaderTimeout bounds the wait for response headers after the
+	// request was sent, zero waits as long as the request lasts
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+	// Prewarm keeps connections to the target open through quiet spells
+	Prewarm PrewarmConfig `yaml:"prewarm"`
+}
+
+// PrewarmConfig opens Conns connections to every target at startup and again
+// for targets that received no requests for Interval, so that the first
+// requests after a quiet spell do not pay for TCP and TLS handshakes. Zero
+// Conns disables pre-warming.
+type PrewarmConfig struct {
+	Conns    int           `yaml:"conns"`
+	Interval time.Duration `yaml:"interval"`
+	Path     string        `yaml:"path"`
+}
+
+// RouteConfig applies route-specific behavior to requests whose path starts
+// with PathPrefix and, if Methods is set, whose method is listed
+type RouteConfig struct {
+	Name       string         `yaml:"name"`
+	PathPrefix string         `yaml:"pathPrefix"`
+	Methods    []string       `yaml:"methods"`
+	Plugins    []PluginConfig `yaml:"plugins"`
+	// SkipAuthz exempts the route from external authorization
+	SkipAuthz bool `yaml:"skipAuthz"`
+	// SkipAuth exempts the route from authentication
+	SkipAuth bool `yaml:"skipAuth"`
+	// RequestsPerMinute gives the route its own rate limit, 0 uses the
+	// global one
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+	// Preflight restricts the route to CORS preflight requests, which are
+	// then counted separately from other traffic
+	Preflight bool `yaml:"preflight"`
+	// Body controls how request bodies are read
+	Body RouteBodyConfig `yaml:"body"`
+	// Signing signs requests before they are forwarded to the target
+	Signing RouteSigningConfig `yaml:"signing"`
+	// Tag forwards blocked, rate-limited and challenged requests with
+	// X-Shielder-* headers instead of rejecting them
+	Tag bool `yaml:"tag"`
+	// Idempotency rejects or replays requests repeating an Idempotency-Key
+	Idempotency RouteIdempotencyConfig `yaml:"idempotency"`
+	// PerEndpoint counts the route limit separately for every path
+	// template under the route
+	PerEndpoint bool `yaml:"perEndpoint"`
+	// Streaming treats every request on the route as long-lived and passes
+	// response bytes on as they arrive
+	Streaming bool `yaml:"streaming"`
+}
+
+// ProfileConfig is a proxy served next to the main one, with its own
+// listener, upstream, rate limit and routes. It shares the store, metrics
+// and every other protection with the main proxy, but counts and blocks its
+// clients separately. Route names are unique across profiles, since they
+// label metrics and route limits
+type ProfileConfig struct {
+	Name       string   `yaml:"name"`
+	ListenAddr string   `yaml:"listenAddr"`
+	TargetURL  string   `yaml:"targetURL"`
+	Targets    []string `yaml:"targets"`
+	// RequestsPerMinute and BlockDuration replace the global rate limit,
+	// 0 uses it
+	RequestsPerMinute int           `yaml:"requestsPerMinute"`
+	BlockDuration     time.Duration `yaml:"blockDuration"`
+	// KeyStrategy and KeyName replace the global key strategy, empty uses
+	// it
+	KeyStrategy string        `yaml:"keyStrategy"`
+	KeyName     string        `yaml:"keyName"`
+	Routes      []RouteConfig `yaml:"routes"`
+}
+
+// QuotaConfig serves callers their limits, remaining budget and reset times
+// as JSON
+type QuotaConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+	// RequireAuth answers callers without valid credentials with 401,
+	// which needs auth
+	RequireAuth bool `yaml:"requireAuth"`
+	// RequestsPerMinute limits how often a client may ask, 0 uses the
+	// default of 30
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+}
+
+// StatusConfig serves callers whether their client key is limited or blocked,
+// why and until when, as JSON
+type StatusConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+	// RequestsPerMinute limits how often a client may ask, 0 uses the
+	// default of 30
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+	// MaxAge is how long clients may cache an answer, 0 uses the default
+	// of 5s
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// BypassConfig configures emergency bypass tokens, which are presented in
+// Header and expire after at most MaxTTL
+type BypassConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Header     string        `yaml:"header"`
+	DefaultTTL time.Duration `yaml:"defaultTTL"`
+	MaxTTL     time.Duration `yaml:"maxTTL"`
+	// Keys sign and verify tokens, the first key signs new tokens
+	Keys []ClearanceKey `yaml:"keys"`
+}
+
+// EscalationConfig promotes a client, by IP or by fingerprint, to the global
+// block list once it was blocked or rate limited on Threshold distinct
+// routes or keys within Window. The global block lasts Duration
+type EscalationConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Threshold int           `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+	Duration  time.Duration `yaml:"duration"`
+}
+
+// AccountingConfig aggregates requests, errors and bytes in and out per
+// authenticated subject into one record per period
+type AccountingConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Sink is stream (a Redis stream), csv or webhook
+	Sink       string `yaml:"sink"`
+	Stream     string `yaml:"stream"`
+	MaxLen     int64  `yaml:"maxLen"`
+	File       string `yaml:"file"`
+	WebhookURL string `yaml:"webhookURL"`
+	// WebhookToken is sent as a bearer token
+	WebhookToken string `yaml:"webhookToken"`
+	// MaxPending bounds the records kept for retrying failed exports
+	MaxPending int `yaml:"maxPending"`
+}
+
+// IdentityHeadersConfig names the headers that carry the client IP and its
+// GeoIP location to the upstream, empty names are not set. Country and ASN
+// need GeoIP databases or overrides
+type IdentityHeadersConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	ClientIP string `yaml:"clientIP"`
+	Country  string `yaml:"country"`
+	ASN      string `yaml:"asn"`
+	// Signing signs these headers and the auth identity header
+	Signing IdentitySigningConfig `yaml:"signing"`
+}
+
+// IdentitySigningConfig signs identity headers so the upstream can reject
+// ones that did not come from Shielder
+type IdentitySigningConfig struct {
+	// Format is hmac or jwt (HS256), empty disables signing
+	Format string `yaml:"format"`
+	Key    string `yaml:"key"`
+	KeyID  string `yaml:"keyID"`
+	// Header carries the signature, X-Shielder-Identity-Signature by
+	// default
+	Header string `yaml:"header"`
+	// TTL is how long JWTs are valid, one minute by default
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// ExpensiveConfig flags individual requests crossing a threshold, zero
+// thresholds are disabled
+type ExpensiveConfig struct {
+	SlowThreshold      time.Duration `yaml:"slowThreshold"`
+	LargeResponseBytes int64         `yaml:"largeResponseBytes"`
+	// LogFile receives one JSON line per flagged request, empty logs them
+	// with everything else
+	LogFile string `yaml:"logFile"`
+}
+
+// IPListsConfig holds addresses and CIDR ranges. Denied clients get 403
+// before any other check, allowed clients skip the rate limits; clients on
+// both lists are denied. The admin API reloads the lists from this file
+type IPListsConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// AccessLogConfig writes one line per request once its response was sent
+type AccessLogConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Format is json, the default, or combined: the Apache/nginx combined
+	// format followed by the latency and the upstream
+	Format string `yaml:"format"`
+	// File receives the lines, empty writes them to stdout
+	File string `yaml:"file"`
+}
+
+// PathTemplatesConfig configures how request paths map to endpoints
+type PathTemplatesConfig struct {
+	// Patterns such as /users/{id}, the first matching one wins
+	Patterns []string `yaml:"patterns"`
+	// CollapseIDs replaces numeric, UUID and long hex segments of paths
+	// no pattern matches
+	CollapseIDs bool `yaml:"collapseIDs"`
+}
+
+// RouteIdempotencyConfig remembers Idempotency-Key headers per client in Redis
+type RouteIdempotencyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Mode is reject (409 for repeats) or replay (serve the stored response)
+	Mode   string        `yaml:"mode"`
+	Window time.Duration `yaml:"window"`
+	// PendingTTL bounds how long a key stays claimed by a request in flight
+	PendingTTL time.Duration `yaml:"pendingTTL"`
+	// Methods are guarded, POST and PATCH by default
+	Methods []string `yaml:"methods"`
+	// Required rejects guarded requests without a key
+	Required     bool `yaml:"required"`
+	MaxBodyBytes int  `yaml:"maxBodyBytes"`
+}
+
+// RouteSigningConfig signs forwarded requests for upstreams that require it
+type RouteSigningConfig struct {
+	// Type is sigv4 or hmac, empty disables signing
+	Type  string             `yaml:"type"`
+	SigV4 SigV4SigningConfig `yaml:"sigv4"`
+	HMAC  HMACSigningConfig  `yaml:"hmac"`
+}
+
+// SigV4SigningConfig configures AWS Signature Version 4. Without an access
+// key, credentials come from the default AWS provider chain
+type SigV4SigningConfig struct {
+	Region          string `yaml:"region"`
+	Service         string `yaml:"service"`
+	AccessKeyID     string `yaml:"accessKeyID"`
+	SecretAccessKey string `yaml:"secretAccessKey"`
+	SessionToken    string `yaml:"sessionToken"`
+	// UnsignedPayload streams bodies without signing them, which S3 accepts
+	UnsignedPayload bool `yaml:"unsignedPayload"`
+}
+
+// HMACSigningConfig configures signing with a shared key
+type HMACSigningConfig struct {
+	Key   string `yaml:"key"`
+	KeyID string `yaml:"keyID"`
+	// Algorithm is sha256 (default) or sha512
+	Algorithm       string `yaml:"algorithm"`
+	Header          string `yaml:"header"`
+	TimestampHeader string `yaml:"timestampHeader"`
+}
+
+// RouteBodyConfig controls buffering and upload rates of request bodies
+type RouteBodyConfig struct {
+	// Mode is stream (default) or buffer, which reads bodies up to
+	// MaxBufferBytes completely once the protection checks passed, before
+	// authentication and upstream-stage plugins inspect them
+	Mode           string        `yaml:"mode"`
+	MaxBufferBytes int64         `yaml:"maxBufferBytes"`
+	Timeout        time.Duration `yaml:"timeout"`
+	// MinUploadRate in bytes per second cuts off slow uploads once
+	// UploadGrace has passed, 0 disables it
+	MinUploadRate int64         `yaml:"minUploadRate"`
+	UploadGrace   time.Duration `yaml:"uploadGrace"`
+}
+
+// PluginConfig enables a registered plugin on a route
+type PluginConfig struct {
+	Name   string         `yaml:"name"`
+	Config map[string]any `yaml:"config"`
+}
+
+// HistoryConfig controls durable storage of block events in a SQL database
+type HistoryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Driver is "sqlite" or "postgres"
+	Driver     string        `yaml:"driver"`
+	DSN        string        `yaml:"dsn"`
+	Retention  time.Duration `yaml:"retention"`
+	BufferSize int           `yaml:"bufferSize"`
+}
+
+// ReplicationConfig configures cross-region replication of block events
+type ReplicationConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Region  string `yaml:"region"`
+	Stream  string `yaml:"stream"`
+	MaxLen  int64  `yaml:"maxLen"`
+	// BufferSize is how many events wait to be published before new ones
+	// are dropped
+	BufferSize int `yaml:"bufferSize"`
+	// Peers are the region-local Redis servers of the other regions
+	Peers []ReplicationPeer `yaml:"peers"`
+}
+
+// AuthzConfig configures an external authorization service speaking the
+// HTTP or gRPC protocol of Envoy's ext_authz filter
+type AuthzConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Mode is "http" or "grpc"
+	Mode string `yaml:"mode"`
+	// Address is a base URL in http mode and host:port in grpc mode
+	Address    string        `yaml:"address"`
+	PathPrefix string        `yaml:"pathPrefix"`
+	Timeout    time.Duration `yaml:"timeout"`
+	// FailurePolicy is "closed" (reject requests) or "open" (allow requests)
+	// while the service is unavailable
+	FailurePolicy string `yaml:"failurePolicy"`
+	// Headers sent to the service and accepted from it in http mode
+	AllowedRequestHeaders  []string         `yaml:"allowedRequestHeaders"`
+	AllowedUpstreamHeaders []string         `yaml:"allowedUpstreamHeaders"`
+	Cache                  AuthzCacheConfig `yaml:"cache"`
+}
+
+// AuthzCacheConfig caches verdicts keyed by method, host, path and KeyHeaders
+type AuthzCacheConfig struct {
+	TTL        time.Duration `yaml:"ttl"`
+	MaxEntries int           `yaml:"maxEntries"`
+	KeyHeaders []string      `yaml:"keyHeaders"`
+}
+
+// AuthConfig authenticates clients before requests are forwarded. Lookups
+// are cached in Redis, valid and invalid credentials with separate TTLs
+type AuthConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Optional lets requests without credentials through unauthenticated
+	Optional bool `yaml:"optional"`
+	// IdentityHeader carries the authenticated subject to the upstream
+	IdentityHeader string                  `yaml:"identityHeader"`
+	Timeout        time.Duration           `yaml:"timeout"`
+	JWT            AuthJWTConfig           `yaml:"jwt"`
+	Introspection  AuthIntrospectionConfig `yaml:"introspection"`
+	APIKey         AuthAPIKeyConfig        `yaml:"apiKey"`
+}
+
+// AuthJWTConfig verifies JWTs locally against a cached JWKS document
+type AuthJWTConfig struct {
+	JWKSURL    string        `yaml:"jwksURL"`
+	Issuer     string        `yaml:"issuer"`
+	Audience   []string      `yaml:"audience"`
+	Algorithms []string      `yaml:"algorithms"`
+	JWKSTTL    time.Duration `yaml:"jwksTTL"`
+}
+
+// AuthIntrospectionConfig introspects opaque bearer tokens (RFC 7662)
+type AuthIntrospectionConfig struct {
+	URL      string `yaml:"url"`
+	ClientID string `yaml:"clientID"`
+	// ClientSecret defaults to the AUTH_INTROSPECTION_CLIENT_SECRET
+	// environment variable
+	ClientSecret string        `yaml:"clientSecret"`
+	TTL          time.Duration `yaml:"ttl"`
+	NegativeTTL  time.Duration `yaml:"negativeTTL"`
+	// Service protects the calls to the introspection endpoint
+	Service AuthServiceConfig `yaml:"service"`
+}
+
+// AuthAPIKeyConfig looks up API keys with a key service
+type AuthAPIKeyConfig struct {
+	Header      string        `yaml:"header"`
+	LookupURL   string        `yaml:"lookupURL"`
+	TTL         time.Duration `yaml:"ttl"`
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
+	// Service protects the calls to the key service
+	Service AuthServiceConfig `yaml:"service"`
+}
+
+// AuthServiceConfig bounds the calls to an identity service by Timeout,
+// auth.timeout by default, stops calling it for OpenDuration after
+// FailureThreshold consecutive failures, and keeps valid lookups StaleTTL
+// past their TTL to answer from while it fails
+type AuthServiceConfig struct {
+	Timeout          time.Duration `yaml:"timeout"`
+	StaleTTL         time.Duration `yaml:"staleTTL"`
+	FailureThreshold int           `yaml:"failureThreshold"`
+	OpenDuration     time.Duration `yaml:"openDuration"`
+}
+
+// AdminConfig configures the token-protected admin API
+type AdminConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	ListenAddr string `yaml:"listenAddr"`
+	Token      string `yaml:"token"`
+	// OIDC lets operators log in with corporate SSO instead of the token
+	OIDC AdminOIDCConfig `yaml:"oidc"`
+}
+
+// AdminOIDCConfig configures the OpenID Connect login of the admin API.
+// Group members get the admin or the read-only viewer role
+type AdminOIDCConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectURL"`
+	Scopes       []string `yaml:"scopes"`
+	GroupsClaim  string   `yaml:"groupsClaim"`
+	AdminGroups  []string `yaml:"adminGroups"`
+	ViewerGroups []string `yaml:"viewerGroups"`
+	// SessionSecret signs session cookies, shared by all instances
+	SessionSecret string        `yaml:"sessionSecret"`
+	SessionTTL    time.Duration `yaml:"sessionTTL"`
+	SecureCookie  bool          `yaml:"secureCookie"`
+}
+
+// ClearanceConfig configures signed clearance cookies that let clients which
+// passed a challenge or were trusted by an operator skip further challenges
+type ClearanceConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	CookieName string        `yaml:"cookieName"`
+	TTL        time.Duration `yaml:"ttl"`
+	Secure     bool          `yaml:"secure"`
+	Domain     string        `yaml:"domain"`
+	// Keys sign and verify tokens, the first key signs new tokens
+	Keys []ClearanceKey `yaml:"keys"`
+}
+
+// SessionConfig configures per-session rate limits. Requests with a session
+// count against RequestsPerMinute for the session and IPRequestsPerMinute for
+// the IP, requests without one against the regular rate limit of their IP
+type SessionConfig struct {
+	Enabled             bool          `yaml:"enabled"`
+	CookieName          string        `yaml:"cookieName"`
+	Secret              string        `yaml:"secret"`
+	TTL                 time.Duration `yaml:"ttl"`
+	Secure              bool          `yaml:"secure"`
+	Domain              string        `yaml:"domain"`
+	RequestsPerMinute   int           `yaml:"requestsPerMinute"`
+	IPRequestsPerMinute int           `yaml:"ipRequestsPerMinute"`
+}
+
+// AnomalyConfig configures anomaly detection against per-route baselines
+// kept in Redis
+type AnomalyConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Alpha is the EWMA smoothing factor
+	Alpha    float64 `yaml:"alpha"`
+	Seasonal bool    `yaml:"seasonal"`
+	// MinSamples is the number of intervals learned before detection starts
+	MinSamples          int     `yaml:"minSamples"`
+	RateThreshold       float64 `yaml:"rateThreshold"`
+	ErrorRatioThreshold float64 `yaml:"errorRatioThreshold"`
+	MinRate             float64 `yaml:"minRate"`
+	// TightenFactor scales the limits of anomalous routes, 1 disables it
+	TightenFactor   float64       `yaml:"tightenFactor"`
+	TightenDuration time.Duration `yaml:"tightenDuration"`
+}
+
+// TuningConfig configures shadow observation of client rates, from which
+// per-route limits are recommended through the admin API
+type TuningConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	Quantile       float64       `yaml:"quantile"`
+	Headroom       float64       `yaml:"headroom"`
+	MinObservation time.Duration `yaml:"minObservation"`
+}
+
+// UnderAttackConfig configures the heightened security mode. When enabled,
+// the mode can be switched through the admin API, by schedule or by the
+// automatic triggers, and Active switches it on permanently
+type UnderAttackConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Active  bool `yaml:"active"`
+	// TightenFactor scales rate limits while the mode is active
+	TightenFactor float64 `yaml:"tightenFactor"`
+	// Challenge challenges clients without a clearance cookie, which
+	// requires clearance to be enabled
+	Challenge           bool                  `yaml:"challenge"`
+	ChallengeDifficulty int                   `yaml:"challengeDifficulty"`
+	Schedule            []UnderAttackWindow   `yaml:"schedule"`
+	Auto                UnderAttackAutoConfig `yaml:"auto"`
+}
+
+type UnderAttackWindow struct {
+	Start time.Time `yaml:"start"`
+	End   time.Time `yaml:"end"`
+}
+
+// UnderAttackAutoConfig activates the mode when the fleet sees more requests
+// or rejections per second, 0 disables a trigger
+type UnderAttackAutoConfig struct {
+	RequestsPerSecond float64       `yaml:"requestsPerSecond"`
+	BlocksPerSecond   float64       `yaml:"blocksPerSecond"`
+	Duration          time.Duration `yaml:"duration"`
+}
+
+// TapConfig configures per-client request capture. Taps are started through
+// the admin API, which has to be enabled
+type TapConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Dir is where tap files are written, empty allows streaming only
+	Dir          string        `yaml:"dir"`
+	MaxDuration  time.Duration `yaml:"maxDuration"`
+	MaxBodyBytes int           `yaml:"maxBodyBytes"`
+	// RedactHeaders and RedactQuery are redacted in addition to credential
+	// headers such as Authorization and Cookie
+	RedactHeaders []string `yaml:"redactHeaders"`
+	RedactQuery   []string `yaml:"redactQuery"`
+}
+
+// UpgradeConfig configures zero-downtime binary upgrades
+type UpgradeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Mode is handoff, which passes the listening sockets to the new
+	// process, or reusePort, which lets it bind them again
+	Mode string `yaml:"mode"`
+	// ReadyTimeout is how long the new process has to start serving
+	ReadyTimeout time.Duration `yaml:"readyTimeout"`
+}
+
+// FleetConfig configures the instance registry
+type FleetConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// HeartbeatInterval is how often the instance refreshes its record and
+	// polls for commands, it drops out after three missed heartbeats
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"`
+}
+
+// SettingsConfig configures runtime settings, which override the limits of
+// this file for the whole fleet once they are changed via the admin API
+type SettingsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PollInterval is how often settings are read in case a change
+	// announcement was missed
+	PollInterval time.Duration `yaml:"pollInterval"`
+}
+
+// FingerprintConfig configures fingerprint linkage: clients sharing the
+// fingerprint of a recently limited client on another IP get a tighter limit
+type FingerprintConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TLSHeader carries a JA3 or JA4 fingerprint set by a TLS terminator
+	TLSHeader string `yaml:"tlsHeader"`
+	// Headers go into the fingerprint next to the User-Agent
+	Headers []string `yaml:"headers"`
+	// CarryOver is the share of the limit such clients lose, 0 to 1
+	CarryOver float64 `yaml:"carryOver"`
+	// Window is how long the fingerprint of a limited client is remembered
+	Window time.Duration `yaml:"window"`
+}
+
+// GreylistConfig configures greylisting of first-seen clients
+type GreylistConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Duration is how long new clients stay greylisted
+	Duration time.Duration `yaml:"duration"`
+	// Memory is how long a client counts as seen after its last request
+	Memory        time.Duration `yaml:"memory"`
+	TightenFactor float64       `yaml:"tightenFactor"`
+	// Challenge challenges greylisted clients instead, requires clearance
+	Challenge bool `yaml:"challenge"`
+}
+
+// ReviewConfig suspends clients whose requests score between MinScore and
+// MaxScore, tightening their limits or challenging them, and queues them for
+// review through the admin API
+type ReviewConfig struct {
+	Enabled       bool    `yaml:"enabled"`
+	MinScore      float64 `yaml:"minScore"`
+	MaxScore      float64 `yaml:"maxScore"`
+	TightenFactor float64 `yaml:"tightenFactor"`
+	// Challenge challenges suspended clients instead, requires clearance
+	Challenge bool `yaml:"challenge"`
+	// TTL is how long a suspension waits for review
+	TTL           time.Duration `yaml:"ttl"`
+	BlockDuration time.Duration `yaml:"blockDuration"`
+	// AllowDuration is how long allowed clients are not suspended again
+	AllowDuration time.Duration `yaml:"allowDuration"`
+}
+
+// DebugTraceConfig adds a breakdown of the protection checks to the
+// responses of requests carrying a token minted through the admin API, or
+// coming from IPs traced through it
+type DebugTraceConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Header  string `yaml:"header"`
+	// Key signs tokens, at least 32 bytes. Read from DEBUG_TRACE_KEY when
+	// empty
+	Key string `yaml:"key"`
+	// MaxTTL bounds tokens and traced IPs
+	MaxTTL time.Duration `yaml:"maxTTL"`
+}
+
+// FeedbackConfig configures false positive reports
+type FeedbackConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// AutoUnblock unblocks reported clients unless a report says otherwise
+	AutoUnblock bool `yaml:"autoUnblock"`
+	// MaxCases is how many recent cases are kept
+	MaxCases int `yaml:"maxCases"`
+}
+
+// FirewallConfig configures the host firewall outputs
+type FirewallConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// LogFile receives a line per block and unblock for fail2ban
+	LogFile string `yaml:"logFile"`
+	// Command is run as "command block|unblock <ip> <seconds> <reason>"
+	Command    string        `yaml:"command"`
+	Timeout    time.Duration `yaml:"timeout"`
+	BufferSize int           `yaml:"bufferSize"`
+}
+
+// DecisionLogConfig configures the decision log files and their upload to
+// object storage
+type DecisionLogConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// MaxBytes and MaxAge rotate the current file
+	MaxBytes int64         `yaml:"maxBytes"`
+	MaxAge   time.Duration `yaml:"maxAge"`
+	// MaxFiles is the number of completed files kept locally, 0 keeps all
+	MaxFiles   int                     `yaml:"maxFiles"`
+	Compress   bool                    `yaml:"compress"`
+	BufferSize int                     `yaml:"bufferSize"`
+	Upload     DecisionLogUploadConfig `yaml:"upload"`
+}
+
+// AuditConfig samples SampleRate of the requests into gzipped batches of
+// JSON lines, uploaded with a PUT to Upload.URL/<batch> once they hold
+// BatchRecords records or are BatchAge old
+type AuditConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	SampleRate   float64       `yaml:"sampleRate"`
+	BatchRecords int           `yaml:"batchRecords"`
+	BatchAge     time.Duration `yaml:"batchAge"`
+	BufferSize   int           `yaml:"bufferSize"`
+	// RedactHeaders are headers whose values are not recorded, empty
+	// redacts Authorization, Proxy-Authorization, Cookie and Set-Cookie
+	RedactHeaders []string          `yaml:"redactHeaders"`
+	Upload        AuditUploadConfig `yaml:"upload"`
+}
+
+// AuditUploadConfig uploads batches to S3, or to GCS through its
+// S3-compatible XML API with HMAC keys
+type AuditUploadConfig struct {
+	// URL is a bucket URL such as https://bucket.s3.eu-west-1.amazonaws.com/audit
+	// or https://storage.googleapis.com/bucket/audit
+	URL string `yaml:"url"`
+	// Signing signs uploads, usually sigv4 with service s3
+	Signing RouteSigningConfig `yaml:"signing"`
+}
+
+// DecisionLogUploadConfig uploads completed files with a PUT to URL/<file>
+type DecisionLogUploadConfig struct {
+	// URL is a bucket URL such as https://bucket.s3.eu-west-1.amazonaws.com/decisions,
+	// empty keeps files local
+	URL string `yaml:"url"`
+	// KeepUploaded keeps uploaded files in the local directory
+	KeepUploaded bool `yaml:"keepUploaded"`
+	// Signing signs uploads, usually sigv4 with service s3
+	Signing RouteSigningConfig `yaml:"signing"`
+}
+
+// WAFSyncConfig configures the WAF provider lists blocks are synced with
+type WAFSyncConfig struct {
+	Interval time.Duration         `yaml:"interval"`
+	Targets  []WAFSyncTargetConfig `yaml:"targets"`
+}
+
+// WAFSyncTargetConfig is a provider list synced in one direction. Export
+// lists are owned by Shielder, entries it did not block are removed
+type WAFSyncTargetConfig struct {
+	Name string `yaml:"name"`
+	// Direction is export or import
+	Direction string `yaml:"direction"`
+	// Type is cloudflare or aws
+	Type       string               `yaml:"type"`
+	Cloudflare CloudflareListConfig `yaml:"cloudflare"`
+	AWS        AWSWAFIPSetConfig    `yaml:"aws"`
+}
+
+// CloudflareListConfig identifies an account-level Cloudflare IP list
+type CloudflareListConfig struct {
+	AccountID string `yaml:"accountID"`
+	ListID    string `yaml:"listID"`
+	// APIToken defaults to the CLOUDFLARE_API_TOKEN environment variable
+	APIToken string `yaml:"apiToken"`
+}
+
+// AWSWAFIPSetConfig identifies an AWS WAF IP set. Without an access key,
+// credentials come from the default AWS provider chain
+type AWSWAFIPSetConfig struct {
+	Region string `yaml:"region"`
+	// Scope is REGIONAL or CLOUDFRONT
+	Scope           string `yaml:"scope"`
+	Name            string `yaml:"name"`
+	ID              string `yaml:"id"`
+	AccessKeyID     string `yaml:"accessKeyID"`
+	SecretAccessKey string `yaml:"secretAccessKey"`
+}
+
+// GeoIPConfig configures the databases that are downloaded on a schedule
+type GeoIPConfig struct {
+	RefreshInterval time.Duration `yaml:"refreshInterval"`
+	// StaleAfter is the age at which a database is reported as stale
+	StaleAfter time.Duration `yaml:"staleAfter"`
+	// LicenseKey replaces {licenseKey} in download URLs
+	LicenseKey string                `yaml:"licenseKey"`
+	Databases  []GeoIPDatabaseConfig `yaml:"databases"`
+	// CountryDatabase and ASNDatabase name the databases used to locate
+	// clients
+	CountryDatabase string `yaml:"countryDatabase"`
+	ASNDatabase     string `yaml:"asnDatabase"`
+	// Overrides correct the location of networks the databases get wrong
+	// and take precedence over them
+	Overrides []GeoIPOverrideConfig `yaml:"overrides"`
+}
+
+// GeoIPOverrideConfig sets the location of a network. Fields left empty
+// keep the database result.
+type GeoIPOverrideConfig struct {
+	CIDR         string `yaml:"cidr"`
+	Country      string `yaml:"country"`
+	ASN          uint   `yaml:"asn"`
+	Organization string `yaml:"organization"`
+}
+
+// GeoIPDatabaseConfig describes a database and where to download it from
+type GeoIPDatabaseConfig struct {
+	Name string `yaml:"name"`
+	// Type is mmdb for MaxMind databases, plain or tar.gz, or list for
+	// files with an IP or CIDR per line
+	Type string `yaml:"type"`
+	// URL is downloaded on every refresh, empty only loads Path
+	URL string `yaml:"url"`
+	// ChecksumURL points to the SHA-256 of the download
+	ChecksumURL string `yaml:"checksumURL"`
+	Path        string `yaml:"path"`
+}
+
+// TrustedIdentity identifies health check or monitoring traffic. Every
+// criterion that is set has to match, and CIDRs or a token are required
+type TrustedIdentity struct {
+	Name  string   `yaml:"name"`
+	CIDRs []string `yaml:"cidrs"`
+	// UserAgents match when the User-Agent contains one of them
+	UserAgents []string `yaml:"userAgents"`
+	// Header and Token match a shared secret sent by the monitor
+	Header string `yaml:"header"`
+	Token  string `yaml:"token"`
+}
+
+type ClearanceKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+type ReplicationPeer struct {
+	Region   string `yaml:"region"`
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
 }
 
 // Load reads the configuration from a YAML file and environment variables
@@ -69,6 +1202,9 @@ func Load(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("error loading environment variables: %w", err)
 	}
 
+	// Fill in defaults for optional settings
+	applyDefaults(config)
+
 	// Validate the configuration
 	if err := validate(config); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -77,6 +1213,18 @@ func Load(configPath string) (*Config, error) {
 	return config, nil
 }
 
+// Hash identifies the effective configuration, after environment overrides
+// and defaults, so that instances running different configurations can be
+// told apart
+func (c *Config) Hash() string {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
 // readConfigFile reads and parses the YAML configuration file
 func readConfigFile(configPath string, config *Config) error {
 	file, err := os.ReadFile(configPath)
@@ -107,6 +1255,21 @@ func loadEnvOverrides(config *Config) error {
 		config.Redis.Password = password
 	}
 
+	// Egress proxy, which usually embeds credentials
+	if egress := os.Getenv("SHIELDER_EGRESS_PROXY"); egress != "" {
+		config.Proxy.EgressProxy = egress
+	}
+
+	// Rate limit failure policy
+	if policy := os.Getenv("RATE_LIMIT_FAILURE_POLICY"); policy != "" {
+		config.RateLimit.FailurePolicy = policy
+	}
+
+	// Store configuration
+	if backend := os.Getenv("STORE_BACKEND"); backend != "" {
+		config.Store.Backend = backend
+	}
+
 	// Rate limit configuration
 	if rpm := os.Getenv("RATE_LIMIT_REQUESTS_PER_MINUTE"); rpm != "" {
 		var requestsPerMinute int
@@ -115,6 +1278,59 @@ func loadEnvOverrides(config *Config) error {
 		}
 	}
 
+	// Admin configuration
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		config.Admin.Token = token
+	}
+	if secret := os.Getenv("ADMIN_OIDC_CLIENT_SECRET"); secret != "" {
+		config.Admin.OIDC.ClientSecret = secret
+	}
+	if secret := os.Getenv("ADMIN_OIDC_SESSION_SECRET"); secret != "" {
+		config.Admin.OIDC.SessionSecret = secret
+	}
+
+	if token := os.Getenv("ACCOUNTING_WEBHOOK_TOKEN"); token != "" {
+		config.Accounting.WebhookToken = token
+	}
+	if key := os.Getenv("IDENTITY_SIGNING_KEY"); key != "" {
+		config.IdentityHeaders.Signing.Key = key
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" && config.Proxy.Discovery.Consul.Token == "" {
+		config.Proxy.Discovery.Consul.Token = token
+	}
+	if key := os.Getenv("DEBUG_TRACE_KEY"); key != "" {
+		config.DebugTrace.Key = key
+	}
+
+	// GeoIP configuration
+	if key := os.Getenv("MAXMIND_LICENSE_KEY"); key != "" {
+		config.GeoIP.LicenseKey = key
+	}
+
+	// WAF sync configuration
+	if token := os.Getenv("CLOUDFLARE_API_TOKEN"); token != "" {
+		for i := range config.WAFSync.Targets {
+			if config.WAFSync.Targets[i].Cloudflare.APIToken == "" {
+				config.WAFSync.Targets[i].Cloudflare.APIToken = token
+			}
+		}
+	}
+
+	// Auth configuration
+	if secret := os.Getenv("AUTH_INTROSPECTION_CLIENT_SECRET"); secret != "" {
+		config.Auth.Introspection.ClientSecret = secret
+	}
+
+	// Session configuration
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		config.Sessions.Secret = secret
+	}
+
+	// History configuration
+	if dsn := os.Getenv("HISTORY_DSN"); dsn != "" {
+		config.History.DSN = dsn
+	}
+
 	// Proxy configuration
 	if targetURL := os.Getenv("PROXY_TARGET_URL"); targetURL != "" {
 		config.Proxy.TargetURL = targetURL
@@ -123,24 +1339,837 @@ func loadEnvOverrides(config *Config) error {
 	return nil
 }
 
+// applyDefaults sets default values for optional settings left empty
+func applyDefaults(config *Config) {
+	if config.Redis.StartupTimeout == 0 {
+		config.Redis.StartupTimeout = 30 * time.Second
+	}
+	if config.Redis.HealthCheckInterval == 0 {
+		config.Redis.HealthCheckInterval = 2 * time.Second
+	}
+	if config.RateLimit.FailurePolicy == "" {
+		config.RateLimit.FailurePolicy = "closed"
+	}
+	if config.Server.DrainTimeout == 0 {
+		config.Server.DrainTimeout = 30 * time.Second
+	}
+	if config.IdentityHeaders.ClientIP == "" {
+		config.IdentityHeaders.ClientIP = "X-Shielder-Client-IP"
+	}
+	if config.Metrics.Path == "" {
+		config.Metrics.Path = "/metrics"
+	}
+	if config.Quota.Path == "" {
+		config.Quota.Path = "/.well-known/rate-limit"
+	}
+	if config.Status.Path == "" {
+		config.Status.Path = "/__shielder/status"
+	}
+	if config.Authz.Mode == "" {
+		config.Authz.Mode = "http"
+	}
+	if config.Authz.Timeout == 0 {
+		config.Authz.Timeout = 200 * time.Millisecond
+	}
+	if config.Authz.FailurePolicy == "" {
+		config.Authz.FailurePolicy = "closed"
+	}
+	if len(config.Authz.Cache.KeyHeaders) == 0 {
+		config.Authz.Cache.KeyHeaders = []string{"Authorization", "Cookie"}
+	}
+	for i := range config.Routes {
+		applyRouteDefaults(&config.Routes[i])
+	}
+	for i := range config.Profiles {
+		profile := &config.Profiles[i]
+		if profile.KeyStrategy == "" {
+			profile.KeyStrategy, profile.KeyName = config.RateLimit.KeyStrategy, config.RateLimit.KeyName
+		}
+		for j := range profile.Routes {
+			applyRouteDefaults(&profile.Routes[j])
+		}
+	}
+}
+
+func applyRouteDefaults(route *RouteConfig) {
+	body := &route.Body
+	if body.Mode == "" {
+		body.Mode = "stream"
+	}
+	if body.Mode == "buffer" && body.MaxBufferBytes == 0 {
+		body.MaxBufferBytes = 1 << 20
+	}
+}
+
 // validate checks if the configuration is valid
 func validate(config *Config) error {
 	if config.Server.ListenAddr == "" {
 		return fmt.Errorf("server listen address is required")
 	}
 
-	if config.Proxy.TargetURL == "" {
+	if config.Proxy.TargetURL == "" && len(config.Proxy.Targets) == 0 && config.Proxy.Discovery.Type == "" {
 		return fmt.Errorf("proxy target URL is required")
 	}
+	for _, target := range config.Proxy.Targets {
+		if u, err := url.Parse(target); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("proxy target %q must be an http or https URL", target)
+		}
+	}
+	if config.Proxy.SlowStart < 0 {
+		return fmt.Errorf("proxy slow start must not be negative")
+	}
+	if d := config.Proxy.Discovery; d.Type != "" {
+		if d.Type != "srv" && d.Type != "a" && d.Type != "consul" && d.Type != "kubernetes" {
+			return fmt.Errorf("proxy discovery type must be srv, a, consul or kubernetes")
+		}
+		if d.Name == "" {
+			return fmt.Errorf("proxy discovery name is required")
+		}
+		if d.Type == "a" && (d.Port <= 0 || d.Port > 65535) {
+			return fmt.Errorf("proxy discovery of a records needs a port")
+		}
+		if d.Scheme != "" && d.Scheme != "http" && d.Scheme != "https" {
+			return fmt.Errorf("proxy discovery scheme must be http or https")
+		}
+		if d.Interval < 0 {
+			return fmt.Errorf("proxy discovery interval must not be negative")
+		}
+	}
+	if h := config.Proxy.HealthCheck; h.Enabled {
+		if len(config.Proxy.Targets) == 0 && config.Proxy.Discovery.Type == "" {
+			return fmt.Errorf("proxy health checks need targets or discovery")
+		}
+		if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+			return fmt.Errorf("proxy health check path must start with /")
+		}
+		if h.Interval < 0 || h.Timeout < 0 || h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 {
+			return fmt.Errorf("proxy health check settings must not be negative")
+		}
+	}
+
+	if config.Proxy.EgressProxy != "" {
+		u, err := url.Parse(config.Proxy.EgressProxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("proxy egress proxy must be a URL with a host")
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("proxy egress proxy scheme must be http, https, socks5 or socks5h")
+		}
+	}
 
 	if config.RateLimit.RequestsPerMinute <= 0 {
 		return fmt.Errorf("rate limit requests per minute must be positive")
 	}
+	if config.RateLimit.BurstSize < 0 {
+		return fmt.Errorf("rate limit burst size must not be negative")
+	}
+
+	if config.Server.CheckBudget < 0 {
+		return fmt.Errorf("server check budget must not be negative")
+	}
+	if config.Server.DrainTimeout < 0 {
+		return fmt.Errorf("server drain timeout must not be negative")
+	}
+
+	if config.Server.Streaming.MaxDuration < 0 {
+		return fmt.Errorf("server streaming max duration must not be negative")
+	}
+	if c := config.Server.Connections; c.MaxConns < 0 || c.PerIPPerSecond < 0 || c.PerIPBurst < 0 {
+		return fmt.Errorf("server connection limits must not be negative")
+	}
+
+	if t := config.Server.TLS; t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return fmt.Errorf("server tls needs both a cert file and a key file")
+		}
+		if t.HandshakesPerSecond < 0 || t.HandshakeBurst < 0 || t.MaxFailures < 0 || t.FailureWindow < 0 || t.BlockDuration < 0 {
+			return fmt.Errorf("server tls handshake limits must not be negative")
+		}
+	}
 
 	if config.RateLimit.BlockDuration <= 0 {
 		return fmt.Errorf("rate limit block duration must be positive")
 	}
 
+	switch config.Proxy.UpstreamDial.IPFamily {
+	case "", "dualStack", "preferIPv4", "preferIPv6", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("proxy upstream dial ip family must be dualStack, preferIPv4, preferIPv6, ipv4 or ipv6")
+	}
+
+	if config.Proxy.UpstreamLimits.MaxConns < 0 || config.Proxy.UpstreamLimits.MaxNewConnsPerSecond < 0 {
+		return fmt.Errorf("upstream connection limits must not be negative")
+	}
+	if t := config.Proxy.UpstreamTransport; t.MaxIdleConnsPerHost < 0 || t.IdleConnTimeout < 0 || t.DialTimeout < 0 ||
+		t.TLSHandshakeTimeout < 0 || t.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("upstream transport settings must not be negative")
+	}
+	if b := config.Proxy.CircuitBreaker; b.Enabled {
+		if b.Window < 0 || b.MinRequests < 0 || b.OpenDuration < 0 || b.HalfOpenProbes < 0 {
+			return fmt.Errorf("proxy circuit breaker settings must not be negative")
+		}
+		if b.FailureRatio < 0 || b.FailureRatio > 1 {
+			return fmt.Errorf("proxy circuit breaker failure ratio must be between 0 and 1")
+		}
+	}
+	if config.Proxy.MaxRequestBodyBytes < 0 {
+		return fmt.Errorf("proxy max request body bytes must not be negative")
+	}
+	if c := config.Proxy.ConditionalCache; c.TTL < 0 || c.MaxEntries < 0 {
+		return fmt.Errorf("proxy conditional cache settings must not be negative")
+	}
+	if p := config.Proxy.UpstreamTransport.Prewarm; p.Conns < 0 || p.Interval < 0 {
+		return fmt.Errorf("upstream prewarm settings must not be negative")
+	} else if idle := config.Proxy.UpstreamTransport.MaxIdleConnsPerHost; idle > 0 && p.Conns > idle {
+		return fmt.Errorf("upstream prewarm conns must not exceed maxIdleConnsPerHost")
+	} else if p.Path != "" && !strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("upstream prewarm path must start with /")
+	}
+
+	switch config.RateLimit.FailurePolicy {
+	case "", "closed", "open", "local":
+	default:
+		return fmt.Errorf("rate limit failure policy must be open, closed or local")
+	}
+	for _, algorithm := range []string{config.RateLimit.Algorithm, config.RateLimit.ShadowAlgorithm} {
+		switch algorithm {
+		case "", "fixed_window", "sliding_window":
+		case "sliding_log", "token_bucket":
+			if config.Store.Backend != "" && config.Store.Backend != "redis" {
+				return fmt.Errorf("the %s rate limit algorithm is only supported with the redis store backend", algorithm)
+			}
+		default:
+			if !slices.Contains(limiter.Algorithms(), algorithm) {
+				return fmt.Errorf("rate limit algorithm must be one of %s", strings.Join(limiter.Algorithms(), ", "))
+			}
+		}
+	}
+	if shadow := config.RateLimit.ShadowAlgorithm; shadow != "" {
+		enforcing := config.RateLimit.Algorithm
+		if enforcing == "" {
+			enforcing = "fixed_window"
+		}
+		if shadow == enforcing {
+			return fmt.Errorf("rate limit shadow algorithm must differ from the enforcing algorithm")
+		}
+	}
+	if err := validateKeyStrategy(config, "rate limit", config.RateLimit.KeyStrategy, config.RateLimit.KeyName); err != nil {
+		return err
+	}
+	if config.RateLimit.InstanceCeiling < 0 || config.RateLimit.InstanceCeilingBurst < 0 {
+		return fmt.Errorf("rate limit instance ceiling must not be negative")
+	}
+	if config.RateLimit.RequestCost < 0 || config.RateLimit.LightRequestCost < 0 {
+		return fmt.Errorf("rate limit request costs must not be negative")
+	}
+
+	if len(config.Redis.ClusterAddrs) > 0 {
+		if config.Redis.UseSentinel {
+			return fmt.Errorf("redis cluster and sentinel cannot be used together")
+		}
+		if config.Redis.DB != 0 {
+			return fmt.Errorf("redis cluster only supports db 0")
+		}
+	}
+	if config.Store.LocalCache.Enabled && config.Store.Backend != "" && config.Store.Backend != "redis" {
+		return fmt.Errorf("local cache is only supported with the redis store backend")
+	}
+
+	switch config.Store.Backend {
+	case "", "redis":
+	case "memcached":
+		if len(config.Store.Memcached.Servers) == 0 {
+			return fmt.Errorf("memcached store requires at least one server")
+		}
+	case "dynamodb":
+		if config.Store.DynamoDB.Table == "" {
+			return fmt.Errorf("dynamodb store requires a table name")
+		}
+	case "etcd":
+		if len(config.Store.Etcd.Endpoints) == 0 {
+			return fmt.Errorf("etcd store requires at least one endpoint")
+		}
+	default:
+		return fmt.Errorf("unknown store backend %q", config.Store.Backend)
+	}
+
+	routeNames := make(map[string]bool)
+	for _, route := range config.Routes {
+		if err := validateRoute(route, routeNames); err != nil {
+			return err
+		}
+	}
+	listenAddrs := map[string]bool{config.Server.ListenAddr: true}
+	profileNames := make(map[string]bool)
+	for _, profile := range config.Profiles {
+		if profile.Name == "" {
+			return fmt.Errorf("profile name is required")
+		}
+		if profileNames[profile.Name] {
+			return fmt.Errorf("duplicate profile name %q", profile.Name)
+		}
+		// Names end up in limiter keys and the listeners passed on upgrades.
+		if strings.IndexFunc(profile.Name, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+		}) >= 0 {
+			return fmt.Errorf("profile name %q may only contain letters, digits, - and _", profile.Name)
+		}
+		profileNames[profile.Name] = true
+		if profile.ListenAddr == "" {
+			return fmt.Errorf("profile %q listen address is required", profile.Name)
+		}
+		if listenAddrs[profile.ListenAddr] {
+			return fmt.Errorf("profile %q listen address %s is already in use", profile.Name, profile.ListenAddr)
+		}
+		listenAddrs[profile.ListenAddr] = true
+		if profile.TargetURL == "" && len(profile.Targets) == 0 {
+			return fmt.Errorf("profile %q target URL is required", profile.Name)
+		}
+		for _, target := range profile.Targets {
+			if u, err := url.Parse(target); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("profile %q target %q must be an http or https URL", profile.Name, target)
+			}
+		}
+		if profile.RequestsPerMinute < 0 || profile.BlockDuration < 0 {
+			return fmt.Errorf("profile %q rate limit must not be negative", profile.Name)
+		}
+		if err := validateKeyStrategy(config, fmt.Sprintf("profile %q", profile.Name), profile.KeyStrategy, profile.KeyName); err != nil {
+			return err
+		}
+		for _, route := range profile.Routes {
+			if err := validateRoute(route, routeNames); err != nil {
+				return err
+			}
+		}
+	}
+
+	if m := config.Metrics; m.Enabled && !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("metrics path must start with /")
+	}
+	if m := config.Metrics; m.Enabled && listenAddrs[m.ListenAddr] {
+		return fmt.Errorf("metrics listen address %s is a proxy listener, leave it empty to serve metrics there", m.ListenAddr)
+	}
+	if p := config.Metrics.PathLabel; p != "" && p != "path" && p != "route" {
+		return fmt.Errorf("metrics path label must be path or route")
+	}
+	switch config.Metrics.ClientLabel {
+	case "", "ip", "subnet", "none":
+	default:
+		return fmt.Errorf("metrics client label must be ip, subnet or none")
+	}
+	if m := config.Metrics; m.IPv4Prefix < 0 || m.IPv4Prefix > 32 || m.IPv6Prefix < 0 || m.IPv6Prefix > 128 {
+		return fmt.Errorf("metrics subnet prefixes must be at most 32 bits for IPv4 and 128 bits for IPv6")
+	}
+	if config.Metrics.MaxClientLabels < 0 {
+		return fmt.Errorf("metrics max client labels must not be negative")
+	}
+	for _, proxy := range config.Proxy.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err := netip.ParseAddr(proxy); err != nil {
+				return fmt.Errorf("trusted proxy %q is not a CIDR or an address", proxy)
+			}
+		}
+	}
+	for _, entry := range append(append([]string{}, config.IPLists.Allow...), config.IPLists.Deny...) {
+		if _, err := netip.ParsePrefix(entry); err != nil {
+			if _, err := netip.ParseAddr(entry); err != nil {
+				return fmt.Errorf("ip list entry %q is not a CIDR or an address", entry)
+			}
+		}
+	}
+	for _, header := range config.Proxy.ClientIPHeaders {
+		switch http.CanonicalHeaderKey(header) {
+		case "X-Forwarded-For", "Forwarded", "X-Real-Ip":
+		default:
+			return fmt.Errorf("client IP header must be X-Forwarded-For, Forwarded or X-Real-IP")
+		}
+	}
+
+	if q := config.Quota; q.Enabled {
+		if !strings.HasPrefix(q.Path, "/") {
+			return fmt.Errorf("quota path must start with /")
+		}
+		if q.RequireAuth && !config.Auth.Enabled {
+			return fmt.Errorf("quota requireAuth needs auth")
+		}
+		if q.RequestsPerMinute < 0 {
+			return fmt.Errorf("quota requestsPerMinute must not be negative")
+		}
+	}
+	if st := config.Status; st.Enabled {
+		if !strings.HasPrefix(st.Path, "/") {
+			return fmt.Errorf("status path must start with /")
+		}
+		if config.Quota.Enabled && st.Path == config.Quota.Path {
+			return fmt.Errorf("status path must differ from the quota path")
+		}
+		if st.RequestsPerMinute < 0 || st.MaxAge < 0 {
+			return fmt.Errorf("status settings must not be negative")
+		}
+	}
+
+	for _, s := range []AuthServiceConfig{config.Auth.Introspection.Service, config.Auth.APIKey.Service} {
+		if s.Timeout < 0 || s.StaleTTL < 0 || s.FailureThreshold < 0 || s.OpenDuration < 0 {
+			return fmt.Errorf("auth service settings must not be negative")
+		}
+	}
+
+	if id := config.IdentityHeaders; id.Enabled {
+		if (id.Country != "" || id.ASN != "") && config.GeoIP.CountryDatabase == "" &&
+			config.GeoIP.ASNDatabase == "" && len(config.GeoIP.Overrides) == 0 {
+			return fmt.Errorf("identity country and asn headers need geoip databases or overrides")
+		}
+		switch id.Signing.Format {
+		case "":
+		case "hmac", "jwt":
+			if id.Signing.Key == "" {
+				return fmt.Errorf("identity signing key is required")
+			}
+			// HS256 keys must not be shorter than the hash
+			if id.Signing.Format == "jwt" && len(id.Signing.Key) < 32 {
+				return fmt.Errorf("identity jwt signing key must be at least 32 bytes")
+			}
+			if id.Signing.TTL < 0 {
+				return fmt.Errorf("identity signing ttl must not be negative")
+			}
+		default:
+			return fmt.Errorf("identity signing format must be hmac or jwt")
+		}
+	}
+
+	if config.Proxy.EnableGeoBlocking {
+		if config.GeoIP.CountryDatabase == "" && len(config.GeoIP.Overrides) == 0 {
+			return fmt.Errorf("geo blocking needs a geoip country database or overrides")
+		}
+		for _, country := range config.Proxy.BlockedCountries {
+			if len(country) != 2 || strings.ToUpper(country) != country {
+				return fmt.Errorf("blocked country %q must be an ISO 3166 alpha-2 code", country)
+			}
+		}
+	}
+
+	if a := config.Accounting; a.Enabled {
+		if !config.Auth.Enabled {
+			return fmt.Errorf("accounting needs auth to identify clients")
+		}
+		if a.Interval < 0 || a.MaxLen < 0 || a.MaxPending < 0 {
+			return fmt.Errorf("accounting interval and limits must not be negative")
+		}
+		switch a.Sink {
+		case "stream":
+		case "csv":
+			if a.File == "" {
+				return fmt.Errorf("accounting csv sink needs a file")
+			}
+		case "webhook":
+			if u, err := url.Parse(a.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("accounting webhook url must be an http or https URL")
+			}
+		default:
+			return fmt.Errorf("accounting sink must be stream, csv or webhook")
+		}
+	}
+
+	if config.Expensive.SlowThreshold < 0 || config.Expensive.LargeResponseBytes < 0 {
+		return fmt.Errorf("expensive request thresholds must not be negative")
+	}
+
+	for _, pattern := range config.PathTemplates.Patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("path template %q must start with /", pattern)
+		}
+	}
+	for _, route := range config.Metrics.Routes {
+		if !routeNames[route] && route != "default" {
+			return fmt.Errorf("metrics route %q is not a configured route", route)
+		}
+	}
+
+	if config.Replication.Enabled {
+		if config.Replication.Region == "" {
+			return fmt.Errorf("replication region is required")
+		}
+		for _, peer := range config.Replication.Peers {
+			if peer.Region == "" || peer.Addr == "" {
+				return fmt.Errorf("replication peers require a region and an address")
+			}
+			if peer.Region == config.Replication.Region {
+				return fmt.Errorf("replication peer %q has the same region as this instance", peer.Region)
+			}
+		}
+	}
+
+	if config.Authz.Enabled {
+		if config.Authz.Mode != "http" && config.Authz.Mode != "grpc" {
+			return fmt.Errorf("authz mode must be http or grpc")
+		}
+		if config.Authz.Address == "" {
+			return fmt.Errorf("authz address is required")
+		}
+		if config.Authz.FailurePolicy != "closed" && config.Authz.FailurePolicy != "open" {
+			return fmt.Errorf("authz failure policy must be open or closed")
+		}
+	}
+
+	if config.Auth.Enabled {
+		a := config.Auth
+		if a.JWT.JWKSURL == "" && a.Introspection.URL == "" && a.APIKey.LookupURL == "" {
+			return fmt.Errorf("auth needs a JWKS URL, an introspection URL or an API key lookup URL")
+		}
+		if a.Timeout < 0 || a.JWT.JWKSTTL < 0 || a.Introspection.TTL < 0 || a.Introspection.NegativeTTL < 0 ||
+			a.APIKey.TTL < 0 || a.APIKey.NegativeTTL < 0 {
+			return fmt.Errorf("auth timeout and TTLs must not be negative")
+		}
+	}
+
+	if config.Admin.Enabled {
+		if config.Admin.ListenAddr == "" {
+			return fmt.Errorf("admin listen address is required")
+		}
+		if config.Admin.Token == "" {
+			return fmt.Errorf("admin token is required")
+		}
+		if o := config.Admin.OIDC; o.Enabled {
+			if o.Issuer == "" || o.ClientID == "" || o.RedirectURL == "" {
+				return fmt.Errorf("admin oidc issuer, client id and redirect url are required")
+			}
+			if len(o.SessionSecret) < 32 {
+				return fmt.Errorf("admin oidc session secret must be at least 32 characters")
+			}
+			if len(o.AdminGroups) == 0 && len(o.ViewerGroups) == 0 {
+				return fmt.Errorf("admin oidc needs admin or viewer groups")
+			}
+			if o.SessionTTL < 0 {
+				return fmt.Errorf("admin oidc session ttl must not be negative")
+			}
+		}
+	}
+
+	if config.Clearance.Enabled && len(config.Clearance.Keys) == 0 {
+		return fmt.Errorf("clearance requires at least one signing key")
+	}
+
+	if b := config.Bypass; b.Enabled {
+		if !config.Admin.Enabled {
+			return fmt.Errorf("bypass tokens are minted through the admin API, which must be enabled")
+		}
+		if len(b.Keys) == 0 {
+			return fmt.Errorf("bypass requires at least one signing key")
+		}
+		if b.DefaultTTL < 0 || b.MaxTTL < 0 {
+			return fmt.Errorf("bypass ttls must not be negative")
+		}
+		if b.DefaultTTL > 0 && b.MaxTTL > 0 && b.DefaultTTL > b.MaxTTL {
+			return fmt.Errorf("bypass defaultTTL must not exceed maxTTL")
+		}
+	}
+	if e := config.Escalation; e.Enabled {
+		if e.Threshold < 0 || e.Window < 0 || e.Duration < 0 {
+			return fmt.Errorf("escalation threshold, window and duration must not be negative")
+		}
+		if e.Threshold == 1 {
+			return fmt.Errorf("escalation threshold must be at least 2, a single offense is handled by the limiter")
+		}
+	}
+
+	if config.Sessions.Enabled {
+		if len(config.Sessions.Secret) < 16 {
+			return fmt.Errorf("session secret must be at least 16 characters")
+		}
+		if config.Sessions.RequestsPerMinute <= 0 || config.Sessions.IPRequestsPerMinute <= 0 {
+			return fmt.Errorf("session rate limits must be positive")
+		}
+	}
+
+	if config.Anomaly.Enabled && (config.Anomaly.TightenFactor < 0 || config.Anomaly.Alpha < 0 || config.Anomaly.Alpha >= 1) {
+		return fmt.Errorf("anomaly alpha must be between 0 and 1 and tighten factor must not be negative")
+	}
+
+	if config.Fingerprint.Enabled && (config.Fingerprint.CarryOver < 0 || config.Fingerprint.CarryOver > 1) {
+		return fmt.Errorf("fingerprint carry over must be between 0 and 1")
+	}
+
+	if config.Greylist.Enabled {
+		if config.Greylist.Challenge && !config.Clearance.Enabled {
+			return fmt.Errorf("greylist challenges require clearance to be enabled")
+		}
+		if config.Greylist.TightenFactor < 0 || config.Greylist.TightenFactor > 1 {
+			return fmt.Errorf("greylist tighten factor must be between 0 and 1")
+		}
+		if config.Greylist.Memory > 0 && config.Greylist.Memory < config.Greylist.Duration {
+			return fmt.Errorf("greylist memory must not be shorter than its duration")
+		}
+	}
+	if d := config.DebugTrace; d.Enabled {
+		if !config.Admin.Enabled {
+			return fmt.Errorf("debug traces are enabled through the admin API, which must be enabled")
+		}
+		if len(d.Key) < 32 {
+			return fmt.Errorf("debug trace key must be at least 32 bytes")
+		}
+		if d.MaxTTL < 0 {
+			return fmt.Errorf("debug trace maxTTL must not be negative")
+		}
+	}
+	if a := config.AccessLog; a.Enabled {
+		switch a.Format {
+		case "", "json", "combined":
+		default:
+			return fmt.Errorf("access log format must be json or combined, got %q", a.Format)
+		}
+	}
+	if rv := config.Review; rv.Enabled {
+		if !config.Admin.Enabled {
+			return fmt.Errorf("review requires the admin API, where suspended clients are resolved")
+		}
+		if rv.Challenge && !config.Clearance.Enabled {
+			return fmt.Errorf("review challenges require clearance to be enabled")
+		}
+		if rv.MinScore < 0 || rv.MaxScore > 1 || (rv.MaxScore > 0 && rv.MaxScore <= rv.MinScore) {
+			return fmt.Errorf("review scores must satisfy 0 <= minScore < maxScore <= 1")
+		}
+		if rv.TightenFactor < 0 || rv.TightenFactor > 1 {
+			return fmt.Errorf("review tighten factor must be between 0 and 1")
+		}
+		if rv.TTL < 0 || rv.BlockDuration < 0 || rv.AllowDuration < 0 {
+			return fmt.Errorf("review durations must not be negative")
+		}
+	}
+
+	if config.Settings.PollInterval < 0 {
+		return fmt.Errorf("settings poll interval must not be negative")
+	}
+
+	if config.Feedback.MaxCases < 0 {
+		return fmt.Errorf("feedback max cases must not be negative")
+	}
+
+	if config.Firewall.Enabled && config.Firewall.LogFile == "" && config.Firewall.Command == "" {
+		return fmt.Errorf("firewall output needs a log file or a command")
+	}
+
+	if d := config.DecisionLog; d.Enabled {
+		if d.Dir == "" {
+			return fmt.Errorf("decision log directory is required")
+		}
+		if d.MaxBytes < 0 || d.MaxAge < 0 || d.MaxFiles < 0 || d.BufferSize < 0 {
+			return fmt.Errorf("decision log limits must not be negative")
+		}
+		if d.Upload.URL != "" {
+			if u, err := url.Parse(d.Upload.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("decision log upload url must be an http or https URL")
+			}
+		}
+		if err := validateSigning("decision log upload", d.Upload.Signing); err != nil {
+			return err
+		}
+	}
+
+	if a := config.Audit; a.Enabled {
+		if a.SampleRate <= 0 || a.SampleRate > 1 {
+			return fmt.Errorf("audit sample rate must be greater than 0 and at most 1")
+		}
+		if a.BatchRecords < 0 || a.BatchAge < 0 || a.BufferSize < 0 {
+			return fmt.Errorf("audit batch limits must not be negative")
+		}
+		if u, err := url.Parse(a.Upload.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("audit upload url must be an http or https URL")
+		}
+		if err := validateSigning("audit upload", a.Upload.Signing); err != nil {
+			return err
+		}
+	}
+
+	if config.WAFSync.Interval < 0 {
+		return fmt.Errorf("waf sync interval must not be negative")
+	}
+	wafTargets := make(map[string]bool)
+	for _, target := range config.WAFSync.Targets {
+		if target.Name == "" || wafTargets[target.Name] {
+			return fmt.Errorf("waf sync targets need a unique name")
+		}
+		wafTargets[target.Name] = true
+		if target.Direction != "export" && target.Direction != "import" {
+			return fmt.Errorf("waf sync target %q direction must be export or import", target.Name)
+		}
+		switch target.Type {
+		case "cloudflare":
+			if target.Cloudflare.AccountID == "" || target.Cloudflare.ListID == "" || target.Cloudflare.APIToken == "" {
+				return fmt.Errorf("waf sync target %q needs a cloudflare account, list and API token", target.Name)
+			}
+		case "aws":
+			if target.AWS.Region == "" || target.AWS.Name == "" || target.AWS.ID == "" {
+				return fmt.Errorf("waf sync target %q needs an aws region, ip set name and id", target.Name)
+			}
+			if target.AWS.Scope != "REGIONAL" && target.AWS.Scope != "CLOUDFRONT" {
+				return fmt.Errorf("waf sync target %q aws scope must be REGIONAL or CLOUDFRONT", target.Name)
+			}
+		default:
+			return fmt.Errorf("waf sync target %q type must be cloudflare or aws", target.Name)
+		}
+	}
+
+	if config.GeoIP.RefreshInterval < 0 || config.GeoIP.StaleAfter < 0 {
+		return fmt.Errorf("geoip refresh interval and stale age must not be negative")
+	}
+	geoNames := make(map[string]bool)
+	for _, db := range config.GeoIP.Databases {
+		if db.Name == "" || db.Path == "" {
+			return fmt.Errorf("geoip databases need a name and a path")
+		}
+		if geoNames[db.Name] {
+			return fmt.Errorf("duplicate geoip database %q", db.Name)
+		}
+		geoNames[db.Name] = true
+		if db.Type != "mmdb" && db.Type != "list" {
+			return fmt.Errorf("geoip database %q type must be mmdb or list", db.Name)
+		}
+	}
+	for _, name := range []string{config.GeoIP.CountryDatabase, config.GeoIP.ASNDatabase} {
+		if name != "" && !geoNames[name] {
+			return fmt.Errorf("unknown geoip database %q", name)
+		}
+	}
+	for _, o := range config.GeoIP.Overrides {
+		if _, err := netip.ParsePrefix(o.CIDR); err != nil {
+			return fmt.Errorf("invalid geoip override cidr %q: %v", o.CIDR, err)
+		}
+		if o.Country == "" && o.ASN == 0 && o.Organization == "" {
+			return fmt.Errorf("geoip override %s does not set anything", o.CIDR)
+		}
+		if o.Country != "" && (len(o.Country) != 2 || strings.ToUpper(o.Country) != o.Country) {
+			return fmt.Errorf("geoip override %s country must be an ISO 3166 alpha-2 code", o.CIDR)
+		}
+	}
+
+	if config.Fleet.HeartbeatInterval < 0 {
+		return fmt.Errorf("fleet heartbeat interval must not be negative")
+	}
+
+	switch config.Upgrade.Mode {
+	case "", "handoff", "reusePort":
+	default:
+		return fmt.Errorf("upgrade mode must be handoff or reusePort")
+	}
+
+	if config.Tap.Enabled {
+		if !config.Admin.Enabled {
+			return fmt.Errorf("tap requires the admin API to be enabled")
+		}
+		if config.Tap.MaxBodyBytes < 0 {
+			return fmt.Errorf("tap max body bytes must not be negative")
+		}
+	}
+
+	if config.UnderAttack.Enabled {
+		if config.UnderAttack.Challenge && !config.Clearance.Enabled {
+			return fmt.Errorf("under attack challenges require clearance to be enabled")
+		}
+		if config.UnderAttack.TightenFactor < 0 || config.UnderAttack.TightenFactor > 1 {
+			return fmt.Errorf("under attack tighten factor must be between 0 and 1")
+		}
+		for _, window := range config.UnderAttack.Schedule {
+			if !window.End.After(window.Start) {
+				return fmt.Errorf("under attack schedule windows must end after they start")
+			}
+		}
+	}
+
+	if config.History.Enabled {
+		if config.History.Driver != "sqlite" && config.History.Driver != "postgres" {
+			return fmt.Errorf("history driver must be sqlite or postgres")
+		}
+		if config.History.DSN == "" {
+			return fmt.Errorf("history DSN is required")
+		}
+	}
+
+	return nil
+}
+
+// validateRoute checks a route of the main proxy or a profile, names are
+// collected in names.
+func validateRoute(route RouteConfig, names map[string]bool) error {
+	if route.Name == "" {
+		return fmt.Errorf("route name is required")
+	}
+	if names[route.Name] {
+		return fmt.Errorf("duplicate route name %q", route.Name)
+	}
+	names[route.Name] = true
+	if !strings.HasPrefix(route.PathPrefix, "/") {
+		return fmt.Errorf("route %q path prefix must start with /", route.Name)
+	}
+	if route.RequestsPerMinute < 0 {
+		return fmt.Errorf("route %q requests per minute must not be negative", route.Name)
+	}
+	if route.Body.Mode != "stream" && route.Body.Mode != "buffer" {
+		return fmt.Errorf("route %q body mode must be stream or buffer", route.Name)
+	}
+	if route.Body.MaxBufferBytes < 0 || route.Body.Timeout < 0 || route.Body.MinUploadRate < 0 || route.Body.UploadGrace < 0 {
+		return fmt.Errorf("route %q body limits must not be negative", route.Name)
+	}
+	if err := validateSigning(fmt.Sprintf("route %q", route.Name), route.Signing); err != nil {
+		return err
+	}
+	if i := route.Idempotency; i.Enabled {
+		if i.Mode != "" && i.Mode != "reject" && i.Mode != "replay" {
+			return fmt.Errorf("route %q idempotency mode must be reject or replay", route.Name)
+		}
+		if i.Window < 0 || i.PendingTTL < 0 || i.MaxBodyBytes < 0 {
+			return fmt.Errorf("route %q idempotency limits must not be negative", route.Name)
+		}
+	}
+	for _, plugin := range route.Plugins {
+		if plugin.Name == "" {
+			return fmt.Errorf("route %q has a plugin without a name", route.Name)
+		}
+	}
+	return nil
+}
+
+// validateKeyStrategy checks the key strategy of the rate limit or a
+// profile, named by subject.
+func validateKeyStrategy(config *Config, subject, strategy, name string) error {
+	switch strategy {
+	case "", "ip":
+	case "header", "cookie":
+		if name == "" {
+			return fmt.Errorf("%s key strategy %s needs a key name", subject, strategy)
+		}
+	case "jwt":
+		if !config.Auth.Enabled || config.Auth.JWT.JWKSURL == "" {
+			return fmt.Errorf("%s key strategy jwt needs auth with a JWKS URL", subject)
+		}
+	default:
+		return fmt.Errorf("%s key strategy must be ip, header, jwt or cookie", subject)
+	}
+	return nil
+}
+
+// validateSigning checks the signing configuration of subject.
+func validateSigning(subject string, signing RouteSigningConfig) error {
+	switch signing.Type {
+	case "":
+	case "sigv4":
+		if signing.SigV4.Region == "" || signing.SigV4.Service == "" {
+			return fmt.Errorf("%s sigv4 signing needs a region and a service", subject)
+		}
+		if (signing.SigV4.AccessKeyID == "") != (signing.SigV4.SecretAccessKey == "") {
+			return fmt.Errorf("%s sigv4 signing needs both an access key id and a secret access key", subject)
+		}
+	case "hmac":
+		if signing.HMAC.Key == "" {
+			return fmt.Errorf("%s hmac signing needs a key", subject)
+		}
+		if a := signing.HMAC.Algorithm; a != "" && a != "sha256" && a != "sha512" {
+			return fmt.Errorf("%s hmac algorithm must be sha256 or sha512", subject)
+		}
+	default:
+		return fmt.Errorf("%s signing type must be sigv4 or hmac", subject)
+	}
 	return nil
 }
 
@@ -166,3 +2195,25 @@ func (rc *RedisConfig) ToRedisSentinelOptions() *redis.FailoverOptions {
 		DB:            rc.DB,
 	}
 }
+
+// ToRedisClusterOptions converts RedisConfig to redis.ClusterOptions if
+// cluster addresses are set
+func (rc *RedisConfig) ToRedisClusterOptions() *redis.ClusterOptions {
+	if len(rc.ClusterAddrs) == 0 {
+		return nil
+	}
+
+	return &redis.ClusterOptions{
+		Addrs:    rc.ClusterAddrs,
+		Password: rc.Password,
+	}
+}
+
+// ToRedisOptions converts a ReplicationPeer to redis.Options
+func (p *ReplicationPeer) ToRedisOptions() *redis.Options {
+	return &redis.Options{
+		Addr:     p.Addr,
+		Password: p.Password,
+		DB:       p.DB,
+	}
+}
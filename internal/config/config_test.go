@@ -49,6 +49,10 @@ proxy:
 	if config.RateLimit.RequestsPerMinute != 100 {
 		t.Errorf("Expected 100 requests per minute, got %d", config.RateLimit.RequestsPerMinute)
 	}
+
+	if config.Metrics.ListenAddr != "" {
+		t.Errorf("Expected metrics on the proxy listener by default, got %q", config.Metrics.ListenAddr)
+	}
 }
 
 func TestEnvironmentOverrides(t *testing.T) {
@@ -153,6 +157,73 @@ func TestValidation(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "Memcached store without servers",
+			config: Config{
+				Server: ServerConfig{
+					ListenAddr: ":8080",
+				},
+				Store: StoreConfig{
+					Backend: "memcached",
+				},
+				RateLimit: RateLimitConfig{
+					RequestsPerMinute: 100,
+					BlockDuration:     time.Hour,
+				},
+				Proxy: ProxyConfig{
+					TargetURL: "http://localhost:3000",
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "Profile",
+			config: Config{
+				Server:    ServerConfig{ListenAddr: ":8080"},
+				RateLimit: RateLimitConfig{RequestsPerMinute: 100, BlockDuration: time.Hour},
+				Proxy:     ProxyConfig{TargetURL: "http://localhost:3000"},
+				Profiles: []ProfileConfig{
+					{Name: "billing", ListenAddr: ":8081", TargetURL: "http://localhost:4000", RequestsPerMinute: 20},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "Profile on the main listen address",
+			config: Config{
+				Server:    ServerConfig{ListenAddr: ":8080"},
+				RateLimit: RateLimitConfig{RequestsPerMinute: 100, BlockDuration: time.Hour},
+				Proxy:     ProxyConfig{TargetURL: "http://localhost:3000"},
+				Profiles: []ProfileConfig{
+					{Name: "billing", ListenAddr: ":8080", TargetURL: "http://localhost:4000"},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "Profile route named like a main route",
+			config: Config{
+				Server:    ServerConfig{ListenAddr: ":8080"},
+				RateLimit: RateLimitConfig{RequestsPerMinute: 100, BlockDuration: time.Hour},
+				Proxy:     ProxyConfig{TargetURL: "http://localhost:3000"},
+				Routes:    []RouteConfig{{Name: "api", PathPrefix: "/api/", Body: RouteBodyConfig{Mode: "stream"}}},
+				Profiles: []ProfileConfig{
+					{Name: "billing", ListenAddr: ":8081", TargetURL: "http://localhost:4000",
+						Routes: []RouteConfig{{Name: "api", PathPrefix: "/api/", Body: RouteBodyConfig{Mode: "stream"}}}},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "Metrics on the proxy listen address",
+			config: Config{
+				Server:    ServerConfig{ListenAddr: ":8080"},
+				RateLimit: RateLimitConfig{RequestsPerMinute: 100, BlockDuration: time.Hour},
+				Proxy:     ProxyConfig{TargetURL: "http://localhost:3000"},
+				Metrics:   MetricsConfig{Enabled: true, Path: "/metrics", ListenAddr: ":8080"},
+			},
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -167,3 +238,16 @@ func TestValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestHash(t *testing.T) {
+	a := Config{Proxy: ProxyConfig{TargetURL: "http://localhost:3000"}}
+	b := a
+
+	if a.Hash() != b.Hash() {
+		t.Errorf("Expected equal configurations to have the same hash")
+	}
+	b.Proxy.TargetURL = "http://localhost:3001"
+	if a.Hash() == b.Hash() {
+		t.Errorf("Expected different configurations to have different hashes")
+	}
+}
@@ -0,0 +1,162 @@
+// Package connlimit protects a listener against connection floods before any
+// bytes of a request are parsed. Connections over the total cap, or from a
+// source IP opening new connections faster than allowed, are closed right
+// after they are accepted.
+package connlimit
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Reasons passed to the Recorder for rejected connections.
+const (
+	ReasonMaxConns = "max_conns"
+	ReasonIPRate   = "ip_rate"
+)
+
+// idleLimiter is how long a source IP's limiter is kept after its last
+// connection.
+const idleLimiter = time.Minute
+
+// Recorder receives connection metrics.
+type Recorder interface {
+	AddClientConnections(delta float64)
+	IncClientConnectionRejected(reason string)
+}
+
+// Options configures the listener limits.
+type Options struct {
+	// MaxConns caps the number of open connections. Zero disables the cap.
+	MaxConns int
+	// PerIPPerSecond is the rate at which a single source IP may open new
+	// connections, with bursts of up to PerIPBurst. Zero disables the limit.
+	PerIPPerSecond float64
+	PerIPBurst     int
+	Recorder       Recorder
+}
+
+// Listener enforces Options on the connections accepted from a wrapped
+// listener.
+type Listener struct {
+	net.Listener
+	opts  Options
+	slots chan struct{}
+
+	mu        sync.Mutex
+	limiters  map[string]*ipLimiter
+	lastSweep time.Time
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewListener wraps l. The returned listener is l itself if opts disables all
+// limits.
+func NewListener(l net.Listener, opts Options) net.Listener {
+	if opts.MaxConns <= 0 && opts.PerIPPerSecond <= 0 {
+		return l
+	}
+	if opts.PerIPBurst <= 0 {
+		opts.PerIPBurst = 1
+	}
+	cl := &Listener{
+		Listener:  l,
+		opts:      opts,
+		limiters:  make(map[string]*ipLimiter),
+		lastSweep: time.Now(),
+	}
+	if opts.MaxConns > 0 {
+		cl.slots = make(chan struct{}, opts.MaxConns)
+	}
+	return cl
+}
+
+// Accept returns the next connection within the limits. Rejected connections
+// are closed without being handed to the server.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.allowIP(conn.RemoteAddr(), time.Now()) {
+			l.reject(conn, ReasonIPRate)
+			continue
+		}
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				l.reject(conn, ReasonMaxConns)
+				continue
+			}
+		}
+		if l.opts.Recorder != nil {
+			l.opts.Recorder.AddClientConnections(1)
+		}
+		return &limitedConn{Conn: conn, listener: l}, nil
+	}
+}
+
+func (l *Listener) reject(conn net.Conn, reason string) {
+	conn.Close()
+	if l.opts.Recorder != nil {
+		l.opts.Recorder.IncClientConnectionRejected(reason)
+	}
+}
+
+func (l *Listener) allowIP(addr net.Addr, now time.Time) bool {
+	if l.opts.PerIPPerSecond <= 0 {
+		return true
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > idleLimiter {
+		for key, entry := range l.limiters {
+			if now.Sub(entry.lastSeen) > idleLimiter {
+				delete(l.limiters, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipLimiter{limiter: rate.NewLimiter(rate.Limit(l.opts.PerIPPerSecond), l.opts.PerIPBurst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+func (l *Listener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+	if l.opts.Recorder != nil {
+		l.opts.Recorder.AddClientConnections(-1)
+	}
+}
+
+// limitedConn returns its slot to the listener exactly once when closed.
+type limitedConn struct {
+	net.Conn
+	listener *Listener
+	once     sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.listener.release)
+	return err
+}
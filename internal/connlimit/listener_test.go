@@ -0,0 +1,142 @@
+package connlimit
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeListener hands out pipe connections from a fixed remote address.
+type fakeListener struct {
+	conns chan net.Conn
+}
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+type fakeConn struct {
+	net.Conn
+	remote fakeAddr
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.remote }
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+func (l *fakeListener) Close() error   { return nil }
+func (l *fakeListener) Addr() net.Addr { return fakeAddr("127.0.0.1:8080") }
+
+type recorder struct {
+	open     float64
+	rejected map[string]int
+}
+
+func (r *recorder) AddClientConnections(delta float64) { r.open += delta }
+func (r *recorder) IncClientConnectionRejected(reason string) {
+	r.rejected[reason]++
+}
+
+func dial(l *fakeListener, remote string) *fakeConn {
+	conn := &fakeConn{remote: fakeAddr(remote), closed: make(chan struct{})}
+	l.conns <- conn
+	return conn
+}
+
+func TestPerIPRate(t *testing.T) {
+	inner := &fakeListener{conns: make(chan net.Conn, 10)}
+	rec := &recorder{rejected: make(map[string]int)}
+	l := NewListener(inner, Options{PerIPPerSecond: 0.001, PerIPBurst: 2, Recorder: rec})
+
+	dial(inner, "10.0.0.1:1000")
+	dial(inner, "10.0.0.1:1001")
+	flood := dial(inner, "10.0.0.1:1002")
+	other := dial(inner, "10.0.0.2:1000")
+	close(inner.conns)
+
+	var accepted []net.Conn
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		accepted = append(accepted, conn)
+	}
+	if len(accepted) != 3 {
+		t.Fatalf("Expected 3 accepted connections, got %d", len(accepted))
+	}
+	if !flood.isClosed() {
+		t.Error("Expected the third connection from the same IP to be closed")
+	}
+	if accepted[2].RemoteAddr() != other.remote {
+		t.Errorf("Expected connection from other IP to be accepted, got %v", accepted[2].RemoteAddr())
+	}
+	if rec.rejected[ReasonIPRate] != 1 {
+		t.Errorf("Expected 1 rate rejection, got %d", rec.rejected[ReasonIPRate])
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	inner := &fakeListener{conns: make(chan net.Conn, 10)}
+	rec := &recorder{rejected: make(map[string]int)}
+	l := NewListener(inner, Options{MaxConns: 2, Recorder: rec})
+
+	dial(inner, "10.0.0.1:1000")
+	dial(inner, "10.0.0.2:1000")
+	first, _ := l.Accept()
+	if _, err := l.Accept(); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	// The connection over the cap is rejected, and once a slot is freed the
+	// next one is accepted.
+	over := dial(inner, "10.0.0.3:1000")
+	<-over.closed
+	first.Close()
+	first.Close()
+	dial(inner, "10.0.0.4:1000")
+	conn := <-accepted
+	if conn == nil || conn.RemoteAddr().String() != "10.0.0.4:1000" {
+		t.Fatalf("Expected the next connection to be accepted, got %v", conn)
+	}
+	if rec.open != 2 {
+		t.Errorf("Expected 2 open connections, got %v", rec.open)
+	}
+	if rec.rejected[ReasonMaxConns] != 1 {
+		t.Errorf("Expected 1 cap rejection, got %d", rec.rejected[ReasonMaxConns])
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	inner := &fakeListener{}
+	if l := NewListener(inner, Options{}); l != net.Listener(inner) {
+		t.Error("Expected the listener to be returned unchanged")
+	}
+}
@@ -0,0 +1,320 @@
+// Package decisionlog writes one compact record per protected request, with
+// the client key, the rule behind the decision, the abuse score and the
+// outcome, for offline tuning and attack forensics without a SIEM.
+//
+// Records are written as JSON lines with a flat, fixed schema, so that the
+// files load directly into DuckDB, Athena or Spark, or convert to Parquet.
+// Files are rotated by size and age and can be compressed and uploaded to
+// object storage once complete. The file being written ends in ".part".
+//
+// Logging never slows down requests: records are handed to a background
+// writer and dropped when its buffer is full.
+package decisionlog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Record is the decision taken on one request.
+type Record struct {
+	Time     time.Time `json:"ts"`
+	Instance string    `json:"instance,omitempty"`
+	Key      string    `json:"key"`
+	Route    string    `json:"route"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	// Endpoint is the path template, such as /users/{id}.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Outcome is allowed, rejected, tagged or error.
+	Outcome string `json:"outcome"`
+	// Rule is the reason behind the outcome, such as rate_limit_exceeded.
+	Rule string `json:"rule"`
+	// Rules are all rules that flagged the request.
+	Rules []string `json:"rules,omitempty"`
+	// Score is how strongly the rules suggest the request is abusive, from
+	// 0 to 1.
+	Score float64 `json:"score"`
+	// EvalMicros is how long the checks took.
+	EvalMicros int64 `json:"eval_us"`
+}
+
+// Uploader receives completed files.
+type Uploader interface {
+	Upload(ctx context.Context, name string, body io.Reader) error
+}
+
+// Recorder counts records by result: written or dropped.
+type Recorder interface {
+	IncDecisionLogRecord(result string)
+}
+
+// Options configures the log.
+type Options struct {
+	// Dir receives the log files.
+	Dir string
+	// Instance names the instance in records and file names.
+	Instance string
+	// MaxBytes and MaxAge rotate the current file, 100 MiB and 1 hour by
+	// default. MaxBytes counts uncompressed bytes.
+	MaxBytes int64
+	MaxAge   time.Duration
+	// MaxFiles is the number of completed files kept in Dir, 0 keeps all.
+	MaxFiles int
+	Compress bool
+	// Uploader, when set, receives every completed file. Uploaded files are
+	// removed from Dir unless KeepUploaded is set; files that failed to
+	// upload are kept.
+	Uploader     Uploader
+	KeepUploaded bool
+	// BufferSize is the number of records queued for the writer, 8192 by
+	// default.
+	BufferSize int
+	Recorder   Recorder
+}
+
+// Log writes decision records in the background.
+type Log struct {
+	opts    Options
+	logger  *logrus.Logger
+	records chan Record
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	// Owned by the writer goroutine.
+	file    *os.File
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	path    string
+	written int64
+	opened  time.Time
+	seq     int
+}
+
+// New creates the log directory and starts the writer.
+func New(opts Options, logger *logrus.Logger) (*Log, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 100 << 20
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = time.Hour
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 8192
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &Log{
+		opts:    opts,
+		logger:  logger,
+		records: make(chan Record, opts.BufferSize),
+		done:    make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.run()
+	return l, nil
+}
+
+// Write queues a record. It does not block.
+func (l *Log) Write(record Record) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Instance = l.opts.Instance
+	select {
+	case l.records <- record:
+	default:
+		l.record("dropped")
+	}
+}
+
+// Close writes the queued records and completes the current file.
+func (l *Log) Close() error {
+	close(l.done)
+	l.wg.Wait()
+	return nil
+}
+
+func (l *Log) run() {
+	defer l.wg.Done()
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case record := <-l.records:
+			l.write(record)
+		case <-flush.C:
+			if l.buf != nil {
+				if time.Since(l.opened) >= l.opts.MaxAge {
+					l.rotate()
+				} else {
+					l.flush()
+				}
+			}
+		case <-l.done:
+			for {
+				select {
+				case record := <-l.records:
+					l.write(record)
+				default:
+					l.rotate()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *Log) write(record Record) {
+	if l.buf == nil {
+		if err := l.open(record.Time); err != nil {
+			l.logger.WithError(err).Error("Error opening decision log")
+			l.record("dropped")
+			return
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		l.record("dropped")
+		return
+	}
+	line = append(line, '\n')
+	if _, err := l.buf.Write(line); err != nil {
+		l.logger.WithError(err).Error("Error writing decision log")
+		l.record("dropped")
+		return
+	}
+	l.record("written")
+	l.written += int64(len(line))
+	if l.written >= l.opts.MaxBytes {
+		l.rotate()
+	}
+}
+
+func (l *Log) open(now time.Time) error {
+	// The sequence number keeps names unique when files fill up quickly.
+	l.seq++
+	name := fmt.Sprintf("decisions-%s-%06d-%s.jsonl", now.UTC().Format("20060102T150405.000Z"), l.seq%1000000, sanitize(l.opts.Instance))
+	if l.opts.Compress {
+		name += ".gz"
+	}
+	path := filepath.Join(l.opts.Dir, name)
+	file, err := os.OpenFile(path+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file, l.path, l.written, l.opened = file, path, 0, time.Now()
+	var w io.Writer = file
+	if l.opts.Compress {
+		l.gz = gzip.NewWriter(file)
+		w = l.gz
+	}
+	l.buf = bufio.NewWriterSize(w, 64<<10)
+	return nil
+}
+
+func (l *Log) flush() {
+	if err := l.buf.Flush(); err != nil {
+		l.logger.WithError(err).Error("Error writing decision log")
+	}
+	if l.gz != nil {
+		l.gz.Flush()
+	}
+}
+
+// rotate completes the current file and hands it to the uploader.
+func (l *Log) rotate() {
+	if l.buf == nil {
+		return
+	}
+	l.flush()
+	if l.gz != nil {
+		l.gz.Close()
+	}
+	err := l.file.Close()
+	if err == nil {
+		err = os.Rename(l.path+".part", l.path)
+	}
+	path := l.path
+	l.file, l.gz, l.buf = nil, nil, nil
+	if err != nil {
+		l.logger.WithError(err).Error("Error completing decision log file")
+		return
+	}
+	if l.opts.Uploader != nil {
+		l.upload(path)
+	}
+	l.prune()
+}
+
+func (l *Log) upload(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		l.logger.WithError(err).Error("Error reading decision log file")
+		return
+	}
+	defer file.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if err := l.opts.Uploader.Upload(ctx, filepath.Base(path), file); err != nil {
+		l.logger.WithError(err).WithField("file", path).Error("Error uploading decision log file")
+		return
+	}
+	if !l.opts.KeepUploaded {
+		os.Remove(path)
+	}
+}
+
+// prune removes the oldest completed files beyond MaxFiles.
+func (l *Log) prune() {
+	if l.opts.MaxFiles <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(l.opts.Dir)
+	if err != nil {
+		return
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, "decisions-") && !strings.HasSuffix(name, ".part") {
+			files = append(files, name)
+		}
+	}
+	// Names start with the time the file was opened.
+	sort.Strings(files)
+	for len(files) > l.opts.MaxFiles {
+		os.Remove(filepath.Join(l.opts.Dir, files[0]))
+		files = files[1:]
+	}
+}
+
+func (l *Log) record(result string) {
+	if l.opts.Recorder != nil {
+		l.opts.Recorder.IncDecisionLogRecord(result)
+	}
+}
+
+// sanitize makes an instance name safe for file names.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, s)
+}
@@ -0,0 +1,112 @@
+package decisionlog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func readRecords(t *testing.T, r io.Reader) []Record {
+	t.Helper()
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLogRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	l, err := New(Options{Dir: dir, Instance: "edge/1", MaxBytes: 400, MaxFiles: 2}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		l.Write(Record{Key: "10.0.0.1", Route: "api", Outcome: "rejected", Rule: "rate_limit_exceeded", Score: 0.9})
+	}
+	l.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "decisions-*"))
+	if len(files) != 2 {
+		t.Fatalf("Expected the 2 newest files to be kept, got %v", files)
+	}
+	for _, path := range files {
+		if strings.HasSuffix(path, ".part") || !strings.Contains(path, "edge-1") {
+			t.Errorf("Unexpected file name %s", path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := readRecords(t, f)
+		f.Close()
+		if len(records) == 0 || records[0].Instance != "edge/1" || records[0].Rule != "rate_limit_exceeded" {
+			t.Errorf("Unexpected records in %s: %+v", path, records)
+		}
+	}
+}
+
+func TestLogUploadsCompressedFiles(t *testing.T) {
+	var mu sync.Mutex
+	uploaded := map[string][]Record{}
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Content-Type") != "application/gzip" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		uploaded[r.URL.Path] = readRecords(t, gz)
+		mu.Unlock()
+	}))
+	defer storage.Close()
+
+	dir := t.TempDir()
+	l, err := New(Options{Dir: dir, Compress: true, Uploader: &HTTPUploader{BaseURL: storage.URL + "/logs/"}}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(Record{Key: "10.0.0.1", Outcome: "allowed", Rule: "within_limit"})
+	l.Write(Record{Key: "10.0.0.2", Outcome: "tagged", Rule: "blocked", Rules: []string{"blocked", "greylisted"}, Score: 1})
+	l.Close()
+
+	if len(uploaded) != 1 {
+		t.Fatalf("Expected one uploaded file, got %v", uploaded)
+	}
+	for path, records := range uploaded {
+		if !strings.HasPrefix(path, "/logs/decisions-") || !strings.HasSuffix(path, ".jsonl.gz") {
+			t.Errorf("Unexpected object name %s", path)
+		}
+		if len(records) != 2 || records[1].Rules[1] != "greylisted" {
+			t.Errorf("Unexpected records %+v", records)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("Expected uploaded files to be removed, got %v", files)
+	}
+}
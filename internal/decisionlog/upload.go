@@ -0,0 +1,49 @@
+package decisionlog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTPUploader uploads files with a PUT to BaseURL/name, which works with
+// S3 and S3-compatible object storage when Client signs requests, see
+// signing.Transport.
+type HTTPUploader struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// Upload stores body under name.
+func (u *HTTPUploader) Upload(ctx context.Context, name string, body io.Reader) error {
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(u.BaseURL, "/")+"/"+name, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(name, ".gz") {
+		req.Header.Set("Content-Type", "application/gzip")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("uploading %s: unexpected status %d", name, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Package escalation promotes repeat offenders to a global block. A client
+// that is blocked or rate limited in several scopes within a window, such as
+// on different routes or under the keys of different tenants, is blocked
+// everywhere and for longer than any single limit would block it.
+//
+// Offenses are remembered in the limiter store. Each scope counts once per
+// window, so a client hammering a single route is left to the rate limiter.
+// The window starts with the first offense of a client and is not sliding.
+package escalation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"time"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+// Kinds of subjects that are escalated.
+const (
+	KindIP          = "ip"
+	KindFingerprint = "fingerprint"
+)
+
+// ReasonEscalated is the reason of global blocks placed by escalation.
+const ReasonEscalated = "escalated"
+
+// Options configures escalation.
+type Options struct {
+	// Threshold is the number of distinct scopes a client has to offend in
+	// within Window to be blocked globally.
+	Threshold int
+	Window    time.Duration
+	// Duration of the global block.
+	Duration time.Duration
+}
+
+// Escalation describes a subject that was promoted to the global block list.
+type Escalation struct {
+	Kind     string
+	Subject  string
+	Scopes   int
+	Duration time.Duration
+	Time     time.Time
+}
+
+// Handler is called synchronously for every escalation.
+type Handler func(ctx context.Context, escalation Escalation)
+
+// Escalator counts offenses and places global blocks. IPs are blocked as
+// networks of one address in the limiter, so the block applies whatever key
+// clients are limited by and shows up with the other network blocks.
+// Fingerprints are kept on a list of their own, see Blocked.
+type Escalator struct {
+	opts     Options
+	store    limiter.Store
+	limiter  *limiter.RateLimiter
+	handlers []Handler
+}
+
+// New creates an escalator that keeps its counters in store and blocks IPs
+// with l.
+func New(opts Options, store limiter.Store, l *limiter.RateLimiter) *Escalator {
+	if opts.Threshold <= 0 {
+		opts.Threshold = 3
+	}
+	if opts.Window <= 0 {
+		opts.Window = 10 * time.Minute
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = 24 * time.Hour
+	}
+	return &Escalator{opts: opts, store: store, limiter: l}
+}
+
+// OnEscalate registers a handler that is notified of escalations. Handlers
+// must be registered before requests are served.
+func (e *Escalator) OnEscalate(handler Handler) {
+	e.handlers = append(e.handlers, handler)
+}
+
+// Record notes that subject offended in scope and blocks it globally once it
+// offended in enough scopes. It reports whether the subject was escalated.
+func (e *Escalator) Record(ctx context.Context, kind, subject, scope string) (bool, error) {
+	first, err := e.store.Increment(ctx, "offense:"+kind+":"+subject+":"+hash(scope), 1, e.opts.Window)
+	if err != nil || first > 1 {
+		return false, err
+	}
+	counter := "offenses:" + kind + ":" + subject
+	scopes, err := e.store.Increment(ctx, counter, 1, e.opts.Window)
+	if err != nil || scopes < int64(e.opts.Threshold) {
+		return false, err
+	}
+
+	switch kind {
+	case KindIP:
+		addr, err := netip.ParseAddr(subject)
+		if err != nil {
+			return false, err
+		}
+		err = e.limiter.BlockNetwork(ctx, netip.PrefixFrom(addr, addr.BitLen()), e.opts.Duration, ReasonEscalated)
+		if err != nil {
+			return false, err
+		}
+	default:
+		if err := e.store.Set(ctx, "escalated:"+kind+":"+subject, ReasonEscalated, e.opts.Duration); err != nil {
+			return false, err
+		}
+	}
+	// The count starts over, a subject that offends again after the block
+	// is escalated again.
+	if err := e.store.Delete(ctx, counter); err != nil {
+		return true, err
+	}
+
+	escalation := Escalation{
+		Kind:     kind,
+		Subject:  subject,
+		Scopes:   int(scopes),
+		Duration: e.opts.Duration,
+		Time:     time.Now(),
+	}
+	for _, handler := range e.handlers {
+		handler(ctx, escalation)
+	}
+	return true, nil
+}
+
+// Blocked reports whether a fingerprint is blocked globally. Escalated IPs
+// are found with limiter.RateLimiter.BlockedNetwork.
+func (e *Escalator) Blocked(ctx context.Context, fp string) (bool, error) {
+	return e.store.Exists(ctx, "escalated:"+KindFingerprint+":"+fp)
+}
+
+// Lift lifts the global block on subject and forgets its offenses.
+func (e *Escalator) Lift(ctx context.Context, kind, subject string) error {
+	if kind == KindIP {
+		addr, err := netip.ParseAddr(subject)
+		if err != nil {
+			return err
+		}
+		if err := e.limiter.UnblockNetwork(ctx, netip.PrefixFrom(addr, addr.BitLen())); err != nil {
+			return err
+		}
+	} else if err := e.store.Delete(ctx, "escalated:"+kind+":"+subject); err != nil {
+		return err
+	}
+	return e.store.Delete(ctx, "offenses:"+kind+":"+subject)
+}
+
+// hash keeps scopes, which may contain credentials hashed or not, short and
+// out of the store keys.
+func hash(scope string) string {
+	sum := sha256.Sum256([]byte(scope))
+	return hex.EncodeToString(sum[:8])
+}
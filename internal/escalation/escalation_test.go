@@ -0,0 +1,85 @@
+package escalation
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/sirupsen/logrus"
+)
+
+func newEscalator(t *testing.T) (*Escalator, *limiter.RateLimiter, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	store := limiter.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	l := limiter.NewRateLimiter(store, limiter.Config{RequestsPerMinute: 10, BlockDuration: time.Minute}, logger)
+	return New(Options{Threshold: 3, Window: 10 * time.Minute, Duration: 24 * time.Hour}, store, l), l, mr
+}
+
+func TestRecordIP(t *testing.T) {
+	ctx := context.Background()
+	e, l, _ := newEscalator(t)
+	var escalations []Escalation
+	e.OnEscalate(func(ctx context.Context, escalation Escalation) {
+		escalations = append(escalations, escalation)
+	})
+
+	// Repeat offenses in one scope count once.
+	for _, scope := range []string{"api", "api", "login", "login"} {
+		if escalated, err := e.Record(ctx, KindIP, "203.0.113.7", scope); err != nil || escalated {
+			t.Fatalf("Unexpected escalation in %s: %v %v", scope, escalated, err)
+		}
+	}
+	escalated, err := e.Record(ctx, KindIP, "203.0.113.7", "search")
+	if err != nil || !escalated {
+		t.Fatalf("Expected an escalation, got %v %v", escalated, err)
+	}
+	if len(escalations) != 1 || escalations[0].Scopes != 3 || escalations[0].Kind != KindIP {
+		t.Errorf("Unexpected escalations %+v", escalations)
+	}
+	block, blocked := l.BlockedNetwork(ctx, netip.MustParseAddr("203.0.113.7"))
+	if !blocked || block.Reason != ReasonEscalated || time.Until(block.Until) < 23*time.Hour {
+		t.Errorf("Expected a global block, got %+v %v", block, blocked)
+	}
+
+	if err := e.Lift(ctx, KindIP, "203.0.113.7"); err != nil {
+		t.Fatal(err)
+	}
+	if _, blocked := l.BlockedNetwork(ctx, netip.MustParseAddr("203.0.113.7")); blocked {
+		t.Error("Expected the block to be lifted")
+	}
+}
+
+func TestRecordFingerprint(t *testing.T) {
+	ctx := context.Background()
+	e, _, mr := newEscalator(t)
+
+	for _, scope := range []string{"api", "login"} {
+		if _, err := e.Record(ctx, KindFingerprint, "f00d", scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Offenses outside the window are forgotten.
+	mr.FastForward(11 * time.Minute)
+	if escalated, _ := e.Record(ctx, KindFingerprint, "f00d", "search"); escalated {
+		t.Fatal("Expected offenses to expire with the window")
+	}
+	for _, scope := range []string{"api", "login"} {
+		if _, err := e.Record(ctx, KindFingerprint, "f00d", scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if blocked, err := e.Blocked(ctx, "f00d"); err != nil || !blocked {
+		t.Fatalf("Expected the fingerprint to be blocked, got %v %v", blocked, err)
+	}
+	mr.FastForward(25 * time.Hour)
+	if blocked, _ := e.Blocked(ctx, "f00d"); blocked {
+		t.Error("Expected the block to expire")
+	}
+}
@@ -0,0 +1,192 @@
+// Package feedback records false positives reported by support tooling or
+// by the upstream, so that operators can see which rules reject legitimate
+// clients.
+//
+// The upstream reports a false positive by answering a request with the
+// HeaderFalsePositive response header, typically after it accepted a request
+// that Shielder tagged. Support tooling reports cases through the admin API.
+// Cases and per-rule counts are kept in Redis and shared by the fleet.
+// Reported clients are unblocked right away when configured to.
+package feedback
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// HeaderFalsePositive is set by the upstream on a response to report the
+// request as a false positive. Its value is either "1" or a comma-separated
+// list of the rules that were wrong. The header is not passed on to the
+// client.
+const HeaderFalsePositive = "X-Shielder-False-Positive"
+
+// Sources of reports.
+const (
+	SourceAPI      = "api"
+	SourceUpstream = "upstream"
+)
+
+// RuleUnspecified counts cases that were reported without rules.
+const RuleUnspecified = "unspecified"
+
+const (
+	casesKey = "feedback:false-positives"
+	rulesKey = "feedback:false-positives:rules"
+)
+
+// Case is a reported false positive.
+type Case struct {
+	// Client is the limiter key of the client, usually its IP.
+	Client    string    `json:"client"`
+	Rules     []string  `json:"rules,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	Source    string    `json:"source"`
+	Actor     string    `json:"actor,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Unblocked bool      `json:"unblocked"`
+	At        time.Time `json:"at"`
+}
+
+// RuleCount is how many false positives a rule caused.
+type RuleCount struct {
+	Rule           string `json:"rule"`
+	FalsePositives int64  `json:"falsePositives"`
+}
+
+// Unblocker lifts the block of a client.
+type Unblocker interface {
+	UnblockIP(ctx context.Context, ip string) error
+}
+
+// Recorder receives a count for every rule of every reported case.
+type Recorder interface {
+	IncFalsePositive(rule, source string)
+}
+
+// Options configures the collector.
+type Options struct {
+	// AutoUnblock unblocks reported clients unless a report says otherwise.
+	AutoUnblock bool
+	// MaxCases is how many recent cases are kept, 1000 by default. Rule
+	// counts are kept indefinitely.
+	MaxCases  int
+	Unblocker Unblocker
+	Recorder  Recorder
+}
+
+// Collector records false positives.
+type Collector struct {
+	opts   Options
+	client redis.UniversalClient
+	logger *logrus.Logger
+}
+
+// New creates a collector that keeps its cases in Redis.
+func New(opts Options, client redis.UniversalClient, logger *logrus.Logger) *Collector {
+	if opts.MaxCases <= 0 {
+		opts.MaxCases = 1000
+	}
+	return &Collector{opts: opts, client: client, logger: logger}
+}
+
+// AutoUnblock reports whether clients are unblocked by default.
+func (c *Collector) AutoUnblock() bool {
+	return c.opts.AutoUnblock
+}
+
+// Report records a case and unblocks the client if unblock is set. A failed
+// unblock is logged and leaves Unblocked unset, the case is recorded anyway.
+func (c *Collector) Report(ctx context.Context, fp Case, unblock bool) (Case, error) {
+	if fp.At.IsZero() {
+		fp.At = time.Now().UTC()
+	}
+	if unblock && c.opts.Unblocker != nil {
+		if err := c.opts.Unblocker.UnblockIP(ctx, fp.Client); err != nil {
+			c.logger.WithError(err).WithField("client", fp.Client).Error("Error unblocking reported client")
+		} else {
+			fp.Unblocked = true
+		}
+	}
+
+	payload, err := json.Marshal(fp)
+	if err != nil {
+		return fp, err
+	}
+	rules := fp.Rules
+	if len(rules) == 0 {
+		rules = []string{RuleUnspecified}
+	}
+	pipe := c.client.TxPipeline()
+	pipe.LPush(ctx, casesKey, payload)
+	pipe.LTrim(ctx, casesKey, 0, int64(c.opts.MaxCases-1))
+	for _, rule := range rules {
+		pipe.HIncrBy(ctx, rulesKey, rule, 1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fp, err
+	}
+	if c.opts.Recorder != nil {
+		for _, rule := range rules {
+			c.opts.Recorder.IncFalsePositive(rule, fp.Source)
+		}
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"client":    fp.Client,
+		"rules":     fp.Rules,
+		"route":     fp.Route,
+		"source":    fp.Source,
+		"actor":     fp.Actor,
+		"unblocked": fp.Unblocked,
+	}).Info("False positive reported")
+	return fp, nil
+}
+
+// Cases returns up to limit recent cases, newest first.
+func (c *Collector) Cases(ctx context.Context, limit int) ([]Case, error) {
+	if limit <= 0 || limit > c.opts.MaxCases {
+		limit = c.opts.MaxCases
+	}
+	values, err := c.client.LRange(ctx, casesKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	cases := make([]Case, 0, len(values))
+	for _, value := range values {
+		var fp Case
+		if err := json.Unmarshal([]byte(value), &fp); err != nil {
+			continue
+		}
+		cases = append(cases, fp)
+	}
+	return cases, nil
+}
+
+// Rules returns the false positive count of every rule, highest first.
+func (c *Collector) Rules(ctx context.Context) ([]RuleCount, error) {
+	fields, err := c.client.HGetAll(ctx, rulesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]RuleCount, 0, len(fields))
+	for rule, value := range fields {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		counts = append(counts, RuleCount{Rule: rule, FalsePositives: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].FalsePositives != counts[j].FalsePositives {
+			return counts[i].FalsePositives > counts[j].FalsePositives
+		}
+		return counts[i].Rule < counts[j].Rule
+	})
+	return counts, nil
+}
@@ -0,0 +1,64 @@
+package feedback
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+type unblocker struct {
+	unblocked []string
+}
+
+func (u *unblocker) UnblockIP(ctx context.Context, ip string) error {
+	u.unblocked = append(u.unblocked, ip)
+	return nil
+}
+
+func TestReport(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	u := &unblocker{}
+	c := New(Options{MaxCases: 2, Unblocker: u}, client, logger)
+	ctx := context.Background()
+
+	fp, err := c.Report(ctx, Case{Client: "10.0.0.1", Rules: []string{"rate_limit_exceeded", "greylisted"}, Source: SourceUpstream}, true)
+	if err != nil || !fp.Unblocked {
+		t.Fatalf("Expected the client to be unblocked, got %+v (%v)", fp, err)
+	}
+	c.Report(ctx, Case{Client: "10.0.0.2", Rules: []string{"rate_limit_exceeded"}, Source: SourceAPI}, false)
+	c.Report(ctx, Case{Client: "10.0.0.3", Source: SourceAPI}, false)
+
+	if len(u.unblocked) != 1 || u.unblocked[0] != "10.0.0.1" {
+		t.Errorf("Expected only 10.0.0.1 to be unblocked, got %v", u.unblocked)
+	}
+
+	cases, err := c.Cases(ctx, 10)
+	if err != nil {
+		t.Fatalf("Cases failed: %v", err)
+	}
+	if len(cases) != 2 || cases[0].Client != "10.0.0.3" || cases[1].Client != "10.0.0.2" {
+		t.Errorf("Expected the two newest cases, got %+v", cases)
+	}
+
+	rules, err := c.Rules(ctx)
+	if err != nil {
+		t.Fatalf("Rules failed: %v", err)
+	}
+	want := []RuleCount{{"rate_limit_exceeded", 2}, {"greylisted", 1}, {RuleUnspecified, 1}}
+	if len(rules) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want, rules)
+			break
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package fingerprint links clients that rotate IP addresses. A fingerprint
+// combines the User-Agent, the TLS parameters and the browser headers a
+// client sends. When a client is rate limited, its fingerprint is remembered
+// for a while, and a client with the same fingerprint on another IP is held
+// to a tighter limit, so that attackers cannot shed their penalty by simply
+// switching proxies.
+//
+// Fingerprints are coarse: many clients behind the same browser version share
+// one. The carried over penalty should therefore stay well below the full
+// limit.
+package fingerprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+// defaultHeaders are the request headers whose values go into a fingerprint.
+var defaultHeaders = []string{"Accept", "Accept-Language", "Accept-Encoding"}
+
+// Options configures fingerprint linkage.
+type Options struct {
+	// TLSHeader names a header in which a TLS terminator in front of
+	// Shielder passes a JA3 or JA4 fingerprint. Without it, the negotiated
+	// TLS parameters of the connection are used.
+	TLSHeader string
+	// Headers whose values go into the fingerprint, in addition to the
+	// User-Agent. Defaults to Accept, Accept-Language and Accept-Encoding.
+	Headers []string
+	// CarryOver is the share of the rate limit, between 0 and 1, that a
+	// client loses when it shares a fingerprint with a recently limited
+	// client on another IP.
+	CarryOver float64
+	// Window is how long the fingerprint of a limited client is remembered.
+	Window time.Duration
+}
+
+// Linker remembers the fingerprints of limited clients.
+type Linker struct {
+	opts  Options
+	store limiter.Store
+}
+
+// New creates a linker that keeps fingerprints in store, next to the limiter
+// counters.
+func New(opts Options, store limiter.Store) *Linker {
+	if len(opts.Headers) == 0 {
+		opts.Headers = defaultHeaders
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Hour
+	}
+	opts.CarryOver = min(max(opts.CarryOver, 0), 1)
+	return &Linker{opts: opts, store: store}
+}
+
+// Fingerprint returns the fingerprint of the client that sent r.
+func (l *Linker) Fingerprint(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.UserAgent())
+	b.WriteByte('\n')
+	if l.opts.TLSHeader != "" {
+		b.WriteString(r.Header.Get(l.opts.TLSHeader))
+	} else if r.TLS != nil {
+		b.WriteString(strconv.Itoa(int(r.TLS.Version)))
+		b.WriteByte(',')
+		b.WriteString(strconv.Itoa(int(r.TLS.CipherSuite)))
+		b.WriteByte(',')
+		b.WriteString(r.TLS.NegotiatedProtocol)
+	}
+	for _, name := range l.opts.Headers {
+		b.WriteByte('\n')
+		b.WriteString(r.Header.Get(name))
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:12])
+}
+
+// Mark remembers that the client at ip with fingerprint fp was limited.
+func (l *Linker) Mark(ctx context.Context, fp, ip string) error {
+	return l.store.Set(ctx, key(fp), ip, l.opts.Window)
+}
+
+// Factor returns the factor the limits of the client at ip with fingerprint
+// fp are scaled by: below 1 if a client with the same fingerprint on another
+// IP was limited within the window. Stores that cannot report the IP of the
+// marked client penalize the same IP as well.
+func (l *Linker) Factor(ctx context.Context, fp, ip string) (float64, error) {
+	if l.opts.CarryOver == 0 {
+		return 1, nil
+	}
+	var linked bool
+	if inspector, ok := l.store.(limiter.Inspector); ok {
+		marked, _, found, err := inspector.Inspect(ctx, key(fp))
+		if err != nil {
+			return 1, err
+		}
+		linked = found && marked != ip
+	} else {
+		found, err := l.store.Exists(ctx, key(fp))
+		if err != nil {
+			return 1, err
+		}
+		linked = found
+	}
+	if !linked {
+		return 1, nil
+	}
+	return 1 - l.opts.CarryOver, nil
+}
+
+func key(fp string) string {
+	return "fingerprint:" + fp
+}
@@ -0,0 +1,79 @@
+package fingerprint
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+func newTestLinker(t *testing.T, opts Options) *Linker {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return New(opts, limiter.NewRedisStore(client))
+}
+
+func TestFingerprint(t *testing.T) {
+	l := newTestLinker(t, Options{TLSHeader: "X-JA4"})
+	request := func(ua, ja4, lang string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", ua)
+		r.Header.Set("X-JA4", ja4)
+		r.Header.Set("Accept-Language", lang)
+		return l.Fingerprint(r)
+	}
+
+	base := request("curl/8.0", "t13d1516h2", "en")
+	if request("curl/8.0", "t13d1516h2", "en") != base {
+		t.Errorf("Expected identical clients to share a fingerprint")
+	}
+	tests := []struct {
+		name string
+		fp   string
+	}{
+		{"different user agent", request("curl/8.1", "t13d1516h2", "en")},
+		{"different TLS fingerprint", request("curl/8.0", "t13d1517h2", "en")},
+		{"different header", request("curl/8.0", "t13d1516h2", "de")},
+	}
+	for _, tt := range tests {
+		if tt.fp == base {
+			t.Errorf("%s: expected a different fingerprint", tt.name)
+		}
+	}
+}
+
+func TestFactor(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLinker(t, Options{CarryOver: 0.75, Window: time.Minute})
+
+	if factor, err := l.Factor(ctx, "fp", "10.0.0.2"); err != nil || factor != 1 {
+		t.Errorf("Expected factor 1 for an unknown fingerprint, got %v (%v)", factor, err)
+	}
+	if err := l.Mark(ctx, "fp", "10.0.0.1"); err != nil {
+		t.Fatalf("Failed to mark fingerprint: %v", err)
+	}
+
+	tests := []struct {
+		fp   string
+		ip   string
+		want float64
+	}{
+		{"fp", "10.0.0.2", 0.25},
+		{"fp", "10.0.0.1", 1},
+		{"other", "10.0.0.2", 1},
+	}
+	for _, tt := range tests {
+		factor, err := l.Factor(ctx, tt.fp, tt.ip)
+		if err != nil {
+			t.Fatalf("Failed to get factor: %v", err)
+		}
+		if factor != tt.want {
+			t.Errorf("%s from %s: expected factor %v, got %v", tt.fp, tt.ip, tt.want, factor)
+		}
+	}
+}
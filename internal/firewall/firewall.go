@@ -0,0 +1,151 @@
+// Package firewall hands block decisions to the host firewall, so that
+// blocked clients are stopped at the network layer instead of receiving 429s.
+//
+// Two outputs are supported, either or both can be used:
+//
+//   - a log file with one line per event, for fail2ban:
+//
+//     2026-01-02 15:04:05 shielder: block 192.0.2.7 duration=3600 reason=rate_limit_exceeded
+//
+//     matched by a filter such as
+//
+//     [Definition]
+//     failregex = ^ shielder: block <HOST>
+//
+//   - a hook command, run as "command block|unblock <ip> <seconds> <reason>",
+//     for example a script calling "ipset add shielder $2 timeout $3 -exist"
+//
+// Only client keys that are IP addresses are passed on. Events are handed off
+// in the background and dropped with a warning when the buffer is full.
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/sirupsen/logrus"
+)
+
+// Options configures the outputs.
+type Options struct {
+	// LogFile is appended to on every event. The file is reopened for every
+	// line, so it can be rotated without signaling Shielder.
+	LogFile string
+	// Command is run for every event.
+	Command string
+	// Timeout bounds a single command run, 10 seconds by default.
+	Timeout    time.Duration
+	BufferSize int
+}
+
+// Output writes events to the host firewall outputs.
+type Output struct {
+	opts   Options
+	logger *logrus.Logger
+	events chan limiter.Event
+	wg     sync.WaitGroup
+}
+
+// New starts an output. Observe must be registered as a limiter event
+// handler.
+func New(opts Options, logger *logrus.Logger) *Output {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1024
+	}
+	o := &Output{opts: opts, logger: logger, events: make(chan limiter.Event, opts.BufferSize)}
+	o.wg.Add(1)
+	go o.run()
+	return o
+}
+
+// Observe queues block and unblock events of IP addresses.
+func (o *Output) Observe(ctx context.Context, event limiter.Event) {
+	addr, err := netip.ParseAddr(event.IP)
+	if err != nil {
+		return
+	}
+	event.IP = addr.Unmap().String()
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	select {
+	case o.events <- event:
+	default:
+		o.logger.WithFields(logrus.Fields{
+			"type": event.Type,
+			"ip":   event.IP,
+		}).Warn("Firewall output buffer full, dropping event")
+	}
+}
+
+// Close stops accepting events and waits for queued events to be written.
+func (o *Output) Close() {
+	close(o.events)
+	o.wg.Wait()
+}
+
+func (o *Output) run() {
+	defer o.wg.Done()
+	for event := range o.events {
+		if o.opts.LogFile != "" {
+			if err := o.writeLog(event); err != nil {
+				o.logger.WithError(err).Error("Error writing firewall log")
+			}
+		}
+		if o.opts.Command != "" {
+			if err := o.runCommand(event); err != nil {
+				o.logger.WithError(err).WithField("ip", event.IP).Error("Error running firewall hook")
+			}
+		}
+	}
+}
+
+// seconds returns the remaining block duration of event, at least one
+// second for blocks, which firewalls take as the timeout of the entry.
+func seconds(event limiter.Event) int64 {
+	if event.Type != limiter.EventBlock {
+		return 0
+	}
+	remaining := event.Duration - time.Since(event.Time)
+	return max(1, int64(remaining.Round(time.Second)/time.Second))
+}
+
+// formatLine formats event as a log line for fail2ban.
+func formatLine(event limiter.Event) string {
+	return fmt.Sprintf("%s shielder: %s %s duration=%d reason=%s\n",
+		event.Time.UTC().Format(time.DateTime), event.Type, event.IP, seconds(event), event.Reason)
+}
+
+func (o *Output) writeLog(event limiter.Event) error {
+	f, err := os.OpenFile(o.opts.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(formatLine(event)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (o *Output) runCommand(event limiter.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.opts.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, o.opts.Command,
+		string(event.Type), event.IP, strconv.FormatInt(seconds(event), 10), event.Reason)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package firewall
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/sirupsen/logrus"
+)
+
+func TestOutput(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "shielder-blocks.log")
+	hookOut := filepath.Join(dir, "hook.out")
+	hook := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\necho \"$@\" >> " + hookOut + "\n"
+	if err := os.WriteFile(hook, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	o := New(Options{LogFile: logFile, Command: hook}, logger)
+	ctx := context.Background()
+	at := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	o.Observe(ctx, limiter.Event{Type: limiter.EventBlock, IP: "192.0.2.7", Reason: limiter.ReasonRateLimitExceeded, Duration: time.Since(at) + time.Hour, Time: at})
+	o.Observe(ctx, limiter.Event{Type: limiter.EventBlock, IP: "session:abc", Duration: time.Hour})
+	o.Observe(ctx, limiter.Event{Type: limiter.EventUnblock, IP: "::ffff:192.0.2.7", Reason: limiter.ReasonManual, Time: at})
+	o.Close()
+
+	log, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2026-01-02 15:04:05 shielder: block 192.0.2.7 duration=3600 reason=rate_limit_exceeded\n" +
+		"2026-01-02 15:04:05 shielder: unblock 192.0.2.7 duration=0 reason=manual\n"
+	if string(log) != want {
+		t.Errorf("Unexpected log:\n%s\nwant:\n%s", log, want)
+	}
+
+	calls, err := os.ReadFile(hookOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if len(lines) != 2 || lines[0] != "block 192.0.2.7 3600 rate_limit_exceeded" || lines[1] != "unblock 192.0.2.7 0 manual" {
+		t.Errorf("Unexpected hook calls %q", lines)
+	}
+}
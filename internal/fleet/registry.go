@@ -0,0 +1,289 @@
+// Package fleet keeps a registry of the running Shielder instances in Redis.
+// Every instance heartbeats its version and configuration hash, so that
+// operators can see the fleet and spot instances running a different
+// configuration, and polls a per-instance queue of commands, such as a
+// binary upgrade or an IP list reload, that operators target at it or
+// at the whole fleet.
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// instancesKey is the set of instance IDs that registered.
+	instancesKey = "shielder:instances"
+	// instancePrefix prefixes the record of an instance, which expires
+	// when the instance stops heartbeating.
+	instancePrefix = "shielder:instance:"
+	// commandsSuffix names the command queue of an instance.
+	commandsSuffix = ":commands"
+)
+
+// Commands the instances run.
+const (
+	// CommandUpgrade replaces the binary and restarts the instance.
+	CommandUpgrade = "upgrade"
+	// CommandReload reads the IP lists from the configuration file again.
+	// Other settings in the file take a restart, runtime changes go through
+	// the settings API.
+	CommandReload = "reload"
+)
+
+// ErrUnknownInstance is returned when a command targets an instance that is
+// not registered.
+var ErrUnknownInstance = errors.New("unknown instance")
+
+// ErrUnknownCommand is returned when a command is not supported.
+var ErrUnknownCommand = errors.New("unknown command")
+
+// Options configures the registry.
+type Options struct {
+	// Instance identifies this instance in the fleet.
+	Instance   string
+	Version    string
+	ConfigHash string
+	// HeartbeatInterval is how often the record is refreshed and commands
+	// are polled. An instance drops out of the registry three intervals
+	// after its last heartbeat.
+	HeartbeatInterval time.Duration
+}
+
+// Instance is the registry record of an instance.
+type Instance struct {
+	ID         string    `json:"id"`
+	Version    string    `json:"version"`
+	ConfigHash string    `json:"configHash"`
+	StartedAt  time.Time `json:"startedAt"`
+	LastSeen   time.Time `json:"lastSeen"`
+	// Drift is set on instances whose configuration hash differs from the
+	// one most of the fleet runs.
+	Drift bool `json:"drift"`
+}
+
+// CommandHandler runs a command targeted at this instance.
+type CommandHandler func(ctx context.Context) error
+
+// Registry registers this instance and lists the fleet.
+type Registry struct {
+	opts      Options
+	client    redis.UniversalClient
+	logger    *logrus.Logger
+	startedAt time.Time
+
+	mu       sync.RWMutex
+	handlers map[string]CommandHandler
+}
+
+// New creates a registry. Run must be called to register the instance.
+func New(opts Options, client redis.UniversalClient, logger *logrus.Logger) *Registry {
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = 5 * time.Second
+	}
+	return &Registry{
+		opts:      opts,
+		client:    client,
+		logger:    logger,
+		startedAt: time.Now().UTC(),
+		handlers:  make(map[string]CommandHandler),
+	}
+}
+
+// Handle registers the handler for a command. Handlers run on the heartbeat
+// goroutine, one at a time.
+func (r *Registry) Handle(command string, handler CommandHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[command] = handler
+}
+
+// Run heartbeats and runs queued commands every heartbeat interval until
+// ctx is done.
+func (r *Registry) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.heartbeat(ctx); err != nil {
+			r.logger.WithError(err).Warn("Error registering instance")
+		}
+		r.runCommands(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Registry) heartbeat(ctx context.Context) error {
+	record, err := json.Marshal(Instance{
+		ID:         r.opts.Instance,
+		Version:    r.opts.Version,
+		ConfigHash: r.opts.ConfigHash,
+		StartedAt:  r.startedAt,
+		LastSeen:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, instancePrefix+r.opts.Instance, record, r.ttl())
+		pipe.SAdd(ctx, instancesKey, r.opts.Instance)
+		return nil
+	})
+	return err
+}
+
+func (r *Registry) runCommands(ctx context.Context) {
+	for ctx.Err() == nil {
+		command, err := r.client.LPop(ctx, instancePrefix+r.opts.Instance+commandsSuffix).Result()
+		if err == redis.Nil {
+			return
+		}
+		if err != nil {
+			r.logger.WithError(err).Warn("Error reading instance commands")
+			return
+		}
+
+		r.mu.RLock()
+		handler, ok := r.handlers[command]
+		r.mu.RUnlock()
+		logger := r.logger.WithField("command", command)
+		if !ok {
+			logger.Warn("Ignoring unsupported instance command")
+			continue
+		}
+		logger.Info("Running instance command")
+		if err := handler(ctx); err != nil {
+			logger.WithError(err).Error("Instance command failed")
+		}
+	}
+}
+
+// Instances lists the registered instances by ID and flags configuration
+// drift. Instances that stopped heartbeating are removed from the registry.
+func (r *Registry) Instances(ctx context.Context) ([]Instance, error) {
+	ids, err := r.client.SMembers(ctx, instancesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	instances := make([]Instance, 0, len(ids))
+	if len(ids) == 0 {
+		return instances, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = instancePrefix + id
+	}
+	records, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var gone []any
+	hashes := make(map[string]int)
+	for i, record := range records {
+		s, ok := record.(string)
+		if !ok {
+			gone = append(gone, ids[i])
+			continue
+		}
+		var instance Instance
+		if err := json.Unmarshal([]byte(s), &instance); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", ids[i], err)
+		}
+		instances = append(instances, instance)
+		hashes[instance.ConfigHash]++
+	}
+	if len(gone) > 0 {
+		if err := r.client.SRem(ctx, instancesKey, gone...).Err(); err != nil {
+			r.logger.WithError(err).Warn("Error removing expired instances")
+		}
+	}
+
+	// The configuration most instances run is taken as the intended one.
+	var common string
+	for hash, n := range hashes {
+		if n > hashes[common] || (n == hashes[common] && hash < common) {
+			common = hash
+		}
+	}
+	for i := range instances {
+		instances[i].Drift = instances[i].ConfigHash != common
+	}
+	return instances, nil
+}
+
+// Send queues a command for the instance with the given ID, which runs it
+// with its next heartbeat. Only commands this instance has a handler for can
+// be sent, as the fleet is expected to run the same configuration.
+func (r *Registry) Send(ctx context.Context, id, command string) error {
+	r.mu.RLock()
+	_, ok := r.handlers[command]
+	r.mu.RUnlock()
+	if !ok {
+		return ErrUnknownCommand
+	}
+
+	n, err := r.client.Exists(ctx, instancePrefix+id).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUnknownInstance
+	}
+	return r.queue(ctx, []string{id}, command)
+}
+
+// Broadcast queues a command for every registered instance and returns their
+// IDs. Like Send, it only accepts commands this instance has a handler for.
+func (r *Registry) Broadcast(ctx context.Context, command string) ([]string, error) {
+	r.mu.RLock()
+	_, ok := r.handlers[command]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownCommand
+	}
+
+	instances, err := r.Instances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(instances))
+	for i, instance := range instances {
+		ids[i] = instance.ID
+	}
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	return ids, r.queue(ctx, ids, command)
+}
+
+func (r *Registry) queue(ctx context.Context, ids []string, command string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			key := instancePrefix + id + commandsSuffix
+			pipe.RPush(ctx, key, command)
+			pipe.Expire(ctx, key, r.ttl())
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *Registry) ttl() time.Duration {
+	return 3 * r.opts.HeartbeatInterval
+}
@@ -0,0 +1,144 @@
+package fleet
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestRegistries(t *testing.T, hashes ...string) ([]*Registry, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	var registries []*Registry
+	for i, hash := range hashes {
+		r := New(Options{
+			Instance:          string(rune('a' + i)),
+			Version:           "v1.2.0",
+			ConfigHash:        hash,
+			HeartbeatInterval: time.Second,
+		}, client, logger)
+		if err := r.heartbeat(context.Background()); err != nil {
+			t.Fatalf("Failed to heartbeat: %v", err)
+		}
+		registries = append(registries, r)
+	}
+	return registries, mr
+}
+
+func TestInstancesFlagsDrift(t *testing.T) {
+	registries, _ := newTestRegistries(t, "h1", "h2", "h1")
+
+	instances, err := registries[0].Instances(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list instances: %v", err)
+	}
+	if len(instances) != 3 {
+		t.Fatalf("Expected 3 instances, got %d", len(instances))
+	}
+	for _, instance := range instances {
+		if want := instance.ID == "b"; instance.Drift != want {
+			t.Errorf("Expected drift %v for instance %s, got %v", want, instance.ID, instance.Drift)
+		}
+		if instance.Version != "v1.2.0" {
+			t.Errorf("Expected version v1.2.0, got %q", instance.Version)
+		}
+	}
+}
+
+func TestInstancesDropExpired(t *testing.T) {
+	registries, mr := newTestRegistries(t, "h1", "h1")
+	mr.FastForward(5 * time.Second)
+	if err := registries[0].heartbeat(context.Background()); err != nil {
+		t.Fatalf("Failed to heartbeat: %v", err)
+	}
+
+	instances, err := registries[0].Instances(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list instances: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "a" {
+		t.Errorf("Expected only instance a to be left, got %+v", instances)
+	}
+	if members, _ := mr.SMembers(instancesKey); len(members) != 1 {
+		t.Errorf("Expected the expired instance to be removed from the set, got %v", members)
+	}
+}
+
+func TestSendRunsCommandOnTarget(t *testing.T) {
+	ctx := context.Background()
+	registries, _ := newTestRegistries(t, "h1", "h1")
+	ran := map[string]int{}
+	for _, r := range registries {
+		r := r
+		r.Handle("upgrade", func(ctx context.Context) error {
+			ran[r.opts.Instance]++
+			return nil
+		})
+	}
+
+	if err := registries[0].Send(ctx, "b", "upgrade"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	for _, r := range registries {
+		r.runCommands(ctx)
+	}
+	if ran["a"] != 0 || ran["b"] != 1 {
+		t.Errorf("Expected the command to run on b only, got %v", ran)
+	}
+
+	if err := registries[0].Send(ctx, "z", "upgrade"); err != ErrUnknownInstance {
+		t.Errorf("Expected ErrUnknownInstance, got %v", err)
+	}
+	if err := registries[0].Send(ctx, "b", "format"); err != ErrUnknownCommand {
+		t.Errorf("Expected ErrUnknownCommand, got %v", err)
+	}
+}
+
+func TestBroadcastRunsCommandEverywhere(t *testing.T) {
+	ctx := context.Background()
+	registries, mr := newTestRegistries(t, "h1", "h1", "h1")
+	ran := map[string]int{}
+	for _, r := range registries {
+		r := r
+		r.Handle(CommandReload, func(ctx context.Context) error {
+			ran[r.opts.Instance]++
+			return nil
+		})
+	}
+
+	// Instance c stopped heartbeating and is not sent the command.
+	mr.FastForward(2 * time.Second)
+	for _, r := range registries[:2] {
+		if err := r.heartbeat(ctx); err != nil {
+			t.Fatalf("Failed to heartbeat: %v", err)
+		}
+	}
+	mr.FastForward(2 * time.Second)
+
+	ids, err := registries[0].Broadcast(ctx, CommandReload)
+	if err != nil {
+		t.Fatalf("Failed to broadcast command: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("Expected the command queued for a and b, got %v", ids)
+	}
+	for _, r := range registries {
+		r.runCommands(ctx)
+	}
+	if ran["a"] != 1 || ran["b"] != 1 || ran["c"] != 0 {
+		t.Errorf("Expected the command to run once on every live instance, got %v", ran)
+	}
+
+	if _, err := registries[0].Broadcast(ctx, "format"); err != ErrUnknownCommand {
+		t.Errorf("Expected ErrUnknownCommand, got %v", err)
+	}
+}
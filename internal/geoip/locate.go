@@ -0,0 +1,111 @@
+package geoip
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// Location is what is known about where an address is.
+type Location struct {
+	Country      string `json:"country,omitempty"`
+	ASN          uint   `json:"asn,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	// Override is the prefix of the override that corrected the location,
+	// if any.
+	Override string `json:"override,omitempty"`
+}
+
+// Override corrects the location of a network that the databases get wrong,
+// such as corporate ranges. Fields left empty keep the database result.
+type Override struct {
+	Prefix       netip.Prefix
+	Country      string
+	ASN          uint
+	Organization string
+}
+
+// LocatorOptions configures a Locator.
+type LocatorOptions struct {
+	// CountryDatabase and ASNDatabase name the MaxMind databases of the
+	// manager to look addresses up in. Either may be empty.
+	CountryDatabase string
+	ASNDatabase     string
+	Overrides       []Override
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// Locator resolves addresses to countries and autonomous systems, applying
+// the configured overrides before the databases are consulted.
+type Locator struct {
+	manager   *Manager
+	opts      LocatorOptions
+	overrides []Override
+}
+
+// NewLocator creates a locator. The manager may be nil, in which case only
+// the overrides are used.
+func NewLocator(m *Manager, opts LocatorOptions) *Locator {
+	overrides := make([]Override, len(opts.Overrides))
+	for i, o := range opts.Overrides {
+		o.Prefix = o.Prefix.Masked()
+		overrides[i] = o
+	}
+	// The most specific override wins.
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return overrides[i].Prefix.Bits() > overrides[j].Prefix.Bits()
+	})
+	return &Locator{manager: m, opts: opts, overrides: overrides}
+}
+
+// Locate returns the location of ip. Lookup errors leave the affected fields
+// empty, as for an address the databases do not know.
+func (l *Locator) Locate(ip netip.Addr) Location {
+	ip = ip.Unmap()
+
+	var loc Location
+	if o, ok := l.override(ip); ok {
+		loc = Location{Country: o.Country, ASN: o.ASN, Organization: o.Organization, Override: o.Prefix.String()}
+		if loc.Country != "" && loc.ASN != 0 {
+			return loc
+		}
+	}
+
+	if l.manager == nil {
+		return loc
+	}
+	if loc.Country == "" && l.opts.CountryDatabase != "" {
+		var record countryRecord
+		if found, err := l.manager.Lookup(l.opts.CountryDatabase, ip, &record); err == nil && found {
+			loc.Country = record.Country.ISOCode
+		}
+	}
+	if loc.ASN == 0 && l.opts.ASNDatabase != "" {
+		var record asnRecord
+		if found, err := l.manager.Lookup(l.opts.ASNDatabase, ip, &record); err == nil && found {
+			loc.ASN = record.Number
+			if loc.Organization == "" {
+				loc.Organization = record.Organization
+			}
+		}
+	}
+	return loc
+}
+
+func (l *Locator) override(ip netip.Addr) (Override, bool) {
+	for _, o := range l.overrides {
+		if o.Prefix.Contains(ip) {
+			return o, true
+		}
+	}
+	return Override{}, false
+}
@@ -0,0 +1,59 @@
+package geoip
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocateOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, buildMMDB(time.Now(), "US", "DE"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{Sources: []Source{{Name: "country", Type: TypeMMDB, Path: path}}}, testLogger())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	l := NewLocator(m, LocatorOptions{
+		CountryDatabase: "country",
+		ASNDatabase:     "asn",
+		Overrides: []Override{
+			{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Country: "GB", Organization: "Corp"},
+			{Prefix: netip.MustParsePrefix("10.1.2.0/24"), Country: "FR", ASN: 64500},
+			{Prefix: netip.MustParsePrefix("200.1.0.0/16"), ASN: 64501},
+		},
+	})
+
+	tests := []struct {
+		ip   string
+		want Location
+	}{
+		{"1.2.3.4", Location{Country: "US"}},
+		{"10.9.9.9", Location{Country: "GB", Organization: "Corp", Override: "10.0.0.0/8"}},
+		{"10.1.2.3", Location{Country: "FR", ASN: 64500, Override: "10.1.2.0/24"}},
+		{"::ffff:10.1.2.3", Location{Country: "FR", ASN: 64500, Override: "10.1.2.0/24"}},
+		// Fields the override leaves empty come from the database.
+		{"200.1.1.1", Location{Country: "DE", ASN: 64501, Override: "200.1.0.0/16"}},
+	}
+	for _, tt := range tests {
+		if got := l.Locate(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("Locate(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestLocateWithoutDatabases(t *testing.T) {
+	l := NewLocator(nil, LocatorOptions{
+		Overrides: []Override{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Country: "NL"}},
+	})
+	if got := l.Locate(netip.MustParseAddr("192.0.2.1")); got.Country != "NL" {
+		t.Errorf("Expected the override country, got %+v", got)
+	}
+	if got := l.Locate(netip.MustParseAddr("198.51.100.1")); got != (Location{}) {
+		t.Errorf("Expected an unknown location, got %+v", got)
+	}
+}
@@ -0,0 +1,499 @@
+// Package geoip keeps GeoIP and IP reputation databases up to date. MaxMind
+// databases and plain IP lists are downloaded on a schedule, checked against
+// their published checksum, validated and swapped in atomically, so lookups
+// never see a partially written database. Every database is also kept on
+// disk, so that a restart does not depend on the download being available.
+package geoip
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+)
+
+// Database types.
+const (
+	// TypeMMDB is a MaxMind database, either as the .mmdb file or in the
+	// tar.gz archive MaxMind publishes.
+	TypeMMDB = "mmdb"
+	// TypeList is a text file with one IP address or CIDR per line. Empty
+	// lines and lines starting with # or ; are ignored.
+	TypeList = "list"
+)
+
+// maxDownloadBytes bounds the size of a download.
+const maxDownloadBytes = 512 << 20
+
+// Source describes a database and where to get it.
+type Source struct {
+	Name string
+	Type string
+	// URL is downloaded on every refresh. If it is empty, the file at Path
+	// is only loaded.
+	URL string
+	// ChecksumURL points to the hex SHA-256 of the download, optionally
+	// followed by the file name as written by sha256sum.
+	ChecksumURL string
+	// Path is where the database is kept on disk.
+	Path string
+}
+
+// Recorder receives database metrics.
+type Recorder interface {
+	SetGeoIPDatabaseAge(database string, age time.Duration)
+	SetGeoIPDatabaseStale(database string, stale bool)
+	IncGeoIPRefresh(database, result string)
+}
+
+// Options configures the manager.
+type Options struct {
+	Sources []Source
+	// RefreshInterval is how often the databases are downloaded.
+	RefreshInterval time.Duration
+	// StaleAfter is the age at which a database counts as stale.
+	StaleAfter time.Duration
+	Recorder   Recorder
+	Client     *http.Client
+}
+
+// Status describes a database.
+type Status struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Loaded      bool      `json:"loaded"`
+	BuiltAt     time.Time `json:"builtAt,omitempty"`
+	RefreshedAt time.Time `json:"refreshedAt,omitempty"`
+	Stale       bool      `json:"stale"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// database is a loaded version of a source.
+type database struct {
+	reader *maxminddb.Reader
+	list   *ipList
+	// builtAt is the build time of MaxMind databases and the modification
+	// time of lists.
+	builtAt time.Time
+}
+
+type entry struct {
+	source  Source
+	current atomic.Pointer[database]
+
+	mu           sync.Mutex
+	refreshedAt  time.Time
+	lastModified string
+	lastError    string
+	stale        bool
+}
+
+// Manager holds the current version of every database.
+type Manager struct {
+	opts    Options
+	entries map[string]*entry
+	order   []string
+	logger  *logrus.Logger
+}
+
+// New creates a manager and loads the databases already on disk. Missing
+// files are not an error, they are downloaded by Run.
+func New(opts Options, logger *logrus.Logger) (*Manager, error) {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = 24 * time.Hour
+	}
+	if opts.StaleAfter <= 0 {
+		opts.StaleAfter = 7 * 24 * time.Hour
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	m := &Manager{opts: opts, entries: make(map[string]*entry), logger: logger}
+	for _, source := range opts.Sources {
+		if source.Type != TypeMMDB && source.Type != TypeList {
+			return nil, fmt.Errorf("geoip: database %s has unknown type %q", source.Name, source.Type)
+		}
+		if source.Path == "" {
+			return nil, fmt.Errorf("geoip: database %s needs a path", source.Name)
+		}
+		if _, exists := m.entries[source.Name]; exists {
+			return nil, fmt.Errorf("geoip: database %s is configured twice", source.Name)
+		}
+		e := &entry{source: source}
+		m.entries[source.Name] = e
+		m.order = append(m.order, source.Name)
+
+		data, err := os.ReadFile(source.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		db, err := parse(source.Type, data)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: database %s: %w", source.Name, err)
+		}
+		if db.builtAt.IsZero() {
+			if info, err := os.Stat(source.Path); err == nil {
+				db.builtAt = info.ModTime()
+			}
+		}
+		e.current.Store(db)
+	}
+	m.checkAge(time.Now())
+	return m, nil
+}
+
+// Run refreshes the databases right away and then every refresh interval
+// until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	m.RefreshAll(ctx)
+	refresh := time.NewTicker(m.opts.RefreshInterval)
+	defer refresh.Stop()
+	age := time.NewTicker(time.Minute)
+	defer age.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			m.RefreshAll(ctx)
+		case now := <-age.C:
+			m.checkAge(now)
+		}
+	}
+}
+
+// RefreshAll downloads every database that has a URL. Failures are logged and
+// leave the previous version in place.
+func (m *Manager) RefreshAll(ctx context.Context) {
+	for _, name := range m.order {
+		e := m.entries[name]
+		if e.source.URL == "" {
+			continue
+		}
+		result := "updated"
+		updated, err := m.refresh(ctx, e)
+		switch {
+		case err != nil:
+			result = "error"
+			m.logger.WithError(err).WithField("database", name).Error("Error refreshing GeoIP database")
+		case !updated:
+			result = "unchanged"
+		default:
+			m.logger.WithField("database", name).Info("GeoIP database updated")
+		}
+		e.mu.Lock()
+		if err != nil {
+			e.lastError = err.Error()
+		} else {
+			e.lastError = ""
+			e.refreshedAt = time.Now()
+		}
+		e.mu.Unlock()
+		if m.opts.Recorder != nil {
+			m.opts.Recorder.IncGeoIPRefresh(name, result)
+		}
+	}
+	m.checkAge(time.Now())
+}
+
+// refresh downloads, verifies and swaps in a new version of e. It reports
+// false if the server said the database did not change.
+func (m *Manager) refresh(ctx context.Context, e *entry) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.source.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	e.mu.Lock()
+	if e.lastModified != "" && e.current.Load() != nil {
+		req.Header.Set("If-Modified-Since", e.lastModified)
+	}
+	e.mu.Unlock()
+
+	resp, err := m.opts.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("download returned %s", resp.Status)
+	}
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadBytes+1))
+	if err != nil {
+		return false, err
+	}
+	if len(payload) > maxDownloadBytes {
+		return false, errors.New("download too large")
+	}
+
+	if e.source.ChecksumURL != "" {
+		want, err := m.checksum(ctx, e.source.ChecksumURL)
+		if err != nil {
+			return false, fmt.Errorf("checksum: %w", err)
+		}
+		sum := sha256.Sum256(payload)
+		if got := hex.EncodeToString(sum[:]); got != want {
+			return false, fmt.Errorf("checksum mismatch: got %s, want %s", got, want)
+		}
+	}
+
+	if e.source.Type == TypeMMDB && isGzip(payload) {
+		if payload, err = extractMMDB(payload); err != nil {
+			return false, err
+		}
+	}
+	db, err := parse(e.source.Type, payload)
+	if err != nil {
+		return false, err
+	}
+	if db.builtAt.IsZero() {
+		db.builtAt = time.Now()
+	}
+	if err := writeFile(e.source.Path, payload); err != nil {
+		return false, err
+	}
+	e.current.Store(db)
+
+	e.mu.Lock()
+	e.lastModified = resp.Header.Get("Last-Modified")
+	e.mu.Unlock()
+	return true, nil
+}
+
+func (m *Manager) checksum(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := m.opts.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", errors.New("no SHA-256 found")
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// checkAge updates the age metrics and warns once when a database goes stale.
+func (m *Manager) checkAge(now time.Time) {
+	for _, name := range m.order {
+		e := m.entries[name]
+		db := e.current.Load()
+		if db == nil {
+			continue
+		}
+		age := now.Sub(db.builtAt)
+		stale := age > m.opts.StaleAfter
+
+		e.mu.Lock()
+		changed := stale != e.stale
+		e.stale = stale
+		e.mu.Unlock()
+		if changed && stale {
+			m.logger.WithFields(logrus.Fields{
+				"database": name,
+				"age":      age.Round(time.Hour),
+			}).Warn("GeoIP database is stale")
+		}
+		if m.opts.Recorder != nil {
+			m.opts.Recorder.SetGeoIPDatabaseAge(name, age)
+			m.opts.Recorder.SetGeoIPDatabaseStale(name, stale)
+		}
+	}
+}
+
+// Status returns the state of every database in configuration order.
+func (m *Manager) Status() []Status {
+	statuses := make([]Status, 0, len(m.order))
+	for _, name := range m.order {
+		e := m.entries[name]
+		status := Status{Name: name, Type: e.source.Type}
+		if db := e.current.Load(); db != nil {
+			status.Loaded = true
+			status.BuiltAt = db.builtAt.UTC()
+		}
+		e.mu.Lock()
+		status.RefreshedAt = e.refreshedAt
+		status.Stale = e.stale
+		status.LastError = e.lastError
+		e.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Lookup decodes the record of ip in the MaxMind database name into result.
+// It reports false if the database is not loaded or has no record for ip.
+func (m *Manager) Lookup(name string, ip netip.Addr, result any) (bool, error) {
+	e, ok := m.entries[name]
+	if !ok {
+		return false, nil
+	}
+	db := e.current.Load()
+	if db == nil || db.reader == nil {
+		return false, nil
+	}
+	_, found, err := db.reader.LookupNetwork(net.IP(ip.Unmap().AsSlice()), result)
+	return found, err
+}
+
+// Listed reports whether ip is on the list name.
+func (m *Manager) Listed(name string, ip netip.Addr) bool {
+	e, ok := m.entries[name]
+	if !ok {
+		return false
+	}
+	db := e.current.Load()
+	if db == nil {
+		return false
+	}
+	return db.list.contains(ip.Unmap())
+}
+
+func parse(typ string, data []byte) (*database, error) {
+	switch typ {
+	case TypeMMDB:
+		reader, err := maxminddb.FromBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		return &database{reader: reader, builtAt: time.Unix(int64(reader.Metadata.BuildEpoch), 0)}, nil
+	default:
+		list, err := parseList(data)
+		if err != nil {
+			return nil, err
+		}
+		return &database{list: list}, nil
+	}
+}
+
+// ipList holds single addresses, which most lists consist of, apart from
+// the networks that have to be scanned.
+type ipList struct {
+	addrs    map[netip.Addr]struct{}
+	prefixes []netip.Prefix
+}
+
+func (l *ipList) contains(ip netip.Addr) bool {
+	if l == nil {
+		return false
+	}
+	if _, ok := l.addrs[ip]; ok {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseList(data []byte) (*ipList, error) {
+	list := &ipList{addrs: make(map[netip.Addr]struct{})}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+		text = strings.Fields(text)[0]
+		if strings.Contains(text, "/") {
+			prefix, err := netip.ParsePrefix(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if prefix.IsSingleIP() {
+				list.addrs[prefix.Addr().Unmap()] = struct{}{}
+			} else {
+				list.prefixes = append(list.prefixes, prefix.Masked())
+			}
+			continue
+		}
+		addr, err := netip.ParseAddr(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		list.addrs[addr.Unmap()] = struct{}{}
+	}
+	return list, scanner.Err()
+}
+
+func isGzip(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// extractMMDB returns the first .mmdb file of a tar.gz archive.
+func extractMMDB(archive []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("archive contains no .mmdb file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(header.Name, ".mmdb") {
+			return io.ReadAll(io.LimitReader(tr, maxDownloadBytes))
+		}
+	}
+}
+
+// writeFile replaces path atomically, so that a crash never leaves a torn
+// database behind.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,272 @@
+package geoip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	stale   map[string]bool
+	results map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{stale: make(map[string]bool), results: make(map[string]int)}
+}
+
+func (r *recorder) SetGeoIPDatabaseAge(database string, age time.Duration) {}
+func (r *recorder) SetGeoIPDatabaseStale(database string, stale bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stale[database] = stale
+}
+func (r *recorder) IncGeoIPRefresh(database, result string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[database+"/"+result]++
+}
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// mmdbString and friends encode values in the MaxMind DB data format.
+func mmdbString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+func mmdbUint(typ byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	value := bytes.TrimLeft(b[:], "\x00")
+	if typ <= 7 {
+		return append([]byte{typ<<5 | byte(len(value))}, value...)
+	}
+	return append([]byte{byte(len(value)), typ - 7}, value...)
+}
+
+func mmdbMap(pairs ...[]byte) []byte {
+	b := []byte{0xe0 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// buildMMDB returns an IPv4 database with a single node, mapping 0.0.0.0/1 to
+// the country low and 128.0.0.0/1 to high.
+func buildMMDB(builtAt time.Time, low, high string) []byte {
+	first := mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(low)))
+	second := mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(high)))
+
+	var db []byte
+	for _, record := range []int{1 + 16, 1 + 16 + len(first)} {
+		db = append(db, byte(record>>16), byte(record>>8), byte(record))
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, first...)
+	db = append(db, second...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, mmdbMap(
+		mmdbString("node_count"), mmdbUint(6, 1),
+		mmdbString("record_size"), mmdbUint(5, 24),
+		mmdbString("ip_version"), mmdbUint(5, 4),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+		mmdbString("languages"), []byte{0x00, 0x04},
+		mmdbString("binary_format_major_version"), mmdbUint(5, 2),
+		mmdbString("binary_format_minor_version"), mmdbUint(5, 0),
+		mmdbString("build_epoch"), mmdbUint(9, uint64(builtAt.Unix())),
+		mmdbString("description"), mmdbMap(),
+	)...)
+	return db
+}
+
+func tarGz(name string, content []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func country(t *testing.T, m *Manager, ip string) string {
+	t.Helper()
+	var record countryRecord
+	if _, err := m.Lookup("country", netip.MustParseAddr(ip), &record); err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	return record.Country.ISOCode
+}
+
+func TestRefreshMMDB(t *testing.T) {
+	var mu sync.Mutex
+	archive := tarGz("GeoLite2-Country_20260101/GeoLite2-Country.mmdb", buildMMDB(time.Now(), "US", "DE"))
+	checksum := func() string {
+		sum := sha256.Sum256(archive)
+		return hex.EncodeToString(sum[:]) + "  GeoLite2-Country.tar.gz\n"
+	}()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/db.tar.gz.sha256" {
+			io.WriteString(w, checksum)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	rec := newRecorder()
+	m, err := New(Options{
+		Sources: []Source{{
+			Name:        "country",
+			Type:        TypeMMDB,
+			URL:         upstream.URL + "/db.tar.gz",
+			ChecksumURL: upstream.URL + "/db.tar.gz.sha256",
+			Path:        path,
+		}},
+		Recorder: rec,
+	}, testLogger())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	if got := country(t, m, "1.2.3.4"); got != "" {
+		t.Errorf("Expected no country before the first refresh, got %q", got)
+	}
+
+	m.RefreshAll(context.Background())
+	if got := country(t, m, "1.2.3.4"); got != "US" {
+		t.Errorf("Expected US, got %q", got)
+	}
+	if got := country(t, m, "200.1.1.1"); got != "DE" {
+		t.Errorf("Expected DE, got %q", got)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the database to be written to disk: %v", err)
+	}
+
+	// A download that does not match its checksum keeps the old version.
+	mu.Lock()
+	archive = tarGz("GeoLite2-Country.mmdb", buildMMDB(time.Now(), "FR", "FR"))
+	mu.Unlock()
+	m.RefreshAll(context.Background())
+	if got := country(t, m, "1.2.3.4"); got != "US" {
+		t.Errorf("Expected the old database to stay in place, got %q", got)
+	}
+	if rec.results["country/error"] != 1 {
+		t.Errorf("Expected 1 failed refresh, got %v", rec.results)
+	}
+	if status := m.Status()[0]; !status.Loaded || status.LastError == "" {
+		t.Errorf("Expected a loaded database with the last error, got %+v", status)
+	}
+
+	// The file on disk is loaded on the next start.
+	restarted, err := New(Options{Sources: []Source{{Name: "country", Type: TypeMMDB, Path: path}}}, testLogger())
+	if err != nil {
+		t.Fatalf("Failed to load database from disk: %v", err)
+	}
+	if got := country(t, restarted, "1.2.3.4"); got != "US" {
+		t.Errorf("Expected US from disk, got %q", got)
+	}
+}
+
+func TestRefreshList(t *testing.T) {
+	lastModified := time.Now().UTC().Format(http.TimeFormat)
+	var requests int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", lastModified)
+		io.WriteString(w, "# exit nodes\n192.0.2.10\n198.51.100.0/24 ; range\n\n2001:db8::1\n")
+	}))
+	defer upstream.Close()
+
+	rec := newRecorder()
+	m, err := New(Options{
+		Sources:  []Source{{Name: "tor", Type: TypeList, URL: upstream.URL, Path: filepath.Join(t.TempDir(), "tor.txt")}},
+		Recorder: rec,
+	}, testLogger())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	m.RefreshAll(context.Background())
+	m.RefreshAll(context.Background())
+
+	tests := []struct {
+		ip     string
+		listed bool
+	}{
+		{"192.0.2.10", true},
+		{"::ffff:192.0.2.10", true},
+		{"192.0.2.11", false},
+		{"198.51.100.77", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+	}
+	for _, tt := range tests {
+		if got := m.Listed("tor", netip.MustParseAddr(tt.ip)); got != tt.listed {
+			t.Errorf("%s: expected listed=%v, got %v", tt.ip, tt.listed, got)
+		}
+	}
+	if rec.results["tor/updated"] != 1 || rec.results["tor/unchanged"] != 1 {
+		t.Errorf("Expected one update and one unchanged refresh, got %v", rec.results)
+	}
+}
+
+func TestStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("192.0.2.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := newRecorder()
+	m, err := New(Options{
+		Sources:    []Source{{Name: "blocklist", Type: TypeList, Path: path}},
+		StaleAfter: 24 * time.Hour,
+		Recorder:   rec,
+	}, testLogger())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	if !m.Status()[0].Stale || !rec.stale["blocklist"] {
+		t.Error("Expected the database to be stale")
+	}
+}
+
+func TestInvalidList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.txt")
+	os.WriteFile(path, []byte("192.0.2.1\nnot-an-ip\n"), 0o644)
+	if _, err := New(Options{Sources: []Source{{Name: "bad", Type: TypeList, Path: path}}}, testLogger()); err == nil {
+		t.Error("Expected an invalid list to be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+// Package greylist holds clients to tighter limits, or challenges them, for
+// their first minutes. Scrapers that burst and disappear never graduate to
+// the normal limits, while returning clients are not affected.
+//
+// Clients are remembered in the limiter store: a greylist marker lives for
+// the greylist duration from the first request, and a longer-lived marker,
+// refreshed by every later request, records that the client was seen at
+// all. A client that was not seen for longer than the memory is greylisted
+// again.
+package greylist
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+// Options configures the greylist.
+type Options struct {
+	// Duration is how long new clients stay greylisted.
+	Duration time.Duration
+	// Memory is how long a client is remembered after its last request. It
+	// defaults to 30 days and must not be shorter than Duration.
+	Memory time.Duration
+	// TightenFactor scales the rate limits of greylisted clients.
+	TightenFactor float64
+	// Challenge challenges greylisted clients instead of tightening their
+	// limits, so that browsers graduate as soon as they pass.
+	Challenge bool
+}
+
+// Greylist tracks first-seen clients.
+type Greylist struct {
+	opts  Options
+	store limiter.Store
+}
+
+// New creates a greylist that keeps its markers in store.
+func New(opts Options, store limiter.Store) (*Greylist, error) {
+	if opts.Duration <= 0 {
+		opts.Duration = 10 * time.Minute
+	}
+	if opts.Memory == 0 {
+		opts.Memory = 30 * 24 * time.Hour
+	}
+	if opts.Memory < opts.Duration {
+		return nil, fmt.Errorf("greylist: memory %s is shorter than the duration %s", opts.Memory, opts.Duration)
+	}
+	if opts.TightenFactor <= 0 || opts.TightenFactor > 1 {
+		opts.TightenFactor = 1
+	}
+	return &Greylist{opts: opts, store: store}, nil
+}
+
+// Check reports whether client is greylisted, registering it if it was not
+// seen before.
+func (g *Greylist) Check(ctx context.Context, client string) (bool, error) {
+	listed, err := g.store.Exists(ctx, "greylist:"+client)
+	if err != nil || listed {
+		return listed, err
+	}
+	known, err := g.store.Exists(ctx, "seen:"+client)
+	if err != nil {
+		return false, err
+	}
+	if err := g.store.Set(ctx, "seen:"+client, "1", g.opts.Memory); err != nil {
+		return false, err
+	}
+	if known {
+		return false, nil
+	}
+	if err := g.store.Set(ctx, "greylist:"+client, "1", g.opts.Duration); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// LimitFactor returns the factor the rate limits of greylisted clients are
+// scaled by. It is 1 when greylisted clients are challenged instead.
+func (g *Greylist) LimitFactor() float64 {
+	if g.opts.Challenge {
+		return 1
+	}
+	return g.opts.TightenFactor
+}
+
+// Challenge reports whether greylisted clients have to be challenged.
+func (g *Greylist) Challenge() bool {
+	return g.opts.Challenge
+}
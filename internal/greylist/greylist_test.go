@@ -0,0 +1,58 @@
+package greylist
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	g, err := New(Options{Duration: 10 * time.Minute, Memory: time.Hour, TightenFactor: 0.25}, limiter.NewRedisStore(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		want    bool
+	}{
+		{"first request", 0, true},
+		{"within greylist duration", 5 * time.Minute, true},
+		{"graduated", 6 * time.Minute, false},
+		{"returning within memory", 30 * time.Minute, false},
+		{"remembered since the last request", 45 * time.Minute, false},
+		{"forgotten", time.Hour, true},
+	}
+	for _, step := range steps {
+		mr.FastForward(step.advance)
+		listed, err := g.Check(ctx, "10.0.0.1")
+		if err != nil {
+			t.Fatalf("%s: check failed: %v", step.name, err)
+		}
+		if listed != step.want {
+			t.Errorf("%s: expected greylisted %v, got %v", step.name, step.want, listed)
+		}
+	}
+
+	if g.LimitFactor() != 0.25 {
+		t.Errorf("Expected limit factor 0.25, got %v", g.LimitFactor())
+	}
+	challenged, err := New(Options{TightenFactor: 0.25, Challenge: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenged.LimitFactor() != 1 {
+		t.Errorf("Expected challenged clients to keep their limits")
+	}
+	if _, err := New(Options{Duration: time.Hour, Memory: time.Minute}, nil); err == nil {
+		t.Errorf("Expected a memory shorter than the duration to be rejected")
+	}
+}
@@ -0,0 +1,309 @@
+// Package history persists block events and manual actions in a relational
+// database, so abuse can be analysed long after the limiter's TTLs expire.
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"           // registers the "postgres" driver
+	_ "github.com/mattn/go-sqlite3" // registers the "sqlite3" driver
+)
+
+// Event types recorded in the history.
+const (
+	EventBlock   = "block"
+	EventUnblock = "unblock"
+	// EventManualBlock and EventManualUnblock record what operators do
+	// through the admin API, with the operator as the actor. Manual blocks
+	// count as offenses like the limiter's own.
+	EventManualBlock   = "manual_block"
+	EventManualUnblock = "manual_unblock"
+	// EventBypassIssue and EventBypassRevoke record emergency bypass tokens
+	// operators issued and revoked, with the holder as the subject.
+	EventBypassIssue  = "bypass_issue"
+	EventBypassRevoke = "bypass_revoke"
+	// EventEscalate records a client promoted to the global block list
+	// after offending on several routes.
+	EventEscalate = "escalate"
+	// EventAnomaly records a route whose traffic deviated from its
+	// baseline, with the route as the subject.
+	EventAnomaly = "anomaly"
+)
+
+// Event is a single entry in the block history.
+type Event struct {
+	ID        int64         `json:"id"`
+	Type      string        `json:"type"`
+	Subject   string        `json:"subject"`
+	Reason    string        `json:"reason"`
+	Actor     string        `json:"actor"`
+	Instance  string        `json:"instance"`
+	Duration  time.Duration `json:"duration"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// Query filters the events returned by Events. Zero values are ignored.
+type Query struct {
+	Subject string
+	Type    string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Offender summarizes how often a subject was blocked.
+type Offender struct {
+	Subject   string    `json:"subject"`
+	Blocks    int       `json:"blocks"`
+	LastBlock time.Time `json:"lastBlock"`
+}
+
+// defaultQueryLimit caps the number of rows returned when Query.Limit is unset.
+const defaultQueryLimit = 100
+
+// Store reads and writes block history in a SQL database.
+type Store struct {
+	db     *sql.DB
+	driver string
+}
+
+// Open connects to the database and creates the history schema if needed.
+// Supported drivers are "sqlite" and "postgres".
+func Open(ctx context.Context, driver, dsn string) (*Store, error) {
+	var schema string
+	switch driver {
+	case "sqlite":
+		driver = "sqlite3"
+		schema = sqliteSchema
+	case "postgres":
+		schema = postgresSchema
+	default:
+		return nil, fmt.Errorf("unsupported history driver %q", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// SQLite allows a single writer at a time.
+		db.SetMaxOpenConns(1)
+	}
+
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating history schema: %w", err)
+	}
+
+	return &Store{db: db, driver: driver}, nil
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS shielder_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_type TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	actor TEXT NOT NULL DEFAULT '',
+	instance TEXT NOT NULL DEFAULT '',
+	duration_ms INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS shielder_events_subject_idx ON shielder_events (subject, created_at);
+CREATE INDEX IF NOT EXISTS shielder_events_created_idx ON shielder_events (created_at);
+`
+
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS shielder_events (
+	id BIGSERIAL PRIMARY KEY,
+	event_type TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	actor TEXT NOT NULL DEFAULT '',
+	instance TEXT NOT NULL DEFAULT '',
+	duration_ms BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS shielder_events_subject_idx ON shielder_events (subject, created_at);
+CREATE INDEX IF NOT EXISTS shielder_events_created_idx ON shielder_events (created_at);
+`
+
+// Record stores a single event.
+func (s *Store) Record(ctx context.Context, event Event) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	_, err := s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO shielder_events (event_type, subject, reason, actor, instance, duration_ms, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		event.Type, event.Subject, event.Reason, event.Actor, event.Instance,
+		event.Duration.Milliseconds(), event.CreatedAt.UTC(),
+	)
+	return err
+}
+
+// Events returns the events matching q, newest first.
+func (s *Store) Events(ctx context.Context, q Query) ([]Event, error) {
+	var (
+		where []string
+		args  []any
+	)
+	if q.Subject != "" {
+		where = append(where, "subject = ?")
+		args = append(args, q.Subject)
+	}
+	if q.Type != "" {
+		where = append(where, "event_type = ?")
+		args = append(args, q.Type)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.Until.UTC())
+	}
+
+	query := `SELECT id, event_type, subject, reason, actor, instance, duration_ms, created_at FROM shielder_events`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, queryLimit(q.Limit))
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var (
+			event      Event
+			durationMs int64
+		)
+		if err := rows.Scan(&event.ID, &event.Type, &event.Subject, &event.Reason,
+			&event.Actor, &event.Instance, &durationMs, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.Duration = time.Duration(durationMs) * time.Millisecond
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// OffenseCount returns how many times subject was blocked since the given time.
+func (s *Store) OffenseCount(ctx context.Context, subject string, since time.Time) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, s.rebind(`
+		SELECT COUNT(*) FROM shielder_events
+		WHERE subject = ? AND event_type IN (?, ?) AND created_at >= ?`),
+		subject, EventBlock, EventManualBlock, since.UTC(),
+	).Scan(&count)
+	return count, err
+}
+
+// TopOffenders returns the subjects blocked most often since the given time.
+func (s *Store) TopOffenders(ctx context.Context, since time.Time, limit int) ([]Offender, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`
+		SELECT subject, COUNT(*), MAX(created_at) FROM shielder_events
+		WHERE event_type IN (?, ?) AND created_at >= ?
+		GROUP BY subject
+		ORDER BY COUNT(*) DESC, subject
+		LIMIT ?`),
+		EventBlock, EventManualBlock, since.UTC(), queryLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var offenders []Offender
+	for rows.Next() {
+		var (
+			offender Offender
+			last     any
+		)
+		if err := rows.Scan(&offender.Subject, &offender.Blocks, &last); err != nil {
+			return nil, err
+		}
+		offender.LastBlock, err = parseTime(last)
+		if err != nil {
+			return nil, err
+		}
+		offenders = append(offenders, offender)
+	}
+	return offenders, rows.Err()
+}
+
+// Purge deletes events older than the given time and returns how many were removed.
+func (s *Store) Purge(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM shielder_events WHERE created_at < ?`), before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// rebind rewrites ? placeholders to the positional form the driver expects.
+func (s *Store) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func queryLimit(limit int) int {
+	if limit <= 0 {
+		return defaultQueryLimit
+	}
+	return limit
+}
+
+// parseTime converts aggregated timestamps, which SQLite returns as text.
+func parseTime(v any) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		return parseTimeString(t)
+	case []byte:
+		return parseTimeString(string(t))
+	case nil:
+		return time.Time{}, nil
+	}
+	return time.Time{}, fmt.Errorf("unexpected timestamp type %T", v)
+}
+
+func parseTimeString(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", s)
+}
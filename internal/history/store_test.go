@@ -0,0 +1,101 @@
+package history
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := Open(context.Background(), "sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRecordAndQuery(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	events := []Event{
+		{Type: EventBlock, Subject: "10.0.0.1", Reason: "rate_limit_exceeded", Duration: time.Hour, CreatedAt: now.Add(-2 * time.Hour)},
+		{Type: EventUnblock, Subject: "10.0.0.1", Actor: "admin", CreatedAt: now.Add(-time.Hour)},
+		{Type: EventBlock, Subject: "10.0.0.1", Reason: "rate_limit_exceeded", CreatedAt: now.Add(-time.Minute)},
+		{Type: EventBlock, Subject: "10.0.0.2", Reason: "rate_limit_exceeded", CreatedAt: now.Add(-time.Minute)},
+		{Type: EventManualBlock, Subject: "10.0.0.3", Reason: "manual", Actor: "ops@example.com", CreatedAt: now.Add(-3 * time.Minute)},
+		{Type: EventManualUnblock, Subject: "10.0.0.3", Reason: "manual", Actor: "ops@example.com", CreatedAt: now.Add(-2 * time.Minute)},
+	}
+	for _, event := range events {
+		if err := store.Record(ctx, event); err != nil {
+			t.Fatalf("Failed to record event: %v", err)
+		}
+	}
+
+	got, err := store.Events(ctx, Query{Subject: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(got))
+	}
+	if got[0].CreatedAt.Before(got[1].CreatedAt) {
+		t.Errorf("Expected events newest first")
+	}
+	if got[2].Duration != time.Hour {
+		t.Errorf("Expected duration 1h, got %s", got[2].Duration)
+	}
+
+	count, err := store.OffenseCount(ctx, "10.0.0.1", now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to count offenses: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 offenses, got %d", count)
+	}
+
+	offenders, err := store.TopOffenders(ctx, now.Add(-24*time.Hour), 10)
+	if err != nil {
+		t.Fatalf("Failed to list offenders: %v", err)
+	}
+	if len(offenders) != 3 || offenders[0].Subject != "10.0.0.1" || offenders[0].Blocks != 2 {
+		t.Errorf("Unexpected offenders: %+v", offenders)
+	}
+
+	// Manual blocks count as offenses, manual unblocks do not.
+	count, err = store.OffenseCount(ctx, "10.0.0.3", now.Add(-24*time.Hour))
+	if err != nil || count != 1 {
+		t.Errorf("Expected the manual block to count once, got %d (%v)", count, err)
+	}
+	manual, err := store.Events(ctx, Query{Type: EventManualUnblock})
+	if err != nil || len(manual) != 1 || manual[0].Actor != "ops@example.com" {
+		t.Errorf("Expected the manual unblock with its actor, got %+v (%v)", manual, err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	store := openTestStore(t)
+	ctx := context.Background()
+
+	store.Record(ctx, Event{Type: EventBlock, Subject: "10.0.0.1", CreatedAt: time.Now().Add(-48 * time.Hour)})
+	store.Record(ctx, Event{Type: EventBlock, Subject: "10.0.0.1", CreatedAt: time.Now()})
+
+	removed, err := store.Purge(ctx, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to purge: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 purged event, got %d", removed)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	store := &Store{driver: "postgres"}
+	got := store.rebind("SELECT * FROM t WHERE a = ? AND b = ?")
+	if want := "SELECT * FROM t WHERE a = $1 AND b = $2"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,91 @@
+package history
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Writer records events in the background so that request handling never
+// waits on the database. Events are dropped, with a warning, when the buffer
+// is full.
+type Writer struct {
+	store    *Store
+	instance string
+	logger   *logrus.Logger
+	events   chan Event
+	wg       sync.WaitGroup
+}
+
+// NewWriter starts a background writer with room for bufferSize pending events.
+// The instance name is stamped on every event that does not set its own.
+func NewWriter(store *Store, instance string, bufferSize int, logger *logrus.Logger) *Writer {
+	if bufferSize <= 0 {
+		bufferSize = 1024
+	}
+	w := &Writer{
+		store:    store,
+		instance: instance,
+		logger:   logger,
+		events:   make(chan Event, bufferSize),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// Record queues an event for writing.
+func (w *Writer) Record(event Event) {
+	if event.Instance == "" {
+		event.Instance = w.instance
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	select {
+	case w.events <- event:
+	default:
+		w.logger.WithFields(logrus.Fields{
+			"type":    event.Type,
+			"subject": event.Subject,
+		}).Warn("History buffer full, dropping event")
+	}
+}
+
+// Close stops accepting events and waits for queued events to be written.
+func (w *Writer) Close() {
+	close(w.events)
+	w.wg.Wait()
+}
+
+func (w *Writer) run() {
+	defer w.wg.Done()
+	for event := range w.events {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := w.store.Record(ctx, event); err != nil {
+			w.logger.WithError(err).Error("Error recording history event")
+		}
+		cancel()
+	}
+}
+
+// PurgeLoop deletes events older than retention once per interval until ctx is done.
+func (s *Store) PurgeLoop(ctx context.Context, retention, interval time.Duration, logger *logrus.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := s.Purge(ctx, time.Now().Add(-retention))
+			if err != nil {
+				logger.WithError(err).Error("Error purging history")
+				continue
+			}
+			logger.WithField("removed", removed).Debug("Purged history")
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Package idempotency enforces the Idempotency-Key contract for backends
+// that must not process a request twice, such as payment APIs.
+//
+// The first request with a key claims it in Redis while it is in flight, for
+// PendingTTL at most, and is forwarded; its outcome is then remembered for
+// the replay window. Repeats of the key by the same client within the window are
+// either rejected with 409 or, in replay mode, answered with the stored
+// response of the first request without reaching the upstream. A repeat that
+// arrives while the first request is still in flight is always rejected.
+//
+// Keys are scoped per client, method and path, so that clients cannot
+// interfere with each other's keys. When the upstream fails with a 5xx or
+// the request is aborted, the key is released so that the client can retry.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Header is the request header carrying the idempotency key.
+const Header = "Idempotency-Key"
+
+// HeaderReplayed marks responses served from the store.
+const HeaderReplayed = "Idempotent-Replayed"
+
+// Modes of handling repeated keys.
+const (
+	ModeReject = "reject"
+	ModeReplay = "replay"
+)
+
+// Results recorded for requests with an idempotency key.
+const (
+	ResultFirst      = "first"
+	ResultReplayed   = "replayed"
+	ResultRejected   = "rejected"
+	ResultInProgress = "in_progress"
+	ResultMissing    = "missing"
+	ResultError      = "error"
+)
+
+// Recorder counts requests with an idempotency key by result.
+type Recorder interface {
+	IncIdempotencyCheck(route, result string)
+}
+
+// Options configures the guard of a route.
+type Options struct {
+	Route string
+	// Mode is reject (default) or replay.
+	Mode string
+	// Window is how long keys are remembered, 24 hours by default.
+	Window time.Duration
+	// PendingTTL is how long a key is held for a request in flight, 5
+	// minutes by default, so that keys of Shielder instances that died
+	// mid-request do not stay claimed for the whole window.
+	PendingTTL time.Duration
+	// Methods are guarded, POST and PATCH by default.
+	Methods []string
+	// Required rejects guarded requests without a key with 400.
+	Required bool
+	// MaxBodyBytes bounds the stored response body in replay mode, 1 MiB
+	// by default. Repeats of larger responses are rejected instead.
+	MaxBodyBytes int
+	// MaxKeyLength bounds client-supplied keys, 255 by default.
+	MaxKeyLength int
+	Recorder     Recorder
+}
+
+// Guard remembers idempotency keys for one route.
+type Guard struct {
+	opts   Options
+	client redis.UniversalClient
+	logger *logrus.Logger
+}
+
+// New creates a guard.
+func New(opts Options, client redis.UniversalClient, logger *logrus.Logger) *Guard {
+	if opts.Mode == "" {
+		opts.Mode = ModeReject
+	}
+	if opts.Window <= 0 {
+		opts.Window = 24 * time.Hour
+	}
+	if opts.PendingTTL <= 0 {
+		opts.PendingTTL = 5 * time.Minute
+	}
+	if len(opts.Methods) == 0 {
+		opts.Methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 1 << 20
+	}
+	if opts.MaxKeyLength <= 0 {
+		opts.MaxKeyLength = 255
+	}
+	return &Guard{opts: opts, client: client, logger: logger}
+}
+
+// entry is what is stored under a key. Status is zero while the first
+// request is in flight.
+type entry struct {
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	// Stored is set when the response was kept for replay.
+	Stored bool `json:"stored,omitempty"`
+}
+
+// Middleware guards next. client returns the key of the client making a
+// request, such as its IP or authenticated subject. Requests are forwarded
+// unguarded while Redis is unavailable.
+func (g *Guard) Middleware(client func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.ContainsFunc(g.opts.Methods, func(m string) bool { return strings.EqualFold(m, r.Method) }) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get(Header)
+		if key == "" {
+			if g.opts.Required {
+				g.record(ResultMissing)
+				http.Error(w, "Idempotency-Key header is required", http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > g.opts.MaxKeyLength {
+			http.Error(w, "Idempotency-Key header is too long", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		storeKey := g.storeKey(client(r), r.Method, r.URL.Path, key)
+		pending, _ := json.Marshal(entry{})
+		claimed, err := g.client.SetNX(ctx, storeKey, pending, g.opts.PendingTTL).Result()
+		if err != nil {
+			g.record(ResultError)
+			g.logger.WithError(err).Warn("Error claiming idempotency key, forwarding unguarded")
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !claimed {
+			g.repeat(w, r, storeKey)
+			return
+		}
+
+		g.record(ResultFirst)
+		completed := false
+		defer func() {
+			// The handler panicked, such as when the client went away
+			// mid-response.
+			if !completed {
+				g.release(context.WithoutCancel(ctx), storeKey)
+			}
+		}()
+		rec := &recorder{ResponseWriter: w, limit: g.opts.MaxBodyBytes, store: g.opts.Mode == ModeReplay}
+		next.ServeHTTP(rec, r)
+		completed = true
+		g.complete(context.WithoutCancel(ctx), storeKey, rec)
+	})
+}
+
+// repeat answers a request whose key was already claimed.
+func (g *Guard) repeat(w http.ResponseWriter, r *http.Request, storeKey string) {
+	value, err := g.client.Get(r.Context(), storeKey).Bytes()
+	var e entry
+	if err == nil {
+		err = json.Unmarshal(value, &e)
+	}
+	switch {
+	case err == redis.Nil:
+		// Released in the meantime, let the client retry.
+		g.record(ResultInProgress)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+	case err != nil:
+		g.record(ResultError)
+		g.logger.WithError(err).Error("Error reading idempotency key")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	case e.Status == 0:
+		g.record(ResultInProgress)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+	case e.Stored:
+		g.record(ResultReplayed)
+		for name, values := range e.Header {
+			w.Header()[name] = values
+		}
+		w.Header().Set(HeaderReplayed, "true")
+		w.WriteHeader(e.Status)
+		w.Write(e.Body)
+	default:
+		g.record(ResultRejected)
+		http.Error(w, "A request with this Idempotency-Key was already processed", http.StatusConflict)
+	}
+}
+
+// complete stores the outcome of the first request for the window, or
+// releases the key if the upstream failed.
+func (g *Guard) complete(ctx context.Context, storeKey string, rec *recorder) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status >= 500 {
+		g.release(ctx, storeKey)
+		return
+	}
+	e := entry{Status: status}
+	if rec.store && !rec.truncated {
+		e.Stored = true
+		e.Header = storedHeader(rec.Header())
+		e.Body = rec.buf.Bytes()
+	}
+	value, _ := json.Marshal(e)
+	if err := g.client.Set(ctx, storeKey, value, g.opts.Window).Err(); err != nil {
+		g.logger.WithError(err).Error("Error storing idempotency key outcome")
+	}
+}
+
+// release drops the claim of a request that did not complete, so that the
+// client can retry. Unreleased claims expire after PendingTTL.
+func (g *Guard) release(ctx context.Context, storeKey string) {
+	if err := g.client.Del(ctx, storeKey).Err(); err != nil {
+		g.logger.WithError(err).Error("Error releasing idempotency key")
+	}
+}
+
+func (g *Guard) storeKey(client, method, path, key string) string {
+	sum := sha256.Sum256([]byte(client + "\x00" + method + "\x00" + path + "\x00" + key))
+	return "idempotency:" + g.opts.Route + ":" + hex.EncodeToString(sum[:])
+}
+
+func (g *Guard) record(result string) {
+	if g.opts.Recorder != nil {
+		g.opts.Recorder.IncIdempotencyCheck(g.opts.Route, result)
+	}
+}
+
+// storedHeader drops headers that must not be replayed.
+func storedHeader(h http.Header) http.Header {
+	stored := h.Clone()
+	for _, name := range []string{"Set-Cookie", "Date", "Connection", "Transfer-Encoding", "Content-Length"} {
+		stored.Del(name)
+	}
+	return stored
+}
+
+// recorder passes the response through and keeps its status and, when
+// store is set, the first limit bytes of the body.
+type recorder struct {
+	http.ResponseWriter
+	status    int
+	store     bool
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (w *recorder) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.store && !w.truncated {
+		if w.buf.Len()+len(b) > w.limit {
+			w.truncated = true
+			w.buf.Reset()
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *recorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,167 @@
+package idempotency
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestGuard(t *testing.T, opts Options) (*Guard, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(opts, client, logger), mr
+}
+
+func clientIP(r *http.Request) string {
+	return r.RemoteAddr
+}
+
+func send(h http.Handler, method, key, remote string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/payments", strings.NewReader("{}"))
+	r.RemoteAddr = remote
+	if key != "" {
+		r.Header.Set(Header, key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestReplay(t *testing.T) {
+	var calls atomic.Int32
+	status := http.StatusCreated
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(status)
+		io.WriteString(w, `{"payment":`+string(rune('0'+n))+`}`)
+	})
+	g, mr := newTestGuard(t, Options{Route: "payments", Mode: ModeReplay, Window: time.Hour})
+	h := g.Middleware(clientIP, upstream)
+
+	first := send(h, http.MethodPost, "k1", "10.0.0.1:1")
+	second := send(h, http.MethodPost, "k1", "10.0.0.1:1")
+	if calls.Load() != 1 {
+		t.Fatalf("Expected the repeat not to reach the upstream, got %d calls", calls.Load())
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() || second.Header().Get(HeaderReplayed) != "true" {
+		t.Errorf("Expected the first response to be replayed, got %d %q", second.Code, second.Body.String())
+	}
+	if second.Header().Get("Set-Cookie") != "" {
+		t.Error("Expected cookies not to be replayed")
+	}
+
+	// Keys are scoped per client, and unguarded methods pass.
+	send(h, http.MethodPost, "k1", "10.0.0.2:1")
+	send(h, http.MethodGet, "k1", "10.0.0.1:1")
+	if calls.Load() != 3 {
+		t.Errorf("Expected other clients and GETs to be forwarded, got %d calls", calls.Load())
+	}
+
+	// Upstream failures release the key.
+	status = http.StatusBadGateway
+	send(h, http.MethodPost, "k2", "10.0.0.1:1")
+	status = http.StatusCreated
+	if w := send(h, http.MethodPost, "k2", "10.0.0.1:1"); w.Code != http.StatusCreated || calls.Load() != 5 {
+		t.Errorf("Expected a retry after a 5xx to be forwarded, got %d", w.Code)
+	}
+
+	mr.FastForward(2 * time.Hour)
+	send(h, http.MethodPost, "k1", "10.0.0.1:1")
+	if calls.Load() != 6 {
+		t.Errorf("Expected keys to be forgotten after the window, got %d calls", calls.Load())
+	}
+}
+
+func TestReject(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Query().Get("slow") != "" {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	g, _ := newTestGuard(t, Options{Required: true})
+	h := g.Middleware(clientIP, upstream)
+
+	if w := send(h, http.MethodPost, "", "10.0.0.1:1"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing key to be rejected, got %d", w.Code)
+	}
+	send(h, http.MethodPost, "k1", "10.0.0.1:1")
+	if w := send(h, http.MethodPost, "k1", "10.0.0.1:1"); w.Code != http.StatusConflict || calls.Load() != 1 {
+		t.Errorf("Expected the duplicate to be rejected, got %d", w.Code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r := httptest.NewRequest(http.MethodPost, "/payments?slow=1", nil)
+		r.RemoteAddr = "10.0.0.1:1"
+		r.Header.Set(Header, "k2")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	for calls.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/payments?slow=1", nil)
+	r.RemoteAddr = "10.0.0.1:1"
+	r.Header.Set(Header, "k2")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a repeat in flight to be rejected with Retry-After, got %d", w.Code)
+	}
+	close(release)
+	<-done
+}
+
+func TestPendingClaim(t *testing.T) {
+	var storeKey string
+	var pendingTTL time.Duration
+	var g *Guard
+	var mr *miniredis.Miniredis
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storeKey = g.storeKey(clientIP(r), r.Method, r.URL.Path, r.Header.Get(Header))
+		pendingTTL = mr.TTL(storeKey)
+		if r.Header.Get(Header) == "crash" {
+			panic(http.ErrAbortHandler)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	g, mr = newTestGuard(t, Options{Window: time.Hour, PendingTTL: time.Minute})
+	h := g.Middleware(clientIP, upstream)
+
+	send(h, http.MethodPost, "k1", "10.0.0.1:1")
+	if pendingTTL != time.Minute {
+		t.Errorf("Expected the claim to be held for the pending TTL, got %v", pendingTTL)
+	}
+	if ttl := mr.TTL(storeKey); ttl != time.Hour {
+		t.Errorf("Expected the outcome to be kept for the window, got %v", ttl)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to be passed on")
+			}
+		}()
+		send(h, http.MethodPost, "crash", "10.0.0.1:1")
+	}()
+	if mr.Exists(storeKey) {
+		t.Error("Expected the claim of an aborted request to be released")
+	}
+}
@@ -0,0 +1,120 @@
+// Package iplist holds static allow and deny lists of client addresses and
+// CIDR ranges. Denied clients are rejected before any other check, allowed
+// ones skip the rate limits. The lists can be replaced while requests are
+// being served.
+package iplist
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// Verdict is the list a client address is on.
+type Verdict int
+
+const (
+	// Unlisted addresses are on neither list.
+	Unlisted Verdict = iota
+	Allowed
+	Denied
+)
+
+// Lists are the allow and deny lists. Entries are single addresses or CIDR
+// ranges; an address on both lists is denied.
+type Lists struct {
+	current atomic.Pointer[lists]
+}
+
+type lists struct {
+	allow, deny []netip.Prefix
+}
+
+// New compiles the lists.
+func New(allow, deny []string) (*Lists, error) {
+	l := &Lists{}
+	if err := l.Replace(allow, deny); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Replace swaps in new lists. The lists in effect are kept when an entry is
+// invalid.
+func (l *Lists) Replace(allow, deny []string) error {
+	next := &lists{}
+	var err error
+	if next.allow, err = parse(allow); err != nil {
+		return fmt.Errorf("iplist: allow: %w", err)
+	}
+	if next.deny, err = parse(deny); err != nil {
+		return fmt.Errorf("iplist: deny: %w", err)
+	}
+	l.current.Store(next)
+	return nil
+}
+
+// Check returns the list clientIP is on and the entry it matched.
+func (l *Lists) Check(clientIP string) (Verdict, netip.Prefix) {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return Unlisted, netip.Prefix{}
+	}
+	addr = addr.Unmap()
+	current := l.current.Load()
+	if prefix, ok := match(current.deny, addr); ok {
+		return Denied, prefix
+	}
+	if prefix, ok := match(current.allow, addr); ok {
+		return Allowed, prefix
+	}
+	return Unlisted, netip.Prefix{}
+}
+
+// Entries returns the lists in effect, in CIDR notation.
+func (l *Lists) Entries() (allow, deny []string) {
+	current := l.current.Load()
+	return format(current.allow), format(current.deny)
+}
+
+// parse accepts addresses and CIDR ranges. Ranges are masked, so that
+// 10.1.2.3/8 means 10.0.0.0/8.
+func parse(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func match(prefixes []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+func format(prefixes []netip.Prefix) []string {
+	entries := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		entries = append(entries, prefix.String())
+	}
+	return entries
+}
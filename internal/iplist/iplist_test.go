@@ -0,0 +1,57 @@
+package iplist
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	l, err := New([]string{"10.0.0.0/8", "2001:db8::1"}, []string{"10.6.6.6", "192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("failed to compile the lists: %v", err)
+	}
+
+	tests := []struct {
+		ip    string
+		want  Verdict
+		entry string
+	}{
+		{"10.1.2.3", Allowed, "10.0.0.0/8"},
+		{"::ffff:10.1.2.3", Allowed, "10.0.0.0/8"},
+		{"2001:db8::1", Allowed, "2001:db8::1/128"},
+		// Deny entries win over allow entries.
+		{"10.6.6.6", Denied, "10.6.6.6/32"},
+		{"192.0.2.77", Denied, "192.0.2.0/24"},
+		{"198.51.100.1", Unlisted, ""},
+		{"not-an-ip", Unlisted, ""},
+	}
+	for _, tt := range tests {
+		verdict, prefix := l.Check(tt.ip)
+		entry := ""
+		if prefix.IsValid() {
+			entry = prefix.String()
+		}
+		if verdict != tt.want || entry != tt.entry {
+			t.Errorf("%s: expected %v %q, got %v %q", tt.ip, tt.want, tt.entry, verdict, entry)
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	l, _ := New(nil, []string{"192.0.2.1"})
+
+	if err := l.Replace([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("expected an invalid range to be rejected")
+	}
+	if verdict, _ := l.Check("192.0.2.1"); verdict != Denied {
+		t.Error("expected the lists in effect to be kept after an invalid replacement")
+	}
+
+	if err := l.Replace([]string{"192.0.2.1/24"}, nil); err != nil {
+		t.Fatalf("failed to replace the lists: %v", err)
+	}
+	if verdict, _ := l.Check("192.0.2.1"); verdict != Allowed {
+		t.Error("expected the new lists to be in effect")
+	}
+	allow, deny := l.Entries()
+	if len(allow) != 1 || allow[0] != "192.0.2.0/24" || len(deny) != 0 {
+		t.Errorf("unexpected entries %v %v", allow, deny)
+	}
+}
@@ -0,0 +1,223 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// AlgorithmSlidingLog keeps a log of request timestamps in a sorted set per
+// client key and counts the entries of the last minute. It enforces the
+// limit exactly over any one-minute span, at the cost of storing one entry
+// per request. It needs a store that implements WindowLog.
+const AlgorithmSlidingLog = "sliding_log"
+
+// WindowLog is implemented by stores that can keep a log of request
+// timestamps, which the sliding log algorithm needs.
+type WindowLog interface {
+	// AddToLog records n requests at now in the log at key, drops the
+	// entries older than window and returns how many are left.
+	AddToLog(ctx context.Context, key string, n int64, now time.Time, window time.Duration) (int64, error)
+}
+
+// AlgorithmTokenBucket refills a bucket of BurstSize tokens at
+// RequestsPerMinute and lets a request through while it has tokens left. It
+// needs a store that implements TokenBuckets.
+const AlgorithmTokenBucket = "token_bucket"
+
+// TokenBuckets is implemented by stores that can take tokens from a bucket
+// atomically, which the token bucket algorithm needs.
+type TokenBuckets interface {
+	// TakeTokens refills the bucket at key up to capacity at perSecond
+	// tokens per second and then takes n tokens if there are enough. It
+	// returns whether it took them and the tokens left.
+	TakeTokens(ctx context.Context, key string, n int64, capacity int64, perSecond float64, now time.Time) (bool, int64, error)
+}
+
+// algorithm decides whether the requests of a client key are within a limit
+// of requests per minute.
+type algorithm interface {
+	// take counts n requests at now against limit. It returns whether they
+	// are within it, how much of the limit is used up and how long until all
+	// of it is available again at the latest.
+	take(ctx context.Context, ip string, n, limit int64, now time.Time) (bool, int64, time.Duration, error)
+	// peek returns how much of limit is used up without counting a request,
+	// and how long until all of it is available again at the latest.
+	peek(ctx context.Context, ip string, limit int64, now time.Time) (int64, time.Duration, error)
+	// reset forgets the requests counted for the client key.
+	reset(ctx context.Context, ip string) error
+}
+
+// newAlgorithm returns the named algorithm with its keys under prefix. The
+// config sizes token buckets.
+func newAlgorithm(name string, store Store, prefix string, config Config) (algorithm, error) {
+	switch name {
+	case "", AlgorithmFixedWindow:
+		return fixedWindow{store: store, prefix: prefix}, nil
+	case AlgorithmSlidingWindow:
+		return slidingWindow{store: store, prefix: prefix + AlgorithmSlidingWindow + ":"}, nil
+	case AlgorithmSlidingLog:
+		log, ok := store.(WindowLog)
+		if !ok {
+			return nil, fmt.Errorf("the %s algorithm is not supported by the store", name)
+		}
+		return slidingLog{store: store, log: log, prefix: prefix + AlgorithmSlidingLog + ":"}, nil
+	case AlgorithmTokenBucket:
+		buckets, ok := store.(TokenBuckets)
+		if !ok {
+			return nil, fmt.Errorf("the %s algorithm is not supported by the store", name)
+		}
+		burst := 1.0
+		if config.BurstSize > 0 && config.RequestsPerMinute > 0 {
+			burst = float64(config.BurstSize) / float64(config.RequestsPerMinute)
+		}
+		return tokenBucket{store: store, buckets: buckets, prefix: prefix + AlgorithmTokenBucket + ":", burst: burst}, nil
+	}
+	return newRegisteredAlgorithm(name, store, prefix, config)
+}
+
+// fixedWindow counts requests in a counter that expires a minute after the
+// first request of the window.
+type fixedWindow struct {
+	store  Store
+	prefix string
+}
+
+// take reports the whole window as the time to reset, Increment does not
+// tell how much of it is left.
+func (f fixedWindow) take(ctx context.Context, ip string, n, limit int64, _ time.Time) (bool, int64, time.Duration, error) {
+	count, err := f.store.Increment(ctx, f.prefix+ip, n, time.Minute)
+	return count <= limit, count, time.Minute, err
+}
+
+func (f fixedWindow) peek(ctx context.Context, ip string, _ int64, _ time.Time) (int64, time.Duration, error) {
+	inspector, ok := f.store.(Inspector)
+	if !ok {
+		count, err := f.store.Increment(ctx, f.prefix+ip, 0, time.Minute)
+		return count, time.Minute, err
+	}
+	value, ttl, found, err := inspector.Inspect(ctx, f.prefix+ip)
+	if err != nil || !found {
+		return 0, 0, err
+	}
+	count, err := strconv.ParseInt(value, 10, 64)
+	return count, ttl, err
+}
+
+func (f fixedWindow) reset(ctx context.Context, ip string) error {
+	return f.store.Delete(ctx, f.prefix+ip)
+}
+
+// slidingWindow counts requests in aligned one-minute windows and weighs in
+// the previous window by how much of it still overlaps the last minute.
+type slidingWindow struct {
+	store  Store
+	prefix string
+}
+
+func (s slidingWindow) take(ctx context.Context, ip string, n, limit int64, now time.Time) (bool, int64, time.Duration, error) {
+	window := now.Truncate(time.Minute)
+	prefix := s.prefix + ip + ":"
+
+	// Windows live for two minutes so that the previous one can still be
+	// read while the current one fills up.
+	current, err := s.store.Increment(ctx, prefix+strconv.FormatInt(window.Unix(), 10), n, 2*time.Minute)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	previous, err := s.store.Increment(ctx, prefix+strconv.FormatInt(window.Add(-time.Minute).Unix(), 10), 0, 2*time.Minute)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	overlap := 1 - float64(now.Sub(window))/float64(time.Minute)
+	count := current + int64(float64(previous)*overlap)
+	return count <= limit, count, window.Add(2 * time.Minute).Sub(now), nil
+}
+
+// peek reports the budget as fully available once the current window has
+// stopped overlapping the last minute, at the end of the next one.
+func (s slidingWindow) peek(ctx context.Context, ip string, limit int64, now time.Time) (int64, time.Duration, error) {
+	_, count, reset, err := s.take(ctx, ip, 0, limit, now)
+	if err != nil || count == 0 {
+		return count, 0, err
+	}
+	return count, reset, nil
+}
+
+func (s slidingWindow) reset(ctx context.Context, ip string) error {
+	window := time.Now().Truncate(time.Minute)
+	prefix := s.prefix + ip + ":"
+	if err := s.store.Delete(ctx, prefix+strconv.FormatInt(window.Unix(), 10)); err != nil {
+		return err
+	}
+	return s.store.Delete(ctx, prefix+strconv.FormatInt(window.Add(-time.Minute).Unix(), 10))
+}
+
+// slidingLog counts the requests logged in the last minute.
+type slidingLog struct {
+	store  Store
+	log    WindowLog
+	prefix string
+}
+
+func (s slidingLog) take(ctx context.Context, ip string, n, limit int64, now time.Time) (bool, int64, time.Duration, error) {
+	count, err := s.log.AddToLog(ctx, s.prefix+ip, n, now, time.Minute)
+	return count <= limit, count, time.Minute, err
+}
+
+func (s slidingLog) peek(ctx context.Context, ip string, _ int64, now time.Time) (int64, time.Duration, error) {
+	count, err := s.log.AddToLog(ctx, s.prefix+ip, 0, now, time.Minute)
+	if err != nil || count == 0 {
+		return count, 0, err
+	}
+	return count, time.Minute, nil
+}
+
+func (s slidingLog) reset(ctx context.Context, ip string) error {
+	return s.store.Delete(ctx, s.prefix+ip)
+}
+
+// tokenBucket takes the tokens of requests from a bucket per client key.
+// Buckets hold burst times the limit, so that route limits get a burst in
+// proportion to theirs.
+type tokenBucket struct {
+	store   Store
+	buckets TokenBuckets
+	prefix  string
+	burst   float64
+}
+
+func (b tokenBucket) take(ctx context.Context, ip string, n, limit int64, now time.Time) (bool, int64, time.Duration, error) {
+	if limit <= 0 {
+		return false, n, 0, nil
+	}
+	capacity := max(int64(float64(limit)*b.burst), 1)
+	allowed, left, err := b.buckets.TakeTokens(ctx, b.prefix+ip, n, capacity, float64(limit)/60, now)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	used := capacity - left
+	reset := time.Duration(float64(used) / float64(limit) * float64(time.Minute))
+	if !allowed {
+		used += n
+	}
+	return allowed, used, reset, nil
+}
+
+func (b tokenBucket) peek(ctx context.Context, ip string, limit int64, now time.Time) (int64, time.Duration, error) {
+	if limit <= 0 {
+		return 0, 0, nil
+	}
+	capacity := max(int64(float64(limit)*b.burst), 1)
+	_, left, err := b.buckets.TakeTokens(ctx, b.prefix+ip, 0, capacity, float64(limit)/60, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	used := capacity - left
+	return used, time.Duration(float64(used) / float64(limit) * float64(time.Minute)), nil
+}
+
+func (b tokenBucket) reset(ctx context.Context, ip string) error {
+	return b.store.Delete(ctx, b.prefix+ip)
+}
@@ -0,0 +1,94 @@
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AtomicWindow is implemented by stores that can take the whole fixed window
+// decision in one step: skip keys that are blocked, count the request and
+// block the key once it goes over the limit. The fixed window uses it when
+// the store has it, so that concurrent requests cannot slip between counting
+// and blocking and a decision costs one round trip.
+type AtomicWindow interface {
+	// TakeWindow counts n requests at counterKey unless blockKey exists. The
+	// counter expires window after the first request counted in it. Going
+	// over limit stores blockValue at blockKey for block.
+	TakeWindow(ctx context.Context, counterKey, blockKey string, n, limit int64, window, block time.Duration, blockValue string) (WindowDecision, error)
+}
+
+// WindowDecision is the outcome of AtomicWindow.TakeWindow.
+type WindowDecision struct {
+	// Count is the counter after the request, zero when it was not counted.
+	Count int64
+	// WasBlocked is set when the key was blocked already, the request was
+	// not counted then.
+	WasBlocked bool
+	// Blocked is set when the request went over the limit and blocked the
+	// key.
+	Blocked bool
+	// TTL is what is left of the window, or of the block when WasBlocked is
+	// set.
+	TTL time.Duration
+}
+
+// Allowed reports whether the request is within the limit.
+func (d WindowDecision) Allowed() bool {
+	return !d.WasBlocked && !d.Blocked
+}
+
+// ScriptLoader is implemented by stores that run server-side scripts, so that
+// they can be loaded before the first request needs them.
+type ScriptLoader interface {
+	LoadScripts(ctx context.Context) error
+}
+
+// checkAtomic is Check on a store implementing AtomicWindow.
+func (r *RateLimiter) checkAtomic(ctx context.Context, ip string, n int, requestsPerMinute int) (Result, error) {
+	event := Event{
+		Type:     EventBlock,
+		IP:       ip,
+		Reason:   ReasonRateLimitExceeded,
+		Duration: r.BlockDuration(),
+		Time:     time.Now(),
+	}
+	decision, err := r.atomic.TakeWindow(ctx, "rate:"+ip, "blocked:"+ip, int64(n), int64(requestsPerMinute),
+		time.Minute, event.Duration, r.blockValue(event))
+	if err != nil {
+		r.logger.WithError(err).Error("Error taking rate limit decision")
+		if r.failOpen() {
+			return r.degradedDecision(ip, n, requestsPerMinute)
+		}
+		return Result{}, err
+	}
+	result := Result{
+		Allowed:   decision.Allowed(),
+		Limit:     requestsPerMinute,
+		Remaining: max(requestsPerMinute-int(decision.Count), 0),
+		Reset:     decision.TTL,
+	}
+
+	r.logger.WithFields(logrus.Fields{
+		"ip":          ip,
+		"count":       decision.Count,
+		"limit":       requestsPerMinute,
+		"was_blocked": decision.WasBlocked,
+	}).Info("Request count checked")
+
+	r.shadow(ctx, ip, n, requestsPerMinute, decision.Allowed())
+
+	switch {
+	case decision.WasBlocked:
+		result.Remaining, result.RetryAfter = 0, decision.TTL
+	case decision.Blocked:
+		result.RetryAfter = event.Duration
+		r.logger.WithFields(logrus.Fields{
+			"ip":     ip,
+			"reason": event.Reason,
+		}).Info("Blocking IP")
+		r.emit(ctx, event)
+	}
+	return result, nil
+}
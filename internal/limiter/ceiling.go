@@ -0,0 +1,31 @@
+package limiter
+
+import "golang.org/x/time/rate"
+
+// ReasonInstanceCeiling is the reason recorded for requests rejected by the
+// instance ceiling.
+const ReasonInstanceCeiling = "instance_ceiling"
+
+// newCeiling returns the limiter for the instance ceiling, or nil if there is
+// none. The burst defaults to one second worth of requests.
+func newCeiling(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = max(1, int(perSecond))
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// WithinCeiling reports whether this instance has room for another request
+// under its ceiling. The ceiling is kept in process and applies regardless of
+// the store, so that an unavailable store together with the open failure
+// policy cannot let unlimited traffic through. It counts requests, not
+// clients, and should be consulted once per request.
+func (r *RateLimiter) WithinCeiling() bool {
+	if r.ceiling == nil {
+		return true
+	}
+	return r.ceiling.Allow()
+}
@@ -0,0 +1,371 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// Attribute names used by the DynamoDB store. The table must have a string
+// partition key named "pk" and should have TTL enabled on "expiresAt".
+const (
+	dynamoKeyAttr     = "pk"
+	dynamoCountAttr   = "count"
+	dynamoValueAttr   = "val"
+	dynamoExpiresAttr = "expiresAt"
+)
+
+// CapacityRecorder receives capacity and throttling information from stores
+// backed by provisioned services.
+type CapacityRecorder interface {
+	ObserveStoreConsumedCapacity(operation string, units float64)
+	IncStoreThrottled(operation string)
+}
+
+// DynamoDBOptions configures the DynamoDB store.
+type DynamoDBOptions struct {
+	Table    string
+	Region   string
+	Endpoint string
+
+	// MaxRetries is the number of times a throttled request is retried.
+	MaxRetries int
+	// BaseBackoff and MaxBackoff bound the exponential backoff between retries.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// Capacity, when set, records consumed capacity and throttling.
+	Capacity CapacityRecorder
+}
+
+// dynamoDBAPI is the part of the DynamoDB client the store uses.
+type dynamoDBAPI interface {
+	GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, in *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, in *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// DynamoDBStore is a Store backed by a DynamoDB table.
+//
+// Counters are updated with conditional UpdateItem calls, which DynamoDB applies
+// atomically. DynamoDB removes expired items lazily (often hours after the TTL
+// passes), so every read and update compares the expiresAt attribute against
+// the current time instead of relying on the item being gone.
+type DynamoDBStore struct {
+	client dynamoDBAPI
+	opts   DynamoDBOptions
+}
+
+// NewDynamoDBStore loads AWS credentials from the default provider chain and
+// verifies that the configured table exists.
+func NewDynamoDBStore(ctx context.Context, opts DynamoDBOptions) (*DynamoDBStore, error) {
+	if opts.Table == "" {
+		return nil, errors.New("dynamodb: table name is required")
+	}
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = 25 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Second
+	}
+
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(opts.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client := dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		// Throttling is retried by the store with its own backoff policy.
+		o.RetryMaxAttempts = 1
+	})
+
+	if _, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(opts.Table),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &DynamoDBStore{client: client, opts: opts}, nil
+}
+
+// Increment atomically increments the counter at key. If the item is missing or
+// its window has passed, a fresh counter is written instead.
+func (s *DynamoDBStore) Increment(ctx context.Context, key string, n int64, window time.Duration) (int64, error) {
+	delta := &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+
+	for {
+		now := time.Now()
+
+		var out *dynamodb.UpdateItemOutput
+		err := s.withBackoff(ctx, "increment", func() error {
+			var err error
+			out, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:           aws.String(s.opts.Table),
+				Key:                 dynamoKey(key),
+				UpdateExpression:    aws.String("ADD #count :n"),
+				ConditionExpression: aws.String("attribute_exists(#pk) AND #expiresAt > :now"),
+				ExpressionAttributeNames: map[string]string{
+					"#pk":        dynamoKeyAttr,
+					"#count":     dynamoCountAttr,
+					"#expiresAt": dynamoExpiresAttr,
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":n":   delta,
+					":now": dynamoTime(now),
+				},
+				ReturnValues:           types.ReturnValueUpdatedNew,
+				ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+			})
+			if out != nil {
+				s.recordCapacity("increment", out.ConsumedCapacity)
+			}
+			return err
+		})
+		if err == nil {
+			return dynamoCount(out.Attributes)
+		}
+		if !isConditionFailed(err) {
+			return 0, err
+		}
+
+		// The counter does not exist or has expired, start a new window.
+		err = s.withBackoff(ctx, "increment", func() error {
+			out, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+				TableName: aws.String(s.opts.Table),
+				Item: map[string]types.AttributeValue{
+					dynamoKeyAttr:     &types.AttributeValueMemberS{Value: key},
+					dynamoCountAttr:   delta,
+					dynamoExpiresAttr: dynamoTime(now.Add(window)),
+				},
+				ConditionExpression: aws.String("attribute_not_exists(#pk) OR #expiresAt <= :now"),
+				ExpressionAttributeNames: map[string]string{
+					"#pk":        dynamoKeyAttr,
+					"#expiresAt": dynamoExpiresAttr,
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":now": dynamoTime(now),
+				},
+				ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+			})
+			if out != nil {
+				s.recordCapacity("increment", out.ConsumedCapacity)
+			}
+			return err
+		})
+		if err == nil {
+			return n, nil
+		}
+		if !isConditionFailed(err) {
+			return 0, err
+		}
+		// Another writer started the window first, count against it.
+	}
+}
+
+func (s *DynamoDBStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return s.withBackoff(ctx, "set", func() error {
+		out, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.opts.Table),
+			Item: map[string]types.AttributeValue{
+				dynamoKeyAttr:     &types.AttributeValueMemberS{Value: key},
+				dynamoValueAttr:   &types.AttributeValueMemberS{Value: value},
+				dynamoExpiresAttr: dynamoTime(time.Now().Add(ttl)),
+			},
+			ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		})
+		if out != nil {
+			s.recordCapacity("set", out.ConsumedCapacity)
+		}
+		return err
+	})
+}
+
+func (s *DynamoDBStore) Exists(ctx context.Context, key string) (bool, error) {
+	var out *dynamodb.GetItemOutput
+	err := s.withBackoff(ctx, "exists", func() error {
+		var err error
+		out, err = s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:            aws.String(s.opts.Table),
+			Key:                  dynamoKey(key),
+			ConsistentRead:       aws.Bool(true),
+			ProjectionExpression: aws.String("#expiresAt"),
+			ExpressionAttributeNames: map[string]string{
+				"#expiresAt": dynamoExpiresAttr,
+			},
+			ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		})
+		if out != nil {
+			s.recordCapacity("exists", out.ConsumedCapacity)
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if out.Item == nil {
+		return false, nil
+	}
+
+	expiresAt, ok := out.Item[dynamoExpiresAttr].(*types.AttributeValueMemberN)
+	if !ok {
+		return true, nil
+	}
+	seconds, err := strconv.ParseInt(expiresAt.Value, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return time.Unix(seconds, 0).After(time.Now()), nil
+}
+
+func (s *DynamoDBStore) Delete(ctx context.Context, key string) error {
+	return s.withBackoff(ctx, "delete", func() error {
+		out, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:              aws.String(s.opts.Table),
+			Key:                    dynamoKey(key),
+			ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		})
+		if out != nil {
+			s.recordCapacity("delete", out.ConsumedCapacity)
+		}
+		return err
+	})
+}
+
+func (s *DynamoDBStore) Inspect(ctx context.Context, key string) (string, time.Duration, bool, error) {
+	var out *dynamodb.GetItemOutput
+	err := s.withBackoff(ctx, "inspect", func() error {
+		var err error
+		out, err = s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:              aws.String(s.opts.Table),
+			Key:                    dynamoKey(key),
+			ConsistentRead:         aws.Bool(true),
+			ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		})
+		if out != nil {
+			s.recordCapacity("inspect", out.ConsumedCapacity)
+		}
+		return err
+	})
+	if err != nil || out.Item == nil {
+		return "", 0, false, err
+	}
+
+	var ttl time.Duration
+	if expiresAt, ok := out.Item[dynamoExpiresAttr].(*types.AttributeValueMemberN); ok {
+		seconds, err := strconv.ParseInt(expiresAt.Value, 10, 64)
+		if err != nil {
+			return "", 0, false, err
+		}
+		if ttl = time.Until(time.Unix(seconds, 0)); ttl <= 0 {
+			return "", 0, false, nil
+		}
+	}
+	if v, ok := out.Item[dynamoCountAttr].(*types.AttributeValueMemberN); ok {
+		return v.Value, ttl, true, nil
+	}
+	if v, ok := out.Item[dynamoValueAttr].(*types.AttributeValueMemberS); ok {
+		return v.Value, ttl, true, nil
+	}
+	return "", ttl, true, nil
+}
+
+// Ping reads a key that never exists, which is the cheapest way to confirm
+// that the table is reachable.
+func (s *DynamoDBStore) Ping(ctx context.Context) error {
+	_, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.opts.Table),
+		Key:       dynamoKey("shielder:ping"),
+	})
+	return err
+}
+
+// Close is a no-op, the AWS SDK client holds no long-lived resources.
+func (s *DynamoDBStore) Close() error {
+	return nil
+}
+
+// withBackoff runs fn and retries it with exponential backoff and full jitter
+// while DynamoDB reports throttling.
+func (s *DynamoDBStore) withBackoff(ctx context.Context, operation string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isThrottled(err) || attempt >= s.opts.MaxRetries {
+			return err
+		}
+
+		if s.opts.Capacity != nil {
+			s.opts.Capacity.IncStoreThrottled(operation)
+		}
+
+		backoff := s.opts.BaseBackoff << attempt
+		if backoff <= 0 || backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// recordCapacity reports consumed capacity units, if a recorder is configured.
+func (s *DynamoDBStore) recordCapacity(operation string, capacity *types.ConsumedCapacity) {
+	if s.opts.Capacity == nil || capacity == nil || capacity.CapacityUnits == nil {
+		return
+	}
+	s.opts.Capacity.ObserveStoreConsumedCapacity(operation, *capacity.CapacityUnits)
+}
+
+func dynamoKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		dynamoKeyAttr: &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+func dynamoTime(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+func dynamoCount(attrs map[string]types.AttributeValue) (int64, error) {
+	count, ok := attrs[dynamoCountAttr].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, errors.New("dynamodb: counter attribute missing from update result")
+	}
+	return strconv.ParseInt(count.Value, 10, 64)
+}
+
+func isConditionFailed(err error) bool {
+	var condErr *types.ConditionalCheckFailedException
+	return errors.As(err, &condErr)
+}
+
+func isThrottled(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ProvisionedThroughputExceededException", "RequestLimitExceeded", "ThrottlingException":
+		return true
+	}
+	return false
+}
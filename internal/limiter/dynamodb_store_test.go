@@ -0,0 +1,281 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeDynamoDB is an in-memory table that evaluates the condition
+// expressions the store sends.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue
+	// errs are returned, in order, instead of running the next calls.
+	errs []error
+	// beforePut runs before the next conditional put is evaluated.
+	beforePut func()
+	calls     int
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: make(map[string]map[string]types.AttributeValue)}
+}
+
+var fakeCapacity = &types.ConsumedCapacity{CapacityUnits: aws.Float64(1)}
+
+func (f *fakeDynamoDB) fail() error {
+	f.calls++
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+// live reports whether the item at key exists and has not expired at now.
+func (f *fakeDynamoDB) live(key string, now types.AttributeValue) bool {
+	item, ok := f.items[key]
+	if !ok {
+		return false
+	}
+	return fakeNumber(item[dynamoExpiresAttr]) > fakeNumber(now)
+}
+
+func (f *fakeDynamoDB) GetItem(ctx context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: f.items[fakeKey(in.Key)], ConsumedCapacity: fakeCapacity}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	key := fakeKey(in.Item)
+	if in.ConditionExpression != nil {
+		if f.beforePut != nil {
+			f.beforePut()
+			f.beforePut = nil
+		}
+		if f.live(key, in.ExpressionAttributeValues[":now"]) {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+	}
+	f.items[key] = in.Item
+	return &dynamodb.PutItemOutput{ConsumedCapacity: fakeCapacity}, nil
+}
+
+func (f *fakeDynamoDB) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	key := fakeKey(in.Key)
+	if !f.live(key, in.ExpressionAttributeValues[":now"]) {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	count := fakeNumber(f.items[key][dynamoCountAttr]) + fakeNumber(in.ExpressionAttributeValues[":n"])
+	f.items[key][dynamoCountAttr] = &types.AttributeValueMemberN{Value: strconv.FormatInt(count, 10)}
+	return &dynamodb.UpdateItemOutput{
+		Attributes:       map[string]types.AttributeValue{dynamoCountAttr: f.items[key][dynamoCountAttr]},
+		ConsumedCapacity: fakeCapacity,
+	}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(ctx context.Context, in *dynamodb.DeleteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	delete(f.items, fakeKey(in.Key))
+	return &dynamodb.DeleteItemOutput{ConsumedCapacity: fakeCapacity}, nil
+}
+
+// expire moves the expiry of the item at key into the past, leaving the
+// item in place as DynamoDB does until its TTL sweep.
+func (f *fakeDynamoDB) expire(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items[key][dynamoExpiresAttr] = dynamoTime(time.Now().Add(-time.Second))
+}
+
+func fakeKey(attrs map[string]types.AttributeValue) string {
+	return attrs[dynamoKeyAttr].(*types.AttributeValueMemberS).Value
+}
+
+func fakeNumber(v types.AttributeValue) int64 {
+	n, ok := v.(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	i, _ := strconv.ParseInt(n.Value, 10, 64)
+	return i
+}
+
+type capacityRecorder struct {
+	units     map[string]float64
+	throttled map[string]int
+}
+
+func (c *capacityRecorder) ObserveStoreConsumedCapacity(operation string, units float64) {
+	c.units[operation] += units
+}
+
+func (c *capacityRecorder) IncStoreThrottled(operation string) {
+	c.throttled[operation]++
+}
+
+func newTestDynamoDBStore(maxRetries int) (*DynamoDBStore, *fakeDynamoDB, *capacityRecorder) {
+	fake := newFakeDynamoDB()
+	capacity := &capacityRecorder{units: make(map[string]float64), throttled: make(map[string]int)}
+	return &DynamoDBStore{client: fake, opts: DynamoDBOptions{Table: "shielder", MaxRetries: maxRetries, Capacity: capacity}}, fake, capacity
+}
+
+func TestDynamoDBIncrement(t *testing.T) {
+	ctx := context.Background()
+	s, fake, capacity := newTestDynamoDBStore(0)
+
+	for want := int64(1); want <= 3; want++ {
+		got, err := s.Increment(ctx, "ratelimit:10.0.0.1", 1, time.Minute)
+		if err != nil {
+			t.Fatalf("Increment failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("Expected count %d, got %d", want, got)
+		}
+	}
+	expiresAt := time.Unix(fakeNumber(fake.items["ratelimit:10.0.0.1"][dynamoExpiresAttr]), 0)
+	if d := time.Until(expiresAt); d <= 58*time.Second || d > time.Minute {
+		t.Errorf("Expected the window to end in a minute, got %v", d)
+	}
+
+	// An expired item that DynamoDB has not removed yet starts a new window.
+	fake.expire("ratelimit:10.0.0.1")
+	if got, err := s.Increment(ctx, "ratelimit:10.0.0.1", 2, time.Minute); err != nil || got != 2 {
+		t.Errorf("Expected a new window with count 2, got %d, %v", got, err)
+	}
+
+	// Another writer creating the item between the failed update and the put
+	// is counted against.
+	fake.beforePut = func() {
+		fake.items["ratelimit:10.0.0.2"] = map[string]types.AttributeValue{
+			dynamoKeyAttr:     &types.AttributeValueMemberS{Value: "ratelimit:10.0.0.2"},
+			dynamoCountAttr:   &types.AttributeValueMemberN{Value: "5"},
+			dynamoExpiresAttr: dynamoTime(time.Now().Add(time.Minute)),
+		}
+	}
+	if got, err := s.Increment(ctx, "ratelimit:10.0.0.2", 1, time.Minute); err != nil || got != 6 {
+		t.Errorf("Expected the concurrent window to count 6, got %d, %v", got, err)
+	}
+
+	if capacity.units["increment"] == 0 {
+		t.Errorf("Expected consumed capacity to be recorded")
+	}
+}
+
+func TestDynamoDBSetExistsInspect(t *testing.T) {
+	ctx := context.Background()
+	s, fake, _ := newTestDynamoDBStore(0)
+
+	if err := s.Set(ctx, "block:10.0.0.1", "manual", time.Hour); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if exists, err := s.Exists(ctx, "block:10.0.0.1"); err != nil || !exists {
+		t.Errorf("Expected the key to exist, got %v, %v", exists, err)
+	}
+	value, ttl, found, err := s.Inspect(ctx, "block:10.0.0.1")
+	if err != nil || !found || value != "manual" || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected manual for an hour, got %q for %v (found %v, %v)", value, ttl, found, err)
+	}
+	if _, err := s.Increment(ctx, "ratelimit:10.0.0.1", 4, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, found, _ := s.Inspect(ctx, "ratelimit:10.0.0.1"); !found || value != "4" {
+		t.Errorf("Expected counter 4, got %q (found %v)", value, found)
+	}
+
+	fake.expire("block:10.0.0.1")
+	if exists, err := s.Exists(ctx, "block:10.0.0.1"); err != nil || exists {
+		t.Errorf("Expected an expired key not to exist, got %v, %v", exists, err)
+	}
+	if _, _, found, err := s.Inspect(ctx, "block:10.0.0.1"); err != nil || found {
+		t.Errorf("Expected an expired key not to be found, got %v, %v", found, err)
+	}
+
+	if err := s.Delete(ctx, "ratelimit:10.0.0.1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if exists, _ := s.Exists(ctx, "ratelimit:10.0.0.1"); exists {
+		t.Errorf("Expected a deleted key not to exist")
+	}
+	if exists, err := s.Exists(ctx, "missing"); err != nil || exists {
+		t.Errorf("Expected a missing key not to exist, got %v, %v", exists, err)
+	}
+}
+
+func TestDynamoDBErrors(t *testing.T) {
+	ctx := context.Background()
+	throttled := &smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException"}
+
+	t.Run("Throttling is retried", func(t *testing.T) {
+		s, fake, capacity := newTestDynamoDBStore(3)
+		fake.errs = []error{throttled, throttled}
+		if got, err := s.Increment(ctx, "ratelimit:10.0.0.1", 1, time.Minute); err != nil || got != 1 {
+			t.Errorf("Expected the increment to succeed after retries, got %d, %v", got, err)
+		}
+		if capacity.throttled["increment"] != 2 {
+			t.Errorf("Expected 2 throttled attempts to be recorded, got %d", capacity.throttled["increment"])
+		}
+	})
+
+	t.Run("Retries are bounded", func(t *testing.T) {
+		s, fake, _ := newTestDynamoDBStore(1)
+		fake.errs = []error{throttled, throttled, throttled}
+		if err := s.Set(ctx, "block:10.0.0.1", "manual", time.Hour); !errors.Is(err, throttled) {
+			t.Errorf("Expected the throttling error, got %v", err)
+		}
+		if fake.calls != 2 {
+			t.Errorf("Expected 2 attempts, got %d", fake.calls)
+		}
+	})
+
+	t.Run("Other errors are not retried", func(t *testing.T) {
+		s, fake, _ := newTestDynamoDBStore(3)
+		denied := &smithy.GenericAPIError{Code: "AccessDeniedException"}
+		fake.errs = []error{denied}
+		if _, err := s.Exists(ctx, "block:10.0.0.1"); !errors.Is(err, denied) {
+			t.Errorf("Expected the access error, got %v", err)
+		}
+		if fake.calls != 1 {
+			t.Errorf("Expected 1 attempt, got %d", fake.calls)
+		}
+	})
+
+	t.Run("Corrupt expiry", func(t *testing.T) {
+		s, fake, _ := newTestDynamoDBStore(0)
+		fake.items["block:10.0.0.1"] = map[string]types.AttributeValue{
+			dynamoKeyAttr:     &types.AttributeValueMemberS{Value: "block:10.0.0.1"},
+			dynamoExpiresAttr: &types.AttributeValueMemberN{Value: "soon"},
+		}
+		if _, err := s.Exists(ctx, "block:10.0.0.1"); err == nil {
+			t.Errorf("Expected an error for a corrupt expiry")
+		}
+	})
+}
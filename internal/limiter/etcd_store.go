@@ -0,0 +1,185 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdOptions configures the etcd store.
+type EtcdOptions struct {
+	Endpoints   []string
+	Username    string
+	Password    string
+	DialTimeout time.Duration
+	// Prefix is prepended to every key, so several deployments can share a cluster.
+	Prefix string
+}
+
+// EtcdStore is a Store backed by an etcd cluster. Expiry is implemented with
+// leases: every counter window and block marker is attached to a lease with
+// the matching TTL, and etcd deletes the key when the lease runs out.
+//
+// etcd has no native increment, so counters are updated with an optimistic
+// transaction on the key's mod revision. That is fine for the request rates
+// small clusters see, but every new window costs an extra lease grant round
+// trip; prefer Redis for high-traffic deployments.
+type EtcdStore struct {
+	client *clientv3.Client
+	prefix string
+}
+
+// NewEtcdStore connects to the etcd cluster and verifies that it is reachable.
+func NewEtcdStore(ctx context.Context, opts EtcdOptions) (*EtcdStore, error) {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   opts.Endpoints,
+		Username:    opts.Username,
+		Password:    opts.Password,
+		DialTimeout: opts.DialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statusCtx, cancel := context.WithTimeout(ctx, opts.DialTimeout)
+	defer cancel()
+	if _, err := client.Status(statusCtx, opts.Endpoints[0]); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &EtcdStore{client: client, prefix: opts.Prefix}, nil
+}
+
+// Increment increments the counter at key. New counters are attached to a
+// fresh lease of length window; existing counters keep their lease so that the
+// window is never extended.
+func (s *EtcdStore) Increment(ctx context.Context, key string, n int64, window time.Duration) (int64, error) {
+	key = s.prefix + key
+
+	for {
+		resp, err := s.client.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(resp.Kvs) == 0 {
+			lease, err := s.client.Grant(ctx, leaseSeconds(window))
+			if err != nil {
+				return 0, err
+			}
+			txn, err := s.client.Txn(ctx).
+				If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+				Then(clientv3.OpPut(key, strconv.FormatInt(n, 10), clientv3.WithLease(lease.ID))).
+				Commit()
+			if err != nil {
+				return 0, err
+			}
+			if txn.Succeeded {
+				return n, nil
+			}
+			// Another writer created the key first, release our lease and retry.
+			s.client.Revoke(ctx, lease.ID)
+			continue
+		}
+
+		kv := resp.Kvs[0]
+		count, err := strconv.ParseInt(string(kv.Value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+
+		txn, err := s.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).
+			Then(clientv3.OpPut(key, strconv.FormatInt(count, 10), clientv3.WithIgnoreLease())).
+			Commit()
+		if err != nil {
+			return 0, err
+		}
+		if txn.Succeeded {
+			return count, nil
+		}
+	}
+}
+
+// Set attaches the value to a fresh lease of length ttl and revokes the lease
+// of the value it replaces, so that keys set over and over, such as blocks
+// that are extended, do not leave a lease behind every time.
+func (s *EtcdStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	lease, err := s.client.Grant(ctx, leaseSeconds(ttl))
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Put(ctx, s.prefix+key, value, clientv3.WithLease(lease.ID), clientv3.WithPrevKV())
+	if err != nil {
+		s.client.Revoke(ctx, lease.ID)
+		return err
+	}
+	// Every key has a lease of its own, revoking the old one only drops
+	// the replaced value.
+	if prev := resp.PrevKv; prev != nil && prev.Lease != 0 && clientv3.LeaseID(prev.Lease) != lease.ID {
+		if _, err := s.client.Revoke(ctx, clientv3.LeaseID(prev.Lease)); err != nil && !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EtcdStore) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.client.Get(ctx, s.prefix+key, clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+func (s *EtcdStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.Delete(ctx, s.prefix+key)
+	return err
+}
+
+func (s *EtcdStore) Inspect(ctx context.Context, key string) (string, time.Duration, bool, error) {
+	resp, err := s.client.Get(ctx, s.prefix+key)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", 0, false, nil
+	}
+	kv := resp.Kvs[0]
+	if kv.Lease == 0 {
+		return string(kv.Value), 0, true, nil
+	}
+	lease, err := s.client.TimeToLive(ctx, clientv3.LeaseID(kv.Lease))
+	if err != nil {
+		return "", 0, false, err
+	}
+	return string(kv.Value), time.Duration(max(lease.TTL, 0)) * time.Second, true, nil
+}
+
+func (s *EtcdStore) Ping(ctx context.Context) error {
+	_, err := s.client.Get(ctx, s.prefix+"ping", clientv3.WithCountOnly())
+	return err
+}
+
+func (s *EtcdStore) Close() error {
+	return s.client.Close()
+}
+
+// leaseSeconds converts a TTL to a lease TTL, rounding up to whole seconds.
+func leaseSeconds(ttl time.Duration) int64 {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
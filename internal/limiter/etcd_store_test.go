@@ -0,0 +1,281 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+// fakeEtcd is an in-memory etcd server behind the KV and lease RPCs the
+// store sends. Leases expire against a clock the tests advance.
+type fakeEtcd struct {
+	pb.KVClient
+	pb.LeaseClient
+
+	mu        sync.Mutex
+	now       time.Time
+	rev       int64
+	nextLease int64
+	kvs       map[string]*mvccpb.KeyValue
+	leases    map[int64]time.Time
+	// beforeTxn runs before the next transaction is evaluated.
+	beforeTxn func()
+}
+
+func newTestEtcdStore(prefix string) (*EtcdStore, *fakeEtcd) {
+	fake := &fakeEtcd{
+		now:    time.Now(),
+		kvs:    make(map[string]*mvccpb.KeyValue),
+		leases: make(map[int64]time.Time),
+	}
+	client := &clientv3.Client{
+		KV:    clientv3.NewKVFromKVClient(fake, nil),
+		Lease: clientv3.NewLeaseFromLeaseClient(fake, nil, time.Second),
+	}
+	return &EtcdStore{client: client, prefix: prefix}, fake
+}
+
+func (f *fakeEtcd) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for id, deadline := range f.leases {
+		if !f.now.Before(deadline) {
+			f.revoke(id)
+		}
+	}
+}
+
+func (f *fakeEtcd) revoke(id int64) {
+	delete(f.leases, id)
+	for key, kv := range f.kvs {
+		if kv.Lease == id {
+			delete(f.kvs, key)
+		}
+	}
+}
+
+func (f *fakeEtcd) put(r *pb.PutRequest) (*mvccpb.KeyValue, error) {
+	prev := f.kvs[string(r.Key)]
+	lease := r.Lease
+	if r.IgnoreLease && prev != nil {
+		lease = prev.Lease
+	}
+	if _, ok := f.leases[lease]; lease != 0 && !ok {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	f.rev++
+	kv := &mvccpb.KeyValue{Key: r.Key, Value: r.Value, Lease: lease, CreateRevision: f.rev, ModRevision: f.rev, Version: 1}
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	}
+	f.kvs[string(r.Key)] = kv
+	return prev, nil
+}
+
+func (f *fakeEtcd) Range(ctx context.Context, r *pb.RangeRequest, _ ...grpc.CallOption) (*pb.RangeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &pb.RangeResponse{Header: &pb.ResponseHeader{Revision: f.rev}}
+	if kv, ok := f.kvs[string(r.Key)]; ok {
+		resp.Count = 1
+		if !r.CountOnly {
+			resp.Kvs = []*mvccpb.KeyValue{kv}
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeEtcd) Put(ctx context.Context, r *pb.PutRequest, _ ...grpc.CallOption) (*pb.PutResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prev, err := f.put(r)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.PutResponse{Header: &pb.ResponseHeader{Revision: f.rev}}
+	if r.PrevKv {
+		resp.PrevKv = prev
+	}
+	return resp, nil
+}
+
+func (f *fakeEtcd) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest, _ ...grpc.CallOption) (*pb.DeleteRangeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &pb.DeleteRangeResponse{Header: &pb.ResponseHeader{Revision: f.rev}}
+	if _, ok := f.kvs[string(r.Key)]; ok {
+		delete(f.kvs, string(r.Key))
+		resp.Deleted = 1
+	}
+	return resp, nil
+}
+
+func (f *fakeEtcd) Txn(ctx context.Context, r *pb.TxnRequest, _ ...grpc.CallOption) (*pb.TxnResponse, error) {
+	if f.beforeTxn != nil {
+		f.beforeTxn()
+		f.beforeTxn = nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	succeeded := true
+	for _, cmp := range r.Compare {
+		var got int64
+		if kv := f.kvs[string(cmp.Key)]; kv != nil {
+			got = kv.ModRevision
+			if cmp.Target == pb.Compare_CREATE {
+				got = kv.CreateRevision
+			}
+		}
+		want := cmp.GetModRevision()
+		if cmp.Target == pb.Compare_CREATE {
+			want = cmp.GetCreateRevision()
+		}
+		if cmp.Result != pb.Compare_EQUAL || got != want {
+			succeeded = false
+		}
+	}
+	if succeeded {
+		for _, op := range r.Success {
+			if _, err := f.put(op.GetRequestPut()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &pb.TxnResponse{Header: &pb.ResponseHeader{Revision: f.rev}, Succeeded: succeeded}, nil
+}
+
+func (f *fakeEtcd) LeaseGrant(ctx context.Context, r *pb.LeaseGrantRequest, _ ...grpc.CallOption) (*pb.LeaseGrantResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextLease++
+	f.leases[f.nextLease] = f.now.Add(time.Duration(r.TTL) * time.Second)
+	return &pb.LeaseGrantResponse{Header: &pb.ResponseHeader{}, ID: f.nextLease, TTL: r.TTL}, nil
+}
+
+func (f *fakeEtcd) LeaseRevoke(ctx context.Context, r *pb.LeaseRevokeRequest, _ ...grpc.CallOption) (*pb.LeaseRevokeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.leases[r.ID]; !ok {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	f.revoke(r.ID)
+	return &pb.LeaseRevokeResponse{Header: &pb.ResponseHeader{}}, nil
+}
+
+func (f *fakeEtcd) LeaseTimeToLive(ctx context.Context, r *pb.LeaseTimeToLiveRequest, _ ...grpc.CallOption) (*pb.LeaseTimeToLiveResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ttl := int64(-1)
+	if deadline, ok := f.leases[r.ID]; ok {
+		ttl = int64(deadline.Sub(f.now) / time.Second)
+	}
+	return &pb.LeaseTimeToLiveResponse{Header: &pb.ResponseHeader{}, ID: r.ID, TTL: ttl}, nil
+}
+
+func (f *fakeEtcd) leaseCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.leases)
+}
+
+func TestEtcdIncrement(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newTestEtcdStore("shielder/")
+
+	for want := int64(1); want <= 3; want++ {
+		got, err := s.Increment(ctx, "ratelimit:10.0.0.1", 1, time.Minute)
+		if err != nil {
+			t.Fatalf("Increment failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("Expected count %d, got %d", want, got)
+		}
+	}
+	if fake.leaseCount() != 1 {
+		t.Errorf("Expected the window to keep its lease, got %d leases", fake.leaseCount())
+	}
+	if _, ok := fake.kvs["shielder/ratelimit:10.0.0.1"]; !ok {
+		t.Errorf("Expected the key to carry the prefix")
+	}
+
+	// The window is not extended by increments and ends with its lease.
+	fake.advance(30 * time.Second)
+	if got, _ := s.Increment(ctx, "ratelimit:10.0.0.1", 1, time.Minute); got != 4 {
+		t.Errorf("Expected count 4 within the window, got %d", got)
+	}
+	fake.advance(30 * time.Second)
+	if got, err := s.Increment(ctx, "ratelimit:10.0.0.1", 2, time.Minute); err != nil || got != 2 {
+		t.Errorf("Expected a new window with count 2, got %d, %v", got, err)
+	}
+
+	// Another writer creating the key first is counted against, and the
+	// lease granted for the lost race is revoked.
+	fake.beforeTxn = func() {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.nextLease++
+		fake.leases[fake.nextLease] = fake.now.Add(time.Minute)
+		fake.put(&pb.PutRequest{Key: []byte("shielder/ratelimit:10.0.0.2"), Value: []byte("5"), Lease: fake.nextLease})
+	}
+	if got, err := s.Increment(ctx, "ratelimit:10.0.0.2", 1, time.Minute); err != nil || got != 6 {
+		t.Errorf("Expected the concurrent window to count 6, got %d, %v", got, err)
+	}
+	if fake.leaseCount() != 2 {
+		t.Errorf("Expected the lease of the lost race to be revoked, got %d leases", fake.leaseCount())
+	}
+}
+
+func TestEtcdSet(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newTestEtcdStore("")
+
+	if err := s.Set(ctx, "block:10.0.0.1", "rate_limit_exceeded", time.Minute); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := s.Set(ctx, "block:10.0.0.1", "manual", time.Hour); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if fake.leaseCount() != 1 {
+		t.Errorf("Expected the replaced lease to be revoked, got %d leases", fake.leaseCount())
+	}
+	value, ttl, found, err := s.Inspect(ctx, "block:10.0.0.1")
+	if err != nil || !found || value != "manual" || ttl != time.Hour {
+		t.Errorf("Expected manual for an hour, got %q for %v (found %v, %v)", value, ttl, found, err)
+	}
+
+	// Revoking the lease of the replaced value is not an error when the
+	// lease already expired.
+	fake.mu.Lock()
+	delete(fake.leases, fake.kvs["block:10.0.0.1"].Lease)
+	fake.mu.Unlock()
+	if err := s.Set(ctx, "block:10.0.0.1", "manual", time.Hour); err != nil {
+		t.Errorf("Expected a missing lease to be ignored, got %v", err)
+	}
+
+	fake.advance(time.Hour)
+	if exists, err := s.Exists(ctx, "block:10.0.0.1"); err != nil || exists {
+		t.Errorf("Expected the key to expire with its lease, got %v, %v", exists, err)
+	}
+
+	if err := s.Set(ctx, "block:10.0.0.2", "manual", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := s.Exists(ctx, "block:10.0.0.2"); !exists {
+		t.Errorf("Expected the key to exist")
+	}
+	if err := s.Delete(ctx, "block:10.0.0.2"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, _, found, _ := s.Inspect(ctx, "block:10.0.0.2"); found {
+		t.Errorf("Expected a deleted key not to be found")
+	}
+}
@@ -0,0 +1,93 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// EventType identifies what happened to a client.
+type EventType string
+
+const (
+	// EventBlock is emitted when a client is blocked.
+	EventBlock EventType = "block"
+	// EventUnblock is emitted when a block is lifted before it expires.
+	EventUnblock EventType = "unblock"
+)
+
+// Reasons attached to limiter events.
+const (
+	ReasonRateLimitExceeded = "rate_limit_exceeded"
+	ReasonManual            = "manual"
+)
+
+// Event describes a block or unblock decision taken by the rate limiter.
+type Event struct {
+	Type     EventType
+	IP       string
+	Reason   string
+	Duration time.Duration
+	Time     time.Time
+	// Origin names the region the decision was replicated from. It is empty
+	// for decisions taken by this instance.
+	Origin string
+	// Actor names the operator who took the decision by hand, see
+	// ContextWithActor. It is empty for the limiter's own decisions.
+	Actor string
+}
+
+type actorKey struct{}
+
+// ContextWithActor returns a copy of ctx that attributes the blocks and
+// unblocks taken with it to actor, such as the caller of the admin API.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// EventHandler is called synchronously for every limiter event, so handlers
+// that do I/O should hand the event off to a background worker.
+type EventHandler func(ctx context.Context, event Event)
+
+// OnEvent registers a handler that is notified of block and unblock events.
+// Handlers must be registered before the limiter starts serving requests.
+func (r *RateLimiter) OnEvent(handler EventHandler) {
+	r.handlers = append(r.handlers, handler)
+}
+
+func (r *RateLimiter) emit(ctx context.Context, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Actor == "" && event.Origin == "" {
+		event.Actor, _ = ctx.Value(actorKey{}).(string)
+	}
+	for _, handler := range r.handlers {
+		handler(ctx, event)
+	}
+}
+
+// ApplyEvent applies a block or unblock that was decided elsewhere, such as in
+// another region, and notifies the registered handlers. A block is kept for
+// whatever is left of its original duration.
+func (r *RateLimiter) ApplyEvent(ctx context.Context, event Event) error {
+	key := "blocked:" + event.IP
+	switch event.Type {
+	case EventBlock:
+		remaining := event.Duration - time.Since(event.Time)
+		if remaining <= 0 {
+			return nil
+		}
+		if err := r.store.Set(ctx, key, r.blockValue(event), remaining); err != nil {
+			return err
+		}
+	case EventUnblock:
+		if err := r.store.Delete(ctx, key); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown event type %q", event.Type)
+	}
+	r.emit(ctx, event)
+	return nil
+}
@@ -0,0 +1,9 @@
+package limiter
+
+// unregisterAlgorithm removes an algorithm added with RegisterAlgorithm, so
+// that tests do not leave it behind in the global registry.
+func unregisterAlgorithm(name string) {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+	delete(algorithms, name)
+}
@@ -0,0 +1,105 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FailurePolicy decides how requests are treated while the store is unavailable.
+type FailurePolicy string
+
+const (
+	// FailClosed rejects requests while the store is unavailable.
+	FailClosed FailurePolicy = "closed"
+	// FailOpen lets requests through unlimited while the store is unavailable.
+	FailOpen FailurePolicy = "open"
+	// FailLocal rate limits each client key in process memory while the
+	// store is unavailable. Instances count on their own, so a client spread
+	// over several of them gets up to that many times the limit, and blocks
+	// stored before the outage are not enforced.
+	FailLocal FailurePolicy = "local"
+)
+
+// ErrStoreUnavailable is returned by the limiter while the store is down and
+// the failure policy is FailClosed.
+var ErrStoreUnavailable = errors.New("limiter store unavailable")
+
+// WaitForStore pings the store until it answers, backing off exponentially
+// between attempts up to maxBackoff, and then loads its scripts. It returns
+// the last ping error if ctx expires first.
+func WaitForStore(ctx context.Context, store Store, maxBackoff time.Duration, logger *logrus.Logger) error {
+	backoff := 100 * time.Millisecond
+	for {
+		err := store.Ping(ctx)
+		if err == nil {
+			if loader, ok := store.(ScriptLoader); ok {
+				if err := loader.LoadScripts(ctx); err != nil {
+					// Scripts are sent along on first use instead.
+					logger.WithError(err).Warn("Error loading store scripts")
+				}
+			}
+			return nil
+		}
+		logger.WithError(err).WithField("retry_in", backoff.String()).Warn("Store not reachable yet")
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Available reports whether the store answered the last health check.
+func (r *RateLimiter) Available() bool {
+	return !r.degraded.Load()
+}
+
+// SetAvailable records the result of a store health check. While the store is
+// unavailable the limiter skips it entirely and applies the failure policy.
+func (r *RateLimiter) SetAvailable(available bool) {
+	if r.degraded.Swap(!available) == !available {
+		return
+	}
+	if available {
+		if r.local != nil {
+			r.local.reset()
+		}
+		r.logger.Info("Store reachable again, leaving degraded mode")
+	} else {
+		r.logger.WithField("failure_policy", r.config.FailurePolicy).Error("Store unreachable, entering degraded mode")
+	}
+}
+
+// MonitorStore pings the store once per interval until ctx is done, switching
+// the limiter in and out of degraded mode. The store client reconnects on its
+// own; the monitor only decides when to start using it again.
+func (r *RateLimiter) MonitorStore(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			r.SetAvailable(r.store.Ping(pingCtx) == nil)
+			cancel()
+		}
+	}
+}
+
+// failOpen reports whether requests should be let through when the store
+// cannot be consulted. Under FailLocal blocks cannot be looked up either, the
+// local buckets limit clients instead.
+func (r *RateLimiter) failOpen() bool {
+	return r.config.FailurePolicy == FailOpen || r.local != nil
+}
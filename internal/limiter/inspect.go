@@ -0,0 +1,86 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrInspectUnsupported is returned by Inspect when the store cannot report
+// the values of its keys.
+var ErrInspectUnsupported = errors.New("limiter: store does not support inspection")
+
+// blockMarker is the value stored under a block key. Markers written before
+// it existed hold "1" and decode to an empty marker.
+type blockMarker struct {
+	Reason string `json:"reason"`
+	// Instance is the instance that decided the block, or
+	// "replication:<region>" for blocks replicated from another region.
+	Instance string    `json:"instance"`
+	At       time.Time `json:"at"`
+}
+
+func (r *RateLimiter) blockValue(event Event) string {
+	marker := blockMarker{Reason: event.Reason, Instance: r.config.Instance, At: event.Time.UTC()}
+	if event.Origin != "" {
+		marker.Instance = "replication:" + event.Origin
+	}
+	value, err := json.Marshal(marker)
+	if err != nil {
+		return "1"
+	}
+	return string(value)
+}
+
+// KeyState is the limiter state of a client key.
+type KeyState struct {
+	Key string `json:"key"`
+	// Count is how much of the budget the current window used up. It is
+	// only tracked for the fixed window algorithm.
+	Count           int64         `json:"count"`
+	WindowRemaining time.Duration `json:"windowRemaining"`
+
+	Blocked        bool          `json:"blocked"`
+	BlockRemaining time.Duration `json:"blockRemaining,omitempty"`
+	BlockReason    string        `json:"blockReason,omitempty"`
+	BlockedBy      string        `json:"blockedBy,omitempty"`
+	BlockedAt      time.Time     `json:"blockedAt,omitempty"`
+}
+
+// Inspect returns the current counter and block of a client key without
+// counting a request.
+func (r *RateLimiter) Inspect(ctx context.Context, ip string) (KeyState, error) {
+	inspector, ok := r.store.(Inspector)
+	if !ok {
+		return KeyState{}, ErrInspectUnsupported
+	}
+	state := KeyState{Key: ip}
+
+	value, ttl, found, err := inspector.Inspect(ctx, "rate:"+ip)
+	if err != nil {
+		return KeyState{}, err
+	}
+	if found {
+		if state.Count, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return KeyState{}, err
+		}
+		state.WindowRemaining = ttl
+	}
+
+	value, ttl, found, err = inspector.Inspect(ctx, "blocked:"+ip)
+	if err != nil {
+		return KeyState{}, err
+	}
+	if found {
+		var marker blockMarker
+		json.Unmarshal([]byte(value), &marker)
+		state.Blocked = true
+		state.BlockRemaining = ttl
+		state.BlockReason = marker.Reason
+		state.BlockedBy = marker.Instance
+		state.BlockedAt = marker.At
+	}
+	return state, nil
+}
@@ -2,22 +2,62 @@ package limiter
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 type Config struct {
 	RequestsPerMinute int
 	BurstSize         int
 	BlockDuration     time.Duration
+	FailurePolicy     FailurePolicy
+	// Algorithm is AlgorithmFixedWindow (the default), AlgorithmSlidingWindow,
+	// AlgorithmSlidingLog, AlgorithmTokenBucket or the name of an algorithm
+	// added with RegisterAlgorithm. Token buckets hold BurstSize tokens, or
+	// RequestsPerMinute when it is not set.
+	Algorithm string
+	// Instance names this instance in block markers, so that diagnostics
+	// can tell where a block was decided.
+	Instance string
+	// ShadowAlgorithm names an algorithm that is evaluated next to the
+	// enforcing one without affecting decisions, to see how switching would
+	// change them. It must differ from Algorithm.
+	ShadowAlgorithm string
+	ShadowRecorder  ShadowRecorder
+	// InstanceCeiling caps the requests per second this instance lets
+	// through across all clients, see WithinCeiling. Zero disables it.
+	InstanceCeiling      float64
+	InstanceCeilingBurst int
 }
 
 type RateLimiter struct {
-	client *redis.Client
-	config Config
-	logger *logrus.Logger
+	store    Store
+	config   Config
+	logger   *logrus.Logger
+	handlers []EventHandler
+	degraded atomic.Bool
+	// algorithm counts the requests of client keys, shadowAlgorithm is set
+	// when another algorithm runs in shadow mode.
+	algorithm       algorithm
+	algorithmName   string
+	shadowAlgorithm algorithm
+	ceiling         *rate.Limiter
+	networks        networkCache
+	// local limits clients while the store is unavailable, set for the
+	// FailLocal policy.
+	local *localBuckets
+	// atomic takes fixed window decisions in one step, set when the store
+	// implements AtomicWindow.
+	atomic AtomicWindow
+
+	// requestsPerMinute and blockDuration start out from the config and can
+	// be changed at runtime with SetLimits.
+	requestsPerMinute atomic.Int64
+	blockDuration     atomic.Int64
 }
 
 // NewRedisClient initializes a new Redis client using the provided configuration options.
@@ -30,89 +70,268 @@ func NewRedisClient(cfg redis.Options) (*redis.Client, error) {
 	return client, nil
 }
 
-// NewRateLimiter initializes a new rate limiter using the provided Redis client and configuration.
+// NewRateLimiter initializes a new rate limiter using the provided store and configuration.
 // The returned rate limiter can be used to block or allow requests based on the configured rate limit.
-func NewRateLimiter(client *redis.Client, config Config, logger *logrus.Logger) *RateLimiter {
-	return &RateLimiter{
-		client: client,
-		config: config,
-		logger: logger,
+// An algorithm the store does not support falls back to the fixed window.
+func NewRateLimiter(store Store, config Config, logger *logrus.Logger) *RateLimiter {
+	r := &RateLimiter{
+		store:         store,
+		config:        config,
+		logger:        logger,
+		algorithmName: config.Algorithm,
+		ceiling:       newCeiling(config.InstanceCeiling, config.InstanceCeilingBurst),
+	}
+	if config.FailurePolicy == FailLocal {
+		r.local = newLocalBuckets()
+	}
+	var err error
+	if r.algorithm, err = newAlgorithm(config.Algorithm, store, "rate:", config); err != nil {
+		logger.WithError(err).Error("Falling back to the fixed window algorithm")
+		r.algorithm, r.algorithmName = fixedWindow{store: store, prefix: "rate:"}, AlgorithmFixedWindow
+	}
+	if r.algorithmName == "" {
+		r.algorithmName = AlgorithmFixedWindow
 	}
+	if atomic, ok := store.(AtomicWindow); ok && r.algorithmName == AlgorithmFixedWindow {
+		r.atomic = atomic
+	}
+	if config.ShadowAlgorithm != "" {
+		if r.shadowAlgorithm, err = newAlgorithm(config.ShadowAlgorithm, store, "shadow:", config); err != nil {
+			logger.WithError(err).Error("Shadow algorithm disabled")
+		}
+	}
+	r.SetLimits(config.RequestsPerMinute, config.BlockDuration)
+	return r
+}
+
+// SetLimits changes the rate limit and block duration while requests are
+// being served. Blocks that are already in place keep their duration.
+func (r *RateLimiter) SetLimits(requestsPerMinute int, blockDuration time.Duration) {
+	r.requestsPerMinute.Store(int64(requestsPerMinute))
+	r.blockDuration.Store(int64(blockDuration))
+}
+
+// AlgorithmFixedWindow counts requests in fixed one-minute windows.
+const AlgorithmFixedWindow = "fixed_window"
+
+// Algorithm names the rate limiting algorithm, for metrics and diagnostics.
+func (r *RateLimiter) Algorithm() string {
+	return r.algorithmName
+}
+
+// RequestsPerMinute returns the rate limit in effect.
+func (r *RateLimiter) RequestsPerMinute() int {
+	return int(r.requestsPerMinute.Load())
+}
+
+// BlockDuration returns the block duration in effect.
+func (r *RateLimiter) BlockDuration() time.Duration {
+	return time.Duration(r.blockDuration.Load())
 }
 
-// IsAllowed checks if the given IP is allowed to make a request based on the
+// IsAllowed checks if the given IP is allowed to make a request, counting the
+// request once. See IsAllowedN.
+func (r *RateLimiter) IsAllowed(ctx context.Context, ip string) (bool, error) {
+	return r.IsAllowedN(ctx, ip, 1)
+}
+
+// IsAllowedN checks if the given IP is allowed to make a request based on the
 // configured rate limit. If the IP exceeds the rate limit, it is blocked for the
 // duration configured in the BlockDuration field of the Config struct.
 // Returns true if the request is allowed, false if it is blocked, and an error if
-// there is an issue with the Redis connection.
-func (r *RateLimiter) IsAllowed(ctx context.Context, ip string) (bool, error) {
-	r.logger.WithFields(logrus.Fields{
-		"ip": ip,
-	}).Info("Checking if IP is allowed")
+// there is an issue with the store. While the store is unavailable the failure
+// policy decides the outcome.
+//
+// The request counts n times against the limit, so that expensive requests can
+// use up more of the budget than cheap ones. The ip can be any client key.
+func (r *RateLimiter) IsAllowedN(ctx context.Context, ip string, n int) (bool, error) {
+	return r.IsAllowedLimit(ctx, ip, n, 0)
+}
 
-	pipe := r.client.Pipeline()
+// IsAllowedLimit is like IsAllowedN, but checks against a limit of
+// requestsPerMinute instead of the configured one when it is positive. This
+// lets callers apply different limits to different kinds of client keys.
+func (r *RateLimiter) IsAllowedLimit(ctx context.Context, ip string, n int, requestsPerMinute int) (bool, error) {
+	result, err := r.Check(ctx, ip, n, requestsPerMinute)
+	return result.Allowed, err
+}
 
-	// Key for storing request count
-	key := "rate:" + ip
+// Result is the outcome of a rate limit check, with what clients need to pace
+// their requests.
+type Result struct {
+	Allowed bool
+	// Limit is the requests per minute the request was checked against.
+	Limit int
+	// Remaining is how many more requests the limit allows right now.
+	Remaining int
+	// Reset is how long until the whole budget is available again, at the
+	// latest.
+	Reset time.Duration
+	// RetryAfter is how long a rejected client should wait: what is left of
+	// its block, or until it has the budget for the request again.
+	RetryAfter time.Duration
+}
 
-	// Increment the counter
-	incr := pipe.Incr(ctx, key)
+// Check is IsAllowedLimit returning the state of the limit along with the
+// decision. While the store is unavailable only Allowed and Limit are known.
+func (r *RateLimiter) Check(ctx context.Context, ip string, n int, requestsPerMinute int) (Result, error) {
+	if requestsPerMinute <= 0 {
+		requestsPerMinute = r.RequestsPerMinute()
+	}
+	r.logger.WithFields(logrus.Fields{
+		"ip":   ip,
+		"cost": n,
+	}).Info("Checking if IP is allowed")
 
-	// Set expiration if the key is new
-	pipe.Expire(ctx, key, time.Minute)
+	if !r.Available() {
+		return r.degradedDecision(ip, n, requestsPerMinute)
+	}
+	if r.atomic != nil {
+		return r.checkAtomic(ctx, ip, n, requestsPerMinute)
+	}
 
-	// Execute pipeline
-	_, err := pipe.Exec(ctx)
+	// Count the request in the current window
+	allowed, count, reset, err := r.algorithm.take(ctx, ip, int64(n), int64(requestsPerMinute), time.Now())
 	if err != nil {
-		r.logger.WithError(err).Error("Error executing Redis pipeline")
-		return false, err
+		r.logger.WithError(err).Error("Error incrementing request counter")
+		if r.failOpen() {
+			return r.degradedDecision(ip, n, requestsPerMinute)
+		}
+		return Result{}, err
+	}
+	result := Result{
+		Allowed:   allowed,
+		Limit:     requestsPerMinute,
+		Remaining: max(requestsPerMinute-int(count), 0),
+		Reset:     reset,
 	}
 
 	// Check if request count exceeds limit
-	count := incr.Val()
 	r.logger.WithFields(logrus.Fields{
-		"ip":     ip,
-		"count":  count,
-		"limit":  r.config.RequestsPerMinute,
+		"ip":    ip,
+		"count": count,
+		"limit": requestsPerMinute,
 	}).Info("Request count checked")
 
-	if count > int64(r.config.RequestsPerMinute) {
+	r.shadow(ctx, ip, n, requestsPerMinute, allowed)
+
+	if !allowed {
 		// Block the IP
+		result.RetryAfter = r.BlockDuration()
 		err = r.BlockIP(ctx, ip)
 		if err != nil {
 			r.logger.WithError(err).Error("Error blocking IP")
 		}
-		return false, err
+		return result, err
 	}
 
-	return true, nil
+	return result, nil
 }
 
-// BlockIP sets a Redis key to block the given IP address for the duration
-// configured in the BlockDuration field of the Config struct. It returns an
-// error if there is an issue with the Redis connection.
-
+// BlockIP sets a key in the store to block the given IP address for the block
+// duration in effect. It returns an error if there is an issue with the store.
 func (r *RateLimiter) BlockIP(ctx context.Context, ip string) error {
+	return r.Block(ctx, ip, r.BlockDuration(), ReasonRateLimitExceeded)
+}
+
+// Block blocks a client key for duration, such as when an operator blocks a
+// client by hand.
+func (r *RateLimiter) Block(ctx context.Context, ip string, duration time.Duration, reason string) error {
 	r.logger.WithFields(logrus.Fields{
-		"ip": ip,
+		"ip":     ip,
+		"reason": reason,
 	}).Info("Blocking IP")
+	event := Event{
+		Type:     EventBlock,
+		IP:       ip,
+		Reason:   reason,
+		Duration: duration,
+		Time:     time.Now(),
+	}
 	key := "blocked:" + ip
-	err := r.client.Set(ctx, key, true, r.config.BlockDuration).Err()
+	err := r.store.Set(ctx, key, r.blockValue(event), event.Duration)
 	if err != nil {
 		r.logger.WithError(err).Error("Error setting blocked key")
+		return err
 	}
-	return err
+	r.emit(ctx, event)
+	return nil
+}
+
+// UnblockIP lifts the block on the given IP address and resets its request
+// counter, so the client starts over with a fresh window.
+func (r *RateLimiter) UnblockIP(ctx context.Context, ip string) error {
+	r.logger.WithFields(logrus.Fields{
+		"ip": ip,
+	}).Info("Unblocking IP")
+	if err := r.store.Delete(ctx, "blocked:"+ip); err != nil {
+		r.logger.WithError(err).Error("Error deleting blocked key")
+		return err
+	}
+	if err := r.algorithm.reset(ctx, ip); err != nil {
+		r.logger.WithError(err).Error("Error deleting rate key")
+		return err
+	}
+	r.emit(ctx, Event{
+		Type:   EventUnblock,
+		IP:     ip,
+		Reason: ReasonManual,
+	})
+	return nil
 }
 
 func (r *RateLimiter) IsBlocked(ctx context.Context, ip string) (bool, error) {
 	r.logger.WithFields(logrus.Fields{
 		"ip": ip,
 	}).Info("Checking if IP is blocked")
+
+	if !r.Available() {
+		if r.failOpen() {
+			return false, nil
+		}
+		return false, ErrStoreUnavailable
+	}
+
 	key := "blocked:" + ip
-	exists, err := r.client.Exists(ctx, key).Result()
+	exists, err := r.store.Exists(ctx, key)
 	if err != nil {
 		r.logger.WithError(err).Error("Error checking blocked key")
+		if r.failOpen() {
+			return false, nil
+		}
 		return false, err
 	}
-	return exists == 1, nil
+	return exists, nil
+}
+
+// BlockRemaining returns what is left of the block on a client key. It
+// returns the block duration in effect, the longest a block placed now would
+// last, when the store cannot tell.
+func (r *RateLimiter) BlockRemaining(ctx context.Context, ip string) time.Duration {
+	inspector, ok := r.store.(Inspector)
+	if !ok || !r.Available() {
+		return r.BlockDuration()
+	}
+	_, ttl, found, err := inspector.Inspect(ctx, "blocked:"+ip)
+	if err != nil || !found || ttl <= 0 {
+		return r.BlockDuration()
+	}
+	return ttl
+}
+
+// degradedDecision applies the failure policy while the store is unavailable.
+func (r *RateLimiter) degradedDecision(ip string, n, requestsPerMinute int) (Result, error) {
+	result := Result{Allowed: true, Limit: requestsPerMinute}
+	if r.local != nil {
+		result.Allowed = r.local.take(ip, int64(n), int64(requestsPerMinute), time.Now())
+		if !result.Allowed && requestsPerMinute > 0 {
+			// Local buckets refill continuously.
+			result.RetryAfter = time.Duration(n) * time.Minute / time.Duration(requestsPerMinute)
+		}
+		return result, nil
+	}
+	if r.failOpen() {
+		return result, nil
+	}
+	return Result{}, ErrStoreUnavailable
 }
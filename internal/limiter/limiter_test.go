@@ -0,0 +1,567 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLimiter(t *testing.T, config Config) (*RateLimiter, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewRateLimiter(NewRedisStore(client), config, logger), mr
+}
+
+func TestIsAllowedBlocksAfterLimit(t *testing.T) {
+	rl, _ := newTestLimiter(t, Config{RequestsPerMinute: 3, BlockDuration: time.Hour})
+	ctx := context.Background()
+
+	var events []Event
+	rl.OnEvent(func(ctx context.Context, event Event) {
+		events = append(events, event)
+	})
+
+	for i := 0; i < 3; i++ {
+		allowed, err := rl.IsAllowed(ctx, "10.0.0.1")
+		if err != nil || !allowed {
+			t.Fatalf("Request %d: expected allowed, got %v (%v)", i+1, allowed, err)
+		}
+	}
+
+	allowed, err := rl.IsAllowed(ctx, "10.0.0.1")
+	if err != nil || allowed {
+		t.Fatalf("Expected request over the limit to be rejected, got %v (%v)", allowed, err)
+	}
+
+	blocked, err := rl.IsBlocked(ctx, "10.0.0.1")
+	if err != nil || !blocked {
+		t.Fatalf("Expected IP to be blocked, got %v (%v)", blocked, err)
+	}
+	if len(events) != 1 || events[0].Type != EventBlock {
+		t.Fatalf("Expected a single block event, got %+v", events)
+	}
+
+	if err := rl.UnblockIP(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Failed to unblock: %v", err)
+	}
+	if blocked, _ := rl.IsBlocked(ctx, "10.0.0.1"); blocked {
+		t.Error("Expected IP to be unblocked")
+	}
+}
+
+func TestIsAllowedAtomic(t *testing.T) {
+	rl, mr := newTestLimiter(t, Config{RequestsPerMinute: 2, BlockDuration: time.Hour})
+	ctx := context.Background()
+	if rl.atomic == nil {
+		t.Fatal("Expected the Redis store to take fixed window decisions atomically")
+	}
+	var events []Event
+	rl.OnEvent(func(ctx context.Context, event Event) {
+		events = append(events, event)
+	})
+
+	// Requests do not extend the window.
+	rl.IsAllowed(ctx, "10.0.0.1")
+	mr.FastForward(30 * time.Second)
+	rl.IsAllowed(ctx, "10.0.0.1")
+	if ttl := mr.TTL("rate:10.0.0.1"); ttl != 30*time.Second {
+		t.Errorf("Expected the window to end in 30s, got %v", ttl)
+	}
+
+	// Blocked keys are not counted any further.
+	for i := 0; i < 3; i++ {
+		if allowed, err := rl.IsAllowed(ctx, "10.0.0.1"); allowed || err != nil {
+			t.Fatalf("Expected the request to be rejected, got %v (%v)", allowed, err)
+		}
+	}
+	if count, _ := mr.Get("rate:10.0.0.1"); count != "3" {
+		t.Errorf("Expected 3 requests counted, got %s", count)
+	}
+	if ttl := mr.TTL("blocked:10.0.0.1"); ttl != time.Hour {
+		t.Errorf("Expected a block of an hour, got %v", ttl)
+	}
+	if len(events) != 1 || events[0].Reason != ReasonRateLimitExceeded {
+		t.Errorf("Expected a single block event, got %+v", events)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmFixedWindow, AlgorithmSlidingWindow} {
+		t.Run(algorithm, func(t *testing.T) {
+			rl, mr := newTestLimiter(t, Config{RequestsPerMinute: 3, BlockDuration: time.Hour, Algorithm: algorithm})
+			ctx := context.Background()
+
+			result, err := rl.Check(ctx, "10.0.0.1", 2, 0)
+			if err != nil || !result.Allowed || result.Limit != 3 || result.Remaining != 1 {
+				t.Fatalf("Expected 1 request remaining of 3, got %+v (%v)", result, err)
+			}
+			if result.Reset <= 0 || result.Reset > 2*time.Minute {
+				t.Errorf("Expected the budget to reset within the window, got %v", result.Reset)
+			}
+
+			result, _ = rl.Check(ctx, "10.0.0.1", 2, 0)
+			if result.Allowed || result.Remaining != 0 || result.RetryAfter != time.Hour {
+				t.Errorf("Expected a rejection for the block duration, got %+v", result)
+			}
+
+			// Requests of blocked keys are told what is left of the block.
+			if algorithm == AlgorithmFixedWindow {
+				mr.FastForward(10 * time.Minute)
+				if result, _ = rl.Check(ctx, "10.0.0.1", 1, 0); result.Allowed || result.RetryAfter != 50*time.Minute {
+					t.Errorf("Expected 50 minutes left of the block, got %+v", result)
+				}
+			}
+			if remaining := rl.BlockRemaining(ctx, "10.0.0.1"); remaining <= 0 || remaining > time.Hour {
+				t.Errorf("Expected the block to end within an hour, got %v", remaining)
+			}
+		})
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      FailurePolicy
+		wantAllowed bool
+		wantErr     error
+	}{
+		{name: "Fail open", policy: FailOpen, wantAllowed: true},
+		{name: "Fail closed", policy: FailClosed, wantErr: ErrStoreUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, _ := newTestLimiter(t, Config{RequestsPerMinute: 1, BlockDuration: time.Hour, FailurePolicy: tt.policy})
+			rl.SetAvailable(false)
+
+			allowed, err := rl.IsAllowed(context.Background(), "10.0.0.1")
+			if allowed != tt.wantAllowed || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected (%v, %v), got (%v, %v)", tt.wantAllowed, tt.wantErr, allowed, err)
+			}
+		})
+	}
+}
+
+func TestFailLocal(t *testing.T) {
+	rl, _ := newTestLimiter(t, Config{RequestsPerMinute: 2, BlockDuration: time.Hour, FailurePolicy: FailLocal})
+	ctx := context.Background()
+	rl.SetAvailable(false)
+
+	// Each key gets the limit from its own bucket.
+	for i, want := range []bool{true, true, false} {
+		if allowed, err := rl.IsAllowed(ctx, "10.0.0.1"); allowed != want || err != nil {
+			t.Errorf("request %d: expected (%v, nil), got (%v, %v)", i+1, want, allowed, err)
+		}
+	}
+	if allowed, _ := rl.IsAllowed(ctx, "10.0.0.2"); !allowed {
+		t.Error("Expected another key to be allowed")
+	}
+	if blocked, err := rl.IsBlocked(ctx, "10.0.0.1"); blocked || err != nil {
+		t.Errorf("Expected blocks to be skipped, got (%v, %v)", blocked, err)
+	}
+
+	// The store counts again once it is back.
+	rl.SetAvailable(true)
+	if allowed, _ := rl.IsAllowed(ctx, "10.0.0.1"); !allowed {
+		t.Error("Expected the store to decide once available")
+	}
+	if len(rl.local.buckets) != 0 {
+		t.Errorf("Expected the local buckets to be dropped, got %d", len(rl.local.buckets))
+	}
+}
+
+func TestInspect(t *testing.T) {
+	rl, mr := newTestLimiter(t, Config{RequestsPerMinute: 2, BlockDuration: time.Hour, Instance: "shielder-1"})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		rl.IsAllowed(ctx, "10.0.0.1")
+	}
+	rl.IsAllowed(ctx, "10.0.0.2")
+	if err := rl.ApplyEvent(ctx, Event{Type: EventBlock, IP: "10.0.0.3", Reason: ReasonManual,
+		Duration: time.Hour, Time: time.Now(), Origin: "eu-west-1"}); err != nil {
+		t.Fatalf("Failed to apply event: %v", err)
+	}
+	mr.Set("blocked:10.0.0.4", "1")
+
+	tests := []struct {
+		ip        string
+		count     int64
+		blocked   bool
+		reason    string
+		blockedBy string
+	}{
+		{"10.0.0.1", 3, true, ReasonRateLimitExceeded, "shielder-1"},
+		{"10.0.0.2", 1, false, "", ""},
+		{"10.0.0.3", 0, true, ReasonManual, "replication:eu-west-1"},
+		{"10.0.0.4", 0, true, "", ""},
+		{"10.0.0.5", 0, false, "", ""},
+	}
+
+	for _, tt := range tests {
+		state, err := rl.Inspect(ctx, tt.ip)
+		if err != nil {
+			t.Fatalf("%s: failed to inspect: %v", tt.ip, err)
+		}
+		if state.Count != tt.count || state.Blocked != tt.blocked || state.BlockReason != tt.reason || state.BlockedBy != tt.blockedBy {
+			t.Errorf("%s: unexpected state %+v", tt.ip, state)
+		}
+		if tt.count > 0 && (state.WindowRemaining <= 0 || state.WindowRemaining > time.Minute) {
+			t.Errorf("%s: expected the window to end within a minute, got %v", tt.ip, state.WindowRemaining)
+		}
+		if tt.reason != "" && (state.BlockRemaining <= 0 || state.BlockRemaining > time.Hour) {
+			t.Errorf("%s: expected the block to end within an hour, got %v", tt.ip, state.BlockRemaining)
+		}
+	}
+}
+
+func TestInstanceCeiling(t *testing.T) {
+	rl, mr := newTestLimiter(t, Config{
+		RequestsPerMinute:    100,
+		FailurePolicy:        FailOpen,
+		InstanceCeiling:      0.001,
+		InstanceCeilingBurst: 2,
+	})
+	mr.Close()
+	rl.SetAvailable(false)
+
+	for i := 0; i < 2; i++ {
+		if !rl.WithinCeiling() {
+			t.Fatalf("Request %d: expected to be within the ceiling", i+1)
+		}
+	}
+	if rl.WithinCeiling() {
+		t.Error("Expected the ceiling to hold while the store is down and failing open")
+	}
+
+	unlimited, _ := newTestLimiter(t, Config{RequestsPerMinute: 100})
+	for i := 0; i < 1000; i++ {
+		if !unlimited.WithinCeiling() {
+			t.Fatal("Expected no ceiling by default")
+		}
+	}
+}
+
+func TestListBlocks(t *testing.T) {
+	rl, _ := newTestLimiter(t, Config{RequestsPerMinute: 10, BlockDuration: time.Hour})
+	ctx := context.Background()
+	now := time.Now()
+
+	for i := 0; i < 25; i++ {
+		event := Event{Type: EventBlock, IP: fmt.Sprintf("10.0.%d.%d", i%2, i), Reason: ReasonRateLimitExceeded, Duration: 2 * time.Hour, Time: now}
+		if i%5 == 0 {
+			event.Reason = ReasonManual
+			event.Time = now.Add(-time.Hour)
+		}
+		if err := rl.ApplyEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Expected the listing to end")
+		}
+		page, err := rl.ListBlocks(ctx, BlockFilter{}, cursor, 7)
+		if err != nil {
+			t.Fatalf("ListBlocks failed: %v", err)
+		}
+		if len(page.Blocks) > 7 {
+			t.Fatalf("Expected at most 7 blocks per page, got %d", len(page.Blocks))
+		}
+		for _, b := range page.Blocks {
+			if seen[b.Key] {
+				t.Errorf("Block %s listed twice", b.Key)
+			}
+			seen[b.Key] = true
+		}
+		if cursor = page.Cursor; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("Expected 25 blocks, got %d", len(seen))
+	}
+
+	for name, tc := range map[string]struct {
+		filter BlockFilter
+		want   int
+	}{
+		"reason": {BlockFilter{Reason: ReasonManual}, 5},
+		"cidr":   {BlockFilter{Prefix: netip.MustParsePrefix("10.0.1.0/24")}, 12},
+		"minAge": {BlockFilter{MinAge: 30 * time.Minute}, 5},
+		"maxAge": {BlockFilter{MaxAge: 30 * time.Minute}, 20},
+		"search": {BlockFilter{Search: "0.1."}, 12},
+	} {
+		page, err := rl.ListBlocks(ctx, tc.filter, "", 100)
+		if err != nil {
+			t.Fatalf("%s: ListBlocks failed: %v", name, err)
+		}
+		if len(page.Blocks) != tc.want || page.Cursor != "" {
+			t.Errorf("%s: expected %d blocks on a single page, got %d (cursor %q)", name, tc.want, len(page.Blocks), page.Cursor)
+		}
+	}
+
+	if _, err := rl.ListBlocks(ctx, BlockFilter{}, "bogus", 10); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Expected an invalid cursor error, got %v", err)
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	rl, mr := newTestLimiter(t, Config{
+		RequestsPerMinute: 3,
+		BlockDuration:     time.Hour,
+		Algorithm:         AlgorithmSlidingLog,
+	})
+	ctx := context.Background()
+	if got := rl.Algorithm(); got != AlgorithmSlidingLog {
+		t.Fatalf("Expected the sliding log algorithm, got %q", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		if allowed, err := rl.IsAllowed(ctx, "10.0.0.1"); err != nil || !allowed {
+			t.Fatalf("Request %d: expected allowed, got %v (%v)", i+1, allowed, err)
+		}
+	}
+	if allowed, _ := rl.IsAllowed(ctx, "10.0.0.1"); allowed {
+		t.Fatal("Expected the fourth request to be rejected")
+	}
+	if !mr.Exists("rate:sliding_log:10.0.0.1") {
+		t.Fatal("Expected the request log to be kept in a sorted set")
+	}
+	if err := rl.UnblockIP(ctx, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("rate:sliding_log:10.0.0.1") {
+		t.Error("Expected unblocking to clear the request log")
+	}
+
+	// Requests at the end of one minute still count at the start of the
+	// next, so there is no burst at the window edge.
+	store := rl.store.(*RedisStore)
+	edge := time.Now().Truncate(time.Minute).Add(-time.Second)
+	for i := 0; i < 3; i++ {
+		store.AddToLog(ctx, "log", 1, edge, time.Minute)
+	}
+	if got, err := store.AddToLog(ctx, "log", 1, edge.Add(2*time.Second), time.Minute); err != nil || got != 4 {
+		t.Fatalf("Expected 4 requests across the window edge, got %d (%v)", got, err)
+	}
+	if got, _ := store.AddToLog(ctx, "log", 2, edge.Add(time.Minute+time.Second), time.Minute); got != 3 {
+		t.Errorf("Expected requests older than a minute to be dropped, got %d", got)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	rl, mr := newTestLimiter(t, Config{
+		RequestsPerMinute: 60,
+		BurstSize:         3,
+		BlockDuration:     time.Hour,
+		Algorithm:         AlgorithmTokenBucket,
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if allowed, err := rl.IsAllowed(ctx, "10.0.0.1"); err != nil || !allowed {
+			t.Fatalf("Request %d: expected allowed within the burst, got %v (%v)", i+1, allowed, err)
+		}
+	}
+	if allowed, _ := rl.IsAllowed(ctx, "10.0.0.1"); allowed {
+		t.Fatal("Expected the request after the burst to be rejected")
+	}
+	if !mr.Exists("rate:token_bucket:10.0.0.1") {
+		t.Fatal("Expected the bucket to be kept in the store")
+	}
+
+	// Buckets refill at the rate limit, one token per second here.
+	store := rl.store.(*RedisStore)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if taken, _, err := store.TakeTokens(ctx, "bucket", 1, 2, 1, now); err != nil || !taken {
+			t.Fatalf("Expected a token, got %v (%v)", taken, err)
+		}
+	}
+	if taken, _, _ := store.TakeTokens(ctx, "bucket", 1, 2, 1, now.Add(500*time.Millisecond)); taken {
+		t.Fatal("Expected the bucket to be empty")
+	}
+	if taken, left, _ := store.TakeTokens(ctx, "bucket", 1, 2, 1, now.Add(2*time.Second)); !taken || left != 1 {
+		t.Errorf("Expected the bucket to have refilled, got %v with %d left", taken, left)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmFixedWindow, AlgorithmSlidingWindow, AlgorithmSlidingLog, AlgorithmTokenBucket} {
+		t.Run(algorithm, func(t *testing.T) {
+			rl, _ := newTestLimiter(t, Config{RequestsPerMinute: 3, BlockDuration: time.Hour, Algorithm: algorithm})
+			ctx := context.Background()
+
+			quota, err := rl.Quota(ctx, "10.0.0.1", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quota.Limit != 3 || quota.Remaining != 3 || quota.Reset != 0 {
+				t.Fatalf("Expected the whole budget for a new client, got %+v", quota)
+			}
+
+			rl.IsAllowed(ctx, "10.0.0.1")
+			for i := 0; i < 3; i++ {
+				if quota, _ = rl.Quota(ctx, "10.0.0.1", 0); quota.Remaining != 2 || quota.Reset <= 0 {
+					t.Fatalf("Expected asking for the quota not to count, got %+v", quota)
+				}
+			}
+
+			for i := 0; i < 3; i++ {
+				rl.IsAllowed(ctx, "10.0.0.1")
+			}
+			quota, _ = rl.Quota(ctx, "10.0.0.1", 0)
+			if !quota.Blocked || quota.Remaining != 0 || quota.BlockRemaining <= 0 {
+				t.Errorf("Expected a blocked client without budget, got %+v", quota)
+			}
+		})
+	}
+}
+
+func TestBlockNetwork(t *testing.T) {
+	rl, _ := newTestLimiter(t, Config{RequestsPerMinute: 3, BlockDuration: time.Hour})
+	ctx := context.Background()
+
+	network := netip.MustParsePrefix("198.51.100.0/24")
+	if err := rl.BlockNetwork(ctx, network, time.Hour, ReasonManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.BlockNetwork(ctx, netip.MustParsePrefix("203.0.113.7/32"), time.Hour, ReasonManual); err != nil {
+		t.Fatal(err)
+	}
+	if block, ok := rl.BlockedNetwork(ctx, netip.MustParseAddr("198.51.100.42")); !ok || block.Prefix != network {
+		t.Fatalf("Expected the address to be in the blocked network, got %v %v", block, ok)
+	}
+	if _, ok := rl.BlockedNetwork(ctx, netip.MustParseAddr("198.51.101.1")); ok {
+		t.Fatal("Expected an address outside the network not to be blocked")
+	}
+	networks, err := rl.Networks(ctx)
+	if err != nil || len(networks) != 2 || networks[0].Prefix.Bits() != 32 {
+		t.Fatalf("Expected two networks, narrowest first, got %v (%v)", networks, err)
+	}
+
+	if err := rl.UnblockNetwork(ctx, network); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rl.BlockedNetwork(ctx, netip.MustParseAddr("198.51.100.42")); ok {
+		t.Error("Expected unblocking to apply right away")
+	}
+	if _, ok := rl.BlockedNetwork(ctx, netip.MustParseAddr("203.0.113.7")); !ok {
+		t.Error("Expected the other network to stay blocked")
+	}
+}
+
+// everyOther is a registered algorithm that lets every other request through
+// regardless of the limit.
+type everyOther struct {
+	store  Store
+	prefix string
+}
+
+func (e everyOther) Take(ctx context.Context, key string, n, limit int64, _ time.Time) (bool, int64, time.Duration, error) {
+	count, err := e.store.Increment(ctx, e.prefix+key, n, time.Minute)
+	return count%2 == 1, count, time.Minute, err
+}
+
+func (e everyOther) Peek(ctx context.Context, key string, _ int64, _ time.Time) (int64, time.Duration, error) {
+	count, err := e.store.Increment(ctx, e.prefix+key, 0, time.Minute)
+	return count, time.Minute, err
+}
+
+func (e everyOther) Reset(ctx context.Context, key string) error {
+	return e.store.Delete(ctx, e.prefix+key)
+}
+
+func TestRegisterAlgorithm(t *testing.T) {
+	RegisterAlgorithm("every_other", func(store Store, prefix string, _ Config) (Algorithm, error) {
+		return everyOther{store: store, prefix: prefix}, nil
+	})
+	t.Cleanup(func() { unregisterAlgorithm("every_other") })
+	if names := Algorithms(); !slices.Contains(names, "every_other") || !slices.Contains(names, AlgorithmTokenBucket) {
+		t.Fatalf("Expected the registered algorithm next to the built-in ones, got %v", names)
+	}
+	for _, name := range []string{"every_other", AlgorithmTokenBucket} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected registering %q again to panic", name)
+				}
+			}()
+			RegisterAlgorithm(name, nil)
+		}()
+	}
+
+	rl, mr := newTestLimiter(t, Config{RequestsPerMinute: 100, BlockDuration: time.Hour, Algorithm: "every_other"})
+	ctx := context.Background()
+	if got := rl.Algorithm(); got != "every_other" {
+		t.Fatalf("Expected the registered algorithm, got %q", got)
+	}
+	if allowed, err := rl.IsAllowed(ctx, "10.0.0.1"); err != nil || !allowed {
+		t.Fatalf("Expected the first request to be allowed, got %v (%v)", allowed, err)
+	}
+	if allowed, _ := rl.IsAllowed(ctx, "10.0.0.2"); !allowed {
+		t.Fatal("Expected another client's first request to be allowed")
+	}
+	if allowed, _ := rl.IsAllowed(ctx, "10.0.0.2"); allowed {
+		t.Fatal("Expected the registered algorithm to reject the second request")
+	}
+	if !mr.Exists("rate:every_other:10.0.0.1") {
+		t.Error("Expected the registered algorithm's keys under its own prefix")
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	// miniredis answers CLUSTER SLOTS as a cluster of one master.
+	mr := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	store := NewRedisStore(client)
+	rl := NewRateLimiter(store, Config{RequestsPerMinute: 2, BlockDuration: time.Hour}, logger)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		rl.IsAllowed(ctx, "10.0.0.1")
+	}
+	// The counter and the block marker of a client hash to the same slot.
+	if !mr.Exists("rate:{10.0.0.1}") || !mr.Exists("blocked:{10.0.0.1}") {
+		t.Fatalf("Expected hash-tagged keys, got %v", mr.Keys())
+	}
+	if blocked, err := rl.IsBlocked(ctx, "10.0.0.1"); err != nil || !blocked {
+		t.Fatalf("Expected the client to be blocked, got %v (%v)", blocked, err)
+	}
+
+	page, err := rl.ListBlocks(ctx, BlockFilter{}, "", 10)
+	if err != nil {
+		t.Fatalf("ListBlocks failed: %v", err)
+	}
+	if len(page.Blocks) != 1 || page.Blocks[0].Key != "10.0.0.1" || page.Cursor != "" {
+		t.Errorf("Expected the block listed under the untagged key, got %+v", page)
+	}
+
+	if err := rl.UnblockIP(ctx, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("blocked:{10.0.0.1}") {
+		t.Error("Expected unblocking to delete the hash-tagged block marker")
+	}
+}
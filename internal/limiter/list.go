@@ -0,0 +1,190 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrListUnsupported is returned by ListBlocks when the store cannot iterate
+// its keys.
+var ErrListUnsupported = errors.New("limiter: store does not support listing")
+
+// ErrInvalidCursor is returned by ListBlocks for cursors it did not issue.
+var ErrInvalidCursor = errors.New("limiter: invalid cursor")
+
+// Scanner is implemented by stores that can iterate their keys incrementally,
+// so that large block lists can be paged through without loading them.
+type Scanner interface {
+	// Scan returns a batch of about count keys matching the glob pattern
+	// together with their values, and the cursor of the next batch, which is
+	// 0 after the last one. Keys may be returned more than once.
+	Scan(ctx context.Context, cursor uint64, match string, count int64) (keys []ScannedKey, next uint64, err error)
+}
+
+// ScannedKey is a key returned by Scanner.
+type ScannedKey struct {
+	Key   string
+	Value string
+	TTL   time.Duration
+}
+
+// BlockFilter selects blocks in ListBlocks. The zero value matches every
+// block.
+type BlockFilter struct {
+	Reason string
+	// MinAge and MaxAge select blocks by how long ago they were decided.
+	// Blocks stored before block markers existed have no age and only match
+	// without age filters.
+	MinAge time.Duration
+	MaxAge time.Duration
+	// Prefix selects blocked IPs in a CIDR range when valid.
+	Prefix netip.Prefix
+	// Search selects client keys containing the string.
+	Search string
+}
+
+// BlockPage is one page of blocks. Cursor continues the listing and is empty
+// on the last page.
+type BlockPage struct {
+	Blocks []KeyState `json:"blocks"`
+	Cursor string     `json:"cursor,omitempty"`
+}
+
+const (
+	// scanBatch is the number of keys requested per SCAN call.
+	scanBatch = 500
+	// maxScannedPerPage bounds the keys examined for one page, so that a
+	// selective filter returns a short page with a cursor instead of walking
+	// the whole keyspace in one request.
+	maxScannedPerPage = 20000
+)
+
+// ListBlocks returns up to limit blocks matching filter, starting at cursor,
+// which is empty for the first page. Pages may be shorter than limit before
+// the last one. Blocks added or lifted during the listing may or may not be
+// returned, and a block may in rare cases be returned twice.
+func (r *RateLimiter) ListBlocks(ctx context.Context, filter BlockFilter, cursor string, limit int) (BlockPage, error) {
+	scanner, ok := r.store.(Scanner)
+	if !ok {
+		return BlockPage{}, ErrListUnsupported
+	}
+	position, skip, err := parseCursor(cursor)
+	if err != nil {
+		return BlockPage{}, err
+	}
+	match := "blocked:*"
+	if filter.Search != "" {
+		match = "blocked:*" + escapeGlob(filter.Search) + "*"
+	}
+
+	page := BlockPage{Blocks: []KeyState{}}
+	now := time.Now()
+	for scanned := 0; ; {
+		keys, next, err := scanner.Scan(ctx, position, match, scanBatch)
+		if err != nil {
+			return BlockPage{}, err
+		}
+		scanned += len(keys)
+
+		var matched []KeyState
+		for _, key := range keys {
+			if state, ok := filter.match(key, now); ok {
+				matched = append(matched, state)
+			}
+		}
+		matched = matched[min(skip, len(matched)):]
+		if room := limit - len(page.Blocks); len(matched) > room {
+			// Resume inside this batch on the next page.
+			page.Blocks = append(page.Blocks, matched[:room]...)
+			page.Cursor = formatCursor(position, skip+room)
+			return page, nil
+		}
+		page.Blocks = append(page.Blocks, matched...)
+		skip = 0
+
+		if next == 0 {
+			return page, nil
+		}
+		position = next
+		if len(page.Blocks) == limit || scanned >= maxScannedPerPage {
+			page.Cursor = formatCursor(position, 0)
+			return page, nil
+		}
+	}
+}
+
+func (f BlockFilter) match(key ScannedKey, now time.Time) (KeyState, bool) {
+	ip := strings.TrimPrefix(key.Key, "blocked:")
+	if f.Prefix.IsValid() {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !f.Prefix.Contains(addr.Unmap()) {
+			return KeyState{}, false
+		}
+	}
+	var marker blockMarker
+	json.Unmarshal([]byte(key.Value), &marker)
+	if f.Reason != "" && marker.Reason != f.Reason {
+		return KeyState{}, false
+	}
+	if f.MinAge > 0 || f.MaxAge > 0 {
+		if marker.At.IsZero() {
+			return KeyState{}, false
+		}
+		age := now.Sub(marker.At)
+		if age < f.MinAge || (f.MaxAge > 0 && age > f.MaxAge) {
+			return KeyState{}, false
+		}
+	}
+	return KeyState{
+		Key:            ip,
+		Blocked:        true,
+		BlockRemaining: key.TTL,
+		BlockReason:    marker.Reason,
+		BlockedBy:      marker.Instance,
+		BlockedAt:      marker.At,
+	}, true
+}
+
+// Cursors are "<scan cursor>.<matches to skip>". The skip count resumes a
+// page that ended inside a batch.
+func parseCursor(cursor string) (uint64, int, error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+	position, skip, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return 0, 0, ErrInvalidCursor
+	}
+	p, err := strconv.ParseUint(position, 10, 64)
+	if err != nil {
+		return 0, 0, ErrInvalidCursor
+	}
+	s, err := strconv.Atoi(skip)
+	if err != nil || s < 0 {
+		return 0, 0, ErrInvalidCursor
+	}
+	return p, s, nil
+}
+
+func formatCursor(position uint64, skip int) string {
+	return fmt.Sprintf("%d.%d", position, skip)
+}
+
+// escapeGlob escapes the characters SCAN MATCH patterns treat specially.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
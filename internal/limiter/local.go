@@ -0,0 +1,70 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// localIdle is how long an unused bucket is kept. A bucket holds a minute's
+// worth of tokens, so after a minute it is full and the same as a new one.
+const localIdle = time.Minute
+
+// localBuckets rate limits client keys in process memory while the store is
+// unavailable and the failure policy is FailLocal. Each bucket holds a
+// minute's worth of tokens and refills at the limit, which approximates the
+// fixed window without any shared state.
+type localBuckets struct {
+	mu        sync.Mutex
+	buckets   map[string]*localBucket
+	lastPrune time.Time
+}
+
+type localBucket struct {
+	limiter           *rate.Limiter
+	requestsPerMinute int64
+	used              time.Time
+}
+
+func newLocalBuckets() *localBuckets {
+	return &localBuckets{buckets: make(map[string]*localBucket)}
+}
+
+// take counts n requests of key against requestsPerMinute and reports whether
+// they are allowed.
+func (b *localBuckets) take(key string, n, requestsPerMinute int64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Sub(b.lastPrune) > localIdle {
+		b.prune(now)
+	}
+	bucket := b.buckets[key]
+	if bucket == nil || bucket.requestsPerMinute != requestsPerMinute {
+		limit := rate.Limit(float64(requestsPerMinute) / 60)
+		bucket = &localBucket{
+			limiter:           rate.NewLimiter(limit, int(requestsPerMinute)),
+			requestsPerMinute: requestsPerMinute,
+		}
+		b.buckets[key] = bucket
+	}
+	bucket.used = now
+	return bucket.limiter.AllowN(now, int(n))
+}
+
+// prune drops the buckets nobody used for a while.
+func (b *localBuckets) prune(now time.Time) {
+	for key, bucket := range b.buckets {
+		if now.Sub(bucket.used) > localIdle {
+			delete(b.buckets, key)
+		}
+	}
+	b.lastPrune = now
+}
+
+// reset drops all buckets, once the store is back and counts again.
+func (b *localBuckets) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.buckets)
+}
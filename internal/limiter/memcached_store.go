@@ -0,0 +1,231 @@
+package limiter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ErrCASContention is returned when a counter could not be updated because
+// concurrent writers kept winning the compare-and-swap race.
+var ErrCASContention = errors.New("memcached: too much contention updating counter")
+
+// defaultMaxCASRetries bounds how often Increment retries a lost CAS race.
+const defaultMaxCASRetries = 10
+
+// MemcachedStore is a Store backed by one or more Memcached servers.
+//
+// Counters are updated with a get/compare-and-swap loop rather than Memcached's
+// native incr command, because incr cannot create a missing key with an
+// expiration and would silently extend or drop the window. This gives weaker
+// guarantees than the Redis store: under heavy contention Increment may fail
+// with ErrCASContention, and Memcached is free to evict counters and block
+// markers under memory pressure, which lets a client start over with a fresh
+// window. Use Redis when limits have to be enforced strictly.
+type MemcachedStore struct {
+	client        *memcache.Client
+	maxCASRetries int
+}
+
+// MemcachedOptions configures the Memcached connection.
+type MemcachedOptions struct {
+	Servers      []string
+	Timeout      time.Duration
+	MaxIdleConns int
+}
+
+// NewMemcachedStore connects to the given Memcached servers and verifies that
+// they are reachable.
+func NewMemcachedStore(opts MemcachedOptions) (*MemcachedStore, error) {
+	if len(opts.Servers) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+
+	client := memcache.New(opts.Servers...)
+	client.Timeout = opts.Timeout
+	client.MaxIdleConns = opts.MaxIdleConns
+
+	if err := client.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &MemcachedStore{
+		client:        client,
+		maxCASRetries: defaultMaxCASRetries,
+	}, nil
+}
+
+// Increment increments the counter at key using compare-and-swap. The value
+// stored in Memcached carries the absolute window end so that updates never
+// extend the original window.
+func (s *MemcachedStore) Increment(ctx context.Context, key string, n int64, window time.Duration) (int64, error) {
+	mkey := memcacheKey(key)
+	for attempt := 0; attempt < s.maxCASRetries; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		item, err := s.client.Get(mkey)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			err = s.client.Add(&memcache.Item{
+				Key:        mkey,
+				Value:      encodeCounter(n, time.Now().Add(window)),
+				Expiration: expirationSeconds(window),
+			})
+			if errors.Is(err, memcache.ErrNotStored) {
+				// Another writer created the key first, retry as an update.
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		count, expiresAt, err := decodeCounter(item.Value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid counter at %q: %w", key, err)
+		}
+
+		remaining := time.Until(expiresAt)
+		if remaining <= 0 {
+			// The item outlived its window, start a new one.
+			count = 0
+			expiresAt = time.Now().Add(window)
+			remaining = window
+		}
+		count += n
+
+		item.Value = encodeCounter(count, expiresAt)
+		item.Expiration = expirationSeconds(remaining)
+		err = s.client.CompareAndSwap(item)
+		if errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return count, nil
+	}
+
+	return 0, ErrCASContention
+}
+
+func (s *MemcachedStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return s.client.Set(&memcache.Item{
+		Key:        memcacheKey(key),
+		Value:      []byte(value),
+		Expiration: expirationSeconds(ttl),
+	})
+}
+
+func (s *MemcachedStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.Get(memcacheKey(key))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *MemcachedStore) Delete(ctx context.Context, key string) error {
+	err := s.client.Delete(memcacheKey(key))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
+
+// Inspect reports the remaining window of counters. Memcached does not expose
+// expirations, so the TTL of other keys is unknown.
+func (s *MemcachedStore) Inspect(ctx context.Context, key string) (string, time.Duration, bool, error) {
+	item, err := s.client.Get(memcacheKey(key))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	if count, expiresAt, err := decodeCounter(item.Value); err == nil {
+		remaining := time.Until(expiresAt)
+		if remaining <= 0 {
+			return "", 0, false, nil
+		}
+		return strconv.FormatInt(count, 10), remaining, true, nil
+	}
+	return string(item.Value), 0, true, nil
+}
+
+func (s *MemcachedStore) Ping(ctx context.Context) error {
+	return s.client.Ping()
+}
+
+// Close is a no-op, the Memcached client closes idle connections on its own.
+func (s *MemcachedStore) Close() error {
+	return nil
+}
+
+// maxKeyLength is the longest key Memcached accepts.
+const maxKeyLength = 250
+
+// memcacheKey returns key as Memcached accepts it. Keys that are too long or
+// contain whitespace or control characters, such as keys built from header
+// values, are replaced by their SHA-256 hash.
+func memcacheKey(key string) string {
+	if len(key) > maxKeyLength || strings.ContainsFunc(key, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		sum := sha256.Sum256([]byte(key))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// encodeCounter serializes a counter value together with its window end.
+func encodeCounter(count int64, expiresAt time.Time) []byte {
+	return []byte(strconv.FormatInt(count, 10) + ":" + strconv.FormatInt(expiresAt.UnixNano(), 10))
+}
+
+// decodeCounter parses a value written by encodeCounter.
+func decodeCounter(value []byte) (int64, time.Time, error) {
+	countPart, expiresPart, ok := strings.Cut(string(value), ":")
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("missing window separator")
+	}
+	count, err := strconv.ParseInt(countPart, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	expiresAt, err := strconv.ParseInt(expiresPart, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return count, time.Unix(0, expiresAt), nil
+}
+
+// maxRelativeExpiration is the longest expiration Memcached interprets as
+// relative, larger values are treated as absolute Unix timestamps.
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// expirationSeconds converts a TTL to a Memcached expiration, rounding up so
+// that short TTLs never become "no expiration".
+func expirationSeconds(ttl time.Duration) int32 {
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	seconds := int32((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
@@ -0,0 +1,93 @@
+package limiter
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterCodecRoundTrip(t *testing.T) {
+	expiresAt := time.Unix(0, 1767225600123456789)
+	for _, count := range []int64{0, 1, 42, -3, 1 << 40} {
+		got, gotExpiresAt, err := decodeCounter(encodeCounter(count, expiresAt))
+		if err != nil {
+			t.Fatalf("Failed to decode counter %d: %v", count, err)
+		}
+		if got != count || !gotExpiresAt.Equal(expiresAt) {
+			t.Errorf("Expected %d until %v, got %d until %v", count, expiresAt, got, gotExpiresAt)
+		}
+	}
+}
+
+func TestDecodeCounterRejectsCorruptValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "Empty", value: ""},
+		{name: "Missing window", value: "12"},
+		{name: "Count not a number", value: "x:1767225600000000000"},
+		{name: "Window not a number", value: "12:soon"},
+		{name: "Empty window", value: "12:"},
+		{name: "Block marker", value: `{"reason":"manual","instance":"a"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if count, expiresAt, err := decodeCounter([]byte(tt.value)); err == nil {
+				t.Errorf("Expected %q to be rejected, got %d until %v", tt.value, count, expiresAt)
+			}
+		})
+	}
+}
+
+func TestExpirationSeconds(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want int32
+	}{
+		{ttl: 0, want: 1},
+		{ttl: 100 * time.Millisecond, want: 1},
+		{ttl: 1500 * time.Millisecond, want: 2},
+		{ttl: time.Hour, want: 3600},
+	}
+	for _, tt := range tests {
+		if got := expirationSeconds(tt.ttl); got != tt.want {
+			t.Errorf("TTL %v: expected %d, got %d", tt.ttl, tt.want, got)
+		}
+	}
+
+	// Longer TTLs are absolute timestamps.
+	ttl := 60 * 24 * time.Hour
+	if got := int64(expirationSeconds(ttl)); got < time.Now().Add(ttl).Unix()-1 {
+		t.Errorf("Expected an absolute expiration for %v, got %d", ttl, got)
+	}
+}
+
+func TestMemcacheKey(t *testing.T) {
+	if got := memcacheKey("ratelimit:10.0.0.1"); got != "ratelimit:10.0.0.1" {
+		t.Errorf("Expected a valid key to be kept, got %q", got)
+	}
+
+	keys := []string{
+		"ratelimit:api-key:with space",
+		"ratelimit:api-key:with\ttab",
+		"ratelimit:api-key:with\nnewline",
+		"ratelimit:" + strings.Repeat("x", 300),
+		"ratelimit:" + strings.Repeat("y", 300),
+	}
+	seen := make(map[string]string)
+	for _, key := range keys {
+		got := memcacheKey(key)
+		if len(got) > maxKeyLength || strings.ContainsFunc(got, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+			t.Errorf("Expected %q to be hashed to a valid key, got %q", key, got)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("Expected %q and %q to map to different keys, both got %q", key, other, got)
+		}
+		seen[got] = key
+		if memcacheKey(key) != got {
+			t.Errorf("Expected %q to always map to %q", key, got)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// networksKey holds the blocked networks of all instances as JSON.
+const networksKey = "blocked-networks"
+
+// networksRefresh is how long an instance uses the blocked networks it read
+// before reading them again, and so how long a change takes to apply
+// everywhere.
+const networksRefresh = 5 * time.Second
+
+// NetworkBlock blocks every address of a network, such as a range a
+// distributed attack comes from. Single addresses are networks of one.
+type NetworkBlock struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Reason string       `json:"reason"`
+	At     time.Time    `json:"at"`
+	Until  time.Time    `json:"until"`
+}
+
+// networkCache is the blocked networks an instance last read.
+type networkCache struct {
+	mu     sync.Mutex
+	blocks []NetworkBlock
+	read   time.Time
+}
+
+// BlockNetwork blocks every address in prefix for duration. Unlike Block it
+// applies to the client address whatever key clients are limited by. Network
+// blocks are not replicated to other regions.
+func (r *RateLimiter) BlockNetwork(ctx context.Context, prefix netip.Prefix, duration time.Duration, reason string) error {
+	blocks, err := r.readNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	prefix = prefix.Masked()
+	now := time.Now()
+	blocks = removeNetwork(blocks, prefix)
+	blocks = append(blocks, NetworkBlock{Prefix: prefix, Reason: reason, At: now.UTC(), Until: now.Add(duration).UTC()})
+	r.logger.WithField("network", prefix.String()).Info("Blocking network")
+	return r.writeNetworks(ctx, blocks)
+}
+
+// UnblockNetwork lifts the block on prefix. It is not an error if there is
+// none.
+func (r *RateLimiter) UnblockNetwork(ctx context.Context, prefix netip.Prefix) error {
+	blocks, err := r.readNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	r.logger.WithField("network", prefix.String()).Info("Unblocking network")
+	return r.writeNetworks(ctx, removeNetwork(blocks, prefix.Masked()))
+}
+
+// Networks returns the blocked networks, narrowest first.
+func (r *RateLimiter) Networks(ctx context.Context) ([]NetworkBlock, error) {
+	blocks, err := r.readNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Prefix.Bits() > blocks[j].Prefix.Bits() })
+	return blocks, nil
+}
+
+// BlockedNetwork returns the block covering ip, if any. The blocked networks
+// are read at most every networksRefresh, a failed read keeps the last ones.
+func (r *RateLimiter) BlockedNetwork(ctx context.Context, ip netip.Addr) (NetworkBlock, bool) {
+	c := &r.networks
+	c.mu.Lock()
+	if time.Since(c.read) > networksRefresh {
+		c.read = time.Now()
+		c.mu.Unlock()
+		blocks, err := r.readNetworks(ctx)
+		c.mu.Lock()
+		if err == nil {
+			c.blocks = blocks
+		} else if err != ErrInspectUnsupported {
+			r.logger.WithError(err).Warn("Error reading blocked networks")
+		}
+	}
+	blocks := c.blocks
+	c.mu.Unlock()
+
+	ip = ip.Unmap()
+	now := time.Now()
+	for _, block := range blocks {
+		if block.Prefix.Contains(ip) && now.Before(block.Until) {
+			return block, true
+		}
+	}
+	return NetworkBlock{}, false
+}
+
+// readNetworks returns the unexpired blocked networks.
+func (r *RateLimiter) readNetworks(ctx context.Context) ([]NetworkBlock, error) {
+	inspector, ok := r.store.(Inspector)
+	if !ok {
+		return nil, ErrInspectUnsupported
+	}
+	value, _, found, err := inspector.Inspect(ctx, networksKey)
+	if err != nil || !found {
+		return nil, err
+	}
+	var blocks []NetworkBlock
+	if err := json.Unmarshal([]byte(value), &blocks); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	live := blocks[:0]
+	for _, block := range blocks {
+		if now.Before(block.Until) {
+			live = append(live, block)
+		}
+	}
+	return live, nil
+}
+
+// writeNetworks stores blocks until the last of them expires. Concurrent
+// changes can overwrite each other, which is acceptable for changes made by
+// hand.
+func (r *RateLimiter) writeNetworks(ctx context.Context, blocks []NetworkBlock) error {
+	if len(blocks) == 0 {
+		err := r.store.Delete(ctx, networksKey)
+		r.invalidateNetworks()
+		return err
+	}
+	var last time.Time
+	for _, block := range blocks {
+		if block.Until.After(last) {
+			last = block.Until
+		}
+	}
+	value, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	err = r.store.Set(ctx, networksKey, string(value), time.Until(last))
+	r.invalidateNetworks()
+	return err
+}
+
+// invalidateNetworks makes the next check read the blocked networks, so that
+// changes apply on this instance right away.
+func (r *RateLimiter) invalidateNetworks() {
+	r.networks.mu.Lock()
+	r.networks.read = time.Time{}
+	r.networks.mu.Unlock()
+}
+
+func removeNetwork(blocks []NetworkBlock, prefix netip.Prefix) []NetworkBlock {
+	kept := blocks[:0]
+	for _, block := range blocks {
+		if block.Prefix != prefix {
+			kept = append(kept, block)
+		}
+	}
+	return kept
+}
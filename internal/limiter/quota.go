@@ -0,0 +1,53 @@
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// Quota is how much of its budget a client key has left.
+type Quota struct {
+	Limit     int
+	Remaining int
+	// Reset is how long until the whole budget is available again, at the
+	// latest.
+	Reset time.Duration
+
+	Blocked        bool
+	BlockRemaining time.Duration
+}
+
+// Quota reports the budget a client key has left against a limit of
+// requestsPerMinute, or the configured one when it is not positive, without
+// counting a request.
+func (r *RateLimiter) Quota(ctx context.Context, ip string, requestsPerMinute int) (Quota, error) {
+	if requestsPerMinute <= 0 {
+		requestsPerMinute = r.RequestsPerMinute()
+	}
+	if !r.Available() {
+		return Quota{}, ErrStoreUnavailable
+	}
+	used, reset, err := r.algorithm.peek(ctx, ip, int64(requestsPerMinute), time.Now())
+	if err != nil {
+		return Quota{}, err
+	}
+	quota := Quota{
+		Limit:     requestsPerMinute,
+		Remaining: max(requestsPerMinute-int(used), 0),
+		Reset:     reset,
+	}
+
+	if inspector, ok := r.store.(Inspector); ok {
+		_, ttl, found, err := inspector.Inspect(ctx, "blocked:"+ip)
+		if err != nil {
+			return Quota{}, err
+		}
+		quota.Blocked, quota.BlockRemaining = found, ttl
+	} else if quota.Blocked, err = r.store.Exists(ctx, "blocked:"+ip); err != nil {
+		return Quota{}, err
+	}
+	if quota.Blocked {
+		quota.Remaining = 0
+	}
+	return quota, nil
+}
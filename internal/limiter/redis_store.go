@@ -0,0 +1,302 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore is a Store backed by a single Redis server or a Redis Cluster.
+//
+// On a cluster, keys are hash-tagged by what follows their namespace, such as
+// the client key of rate:<key> and blocked:<key>, which are stored as
+// rate:{<key>} and blocked:{<key>}. The keys a script takes together then
+// hash to the same slot. Callers keep using the untagged keys.
+type RedisStore struct {
+	client  redis.UniversalClient
+	cluster *redis.ClusterClient
+}
+
+// NewRedisStore wraps an already connected Redis client in a Store. The
+// client is a *redis.Client, a Sentinel failover client or a
+// *redis.ClusterClient.
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	cluster, _ := client.(*redis.ClusterClient)
+	return &RedisStore{client: client, cluster: cluster}
+}
+
+// Client returns the underlying Redis client.
+func (s *RedisStore) Client() redis.UniversalClient {
+	return s.client
+}
+
+// key returns the key stored for key, hash-tagged on a cluster.
+func (s *RedisStore) key(key string) string {
+	if s.cluster == nil {
+		return key
+	}
+	namespace, rest, ok := strings.Cut(key, ":")
+	if !ok {
+		return "{" + key + "}"
+	}
+	return namespace + ":{" + rest + "}"
+}
+
+// untag returns the key a stored key was stored for.
+func (s *RedisStore) untag(key string) string {
+	if s.cluster == nil {
+		return key
+	}
+	namespace, rest, ok := strings.Cut(key, ":")
+	if !ok {
+		namespace, rest = "", key
+	} else {
+		namespace += ":"
+	}
+	if len(rest) < 2 || rest[0] != '{' || rest[len(rest)-1] != '}' {
+		return key
+	}
+	return namespace + rest[1:len(rest)-1]
+}
+
+// Increment increments the counter at key and refreshes its expiration in a
+// single pipeline round trip.
+func (s *RedisStore) Increment(ctx context.Context, key string, n int64, window time.Duration) (int64, error) {
+	key = s.key(key)
+	pipe := s.client.Pipeline()
+
+	// Increment the counter
+	incr := pipe.IncrBy(ctx, key, n)
+
+	// Set expiration if the key is new
+	pipe.Expire(ctx, key, window)
+
+	// Execute pipeline
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	return incr.Val(), nil
+}
+
+// logScript adds entries to a sorted set log scored by their time in
+// microseconds and trims it to the window in one step, so that concurrent
+// requests of a client on different instances are all counted. Entries get a
+// random id, because requests in the same microsecond must not collapse into
+// one member.
+var logScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+for i = 1, n do
+  redis.call('ZADD', KEYS[1], now, ARGV[4] .. ':' .. i)
+end
+redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+return redis.call('ZCARD', KEYS[1])
+`)
+
+// AddToLog implements WindowLog with a sorted set per key.
+func (s *RedisStore) AddToLog(ctx context.Context, key string, n int64, now time.Time, window time.Duration) (int64, error) {
+	var id [8]byte
+	rand.Read(id[:])
+	return logScript.Run(ctx, s.client, []string{s.key(key)},
+		now.UnixMicro(), window.Microseconds(), n, hex.EncodeToString(id[:])).Int64()
+}
+
+// bucketScript refills a token bucket for the time since it was last used
+// and takes tokens from it in one step. Buckets expire once they would be
+// full again, a missing bucket is full.
+var bucketScript = redis.NewScript(`
+local n = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local rate = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or capacity
+local ts = tonumber(b[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local taken = 0
+if tokens >= n then
+  tokens = tokens - n
+  taken = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate) + 1000)
+return {taken, math.floor(tokens)}
+`)
+
+// TakeTokens implements TokenBuckets with a hash per key.
+func (s *RedisStore) TakeTokens(ctx context.Context, key string, n int64, capacity int64, perSecond float64, now time.Time) (bool, int64, error) {
+	res, err := bucketScript.Run(ctx, s.client, []string{s.key(key)},
+		n, capacity, perSecond/1000, now.UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, res[1], nil
+}
+
+// windowScript takes a fixed window decision in one step. Blocked keys are
+// not counted, the counter only gets its expiration when it is created so
+// that requests do not extend the window, and the key is blocked by the
+// request that goes over the limit. It returns the count, whether the request
+// blocked the key, whether the key was blocked already, and the milliseconds
+// left of the window or of the block the key was in.
+var windowScript = redis.NewScript(`
+local blocked = redis.call('PTTL', KEYS[2])
+if blocked ~= -2 then
+  return {0, 0, 1, math.max(blocked, 0)}
+end
+local count = redis.call('INCRBY', KEYS[1], ARGV[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[3])
+  ttl = tonumber(ARGV[3])
+end
+if count <= tonumber(ARGV[2]) then
+  return {count, 0, 0, ttl}
+end
+if tonumber(ARGV[4]) > 0 then
+  redis.call('SET', KEYS[2], ARGV[5], 'PX', ARGV[4])
+else
+  redis.call('SET', KEYS[2], ARGV[5])
+end
+return {count, 1, 0, ttl}
+`)
+
+// TakeWindow implements AtomicWindow.
+func (s *RedisStore) TakeWindow(ctx context.Context, counterKey, blockKey string, n, limit int64, window, block time.Duration, blockValue string) (WindowDecision, error) {
+	res, err := windowScript.Run(ctx, s.client, []string{s.key(counterKey), s.key(blockKey)},
+		n, limit, window.Milliseconds(), block.Milliseconds(), blockValue).Int64Slice()
+	if err != nil {
+		return WindowDecision{}, err
+	}
+	return WindowDecision{Count: res[0], Blocked: res[1] == 1, WasBlocked: res[2] == 1, TTL: time.Duration(res[3]) * time.Millisecond}, nil
+}
+
+// LoadScripts implements ScriptLoader. Scripts that are missing later on,
+// such as after a failover, are sent again on their next use.
+func (s *RedisStore) LoadScripts(ctx context.Context) error {
+	for _, script := range []*redis.Script{logScript, bucketScript, windowScript} {
+		if err := script.Load(ctx, s.client).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.key(key), value, ttl).Err()
+}
+
+func (s *RedisStore) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := s.client.Exists(ctx, s.key(key)).Result()
+	if err != nil {
+		return false, err
+	}
+	return exists == 1, nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.key(key)).Err()
+}
+
+func (s *RedisStore) Inspect(ctx context.Context, key string) (string, time.Duration, bool, error) {
+	key = s.key(key)
+	pipe := s.client.Pipeline()
+	get := pipe.Get(ctx, key)
+	ttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return "", 0, false, err
+	}
+	if get.Err() == redis.Nil {
+		return "", 0, false, nil
+	}
+	return get.Val(), max(ttl.Val(), 0), true, nil
+}
+
+func (s *RedisStore) Scan(ctx context.Context, cursor uint64, match string, count int64) ([]ScannedKey, uint64, error) {
+	if s.cluster != nil {
+		return s.scanCluster(ctx, cursor, match, count)
+	}
+	return s.scan(ctx, s.client, cursor, match, count)
+}
+
+// clusterCursorShift splits cluster cursors into the index of the master in
+// the high bits and the cursor of its SCAN in the low bits.
+const clusterCursorShift = 48
+
+// scanCluster scans the masters of the cluster one after the other, ordered
+// by address.
+func (s *RedisStore) scanCluster(ctx context.Context, cursor uint64, match string, count int64) ([]ScannedKey, uint64, error) {
+	var (
+		mu      sync.Mutex
+		masters []*redis.Client
+	)
+	err := s.cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		mu.Lock()
+		masters = append(masters, master)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].Options().Addr < masters[j].Options().Addr })
+
+	index := int(cursor >> clusterCursorShift)
+	if index >= len(masters) {
+		return nil, 0, nil
+	}
+	keys, next, err := s.scan(ctx, masters[index], cursor&(1<<clusterCursorShift-1), s.key(match), count)
+	if err != nil {
+		return nil, 0, err
+	}
+	if next == 0 {
+		if index++; index == len(masters) {
+			return keys, 0, nil
+		}
+	}
+	return keys, uint64(index)<<clusterCursorShift | next, nil
+}
+
+// scan scans the keys of one server.
+func (s *RedisStore) scan(ctx context.Context, client redis.Cmdable, cursor uint64, match string, count int64) ([]ScannedKey, uint64, error) {
+	keys, next, err := client.Scan(ctx, cursor, match, count).Result()
+	if err != nil || len(keys) == 0 {
+		return nil, next, err
+	}
+	pipe := client.Pipeline()
+	gets := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		gets[i] = pipe.Get(ctx, key)
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+	scanned := make([]ScannedKey, 0, len(keys))
+	for i, key := range keys {
+		// Keys that expired since the scan are skipped.
+		if gets[i].Err() == redis.Nil {
+			continue
+		}
+		scanned = append(scanned, ScannedKey{Key: s.untag(key), Value: gets[i].Val(), TTL: max(ttls[i].Val(), 0)})
+	}
+	return scanned, next, nil
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
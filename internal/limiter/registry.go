@@ -0,0 +1,101 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Algorithm is a rate limiting algorithm added with RegisterAlgorithm. It
+// counts the requests of client keys against a limit of requests per minute.
+type Algorithm interface {
+	// Take counts n requests of key at now against limit. It returns whether
+	// they are within it, how much of the limit is used up and how long until
+	// all of it is available again at the latest.
+	Take(ctx context.Context, key string, n, limit int64, now time.Time) (bool, int64, time.Duration, error)
+	// Peek returns how much of limit is used up without counting a request,
+	// and how long until all of it is available again at the latest.
+	Peek(ctx context.Context, key string, limit int64, now time.Time) (int64, time.Duration, error)
+	// Reset forgets the requests counted for key.
+	Reset(ctx context.Context, key string) error
+}
+
+// AlgorithmFactory creates an algorithm that keeps its state in store, with
+// its keys under prefix. An error, such as a store that lacks what the
+// algorithm needs, makes the rate limiter fall back to the fixed window.
+type AlgorithmFactory func(store Store, prefix string, config Config) (Algorithm, error)
+
+var builtinAlgorithms = []string{AlgorithmFixedWindow, AlgorithmSlidingWindow, AlgorithmSlidingLog, AlgorithmTokenBucket}
+
+var (
+	algorithmsMu sync.RWMutex
+	algorithms   = make(map[string]AlgorithmFactory)
+)
+
+// RegisterAlgorithm makes an algorithm available under name, so that it can
+// be selected as Config.Algorithm or Config.ShadowAlgorithm. It is meant to
+// be called from an init function, and panics if name is taken.
+func RegisterAlgorithm(name string, factory AlgorithmFactory) {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+	if _, exists := algorithms[name]; exists || name == "" || isBuiltinAlgorithm(name) {
+		panic(fmt.Sprintf("limiter: algorithm %q registered twice", name))
+	}
+	algorithms[name] = factory
+}
+
+// Algorithms returns the names of the built-in and registered algorithms,
+// sorted.
+func Algorithms() []string {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+	names := append([]string(nil), builtinAlgorithms...)
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isBuiltinAlgorithm(name string) bool {
+	for _, builtin := range builtinAlgorithms {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// newRegisteredAlgorithm creates the registered algorithm called name.
+func newRegisteredAlgorithm(name string, store Store, prefix string, config Config) (algorithm, error) {
+	algorithmsMu.RLock()
+	factory, ok := algorithms[name]
+	algorithmsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown rate limiting algorithm %q", name)
+	}
+	a, err := factory(store, prefix+name+":", config)
+	if err != nil {
+		return nil, err
+	}
+	return registered{a}, nil
+}
+
+// registered adapts a registered algorithm to the internal interface.
+type registered struct {
+	Algorithm
+}
+
+func (r registered) take(ctx context.Context, ip string, n, limit int64, now time.Time) (bool, int64, time.Duration, error) {
+	return r.Take(ctx, ip, n, limit, now)
+}
+
+func (r registered) peek(ctx context.Context, ip string, limit int64, now time.Time) (int64, time.Duration, error) {
+	return r.Peek(ctx, ip, limit, now)
+}
+
+func (r registered) reset(ctx context.Context, ip string) error {
+	return r.Reset(ctx, ip)
+}
@@ -0,0 +1,65 @@
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AlgorithmSlidingWindow approximates a sliding one-minute window by adding
+// the part of the previous fixed window that still overlaps it to the count
+// of the current one. It avoids the bursts fixed windows allow at their
+// edges.
+const AlgorithmSlidingWindow = "sliding_window"
+
+// Results of comparing the enforcing algorithm with the shadow algorithm.
+const (
+	ShadowAgree = "agree"
+	// ShadowStricter means the shadow algorithm would have rejected a request
+	// the enforcing algorithm allowed.
+	ShadowStricter = "shadow_stricter"
+	// ShadowLooser means the shadow algorithm would have allowed a request
+	// the enforcing algorithm rejected.
+	ShadowLooser = "shadow_looser"
+)
+
+// ShadowRecorder receives the outcome of every comparison between the
+// enforcing and the shadow algorithm.
+type ShadowRecorder interface {
+	IncLimiterShadowDecision(enforcing, shadow, result string)
+}
+
+// shadow evaluates the shadow algorithm for a request the enforcing
+// algorithm decided on and records whether the two agree. Clients blocked by
+// the enforcing algorithm are rejected before they reach the limiter, so
+// while a block lasts the shadow algorithm sees none of their requests.
+func (r *RateLimiter) shadow(ctx context.Context, ip string, n int, limit int, allowed bool) {
+	if r.shadowAlgorithm == nil {
+		return
+	}
+	shadowAllowed, count, _, err := r.shadowAlgorithm.take(ctx, ip, int64(n), int64(limit), time.Now())
+	if err != nil {
+		r.logger.WithError(err).Debug("Error evaluating shadow algorithm")
+		return
+	}
+
+	result := ShadowAgree
+	switch {
+	case allowed && !shadowAllowed:
+		result = ShadowStricter
+	case !allowed && shadowAllowed:
+		result = ShadowLooser
+	}
+	if result != ShadowAgree {
+		r.logger.WithFields(logrus.Fields{
+			"ip":     ip,
+			"count":  count,
+			"limit":  limit,
+			"result": result,
+		}).Debug("Shadow algorithm disagrees")
+	}
+	if r.config.ShadowRecorder != nil {
+		r.config.ShadowRecorder.IncLimiterShadowDecision(r.Algorithm(), r.config.ShadowAlgorithm, result)
+	}
+}
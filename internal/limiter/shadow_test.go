@@ -0,0 +1,53 @@
+package limiter
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type shadowRecorder struct {
+	results map[string]int
+}
+
+func (r *shadowRecorder) IncLimiterShadowDecision(enforcing, shadow, result string) {
+	r.results[enforcing+"/"+shadow+"/"+result]++
+}
+
+func TestShadowAlgorithm(t *testing.T) {
+	rec := &shadowRecorder{results: make(map[string]int)}
+	rl, mr := newTestLimiter(t, Config{
+		RequestsPerMinute: 3,
+		BlockDuration:     time.Hour,
+		ShadowAlgorithm:   AlgorithmSlidingWindow,
+		ShadowRecorder:    rec,
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		rl.IsAllowed(ctx, "10.0.0.1")
+	}
+	if got := rec.results["fixed_window/sliding_window/agree"]; got != 4 {
+		t.Fatalf("Expected 4 agreeing decisions, got %v", rec.results)
+	}
+
+	// A busy previous window makes the sliding window reject a request the
+	// fixed window allows.
+	previous := time.Now().Truncate(time.Minute).Add(-time.Minute).Unix()
+	mr.Set("shadow:sliding_window:10.0.0.2:"+strconv.FormatInt(previous, 10), "1000000000")
+	if allowed, err := rl.IsAllowed(ctx, "10.0.0.2"); err != nil || !allowed {
+		t.Fatalf("Expected the shadow algorithm not to affect the decision, got %v (%v)", allowed, err)
+	}
+	if got := rec.results["fixed_window/sliding_window/shadow_stricter"]; got != 1 {
+		t.Errorf("Expected a stricter shadow decision, got %v", rec.results)
+	}
+
+	mr.Set("rate:10.0.0.3", "10")
+	if allowed, _ := rl.IsAllowed(ctx, "10.0.0.3"); allowed {
+		t.Fatal("Expected the enforcing algorithm to reject the request")
+	}
+	if got := rec.results["fixed_window/sliding_window/shadow_looser"]; got != 1 {
+		t.Errorf("Expected a looser shadow decision, got %v", rec.results)
+	}
+}
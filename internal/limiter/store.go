@@ -0,0 +1,37 @@
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the backend the rate limiter keeps its counters and block markers in.
+// Implementations must be safe for concurrent use by multiple goroutines.
+type Store interface {
+	// Increment adds n to the counter stored at key and returns the new value.
+	// When the key does not exist yet it is created with a lifetime of window.
+	Increment(ctx context.Context, key string, n int64, window time.Duration) (int64, error)
+
+	// Set stores value at key for the given TTL.
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+
+	// Exists reports whether key is currently present in the store.
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// Delete removes key from the store. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// Inspector is implemented by stores that can report the value and remaining
+// lifetime of a key, which diagnostics use to explain decisions.
+type Inspector interface {
+	// Inspect returns the value at key and how long it lives on. The TTL is
+	// zero when the key has no expiration or the store cannot tell.
+	Inspect(ctx context.Context, key string) (value string, ttl time.Duration, found bool, err error)
+}
@@ -0,0 +1,272 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// CacheRecorder receives hit and miss counts from stores with a local cache.
+type CacheRecorder interface {
+	IncStoreCacheLookup(result string)
+}
+
+// TieredOptions configures the local cache in front of Redis.
+type TieredOptions struct {
+	// Channel is the Redis pub/sub channel invalidations are broadcast on.
+	Channel string
+	// NegativeTTL is how long a "key does not exist" answer is cached. It bounds
+	// staleness should an invalidation message ever be lost.
+	NegativeTTL time.Duration
+	// MaxEntries bounds the number of locally cached keys.
+	MaxEntries int
+
+	Recorder CacheRecorder
+}
+
+// TieredStore caches Exists lookups in process memory in front of a RedisStore,
+// and answers Inspect for keys it knows to be absent.
+// Every Set and Delete is broadcast over Redis pub/sub so that all instances
+// update their caches within milliseconds, which lets the cache answer the
+// per-request block checks without a Redis round trip. Counters always go
+// straight to Redis, since they have to be exact across the fleet.
+type TieredStore struct {
+	*RedisStore
+
+	opts   TieredOptions
+	origin string
+	pubsub *redis.PubSub
+	logger *logrus.Logger
+	// confirming is set while the confirmation of the subscription made
+	// by NewTieredStore is pending, which needs no flush, see listen.
+	confirming bool
+
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	exists    bool
+	expiresAt time.Time
+}
+
+// invalidation is the message broadcast to other instances.
+type invalidation struct {
+	Origin string `json:"origin"`
+	Op     string `json:"op"`
+	Key    string `json:"key"`
+	TTL    int64  `json:"ttlMs,omitempty"`
+}
+
+// NewTieredStore wraps store with a local cache and starts listening for
+// invalidations from other instances. The listener stops when Close is called.
+func NewTieredStore(store *RedisStore, opts TieredOptions, logger *logrus.Logger) *TieredStore {
+	if opts.Channel == "" {
+		opts.Channel = "shielder:invalidations"
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = 5 * time.Second
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 100000
+	}
+
+	s := &TieredStore{
+		RedisStore: store,
+		opts:       opts,
+		origin:     randomID(),
+		pubsub:     store.Client().Subscribe(context.Background()),
+		logger:     logger,
+		entries:    make(map[string]cacheEntry),
+	}
+	// Invalidations are delivered from the moment the subscription is made,
+	// before anything is cached.
+	s.confirming = s.pubsub.Subscribe(context.Background(), opts.Channel) == nil
+	go s.listen()
+	return s
+}
+
+// Exists answers from the local cache when possible and falls back to Redis.
+func (s *TieredStore) Exists(ctx context.Context, key string) (bool, error) {
+	s.mu.RLock()
+	entry, ok := s.entries[key]
+	s.mu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		s.record("hit")
+		return entry.exists, nil
+	}
+	s.record("miss")
+
+	ttl, err := s.client.PTTL(ctx, s.key(key)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	// PTTL returns -2 for missing keys and -1 for keys without expiration.
+	switch {
+	case ttl == -2:
+		s.put(key, false, s.opts.NegativeTTL)
+		return false, nil
+	case ttl < 0:
+		s.put(key, true, s.opts.NegativeTTL)
+		return true, nil
+	default:
+		s.put(key, true, ttl)
+		return true, nil
+	}
+}
+
+// Inspect answers keys the local cache knows to be absent without a Redis
+// round trip and reads all others from Redis, since the cache keeps no values.
+func (s *TieredStore) Inspect(ctx context.Context, key string) (string, time.Duration, bool, error) {
+	s.mu.RLock()
+	entry, ok := s.entries[key]
+	s.mu.RUnlock()
+	if ok && !entry.exists && time.Now().Before(entry.expiresAt) {
+		return "", 0, false, nil
+	}
+	return s.RedisStore.Inspect(ctx, key)
+}
+
+// Set writes to Redis, updates the local cache and notifies other instances.
+func (s *TieredStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if err := s.RedisStore.Set(ctx, key, value, ttl); err != nil {
+		return err
+	}
+	s.put(key, true, ttl)
+	s.publish(ctx, invalidation{Op: "set", Key: key, TTL: ttl.Milliseconds()})
+	return nil
+}
+
+// TakeWindow takes the decision in Redis and, when it blocks the key, updates
+// the local cache and notifies other instances like Set.
+func (s *TieredStore) TakeWindow(ctx context.Context, counterKey, blockKey string, n, limit int64, window, block time.Duration, blockValue string) (WindowDecision, error) {
+	decision, err := s.RedisStore.TakeWindow(ctx, counterKey, blockKey, n, limit, window, block, blockValue)
+	if err != nil || !decision.Blocked {
+		return decision, err
+	}
+	s.put(blockKey, true, block)
+	s.publish(ctx, invalidation{Op: "set", Key: blockKey, TTL: block.Milliseconds()})
+	return decision, nil
+}
+
+// Delete removes the key from Redis and the local cache and notifies other instances.
+func (s *TieredStore) Delete(ctx context.Context, key string) error {
+	if err := s.RedisStore.Delete(ctx, key); err != nil {
+		return err
+	}
+	s.put(key, false, s.opts.NegativeTTL)
+	s.publish(ctx, invalidation{Op: "del", Key: key})
+	return nil
+}
+
+// Close stops listening for invalidations and closes the Redis client.
+func (s *TieredStore) Close() error {
+	s.pubsub.Close()
+	return s.RedisStore.Close()
+}
+
+func (s *TieredStore) publish(ctx context.Context, msg invalidation) {
+	msg.Origin = s.origin
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err := s.client.Publish(ctx, s.opts.Channel, payload).Err(); err != nil {
+		// Other instances converge once their negative TTL runs out.
+		s.logger.WithError(err).Warn("Error publishing cache invalidation")
+	}
+}
+
+// listen applies invalidations published by other instances. Whenever the
+// subscription is re-established the cache is flushed, because messages sent
+// while disconnected are lost.
+func (s *TieredStore) listen() {
+	for {
+		msg, err := s.pubsub.Receive(context.Background())
+		if err != nil {
+			if err == redis.ErrClosed {
+				return
+			}
+			s.flush()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if s.confirming {
+				s.confirming = false
+				continue
+			}
+			s.flush()
+		case *redis.Message:
+			var inv invalidation
+			if err := json.Unmarshal([]byte(m.Payload), &inv); err != nil {
+				s.logger.WithError(err).Warn("Ignoring malformed cache invalidation")
+				continue
+			}
+			if inv.Origin == s.origin {
+				continue
+			}
+			switch inv.Op {
+			case "set":
+				s.put(inv.Key, true, time.Duration(inv.TTL)*time.Millisecond)
+			case "del":
+				s.put(inv.Key, false, s.opts.NegativeTTL)
+			}
+		}
+	}
+}
+
+func (s *TieredStore) put(key string, exists bool, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) >= s.opts.MaxEntries {
+		s.evictLocked()
+	}
+	s.entries[key] = cacheEntry{exists: exists, expiresAt: time.Now().Add(ttl)}
+}
+
+// evictLocked drops expired entries and, if the cache is still full, an
+// arbitrary tenth of it. Callers must hold the write lock.
+func (s *TieredStore) evictLocked() {
+	now := time.Now()
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	for key := range s.entries {
+		if len(s.entries) < s.opts.MaxEntries*9/10 {
+			break
+		}
+		delete(s.entries, key)
+	}
+}
+
+func (s *TieredStore) flush() {
+	s.mu.Lock()
+	s.entries = make(map[string]cacheEntry)
+	s.mu.Unlock()
+}
+
+func (s *TieredStore) record(result string) {
+	if s.opts.Recorder != nil {
+		s.opts.Recorder.IncStoreCacheLookup(result)
+	}
+}
+
+// randomID returns a random identifier used to recognize our own broadcasts.
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
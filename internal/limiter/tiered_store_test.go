@@ -0,0 +1,95 @@
+package limiter
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestTieredStore(t *testing.T, addr string) *TieredStore {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	store := NewTieredStore(NewRedisStore(client), TieredOptions{NegativeTTL: time.Minute}, logger)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestTieredStoreServesFromCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := newTestTieredStore(t, mr.Addr())
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "blocked:10.0.0.1", "1", time.Hour); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+
+	// Remove the key behind the store's back, the cached answer must still be used.
+	mr.Del("blocked:10.0.0.1")
+	exists, err := store.Exists(ctx, "blocked:10.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to check key: %v", err)
+	}
+	if !exists {
+		t.Error("Expected cached key to exist")
+	}
+}
+
+func TestTieredStoreInvalidatesOtherInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	first := newTestTieredStore(t, mr.Addr())
+	second := newTestTieredStore(t, mr.Addr())
+	ctx := context.Background()
+
+	// Prime the second instance with a negative answer.
+	if exists, _ := second.Exists(ctx, "blocked:10.0.0.1"); exists {
+		t.Fatal("Expected key to be absent")
+	}
+
+	if err := first.Set(ctx, "blocked:10.0.0.1", "1", time.Hour); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if exists, _ := second.Exists(ctx, "blocked:10.0.0.1"); exists {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected invalidation to reach the second instance")
+}
+
+func TestTieredStoreInspect(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := newTestTieredStore(t, mr.Addr())
+	ctx := context.Background()
+
+	// A key cached as absent is answered locally.
+	if exists, _ := store.Exists(ctx, "blocked:10.0.0.1"); exists {
+		t.Fatal("Expected key to be absent")
+	}
+	mr.Set("blocked:10.0.0.1", "1")
+	if _, _, found, err := store.Inspect(ctx, "blocked:10.0.0.1"); err != nil || found {
+		t.Errorf("Expected the cached absence to be reported, got found=%v err=%v", found, err)
+	}
+
+	// Values only live in Redis.
+	if err := store.Set(ctx, "blocked:10.0.0.2", `{"reason":"manual"}`, time.Hour); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+	value, ttl, found, err := store.Inspect(ctx, "blocked:10.0.0.2")
+	if err != nil || !found || value != `{"reason":"manual"}` || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Expected the value and TTL from Redis, got %q %v found=%v err=%v", value, ttl, found, err)
+	}
+	mr.Del("blocked:10.0.0.2")
+	if _, _, found, _ := store.Inspect(ctx, "blocked:10.0.0.2"); found {
+		t.Error("Expected a key deleted in Redis to be reported absent")
+	}
+}
@@ -0,0 +1,441 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DashboardOptions describes what a configuration exports, so that the
+// generated dashboard and alerts only cover metrics that will exist.
+type DashboardOptions struct {
+	// Routes are the names of the configured routes. The default route is
+	// always included unless AggregateRoutes is set.
+	Routes []string
+	// AggregateRoutes is set when only Routes are reported as their own
+	// series and every other route as OtherRoute.
+	AggregateRoutes bool
+	// StoreBackend is the limiter store, such as redis or dynamodb.
+	StoreBackend string
+	LocalCache   bool
+	TLS          bool
+
+	Authz        bool
+	Auth         bool
+	Replication  bool
+	Anomaly      bool
+	Fingerprints bool
+	Greylist     bool
+	Trusted      bool
+	GeoIP        bool
+	Shadow       bool
+	Feedback     bool
+	WAFSync      bool
+	DecisionLog  bool
+	Idempotency  bool
+	Expensive    bool
+	Accounting   bool
+	GeoBlocking  bool
+	Bypass       bool
+	HealthChecks bool
+	Review       bool
+	// ConditionalCache is set when HEAD requests and conditional GETs are
+	// answered from cached headers.
+	ConditionalCache bool
+	CircuitBreaker   bool
+}
+
+// defaultRoute is the route label of requests matching no configured route.
+const defaultRoute = "default"
+
+func (o DashboardOptions) routes() []string {
+	routes := slices.Clone(o.Routes)
+	if o.AggregateRoutes {
+		return append(routes, OtherRoute)
+	}
+	if !slices.Contains(routes, defaultRoute) {
+		routes = append(routes, defaultRoute)
+	}
+	return routes
+}
+
+type grafanaDashboard struct {
+	UID           string            `json:"uid"`
+	Title         string            `json:"title"`
+	Tags          []string          `json:"tags"`
+	Timezone      string            `json:"timezone"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          grafanaTimeRange  `json:"time"`
+	Templating    grafanaTemplating `json:"templating"`
+	Panels        []grafanaPanel    `json:"panels"`
+}
+
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name       string          `json:"name"`
+	Label      string          `json:"label"`
+	Type       string          `json:"type"`
+	Query      string          `json:"query"`
+	IncludeAll bool            `json:"includeAll,omitempty"`
+	Multi      bool            `json:"multi,omitempty"`
+	AllValue   string          `json:"allValue,omitempty"`
+	Current    map[string]any  `json:"current,omitempty"`
+	Options    []grafanaOption `json:"options,omitempty"`
+}
+
+type grafanaOption struct {
+	Text     string `json:"text"`
+	Value    string `json:"value"`
+	Selected bool   `json:"selected"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Type        string             `json:"type"`
+	Title       string             `json:"title"`
+	Description string             `json:"description,omitempty"`
+	Datasource  *grafanaDatasource `json:"datasource,omitempty"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	Targets     []grafanaTarget    `json:"targets,omitempty"`
+	FieldConfig *grafanaFieldConf  `json:"fieldConfig,omitempty"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+}
+
+type grafanaFieldConf struct {
+	Defaults grafanaFieldDefaults `json:"defaults"`
+}
+
+type grafanaFieldDefaults struct {
+	Unit string `json:"unit,omitempty"`
+}
+
+// dashboardPanel is a graph of one or more queries.
+type dashboardPanel struct {
+	title  string
+	unit   string
+	kind   string
+	series []series
+}
+
+type series struct {
+	expr   string
+	legend string
+}
+
+type dashboardRow struct {
+	title  string
+	panels []dashboardPanel
+}
+
+// rate is the range selector of all rate queries.
+const rate = "[$__rate_interval]"
+
+// routeSelector restricts a query to the routes selected on the dashboard.
+const routeSelector = `route=~"$route"`
+
+func graph(title, unit string, s ...series) dashboardPanel {
+	return dashboardPanel{title: title, unit: unit, kind: "timeseries", series: s}
+}
+
+func stat(title, unit string, s ...series) dashboardPanel {
+	return dashboardPanel{title: title, unit: unit, kind: "stat", series: s}
+}
+
+func (o DashboardOptions) rows() []dashboardRow {
+	rows := []dashboardRow{
+		{title: "Traffic", panels: []dashboardPanel{
+			graph("Decisions", "reqps", series{`sum by (decision) (rate(shielder_limiter_decisions_total{` + routeSelector + `}` + rate + `))`, "{{decision}}"}),
+			graph("Rejections by route and reason", "reqps", series{`sum by (route, reason) (rate(shielder_limiter_decisions_total{decision="rejected", ` + routeSelector + `}` + rate + `))`, "{{route}} {{reason}}"}),
+			graph("Request duration", "s",
+				series{`histogram_quantile(0.5, sum by (le) (rate(shielder_request_duration_seconds_bucket` + rate + `)))`, "p50"},
+				series{`histogram_quantile(0.99, sum by (le) (rate(shielder_request_duration_seconds_bucket` + rate + `)))`, "p99"}),
+			graph("Limiter evaluation p99", "s", series{`histogram_quantile(0.99, sum by (le, algorithm) (rate(shielder_limiter_evaluation_seconds_bucket` + rate + `)))`, "{{algorithm}}"}),
+			graph("Check budget exceeded", "reqps", series{`sum by (route) (rate(shielder_check_budget_exceeded_total{` + routeSelector + `}` + rate + `))`, "{{route}}"}),
+			graph("Client connections", "short",
+				series{`sum(shielder_client_connections_open)`, "open"},
+				series{`sum by (reason) (rate(shielder_client_connections_rejected_total` + rate + `))`, "rejected {{reason}}"}),
+		}},
+	}
+
+	store := dashboardRow{title: "Limiter store", panels: []dashboardPanel{
+		stat("Instances with the store reachable", "short", series{`sum(shielder_store_up)`, ""}),
+	}}
+	if o.LocalCache {
+		store.panels = append(store.panels, graph("Local cache lookups", "ops", series{`sum by (result) (rate(shielder_store_cache_lookups_total` + rate + `))`, "{{result}}"}))
+	}
+	if o.StoreBackend == "dynamodb" {
+		store.panels = append(store.panels,
+			graph("Consumed capacity", "short", series{`sum by (operation) (rate(shielder_store_consumed_capacity_units_total` + rate + `))`, "{{operation}}"}),
+			graph("Throttled requests", "ops", series{`sum by (operation) (rate(shielder_store_throttled_requests_total` + rate + `))`, "{{operation}}"}))
+	}
+	upstream := dashboardRow{title: "Upstream", panels: []dashboardPanel{
+		graph("Upstream connections", "short", series{`sum(shielder_upstream_connections_open)`, "open"}),
+		graph("Rejected upstream dials", "ops", series{`sum by (reason) (rate(shielder_upstream_dial_rejected_total` + rate + `))`, "{{reason}}"}),
+		graph("Time to first byte p99", "s", series{`histogram_quantile(0.99, sum by (le, route) (rate(shielder_upstream_time_to_first_byte_seconds_bucket{` + routeSelector + `}` + rate + `)))`, "{{route}}"}),
+		graph("Transfer duration p99", "s", series{`histogram_quantile(0.99, sum by (le, route) (rate(shielder_upstream_transfer_duration_seconds_bucket{` + routeSelector + `}` + rate + `)))`, "{{route}}"}),
+		graph("Open streams", "short", series{`sum by (route, kind) (shielder_streams_open{` + routeSelector + `})`, "{{route}} {{kind}}"}),
+	}}
+	if o.CircuitBreaker {
+		upstream.panels = append(upstream.panels,
+			graph("Circuit breaker state", "short", series{`max by (route) (shielder_circuit_breaker_state{` + routeSelector + `})`, "{{route}}"}),
+			graph("Rejected by circuit breaker", "reqps", series{`sum by (route) (rate(shielder_circuit_breaker_rejected_total{` + routeSelector + `}` + rate + `))`, "{{route}}"}))
+	}
+	rows = append(rows, store, upstream)
+
+	var protection []dashboardPanel
+	if o.Fingerprints {
+		protection = append(protection, graph("Fingerprint penalties", "reqps", series{`sum by (route) (rate(shielder_fingerprint_penalties_total{` + routeSelector + `}` + rate + `))`, "{{route}}"}))
+	}
+	if o.Greylist {
+		protection = append(protection, graph("Greylisted requests", "reqps", series{`sum by (route) (rate(shielder_greylisted_requests_total{` + routeSelector + `}` + rate + `))`, "{{route}}"}))
+	}
+	if o.Anomaly {
+		protection = append(protection, graph("Traffic anomalies", "short", series{`sum by (route, kind) (increase(shielder_traffic_anomalies_total{` + routeSelector + `}[1h]))`, "{{route}} {{kind}}"}))
+	}
+	if o.Shadow {
+		protection = append(protection, graph("Shadow algorithm comparison", "reqps", series{`sum by (shadow, result) (rate(shielder_limiter_shadow_decisions_total` + rate + `))`, "{{shadow}} {{result}}"}))
+	}
+	if o.Feedback {
+		protection = append(protection, graph("False positives by rule", "short", series{`sum by (rule) (increase(shielder_false_positives_total[1h]))`, "{{rule}}"}))
+	}
+	if o.Trusted {
+		protection = append(protection, graph("Trusted requests", "reqps", series{`sum by (identity) (rate(shielder_trusted_requests_total` + rate + `))`, "{{identity}}"}))
+	}
+	if o.ConditionalCache {
+		protection = append(protection, graph("Conditional cache lookups", "reqps", series{`sum by (route, result) (rate(shielder_conditional_cache_requests_total{` + routeSelector + `}` + rate + `))`, "{{route}} {{result}}"}))
+	}
+	if o.Expensive {
+		protection = append(protection, graph("Expensive requests", "reqps", series{`sum by (route, kind) (rate(shielder_expensive_requests_total{` + routeSelector + `}` + rate + `))`, "{{route}} {{kind}}"}))
+	}
+	if o.Bypass {
+		protection = append(protection, graph("Bypassed requests", "reqps", series{`sum by (subject) (rate(shielder_bypassed_requests_total` + rate + `))`, "{{subject}}"}))
+	}
+	if o.Review {
+		protection = append(protection, graph("Review queue", "short",
+			series{`sum by (route) (increase(shielder_review_suspensions_total{` + routeSelector + `}[1h]))`, "suspended {{route}}"},
+			series{`sum by (verdict) (increase(shielder_review_verdicts_total[1h]))`, "{{verdict}}"},
+		))
+	}
+	if o.GeoBlocking {
+		protection = append(protection, graph("Geo-blocked requests", "reqps", series{`sum by (country) (rate(shielder_geo_blocked_requests_total` + rate + `))`, "{{country}}"}))
+	}
+	if o.TLS {
+		protection = append(protection, graph("TLS handshakes", "ops", series{`sum by (result) (rate(shielder_tls_handshakes_total` + rate + `))`, "{{result}}"}))
+	}
+	if len(protection) > 0 {
+		rows = append(rows, dashboardRow{title: "Protection", panels: protection})
+	}
+
+	var integrations []dashboardPanel
+	if o.Auth {
+		integrations = append(integrations, graph("Credential checks", "ops", series{`sum by (method, source, result) (rate(shielder_auth_checks_total` + rate + `))`, "{{method}} {{source}} {{result}}"}))
+	}
+	if o.Authz {
+		integrations = append(integrations, graph("Authorization checks", "ops", series{`sum by (result, source) (rate(shielder_authz_checks_total` + rate + `))`, "{{result}} {{source}}"}))
+	}
+	if o.Replication {
+		integrations = append(integrations, graph("Replicated block events", "ops", series{`sum by (region, direction) (rate(shielder_replication_events_total` + rate + `))`, "{{region}} {{direction}}"}))
+	}
+	if o.GeoIP {
+		integrations = append(integrations,
+			graph("GeoIP database age", "s", series{`max by (database) (shielder_geoip_database_age_seconds)`, "{{database}}"}),
+			graph("GeoIP refreshes", "short", series{`sum by (database, result) (increase(shielder_geoip_refreshes_total[1h]))`, "{{database}} {{result}}"}))
+	}
+	if o.WAFSync {
+		integrations = append(integrations, graph("WAF list syncs", "short", series{`sum by (target, direction, result) (increase(shielder_waf_syncs_total[1h]))`, "{{target}} {{direction}} {{result}}"}))
+	}
+	if o.HealthChecks {
+		integrations = append(integrations,
+			graph("Healthy upstream targets", "short", series{`sum(shielder_upstream_target_healthy)`, "healthy"}, series{`count(shielder_upstream_target_healthy)`, "total"}),
+			graph("Failed upstream health checks", "short", series{`sum by (target) (increase(shielder_upstream_health_checks_total{result="failed"}[5m]))`, "{{target}}"}))
+	}
+	if o.Idempotency {
+		integrations = append(integrations, graph("Idempotency keys", "reqps", series{`sum by (route, result) (rate(shielder_idempotency_checks_total{` + routeSelector + `}` + rate + `))`, "{{route}} {{result}}"}))
+	}
+	if o.DecisionLog {
+		integrations = append(integrations, graph("Decision log records", "ops", series{`sum by (result) (rate(shielder_decision_log_records_total` + rate + `))`, "{{result}}"}))
+	}
+	if o.Accounting {
+		integrations = append(integrations, graph("Accounting exports", "short", series{`sum by (result) (increase(shielder_accounting_exports_total[1h]))`, "{{result}}"}))
+	}
+	if len(integrations) > 0 {
+		rows = append(rows, dashboardRow{title: "Integrations", panels: integrations})
+	}
+	return rows
+}
+
+// Dashboard returns a Grafana dashboard for the metrics of a configuration.
+// The route variable offers the configured routes.
+func Dashboard(o DashboardOptions) ([]byte, error) {
+	datasource := &grafanaDatasource{Type: "prometheus", UID: "${datasource}"}
+	routeOptions := []grafanaOption{{Text: "All", Value: "$__all", Selected: true}}
+	for _, route := range o.routes() {
+		routeOptions = append(routeOptions, grafanaOption{Text: route, Value: route})
+	}
+	d := grafanaDashboard{
+		UID:           "shielder",
+		Title:         "Shielder",
+		Tags:          []string{"shielder"},
+		Timezone:      "browser",
+		SchemaVersion: 39,
+		Refresh:       "30s",
+		Time:          grafanaTimeRange{From: "now-6h", To: "now"},
+		Templating: grafanaTemplating{List: []grafanaVariable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+			{
+				Name:       "route",
+				Label:      "Route",
+				Type:       "custom",
+				Query:      strings.Join(o.routes(), ","),
+				IncludeAll: true,
+				Multi:      true,
+				AllValue:   ".*",
+				Current:    map[string]any{"text": "All", "value": []string{"$__all"}},
+				Options:    routeOptions,
+			},
+		}},
+	}
+
+	id, y := 1, 0
+	for _, row := range o.rows() {
+		d.Panels = append(d.Panels, grafanaPanel{ID: id, Type: "row", Title: row.title, GridPos: grafanaGridPos{H: 1, W: 24, Y: y}})
+		id, y = id+1, y+1
+		for i, p := range row.panels {
+			panel := grafanaPanel{
+				ID:          id,
+				Type:        p.kind,
+				Title:       p.title,
+				Datasource:  datasource,
+				GridPos:     grafanaGridPos{H: 8, W: 12, X: 12 * (i % 2), Y: y + 8*(i/2)},
+				FieldConfig: &grafanaFieldConf{Defaults: grafanaFieldDefaults{Unit: p.unit}},
+			}
+			for j, s := range p.series {
+				panel.Targets = append(panel.Targets, grafanaTarget{RefID: string(rune('A' + j)), Expr: s.expr, LegendFormat: s.legend})
+			}
+			d.Panels = append(d.Panels, panel)
+			id++
+		}
+		y += 8 * ((len(row.panels) + 1) / 2)
+	}
+	return json.MarshalIndent(d, "", "  ")
+}
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string      `yaml:"name"`
+	Rules []alertRule `yaml:"rules"`
+}
+
+type alertRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+func alert(name, expr, forDuration, severity, summary string) alertRule {
+	return alertRule{
+		Alert:       name,
+		Expr:        expr,
+		For:         forDuration,
+		Labels:      map[string]string{"severity": severity},
+		Annotations: map[string]string{"summary": summary},
+	}
+}
+
+// AlertRules returns Prometheus alerting rules for the metrics of a
+// configuration. Rejection rates are alerted per configured route.
+func AlertRules(o DashboardOptions) ([]byte, error) {
+	rules := []alertRule{
+		alert("ShielderStoreDown", `min(shielder_store_up) == 0`, "1m", "critical",
+			"The limiter store is unreachable, Shielder runs in degraded mode"),
+		alert("ShielderCheckBudgetExceeded", `sum by (route) (rate(shielder_check_budget_exceeded_total[5m])) > 1`, "10m", "warning",
+			"Checks on route {{ $labels.route }} run out of their latency budget"),
+		alert("ShielderLimiterErrors", `sum by (route) (rate(shielder_limiter_decisions_total{decision="error"}[5m])) > 0`, "5m", "warning",
+			"Limiter decisions on route {{ $labels.route }} fail"),
+		alert("ShielderPanics", `sum(increase(shielder_panics_total[5m])) > 0`, "", "warning",
+			"Handling requests panics, see the logs for the stack trace"),
+		alert("ShielderUpstreamDialsRejected", `sum by (reason) (rate(shielder_upstream_dial_rejected_total[5m])) > 0`, "10m", "warning",
+			"Upstream dials are rejected by the connection gate ({{ $labels.reason }})"),
+	}
+	for _, route := range o.routes() {
+		rule := alert("ShielderHighRejectionRate",
+			fmt.Sprintf(`sum(rate(shielder_limiter_decisions_total{decision="rejected", route=%q}[5m])) / sum(rate(shielder_limiter_decisions_total{route=%q}[5m])) > 0.25`, route, route),
+			"10m", "warning", fmt.Sprintf("More than 25%% of the requests on route %s are rejected", route))
+		rule.Labels["route"] = route
+		rules = append(rules, rule)
+	}
+	if o.StoreBackend == "dynamodb" {
+		rules = append(rules, alert("ShielderStoreThrottled", `sum(rate(shielder_store_throttled_requests_total[5m])) > 0`, "5m", "warning",
+			"DynamoDB throttles limiter store requests"))
+	}
+	if o.Auth {
+		rules = append(rules, alert("ShielderAuthErrors", `sum by (method) (rate(shielder_auth_checks_total{result="error"}[5m])) > 0`, "5m", "critical",
+			"Credential checks by {{ $labels.method }} fail, clients are rejected"))
+	}
+	if o.Authz {
+		rules = append(rules, alert("ShielderAuthzErrors", `sum(rate(shielder_authz_checks_total{result="error"}[5m])) > 0`, "5m", "critical",
+			"The external authorization service fails"))
+	}
+	if o.CircuitBreaker {
+		rules = append(rules, alert("ShielderCircuitOpen", `max by (route) (shielder_circuit_breaker_state) == 2`, "1m", "critical",
+			"The circuit breaker of route {{ $labels.route }} is open, requests are rejected with 503"))
+	}
+	if o.Anomaly {
+		rules = append(rules, alert("ShielderTrafficAnomaly", `sum by (route, kind) (increase(shielder_traffic_anomalies_total[10m])) > 0`, "", "info",
+			"Traffic on route {{ $labels.route }} deviates from its baseline ({{ $labels.kind }})"))
+	}
+	if o.GeoIP {
+		rules = append(rules, alert("ShielderGeoIPDatabaseStale", `max by (database) (shielder_geoip_database_stale) == 1`, "1h", "warning",
+			"GeoIP database {{ $labels.database }} is stale"))
+	}
+	if o.WAFSync {
+		rules = append(rules, alert("ShielderWAFSyncFailing", `sum by (target, direction) (increase(shielder_waf_syncs_total{result="error"}[30m])) > 0`, "30m", "warning",
+			"Syncing WAF list {{ $labels.target }} ({{ $labels.direction }}) fails"))
+	}
+	if o.HealthChecks {
+		rules = append(rules, alert("ShielderUpstreamTargetDown", `max by (target) (shielder_upstream_target_healthy) == 0`, "5m", "warning",
+			"Upstream target {{ $labels.target }} fails its health checks and receives no traffic"))
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(ruleFile{Groups: []ruleGroup{{Name: "shielder", Rules: rules}}}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,138 @@
+package monitor
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// registeredMetrics returns the metric names declared in metrics.go.
+func registeredMetrics(t *testing.T) map[string]bool {
+	t.Helper()
+	source, err := os.ReadFile("metrics.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, m := range regexp.MustCompile(`Name:\s+"(shielder_\w+)"`).FindAllStringSubmatch(string(source), -1) {
+		names[m[1]] = true
+	}
+	return names
+}
+
+var metricRef = regexp.MustCompile(`shielder_\w+`)
+
+func checkMetrics(t *testing.T, expr string, registered map[string]bool) {
+	t.Helper()
+	for _, name := range metricRef.FindAllString(expr, -1) {
+		name = strings.TrimSuffix(name, "_bucket")
+		if !registered[name] {
+			t.Errorf("Query references unknown metric %s: %s", name, expr)
+		}
+	}
+}
+
+var allFeatures = DashboardOptions{
+	Routes:       []string{"api", "login"},
+	StoreBackend: "dynamodb",
+	LocalCache:   true,
+	TLS:          true,
+	Authz:        true,
+	Auth:         true,
+	Replication:  true,
+	Anomaly:      true,
+	Fingerprints: true,
+	Greylist:     true,
+	Trusted:      true,
+	GeoIP:        true,
+	Shadow:       true,
+	Feedback:     true,
+	WAFSync:      true,
+	DecisionLog:  true,
+	Idempotency:  true,
+	Expensive:    true,
+	Accounting:   true,
+	GeoBlocking:  true,
+	Bypass:       true,
+	HealthChecks: true,
+	Review:       true,
+
+	ConditionalCache: true,
+	CircuitBreaker:   true,
+}
+
+func TestDashboard(t *testing.T) {
+	registered := registeredMetrics(t)
+
+	out, err := Dashboard(allFeatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d grafanaDashboard
+	if err := json.Unmarshal(out, &d); err != nil {
+		t.Fatalf("Dashboard is not valid JSON: %v", err)
+	}
+	var queries int
+	for _, p := range d.Panels {
+		for _, target := range p.Targets {
+			checkMetrics(t, target.Expr, registered)
+			queries++
+		}
+	}
+	if queries == 0 {
+		t.Fatal("Expected queries in the dashboard")
+	}
+	if route := d.Templating.List[1]; route.Query != "api,login,default" {
+		t.Errorf("Expected the configured routes in the route variable, got %q", route.Query)
+	}
+
+	aggregated, err := Dashboard(DashboardOptions{Routes: []string{"api"}, AggregateRoutes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(aggregated, &d); err != nil {
+		t.Fatal(err)
+	}
+	if route := d.Templating.List[1]; route.Query != "api,other" {
+		t.Errorf("Expected the reported routes in the route variable, got %q", route.Query)
+	}
+
+	minimal, err := Dashboard(DashboardOptions{StoreBackend: "redis"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"shielder_auth_checks_total", "shielder_store_throttled_requests_total", "shielder_waf_syncs_total"} {
+		if strings.Contains(string(minimal), name) {
+			t.Errorf("Expected no %s panel without the feature", name)
+		}
+	}
+}
+
+func TestAlertRules(t *testing.T) {
+	registered := registeredMetrics(t)
+
+	out, err := AlertRules(allFeatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rules ruleFile
+	if err := yaml.Unmarshal(out, &rules); err != nil {
+		t.Fatalf("Alert rules are not valid YAML: %v", err)
+	}
+	perRoute := map[string]bool{}
+	for _, rule := range rules.Groups[0].Rules {
+		checkMetrics(t, rule.Expr, registered)
+		if rule.Alert == "ShielderHighRejectionRate" {
+			perRoute[rule.Labels["route"]] = true
+		}
+	}
+	for _, route := range []string{"api", "login", "default"} {
+		if !perRoute[route] {
+			t.Errorf("Expected a rejection rate alert for route %s", route)
+		}
+	}
+}
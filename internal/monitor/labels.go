@@ -0,0 +1,159 @@
+package monitor
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// OtherRoute is the route label of routes that are not reported as their
+// own series.
+const OtherRoute = "other"
+
+// OtherClient is the ip label of clients beyond MaxClients, and of client
+// keys that are not addresses when clients are reported by subnet.
+const OtherClient = "other"
+
+// Client label modes, see LabelOptions.
+const (
+	ClientIP     = "ip"
+	ClientSubnet = "subnet"
+	ClientNone   = "none"
+)
+
+// LabelOptions bounds the label values the collector reports, so that paths
+// with IDs in them or many routes do not create a series each.
+type LabelOptions struct {
+	// Routes lists the routes reported as their own series, the others are
+	// aggregated into OtherRoute. Empty reports every route.
+	Routes []string
+	// PathsByRoute labels request durations with the route instead of the
+	// raw request path.
+	PathsByRoute bool
+	// Clients is how the ip label of per client counters is reported:
+	// ClientIP (the default) reports the client key, ClientSubnet the
+	// subnet of its address, IPv4Prefix and IPv6Prefix bits long, and
+	// ClientNone leaves the label out. Keys scoped to a route or endpoint
+	// are reported by the address they end in.
+	Clients    string
+	IPv4Prefix int
+	IPv6Prefix int
+	// MaxClients bounds the distinct ip label values, 1000 by default.
+	// Clients beyond it are aggregated into OtherClient, so that an attack
+	// from many addresses does not create a series each.
+	MaxClients int
+}
+
+// clientLabels bounds the ip label values, see LabelOptions.Clients.
+type clientLabels struct {
+	mode                   string
+	ipv4Prefix, ipv6Prefix int
+	max                    int
+
+	mu   sync.RWMutex
+	seen map[string]bool
+}
+
+// SetLabelOptions changes which label values are reported. It must be called
+// before the collector is used.
+func (m *MetricsCollector) SetLabelOptions(o LabelOptions) {
+	m.routes = nil
+	if len(o.Routes) > 0 {
+		m.routes = make(map[string]bool, len(o.Routes))
+		for _, route := range o.Routes {
+			m.routes[route] = true
+		}
+	}
+	m.pathsByRoute = o.PathsByRoute
+
+	m.clients = &clientLabels{mode: o.Clients, ipv4Prefix: o.IPv4Prefix, ipv6Prefix: o.IPv6Prefix, max: o.MaxClients, seen: make(map[string]bool)}
+	if m.clients.ipv4Prefix <= 0 {
+		m.clients.ipv4Prefix = 24
+	}
+	if m.clients.ipv6Prefix <= 0 {
+		m.clients.ipv6Prefix = 48
+	}
+	if m.clients.max <= 0 {
+		m.clients.max = 1000
+	}
+}
+
+// client returns the ip label value reported for a client key.
+func (m *MetricsCollector) client(key string) string {
+	c := m.clients
+	if c == nil {
+		return key
+	}
+	label := key
+	switch c.mode {
+	case ClientNone:
+		// Prometheus treats an empty label like a missing one.
+		return ""
+	case ClientSubnet:
+		addr, ok := keyAddr(key)
+		if !ok {
+			return OtherClient
+		}
+		bits := c.ipv6Prefix
+		if addr.Is4() {
+			bits = c.ipv4Prefix
+		}
+		prefix, err := addr.Prefix(min(bits, addr.BitLen()))
+		if err != nil {
+			return OtherClient
+		}
+		label = prefix.String()
+	}
+
+	c.mu.RLock()
+	seen, full := c.seen[label], len(c.seen) >= c.max
+	c.mu.RUnlock()
+	if seen {
+		return label
+	}
+	if full {
+		return OtherClient
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.seen[label] && len(c.seen) >= c.max {
+		return OtherClient
+	}
+	c.seen[label] = true
+	return label
+}
+
+// keyAddr returns the address a client key is or ends in, such as the
+// address of route:api:10.0.0.1.
+func keyAddr(key string) (netip.Addr, bool) {
+	for rest := key; ; {
+		if addr, err := netip.ParseAddr(rest); err == nil {
+			return addr.Unmap(), true
+		}
+		i := strings.IndexByte(rest, ':')
+		if i < 0 {
+			return netip.Addr{}, false
+		}
+		rest = rest[i+1:]
+	}
+}
+
+// route returns the label value reported for a route.
+func (m *MetricsCollector) route(name string) string {
+	if m.routes != nil && !m.routes[name] {
+		return OtherRoute
+	}
+	return name
+}
+
+// durationLabel returns the path label of a request duration. Requests
+// answered before a route matched have no route and count as OtherRoute.
+func (m *MetricsCollector) durationLabel(path, route string) string {
+	if !m.pathsByRoute {
+		return path
+	}
+	if route == "" {
+		return OtherRoute
+	}
+	return m.route(route)
+}
@@ -0,0 +1,70 @@
+package monitor
+
+import "testing"
+
+func TestLabelOptions(t *testing.T) {
+	m := &MetricsCollector{}
+	if got := m.route("orders"); got != "orders" {
+		t.Errorf("Expected every route to be reported without an allowlist, got %q", got)
+	}
+
+	m.SetLabelOptions(LabelOptions{Routes: []string{"api", "login"}, PathsByRoute: true})
+	tests := map[string]string{
+		"api":     "api",
+		"login":   "login",
+		"orders":  OtherRoute,
+		"default": OtherRoute,
+		"":        OtherRoute,
+	}
+	for route, want := range tests {
+		if got := m.route(route); got != want {
+			t.Errorf("route(%q) = %q, want %q", route, got, want)
+		}
+	}
+	if got := m.durationLabel("/api/users/12345", "api"); got != "api" {
+		t.Errorf("Expected request durations to be labeled by route, got %q", got)
+	}
+
+	m.SetLabelOptions(LabelOptions{})
+	if got := m.durationLabel("/api/users/12345", "api"); got != "/api/users/12345" {
+		t.Errorf("Expected request durations to be labeled by path, got %q", got)
+	}
+}
+
+func TestClientLabels(t *testing.T) {
+	m := &MetricsCollector{}
+	if got := m.client("10.1.2.3"); got != "10.1.2.3" {
+		t.Errorf("Expected client keys to be reported as they are by default, got %q", got)
+	}
+
+	m.SetLabelOptions(LabelOptions{Clients: ClientSubnet, MaxClients: 3})
+	tests := map[string]string{
+		"10.1.2.3":                       "10.1.2.0/24",
+		"::ffff:10.1.2.200":              "10.1.2.0/24",
+		"route:api:10.9.8.7":             "10.9.8.0/24",
+		"route:api:2001:db8:1:2::1":      "2001:db8:1::/48",
+		"route:api:/users/{id}:10.1.2.9": "10.1.2.0/24",
+		"api-key-123":                    OtherClient,
+	}
+	for key, want := range tests {
+		if got := m.client(key); got != want {
+			t.Errorf("client(%q) = %q, want %q", key, got, want)
+		}
+	}
+	// The third subnet fills the label values up, later ones are aggregated.
+	if got := m.client("192.168.0.1"); got != OtherClient {
+		t.Errorf("Expected subnets beyond the maximum to be aggregated, got %q", got)
+	}
+	if got := m.client("10.9.8.1"); got != "10.9.8.0/24" {
+		t.Errorf("Expected known subnets to keep their label, got %q", got)
+	}
+
+	m.SetLabelOptions(LabelOptions{Clients: ClientSubnet, IPv4Prefix: 16})
+	if got := m.client("10.1.2.3"); got != "10.1.0.0/16" {
+		t.Errorf("Expected a /16 subnet, got %q", got)
+	}
+	m.SetLabelOptions(LabelOptions{Clients: ClientNone})
+	if got := m.client("10.1.2.3"); got != "" {
+		t.Errorf("Expected the label to be left out, got %q", got)
+	}
+}
@@ -11,6 +11,73 @@ type MetricsCollector struct {
 	requestDuration *prometheus.HistogramVec
 	blockedRequests *prometheus.CounterVec
 	successRequests *prometheus.CounterVec
+
+	storeConsumedCapacity *prometheus.CounterVec
+	storeThrottled        *prometheus.CounterVec
+	storeCacheLookups     *prometheus.CounterVec
+
+	replicationEvents *prometheus.CounterVec
+
+	upstreamConnections  prometheus.Gauge
+	upstreamDialRejected *prometheus.CounterVec
+
+	authzChecks *prometheus.CounterVec
+
+	anomalies *prometheus.CounterVec
+
+	trustedRequests *prometheus.CounterVec
+
+	limiterDecisions  *prometheus.CounterVec
+	limiterEvaluation *prometheus.HistogramVec
+
+	checkBudgetExceeded *prometheus.CounterVec
+
+	fingerprintPenalties *prometheus.CounterVec
+
+	greylistedRequests *prometheus.CounterVec
+
+	clientConnections        prometheus.Gauge
+	clientConnectionRejected *prometheus.CounterVec
+
+	tlsHandshakes *prometheus.CounterVec
+
+	geoipDatabaseAge   *prometheus.GaugeVec
+	geoipDatabaseStale *prometheus.GaugeVec
+	geoipRefreshes     *prometheus.CounterVec
+
+	limiterShadowDecisions *prometheus.CounterVec
+
+	falsePositives *prometheus.CounterVec
+
+	wafSyncs *prometheus.CounterVec
+
+	authChecks *prometheus.CounterVec
+
+	decisionLogRecords *prometheus.CounterVec
+	idempotencyChecks  *prometheus.CounterVec
+	expensiveRequests  *prometheus.CounterVec
+	accountingExports  *prometheus.CounterVec
+	geoBlocked         *prometheus.CounterVec
+	bypassedRequests   *prometheus.CounterVec
+	upstreamChecks     *prometheus.CounterVec
+	upstreamHealthy    *prometheus.GaugeVec
+	escalations        *prometheus.CounterVec
+	reviewSuspensions  *prometheus.CounterVec
+	reviewVerdicts     *prometheus.CounterVec
+	timeToFirstByte    *prometheus.HistogramVec
+	transferDuration   *prometheus.HistogramVec
+	panics             prometheus.Counter
+	conditionalCache   *prometheus.CounterVec
+	openStreams        *prometheus.GaugeVec
+	breakerState       *prometheus.GaugeVec
+	breakerRejected    *prometheus.CounterVec
+	bodyTooLarge       *prometheus.CounterVec
+	auditRecords       *prometheus.CounterVec
+
+	// routes, pathsByRoute and clients are set by SetLabelOptions.
+	routes       map[string]bool
+	pathsByRoute bool
+	clients      *clientLabels
 }
 
 func NewMetricsCollector() *MetricsCollector {
@@ -37,19 +104,542 @@ func NewMetricsCollector() *MetricsCollector {
 			},
 			[]string{"ip"},
 		),
+		storeConsumedCapacity: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_store_consumed_capacity_units_total",
+				Help: "Total capacity units consumed by limiter store operations",
+			},
+			[]string{"operation"},
+		),
+		storeThrottled: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_store_throttled_requests_total",
+				Help: "Total number of limiter store requests throttled by the backend",
+			},
+			[]string{"operation"},
+		),
+		storeCacheLookups: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_store_cache_lookups_total",
+				Help: "Total number of limiter store lookups answered by the local cache (hit) or the backend (miss)",
+			},
+			[]string{"result"},
+		),
+		replicationEvents: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_replication_events_total",
+				Help: "Total number of block events published to, applied from or dropped before region streams",
+			},
+			[]string{"region", "direction"},
+		),
+		upstreamConnections: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "shielder_upstream_connections_open",
+				Help: "Number of open connections to the upstream",
+			},
+		),
+		upstreamDialRejected: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_upstream_dial_rejected_total",
+				Help: "Total number of upstream dials rejected by the connection gate",
+			},
+			[]string{"reason"},
+		),
+		authzChecks: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_authz_checks_total",
+				Help: "Total number of external authorization decisions by result and whether they came from the service or the cache",
+			},
+			[]string{"result", "source"},
+		),
+		anomalies: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_traffic_anomalies_total",
+				Help: "Total number of observation windows in which a route deviated from its traffic baseline",
+			},
+			[]string{"route", "kind"},
+		),
+		trustedRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_trusted_requests_total",
+				Help: "Total number of health check and monitoring requests that bypassed protection",
+			},
+			[]string{"identity"},
+		),
+		limiterDecisions: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_limiter_decisions_total",
+				Help: "Total number of limiter decisions by outcome and the reason behind it",
+			},
+			[]string{"algorithm", "decision", "reason", "route"},
+		),
+		limiterEvaluation: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "shielder_limiter_evaluation_seconds",
+				Help: "Time spent evaluating block and rate limit checks per request",
+				// From 50µs, where local caches answer, to 1s.
+				Buckets: prometheus.ExponentialBuckets(0.00005, 2.5, 12),
+			},
+			[]string{"algorithm"},
+		),
+		checkBudgetExceeded: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_check_budget_exceeded_total",
+				Help: "Total number of requests whose checks ran out of their latency budget",
+			},
+			[]string{"route"},
+		),
+		fingerprintPenalties: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_fingerprint_penalties_total",
+				Help: "Total number of requests held to a tighter limit because their fingerprint matched a recently limited client on another IP",
+			},
+			[]string{"route"},
+		),
+		greylistedRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_greylisted_requests_total",
+				Help: "Total number of requests from first-seen clients that were tightened or challenged",
+			},
+			[]string{"route"},
+		),
+		clientConnections: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "shielder_client_connections_open",
+				Help: "Number of open client connections",
+			},
+		),
+		clientConnectionRejected: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_client_connections_rejected_total",
+				Help: "Total number of client connections closed by the listener limits",
+			},
+			[]string{"reason"},
+		),
+		tlsHandshakes: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_tls_handshakes_total",
+				Help: "Total number of TLS handshakes by result, including refused ones",
+			},
+			[]string{"result"},
+		),
+		geoipDatabaseAge: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "shielder_geoip_database_age_seconds",
+				Help: "Age of the loaded GeoIP and reputation databases",
+			},
+			[]string{"database"},
+		),
+		geoipDatabaseStale: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "shielder_geoip_database_stale",
+				Help: "Whether a GeoIP or reputation database is older than its stale age",
+			},
+			[]string{"database"},
+		),
+		geoipRefreshes: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_geoip_refreshes_total",
+				Help: "Total number of GeoIP and reputation database downloads by result",
+			},
+			[]string{"database", "result"},
+		),
+		limiterShadowDecisions: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_limiter_shadow_decisions_total",
+				Help: "Total number of rate limit decisions compared with the shadow algorithm, by whether they agree",
+			},
+			[]string{"enforcing", "shadow", "result"},
+		),
+		falsePositives: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_false_positives_total",
+				Help: "Total number of reported false positives by rule and source",
+			},
+			[]string{"rule", "source"},
+		),
+		wafSyncs: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_waf_syncs_total",
+				Help: "Total number of syncs with WAF provider lists by direction and result",
+			},
+			[]string{"target", "direction", "result"},
+		),
+		authChecks: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_auth_checks_total",
+				Help: "Total number of credential checks by method, source of the answer and result",
+			},
+			[]string{"method", "source", "result"},
+		),
+		decisionLogRecords: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_decision_log_records_total",
+				Help: "Total number of decision log records by whether they were written or dropped",
+			},
+			[]string{"result"},
+		),
+		idempotencyChecks: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_idempotency_checks_total",
+				Help: "Total number of guarded requests by route and whether they were first, replayed or rejected",
+			},
+			[]string{"route", "result"},
+		),
+		expensiveRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_expensive_requests_total",
+				Help: "Total number of requests flagged as slow or as returning a large response",
+			},
+			[]string{"route", "kind"},
+		),
+		accountingExports: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_accounting_exports_total",
+				Help: "Total number of accounting exports by whether they were exported, failed or dropped records",
+			},
+			[]string{"result"},
+		),
+		geoBlocked: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_geo_blocked_requests_total",
+				Help: "Total number of requests rejected because of the country of the client",
+			},
+			[]string{"country"},
+		),
+		bypassedRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_bypassed_requests_total",
+				Help: "Total number of requests that skipped protection with a bypass token, by the subject of the token",
+			},
+			[]string{"subject"},
+		),
+		upstreamChecks: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_upstream_health_checks_total",
+				Help: "Total number of upstream health checks by target and whether they passed",
+			},
+			[]string{"target", "result"},
+		),
+		upstreamHealthy: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "shielder_upstream_target_healthy",
+				Help: "Whether an upstream target receives traffic",
+			},
+			[]string{"target"},
+		),
+		escalations: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_escalations_total",
+				Help: "Total number of clients promoted to the global block list, by whether they were tracked by ip or fingerprint",
+			},
+			[]string{"kind"},
+		),
+		reviewSuspensions: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_review_suspensions_total",
+				Help: "Total number of borderline clients suspended pending review",
+			},
+			[]string{"route"},
+		),
+		reviewVerdicts: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_review_verdicts_total",
+				Help: "Total number of suspended clients an operator blocked or allowed",
+			},
+			[]string{"verdict"},
+		),
+		timeToFirstByte: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "shielder_upstream_time_to_first_byte_seconds",
+				Help:    "Time from forwarding a request until its response headers were sent to the client",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"route"},
+		),
+		transferDuration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "shielder_upstream_transfer_duration_seconds",
+				Help: "Time from forwarding a request until the last byte of its response was sent to the client",
+				// Streamed responses last up to the write timeout.
+				Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+			},
+			[]string{"route"},
+		),
+		panics: promauto.NewCounter(
+			prometheus.CounterOpts{
+				Name: "shielder_panics_total",
+				Help: "Total number of requests whose handling panicked",
+			},
+		),
+		conditionalCache: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_conditional_cache_requests_total",
+				Help: "HEAD requests and conditional GETs looked up in the conditional cache by route and result (hit or miss)",
+			},
+			[]string{"route", "result"},
+		),
+		openStreams: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "shielder_streams_open",
+				Help: "Open long-lived requests by route and kind (websocket, upgrade, sse or stream)",
+			},
+			[]string{"route", "kind"},
+		),
+		breakerState: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "shielder_circuit_breaker_state",
+				Help: "State of the circuit breaker of a route: 0 closed, 1 half open, 2 open",
+			},
+			[]string{"route"},
+		),
+		breakerRejected: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_circuit_breaker_rejected_total",
+				Help: "Total number of requests rejected by an open circuit breaker by route",
+			},
+			[]string{"route"},
+		),
+		bodyTooLarge: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_request_body_too_large_total",
+				Help: "Total number of requests rejected with 413 for a body over the size limit by route",
+			},
+			[]string{"route"},
+		),
+		auditRecords: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shielder_audit_records_total",
+				Help: "Total number of sampled audit records by whether they were uploaded, dropped or failed to upload",
+			},
+			[]string{"result"},
+		),
 	}
 
 	return m
 }
 
-func (m *MetricsCollector) ObserveRequestDuration(path string, duration time.Duration) {
-	m.requestDuration.WithLabelValues(path).Observe(duration.Seconds())
+// RegisterStoreUp exposes the limiter store availability as a gauge
+func (m *MetricsCollector) RegisterStoreUp(available func() bool) {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "shielder_store_up",
+			Help: "Whether the limiter store is reachable (1) or the limiter runs degraded (0)",
+		},
+		func() float64 {
+			if available() {
+				return 1
+			}
+			return 0
+		},
+	)
+}
+
+func (m *MetricsCollector) ObserveRequestDuration(path, route string, duration time.Duration) {
+	m.requestDuration.WithLabelValues(m.durationLabel(path, route)).Observe(duration.Seconds())
 }
 
 func (m *MetricsCollector) IncBlockedRequests(ip string) {
-	m.blockedRequests.WithLabelValues(ip).Inc()
+	m.blockedRequests.WithLabelValues(m.client(ip)).Inc()
 }
 
 func (m *MetricsCollector) IncSuccessfulRequests(ip string) {
-	m.successRequests.WithLabelValues(ip).Inc()
+	m.successRequests.WithLabelValues(m.client(ip)).Inc()
+}
+
+func (m *MetricsCollector) ObserveStoreConsumedCapacity(operation string, units float64) {
+	m.storeConsumedCapacity.WithLabelValues(operation).Add(units)
+}
+
+func (m *MetricsCollector) IncStoreThrottled(operation string) {
+	m.storeThrottled.WithLabelValues(operation).Inc()
+}
+
+func (m *MetricsCollector) IncStoreCacheLookup(result string) {
+	m.storeCacheLookups.WithLabelValues(result).Inc()
+}
+
+func (m *MetricsCollector) IncReplicationEvents(region, direction string) {
+	m.replicationEvents.WithLabelValues(region, direction).Inc()
+}
+
+func (m *MetricsCollector) AddUpstreamConnections(delta float64) {
+	m.upstreamConnections.Add(delta)
+}
+
+func (m *MetricsCollector) IncUpstreamDialRejected(reason string) {
+	m.upstreamDialRejected.WithLabelValues(reason).Inc()
+}
+
+func (m *MetricsCollector) IncAuthzCheck(result, source string) {
+	m.authzChecks.WithLabelValues(result, source).Inc()
+}
+
+func (m *MetricsCollector) IncAnomaly(route, kind string) {
+	m.anomalies.WithLabelValues(m.route(route), kind).Inc()
+}
+
+func (m *MetricsCollector) IncTrustedRequest(identity string) {
+	m.trustedRequests.WithLabelValues(identity).Inc()
+}
+
+func (m *MetricsCollector) IncLimiterDecision(algorithm, decision, reason, route string) {
+	m.limiterDecisions.WithLabelValues(algorithm, decision, reason, m.route(route)).Inc()
+}
+
+func (m *MetricsCollector) ObserveLimiterEvaluation(algorithm string, duration time.Duration) {
+	m.limiterEvaluation.WithLabelValues(algorithm).Observe(duration.Seconds())
+}
+
+func (m *MetricsCollector) IncCheckBudgetExceeded(route string) {
+	m.checkBudgetExceeded.WithLabelValues(m.route(route)).Inc()
+}
+
+func (m *MetricsCollector) IncFingerprintPenalty(route string) {
+	m.fingerprintPenalties.WithLabelValues(m.route(route)).Inc()
+}
+
+func (m *MetricsCollector) IncGreylistedRequest(route string) {
+	m.greylistedRequests.WithLabelValues(m.route(route)).Inc()
+}
+
+func (m *MetricsCollector) AddClientConnections(delta float64) {
+	m.clientConnections.Add(delta)
+}
+
+func (m *MetricsCollector) IncClientConnectionRejected(reason string) {
+	m.clientConnectionRejected.WithLabelValues(reason).Inc()
+}
+
+func (m *MetricsCollector) IncTLSHandshake(result string) {
+	m.tlsHandshakes.WithLabelValues(result).Inc()
+}
+
+func (m *MetricsCollector) SetGeoIPDatabaseAge(database string, age time.Duration) {
+	m.geoipDatabaseAge.WithLabelValues(database).Set(age.Seconds())
+}
+
+func (m *MetricsCollector) SetGeoIPDatabaseStale(database string, stale bool) {
+	value := 0.0
+	if stale {
+		value = 1
+	}
+	m.geoipDatabaseStale.WithLabelValues(database).Set(value)
+}
+
+func (m *MetricsCollector) IncGeoIPRefresh(database, result string) {
+	m.geoipRefreshes.WithLabelValues(database, result).Inc()
+}
+
+func (m *MetricsCollector) IncLimiterShadowDecision(enforcing, shadow, result string) {
+	m.limiterShadowDecisions.WithLabelValues(enforcing, shadow, result).Inc()
+}
+
+func (m *MetricsCollector) IncFalsePositive(rule, source string) {
+	m.falsePositives.WithLabelValues(rule, source).Inc()
+}
+
+func (m *MetricsCollector) IncWAFSync(target, direction, result string) {
+	m.wafSyncs.WithLabelValues(target, direction, result).Inc()
+}
+
+func (m *MetricsCollector) IncAuthCheck(method, source, result string) {
+	m.authChecks.WithLabelValues(method, source, result).Inc()
+}
+
+func (m *MetricsCollector) IncDecisionLogRecord(result string) {
+	m.decisionLogRecords.WithLabelValues(result).Inc()
+}
+
+func (m *MetricsCollector) IncIdempotencyCheck(route, result string) {
+	m.idempotencyChecks.WithLabelValues(m.route(route), result).Inc()
+}
+
+func (m *MetricsCollector) IncExpensiveRequest(route, kind string) {
+	m.expensiveRequests.WithLabelValues(m.route(route), kind).Inc()
+}
+
+func (m *MetricsCollector) IncAccountingExport(result string) {
+	m.accountingExports.WithLabelValues(result).Inc()
+}
+
+func (m *MetricsCollector) IncGeoBlocked(country string) {
+	m.geoBlocked.WithLabelValues(country).Inc()
+}
+
+func (m *MetricsCollector) IncBypassedRequest(subject string) {
+	m.bypassedRequests.WithLabelValues(subject).Inc()
+}
+
+func (m *MetricsCollector) IncUpstreamHealthCheck(target, result string) {
+	m.upstreamChecks.WithLabelValues(target, result).Inc()
+}
+
+func (m *MetricsCollector) SetUpstreamHealthy(target string, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	m.upstreamHealthy.WithLabelValues(target).Set(value)
+}
+
+func (m *MetricsCollector) DeleteUpstreamTarget(target string) {
+	m.upstreamChecks.DeletePartialMatch(prometheus.Labels{"target": target})
+	m.upstreamHealthy.DeleteLabelValues(target)
+}
+
+func (m *MetricsCollector) IncEscalation(kind string) {
+	m.escalations.WithLabelValues(kind).Inc()
+}
+
+func (m *MetricsCollector) IncReviewSuspension(route string) {
+	m.reviewSuspensions.WithLabelValues(m.route(route)).Inc()
+}
+
+func (m *MetricsCollector) IncReviewVerdict(verdict string) {
+	m.reviewVerdicts.WithLabelValues(verdict).Inc()
+}
+
+func (m *MetricsCollector) ObserveTimeToFirstByte(route string, d time.Duration) {
+	m.timeToFirstByte.WithLabelValues(m.route(route)).Observe(d.Seconds())
+}
+
+func (m *MetricsCollector) ObserveTransferDuration(route string, d time.Duration) {
+	m.transferDuration.WithLabelValues(m.route(route)).Observe(d.Seconds())
+}
+
+func (m *MetricsCollector) IncPanic() {
+	m.panics.Inc()
+}
+
+func (m *MetricsCollector) IncConditionalCache(route, result string) {
+	m.conditionalCache.WithLabelValues(m.route(route), result).Inc()
+}
+
+func (m *MetricsCollector) AddOpenStreams(route, kind string, delta float64) {
+	m.openStreams.WithLabelValues(m.route(route), kind).Add(delta)
+}
+
+// SetBreakerState takes the state as closed, half_open or open.
+func (m *MetricsCollector) SetBreakerState(route, state string) {
+	value := 0.0
+	switch state {
+	case "half_open":
+		value = 1
+	case "open":
+		value = 2
+	}
+	m.breakerState.WithLabelValues(m.route(route)).Set(value)
+}
+
+func (m *MetricsCollector) IncBreakerRejected(route string) {
+	m.breakerRejected.WithLabelValues(m.route(route)).Inc()
+}
+
+func (m *MetricsCollector) IncBodyTooLarge(route string) {
+	m.bodyTooLarge.WithLabelValues(m.route(route)).Inc()
+}
+
+func (m *MetricsCollector) IncAuditRecords(result string, n int) {
+	m.auditRecords.WithLabelValues(result).Add(float64(n))
 }
@@ -0,0 +1,137 @@
+// Package pathtemplate maps request paths to the endpoint they address, such
+// as /users/123 and /users/456 to /users/{id}, so that metrics, limits and
+// logs treat them as one.
+package pathtemplate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Options configures a Templater.
+type Options struct {
+	// Patterns are templates such as /users/{id}/orders/{order}. A segment
+	// in braces matches any one non-empty path segment. The first pattern
+	// matching a path wins.
+	Patterns []string
+	// CollapseIDs replaces numeric, UUID and long hexadecimal segments of
+	// paths no pattern matches with {id}, {uuid} and {hex}.
+	CollapseIDs bool
+}
+
+// Templater maps request paths to templates.
+type Templater struct {
+	patterns []pattern
+	collapse bool
+}
+
+type pattern struct {
+	template string
+	// segments are the literal segments of the template, with an empty
+	// string in place of each parameter.
+	segments []string
+}
+
+// New parses the patterns of opts.
+func New(opts Options) (*Templater, error) {
+	t := &Templater{collapse: opts.CollapseIDs}
+	for _, template := range opts.Patterns {
+		if !strings.HasPrefix(template, "/") {
+			return nil, fmt.Errorf("path template %q must start with /", template)
+		}
+		p := pattern{template: template}
+		for _, segment := range strings.Split(template[1:], "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") && len(segment) > 2 {
+				segment = ""
+			} else if strings.ContainsAny(segment, "{}") {
+				return nil, fmt.Errorf("path template %q has a malformed parameter %q", template, segment)
+			}
+			p.segments = append(p.segments, segment)
+		}
+		t.patterns = append(t.patterns, p)
+	}
+	return t, nil
+}
+
+// Template returns the template of path, or path itself when no pattern
+// matches and it has no segments to collapse.
+func (t *Templater) Template(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return path
+	}
+	segments := strings.Split(path[1:], "/")
+	for _, p := range t.patterns {
+		if p.match(segments) {
+			return p.template
+		}
+	}
+	if !t.collapse {
+		return path
+	}
+	collapsed := false
+	for i, segment := range segments {
+		if id := idKind(segment); id != "" {
+			segments[i] = id
+			collapsed = true
+		}
+	}
+	if !collapsed {
+		return path
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func (p pattern) match(segments []string) bool {
+	if len(segments) != len(p.segments) {
+		return false
+	}
+	for i, literal := range p.segments {
+		if literal == "" {
+			if segments[i] == "" {
+				return false
+			}
+		} else if segments[i] != literal {
+			return false
+		}
+	}
+	return true
+}
+
+// idKind returns the placeholder for a segment that looks like an
+// identifier, an empty string otherwise.
+func idKind(segment string) string {
+	switch {
+	case segment == "":
+		return ""
+	case strings.Trim(segment, "0123456789") == "":
+		return "{id}"
+	case isUUID(segment):
+		return "{uuid}"
+	case len(segment) >= 16 && isHex(segment) && strings.ContainsAny(segment, "0123456789"):
+		return "{hex}"
+	}
+	return ""
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !isHex(string(c)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	return strings.Trim(strings.ToLower(s), "0123456789abcdef") == ""
+}
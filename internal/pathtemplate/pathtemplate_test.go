@@ -0,0 +1,43 @@
+package pathtemplate
+
+import "testing"
+
+func TestTemplate(t *testing.T) {
+	templater, err := New(Options{
+		Patterns:    []string{"/users/{id}/orders/{order}", "/users/{id}", "/files/{name}"},
+		CollapseIDs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/users/123", "/users/{id}"},
+		{"/users/alice", "/users/{id}"},
+		{"/users/123/orders/9", "/users/{id}/orders/{order}"},
+		{"/users/", "/users/"},
+		{"/users/123/profile", "/users/{id}/profile"},
+		{"/files/report.pdf", "/files/{name}"},
+		{"/items/42/reviews", "/items/{id}/reviews"},
+		{"/items/0b7e4a5c-1f7d-4c57-9d1e-8f2b3c4d5e6f", "/items/{uuid}"},
+		{"/blobs/9f86d081884c7d659a2feaa0c55ad015", "/blobs/{hex}"},
+		{"/blobs/deadbeefdeadbeefdead", "/blobs/deadbeefdeadbeefdead"},
+		{"/health", "/health"},
+	}
+	for _, tt := range tests {
+		if got := templater.Template(tt.path); got != tt.want {
+			t.Errorf("Template(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNewRejectsMalformedPatterns(t *testing.T) {
+	for _, pattern := range []string{"users/{id}", "/users/{id", "/users/x{id}", "/users/{}"} {
+		if _, err := New(Options{Patterns: []string{pattern}}); err == nil {
+			t.Errorf("Expected %q to be rejected", pattern)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package plan replays the requests of a decision log against two policies
+// and reports the requests whose outcome would change, so that a change of
+// routes or rate limits can be reviewed before it is rolled out.
+//
+// Both policies are simulated from scratch over the same traffic rather than
+// compared with the recorded outcomes, so that what the simulation cannot
+// know, such as blocks placed by operators, affects both sides alike.
+// Limits are counted in fixed one-minute windows on a single instance, every
+// request costs one, and CORS preflights are taken to be OPTIONS requests.
+// Requests decided by other rules, such as blocked networks or countries,
+// keep their recorded outcome.
+package plan
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knakul853/shielder/internal/decisionlog"
+)
+
+// Outcomes, as in the decision log
+const (
+	OutcomeAllowed  = "allowed"
+	OutcomeRejected = "rejected"
+	OutcomeTagged   = "tagged"
+)
+
+// Rules the simulation decides, everything else keeps its recorded outcome
+const (
+	ruleWithinLimit = "within_limit"
+	ruleBlocked     = "blocked"
+	ruleRateLimit   = "rate_limit_exceeded"
+)
+
+// defaultRouteName is the route of requests no configured route matches.
+const defaultRouteName = "default"
+
+// Policy is what decides the outcome of replayed requests.
+type Policy struct {
+	RequestsPerMinute int
+	BlockDuration     time.Duration
+	Routes            []Route
+}
+
+// Route is a configured route, see the routes of the proxy.
+type Route struct {
+	Name              string
+	PathPrefix        string
+	Methods           []string
+	RequestsPerMinute int
+	Preflight         bool
+	PerEndpoint       bool
+	Tag               bool
+}
+
+// Report counts the requests whose outcome changes.
+type Report struct {
+	// Requests is the number of records read, Replayed the number of them
+	// decided by routes and rate limits.
+	Requests int `json:"requests"`
+	Replayed int `json:"replayed"`
+	Changed  int `json:"changed"`
+	// Rerouted counts requests matching another route.
+	Rerouted int `json:"rerouted"`
+	// Transitions counts changed requests by old and new outcome, such as
+	// "allowed -> rejected".
+	Transitions map[string]int `json:"transitions"`
+	// Routes breaks the replayed requests down by their new route.
+	Routes map[string]*RouteReport `json:"routes"`
+	// Keys lists the client keys with the most changed requests, at most
+	// ten.
+	Keys []KeyReport `json:"keys,omitempty"`
+}
+
+// RouteReport counts the replayed and changed requests of a route.
+type RouteReport struct {
+	Requests int `json:"requests"`
+	Changed  int `json:"changed"`
+}
+
+// KeyReport counts the changed requests of a client key.
+type KeyReport struct {
+	Key     string `json:"key"`
+	Changed int    `json:"changed"`
+}
+
+// maxKeys bounds Report.Keys.
+const maxKeys = 10
+
+// Read reads decision log records, one JSON object per line, calling fn for
+// each of them.
+func Read(r io.Reader, fn func(decisionlog.Record)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record decisionlog.Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		fn(record)
+	}
+	return scanner.Err()
+}
+
+// Replay simulates an old and a proposed policy over the same requests.
+type Replay struct {
+	before, after *simulation
+	report        Report
+	changedKeys   map[string]int
+}
+
+// NewReplay returns a replay of old and proposed.
+func NewReplay(old, proposed Policy) *Replay {
+	return &Replay{
+		before:      newSimulation(old),
+		after:       newSimulation(proposed),
+		report:      Report{Transitions: make(map[string]int), Routes: make(map[string]*RouteReport)},
+		changedKeys: make(map[string]int),
+	}
+}
+
+// Add replays a record. Records must be added in the order they were
+// recorded.
+func (p *Replay) Add(record decisionlog.Record) {
+	p.report.Requests++
+	if !replayable(record) {
+		return
+	}
+	p.report.Replayed++
+	key := clientKey(record)
+	oldRoute, oldOutcome := p.before.decide(record, key)
+	newRoute, newOutcome := p.after.decide(record, key)
+
+	route := p.report.Routes[newRoute.Name]
+	if route == nil {
+		route = &RouteReport{}
+		p.report.Routes[newRoute.Name] = route
+	}
+	route.Requests++
+	if oldRoute.Name != newRoute.Name {
+		p.report.Rerouted++
+	}
+	if oldOutcome != newOutcome {
+		p.report.Changed++
+		route.Changed++
+		p.report.Transitions[oldOutcome+" -> "+newOutcome]++
+		p.changedKeys[key]++
+	}
+}
+
+// Report returns the changes of the records added so far.
+func (p *Replay) Report() *Report {
+	report := p.report
+	report.Keys = nil
+	for key, changed := range p.changedKeys {
+		report.Keys = append(report.Keys, KeyReport{Key: key, Changed: changed})
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		a, b := report.Keys[i], report.Keys[j]
+		if a.Changed != b.Changed {
+			return a.Changed > b.Changed
+		}
+		return a.Key < b.Key
+	})
+	if len(report.Keys) > maxKeys {
+		report.Keys = report.Keys[:maxKeys]
+	}
+	return &report
+}
+
+// replayable reports whether routes and rate limits decided the record.
+func replayable(record decisionlog.Record) bool {
+	switch record.Outcome {
+	case OutcomeAllowed:
+		return record.Rule == ruleWithinLimit
+	case OutcomeRejected, OutcomeTagged:
+		return record.Rule == ruleBlocked || record.Rule == ruleRateLimit
+	}
+	return false
+}
+
+// clientKey strips the route and endpoint the proxy prefixes the keys of
+// route limits with.
+func clientKey(record decisionlog.Record) string {
+	key, ok := strings.CutPrefix(record.Key, "route:"+record.Route+":")
+	if !ok {
+		return key
+	}
+	if record.Endpoint != "" {
+		key = strings.TrimPrefix(key, record.Endpoint+":")
+	}
+	return key
+}
+
+// simulation counts requests and blocks under one policy.
+type simulation struct {
+	policy   Policy
+	routes   []Route
+	windows  map[string]window
+	blocked  map[string]time.Time
+	fallback Route
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+func newSimulation(policy Policy) *simulation {
+	routes := append([]Route(nil), policy.Routes...)
+	// Same precedence as the proxy: preflight routes, then longer prefixes.
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.Preflight != b.Preflight {
+			return a.Preflight
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+	return &simulation{
+		policy:   policy,
+		routes:   routes,
+		windows:  make(map[string]window),
+		blocked:  make(map[string]time.Time),
+		fallback: Route{Name: defaultRouteName},
+	}
+}
+
+func (s *simulation) match(record decisionlog.Record) Route {
+	for _, route := range s.routes {
+		if !strings.HasPrefix(record.Path, route.PathPrefix) {
+			continue
+		}
+		if route.Preflight && record.Method != "OPTIONS" {
+			continue
+		}
+		if len(route.Methods) == 0 {
+			return route
+		}
+		for _, method := range route.Methods {
+			if strings.EqualFold(method, record.Method) {
+				return route
+			}
+		}
+	}
+	return s.fallback
+}
+
+// decide returns the route and outcome of the request of key.
+func (s *simulation) decide(record decisionlog.Record, key string) (Route, string) {
+	route := s.match(record)
+	limit := s.policy.RequestsPerMinute
+	if route.RequestsPerMinute > 0 || route.Preflight {
+		if route.PerEndpoint {
+			key = record.Endpoint + ":" + key
+		}
+		key = "route:" + route.Name + ":" + key
+		limit = route.RequestsPerMinute
+	}
+	if limit <= 0 {
+		limit = s.policy.RequestsPerMinute
+	}
+	rejected := OutcomeRejected
+	if route.Tag {
+		rejected = OutcomeTagged
+	}
+
+	now := record.Time
+	if until, ok := s.blocked[key]; ok {
+		if now.Before(until) {
+			return route, rejected
+		}
+		delete(s.blocked, key)
+	}
+	start := now.Truncate(time.Minute)
+	w := s.windows[key]
+	if !w.start.Equal(start) {
+		w = window{start: start}
+	}
+	w.count++
+	s.windows[key] = w
+	if w.count > limit {
+		s.blocked[key] = now.Add(s.policy.BlockDuration)
+		return route, rejected
+	}
+	return route, OutcomeAllowed
+}
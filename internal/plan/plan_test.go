@@ -0,0 +1,74 @@
+package plan
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/internal/decisionlog"
+)
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var records []decisionlog.Record
+	// Five logins and two API calls of one client within a minute, and a
+	// request rejected by another rule.
+	for i := 0; i < 5; i++ {
+		records = append(records, decisionlog.Record{Time: start.Add(time.Duration(i) * time.Second),
+			Key: "route:login:10.0.0.1", Route: "login", Method: "POST", Path: "/login", Outcome: OutcomeAllowed, Rule: ruleWithinLimit})
+	}
+	for i := 0; i < 2; i++ {
+		records = append(records, decisionlog.Record{Time: start.Add(10 * time.Second),
+			Key: "10.0.0.1", Route: "default", Method: "GET", Path: "/api/users", Outcome: OutcomeAllowed, Rule: ruleWithinLimit})
+	}
+	records = append(records, decisionlog.Record{Time: start.Add(20 * time.Second),
+		Key: "10.0.0.2", Route: "default", Method: "GET", Path: "/", Outcome: OutcomeRejected, Rule: "blocked_country"})
+
+	old := Policy{RequestsPerMinute: 100, BlockDuration: time.Hour,
+		Routes: []Route{{Name: "login", PathPrefix: "/login", RequestsPerMinute: 10}}}
+	proposed := Policy{RequestsPerMinute: 100, BlockDuration: time.Hour,
+		Routes: []Route{
+			{Name: "login", PathPrefix: "/login", RequestsPerMinute: 3},
+			{Name: "api", PathPrefix: "/api", RequestsPerMinute: 1, Tag: true},
+		}}
+
+	replay := NewReplay(old, proposed)
+	for _, record := range records {
+		replay.Add(record)
+	}
+	report := replay.Report()
+
+	if report.Requests != 8 || report.Replayed != 7 {
+		t.Errorf("expected 8 requests and 7 replayed, got %d and %d", report.Requests, report.Replayed)
+	}
+	if report.Changed != 3 || report.Rerouted != 2 {
+		t.Errorf("expected 3 changed and 2 rerouted, got %d and %d", report.Changed, report.Rerouted)
+	}
+	if report.Transitions["allowed -> rejected"] != 2 || report.Transitions["allowed -> tagged"] != 1 {
+		t.Errorf("unexpected transitions %v", report.Transitions)
+	}
+	if r := report.Routes["login"]; r == nil || r.Requests != 5 || r.Changed != 2 {
+		t.Errorf("unexpected login route %+v", r)
+	}
+	if len(report.Keys) != 1 || report.Keys[0] != (KeyReport{Key: "10.0.0.1", Changed: 3}) {
+		t.Errorf("unexpected keys %v", report.Keys)
+	}
+}
+
+func TestRead(t *testing.T) {
+	log := `{"ts":"2024-05-01T12:00:00Z","key":"10.0.0.1","route":"default","method":"GET","path":"/","outcome":"allowed","rule":"within_limit","score":0,"eval_us":12}
+
+{"ts":"2024-05-01T12:00:01Z","key":"10.0.0.2","route":"default","method":"GET","path":"/","outcome":"allowed","rule":"within_limit","score":0,"eval_us":9}
+`
+	var records []decisionlog.Record
+	if err := Read(strings.NewReader(log), func(r decisionlog.Record) { records = append(records, r) }); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if len(records) != 2 || records[1].Key != "10.0.0.2" {
+		t.Errorf("unexpected records %+v", records)
+	}
+
+	if err := Read(strings.NewReader("{\n"), func(decisionlog.Record) {}); err == nil || !strings.HasPrefix(err.Error(), "line 1") {
+		t.Errorf("expected an error on line 1, got %v", err)
+	}
+}
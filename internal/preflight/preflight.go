@@ -0,0 +1,139 @@
+// Package preflight runs the checks of the preflight command, which makes
+// sure that Shielder can start with a configuration before it does: that the
+// store answers, the upstream targets resolve and accept connections, and
+// databases and certificates load. It is meant to run as an init container
+// in front of the real process.
+package preflight
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Check is a single check.
+type Check struct {
+	// Component groups checks in the report, such as store or upstream.
+	Component string
+	// Name tells the checks of a component apart, such as the target
+	// checked.
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Component string        `json:"component"`
+	Name      string        `json:"name"`
+	Passed    bool          `json:"passed"`
+	Error     string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Run runs checks concurrently, each for at most timeout, and returns their
+// results in the order of checks.
+func Run(ctx context.Context, checks []Check, timeout time.Duration) []Result {
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := check.Run(checkCtx)
+			results[i] = Result{Component: check.Component, Name: check.Name, Passed: err == nil, Duration: time.Since(start)}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Failed returns the number of failed results.
+func Failed(results []Result) int {
+	failed := 0
+	for _, result := range results {
+		if !result.Passed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Print writes results as a table.
+func Print(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMPONENT\tCHECK\tRESULT\tTIME\tERROR")
+	for _, result := range results {
+		outcome := "pass"
+		if !result.Passed {
+			outcome = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Component, result.Name, outcome, result.Duration.Round(time.Millisecond), result.Error)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d of %d checks passed\n", len(results)-Failed(results), len(results))
+}
+
+// ProbeTarget resolves the host of an upstream URL and opens a TCP
+// connection to every address it resolves to.
+func ProbeTarget(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conn.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// CheckCertificate loads a certificate and its key, and checks that the
+// certificate is valid at now.
+func CheckCertificate(certFile, keyFile string, now time.Time) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package preflight
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	checks := []Check{
+		{Component: "store", Name: "redis", Run: func(context.Context) error { return nil }},
+		{Component: "upstream", Name: "slow", Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{Component: "geoip", Name: "country", Run: func(context.Context) error { return errors.New("not loaded") }},
+	}
+	results := Run(context.Background(), checks, 50*time.Millisecond)
+	if len(results) != 3 || !results[0].Passed || results[1].Passed || results[2].Error != "not loaded" {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	if got := Failed(results); got != 2 {
+		t.Errorf("Expected 2 failed checks, got %d", got)
+	}
+
+	var out bytes.Buffer
+	Print(&out, results)
+	if !strings.Contains(out.String(), "FAIL") || !strings.Contains(out.String(), "1 of 3 checks passed") {
+		t.Errorf("Unexpected report:\n%s", out.String())
+	}
+}
+
+func TestProbeTarget(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	ctx := context.Background()
+	if err := ProbeTarget(ctx, "http://"+addr); err != nil {
+		t.Errorf("Expected the listening target to pass, got %v", err)
+	}
+	l.Close()
+	if err := ProbeTarget(ctx, "http://"+addr); err == nil {
+		t.Error("Expected a closed port to fail")
+	}
+}
+
+func TestCheckCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	if err := CheckCertificate(certFile, keyFile, time.Now()); err != nil {
+		t.Errorf("Expected a valid certificate, got %v", err)
+	}
+	if err := CheckCertificate(certFile, keyFile, notAfter.Add(time.Minute)); err == nil {
+		t.Error("Expected an expired certificate to fail")
+	}
+	if err := CheckCertificate(certFile, filepath.Join(dir, "missing.pem"), time.Now()); err == nil {
+		t.Error("Expected a missing key to fail")
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+)
+
+// AccessLog writes one line per request once its response was sent, with the
+// status and byte count the client actually received. The combined format is
+// the Apache/nginx one followed by the latency in milliseconds and the
+// upstream, so that the usual tools parse it.
+type AccessLog struct {
+	format string
+	mu     sync.Mutex
+	out    io.Writer
+}
+
+// NewAccessLog returns an access log writing to out in format, JSON unless it
+// is AccessLogCombined.
+func NewAccessLog(out io.Writer, format string) *AccessLog {
+	if format != AccessLogCombined {
+		format = AccessLogJSON
+	}
+	return &AccessLog{format: format, out: out}
+}
+
+type accessEntryKey struct{}
+
+// accessEntry collects what only the inner handlers learn about a request.
+type accessEntry struct {
+	route    string
+	upstream string
+}
+
+// accessEntryFrom returns the access log entry of the request, nil when
+// access logging is off.
+func accessEntryFrom(ctx context.Context) *accessEntry {
+	entry, _ := ctx.Value(accessEntryKey{}).(*accessEntry)
+	return entry
+}
+
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMS float64   `json:"latency_ms"`
+	Route     string    `json:"route,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+}
+
+// accessLogged wraps next so that every request it serves is written to the
+// access log.
+func (s *Server) accessLogged(next http.Handler) http.Handler {
+	if s.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry))
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		status := sw.status
+		if status == 0 {
+			// Nothing was written, net/http sends an empty 200.
+			status = http.StatusOK
+		}
+		s.accessLog.write(accessRecord{
+			Time:      start,
+			ClientIP:  s.clientIP(r),
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Protocol:  r.Proto,
+			Status:    status,
+			Bytes:     sw.bytes,
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			Route:     entry.route,
+			Upstream:  entry.upstream,
+			UserAgent: r.UserAgent(),
+			Referer:   r.Referer(),
+		})
+	})
+}
+
+func (l *AccessLog) write(rec accessRecord) {
+	var line []byte
+	if l.format == AccessLogCombined {
+		bytes := "-"
+		if rec.Bytes > 0 {
+			bytes = fmt.Sprint(rec.Bytes)
+		}
+		line = fmt.Appendf(nil, "%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" %.3f \"%s\"\n",
+			rec.ClientIP, rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			rec.Method, escapeQuotes(rec.Path), rec.Protocol, rec.Status, bytes,
+			orDash(escapeQuotes(rec.Referer)), orDash(escapeQuotes(rec.UserAgent)),
+			rec.LatencyMS, orDash(rec.Upstream))
+	} else {
+		line, _ = json.Marshal(rec)
+		line = append(line, '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+func escapeQuotes(s string) string {
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogged(t *testing.T) {
+	var out bytes.Buffer
+	s := &Server{accessLog: NewAccessLog(&out, AccessLogJSON)}
+	h := s.accessLogged(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := accessEntryFrom(r.Context())
+		entry.route, entry.upstream = "api", "backend:3000"
+		http.Error(w, "boom", http.StatusBadGateway)
+	}))
+
+	r := httptest.NewRequest("GET", "/users?id=1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "curl/8.0")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var rec accessRecord
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatalf("invalid JSON line %q: %v", out.String(), err)
+	}
+	if rec.Status != http.StatusBadGateway || rec.Bytes != 5 {
+		t.Errorf("expected the status and bytes sent, got %d and %d", rec.Status, rec.Bytes)
+	}
+	if rec.ClientIP != "192.0.2.1" || rec.Path != "/users?id=1" || rec.Route != "api" ||
+		rec.Upstream != "backend:3000" || rec.UserAgent != "curl/8.0" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	var out bytes.Buffer
+	s := &Server{accessLog: NewAccessLog(&out, AccessLogCombined)}
+	h := s.accessLogged(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", `say "hi"`)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	line := out.String()
+	if !strings.HasPrefix(line, "192.0.2.1 - - [") || !strings.HasSuffix(line, "\"-\"\n") {
+		t.Errorf("unexpected line %q", line)
+	}
+	// Nothing written is an empty 200, quotes in headers are escaped.
+	if !strings.Contains(line, `"POST /login HTTP/1.1" 200 - "-" "say \"hi\"" `) {
+		t.Errorf("unexpected line %q", line)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/auth"
+)
+
+// countingBody counts the request body bytes the upstream transport reads.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// accounted wraps w and the body of r for accounting. The returned function
+// accounts the request to its authenticated subject once it was forwarded;
+// unauthenticated requests are not accounted.
+func (s *Server) accounted(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	identity := auth.FromContext(r.Context())
+	if s.accountant == nil || identity == nil {
+		return w, func() {}
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	var body *countingBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	return sw, func() {
+		var bytesIn int64
+		if body != nil {
+			bytesIn = body.n
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.accountant.Add(identity.Subject, status, bytesIn, sw.bytes)
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/knakul853/shielder/internal/audit"
+	"github.com/knakul853/shielder/plugin"
+)
+
+// auditRequest hands the metadata of a served request to the audit sampler.
+func (s *Server) auditRequest(r *http.Request, route *Route, clientIP, endpoint string, sw *statusWriter, start time.Time) {
+	record := audit.Record{
+		Time:          start,
+		ClientIP:      clientIP,
+		Route:         route.Name,
+		Endpoint:      endpoint,
+		Method:        r.Method,
+		Host:          r.Host,
+		Path:          r.URL.Path,
+		Query:         r.URL.RawQuery,
+		Proto:         r.Proto,
+		Request:       r.Header,
+		RequestBytes:  r.ContentLength,
+		Status:        sw.status,
+		Response:      sw.Header(),
+		ResponseBytes: sw.bytes,
+		DurationMicro: time.Since(start).Microseconds(),
+	}
+	if d := plugin.DecisionFromContext(r.Context()); d != nil {
+		record.Key, record.Outcome, record.Rule, record.Rules, record.Score = d.Key, d.Outcome, d.Reason, d.Rules, d.Score
+	}
+	s.audit.Write(record)
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+// errSlowBody is returned while reading a request body that exceeded its
+// timeout or fell below the minimum upload rate.
+var errSlowBody = errors.New("proxy: request body too slow")
+
+// BodyPolicy controls how a route reads request bodies. The zero value
+// streams bodies to the upstream as they arrive.
+type BodyPolicy struct {
+	// Buffer reads the whole body once the protection checks passed, so
+	// that authentication and upstream-stage plugins can inspect all of it.
+	// Bodies over MaxBufferBytes are rejected with 413.
+	Buffer         bool
+	MaxBufferBytes int64
+	// Timeout bounds how long reading the body may take.
+	Timeout time.Duration
+	// MinRate is the minimum average upload rate in bytes per second that
+	// clients have to keep up once Grace has passed, which cuts off
+	// slow-body attacks.
+	MinRate int64
+	Grace   time.Duration
+}
+
+func (p BodyPolicy) enabled() bool {
+	return p.Buffer || p.Timeout > 0 || p.MinRate > 0
+}
+
+// readBody applies the body policy of a route. Bodies that are too slow are
+// answered with 408, either here while buffering or by proxyError while
+// streaming.
+func (s *Server) readBody(policy BodyPolicy, next http.Handler) http.Handler {
+	if !policy.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if policy.Timeout > 0 || policy.MinRate > 0 {
+			r.Body = &deadlineBody{
+				ReadCloser: r.Body,
+				rc:         http.NewResponseController(w),
+				policy:     policy,
+				start:      time.Now(),
+			}
+		}
+		if !policy.Buffer {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, policy.MaxBufferBytes+1))
+		r.Body.Close()
+		if errors.Is(err, errSlowBody) {
+			http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+			return
+		}
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			s.rejectLargeBody(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > policy.MaxBufferBytes {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		r.ContentLength = int64(len(body))
+		r.TransferEncoding = nil
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody rejects request bodies over maxBodyBytes with 413 and reports
+// whether the request may go on. Bodies that announce a larger
+// Content-Length are rejected before any of them is read, others once reading
+// them passes the limit, which proxyError answers while forwarding.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) bool {
+	if s.maxBodyBytes <= 0 {
+		return true
+	}
+	if r.ContentLength > s.maxBodyBytes {
+		s.rejectLargeBody(w, r)
+		return false
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	}
+	return true
+}
+
+func (s *Server) rejectLargeBody(w http.ResponseWriter, r *http.Request) {
+	route := ""
+	if decision := plugin.DecisionFromContext(r.Context()); decision != nil {
+		route = decision.Route
+	}
+	s.metrics.IncBodyTooLarge(route)
+	http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+}
+
+// deadlineBody moves the read deadline of the connection along with the
+// bytes received, so that a read blocks at most until the client falls
+// behind the minimum rate or the body timeout passes.
+type deadlineBody struct {
+	io.ReadCloser
+	rc     *http.ResponseController
+	policy BodyPolicy
+	start  time.Time
+	read   int64
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	deadline := b.deadline()
+	if time.Now().After(deadline) {
+		return 0, errSlowBody
+	}
+	// Connections that do not support deadlines are bounded by the server
+	// read timeout only.
+	b.rc.SetReadDeadline(deadline)
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, errSlowBody
+	}
+	if err == io.EOF {
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// deadline is when the next byte has to arrive at the latest.
+func (b *deadlineBody) deadline() time.Time {
+	var deadline time.Time
+	if b.policy.Timeout > 0 {
+		deadline = b.start.Add(b.policy.Timeout)
+	}
+	if b.policy.MinRate > 0 {
+		due := b.start.Add(b.policy.Grace + time.Duration(float64(b.read+1)/float64(b.policy.MinRate)*float64(time.Second)))
+		if deadline.IsZero() || due.Before(deadline) {
+			deadline = due
+		}
+	}
+	return deadline
+}
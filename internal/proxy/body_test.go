@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/internal/trust"
+)
+
+func TestReadBodyBuffer(t *testing.T) {
+	policy := BodyPolicy{Buffer: true, MaxBufferBytes: 10}
+	h := (&Server{}).readBody(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d:%s", r.ContentLength, body)
+	}))
+
+	tests := []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{"hello", http.StatusOK, "5:hello"},
+		{"0123456789", http.StatusOK, "10:0123456789"},
+		{"0123456789a", http.StatusRequestEntityTooLarge, ""},
+	}
+
+	for _, tt := range tests {
+		// Hide the length so the body arrives chunked.
+		req := httptest.NewRequest(http.MethodPost, "/upload", io.MultiReader(strings.NewReader(tt.body)))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.body, tt.status, rec.Code)
+		}
+		if tt.want != "" && rec.Body.String() != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.body, tt.want, rec.Body.String())
+		}
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	s := &Server{maxBodyBytes: 10}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.limitBody(w, r) {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Write(body)
+	})
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{"hello", http.StatusOK},
+		{"0123456789", http.StatusOK},
+		{"0123456789a", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		// Hide the length so the limit applies while reading.
+		req := httptest.NewRequest(http.MethodPost, "/upload", io.MultiReader(strings.NewReader(tt.body)))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.body, tt.status, rec.Code)
+		}
+		if tt.status == http.StatusOK && rec.Body.String() != tt.body {
+			t.Errorf("%q: expected the body to pass unchanged, got %q", tt.body, rec.Body.String())
+		}
+	}
+}
+
+func TestReadBodyMinRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer bool
+	}{
+		{"buffered", true},
+		{"streamed", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := BodyPolicy{Buffer: tt.buffer, MaxBufferBytes: 1 << 10, MinRate: 100, Grace: 50 * time.Millisecond}
+			srv := httptest.NewServer((&Server{}).readBody(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := io.ReadAll(r.Body); errors.Is(err, errSlowBody) {
+					http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			})))
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+			// Announce 100 bytes but send only one of them.
+			fmt.Fprint(conn, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\n\r\nx")
+
+			start := time.Now()
+			conn.SetReadDeadline(start.Add(5 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if resp.StatusCode != http.StatusRequestTimeout {
+				t.Errorf("Expected status 408, got %d", resp.StatusCode)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Expected the slow upload to be cut off quickly, took %v", elapsed)
+			}
+		})
+	}
+}
+
+// readRecorder is a request body that notes whether it was read.
+type readRecorder struct {
+	io.Reader
+	read bool
+}
+
+func (b *readRecorder) Read(p []byte) (int, error) {
+	b.read = true
+	return b.Reader.Read(p)
+}
+
+func TestBlockedBodyIsNotRead(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, Config{
+		TargetURL: upstream.URL,
+		Routes:    []Route{{Name: "upload", PathPrefix: "/upload", Body: BodyPolicy{Buffer: true, MaxBufferBytes: 1 << 10}}},
+	}, 100)
+
+	send := func(remote string) (*readRecorder, int) {
+		body := &readRecorder{Reader: strings.NewReader("payload")}
+		r := httptest.NewRequest(http.MethodPost, "/upload", body)
+		r.RemoteAddr = remote
+		return body, serveTest(s, r).Code
+	}
+	if body, code := send("198.51.100.1:1234"); code != http.StatusOK || !body.read || received != "payload" {
+		t.Fatalf("Expected the body to be forwarded, got %d and %q", code, received)
+	}
+
+	if err := s.rateLimiter.Block(context.Background(), "198.51.100.2", time.Hour, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if body, code := send("198.51.100.2:1234"); code != http.StatusTooManyRequests || body.read {
+		t.Errorf("Expected the blocked client to be rejected without reading its body, got %d (read %v)", code, body.read)
+	}
+}
+
+func TestBodyLimitThroughChain(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+	trusted, err := trust.New([]trust.Identity{{Name: "monitoring", CIDRs: []string{"192.0.2.0/24"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{
+		TargetURL:           upstream.URL,
+		MaxRequestBodyBytes: 10,
+		Trusted:             trusted,
+	}, 100)
+
+	tests := []struct {
+		name   string
+		remote string
+		body   string
+		// hideLength streams the body, so that the limit is only hit while
+		// forwarding and answered by proxyError.
+		hideLength bool
+		status     int
+	}{
+		{name: "Small body", remote: "198.51.100.1:1234", body: "payload", status: http.StatusOK},
+		{name: "Announced oversized body", remote: "198.51.100.1:1234", body: "0123456789a", status: http.StatusRequestEntityTooLarge},
+		{name: "Streamed oversized body", remote: "198.51.100.1:1234", body: strings.Repeat("x", 1<<10), hideLength: true, status: http.StatusRequestEntityTooLarge},
+		{name: "Trusted oversized body", remote: "192.0.2.1:1234", body: "0123456789a", status: http.StatusRequestEntityTooLarge},
+		{name: "Trusted streamed oversized body", remote: "192.0.2.1:1234", body: strings.Repeat("x", 1<<10), hideLength: true, status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upload", io.MultiReader(strings.NewReader(tt.body)))
+			r.RemoteAddr = tt.remote
+			if !tt.hideLength {
+				r.ContentLength = int64(len(tt.body))
+			}
+			rec := serveTest(s, r)
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != tt.body {
+				t.Errorf("Expected the body to be forwarded, got %q", rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BreakerPolicy opens the circuit of a route when too many of its requests
+// fail upstream, answering them with 503 instead of piling more load on a
+// failing upstream. Failures are 5xx responses and transport errors,
+// timeouts included; requests the client abandoned are not counted.
+//
+// While open, requests are rejected for OpenDuration. The circuit is
+// half-open then, letting HalfOpenProbes requests through: it closes when
+// they all succeed and opens again on the first failure.
+type BreakerPolicy struct {
+	// Window is how far back failures are counted, 10s by default
+	Window time.Duration
+	// MinRequests in the window are needed before the circuit opens, 20 by
+	// default
+	MinRequests int
+	// FailureRatio of the requests in the window opens the circuit, 0.5 by
+	// default
+	FailureRatio float64
+	// OpenDuration is how long the circuit stays open, 30s by default
+	OpenDuration time.Duration
+	// HalfOpenProbes is how many requests are let through to probe the
+	// upstream, 5 by default
+	HalfOpenProbes int
+	// FallbackBody, when set, is sent with the 503 responses of an open
+	// circuit, with FallbackContentType
+	FallbackBody        []byte
+	FallbackContentType string
+}
+
+// BreakerState is the state of the circuit of a route.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// BreakerStatus describes the circuit of a route.
+type BreakerStatus struct {
+	Route string       `json:"route"`
+	State BreakerState `json:"state"`
+	// Requests and Failures are counted in the window of a closed circuit.
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+	// OpenedAt is when the circuit last opened.
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// breakerBuckets split the window, so that it slides in steps of a tenth.
+const breakerBuckets = 10
+
+type breakerBucket struct {
+	// epoch is the window step the counts belong to
+	epoch              int64
+	requests, failures int
+}
+
+// breaker is the circuit of one route.
+type breaker struct {
+	policy   BreakerPolicy
+	onChange func(BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	buckets  [breakerBuckets]breakerBucket
+	openedAt time.Time
+	// probes is how many requests were let through while half-open, and
+	// succeeded how many of them succeeded
+	probes, succeeded int
+}
+
+func newBreaker(policy BreakerPolicy, onChange func(BreakerState)) *breaker {
+	if policy.Window <= 0 {
+		policy.Window = 10 * time.Second
+	}
+	if policy.MinRequests <= 0 {
+		policy.MinRequests = 20
+	}
+	if policy.FailureRatio <= 0 {
+		policy.FailureRatio = 0.5
+	}
+	if policy.OpenDuration <= 0 {
+		policy.OpenDuration = 30 * time.Second
+	}
+	if policy.HalfOpenProbes <= 0 {
+		policy.HalfOpenProbes = 5
+	}
+	return &breaker{policy: policy, onChange: onChange, state: BreakerClosed}
+}
+
+// allow reports whether a request may go upstream now, and otherwise how
+// long the circuit stays open.
+func (b *breaker) allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if left := b.openedAt.Add(b.policy.OpenDuration).Sub(now); left > 0 {
+			return false, left
+		}
+		b.probes, b.succeeded = 1, 0
+		b.setState(BreakerHalfOpen)
+		return true, 0
+	case BreakerHalfOpen:
+		if b.probes >= b.policy.HalfOpenProbes {
+			return false, 0
+		}
+		b.probes++
+	}
+	return true, 0
+}
+
+// record counts the outcome of a request allow let through.
+func (b *breaker) record(now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		bucket := b.bucket(now)
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+		requests, failures := b.counts(now)
+		if requests >= b.policy.MinRequests && float64(failures) >= b.policy.FailureRatio*float64(requests) {
+			b.open(now)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.open(now)
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.policy.HalfOpenProbes {
+			b.reset()
+		}
+	}
+	// Requests that were in flight when the circuit opened are ignored.
+}
+
+// cancel gives back the probe of a request whose outcome says nothing about
+// the upstream.
+func (b *breaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.probes > b.succeeded {
+		b.probes--
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.openedAt = now
+	b.setState(BreakerOpen)
+}
+
+// reset closes the circuit with an empty window.
+func (b *breaker) reset() {
+	b.buckets = [breakerBuckets]breakerBucket{}
+	b.setState(BreakerClosed)
+}
+
+func (b *breaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
+
+// bucket returns the bucket of now, emptied when it belonged to an earlier
+// step.
+func (b *breaker) bucket(now time.Time) *breakerBucket {
+	epoch := now.UnixNano() / int64(b.policy.Window/breakerBuckets)
+	bucket := &b.buckets[epoch%breakerBuckets]
+	if bucket.epoch != epoch {
+		*bucket = breakerBucket{epoch: epoch}
+	}
+	return bucket
+}
+
+// counts sums the buckets within the window.
+func (b *breaker) counts(now time.Time) (requests, failures int) {
+	epoch := now.UnixNano() / int64(b.policy.Window/breakerBuckets)
+	for _, bucket := range b.buckets {
+		if epoch-bucket.epoch < breakerBuckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+func (b *breaker) status(route string) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{Route: route, State: b.state}
+	if !b.openedAt.IsZero() {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if b.state == BreakerClosed {
+		status.Requests, status.Failures = b.counts(time.Now())
+	}
+	return status
+}
+
+// circuit rejects requests while the circuit of the route is open and
+// records the outcome of the others.
+func (s *Server) circuit(route *Route, next http.Handler) http.Handler {
+	b := newBreaker(*s.breakerPolicy, func(state BreakerState) {
+		s.metrics.SetBreakerState(route.Name, string(state))
+		s.logger.WithFields(logrus.Fields{"route": route.Name, "state": state}).Warn("Circuit breaker changed state")
+	})
+	s.breakers[route.Name] = b
+	s.metrics.SetBreakerState(route.Name, string(BreakerClosed))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := b.allow(time.Now())
+		if !ok {
+			s.metrics.IncBreakerRejected(route.Name)
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+			}
+			if body := s.breakerPolicy.FallbackBody; body != nil {
+				w.Header().Set("Content-Type", s.breakerPolicy.FallbackContentType)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write(body)
+				return
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		// Deferred, so that probes are accounted for when next panics.
+		defer func() {
+			if r.Context().Err() != nil {
+				// The client went away, which says nothing about the upstream.
+				b.cancel()
+				return
+			}
+			// Nothing is written when the upstream breaks off a response.
+			b.record(time.Now(), sw.status == 0 || sw.status >= http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// Breakers returns the circuits of the routes, empty when circuit breaking
+// is disabled.
+func (s *Server) Breakers() []BreakerStatus {
+	statuses := make([]BreakerStatus, 0, len(s.breakers))
+	for _, route := range s.routes.all() {
+		if b, ok := s.breakers[route.Name]; ok {
+			statuses = append(statuses, b.status(route.Name))
+		}
+	}
+	return statuses
+}
+
+// ResetBreaker closes the circuit of route, reporting false when the route
+// has none.
+func (s *Server) ResetBreaker(route string) (BreakerStatus, bool) {
+	b, ok := s.breakers[route]
+	if !ok {
+		return BreakerStatus{}, false
+	}
+	b.mu.Lock()
+	b.reset()
+	b.mu.Unlock()
+	return b.status(route), true
+}
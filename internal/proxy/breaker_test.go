@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	var states []BreakerState
+	b := newBreaker(BreakerPolicy{
+		Window:         10 * time.Second,
+		MinRequests:    4,
+		FailureRatio:   0.5,
+		OpenDuration:   30 * time.Second,
+		HalfOpenProbes: 2,
+	}, func(state BreakerState) { states = append(states, state) })
+	now := time.Unix(1700000000, 0)
+
+	// Failures below the minimum number of requests keep the circuit closed.
+	for range 3 {
+		b.allow(now)
+		b.record(now, true)
+	}
+	if b.state != BreakerClosed {
+		t.Fatalf("expected the circuit to stay closed below the minimum, got %s", b.state)
+	}
+	// Failures that slid out of the window are not counted.
+	now = now.Add(11 * time.Second)
+	b.record(now, false)
+	b.record(now, false)
+	b.record(now, true)
+	if b.state != BreakerClosed {
+		t.Fatalf("expected old failures to be forgotten, got %s", b.state)
+	}
+	b.record(now, true)
+	if b.state != BreakerOpen {
+		t.Fatalf("expected the circuit to open at half failures, got %s", b.state)
+	}
+
+	if ok, retryAfter := b.allow(now.Add(10 * time.Second)); ok || retryAfter != 20*time.Second {
+		t.Errorf("expected requests to be rejected for 20s more, got %v %v", ok, retryAfter)
+	}
+
+	// Once open long enough, probes go through, and no more than that.
+	now = now.Add(30 * time.Second)
+	if ok, _ := b.allow(now); !ok || b.state != BreakerHalfOpen {
+		t.Fatalf("expected a probe in the half-open state, got %v %s", ok, b.state)
+	}
+	if ok, _ := b.allow(now); !ok {
+		t.Fatal("expected a second probe")
+	}
+	if ok, _ := b.allow(now); ok {
+		t.Fatal("expected requests beyond the probes to be rejected")
+	}
+	// A probe the client abandoned is given back.
+	b.cancel()
+	if ok, _ := b.allow(now); !ok {
+		t.Fatal("expected the abandoned probe to be given back")
+	}
+	b.record(now, false)
+	b.record(now, true)
+	if b.state != BreakerOpen {
+		t.Fatalf("expected a failed probe to open the circuit again, got %s", b.state)
+	}
+
+	now = now.Add(30 * time.Second)
+	b.allow(now)
+	b.allow(now)
+	b.record(now, false)
+	b.record(now, false)
+	if b.state != BreakerClosed {
+		t.Fatalf("expected successful probes to close the circuit, got %s", b.state)
+	}
+	if requests, _ := b.counts(now); requests != 0 {
+		t.Errorf("expected a closed circuit to start with an empty window, got %d requests", requests)
+	}
+
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(states) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, states)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("expected transitions %v, got %v", want, states)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/bypass"
+	"github.com/sirupsen/logrus"
+)
+
+// verifyBypass returns the claims of a valid bypass token presented with r,
+// or nil. Every use is logged for the audit trail, and so are rejected tokens
+// that Shielder issued; forged and expired ones only at debug level.
+func (s *Server) verifyBypass(r *http.Request, clientIP string) *bypass.Claims {
+	claims, err := s.bypass.Verify(r.Context(), r)
+	if errors.Is(err, bypass.ErrNoToken) {
+		return nil
+	}
+	switch {
+	case errors.Is(err, bypass.ErrInvalidToken), errors.Is(err, bypass.ErrExpired):
+		// Anyone can send garbage in the header, only tokens that were
+		// issued are worth a warning.
+		s.logger.WithError(err).WithField("client_ip", clientIP).Debug("Rejected bypass token")
+		return nil
+	case err != nil:
+		s.logger.WithError(err).WithField("client_ip", clientIP).Warn("Rejected bypass token")
+		return nil
+	}
+	s.logger.WithFields(logrus.Fields{
+		"client_ip": clientIP,
+		"token":     claims.ID,
+		"subject":   claims.Subject,
+		"issued_by": claims.IssuedBy,
+		"method":    r.Method,
+		"path":      r.URL.Path,
+	}).Info("Request bypassed protection")
+	return claims
+}
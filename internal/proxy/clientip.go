@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Client IP headers the resolver understands.
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// ClientIPResolver finds the address of the client behind trusted proxies,
+// such as a load balancer. Headers are only read when the peer is a trusted
+// proxy, since anyone else can send them.
+type ClientIPResolver struct {
+	// TrustedProxies are the networks of proxies whose headers are believed.
+	TrustedProxies []netip.Prefix
+	// Headers are read in order until one yields an address. Only list
+	// headers the trusted proxies set or append to, a header they pass on
+	// untouched is chosen by the client.
+	Headers []string
+}
+
+// DefaultClientIPHeaders are read when no headers are configured.
+var DefaultClientIPHeaders = []string{HeaderXForwardedFor, HeaderXRealIP}
+
+// ClientIP returns the address of the client that sent r. Forwarded and
+// X-Forwarded-For are walked from the right, skipping trusted proxies, so
+// that addresses the client prepended itself are ignored.
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+	peer := remoteHost(r.RemoteAddr)
+	if !c.trusted(peer) {
+		return peer
+	}
+	headers := c.Headers
+	if len(headers) == 0 {
+		headers = DefaultClientIPHeaders
+	}
+	for _, header := range headers {
+		var hops []string
+		switch http.CanonicalHeaderKey(header) {
+		case HeaderForwarded:
+			hops = forwardedFor(r.Header.Values(HeaderForwarded))
+		case http.CanonicalHeaderKey(HeaderXRealIP):
+			if value := strings.TrimSpace(r.Header.Get(HeaderXRealIP)); value != "" {
+				hops = []string{value}
+			}
+		default:
+			for _, value := range r.Header.Values(header) {
+				hops = append(hops, strings.Split(value, ",")...)
+			}
+		}
+		if ip, ok := c.walk(hops); ok {
+			return ip
+		}
+	}
+	return peer
+}
+
+// walk returns the rightmost hop that is not a trusted proxy, or the leftmost
+// one when all are trusted. Hops that are not addresses end the walk, since
+// nothing left of them can be believed.
+func (c *ClientIPResolver) walk(hops []string) (string, bool) {
+	var last string
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		last = addr.String()
+		if !c.trusted(last) {
+			return last, true
+		}
+	}
+	return last, last != ""
+}
+
+func (c *ClientIPResolver) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHop parses an address as it appears in forwarding headers: bare, with
+// a port, or as a bracketed IPv6 address with or without one.
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 Forwarded headers in
+// order. Elements without one, or with an obfuscated identifier, yield an
+// empty hop, which ends the walk.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hop = val
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// ParseTrustedProxies parses CIDRs and single addresses, which stand for
+// themselves.
+func ParseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
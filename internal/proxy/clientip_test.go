@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &ClientIPResolver{TrustedProxies: trusted, Headers: []string{HeaderForwarded, HeaderXForwardedFor, HeaderXRealIP}}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer", "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.9"},
+		{"trusted peer without headers", "10.0.0.5:1234", nil, "10.0.0.5"},
+		{"x-forwarded-for", "10.0.0.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed prefix", "10.0.0.5:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.7"}, "198.51.100.1"},
+		{"all trusted", "10.0.0.5:1234", map[string]string{"X-Forwarded-For": "10.0.0.8, 10.0.0.7"}, "10.0.0.8"},
+		{"garbage ends the walk", "10.0.0.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, nonsense, 10.0.0.7"}, "10.0.0.7"},
+		{"single trusted address", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"forwarded", "10.0.0.5:1234", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8::1]:4711"`}, "198.51.100.1"},
+		{"forwarded ipv6", "[2001:db8::2]:443", map[string]string{"Forwarded": `for="[2001:db9::1]:4711"`}, "2001:db9::1"},
+		{"x-real-ip", "10.0.0.5:1234", map[string]string{"X-Real-IP": "198.51.100.3"}, "198.51.100.3"},
+		{"invalid x-real-ip", "10.0.0.5:1234", map[string]string{"X-Real-IP": "unknown"}, "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := resolver.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientKeyedWithoutPort(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	s := newTestServer(t, Config{TargetURL: upstream.URL}, 1)
+
+	// A client opening a new connection, and so a new source port, is still
+	// the same client.
+	for i, remote := range []string{"198.51.100.1:40000", "198.51.100.1:40001"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		want := []int{http.StatusOK, http.StatusTooManyRequests}[i]
+		if got := serveTest(s, r).Code; got != want {
+			t.Errorf("Request from %s: expected %d, got %d", remote, want, got)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "[2001:db8::1]:40000"
+	if got := s.clientIP(r); got != "2001:db8::1" {
+		t.Errorf("Expected the IPv6 address without the port, got %q", got)
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/auth"
+)
+
+// Key strategies select the request attribute clients are rate limited by.
+const (
+	KeyByIP     = "ip"
+	KeyByHeader = "header"
+	KeyByJWT    = "jwt"
+	KeyByCookie = "cookie"
+)
+
+// KeyStrategy selects the request attribute clients are rate limited by.
+// Requests without the attribute are limited by their IP, so that leaving it
+// out does not escape the limit.
+//
+// Header and cookie values are not verified, a client sending a different
+// value with every request gets a fresh budget each time. Keying by JWT uses
+// the subject of tokens the authenticator verified.
+type KeyStrategy struct {
+	// Kind is one of the KeyBy constants, empty keys by IP.
+	Kind string
+	// Name is the header or cookie holding the key.
+	Name string
+}
+
+// limitKey returns the key the request is rate limited by. Header and cookie
+// values are hashed, since they are often credentials and keys end up in the
+// store, logs and the admin API.
+func (s *Server) limitKey(r *http.Request, clientIP string) string {
+	return s.keyNamespace + s.strategyKey(r, clientIP)
+}
+
+func (s *Server) strategyKey(r *http.Request, clientIP string) string {
+	switch s.keyStrategy.Kind {
+	case KeyByHeader:
+		if value := r.Header.Get(s.keyStrategy.Name); value != "" {
+			return "header:" + hashKey(value)
+		}
+	case KeyByCookie:
+		if cookie, err := r.Cookie(s.keyStrategy.Name); err == nil && cookie.Value != "" {
+			return "cookie:" + hashKey(cookie.Value)
+		}
+	case KeyByJWT:
+		if s.auth == nil {
+			break
+		}
+		if identity, err := s.auth.Authenticate(r); err == nil && identity.Method == auth.MethodJWT && identity.Subject != "" {
+			return "sub:" + identity.Subject
+		}
+	}
+	return clientIP
+}
+
+func hashKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitKey(t *testing.T) {
+	header := &Server{keyStrategy: KeyStrategy{Kind: KeyByHeader, Name: "X-API-Key"}}
+	r := httptest.NewRequest("GET", "/api", nil)
+	if got := header.limitKey(r, "10.0.0.1"); got != "10.0.0.1" {
+		t.Errorf("Expected requests without the header to be keyed by IP, got %q", got)
+	}
+	r.Header.Set("X-API-Key", "secret-key")
+	key := header.limitKey(r, "10.0.0.1")
+	if !strings.HasPrefix(key, "header:") || strings.Contains(key, "secret-key") {
+		t.Errorf("Expected a hashed header key, got %q", key)
+	}
+	if other := header.limitKey(r, "10.0.0.2"); other != key {
+		t.Errorf("Expected the same key from another IP, got %q and %q", key, other)
+	}
+
+	cookie := &Server{keyStrategy: KeyStrategy{Kind: KeyByCookie, Name: "sid"}}
+	r = httptest.NewRequest("GET", "/api", nil)
+	r.AddCookie(&http.Cookie{Name: "sid", Value: "abc"})
+	if got := cookie.limitKey(r, "10.0.0.1"); !strings.HasPrefix(got, "cookie:") {
+		t.Errorf("Expected a cookie key, got %q", got)
+	}
+
+	jwt := &Server{keyStrategy: KeyStrategy{Kind: KeyByJWT}}
+	r.Header.Set("Authorization", "Bearer x.y.z")
+	if got := jwt.limitKey(r, "10.0.0.1"); got != "10.0.0.1" {
+		t.Errorf("Expected unverified tokens to be keyed by IP, got %q", got)
+	}
+
+	namespaced := &Server{keyStrategy: header.keyStrategy, keyNamespace: "profile:billing:"}
+	r.Header.Set("X-API-Key", "secret-key")
+	if got := namespaced.limitKey(r, "10.0.0.1"); got != "profile:billing:"+key {
+		t.Errorf("Expected the key in the namespace, got %q", got)
+	}
+}
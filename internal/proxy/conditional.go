@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"container/list"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isLight reports whether r is a HEAD request or a conditional GET. Clients
+// polling for changes send these, and they cost the upstream little.
+func isLight(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodHead:
+		return true
+	case http.MethodGet:
+		return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+	}
+	return false
+}
+
+// requestCost returns what r counts as against the rate limits.
+func (s *Server) requestCost(r *http.Request) int {
+	if isLight(r) {
+		return s.lightCost
+	}
+	return s.fullCost
+}
+
+// ConditionalCache remembers the headers of recent GET responses, so that
+// HEAD requests and conditional GETs for the same URL are answered without
+// reaching the upstream while the headers are fresh. Only responses a shared
+// cache may store are remembered: no Set-Cookie, no Vary, no private,
+// no-store or no-cache, and requests with credentials only when the response
+// is public.
+type ConditionalCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the entries, most recently stored first
+	order *list.List
+}
+
+type conditionalEntry struct {
+	key          string
+	header       http.Header
+	etag         string
+	lastModified time.Time
+	stored       time.Time
+	expires      time.Time
+}
+
+// NewConditionalCache returns a cache keeping up to maxEntries responses,
+// 10000 when zero, for ttl at most, less when their Cache-Control says so.
+func NewConditionalCache(ttl time.Duration, maxEntries int) *ConditionalCache {
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	return &ConditionalCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Results of looking up a light request in the conditional cache.
+const (
+	conditionalHit  = "hit"
+	conditionalMiss = "miss"
+)
+
+// conditional answers light requests from the conditional cache and stores
+// the GET responses of next in it.
+func (s *Server) conditional(route *Route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := route.Name + " " + r.Host + r.URL.RequestURI()
+		if isLight(r) {
+			if s.conditionalCache.serve(w, r, key) {
+				s.metrics.IncConditionalCache(route.Name, conditionalHit)
+				return
+			}
+			s.metrics.IncConditionalCache(route.Name, conditionalMiss)
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if r.Method == http.MethodGet && sw.status == http.StatusOK {
+			s.conditionalCache.store(key, r, w.Header())
+		}
+	})
+}
+
+// serve answers r from the entry at key when it is fresh: with 304 when the
+// validators of r match, with the stored headers for HEAD requests.
+func (c *ConditionalCache) serve(w http.ResponseWriter, r *http.Request, key string) bool {
+	c.mu.Lock()
+	var entry *conditionalEntry
+	if element, ok := c.entries[key]; ok {
+		entry = element.Value.(*conditionalEntry)
+		if time.Now().After(entry.expires) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+			entry = nil
+		}
+	}
+	c.mu.Unlock()
+	if entry == nil {
+		return false
+	}
+
+	age := strconv.Itoa(int(time.Since(entry.stored).Seconds()))
+	if entry.notModified(r) {
+		for _, name := range []string{"Cache-Control", "Content-Location", "ETag", "Expires", "Last-Modified"} {
+			if values := entry.header.Values(name); len(values) > 0 {
+				w.Header()[http.CanonicalHeaderKey(name)] = slices.Clone(values)
+			}
+		}
+		w.Header().Set("Age", age)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	if r.Method != http.MethodHead {
+		return false
+	}
+	for name, values := range entry.header {
+		w.Header()[name] = slices.Clone(values)
+	}
+	w.Header().Set("Age", age)
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// notModified evaluates the conditions of r against the entry. If-None-Match
+// takes precedence over If-Modified-Since.
+func (e *conditionalEntry) notModified(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if e.etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(e.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !e.lastModified.IsZero() {
+		since, err := http.ParseTime(ims)
+		return err == nil && !e.lastModified.After(since)
+	}
+	return false
+}
+
+// store remembers the headers of a 200 response to the GET request r, if a
+// shared cache may store it.
+func (c *ConditionalCache) store(key string, r *http.Request, header http.Header) {
+	directives := cacheDirectives(header.Values("Cache-Control"))
+	_, public := directives["public"]
+	switch {
+	case header.Get("Set-Cookie") != "", header.Get("Vary") != "":
+		return
+	case (r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "") && !public:
+		return
+	}
+	for _, directive := range []string{"private", "no-store", "no-cache"} {
+		if _, ok := directives[directive]; ok {
+			return
+		}
+	}
+	ttl := c.ttl
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			if seconds, err := strconv.Atoi(value); err == nil {
+				ttl = min(ttl, time.Duration(seconds)*time.Second)
+			}
+			break
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &conditionalEntry{
+		key:     key,
+		header:  header.Clone(),
+		etag:    header.Get("ETag"),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	entry.header.Del("Date")
+	entry.header.Del("Age")
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		entry.lastModified = lastModified
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*conditionalEntry).key)
+	}
+}
+
+// cacheDirectives parses Cache-Control header values into directives and
+// their arguments.
+func cacheDirectives(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
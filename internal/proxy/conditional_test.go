@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestCost(t *testing.T) {
+	s := &Server{fullCost: 4, lightCost: 1}
+	tests := []struct {
+		method string
+		header string
+		want   int
+	}{
+		{http.MethodGet, "", 4},
+		{http.MethodPost, "If-None-Match", 4},
+		{http.MethodHead, "", 1},
+		{http.MethodGet, "If-None-Match", 1},
+		{http.MethodGet, "If-Modified-Since", 1},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, `"v1"`)
+		}
+		if got := s.requestCost(r); got != tt.want {
+			t.Errorf("%s with %q: expected cost %d, got %d", tt.method, tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestConditionalCache(t *testing.T) {
+	c := NewConditionalCache(time.Minute, 2)
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	header := http.Header{}
+	header.Set("ETag", `W/"v1"`)
+	header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Length", "42")
+	c.store("a", httptest.NewRequest(http.MethodGet, "/a", nil), header)
+
+	serve := func(key, method, name, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		if name != "" {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		if !c.serve(w, r, key) {
+			return nil
+		}
+		return w
+	}
+
+	if w := serve("a", http.MethodGet, "If-None-Match", `"v0", "v1"`); w == nil || w.Code != http.StatusNotModified || w.Header().Get("ETag") != `W/"v1"` {
+		t.Errorf("expected 304 for a matching ETag, got %+v", w)
+	}
+	if w := serve("a", http.MethodGet, "If-Modified-Since", lastModified.Add(time.Hour).Format(http.TimeFormat)); w == nil || w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for an unmodified resource, got %+v", w)
+	}
+	if w := serve("a", http.MethodGet, "If-None-Match", `"v2"`); w != nil {
+		t.Errorf("expected a changed ETag to be forwarded, got %d", w.Code)
+	}
+	if w := serve("a", http.MethodGet, "If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat)); w != nil {
+		t.Errorf("expected a modified resource to be forwarded, got %d", w.Code)
+	}
+	if w := serve("a", http.MethodHead, "", ""); w == nil || w.Code != http.StatusOK || w.Header().Get("Content-Length") != "42" || w.Body.Len() != 0 {
+		t.Errorf("expected HEAD to be answered with the stored headers, got %+v", w)
+	}
+	if w := serve("b", http.MethodHead, "", ""); w != nil {
+		t.Error("expected an unknown URL to be forwarded")
+	}
+
+	// The least recently stored entry is evicted.
+	c.store("b", httptest.NewRequest(http.MethodGet, "/b", nil), header)
+	c.store("c", httptest.NewRequest(http.MethodGet, "/c", nil), header)
+	if serve("a", http.MethodHead, "", "") != nil || serve("c", http.MethodHead, "", "") == nil {
+		t.Error("expected the oldest entry to be evicted")
+	}
+}
+
+func TestConditionalCacheStore(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        http.Header
+		authorization bool
+		stored        bool
+	}{
+		{"plain", http.Header{}, false, true},
+		{"cookie", http.Header{"Set-Cookie": {"session=1"}}, false, false},
+		{"vary", http.Header{"Vary": {"Accept-Encoding"}}, false, false},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, false, false},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, false, false},
+		{"max-age zero", http.Header{"Cache-Control": {"max-age=0"}}, false, false},
+		{"credentials", http.Header{}, true, false},
+		{"public with credentials", http.Header{"Cache-Control": {"public, max-age=30"}}, true, true},
+	}
+	for _, tt := range tests {
+		c := NewConditionalCache(time.Minute, 0)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.authorization {
+			r.Header.Set("Authorization", "Bearer token")
+		}
+		c.store("key", r, tt.header)
+		if stored := len(c.entries) == 1; stored != tt.stored {
+			t.Errorf("%s: expected stored %v, got %v", tt.name, tt.stored, stored)
+		}
+	}
+
+	c := NewConditionalCache(time.Minute, 0)
+	c.store("key", httptest.NewRequest(http.MethodGet, "/", nil), http.Header{"Cache-Control": {"max-age=5"}})
+	entry := c.entries["key"].Value.(*conditionalEntry)
+	if ttl := entry.expires.Sub(entry.stored); ttl != 5*time.Second {
+		t.Errorf("expected max-age to shorten the TTL to 5s, got %v", ttl)
+	}
+}
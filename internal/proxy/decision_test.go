@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/internal/decisionlog"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/knakul853/shielder/internal/trust"
+	"github.com/knakul853/shielder/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// decisionRecorder is an upstream-stage plugin keeping a copy of the
+// decisions of the requests it sees.
+type decisionRecorder struct {
+	decisions []plugin.Decision
+}
+
+func (d *decisionRecorder) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageUpstream {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if decision := plugin.DecisionFromContext(r.Context()); decision != nil {
+			d.decisions = append(d.decisions, *decision)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestUpstreamPluginSeesDecision(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	trusted, err := trust.New([]trust.Identity{{Name: "monitoring", CIDRs: []string{"192.0.2.0/24"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &decisionRecorder{}
+	s := newTestServer(t, Config{
+		TargetURL: upstream.URL,
+		Trusted:   trusted,
+		Routes:    []Route{{Name: "api", PathPrefix: "/api/", Plugins: []plugin.Plugin{recorder}}},
+	}, 10)
+
+	send := func(remoteAddr string) plugin.Decision {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		r.RemoteAddr = remoteAddr
+		recorder.decisions = nil
+		if rec := serveTest(s, r); rec.Code != http.StatusOK {
+			t.Fatalf("Expected the request to be forwarded, got %d", rec.Code)
+		}
+		if len(recorder.decisions) != 1 {
+			t.Fatalf("Expected the plugin to see one decision, got %+v", recorder.decisions)
+		}
+		return recorder.decisions[0]
+	}
+
+	allowed := send("198.51.100.1:1234")
+	if allowed.Outcome != plugin.OutcomeAllowed || allowed.ClientIP != "198.51.100.1" || allowed.Route != "api" || allowed.RequestsPerMinute != 10 {
+		t.Errorf("Expected an allowed decision for the client on route api, got %+v", allowed)
+	}
+	trustedDecision := send("192.0.2.10:1234")
+	if trustedDecision.Outcome != plugin.OutcomeTrusted || trustedDecision.Reason != "monitoring" || trustedDecision.Route != "api" {
+		t.Errorf("Expected a trusted decision naming the identity, got %+v", trustedDecision)
+	}
+}
+
+// limiterDecisions returns how many decisions with outcome and reason were
+// recorded on route.
+func limiterDecisions(t *testing.T, route, decision, reason string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total float64
+	for _, family := range families {
+		if family.GetName() != "shielder_limiter_decisions_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["route"] == route && labels["decision"] == decision && labels["reason"] == reason {
+				total += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return total
+}
+
+func TestRecordDecision(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	decisions, err := decisionlog.New(decisionlog.Options{Dir: dir}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{
+		TargetURL:   upstream.URL,
+		Routes:      []Route{{Name: "decisions", PathPrefix: "/"}},
+		DecisionLog: decisions,
+	}, 1)
+	if err := s.rateLimiter.Block(context.Background(), "198.51.100.1", time.Hour, limiter.ReasonManual); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		client   string
+		code     int
+		decision string
+		reason   string
+	}{
+		{"192.0.2.1", http.StatusOK, decisionAllowed, reasonWithinLimit},
+		{"192.0.2.1", http.StatusTooManyRequests, decisionRejected, limiter.ReasonRateLimitExceeded},
+		{"198.51.100.1", http.StatusTooManyRequests, decisionRejected, reasonBlocked},
+	}
+	for _, step := range steps {
+		before := limiterDecisions(t, "decisions", step.decision, step.reason)
+		r := httptest.NewRequest(http.MethodGet, "/items", nil)
+		r.RemoteAddr = step.client + ":1234"
+		if rec := serveTest(s, r); rec.Code != step.code {
+			t.Errorf("%s %s: expected %d, got %d", step.decision, step.reason, step.code, rec.Code)
+		}
+		if got := limiterDecisions(t, "decisions", step.decision, step.reason) - before; got != 1 {
+			t.Errorf("%s %s: expected 1 decision to be counted, got %v", step.decision, step.reason, got)
+		}
+	}
+
+	decisions.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "decisions-*"))
+	var records []decisionlog.Record
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record decisionlog.Record
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("Invalid record %q: %v", scanner.Text(), err)
+			}
+			records = append(records, record)
+		}
+		f.Close()
+	}
+	if len(records) != len(steps) {
+		t.Fatalf("Expected %d records, got %+v", len(steps), records)
+	}
+	for i, step := range steps {
+		record := records[i]
+		if record.Key != step.client || record.Route != "decisions" || record.Outcome != step.decision || record.Rule != step.reason {
+			t.Errorf("Expected %s %s for %s, got %+v", step.decision, step.reason, step.client, record)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+// Diagnosis explains how a client is currently treated, to answer reports of
+// wrongly blocked clients.
+type Diagnosis struct {
+	Subject     string `json:"subject"`
+	Blocked     bool   `json:"blocked"`
+	UnderAttack bool   `json:"underAttack"`
+	// Limits lists the limit every route applies to the client.
+	Limits []LimitDiagnosis `json:"limits"`
+}
+
+// LimitDiagnosis is the state of the limit a route applies to a client.
+type LimitDiagnosis struct {
+	Route string `json:"route"`
+	// RequestsPerMinute is the limit in effect, after tightening.
+	RequestsPerMinute int  `json:"requestsPerMinute"`
+	Exceeded          bool `json:"exceeded"`
+	limiter.KeyState
+}
+
+// Diagnose inspects the counters and blocks of subject, which is a client IP
+// or any other client key such as "session:<id>".
+func (s *Server) Diagnose(ctx context.Context, subject string) (*Diagnosis, error) {
+	d := &Diagnosis{
+		Subject:     subject,
+		UnderAttack: s.underAttack != nil && s.underAttack.Active(),
+	}
+	states := make(map[string]limiter.KeyState)
+	for _, route := range s.routes.all() {
+		key, requestsPerMinute := subject, 0
+		if rpm := s.routeRequestsPerMinute(route); rpm > 0 || route.Preflight {
+			key = "route:" + route.Name + ":" + subject
+			requestsPerMinute = rpm
+		} else if s.sessions != nil && strings.HasPrefix(subject, "session:") {
+			requestsPerMinute = s.sessions.RequestsPerMinute()
+		}
+		if requestsPerMinute <= 0 {
+			requestsPerMinute = s.rateLimiter.RequestsPerMinute()
+		}
+		if factor := s.limitFactor(route); factor < 1 {
+			requestsPerMinute = max(1, int(float64(requestsPerMinute)*factor))
+		}
+
+		state, ok := states[key]
+		if !ok {
+			var err error
+			if state, err = s.rateLimiter.Inspect(ctx, key); err != nil {
+				return nil, err
+			}
+			states[key] = state
+		}
+		d.Blocked = d.Blocked || state.Blocked
+		d.Limits = append(d.Limits, LimitDiagnosis{
+			Route:             route.Name,
+			RequestsPerMinute: requestsPerMinute,
+			Exceeded:          state.Count > int64(requestsPerMinute),
+			KeyState:          state,
+		})
+	}
+	return d, nil
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/knakul853/shielder/internal/monitor"
+	"golang.org/x/time/rate"
+)
+
+// errUpstreamConnLimit is returned when no upstream connection slot became
+// free within the configured wait time.
+var errUpstreamConnLimit = errors.New("upstream connection limit reached")
+
+// DialFunc matches http.Transport.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// connGate caps the number of open connections to every upstream address and
+// the rate at which new ones are dialed, so that a burst of clients cannot
+// exhaust a backend's file descriptors even when requests are queued up behind
+// Shielder.
+type connGate struct {
+	dial              DialFunc
+	maxConns          int
+	newConnsPerSecond float64
+	burst             int
+	wait              time.Duration
+	metrics           *monitor.MetricsCollector
+
+	mu      sync.Mutex
+	targets map[string]*targetGate
+}
+
+// targetGate holds the connection slots and dial tokens of one address.
+type targetGate struct {
+	slots chan struct{}
+	rate  *rate.Limiter
+}
+
+// newConnGate wraps dial. A maxConns of zero disables the connection cap and a
+// newConnsPerSecond of zero disables the dial rate limit.
+func newConnGate(dial DialFunc, maxConns int, newConnsPerSecond float64, burst int, wait time.Duration, metrics *monitor.MetricsCollector) *connGate {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &connGate{
+		dial:              dial,
+		maxConns:          maxConns,
+		newConnsPerSecond: newConnsPerSecond,
+		burst:             burst,
+		wait:              wait,
+		metrics:           metrics,
+		targets:           make(map[string]*targetGate),
+	}
+}
+
+// target returns the gate of addr, creating it on first use.
+func (g *connGate) target(addr string) *targetGate {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t, ok := g.targets[addr]
+	if !ok {
+		t = &targetGate{}
+		if g.maxConns > 0 {
+			t.slots = make(chan struct{}, g.maxConns)
+		}
+		if g.newConnsPerSecond > 0 {
+			t.rate = rate.NewLimiter(rate.Limit(g.newConnsPerSecond), g.burst)
+		}
+		g.targets[addr] = t
+	}
+	return t
+}
+
+// DialContext waits for a free slot and a dial token of addr, then dials. The
+// slot is released when the returned connection is closed.
+func (g *connGate) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if g.wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.wait)
+		defer cancel()
+	}
+
+	t := g.target(addr)
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		case <-ctx.Done():
+			g.metrics.IncUpstreamDialRejected("max_conns")
+			return nil, errUpstreamConnLimit
+		}
+	}
+
+	if t.rate != nil {
+		if err := t.rate.Wait(ctx); err != nil {
+			t.release()
+			g.metrics.IncUpstreamDialRejected("dial_rate")
+			return nil, errUpstreamConnLimit
+		}
+	}
+
+	conn, err := g.dial(ctx, network, addr)
+	if err != nil {
+		t.release()
+		return nil, err
+	}
+
+	g.metrics.AddUpstreamConnections(1)
+	return &gatedConn{Conn: conn, target: t, metrics: g.metrics}, nil
+}
+
+func (t *targetGate) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// gatedConn returns its slot to the gate exactly once when closed.
+type gatedConn struct {
+	net.Conn
+	target  *targetGate
+	metrics *monitor.MetricsCollector
+	once    sync.Once
+}
+
+func (c *gatedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.target.release()
+		c.metrics.AddUpstreamConnections(-1)
+	})
+	return err
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pipeDial returns one end of an in-memory connection for every dial.
+func pipeDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, nil
+}
+
+// dialRejections returns how many dials the gate rejected for reason.
+func dialRejections(t *testing.T, reason string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "shielder_upstream_dial_rejected_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" && label.GetValue() == reason {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestConnGateCapsConnsPerTarget(t *testing.T) {
+	ctx := context.Background()
+	g := newConnGate(pipeDial, 1, 0, 0, 10*time.Millisecond, sharedMetrics())
+	rejected := dialRejections(t, "max_conns")
+
+	first, err := g.DialContext(ctx, "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.DialContext(ctx, "tcp", "10.0.0.1:80"); !errors.Is(err, errUpstreamConnLimit) {
+		t.Errorf("Expected a second connection to the target to be rejected, got %v", err)
+	}
+	if got := dialRejections(t, "max_conns") - rejected; got != 1 {
+		t.Errorf("Expected one dial rejected for max_conns, got %v", got)
+	}
+	other, err := g.DialContext(ctx, "tcp", "10.0.0.2:80")
+	if err != nil {
+		t.Errorf("Expected another target to have slots of its own, got %v", err)
+	} else {
+		other.Close()
+	}
+
+	// Closing releases the slot, closing twice releases it once.
+	first.Close()
+	first.Close()
+	second, err := g.DialContext(ctx, "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatalf("Expected the slot to be released on close, got %v", err)
+	}
+	defer second.Close()
+	if _, err := g.DialContext(ctx, "tcp", "10.0.0.1:80"); !errors.Is(err, errUpstreamConnLimit) {
+		t.Errorf("Expected a double close to release a single slot, got %v", err)
+	}
+}
+
+func TestConnGateLimitsDialRate(t *testing.T) {
+	ctx := context.Background()
+	g := newConnGate(pipeDial, 2, 0.01, 1, 10*time.Millisecond, sharedMetrics())
+	rejected := dialRejections(t, "dial_rate")
+
+	conn, err := g.DialContext(ctx, "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := g.DialContext(ctx, "tcp", "10.0.0.1:80"); !errors.Is(err, errUpstreamConnLimit) {
+		t.Errorf("Expected a dial over the rate to be rejected, got %v", err)
+	}
+	if got := dialRejections(t, "dial_rate") - rejected; got != 1 {
+		t.Errorf("Expected one dial rejected for dial_rate, got %v", got)
+	}
+	// The rejected dial gives its slot back.
+	if n := len(g.target("10.0.0.1:80").slots); n != 1 {
+		t.Errorf("Expected one slot taken, got %d", n)
+	}
+}
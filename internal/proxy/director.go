@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// upstreamTargetKey carries the upstream target picked for a request to the
+// director of the reverse proxy.
+type upstreamTargetKey struct{}
+
+// direct points an outgoing request at the upstream target picked for it, or
+// at the target URL, the way httputil.NewSingleHostReverseProxy does for a
+// single target. The Host header of the client is kept.
+func (s *Server) direct(req *http.Request) {
+	target, ok := req.Context().Value(upstreamTargetKey{}).(*url.URL)
+	if !ok {
+		target = s.target
+	}
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
+}
+
+func joinURLPath(a, b *url.URL) (path, rawPath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	aPath, bPath := a.EscapedPath(), b.EscapedPath()
+	aSlash, bSlash := strings.HasSuffix(aPath, "/"), strings.HasPrefix(bPath, "/")
+	switch {
+	case aSlash && bSlash:
+		return a.Path + b.Path[1:], aPath + bPath[1:]
+	case !aSlash && !bSlash:
+		return a.Path + "/" + b.Path, aPath + "/" + bPath
+	}
+	return a.Path + b.Path, aPath + bPath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aSlash, bSlash := strings.HasSuffix(a, "/"), strings.HasPrefix(b, "/")
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestDirect(t *testing.T) {
+	tests := []struct {
+		target, request string
+	}{
+		{"http://backend:3000", "/users?id=1"},
+		{"http://backend:3000/api/", "/users"},
+		{"http://backend:3000/api", "/users"},
+		{"http://backend:3000/api?key=a", "/users?id=1"},
+		{"http://backend:3000/a%2Fb/", "/c%2Fd"},
+	}
+	for _, tt := range tests {
+		target, _ := url.Parse(tt.target)
+
+		// The director behaves like that of a single host reverse proxy.
+		want := httptest.NewRequest("GET", tt.request, nil)
+		httputil.NewSingleHostReverseProxy(target).Director(want)
+
+		s := &Server{target: target}
+		got := httptest.NewRequest("GET", tt.request, nil)
+		s.direct(got)
+		if got.URL.String() != want.URL.String() || got.Host != want.Host {
+			t.Errorf("%s%s: expected %s, got %s", tt.target, tt.request, want.URL, got.URL)
+		}
+
+		// Picked targets take precedence.
+		picked, _ := url.Parse("https://other:8443")
+		req := httptest.NewRequest("GET", tt.request, nil)
+		req = req.WithContext(context.WithValue(req.Context(), upstreamTargetKey{}, picked))
+		s.direct(req)
+		if req.URL.Host != "other:8443" || req.URL.Scheme != "https" {
+			t.Errorf("%s: expected the picked target, got %s", tt.request, req.URL)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// drainPoll is how often Shutdown checks whether the requests on hijacked
+// connections, such as WebSockets, are done.
+const drainPoll = 50 * time.Millisecond
+
+// counted counts the requests in flight for Shutdown.
+func (s *Server) counted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Shutdown stops accepting connections and waits for the requests in flight
+// until ctx is done. Requests still being served then are aborted: their
+// connections are closed and their contexts canceled, which also ends
+// streams on hijacked connections. It logs how many requests were drained
+// and how many aborted, and returns ctx's error if any were aborted.
+func (s *Server) Shutdown(ctx context.Context) error {
+	pending := s.inFlight.Load()
+	s.logger.WithField("in_flight", pending).Info("Shutting down server")
+	err := s.server.Shutdown(ctx)
+	if err == nil {
+		// Shutdown does not wait for hijacked connections.
+		err = s.waitIdle(ctx)
+	}
+	var aborted int64
+	if err != nil {
+		aborted = s.inFlight.Load()
+		s.abort()
+		s.server.Close()
+	}
+	fields := logrus.Fields{"drained": max(pending-aborted, 0), "aborted": aborted}
+	if aborted > 0 {
+		s.logger.WithFields(fields).Warn("Drain timeout reached, aborted requests in flight")
+	} else {
+		s.logger.WithFields(fields).Info("Drained requests in flight")
+	}
+	return err
+}
+
+// waitIdle waits until no request is in flight or ctx is done.
+func (s *Server) waitIdle(ctx context.Context) error {
+	tick := time.NewTicker(drainPoll)
+	defer tick.Stop()
+	for s.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// drainServer serves handler the way NewServer does, on a local listener.
+func drainServer(t *testing.T, handler http.Handler) (*Server, string) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s := &Server{logger: logger}
+	base, abort := context.WithCancel(context.Background())
+	s.abort = abort
+	s.server = &http.Server{
+		Handler:     s.counted(handler),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return s, "http://" + l.Addr().String()
+}
+
+func TestShutdownDrains(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s, url := drainServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected the request to be drained, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected the drained request to complete, got %v", err)
+	}
+}
+
+func TestShutdownAborts(t *testing.T) {
+	started, canceled := make(chan struct{}), make(chan struct{})
+	s, url := drainServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the drain timeout to be reached, got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request in flight to be canceled")
+	}
+}
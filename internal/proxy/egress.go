@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// parseEgressProxy parses the URL of a forward proxy. Credentials in the URL
+// are sent as Proxy-Authorization, or used for SOCKS5 authentication.
+func parseEgressProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported egress proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("egress proxy %q has no host", raw)
+	}
+	return u, nil
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+
+	"github.com/knakul853/shielder/internal/escalation"
+)
+
+// escalate records that the client of r was rejected under key on route. A
+// scope is a route and a limit key, so clients that plugins key by tenant
+// offend once per tenant. Clients are tracked by IP and, when fingerprints
+// are linked, by fingerprint.
+func (s *Server) escalate(ctx context.Context, r *http.Request, route *Route, key, fp string) {
+	if s.escalator == nil {
+		return
+	}
+	scope := route.Name + " " + key
+	if ip, err := netip.ParseAddr(s.clientIP(r)); err == nil {
+		if _, err := s.escalator.Record(ctx, escalation.KindIP, ip.String(), scope); err != nil {
+			s.logger.WithError(err).Warn("Error recording offense")
+		}
+	}
+	if fp != "" {
+		if _, err := s.escalator.Record(ctx, escalation.KindFingerprint, fp, scope); err != nil {
+			s.logger.WithError(err).Warn("Error recording offense")
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of expensive requests.
+const (
+	ExpensiveSlow  = "slow"
+	ExpensiveLarge = "large"
+)
+
+// ExpensivePolicy flags individual requests that take long or return large
+// responses. A rate limit counting requests misses clients that send few
+// but expensive ones.
+type ExpensivePolicy struct {
+	// SlowThreshold flags requests taking longer, zero disables it
+	SlowThreshold time.Duration
+	// LargeResponseBytes flags responses with larger bodies, zero disables
+	// it
+	LargeResponseBytes int64
+	// Log receives an entry for every flagged request, the proxy logger is
+	// used when it is nil
+	Log *logrus.Logger
+}
+
+// flagExpensive counts and logs the request if it crossed a threshold of
+// the expensive policy.
+func (s *Server) flagExpensive(r *http.Request, route *Route, key, endpoint string, sw *statusWriter, elapsed time.Duration) {
+	p := s.expensive
+	var kinds []string
+	if p.SlowThreshold > 0 && elapsed > p.SlowThreshold {
+		kinds = append(kinds, ExpensiveSlow)
+	}
+	if p.LargeResponseBytes > 0 && sw.bytes > p.LargeResponseBytes {
+		kinds = append(kinds, ExpensiveLarge)
+	}
+	if len(kinds) == 0 {
+		return
+	}
+	for _, kind := range kinds {
+		s.metrics.IncExpensiveRequest(route.Name, kind)
+	}
+	log := p.Log
+	if log == nil {
+		log = s.logger
+	}
+	log.WithFields(logrus.Fields{
+		"kinds":       kinds,
+		"key":         key,
+		"route":       route.Name,
+		"endpoint":    endpoint,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      sw.status,
+		"duration_ms": elapsed.Milliseconds(),
+		"bytes":       sw.bytes,
+	}).Warn("Expensive request")
+}
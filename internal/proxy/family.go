@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Address family policies for upstream connections.
+const (
+	// FamilyDualStack dials addresses in resolver order and races the other
+	// family after the fallback delay (Happy Eyeballs).
+	FamilyDualStack = "dualStack"
+	// FamilyPreferIPv4 and FamilyPreferIPv6 dial the preferred family first
+	// and race the other one after the fallback delay or once the preferred
+	// family failed, which works around broken A or AAAA records.
+	FamilyPreferIPv4 = "preferIPv4"
+	FamilyPreferIPv6 = "preferIPv6"
+	// FamilyIPv4 and FamilyIPv6 only ever dial the given family.
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// defaultFallbackDelay matches the delay net.Dialer uses for Happy Eyeballs.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// newFamilyDialer returns the dial function for upstream connections under
+// the given address family policy. A zero fallbackDelay uses 300ms, a negative
+// one only falls back once the first family failed.
+func newFamilyDialer(d *net.Dialer, family string, fallbackDelay time.Duration) (DialFunc, error) {
+	if fallbackDelay == 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+	switch family {
+	case "", FamilyDualStack:
+		d.FallbackDelay = fallbackDelay
+		return d.DialContext, nil
+	case FamilyIPv4:
+		return forceFamily(d.DialContext, "tcp4"), nil
+	case FamilyIPv6:
+		return forceFamily(d.DialContext, "tcp6"), nil
+	case FamilyPreferIPv4:
+		return preferFamily(d.DialContext, "tcp4", "tcp6", fallbackDelay), nil
+	case FamilyPreferIPv6:
+		return preferFamily(d.DialContext, "tcp6", "tcp4", fallbackDelay), nil
+	default:
+		return nil, fmt.Errorf("unknown upstream address family %q", family)
+	}
+}
+
+func forceFamily(dial DialFunc, network string) DialFunc {
+	return func(ctx context.Context, n, addr string) (net.Conn, error) {
+		if n == "tcp" {
+			n = network
+		}
+		return dial(ctx, n, addr)
+	}
+}
+
+func preferFamily(dial DialFunc, primary, fallback string, delay time.Duration) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" {
+			return dial(ctx, network, addr)
+		}
+		return dialRace(ctx, dial, primary, fallback, delay, addr)
+	}
+}
+
+type dialResult struct {
+	conn    net.Conn
+	err     error
+	primary bool
+}
+
+// dialRace dials the primary network and starts dialing the fallback network
+// after delay, or as soon as the primary failed. The first connection wins;
+// a connection that is established after that is closed.
+func dialRace(ctx context.Context, dial DialFunc, primary, fallback string, delay time.Duration, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	start := func(network string, isPrimary bool) {
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- dialResult{conn: conn, err: err, primary: isPrimary}
+		}()
+	}
+	start(primary, true)
+	pending := 1
+
+	var fallbackTimer <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		fallbackTimer = timer.C
+	}
+	fallbackStarted := false
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			start(fallback, false)
+			pending++
+		}
+	}
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-fallbackTimer:
+			startFallback()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			startFallback()
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
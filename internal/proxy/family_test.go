@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDial answers per network after the given delay, failing networks that
+// are not listed.
+func fakeDial(delays map[string]time.Duration) (DialFunc, func() []string) {
+	var mu sync.Mutex
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, network)
+		mu.Unlock()
+		delay, ok := delays[network]
+		if !ok {
+			return nil, errors.New("no route to host")
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return &namedConn{Conn: client, network: network}, nil
+	}
+	return dial, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), dialed...)
+	}
+}
+
+type namedConn struct {
+	net.Conn
+	network string
+}
+
+func TestPreferFamily(t *testing.T) {
+	tests := []struct {
+		name    string
+		delays  map[string]time.Duration
+		want    string
+		wantErr bool
+	}{
+		{"preferred family answers", map[string]time.Duration{"tcp4": 0, "tcp6": 0}, "tcp4", false},
+		{"preferred family broken", map[string]time.Duration{"tcp6": 0}, "tcp6", false},
+		{"preferred family slow", map[string]time.Duration{"tcp4": time.Second, "tcp6": 0}, "tcp6", false},
+		{"both families broken", map[string]time.Duration{}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial, _ := fakeDial(tt.delays)
+			conn, err := preferFamily(dial, "tcp4", "tcp6", 20*time.Millisecond)(context.Background(), "tcp", "backend:80")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got a connection over %s", conn.(*namedConn).network)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected a connection, got %v", err)
+			}
+			defer conn.Close()
+			if got := conn.(*namedConn).network; got != tt.want {
+				t.Errorf("Expected a connection over %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestForceFamily(t *testing.T) {
+	dial, dialed := fakeDial(map[string]time.Duration{"tcp4": 0, "tcp6": 0})
+	conn, err := forceFamily(dial, "tcp6")(context.Background(), "tcp", "backend:80")
+	if err != nil {
+		t.Fatalf("Expected a connection, got %v", err)
+	}
+	conn.Close()
+
+	if got := dialed(); len(got) != 1 || got[0] != "tcp6" {
+		t.Errorf("Expected only tcp6 to be dialed, got %v", got)
+	}
+}
+
+func TestNewFamilyDialerRejectsUnknownFamily(t *testing.T) {
+	if _, err := newFamilyDialer(&net.Dialer{}, "ipv5", 0); err == nil {
+		t.Error("Expected an error for an unknown address family")
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/knakul853/shielder/internal/feedback"
+	"github.com/knakul853/shielder/plugin"
+)
+
+// reportFalsePositives wraps modifyResponse to pick up false positives the
+// upstream reports with feedback.HeaderFalsePositive. The header is removed
+// from the response before anything else sees it. The rules default to the
+// ones the request was tagged with.
+func (s *Server) reportFalsePositives(route *Route, modifyResponse func(*http.Response) error) func(*http.Response) error {
+	if s.feedback == nil {
+		return modifyResponse
+	}
+	return func(resp *http.Response) error {
+		if value := resp.Header.Get(feedback.HeaderFalsePositive); value != "" {
+			resp.Header.Del(feedback.HeaderFalsePositive)
+			s.reportFalsePositive(route, resp.Request, value)
+		}
+		if modifyResponse != nil {
+			return modifyResponse(resp)
+		}
+		return nil
+	}
+}
+
+func (s *Server) reportFalsePositive(route *Route, r *http.Request, value string) {
+	fp := feedback.Case{
+		Client: s.clientIP(r),
+		Route:  route.Name,
+		Source: feedback.SourceUpstream,
+		Rules:  tagged(r),
+	}
+	if limit := plugin.LimitFromContext(r.Context()); limit != nil {
+		fp.Client = limit.Key
+	}
+	if value != "1" && !strings.EqualFold(value, "true") {
+		fp.Rules = nil
+		for _, rule := range strings.Split(value, ",") {
+			if rule = strings.TrimSpace(rule); rule != "" {
+				fp.Rules = append(fp.Rules, rule)
+			}
+		}
+	}
+
+	// Recording must not hold up the response.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := s.feedback.Report(ctx, fp, s.feedback.AutoUnblock()); err != nil {
+			s.logger.WithError(err).Warn("Error recording false positive")
+		}
+	}()
+}
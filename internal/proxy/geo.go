@@ -0,0 +1,15 @@
+package proxy
+
+import (
+	"net/netip"
+)
+
+// blockedCountry returns the country of ip if requests from it are
+// blocked. Addresses the locator cannot place are never blocked.
+func (s *Server) blockedCountry(ip netip.Addr) (string, bool) {
+	if s.locator == nil || len(s.blockedCountries) == 0 {
+		return "", false
+	}
+	country := s.locator.Locate(ip).Country
+	return country, country != "" && s.blockedCountries[country]
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/knakul853/shielder/internal/geoip"
+)
+
+func TestBlockedCountry(t *testing.T) {
+	locator := geoip.NewLocator(nil, geoip.LocatorOptions{Overrides: []geoip.Override{
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Country: "XX"},
+		{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Country: "NL"},
+	}})
+	s := &Server{locator: locator, blockedCountries: map[string]bool{"XX": true}}
+
+	tests := []struct {
+		ip      string
+		country string
+		blocked bool
+	}{
+		{"198.51.100.7", "XX", true},
+		{"203.0.113.7", "NL", false},
+		// Unknown locations are never blocked.
+		{"192.0.2.1", "", false},
+	}
+	for _, tt := range tests {
+		country, blocked := s.blockedCountry(netip.MustParseAddr(tt.ip))
+		if blocked != tt.blocked || (blocked && country != tt.country) {
+			t.Errorf("%s: expected %q blocked=%v, got %q blocked=%v", tt.ip, tt.country, tt.blocked, country, blocked)
+		}
+	}
+}
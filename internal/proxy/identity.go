@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/knakul853/shielder/internal/auth"
+	"github.com/knakul853/shielder/internal/signing"
+)
+
+// IdentityHeaders passes what Shielder resolved about the client on to the
+// upstream. Each header is removed from the incoming request first, so a
+// client cannot set it itself; headers with an empty name are not set.
+type IdentityHeaders struct {
+	ClientIP string
+	// Country and ASN are looked up with the locator of the server, they
+	// are left out without one.
+	Country string
+	ASN     string
+	// Subject is the header the authenticator passes the subject in. It is
+	// set again from the identity of the request, so that routes skipping
+	// authentication do not pass on a subject sent by the client.
+	Subject string
+	// Signer, when set, signs the identity headers, together with the
+	// subject header of the authenticator, so that the upstream can verify
+	// they came from Shielder and not from a client that reached it
+	// directly.
+	Signer *signing.IdentitySigner
+}
+
+// setIdentityHeaders replaces the identity headers of r, and every header the
+// signer covers, with the resolved identity of the client.
+func (s *Server) setIdentityHeaders(r *http.Request, clientIP string) {
+	h := s.identity
+	names := []string{h.ClientIP, h.Country, h.ASN, h.Subject}
+	if h.Signer != nil {
+		names = append(names, h.Signer.Headers()...)
+	}
+	for _, name := range names {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+
+	if h.Subject != "" {
+		if identity := auth.FromContext(r.Context()); identity != nil {
+			r.Header.Set(h.Subject, identity.Subject)
+		}
+	}
+	if h.ClientIP != "" {
+		r.Header.Set(h.ClientIP, clientIP)
+	}
+	if s.locator == nil || (h.Country == "" && h.ASN == "") {
+		return
+	}
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return
+	}
+	loc := s.locator.Locate(ip)
+	if h.Country != "" && loc.Country != "" {
+		r.Header.Set(h.Country, loc.Country)
+	}
+	if h.ASN != "" && loc.ASN != 0 {
+		r.Header.Set(h.ASN, strconv.FormatUint(uint64(loc.ASN), 10))
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/auth"
+	"github.com/knakul853/shielder/internal/geoip"
+	"github.com/knakul853/shielder/internal/signing"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetIdentityHeaders(t *testing.T) {
+	locator := geoip.NewLocator(nil, geoip.LocatorOptions{Overrides: []geoip.Override{
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Country: "NL", ASN: 64500},
+	}})
+	s := &Server{locator: locator, identity: &IdentityHeaders{
+		ClientIP: "X-Shielder-Client-IP",
+		Country:  "X-Shielder-Country",
+		ASN:      "X-Shielder-ASN",
+	}}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Shielder-Client-IP", "10.0.0.1")
+	req.Header.Set("X-Shielder-Country", "US")
+	s.setIdentityHeaders(req, "198.51.100.7")
+	if got := req.Header.Get("X-Shielder-Client-IP"); got != "198.51.100.7" {
+		t.Errorf("Expected client IP 198.51.100.7, got %q", got)
+	}
+	if got := req.Header.Get("X-Shielder-Country"); got != "NL" {
+		t.Errorf("Expected country NL, got %q", got)
+	}
+	if got := req.Header.Get("X-Shielder-ASN"); got != "64500" {
+		t.Errorf("Expected ASN 64500, got %q", got)
+	}
+
+	// Headers sent by the client are dropped for unknown locations.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Shielder-Country", "US")
+	s.setIdentityHeaders(req, "203.0.113.7")
+	if got := req.Header.Get("X-Shielder-Country"); got != "" {
+		t.Errorf("Expected no country, got %q", got)
+	}
+}
+
+func TestForgedSubjectIsNotSigned(t *testing.T) {
+	var got []http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Clone())
+	}))
+	defer upstream.Close()
+	lookup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "alice-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"subject":"alice"}`)
+	}))
+	defer lookup.Close()
+
+	mr := miniredis.RunT(t)
+	cache := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { cache.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	authenticator, err := auth.New(auth.Options{
+		APIKey:         &auth.APIKeyOptions{LookupURL: lookup.URL},
+		IdentityHeader: "X-Subject",
+	}, cache, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := signing.NewIdentitySigner(signing.IdentityOptions{
+		Headers: []string{"X-Shielder-Client-IP", "X-Subject"},
+		Key:     []byte("0123456789abcdef0123456789abcdef"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{
+		TargetURL: upstream.URL,
+		Auth:      authenticator,
+		Identity:  &IdentityHeaders{ClientIP: "X-Shielder-Client-IP", Subject: "X-Subject", Signer: signer},
+		Routes:    []Route{{Name: "public", PathPrefix: "/public/", SkipAuth: true}},
+	}, 100)
+
+	send := func(path string, header http.Header) http.Header {
+		t.Helper()
+		got = nil
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header = header
+		if rec := serveTest(s, r); rec.Code != http.StatusOK || len(got) != 1 {
+			t.Fatalf("Expected %s to be forwarded, got %d", path, rec.Code)
+		}
+		return got[0]
+	}
+
+	// A route without authentication passes no subject, whatever the
+	// client sends.
+	forwarded := send("/public/page", http.Header{"X-Subject": {"admin"}})
+	if subject := forwarded.Get("X-Subject"); subject != "" {
+		t.Errorf("Expected the forged subject to be removed, got %q", subject)
+	}
+	if forwarded.Get("X-Shielder-Identity-Signature") == "" {
+		t.Error("Expected the identity headers to be signed")
+	}
+
+	forwarded = send("/api/orders", http.Header{"X-Subject": {"admin"}, "X-Api-Key": {"alice-key"}})
+	if subject := forwarded.Get("X-Subject"); subject != "alice" {
+		t.Errorf("Expected the authenticated subject, got %q", subject)
+	}
+}
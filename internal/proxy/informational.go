@@ -0,0 +1,80 @@
+package proxy
+
+import "net/http"
+
+// informationalWriter passes 1xx responses from the upstream, such as 103
+// Early Hints, on to the client. ReverseProxy forwards them by adding their
+// headers to the response headers, writing the status and clearing all
+// headers afterwards, which would leak headers Shielder set before forwarding
+// into the 1xx response and lose them for the final one. The writer sends
+// only the upstream's 1xx headers and restores Shielder's own afterwards.
+type informationalWriter struct {
+	http.ResponseWriter
+	// own holds the headers set before the request was forwarded.
+	own http.Header
+	// send is false for clients that cannot receive 1xx responses.
+	send bool
+	// allowed limits the forwarded headers, nil forwards all of them.
+	allowed map[string]bool
+	restore bool
+}
+
+// informational wraps w for forwarding the request r.
+func (s *Server) informational(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	return &informationalWriter{
+		ResponseWriter: w,
+		own:            w.Header().Clone(),
+		// HTTP/1.0 clients do not expect 1xx responses.
+		send:    !s.dropInformational && r.ProtoAtLeast(1, 1),
+		allowed: s.informationalHeaders,
+	}
+}
+
+func (w *informationalWriter) Header() http.Header {
+	h := w.ResponseWriter.Header()
+	if w.restore {
+		clear(h)
+		for name, values := range w.own {
+			h[name] = append([]string(nil), values...)
+		}
+		w.restore = false
+	}
+	return h
+}
+
+func (w *informationalWriter) WriteHeader(code int) {
+	if code < 100 || code > 199 || code == http.StatusSwitchingProtocols {
+		w.Header()
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	// The upstream's headers were appended to Shielder's own.
+	h := w.ResponseWriter.Header()
+	hints := make(http.Header)
+	for name, values := range h {
+		if w.allowed != nil && !w.allowed[name] {
+			continue
+		}
+		if own := len(w.own[name]); own < len(values) {
+			hints[name] = values[own:]
+		}
+	}
+	clear(h)
+	for name, values := range hints {
+		h[name] = values
+	}
+	if w.send {
+		w.ResponseWriter.WriteHeader(code)
+	}
+	w.restore = true
+}
+
+func (w *informationalWriter) Write(b []byte) (int, error) {
+	w.Header()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *informationalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
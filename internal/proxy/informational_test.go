@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"testing"
+)
+
+func TestInformationalResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", "</app.css>; rel=preload; as=style")
+		w.Header().Add("X-Internal", "1")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Header().Del("X-Internal")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	tests := []struct {
+		name      string
+		server    *Server
+		wantHints http.Header
+	}{
+		{
+			name:   "forward",
+			server: &Server{},
+			wantHints: http.Header{
+				"Link":       {"</app.css>; rel=preload; as=style"},
+				"X-Internal": {"1"},
+			},
+		},
+		{
+			name:      "allowed headers",
+			server:    &Server{informationalHeaders: map[string]bool{"Link": true}},
+			wantHints: http.Header{"Link": {"</app.css>; rel=preload; as=style"}},
+		},
+		{
+			name:   "drop",
+			server: &Server{dropInformational: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Headers set by Shielder before forwarding.
+				w.Header().Set("Set-Cookie", "shielder_session=abc")
+				httputil.NewSingleHostReverseProxy(target).ServeHTTP(tt.server.informational(w, r), r)
+			}))
+			defer front.Close()
+
+			var hints http.Header
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					if code == http.StatusEarlyHints {
+						hints = http.Header(header).Clone()
+					}
+					return nil
+				},
+			}
+			req, _ := http.NewRequest(http.MethodGet, front.URL, nil)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if tt.wantHints == nil && hints != nil {
+				t.Errorf("Expected no early hints, got %v", hints)
+			}
+			if tt.wantHints != nil {
+				if hints == nil {
+					t.Fatal("Expected early hints")
+				}
+				if len(hints) != len(tt.wantHints) {
+					t.Errorf("Expected early hints %v, got %v", tt.wantHints, hints)
+				}
+				for name, values := range tt.wantHints {
+					if hints.Get(name) != values[0] {
+						t.Errorf("Expected early hint %s=%q, got %q", name, values[0], hints.Get(name))
+					}
+				}
+			}
+			if got := resp.Header.Get("Set-Cookie"); got != "shielder_session=abc" {
+				t.Errorf("Expected Shielder's cookie on the final response, got %q", got)
+			}
+			if got := resp.Header.Get("Link"); got != "" {
+				t.Errorf("Expected early hints not to leak into the final response, got %q", got)
+			}
+		})
+	}
+}
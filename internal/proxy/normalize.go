@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// normalizeRequest rewrites the URL and host of r to a canonical form before
+// routes, plugins, authorization and caches look at them, so that encoding
+// tricks cannot slip past path-based rules or split cache entries.
+//
+// The path is percent-decoded exactly once, which net/http already did for
+// URL.Path, and the decoded form is what gets forwarded: an encoded slash
+// becomes a path separator, while a double-encoded sequence such as %252e
+// stays the literal text %2e. Empty and dot segments are removed, and the
+// host is lowercased without a trailing dot.
+func normalizeRequest(r *http.Request) {
+	r.URL.Path = normalizePath(r.URL.Path)
+	r.URL.RawPath = ""
+	r.Host = normalizeHost(r.Host)
+}
+
+func normalizePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if cleaned != "/" && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")) {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func normalizeHost(host string) string {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.ToLower(name), "."), port)
+}
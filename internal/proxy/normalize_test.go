@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeRequest(t *testing.T) {
+	tests := []struct {
+		target string
+		host   string
+		path   string
+		uri    string
+		want   string
+	}{
+		{"/api/users", "Example.COM", "/api/users", "/api/users", "example.com"},
+		{"/api//users/./1", "example.com", "/api/users/1", "/api/users/1", "example.com"},
+		{"/static/../admin/", "example.com", "/admin/", "/admin/", "example.com"},
+		{"/../../etc/passwd", "example.com", "/etc/passwd", "/etc/passwd", "example.com"},
+		{"/%61dmin/%2e%2e/secret", "example.com", "/secret", "/secret", "example.com"},
+		{"/api%2Fadmin?x=%2F", "EXAMPLE.com.:8443", "/api/admin", "/api/admin?x=%2F", "example.com:8443"},
+		{"/api/%252e%252e/admin", "example.com", "/api/%2e%2e/admin", "/api/%252e%252e/admin", "example.com"},
+		{"/a/b/..", "example.com", "/a/", "/a/", "example.com"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		r.Host = tt.host
+		normalizeRequest(r)
+		if r.URL.Path != tt.path {
+			t.Errorf("%s: expected path %q, got %q", tt.target, tt.path, r.URL.Path)
+		}
+		if got := r.URL.RequestURI(); got != tt.uri {
+			t.Errorf("%s: expected request URI %q, got %q", tt.target, tt.uri, got)
+		}
+		if r.Host != tt.want {
+			t.Errorf("%s: expected host %q, got %q", tt.target, tt.want, r.Host)
+		}
+	}
+}
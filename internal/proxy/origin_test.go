@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knakul853/shielder/plugin"
+	"github.com/knakul853/shielder/plugin/origin"
+)
+
+func TestOriginLimitKeepsClientLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	origins, err := origin.New(map[string]any{
+		"keyByOrigin": true,
+		"quotas": []any{
+			map[string]any{"origin": "https://partner.example", "requestsPerMinute": 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{
+		TargetURL: upstream.URL,
+		Routes:    []Route{{Name: "api", PathPrefix: "/api/", RequestsPerMinute: 2, Plugins: []plugin.Plugin{origins}}},
+	}, 100)
+	send := func(remoteAddr, from string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Origin", from)
+		return serveTest(s, r).Code
+	}
+
+	// A client sending another origin on every request keeps its own count.
+	for i, from := range []string{"https://a.example", "https://b.example"} {
+		if code := send("198.51.100.1:1234", from); code != http.StatusOK {
+			t.Fatalf("Expected request %d to pass, got %d", i+1, code)
+		}
+	}
+	if code := send("198.51.100.1:1234", "https://c.example"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected a fresh origin not to reset the client limit, got %d", code)
+	}
+
+	// The quota of an origin is shared by all its visitors.
+	if code := send("198.51.100.2:1234", "https://partner.example"); code != http.StatusOK {
+		t.Fatalf("Expected the first visitor of the partner to pass, got %d", code)
+	}
+	if code := send("198.51.100.3:1234", "https://partner.example"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the partner quota to be used up, got %d", code)
+	}
+}
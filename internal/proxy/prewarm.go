@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// targetUse remembers when each target last received a request, so that
+// only targets that went quiet are warmed up again.
+type targetUse struct {
+	hosts sync.Map // host -> *atomic.Int64 of unix nanoseconds
+}
+
+func (u *targetUse) touch(host string) {
+	last, ok := u.hosts.Load(host)
+	if !ok {
+		last, _ = u.hosts.LoadOrStore(host, new(atomic.Int64))
+	}
+	last.(*atomic.Int64).Store(time.Now().UnixNano())
+}
+
+func (u *targetUse) idle(host string, d time.Duration) bool {
+	last, ok := u.hosts.Load(host)
+	return !ok || time.Since(time.Unix(0, last.(*atomic.Int64).Load())) >= d
+}
+
+// Prewarm keeps Config.UpstreamPrewarmConns idle connections open to every
+// target until ctx is done, so that the first requests after a quiet spell
+// do not pay for TCP and TLS handshakes. Connections are opened right away
+// and topped up every interval for targets that received no requests
+// meanwhile, before the transport closes them as idle.
+func (s *Server) Prewarm(ctx context.Context) {
+	if s.prewarmConns <= 0 {
+		return
+	}
+	s.prewarmTargets(ctx, 0)
+	ticker := time.NewTicker(s.prewarmInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.prewarmTargets(ctx, s.prewarmInterval)
+		}
+	}
+}
+
+// prewarmTargets warms the targets idle for at least idle.
+func (s *Server) prewarmTargets(ctx context.Context, idle time.Duration) {
+	targets := []*url.URL{s.target}
+	if s.upstream != nil {
+		targets = targets[:0]
+		for _, target := range s.upstream.Targets() {
+			if target.Healthy {
+				targets = append(targets, target.URL)
+			}
+		}
+	}
+	for _, target := range targets {
+		if idle > 0 && !s.targetUse.idle(target.Host, idle) {
+			continue
+		}
+		s.prewarm(ctx, target)
+	}
+}
+
+// prewarm sends concurrent HEAD requests for the warm-up path, which leaves
+// as many connections idle in the transport. Requests that find an idle
+// connection reuse it, so the pool is topped up rather than grown.
+func (s *Server) prewarm(ctx context.Context, target *url.URL) {
+	ctx, cancel := context.WithTimeout(ctx, s.prewarmInterval)
+	defer cancel()
+	probe := *target
+	probe.Path = singleJoiningSlash(target.Path, s.prewarmPath)
+	probe.RawPath = ""
+
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for i := 0; i < s.prewarmConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, probe.String(), nil)
+			if err != nil {
+				failed.Add(1)
+				return
+			}
+			resp, err := s.transport.RoundTrip(req)
+			if err != nil {
+				failed.Add(1)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if n := failed.Load(); n > 0 {
+		s.logger.WithFields(logrus.Fields{"target": target.Host, "failed": n}).Warn("Error pre-warming upstream connections")
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestPrewarm(t *testing.T) {
+	var conns, heads atomic.Int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && r.URL.Path == "/healthz" {
+			heads.Add(1)
+		}
+		// Hold the requests, so that they cannot share a connection.
+		time.Sleep(20 * time.Millisecond)
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 3
+	defer transport.CloseIdleConnections()
+	s := &Server{
+		target:          target,
+		transport:       transport,
+		prewarmConns:    3,
+		prewarmInterval: time.Minute,
+		prewarmPath:     "/healthz",
+		logger:          logrus.New(),
+	}
+
+	s.prewarmTargets(context.Background(), 0)
+	if conns.Load() != 3 || heads.Load() != 3 {
+		t.Fatalf("expected 3 connections and probes, got %d and %d", conns.Load(), heads.Load())
+	}
+
+	// Warming up again reuses the idle connections.
+	s.prewarmTargets(context.Background(), 0)
+	if conns.Load() != 3 || heads.Load() != 6 {
+		t.Errorf("expected the idle connections to be reused, got %d connections and %d probes", conns.Load(), heads.Load())
+	}
+
+	// Targets that were used recently are left alone.
+	s.targetUse.touch(target.Host)
+	s.prewarmTargets(context.Background(), time.Minute)
+	if heads.Load() != 6 {
+		t.Errorf("expected a busy target not to be probed, got %d probes", heads.Load())
+	}
+}
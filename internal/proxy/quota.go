@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/knakul853/shielder/internal/auth"
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+// QuotaEndpoint serves callers their remaining budget, so that clients can
+// pace their requests instead of probing for 429 responses.
+type QuotaEndpoint struct {
+	// Path is where the quota is served, such as /.well-known/rate-limit
+	Path string
+	// RequireAuth answers callers without valid credentials with 401.
+	// It needs Config.Auth.
+	RequireAuth bool
+	// RequestsPerMinute is how often a client may ask, 30 by default.
+	// Asking more often gets the client's quota requests blocked, not its
+	// other requests.
+	RequestsPerMinute int
+}
+
+// quotaJSON is a budget as served to clients, with durations in seconds.
+type quotaJSON struct {
+	Limit      int   `json:"limit"`
+	Remaining  int   `json:"remaining"`
+	Reset      int64 `json:"reset"`
+	Blocked    bool  `json:"blocked,omitempty"`
+	BlockReset int64 `json:"blockReset,omitempty"`
+}
+
+type quotaResponse struct {
+	Algorithm string `json:"algorithm"`
+	// Window is the period limits are counted over, in seconds.
+	Window int `json:"window"`
+	quotaJSON
+	// Routes are the budgets of routes with a limit of their own.
+	Routes map[string]quotaJSON `json:"routes,omitempty"`
+}
+
+// serveQuota answers with the budgets of the caller's client key: the global
+// one and those of routes with their own limit. Limits tightened for the
+// caller, such as while greylisted, are not reflected. Asking for the quota
+// does not count against it but against a limit of its own, and blocked
+// clients are rejected as they would be anywhere else.
+func (s *Server) serveQuota(w http.ResponseWriter, r *http.Request, clientIP string) {
+	result, err := s.rateLimiter.Check(r.Context(), "quota:"+clientIP, 1, s.quota.RequestsPerMinute)
+	if err != nil {
+		s.logger.WithError(err).Warn("Error limiting quota requests")
+		limiterError(w, err)
+		return
+	}
+	if !result.Allowed {
+		setRateLimitHeaders(w.Header(), result)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	if s.quota.RequireAuth {
+		_, err := s.auth.Authenticate(r)
+		switch {
+		case errors.Is(err, auth.ErrNoCredentials), errors.Is(err, auth.ErrInvalidCredentials):
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		case err != nil:
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	key, rpm := s.limitKey(r, clientIP), 0
+	// Clients with a session are limited per session, see trackSession.
+	if sessionKey, sessionRPM, ok := s.sessionLimit(r); ok {
+		key, rpm = sessionKey, sessionRPM
+	}
+	quota, err := s.rateLimiter.Quota(r.Context(), key, rpm)
+	if err != nil {
+		s.logger.WithError(err).Warn("Error reading quota")
+		limiterError(w, err)
+		return
+	}
+	if quota.Blocked {
+		w.Header().Set("Retry-After", strconv.FormatInt(max(seconds(quota.BlockRemaining), 1), 10))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	resp := quotaResponse{
+		Algorithm: s.rateLimiter.Algorithm(),
+		Window:    int(time.Minute / time.Second),
+		quotaJSON: newQuotaJSON(quota),
+	}
+	for _, route := range s.routes.all() {
+		rpm := s.routeRequestsPerMinute(route)
+		// Preflight and per endpoint budgets are not the caller's to plan.
+		if rpm <= 0 || route.Preflight || route.PerEndpoint {
+			continue
+		}
+		quota, err := s.rateLimiter.Quota(r.Context(), "route:"+route.Name+":"+key, rpm)
+		if err != nil {
+			s.logger.WithError(err).Warn("Error reading quota")
+			limiterError(w, err)
+			return
+		}
+		if resp.Routes == nil {
+			resp.Routes = make(map[string]quotaJSON)
+		}
+		resp.Routes[route.Name] = newQuotaJSON(quota)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newQuotaJSON(q limiter.Quota) quotaJSON {
+	return quotaJSON{
+		Limit:      q.Limit,
+		Remaining:  q.Remaining,
+		Reset:      seconds(q.Reset),
+		Blocked:    q.Blocked,
+		BlockReset: seconds(q.BlockRemaining),
+	}
+}
+
+// setRateLimitHeaders tells a rejected client how its budget stands and when
+// to come back, in whole seconds.
+func setRateLimitHeaders(h http.Header, result limiter.Result) {
+	h.Set("Retry-After", strconv.FormatInt(max(seconds(result.RetryAfter), 1), 10))
+	h.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(seconds(result.Reset), 10))
+}
+
+// seconds rounds d up to whole seconds, so that clients waiting that long
+// are not early.
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	h := http.Header{}
+	setRateLimitHeaders(h, limiter.Result{Limit: 100, Reset: 42500 * time.Millisecond, RetryAfter: time.Hour})
+	want := map[string]string{
+		"Retry-After":           "3600",
+		"X-RateLimit-Limit":     "100",
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     "43",
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s: expected %s, got %s", name, value, got)
+		}
+	}
+
+	// Clients are never told to retry right away.
+	setRateLimitHeaders(h, limiter.Result{Limit: 100})
+	if got := h.Get("Retry-After"); got != "1" {
+		t.Errorf("expected a Retry-After of at least a second, got %s", got)
+	}
+}
+
+func TestQuotaIsLimited(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	s := newTestServer(t, Config{
+		TargetURL: upstream.URL,
+		Quota:     &QuotaEndpoint{Path: "/.well-known/rate-limit", RequestsPerMinute: 2},
+	}, 100)
+	ask := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/.well-known/rate-limit", nil)
+		r.RemoteAddr = remoteAddr
+		return serveTest(s, r)
+	}
+
+	for i := range 2 {
+		if rec := ask("198.51.100.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("Expected quota request %d to be answered, got %d", i+1, rec.Code)
+		}
+	}
+	if rec := ask("198.51.100.1:1234"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected quota requests over their own limit to be rejected, got %d", rec.Code)
+	}
+	// The limit of the quota is not the limit of the client.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	if rec := serveTest(s, r); rec.Code != http.StatusOK {
+		t.Errorf("Expected the other requests of the client to pass, got %d", rec.Code)
+	}
+
+	if err := s.rateLimiter.Block(context.Background(), "198.51.100.2", time.Hour, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := ask("198.51.100.2:1234"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Expected a blocked client to be rejected until its block ends, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
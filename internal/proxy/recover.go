@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/sirupsen/logrus"
+)
+
+// headerRequestID carries the ID of a request, taken over from the client or
+// a load balancer in front when it sends one.
+const headerRequestID = "X-Request-Id"
+
+// recovered turns panics of next into 500 responses carrying a request ID,
+// which the log line with the stack trace repeats, so that a bug in one
+// check or plugin fails one request instead of being dumped by net/http.
+// Responses that already started cannot be turned into a 500, their
+// connection is aborted instead.
+func (s *Server) recovered(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// Aborted on purpose, such as by the reverse proxy when the
+				// upstream breaks off a response.
+				panic(err)
+			}
+			id := requestID(r)
+			s.metrics.IncPanic()
+			s.logger.WithFields(logrus.Fields{
+				"request_id": id,
+				"client_ip":  s.clientIP(r),
+				"method":     r.Method,
+				"url":        r.URL.String(),
+				"panic":      fmt.Sprint(err),
+				"stack":      string(debug.Stack()),
+			}).Error("Panic serving request")
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set(headerRequestID, id)
+			http.Error(w, "Internal Server Error (request "+id+")", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// requestID returns the ID the request came with, or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(headerRequestID); id != "" && len(id) <= 128 && printable(id) {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(headerRequestID, "lb-1234")
+	if id := requestID(r); id != "lb-1234" {
+		t.Errorf("expected the ID of the load balancer, got %q", id)
+	}
+
+	// IDs that do not fit in a header or log line are replaced.
+	for _, bad := range []string{"", "a b", "a\x00", strings.Repeat("a", 129)} {
+		r.Header.Set(headerRequestID, bad)
+		if id := requestID(r); len(id) != 16 || id == bad {
+			t.Errorf("%q: expected a new ID, got %q", bad, id)
+		}
+	}
+}
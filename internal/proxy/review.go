@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/knakul853/shielder/internal/review"
+	"github.com/sirupsen/logrus"
+)
+
+// pendingReview reports whether the client limited by key is suspended
+// pending review, suspending it first if the signals that flagged it score in
+// the borderline band. Store errors leave the client alone.
+func (s *Server) pendingReview(ctx context.Context, r *http.Request, route *Route, key string, signals []string) bool {
+	suspended, err := s.review.Suspended(ctx, key)
+	if err != nil {
+		s.logger.WithError(err).Warn("Error checking review queue")
+		return false
+	}
+	if suspended {
+		return true
+	}
+	abuse := score(signals)
+	if !s.review.Borderline(abuse) {
+		return false
+	}
+	added, err := s.review.Suspend(ctx, review.Entry{
+		Client:   key,
+		ClientIP: s.clientIP(r),
+		Score:    abuse,
+		Rules:    signals,
+		Route:    route.Name,
+	})
+	if err != nil {
+		s.logger.WithError(err).Warn("Error suspending client for review")
+		return false
+	}
+	if added {
+		s.metrics.IncReviewSuspension(route.Name)
+		s.logger.WithFields(logrus.Fields{"client": key, "score": abuse, "rules": signals}).Info("Client suspended pending review")
+	}
+	return added
+}
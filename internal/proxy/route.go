@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/knakul853/shielder/internal/idempotency"
+	"github.com/knakul853/shielder/internal/signing"
+	"github.com/knakul853/shielder/plugin"
+)
+
+// Route applies route-specific behavior to requests matching a path prefix
+// and, optionally, a set of methods.
+type Route struct {
+	Name       string
+	PathPrefix string
+	Methods    []string
+	Plugins    []plugin.Plugin
+	// SkipAuthz exempts the route from external authorization
+	SkipAuthz bool
+	// SkipAuth exempts the route from authentication
+	SkipAuth bool
+	// RequestsPerMinute gives the route its own rate limit, counted
+	// separately from other routes. Zero uses the global limit.
+	RequestsPerMinute int
+	// Preflight restricts the route to CORS preflight requests. Preflight
+	// routes take precedence over other routes and are always counted
+	// separately, so that preflights do not consume the API budget.
+	Preflight bool
+	// Body controls buffering and upload rate limits of request bodies
+	Body BodyPolicy
+	// Signer, when set, signs requests right before they are sent to the
+	// target
+	Signer signing.Signer
+	// Tag forwards requests that would be rejected or challenged with
+	// headers describing why, leaving the decision to the upstream.
+	// Requests over the instance ceiling are still rejected.
+	Tag bool
+	// Idempotency, when set, enforces the Idempotency-Key contract on the
+	// route, per client
+	Idempotency *idempotency.Guard
+	// PerEndpoint counts the route limit separately for every path
+	// template, see Config.PathTemplates
+	PerEndpoint bool
+	// Streaming marks every request on the route as long-lived and passes
+	// response bytes on as soon as they arrive. WebSocket upgrades and
+	// Server-Sent Events are recognized on any route.
+	Streaming bool
+
+	handler http.Handler
+	// trusted serves health checks and monitoring, see Server.buildRoute
+	trusted http.Handler
+}
+
+// defaultRouteName is used for requests that match no configured route.
+const defaultRouteName = "default"
+
+// matches reports whether the request falls under this route.
+func (rt *Route) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.Preflight && !plugin.IsPreflight(r) {
+		return false
+	}
+	if len(rt.Methods) == 0 {
+		return true
+	}
+	for _, method := range rt.Methods {
+		if strings.EqualFold(method, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// modifyResponse chains the ModifyResponse hooks of the route's plugins.
+func (rt *Route) modifyResponse() func(*http.Response) error {
+	var modifiers []plugin.ResponseModifier
+	for _, p := range rt.Plugins {
+		if m, ok := p.(plugin.ResponseModifier); ok {
+			modifiers = append(modifiers, m)
+		}
+	}
+	if len(modifiers) == 0 {
+		return nil
+	}
+	return func(resp *http.Response) error {
+		for _, m := range modifiers {
+			if err := m.ModifyResponse(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// wrap applies the route's plugins for the given stage around next. The first
+// configured plugin is the outermost middleware.
+func (rt *Route) wrap(stage plugin.Stage, next http.Handler) http.Handler {
+	for i := len(rt.Plugins) - 1; i >= 0; i-- {
+		next = rt.Plugins[i].Middleware(stage, next)
+	}
+	return next
+}
+
+// routeTable finds the route for a request. Preflight routes take precedence,
+// then longer path prefixes, and a catch-all default route handles everything
+// else.
+type routeTable struct {
+	routes   []*Route
+	fallback *Route
+}
+
+func newRouteTable(routes []Route) *routeTable {
+	table := &routeTable{fallback: &Route{Name: defaultRouteName}}
+	for i := range routes {
+		table.routes = append(table.routes, &routes[i])
+	}
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		a, b := table.routes[i], table.routes[j]
+		if a.Preflight != b.Preflight {
+			return a.Preflight
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+	return table
+}
+
+func (t *routeTable) match(r *http.Request) *Route {
+	for _, route := range t.routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+	return t.fallback
+}
+
+// all returns every route including the default one.
+func (t *routeTable) all() []*Route {
+	return append(append([]*Route{}, t.routes...), t.fallback)
+}
+
+// SetRouteLimits overrides the requests per minute of the named routes while
+// requests are being served. Routes that are not listed keep their configured
+// limit.
+func (s *Server) SetRouteLimits(limits map[string]int) {
+	s.routeLimits.Store(&limits)
+}
+
+// routeRequestsPerMinute returns the limit in effect for route, zero if the
+// route falls under the global limit.
+func (s *Server) routeRequestsPerMinute(route *Route) int {
+	if limits := s.routeLimits.Load(); limits != nil {
+		if rpm, ok := (*limits)[route.Name]; ok {
+			return rpm
+		}
+	}
+	return route.RequestsPerMinute
+}
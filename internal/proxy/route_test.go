@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteTableMatch(t *testing.T) {
+	table := newRouteTable([]Route{
+		{Name: "api", PathPrefix: "/api/"},
+		{Name: "api-write", PathPrefix: "/api/", Methods: []string{"POST", "PUT"}},
+		{Name: "users", PathPrefix: "/api/users/"},
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/api/users/1", "users"},
+		{"GET", "/api/orders", "api"},
+		{"POST", "/api/orders", "api"},
+		{"GET", "/static/app.js", defaultRouteName},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := table.match(r).Name; got != tt.want {
+			t.Errorf("%s %s: expected route %q, got %q", tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestRouteTableMatchPreflight(t *testing.T) {
+	table := newRouteTable([]Route{
+		{Name: "users", PathPrefix: "/api/users/"},
+		{Name: "api-preflight", PathPrefix: "/api/", Preflight: true},
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    string
+	}{
+		{"preflight", "OPTIONS", map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "PUT"}, "api-preflight"},
+		{"plain OPTIONS", "OPTIONS", nil, "users"},
+		{"OPTIONS without request method", "OPTIONS", map[string]string{"Origin": "https://app.example.com"}, "users"},
+		{"GET", "GET", map[string]string{"Origin": "https://app.example.com"}, "users"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/users/1", nil)
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		if got := table.match(r).Name; got != tt.want {
+			t.Errorf("%s: expected route %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestSetRouteLimits(t *testing.T) {
+	s := &Server{}
+	login := &Route{Name: "login", RequestsPerMinute: 10}
+	api := &Route{Name: "api", RequestsPerMinute: 100}
+
+	if got := s.routeRequestsPerMinute(login); got != 10 {
+		t.Errorf("Expected the configured limit 10, got %d", got)
+	}
+	s.SetRouteLimits(map[string]int{"login": 5})
+	if got := s.routeRequestsPerMinute(login); got != 5 {
+		t.Errorf("Expected the overridden limit 5, got %d", got)
+	}
+	if got := s.routeRequestsPerMinute(api); got != 100 {
+		t.Errorf("Expected routes without override to keep 100, got %d", got)
+	}
+	s.SetRouteLimits(nil)
+	if got := s.routeRequestsPerMinute(login); got != 10 {
+		t.Errorf("Expected the configured limit after reset, got %d", got)
+	}
+}
@@ -2,29 +2,352 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/knakul853/shielder/internal/accounting"
+	"github.com/knakul853/shielder/internal/anomaly"
+	"github.com/knakul853/shielder/internal/audit"
+	"github.com/knakul853/shielder/internal/auth"
+	"github.com/knakul853/shielder/internal/authz"
+	"github.com/knakul853/shielder/internal/bypass"
+	"github.com/knakul853/shielder/internal/challenge"
+	"github.com/knakul853/shielder/internal/clearance"
+	"github.com/knakul853/shielder/internal/decisionlog"
+	"github.com/knakul853/shielder/internal/escalation"
+	"github.com/knakul853/shielder/internal/feedback"
+	"github.com/knakul853/shielder/internal/fingerprint"
+	"github.com/knakul853/shielder/internal/geoip"
+	"github.com/knakul853/shielder/internal/greylist"
+	"github.com/knakul853/shielder/internal/iplist"
 	"github.com/knakul853/shielder/internal/limiter"
 	"github.com/knakul853/shielder/internal/monitor"
+	"github.com/knakul853/shielder/internal/pathtemplate"
+	"github.com/knakul853/shielder/internal/review"
+	"github.com/knakul853/shielder/internal/session"
+	"github.com/knakul853/shielder/internal/signing"
+	"github.com/knakul853/shielder/internal/tap"
+	"github.com/knakul853/shielder/internal/tracing"
+	"github.com/knakul853/shielder/internal/trust"
+	"github.com/knakul853/shielder/internal/tuning"
+	"github.com/knakul853/shielder/internal/underattack"
+	"github.com/knakul853/shielder/internal/upstream"
+	"github.com/knakul853/shielder/internal/wafsync"
+	"github.com/knakul853/shielder/plugin"
 	"github.com/sirupsen/logrus"
 )
 
 type Server struct {
-	server      *http.Server
-	target      *url.URL
-	rateLimiter *limiter.RateLimiter
-	metrics     *monitor.MetricsCollector
-	logger      *logrus.Logger
+	server           *http.Server
+	target           *url.URL
+	upstream         *upstream.Pool
+	transport        *http.Transport
+	routes           *routeTable
+	authz            *authz.Authorizer
+	auth             *auth.Authenticator
+	clearance        *clearance.Manager
+	bypass           *bypass.Manager
+	sessions         *session.Manager
+	anomaly          *anomaly.Analyzer
+	tuner            *tuning.Tuner
+	underAttack      *underattack.Mode
+	challenger       *challenge.Challenger
+	tapper           *tap.Tapper
+	trusted          *trust.Matcher
+	fingerprints     *fingerprint.Linker
+	greylist         *greylist.Greylist
+	escalator        *escalation.Escalator
+	review           *review.Queue
+	tracer           *tracing.Tracer
+	feedback         *feedback.Collector
+	wafSync          *wafsync.Syncer
+	decisionLog      *decisionlog.Log
+	audit            *audit.Sampler
+	templates        *pathtemplate.Templater
+	expensive        *ExpensivePolicy
+	accessLog        *AccessLog
+	conditionalCache *ConditionalCache
+	breakerPolicy    *BreakerPolicy
+	// breakers holds the circuits by route name, see circuit
+	breakers map[string]*breaker
+	ipLists  *iplist.Lists
+	quota    *QuotaEndpoint
+	status   *StatusEndpoint
+	identity *IdentityHeaders
+	locator  *geoip.Locator
+	// blockedCountries holds ISO 3166 alpha-2 codes, see blockedCountry
+	blockedCountries map[string]bool
+	accountant       *accounting.Accountant
+	metricsPath      string
+	scrape           http.Handler
+	normalize        bool
+	keyStrategy      KeyStrategy
+	keyNamespace     string
+	clientIPs        *ClientIPResolver
+	budget           time.Duration
+	rateLimiter      *limiter.RateLimiter
+	metrics          *monitor.MetricsCollector
+	logger           *logrus.Logger
+
+	// dropInformational and informationalHeaders apply to 1xx responses,
+	// see informationalWriter
+	dropInformational    bool
+	informationalHeaders map[string]bool
+
+	// prewarmConns, prewarmInterval and prewarmPath configure Prewarm,
+	// targetUse tells it which targets went quiet
+	prewarmConns    int
+	prewarmInterval time.Duration
+	prewarmPath     string
+	targetUse       targetUse
+
+	// fullCost and lightCost are what requests count as, see requestCost
+	fullCost  int
+	lightCost int
+
+	// exemptStreams and maxStreamDuration apply to long-lived requests,
+	// see streaming
+	exemptStreams     bool
+	maxStreamDuration time.Duration
+
+	// maxBodyBytes caps request bodies, see limitBody
+	maxBodyBytes int64
+
+	// routeLimits overrides the configured route limits, see SetRouteLimits
+	routeLimits atomic.Pointer[map[string]int]
+
+	// inFlight counts the requests being served, abort cancels them when
+	// draining them timed out, see Shutdown
+	inFlight atomic.Int64
+	abort    context.CancelFunc
 }
 
 type Config struct {
-	ListenAddr  string
-	TargetURL   string
-	ReadTimeout time.Duration
+	ListenAddr   string
+	TargetURL    string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// ExemptStreams lifts ReadTimeout and WriteTimeout for long-lived
+	// requests, WebSocket upgrades, Server-Sent Events and requests on
+	// streaming routes. They last MaxStreamDuration at most then, zero
+	// leaves them open until either side closes.
+	ExemptStreams     bool
+	MaxStreamDuration time.Duration
+
+	// Upstream, when set, balances requests over several targets instead
+	// of sending them all to TargetURL
+	Upstream *upstream.Pool
+
+	// EgressProxy is an http, https or socks5 proxy the target is reached
+	// through. Empty uses the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables.
+	EgressProxy string
+
+	// NormalizeURLs canonicalizes paths and hosts before anything matches
+	// on them, see normalizeRequest
+	NormalizeURLs bool
+
+	// KeyStrategy selects what clients are rate limited by, the client IP
+	// by default
+	KeyStrategy KeyStrategy
+	// KeyNamespace prefixes the keys clients are limited by, so that
+	// servers sharing a store count and block their clients separately
+	KeyNamespace string
+
+	// ClientIPs, when set, finds the client address behind trusted proxies.
+	// Without it the peer address is the client address.
+	ClientIPs *ClientIPResolver
+
+	// CheckBudget bounds the time spent in request-stage plugins and the
+	// protection checks. Once it is used up, the failure policies decide
+	// instead of waiting on a slow store. Zero disables the budget.
+	CheckBudget time.Duration
+
+	// UpstreamIPFamily is the address family policy for upstream
+	// connections, see the Family constants. Empty dials dual-stack.
+	// UpstreamFallbackDelay is how long the first family gets before the
+	// other one is tried, zero uses 300ms.
+	UpstreamIPFamily      string
+	UpstreamFallbackDelay time.Duration
+
+	// Upstream connection limits per target address, zero disables the
+	// respective limit
+	MaxUpstreamConns          int
+	MaxNewUpstreamConnsPerSec float64
+	NewUpstreamConnBurst      int
+	UpstreamConnWait          time.Duration
+
+	// Upstream transport tuning, zero keeps up to 100 idle connections per
+	// target for 90s and gives dialing and TLS handshakes 5s each. A zero
+	// UpstreamResponseHeaderTimeout waits for response headers as long as
+	// the request lasts.
+	UpstreamMaxIdleConnsPerHost   int
+	UpstreamIdleConnTimeout       time.Duration
+	UpstreamDialTimeout           time.Duration
+	UpstreamTLSHandshakeTimeout   time.Duration
+	UpstreamResponseHeaderTimeout time.Duration
+
+	// UpstreamPrewarmConns is the number of idle connections Prewarm keeps
+	// open to every target, zero disables pre-warming. Targets idle for
+	// UpstreamPrewarmInterval, half the idle connection timeout by default,
+	// are warmed up again with HEAD requests for UpstreamPrewarmPath, "/" by
+	// default.
+	UpstreamPrewarmConns    int
+	UpstreamPrewarmInterval time.Duration
+	UpstreamPrewarmPath     string
+
+	// DropInformational discards 1xx responses from the upstream, such as
+	// 103 Early Hints, instead of passing them on. InformationalHeaders
+	// limits the headers passed on with them, empty passes all.
+	DropInformational    bool
+	InformationalHeaders []string
+
+	// Routes with route-specific behavior, requests matching none of them use
+	// the default route
+	Routes []Route
+
+	// Authz, when set, checks protected requests with an external
+	// authorization service
+	Authz *authz.Authorizer
+
+	// Auth, when set, authenticates protected requests by JWT, token
+	// introspection or API key
+	Auth *auth.Authenticator
+
+	// Clearance, when set, verifies clearance cookies so that later stages
+	// can let cleared clients skip challenges
+	Clearance *clearance.Manager
+
+	// Bypass, when set, lets requests with an emergency bypass token skip
+	// limits and challenges
+	Bypass *bypass.Manager
+
+	// Sessions, when set, rate limits browsers by Shielder session in
+	// addition to a shared per-IP limit
+	Sessions *session.Manager
+
+	// Anomaly, when set, observes the responses of every route and tightens
+	// the rate limits of routes with anomalous traffic
+	Anomaly *anomaly.Analyzer
+
+	// Tuner, when set, observes client rates to recommend rate limits
+	Tuner *tuning.Tuner
+
+	// UnderAttack, when set, tightens limits and challenges uncleared
+	// clients while the mode is active. Challenges need Challenger.
+	UnderAttack *underattack.Mode
+	Challenger  *challenge.Challenger
+
+	// Tapper, when set, captures the exchanges of tapped clients
+	Tapper *tap.Tapper
+
+	// Trusted, when set, recognizes health checks and monitoring, which
+	// bypass protection and are kept out of traffic baselines
+	Trusted *trust.Matcher
+
+	// Fingerprints, when set, carries part of the penalty of limited clients
+	// over to clients with the same fingerprint on other IPs
+	Fingerprints *fingerprint.Linker
+
+	// Greylist, when set, tightens limits for or challenges clients without
+	// clearance during their first minutes. Challenges need Challenger.
+	Greylist *greylist.Greylist
+
+	// Escalator, when set, blocks clients everywhere that are blocked or
+	// rate limited on several routes or under several keys
+	Escalator *escalation.Escalator
+
+	// Review, when set, suspends clients with borderline scores pending an
+	// operator's review, tightening their limits or challenging them.
+	// Challenges need Challenger.
+	Review *review.Queue
+
+	// Tracer, when set, adds a breakdown of the protection checks to the
+	// responses of traced requests
+	Tracer *tracing.Tracer
+
+	// Feedback, when set, records false positives the upstream reports in
+	// response headers
+	Feedback *feedback.Collector
+
+	// WAFSync, when set, rejects clients on the lists imported from WAF
+	// providers
+	WAFSync *wafsync.Syncer
+
+	// DecisionLog, when set, receives a record of every protection decision
+	DecisionLog *decisionlog.Log
+
+	// Audit, when set, samples requests with their headers and outcome
+	Audit *audit.Sampler
+
+	// PathTemplates, when set, maps request paths to the endpoints that
+	// metrics, per endpoint limits and logs use
+	PathTemplates *pathtemplate.Templater
+
+	// Expensive, when set, flags slow requests and large responses
+	Expensive *ExpensivePolicy
+
+	// AccessLog, when set, receives one line per request with the status and
+	// bytes the client received
+	AccessLog *AccessLog
+
+	// RequestCost is what a request counts as against the rate limits, one
+	// by default. HEAD requests and conditional GETs count as
+	// LightRequestCost instead, RequestCost by default, so that clients
+	// polling for changes can poll more often than they can fetch.
+	RequestCost      int
+	LightRequestCost int
+
+	// ConditionalCache, when set, answers HEAD requests and conditional
+	// GETs from the headers of recent responses
+	ConditionalCache *ConditionalCache
+
+	// Breaker, when set, gives every route a circuit breaker that stops
+	// forwarding while the upstream fails
+	Breaker *BreakerPolicy
+
+	// MaxRequestBodyBytes rejects request bodies over this size with 413
+	// before they reach the upstream, zero disables the limit
+	MaxRequestBodyBytes int64
+
+	// IPLists, when set, reject denied clients with 403 and let allowed
+	// clients past the rate limits
+	IPLists *iplist.Lists
+
+	// Quota, when set, serves callers their remaining budget
+	Quota *QuotaEndpoint
+
+	// Status, when set, tells callers whether they are limited or blocked
+	Status *StatusEndpoint
+
+	// Identity, when set, passes the resolved client identity to the
+	// upstream in headers
+	Identity *IdentityHeaders
+
+	// Locator, when set, locates clients for identity headers and country
+	// blocking. Requests from BlockedCountries are rejected with 403.
+	Locator          *geoip.Locator
+	BlockedCountries []string
+
+	// Accountant, when set, aggregates the usage of authenticated clients
+	// for billing
+	Accountant *accounting.Accountant
+
+	// MetricsPath, when set, serves MetricsHandler on the proxy listener.
+	// Scrapes bypass protection and are not counted as requests.
+	MetricsPath    string
+	MetricsHandler http.Handler
 }
 
 // NewServer initializes a new reverse proxy server that forwards requests to the target URL.
@@ -45,18 +368,169 @@ func NewServer(cfg Config, limiter *limiter.RateLimiter, metrics *monitor.Metric
 	logger.SetFormatter(&logrus.JSONFormatter{})
 	logger.SetLevel(logrus.DebugLevel) // Adjust log level as needed
 
+	dialTimeout := 5 * time.Second
+	if cfg.UpstreamDialTimeout > 0 {
+		dialTimeout = cfg.UpstreamDialTimeout
+	}
+	dial, err := newFamilyDialer(
+		&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second},
+		cfg.UpstreamIPFamily,
+		cfg.UpstreamFallbackDelay,
+	)
+	if err != nil {
+		log.Fatalf("Invalid upstream dialing policy: %v", err)
+	}
+	gate := newConnGate(
+		dial,
+		cfg.MaxUpstreamConns,
+		cfg.MaxNewUpstreamConnsPerSec,
+		cfg.NewUpstreamConnBurst,
+		cfg.UpstreamConnWait,
+		metrics,
+	)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = gate.DialContext
+	transport.MaxConnsPerHost = cfg.MaxUpstreamConns
+	// Idle connections are bounded per target, the default of two per host
+	// makes busy proxies open and close upstream connections constantly.
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = 100
+	if cfg.UpstreamMaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.UpstreamMaxIdleConnsPerHost
+	}
+	if cfg.UpstreamIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.UpstreamIdleConnTimeout
+	}
+	transport.TLSHandshakeTimeout = 5 * time.Second
+	if cfg.UpstreamTLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = cfg.UpstreamTLSHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = cfg.UpstreamResponseHeaderTimeout
+	if cfg.EgressProxy != "" {
+		egress, err := parseEgressProxy(cfg.EgressProxy)
+		if err != nil {
+			log.Fatalf("Invalid egress proxy: %v", err)
+		}
+		// Connections to the egress proxy count against the upstream limits.
+		transport.Proxy = http.ProxyURL(egress)
+	}
+
 	proxy := &Server{
-		target:      target,
-		rateLimiter: limiter,
-		metrics:     metrics,
-		logger:      logger,
+		target:           target,
+		upstream:         cfg.Upstream,
+		transport:        transport,
+		routes:           newRouteTable(cfg.Routes),
+		authz:            cfg.Authz,
+		auth:             cfg.Auth,
+		clearance:        cfg.Clearance,
+		bypass:           cfg.Bypass,
+		sessions:         cfg.Sessions,
+		anomaly:          cfg.Anomaly,
+		tuner:            cfg.Tuner,
+		underAttack:      cfg.UnderAttack,
+		challenger:       cfg.Challenger,
+		tapper:           cfg.Tapper,
+		trusted:          cfg.Trusted,
+		fingerprints:     cfg.Fingerprints,
+		greylist:         cfg.Greylist,
+		escalator:        cfg.Escalator,
+		review:           cfg.Review,
+		tracer:           cfg.Tracer,
+		feedback:         cfg.Feedback,
+		wafSync:          cfg.WAFSync,
+		decisionLog:      cfg.DecisionLog,
+		audit:            cfg.Audit,
+		templates:        cfg.PathTemplates,
+		expensive:        cfg.Expensive,
+		accessLog:        cfg.AccessLog,
+		conditionalCache: cfg.ConditionalCache,
+		breakerPolicy:    cfg.Breaker,
+		breakers:         make(map[string]*breaker),
+		ipLists:          cfg.IPLists,
+		quota:            cfg.Quota,
+		status:           cfg.Status,
+		identity:         cfg.Identity,
+		locator:          cfg.Locator,
+		accountant:       cfg.Accountant,
+		metricsPath:      cfg.MetricsPath,
+		scrape:           cfg.MetricsHandler,
+		normalize:        cfg.NormalizeURLs,
+		keyStrategy:      cfg.KeyStrategy,
+		keyNamespace:     cfg.KeyNamespace,
+		clientIPs:        cfg.ClientIPs,
+		budget:           cfg.CheckBudget,
+		rateLimiter:      limiter,
+		metrics:          metrics,
+		logger:           logger,
+
+		dropInformational: cfg.DropInformational,
+
+		prewarmConns:    cfg.UpstreamPrewarmConns,
+		prewarmInterval: cfg.UpstreamPrewarmInterval,
+		prewarmPath:     cfg.UpstreamPrewarmPath,
+
+		fullCost:  cfg.RequestCost,
+		lightCost: cfg.LightRequestCost,
+
+		exemptStreams:     cfg.ExemptStreams,
+		maxStreamDuration: cfg.MaxStreamDuration,
+
+		maxBodyBytes: cfg.MaxRequestBodyBytes,
+	}
+	if proxy.fullCost <= 0 {
+		proxy.fullCost = 1
+	}
+	if proxy.lightCost <= 0 {
+		proxy.lightCost = proxy.fullCost
+	}
+	if proxy.prewarmInterval <= 0 {
+		proxy.prewarmInterval = transport.IdleConnTimeout / 2
+	}
+	if proxy.prewarmPath == "" {
+		proxy.prewarmPath = "/"
+	}
+	if cfg.Quota != nil {
+		quota := *cfg.Quota
+		if quota.RequestsPerMinute <= 0 {
+			quota.RequestsPerMinute = 30
+		}
+		proxy.quota = &quota
+	}
+	if cfg.Status != nil {
+		status := *cfg.Status
+		if status.RequestsPerMinute <= 0 {
+			status.RequestsPerMinute = 30
+		}
+		if status.MaxAge <= 0 {
+			status.MaxAge = 5 * time.Second
+		}
+		proxy.status = &status
+	}
+	if len(cfg.BlockedCountries) > 0 {
+		proxy.blockedCountries = make(map[string]bool, len(cfg.BlockedCountries))
+		for _, country := range cfg.BlockedCountries {
+			proxy.blockedCountries[country] = true
+		}
+	}
+	if len(cfg.InformationalHeaders) > 0 {
+		proxy.informationalHeaders = make(map[string]bool, len(cfg.InformationalHeaders))
+		for _, name := range cfg.InformationalHeaders {
+			proxy.informationalHeaders[http.CanonicalHeaderKey(name)] = true
+		}
 	}
 
+	for _, route := range proxy.routes.all() {
+		proxy.buildRoute(route)
+	}
+
+	base, abort := context.WithCancel(context.Background())
+	proxy.abort = abort
 	proxy.server = &http.Server{
 		Addr:         cfg.ListenAddr,
-		Handler:      proxy.handler(),
+		Handler:      proxy.counted(proxy.accessLogged(proxy.recovered(proxy.handler()))),
 		ReadTimeout:  cfg.ReadTimeout,
-		WriteTimeout: cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		BaseContext:  func(net.Listener) context.Context { return base },
 	}
 
 	return proxy
@@ -67,74 +541,767 @@ func NewServer(cfg Config, limiter *limiter.RateLimiter, metrics *monitor.Metric
 //
 // The handler logs the request and response, and records metrics about the request
 // traffic, including the number of requests and the number of blocked requests.
-//
-// If the request is blocked due to rate limiting, the handler returns a 429 status
-// code with a "Too Many Requests" message. If there is an error checking the rate
-// limit, the handler returns a 500 status code with an "Internal Server Error"
-// message.
+// Each request is dispatched to the chain of the route it matches, see buildRoute.
 func (s *Server) handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		clientIP := r.RemoteAddr
+		if s.scrape != nil && r.URL.Path == s.metricsPath {
+			s.scrape.ServeHTTP(w, r)
+			return
+		}
+		clientIP := s.clientIP(r)
 
 		// Start timing the request
 		start := time.Now()
+		trusted := false
+		routeName, endpoint := "", ""
 		defer func() {
-			s.metrics.ObserveRequestDuration(r.URL.Path, time.Since(start))
+			if !trusted {
+				s.metrics.ObserveRequestDuration(endpoint, routeName, time.Since(start))
+			}
 		}()
 
+		if s.tapper != nil {
+			if capture := s.tapper.Begin(w, r, clientIP); capture != nil {
+				w, r = capture.Writer, capture.Request
+				defer func() { capture.Finish(routeName) }()
+			}
+		}
+		if s.normalize {
+			normalizeRequest(r)
+		}
+		endpoint = s.endpoint(r.URL.Path)
+
+		if s.challenger != nil && r.URL.Path == s.challenger.Path() {
+			s.challenger.Verify(w, r, clientIP)
+			return
+		}
+		if s.quota != nil && r.URL.Path == s.quota.Path {
+			s.serveQuota(w, r, clientIP)
+			return
+		}
+		if s.status != nil && r.URL.Path == s.status.Path {
+			s.serveStatus(w, r, clientIP)
+			return
+		}
+
+		route := s.routes.match(r)
+		routeName = route.Name
+		if entry := accessEntryFrom(r.Context()); entry != nil {
+			entry.route = route.Name
+		}
+		decision := &plugin.Decision{ClientIP: clientIP, Key: clientIP, Route: route.Name, Endpoint: endpoint}
+		r = r.WithContext(plugin.ContextWithDecision(r.Context(), decision))
+		var trace *tracing.Trace
+		if s.tracer != nil && s.tracer.Enabled(r.Context(), r, clientIP) {
+			trace = tracing.Start()
+			trace.Add("route", route.Name, "client "+clientIP+" endpoint "+endpoint)
+			r = r.WithContext(tracing.NewContext(r.Context(), trace))
+			w = trace.Writer(w)
+		}
+		// The body size limit holds for trusted and bypassing clients as well.
+		if !s.limitBody(w, r) {
+			return
+		}
+		if s.trusted != nil {
+			var identity string
+			if identity, trusted = s.trusted.Match(r, clientIP); trusted {
+				trace.Add("trusted", "matched", identity)
+				s.metrics.IncTrustedRequest(identity)
+				decision.Outcome, decision.Reason = plugin.OutcomeTrusted, identity
+				route.trusted.ServeHTTP(w, r)
+				return
+			}
+		}
+		if s.bypass != nil {
+			if claims := s.verifyBypass(r, clientIP); claims != nil {
+				trace.Add("bypass", "granted", claims.Subject)
+				s.metrics.IncBypassedRequest(claims.Subject)
+				decision.Outcome, decision.Reason = plugin.OutcomeBypassed, claims.Subject
+				route.trusted.ServeHTTP(w, r)
+				return
+			}
+		}
+		limit := &plugin.Limit{Key: s.limitKey(r, clientIP), Cost: s.requestCost(r)}
+		r = r.WithContext(plugin.ContextWithLimit(r.Context(), limit))
+		r = s.verifyClearance(r, clientIP)
+		// Preflights carry no cookies, a session would start on every one.
+		if !plugin.IsPreflight(r) {
+			r = s.trackSession(w, r, clientIP)
+		}
+		// Route limits are counted per client key, the session of clients
+		// that have one.
+		if rpm := s.routeRequestsPerMinute(route); rpm > 0 || route.Preflight {
+			if route.PerEndpoint {
+				limit.Key = endpoint + ":" + limit.Key
+			}
+			limit.Key = "route:" + route.Name + ":" + limit.Key
+			limit.RequestsPerMinute = rpm
+		}
+
 		s.logger.WithFields(logrus.Fields{
 			"client_ip": clientIP,
 			"method":    r.Method,
 			"url":       r.URL,
+			"route":     route.Name,
+			"endpoint":  endpoint,
 		}).Info("Request received")
 
-		// Check if IP is blocked
-		blocked, err := s.rateLimiter.IsBlocked(r.Context(), clientIP)
-		if err != nil {
-			s.logger.WithError(err).Error("Error checking if IP is blocked")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+		sw := &statusWriter{ResponseWriter: w}
+		route.handler.ServeHTTP(sw, r)
+		// Long-lived requests are slow by design.
+		if s.expensive != nil && streamKind(route, r) == "" {
+			s.flagExpensive(r, route, limit.Key, endpoint, sw, time.Since(start))
+		}
+		if s.anomaly != nil {
+			s.anomaly.Observe(route.Name, sw.status)
+		}
+		if s.tuner != nil {
+			s.tuner.Observe(route.Name, limit.Key, limit.Cost, sw.status)
+		}
+		if s.underAttack != nil {
+			s.underAttack.Observe(sw.status)
+		}
+		if s.audit != nil && s.audit.Sample() {
+			s.auditRequest(r, route, clientIP, endpoint, sw, start)
+		}
+	})
+}
+
+// endpoint returns the path template of path, or path itself when no
+// templates are configured.
+func (s *Server) endpoint(path string) string {
+	if s.templates == nil {
+		return path
+	}
+	return s.templates.Template(path)
+}
+
+// clientIP returns the address of the client without the port, so that all
+// connections of a client share one identity. Behind trusted proxies it is
+// taken from their forwarding headers, see ClientIPResolver.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.clientIPs != nil {
+		return s.clientIPs.ClientIP(r)
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+// verifyClearance attaches the verified clearance of the client to the request
+// context. Invalid cookies are ignored, the client is treated as uncleared.
+func (s *Server) verifyClearance(r *http.Request, clientIP string) *http.Request {
+	if s.clearance == nil {
+		return r
+	}
+	claims, err := s.clearance.Verify(r.Context(), r, clientIP)
+	if err != nil {
+		if !errors.Is(err, clearance.ErrNoToken) {
+			s.logger.WithError(err).WithField("client_ip", clientIP).Debug("Ignoring clearance cookie")
+		}
+		return r
+	}
+	return r.WithContext(clearance.ContextWithClaims(r.Context(), claims))
+}
+
+// buildRoute assembles the handler chain of a route:
+//
+//	request-stage plugins -> protection checks ->
+//	under attack guard -> body policy -> authentication ->
+//	external authorization -> upstream-stage plugins -> idempotency ->
+//	conditional cache -> streaming -> circuit breaker -> forward
+//
+// so that request-stage plugins see every request, while upstream-stage
+// plugins only see requests that are going to be forwarded. Rate limiting runs
+// before authentication and external authorization to shield the identity and
+// authorization services as well. The body policy only reads the bodies of
+// requests that passed the checks, so that blocked clients cannot tie up the
+// proxy with uploads. Trusted health checks and monitoring enter the chain at
+// the body policy, bypassing limits and request-stage filters, and so do
+// requests with a bypass token. The body size limit is applied to all of them
+// before they enter the chain, see limitBody.
+func (s *Server) buildRoute(route *Route) {
+	var transport http.RoundTripper = s.transport
+	if route.Signer != nil {
+		transport = signing.Transport(transport, route.Signer)
+	}
+	// Identity headers are signed first, route signatures may cover them.
+	if s.identity != nil && s.identity.Signer != nil {
+		transport = signing.Transport(transport, s.identity.Signer)
+	}
+	h := s.forward(route, s.reportFalsePositives(route, route.modifyResponse()), transport)
+	if s.breakerPolicy != nil {
+		h = s.circuit(route, h)
+	}
+	if s.conditionalCache != nil {
+		h = s.conditional(route, h)
+	}
+	h = s.streaming(route, h)
+	if route.Idempotency != nil {
+		h = route.Idempotency.Middleware(s.idempotencyClient, h)
+	}
+	h = route.wrap(plugin.StageUpstream, h)
+	if s.authz != nil && !route.SkipAuthz {
+		h = s.authz.Middleware(h)
+	}
+	if s.auth != nil && !route.SkipAuth {
+		h = s.auth.Middleware(h)
+	}
+	h = s.readBody(route.Body, h)
+	route.trusted = h
+	h = s.guard(h)
+	h = s.protect(route, h)
+	route.handler = s.startBudget(route.wrap(plugin.StageRequest, h))
+}
+
+// idempotencyClient scopes idempotency keys to the authenticated subject, or
+// to the client IP of unauthenticated requests.
+func (s *Server) idempotencyClient(r *http.Request) string {
+	if identity := auth.FromContext(r.Context()); identity != nil {
+		return identity.Method + ":" + identity.Subject
+	}
+	return s.clientIP(r)
+}
+
+// protect returns middleware that rejects blocked and rate-limited clients.
+//
+// If the request is blocked due to rate limiting, it returns a 429 status code
+// with a "Too Many Requests" message. If there is an error checking the rate
+// limit, it returns a 500 status code with an "Internal Server Error" message,
+// or 503 while the limiter store is down and the failure policy is closed.
+//
+// Clients are identified by the plugin.Limit of the request, which
+// request-stage plugins may have rewritten. Requests limited per session are
+// also checked against the limit shared by all sessions of their IP, and every
+// request against the extra limits plugins added to it. All limits are scaled
+// down while the route is tightened after a traffic anomaly, for clients that
+// share their fingerprint with a recently limited client, and for greylisted
+// clients and clients pending review, which are marked for guard if they are to
+// be challenged instead. Clients whose signals score in the borderline band are
+// suspended pending review, see pendingReview.
+//
+// Clients on lists imported from WAF providers are rejected with 403, as are
+// fingerprints escalated to the global block list. On tagging routes, blocked
+// and rate-limited requests are forwarded with tag headers instead of being
+// rejected, see setTagHeaders.
+//
+// The static IP lists come before everything else: denied clients are
+// rejected with 403 whatever the route, allowed clients skip the checks.
+func (s *Server) protect(route *Route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route.Tag {
+			r = withTags(r)
 		}
-		if blocked {
-			s.logger.WithField("client_ip", clientIP).Info("IP blocked")
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-			s.metrics.IncBlockedRequests(clientIP)
+		ctx, cancel := plugin.BudgetContext(r.Context())
+		defer cancel()
+
+		trace := tracing.FromContext(r.Context())
+		if s.ipLists != nil {
+			start := time.Now()
+			verdict, entry := s.ipLists.Check(s.clientIP(r))
+			switch verdict {
+			case iplist.Denied:
+				trace.Add("ip_lists", "denied", entry.String())
+				s.recordDecision(ctx, r, route, s.clientIP(r), start, decisionRejected, reasonDenylisted)
+				s.logger.WithFields(logrus.Fields{"client_ip": s.clientIP(r), "entry": entry.String()}).Info("IP denied by list")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			case iplist.Allowed:
+				trace.Add("ip_lists", "allowed", entry.String())
+				s.recordDecision(ctx, r, route, s.clientIP(r), start, decisionAllowed, reasonAllowlisted)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		limit := plugin.LimitFromContext(r.Context())
+		if limit == nil {
+			limit = &plugin.Limit{Key: s.limitKey(r, s.clientIP(r)), Cost: s.requestCost(r)}
+		}
+		checks := []plugin.Limit{*limit}
+		if ip, ok := r.Context().Value(sessionIPKey{}).(string); ok {
+			checks = append(checks, plugin.Limit{Key: s.keyNamespace + ip, Cost: limit.Cost, RequestsPerMinute: s.sessions.IPRequestsPerMinute()})
+		}
+		for _, extra := range limit.Extra {
+			if extra.Cost <= 0 {
+				extra.Cost = limit.Cost
+			}
+			checks = append(checks, plugin.Limit{Key: extra.Key, Cost: extra.Cost, RequestsPerMinute: extra.RequestsPerMinute})
+		}
+		factor := s.limitFactor(route)
+		// signals are the rules that flagged the client so far, whether or
+		// not the route tags requests
+		var signals []string
+		var fp string
+		if s.fingerprints != nil {
+			fp = s.fingerprints.Fingerprint(r)
+			penalty, err := s.fingerprints.Factor(ctx, fp, s.clientIP(r))
+			if err != nil {
+				s.logger.WithError(err).Warn("Error checking fingerprint")
+			}
+			if penalty < 1 {
+				factor *= penalty
+				s.metrics.IncFingerprintPenalty(route.Name)
+				tag(r, ruleFingerprint)
+				signals = append(signals, ruleFingerprint)
+			}
+			if trace != nil {
+				trace.Add("fingerprint", traceResult(penalty < 1, "penalized", "clear"), fmt.Sprintf("fp %s factor %.2f", fp, penalty))
+			}
+		}
+		if s.greylist != nil && clearance.FromContext(r.Context()) == nil && !plugin.IsPreflight(r) {
+			listed, err := s.greylist.Check(ctx, s.clientIP(r))
+			if err != nil {
+				s.logger.WithError(err).Warn("Error checking greylist")
+			}
+			trace.Add("greylist", traceResult(listed, "listed", "clear"), "")
+			if listed {
+				s.metrics.IncGreylistedRequest(route.Name)
+				tag(r, ruleGreylisted)
+				signals = append(signals, ruleGreylisted)
+				factor *= s.greylist.LimitFactor()
+				if s.greylist.Challenge() {
+					r = r.WithContext(context.WithValue(r.Context(), greylistedKey{}, true))
+				}
+			}
+		}
+		if s.review != nil && clearance.FromContext(r.Context()) == nil && !plugin.IsPreflight(r) && s.pendingReview(ctx, r, route, limit.Key, signals) {
+			trace.Add("review", "suspended", "")
+			tag(r, ruleSuspended)
+			factor *= s.review.LimitFactor()
+			if s.review.Challenge() {
+				r = r.WithContext(context.WithValue(r.Context(), suspendedKey{}, true))
+			}
+		}
+		if factor < 1 {
+			for i := range checks {
+				if checks[i].RequestsPerMinute <= 0 {
+					checks[i].RequestsPerMinute = s.rateLimiter.RequestsPerMinute()
+				}
+				checks[i].RequestsPerMinute = max(1, int(float64(checks[i].RequestsPerMinute)*factor))
+			}
+		}
+		if decision := plugin.DecisionFromContext(r.Context()); decision != nil {
+			decision.RequestsPerMinute = checks[0].RequestsPerMinute
+			if decision.RequestsPerMinute <= 0 {
+				decision.RequestsPerMinute = s.rateLimiter.RequestsPerMinute()
+			}
+			decision.Cost = checks[0].Cost
+			decision.Factor = factor
+		}
+		if trace != nil {
+			for _, check := range checks {
+				rpm := check.RequestsPerMinute
+				if rpm <= 0 {
+					rpm = s.rateLimiter.RequestsPerMinute()
+				}
+				trace.Add("limit", check.Key, fmt.Sprintf("rpm %d cost %d factor %.2f algorithm %s", rpm, check.Cost, factor, s.rateLimiter.Algorithm()))
+			}
+		}
+
+		start := time.Now()
+
+		// The instance ceiling protects the upstream even when the store
+		// cannot, so it is checked first
+		if !s.rateLimiter.WithinCeiling() {
+			trace.Add("ceiling", "exceeded", "")
+			s.recordDecision(ctx, r, route, limit.Key, start, decisionRejected, limiter.ReasonInstanceCeiling)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 			return
 		}
 
+		// taggedReason is the limiter reason of tagged requests that would
+		// have been rejected
+		var taggedReason string
+
+		if s.wafSync != nil {
+			if ip, err := netip.ParseAddr(s.clientIP(r)); err == nil {
+				list, blocked := s.wafSync.Blocked(ip)
+				trace.Add("waf_lists", traceResult(blocked, "listed", "clear"), list)
+				if blocked && tag(r, reasonImportedBlock) {
+					taggedReason = reasonImportedBlock
+				} else if blocked {
+					s.recordDecision(ctx, r, route, ip.String(), start, decisionRejected, reasonImportedBlock)
+					s.logger.WithFields(logrus.Fields{"client_ip": ip, "list": list}).Info("IP blocked by imported WAF list")
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		// Networks and countries blocked by operators apply whatever the
+		// client key is
+		if ip, err := netip.ParseAddr(s.clientIP(r)); err == nil {
+			block, blocked := s.rateLimiter.BlockedNetwork(ctx, ip)
+			if trace != nil {
+				trace.Add("network", traceResult(blocked, "blocked", "clear"), block.Reason)
+			}
+			if blocked && tag(r, reasonBlockedNetwork) {
+				taggedReason = reasonBlockedNetwork
+			} else if blocked {
+				s.recordDecision(ctx, r, route, ip.String(), start, decisionRejected, reasonBlockedNetwork)
+				s.logger.WithFields(logrus.Fields{"client_ip": ip, "network": block.Prefix.String()}).Info("IP in blocked network")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			country, blocked := s.blockedCountry(ip)
+			if s.locator != nil {
+				trace.Add("country", traceResult(blocked, "blocked", "allowed"), country)
+			}
+			if blocked && tag(r, reasonBlockedCountry) {
+				taggedReason = reasonBlockedCountry
+			} else if blocked {
+				s.metrics.IncGeoBlocked(country)
+				s.recordDecision(ctx, r, route, ip.String(), start, decisionRejected, reasonBlockedCountry)
+				s.logger.WithFields(logrus.Fields{"client_ip": ip, "country": country}).Info("IP in blocked country")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		if s.escalator != nil && fp != "" {
+			blocked, err := s.escalator.Blocked(ctx, fp)
+			if err != nil {
+				s.logger.WithError(err).Warn("Error checking escalated fingerprint")
+			}
+			trace.Add("escalation", traceResult(blocked, "blocked", "clear"), "")
+			if blocked && tag(r, reasonEscalated) {
+				taggedReason = reasonEscalated
+			} else if blocked {
+				s.recordDecision(ctx, r, route, limit.Key, start, decisionRejected, reasonEscalated)
+				s.logger.WithField("fingerprint", fp).Info("Fingerprint blocked by escalation")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		// Check if IP is blocked
+		for _, check := range checks {
+			blocked, err := s.rateLimiter.IsBlocked(ctx, check.Key)
+			if err != nil {
+				s.logger.WithError(err).Error("Error checking if IP is blocked")
+				s.recordDecision(ctx, r, route, check.Key, start, decisionError, errorReason(err))
+				limiterError(w, err)
+				return
+			}
+			if trace != nil {
+				trace.Add("block", traceResult(blocked, "blocked", "clear"), "key "+check.Key)
+			}
+			if blocked && tag(r, reasonBlocked) {
+				taggedReason = reasonBlocked
+				continue
+			}
+			if blocked {
+				s.recordDecision(ctx, r, route, check.Key, start, decisionRejected, reasonBlocked)
+				s.escalate(ctx, r, route, check.Key, fp)
+				s.logger.WithField("client_ip", check.Key).Info("IP blocked")
+				rpm := check.RequestsPerMinute
+				if rpm <= 0 {
+					rpm = s.rateLimiter.RequestsPerMinute()
+				}
+				remaining := s.rateLimiter.BlockRemaining(ctx, check.Key)
+				setRateLimitHeaders(w.Header(), limiter.Result{Limit: rpm, Reset: remaining, RetryAfter: remaining})
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				s.metrics.IncBlockedRequests(check.Key)
+				return
+			}
+		}
+
 		// Check rate limit
-		allowed, err := s.rateLimiter.IsAllowed(r.Context(), clientIP)
-		if err != nil {
-			s.logger.WithError(err).Error("Error checking rate limit")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		for _, check := range checks {
+			result, err := s.rateLimiter.Check(ctx, check.Key, check.Cost, check.RequestsPerMinute)
+			allowed := result.Allowed
+			if err != nil {
+				s.logger.WithError(err).Error("Error checking rate limit")
+				s.recordDecision(ctx, r, route, check.Key, start, decisionError, errorReason(err))
+				limiterError(w, err)
+				return
+			}
+			if trace != nil {
+				s.traceCounter(ctx, trace, check.Key, allowed)
+			}
+			if !allowed {
+				if s.fingerprints != nil {
+					if err := s.fingerprints.Mark(ctx, fp, s.clientIP(r)); err != nil {
+						s.logger.WithError(err).Warn("Error remembering fingerprint")
+					}
+				}
+				if tag(r, limiter.ReasonRateLimitExceeded) {
+					if taggedReason == "" {
+						taggedReason = limiter.ReasonRateLimitExceeded
+					}
+					continue
+				}
+				s.recordDecision(ctx, r, route, check.Key, start, decisionRejected, limiter.ReasonRateLimitExceeded)
+				s.escalate(ctx, r, route, check.Key, fp)
+				s.logger.WithField("client_ip", check.Key).Info("Rate limit exceeded")
+				setRateLimitHeaders(w.Header(), result)
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				s.metrics.IncBlockedRequests(check.Key)
+				return
+			}
+		}
+
+		// Requests allowed by a fail-open policy are recorded with the reason
+		// the limiter could not decide.
+		reason := reasonWithinLimit
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			reason = reasonBudgetExceeded
+		case !s.rateLimiter.Available():
+			reason = reasonStoreUnavailable
+		}
+		if taggedReason != "" {
+			s.recordDecision(ctx, r, route, limit.Key, start, decisionTagged, taggedReason)
+			next.ServeHTTP(w, r)
 			return
 		}
-		if !allowed {
-			s.logger.WithField("client_ip", clientIP).Info("Rate limit exceeded")
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-			s.metrics.IncBlockedRequests(clientIP)
+		s.recordDecision(ctx, r, route, limit.Key, start, decisionAllowed, reason)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Limiter decisions and their reasons, as recorded in metrics.
+const (
+	decisionAllowed  = plugin.OutcomeAllowed
+	decisionRejected = plugin.OutcomeRejected
+	decisionError    = plugin.OutcomeError
+	// decisionTagged is recorded for requests forwarded with tag headers
+	// instead of being rejected
+	decisionTagged = plugin.OutcomeTagged
+
+	reasonWithinLimit      = "within_limit"
+	reasonBlocked          = "blocked"
+	reasonImportedBlock    = "imported_block"
+	reasonBlockedNetwork   = "blocked_network"
+	reasonBlockedCountry   = "blocked_country"
+	reasonDenylisted       = "denylisted"
+	reasonAllowlisted      = "allowlisted"
+	reasonEscalated        = escalation.ReasonEscalated
+	reasonStoreUnavailable = "store_unavailable"
+	reasonStoreError       = "store_error"
+	reasonBudgetExceeded   = "budget_exceeded"
+)
+
+// recordDecision records the outcome of the protection checks of a request
+// and how long evaluating them took, and writes it to the decision log.
+func (s *Server) recordDecision(ctx context.Context, r *http.Request, route *Route, key string, start time.Time, decision, reason string) {
+	s.checkBudget(ctx, route)
+	algorithm := s.rateLimiter.Algorithm()
+	elapsed := time.Since(start)
+	s.metrics.ObserveLimiterEvaluation(algorithm, elapsed)
+	s.metrics.IncLimiterDecision(algorithm, decision, reason, route.Name)
+
+	rules := tagged(r)
+	if _, scored := ruleScores[reason]; scored && !slices.Contains(rules, reason) {
+		rules = append(rules, reason)
+	}
+	abuse := score(rules)
+	if trace := tracing.FromContext(r.Context()); trace != nil {
+		trace.Add("decision", decision, fmt.Sprintf("reason %s score %.2f rules %s", reason, abuse, strings.Join(rules, ",")))
+	}
+	if d := plugin.DecisionFromContext(r.Context()); d != nil {
+		d.Key = key
+		d.Outcome = decision
+		d.Reason = reason
+		d.Rules = rules
+		d.Score = abuse
+		d.Elapsed = elapsed
+	}
+	if s.decisionLog != nil {
+		s.decisionLog.Write(decisionlog.Record{
+			Time:       start,
+			Key:        key,
+			Route:      route.Name,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Endpoint:   s.endpoint(r.URL.Path),
+			Outcome:    decision,
+			Rule:       reason,
+			Rules:      rules,
+			Score:      abuse,
+			EvalMicros: elapsed.Microseconds(),
+		})
+	}
+}
+
+func errorReason(err error) string {
+	if errors.Is(err, limiter.ErrStoreUnavailable) {
+		return reasonStoreUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return reasonBudgetExceeded
+	}
+	return reasonStoreError
+}
+
+// startBudget starts the check budget of a request.
+func (s *Server) startBudget(next http.Handler) http.Handler {
+	if s.budget <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := plugin.ContextWithBudget(r.Context(), time.Now().Add(s.budget))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// checkBudget records requests whose check budget ran out. Requests canceled
+// by the client do not count.
+func (s *Server) checkBudget(ctx context.Context, route *Route) {
+	if s.budget > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.metrics.IncCheckBudgetExceeded(route.Name)
+	}
+}
+
+// limitFactor returns the factor the rate limits of route are currently scaled
+// by, combining anomaly tightening and under attack mode.
+func (s *Server) limitFactor(route *Route) float64 {
+	factor := 1.0
+	if s.anomaly != nil {
+		factor *= s.anomaly.LimitFactor(route.Name)
+	}
+	if s.underAttack != nil {
+		factor *= s.underAttack.LimitFactor()
+	}
+	return factor
+}
+
+// greylistedKey marks requests of greylisted clients that are to be
+// challenged, suspendedKey those of clients pending review.
+type (
+	greylistedKey struct{}
+	suspendedKey  struct{}
+)
+
+// guard applies under attack mode to clients without clearance: their cache
+// control headers are dropped, so that they cannot force cache misses on the
+// upstream, and they are challenged if challenges are enabled. Greylisted
+// clients and clients pending review are challenged as well if the greylist
+// or the review queue asks for it.
+func (s *Server) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Preflights are sent without cookies and cannot be challenged, they
+		// stay subject to the tightened limits.
+		if clearance.FromContext(r.Context()) != nil || plugin.IsPreflight(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.underAttack != nil && s.underAttack.Active() {
+			r.Header.Del("Cache-Control")
+			r.Header.Del("Pragma")
+			if s.underAttack.Challenge() && s.challenger != nil && !tag(r, ruleUnderAttack) {
+				tracing.FromContext(r.Context()).Add("challenge", "served", ruleUnderAttack)
+				s.challenger.Serve(w, r, s.clientIP(r))
+				return
+			}
+		}
+		if greylisted, _ := r.Context().Value(greylistedKey{}).(bool); greylisted && s.challenger != nil && !tag(r, ruleGreylisted) {
+			tracing.FromContext(r.Context()).Add("challenge", "served", ruleGreylisted)
+			s.challenger.Serve(w, r, s.clientIP(r))
+			return
+		}
+		if suspended, _ := r.Context().Value(suspendedKey{}).(bool); suspended && s.challenger != nil && !tag(r, ruleSuspended) {
+			tracing.FromContext(r.Context()).Add("challenge", "served", ruleSuspended)
+			s.challenger.Serve(w, r, s.clientIP(r))
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		// Forward the request to the target
-		proxy := httputil.NewSingleHostReverseProxy(s.target)
-		proxy.ServeHTTP(w, r)
+// forward returns the handler that proxies requests of route to the target
+// through transport, passing upstream responses through modifyResponse when
+// it is set. The reverse proxy is built once per route, the target of a
+// request is picked per request and handed to it in the request context.
+// The time to the first byte and the whole transfer are observed separately,
+// streamed responses would make a single duration meaningless.
+func (s *Server) forward(route *Route, modifyResponse func(*http.Response) error, transport http.RoundTripper) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Director:       s.direct,
+		Transport:      transport,
+		ErrorHandler:   s.proxyError,
+		ModifyResponse: modifyResponse,
+	}
+	if route.Streaming {
+		// Pass bytes on as they arrive, the reverse proxy does so for
+		// Server-Sent Events on any route.
+		proxy.FlushInterval = -1
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := s.clientIP(r)
+		setTagHeaders(r)
+		if s.identity != nil {
+			s.setIdentityHeaders(r, clientIP)
+		}
 
-		s.logger.WithFields(logrus.Fields{
-			"client_ip": clientIP,
-			"status":    http.StatusOK,
-		}).Info("Request successful")
+		// Forward the request to the target
+		host := s.target.Host
+		if s.upstream != nil {
+			target := s.upstream.Pick()
+			if target == nil {
+				s.logger.WithField("url", r.URL.String()).Error("No upstream target")
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), upstreamTargetKey{}, target))
+			host = target.Host
+		}
+		s.targetUse.touch(host)
+		if entry := accessEntryFrom(r.Context()); entry != nil {
+			entry.upstream = host
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		w, account := s.accounted(sw, r)
+		proxy.ServeHTTP(s.informational(w, r), r)
+		account()
+		if !sw.wroteHeader.IsZero() {
+			s.metrics.ObserveTimeToFirstByte(route.Name, sw.wroteHeader.Sub(start))
+			s.metrics.ObserveTransferDuration(route.Name, time.Since(start))
+		}
 
 		s.metrics.IncSuccessfulRequests(clientIP)
 	})
 }
 
+// limiterError writes the response for a request the limiter could not decide
+// on: 503 while the store is down or too slow for the check budget and the
+// failure policy is closed, 500 otherwise.
+func limiterError(w http.ResponseWriter, err error) {
+	if errors.Is(err, limiter.ErrStoreUnavailable) || errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// proxyError handles errors talking to the upstream. Requests that could not
+// get an upstream connection slot are answered with 503, request bodies that
+// were too slow with 408, bodies over the size limit with 413, and
+// everything else with 502 like the default ReverseProxy behavior.
+func (s *Server) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	s.logger.WithError(err).WithField("url", r.URL.String()).Error("Error proxying request")
+	if errors.Is(err, errUpstreamConnLimit) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errSlowBody) {
+		http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+		return
+	}
+	if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+		s.rejectLargeBody(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
 func (s *Server) Start() error {
 	s.logger.WithField("address", s.server.Addr).Info("Starting server")
 	return s.server.ListenAndServe()
 }
 
-func (s *Server) Shutdown(ctx context.Context) error {
-	s.logger.Info("Shutting down server")
-	return s.server.Shutdown(ctx)
+// Serve serves on l, such as a listener inherited during an upgrade.
+func (s *Server) Serve(l net.Listener) error {
+	s.logger.WithField("address", l.Addr().String()).Info("Starting server")
+	return s.server.Serve(l)
 }
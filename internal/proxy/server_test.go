@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/knakul853/shielder/internal/monitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// The collector registers its metrics globally, so tests share one.
+	testMetricsOnce sync.Once
+	testMetrics     *monitor.MetricsCollector
+)
+
+// sharedMetrics returns the collector shared by the tests.
+func sharedMetrics() *monitor.MetricsCollector {
+	testMetricsOnce.Do(func() { testMetrics = monitor.NewMetricsCollector() })
+	return testMetrics
+}
+
+// newTestServer creates a proxy for cfg whose limiter keeps its state in
+// miniredis, allowing requestsPerMinute per client.
+func newTestServer(t *testing.T, cfg Config, requestsPerMinute int) *Server {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	l := limiter.NewRateLimiter(limiter.NewRedisStore(client), limiter.Config{RequestsPerMinute: requestsPerMinute, BlockDuration: time.Hour}, logger)
+	s := NewServer(cfg, l, sharedMetrics())
+	s.logger.SetOutput(io.Discard)
+	return s
+}
+
+// serveTest sends r through the whole handler chain of s.
+func serveTest(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestMetricsPathIsProxied(t *testing.T) {
+	var paths []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, Config{TargetURL: upstream.URL}, 1)
+
+	// Without a metrics path, the path is forwarded and limited like any
+	// other.
+	rec := serveTest(s, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "upstream" || strings.Join(paths, ",") != "/metrics" {
+		t.Fatalf("Expected /metrics to reach the upstream, got %d %q", rec.Code, rec.Body)
+	}
+	if rec := serveTest(s, httptest.NewRequest(http.MethodGet, "/metrics", nil)); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected /metrics to be rate limited, got %d", rec.Code)
+	}
+}
+
+func TestMetricsOnProxyListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected scrapes not to reach the upstream, got %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+	scrape := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "metrics")
+	})
+	s := newTestServer(t, Config{TargetURL: upstream.URL, MetricsPath: "/metrics", MetricsHandler: scrape}, 1)
+
+	// Scrapes are answered by Shielder and not counted as requests.
+	for i := range 3 {
+		if rec := serveTest(s, httptest.NewRequest(http.MethodGet, "/metrics", nil)); rec.Code != http.StatusOK || rec.Body.String() != "metrics" {
+			t.Fatalf("Expected scrape %d to be served, got %d %q", i+1, rec.Code, rec.Body)
+		}
+	}
+}
+
+// routeGatherer gathers the series of route from the shared registry.
+func routeGatherer(route string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		var kept []*dto.MetricFamily
+		for _, family := range families {
+			var metrics []*dto.Metric
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "route" && label.GetValue() == route {
+						metrics = append(metrics, m)
+					}
+				}
+			}
+			if len(metrics) > 0 {
+				family.Metric = metrics
+				kept = append(kept, family)
+			}
+		}
+		return kept, err
+	})
+}
+
+// histogram returns the histogram of metric gathered by g.
+func histogram(t *testing.T, g prometheus.Gatherer, metric string) *dto.Histogram {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == metric && len(family.GetMetric()) > 0 {
+			return family.GetMetric()[0].GetHistogram()
+		}
+	}
+	return &dto.Histogram{}
+}
+
+func TestUpstreamTimingMetrics(t *testing.T) {
+	const (
+		ttfbMetric     = "shielder_upstream_time_to_first_byte_seconds"
+		transferMetric = "shielder_upstream_transfer_duration_seconds"
+	)
+	// The upstream sends its headers at once and the body later.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, Config{TargetURL: upstream.URL, Routes: []Route{{Name: "timing", PathPrefix: "/"}}}, 10)
+	g := routeGatherer("timing")
+	ttfbBefore, transferBefore := histogram(t, g, ttfbMetric), histogram(t, g, transferMetric)
+
+	if rec := serveTest(s, httptest.NewRequest(http.MethodGet, "/slow", nil)); rec.Code != http.StatusOK || rec.Body.String() != "upstream" {
+		t.Fatalf("Expected the request to be proxied, got %d %q", rec.Code, rec.Body)
+	}
+
+	if n, err := testutil.GatherAndCount(g, ttfbMetric, transferMetric); err != nil || n != 2 {
+		t.Fatalf("Expected both histograms to have a series for the route, got %d, %v", n, err)
+	}
+	ttfb, transfer := histogram(t, g, ttfbMetric), histogram(t, g, transferMetric)
+	if ttfb.GetSampleCount()-ttfbBefore.GetSampleCount() != 1 || transfer.GetSampleCount()-transferBefore.GetSampleCount() != 1 {
+		t.Fatalf("Expected one observation each, got %d and %d",
+			ttfb.GetSampleCount()-ttfbBefore.GetSampleCount(), transfer.GetSampleCount()-transferBefore.GetSampleCount())
+	}
+	firstByte := ttfb.GetSampleSum() - ttfbBefore.GetSampleSum()
+	lastByte := transfer.GetSampleSum() - transferBefore.GetSampleSum()
+	if firstByte >= 0.2 {
+		t.Errorf("Expected the first byte before the body, got %vs", firstByte)
+	}
+	if lastByte < 0.2 || lastByte < firstByte {
+		t.Errorf("Expected the transfer to last until the body was sent, got %vs", lastByte)
+	}
+}
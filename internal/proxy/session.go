@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+// sessionIPKey marks requests that are rate limited per session. Its value is
+// the client IP, whose shared limit is checked in addition.
+type sessionIPKey struct{}
+
+// trackSession keys the rate limit of requests with a valid session cookie by
+// session, and starts a session for clients without one. Requests without a
+// session stay limited per IP.
+func (s *Server) trackSession(w http.ResponseWriter, r *http.Request, clientIP string) *http.Request {
+	if s.sessions == nil {
+		return r
+	}
+
+	key, rpm, ok := s.sessionLimit(r)
+	if !ok {
+		_, cookie, err := s.sessions.New()
+		if err != nil {
+			s.logger.WithError(err).Error("Error starting session")
+			return r
+		}
+		http.SetCookie(w, cookie)
+		return r
+	}
+
+	if limit := plugin.LimitFromContext(r.Context()); limit != nil {
+		limit.Key = key
+		limit.RequestsPerMinute = rpm
+	}
+	return r.WithContext(context.WithValue(r.Context(), sessionIPKey{}, clientIP))
+}
+
+// sessionLimit returns the rate limit key and limit of the session r carries,
+// if it carries a valid one. Routes with a limit of their own count sessions
+// under the route prefixed to the key.
+func (s *Server) sessionLimit(r *http.Request) (string, int, bool) {
+	if s.sessions == nil {
+		return "", 0, false
+	}
+	id, ok := s.sessions.FromRequest(r)
+	if !ok {
+		return "", 0, false
+	}
+	return s.keyNamespace + "session:" + id, s.sessions.RequestsPerMinute(), true
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/internal/session"
+)
+
+func TestRouteLimitPerSession(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	sessions, err := session.NewManager(session.Options{
+		CookieName:          "sid",
+		Secret:              []byte("0123456789abcdef"),
+		TTL:                 time.Hour,
+		RequestsPerMinute:   5,
+		IPRequestsPerMinute: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{
+		TargetURL: upstream.URL,
+		Sessions:  sessions,
+		Quota:     &QuotaEndpoint{Path: "/.well-known/rate-limit"},
+		Routes:    []Route{{Name: "search", PathPrefix: "/search", RequestsPerMinute: 1}},
+	}, 100)
+
+	var cookies []*http.Cookie
+	for range 3 {
+		_, cookie, err := sessions.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies = append(cookies, cookie)
+	}
+	send := func(cookie *http.Cookie) int {
+		r := httptest.NewRequest(http.MethodGet, "/search", nil)
+		r.RemoteAddr = "198.51.100.1:1234"
+		r.AddCookie(cookie)
+		return serveTest(s, r).Code
+	}
+
+	// Two sessions behind one address have a route limit each.
+	if code := send(cookies[0]); code != http.StatusOK {
+		t.Fatalf("Expected the first session's request to pass, got %d", code)
+	}
+	if code := send(cookies[1]); code != http.StatusOK {
+		t.Errorf("Expected the second session to have its own route limit, got %d", code)
+	}
+	if code := send(cookies[0]); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the first session to be over its route limit, got %d", code)
+	}
+
+	// The quota reports the budget of the session asking.
+	remaining := func(cookie *http.Cookie) int {
+		r := httptest.NewRequest(http.MethodGet, "/.well-known/rate-limit", nil)
+		r.RemoteAddr = "198.51.100.1:1234"
+		r.AddCookie(cookie)
+		var quota quotaResponse
+		if err := json.NewDecoder(serveTest(s, r).Body).Decode(&quota); err != nil {
+			t.Fatal(err)
+		}
+		return quota.Routes["search"].Remaining
+	}
+	if got := remaining(cookies[0]); got != 0 {
+		t.Errorf("Expected the first session to have no route budget left, got %d", got)
+	}
+	if got := remaining(cookies[2]); got != 1 {
+		t.Errorf("Expected an unused session to have its whole route budget, got %d", got)
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+// StatusEndpoint tells callers whether their client key is limited or
+// blocked and until when, so that integrators can tell a block from an
+// outage on their own.
+type StatusEndpoint struct {
+	// Path is where the status is served, such as /__shielder/status
+	Path string
+	// RequestsPerMinute is how often a client may ask, 30 by default.
+	// Asking more often gets the client's status requests blocked, not its
+	// other requests.
+	RequestsPerMinute int
+	// MaxAge is how long clients may cache an answer, 5 seconds by default.
+	// Answers about a limit or block are cached until it ends at most.
+	MaxAge time.Duration
+}
+
+// Statuses of a client key.
+const (
+	statusOK      = "ok"
+	statusLimited = "limited"
+	statusBlocked = "blocked"
+)
+
+// keyStatus is the status of a client key as served to clients.
+type keyStatus struct {
+	Status string `json:"status"`
+	// Reason is why the key is blocked, such as rate_limit_exceeded.
+	Reason string `json:"reason,omitempty"`
+	// Until is when the key may send requests again, in whole seconds.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+type statusResponse struct {
+	// ClientIP is the address Shielder sees the caller at.
+	ClientIP string `json:"clientIP"`
+	keyStatus
+	// Routes are the statuses under routes with a limit of their own.
+	Routes map[string]keyStatus `json:"routes,omitempty"`
+}
+
+// serveStatus answers with the status of the caller's client key, globally
+// and under routes with their own limit. Answers are private to the caller
+// and carry an ETag, so that clients polling it get 304 while nothing
+// changed.
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request, clientIP string) {
+	ctx := r.Context()
+	result, err := s.rateLimiter.Check(ctx, "status:"+clientIP, 1, s.status.RequestsPerMinute)
+	if err != nil {
+		s.logger.WithError(err).Warn("Error limiting status requests")
+		limiterError(w, err)
+		return
+	}
+	if !result.Allowed {
+		setRateLimitHeaders(w.Header(), result)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	now := time.Now()
+	key, rpm := s.limitKey(r, clientIP), 0
+	// Clients with a session are limited per session, see trackSession.
+	if sessionKey, sessionRPM, ok := s.sessionLimit(r); ok {
+		key, rpm = sessionKey, sessionRPM
+	}
+	resp := statusResponse{ClientIP: clientIP}
+	if resp.keyStatus, err = s.keyStatus(r, key, rpm, now); err != nil {
+		s.logger.WithError(err).Warn("Error reading client status")
+		limiterError(w, err)
+		return
+	}
+	until := resp.Until
+	for _, route := range s.routes.all() {
+		rpm := s.routeRequestsPerMinute(route)
+		// Preflight and per endpoint budgets are not the caller's to plan.
+		if rpm <= 0 || route.Preflight || route.PerEndpoint {
+			continue
+		}
+		status, err := s.keyStatus(r, "route:"+route.Name+":"+key, rpm, now)
+		if err != nil {
+			s.logger.WithError(err).Warn("Error reading client status")
+			limiterError(w, err)
+			return
+		}
+		if resp.Routes == nil {
+			resp.Routes = make(map[string]keyStatus)
+		}
+		resp.Routes[route.Name] = status
+		if status.Until != nil && (until == nil || status.Until.Before(*until)) {
+			until = status.Until
+		}
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	maxAge := s.status.MaxAge
+	if until != nil {
+		maxAge = min(maxAge, until.Sub(now))
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.FormatInt(max(seconds(maxAge), 0), 10))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// keyStatus returns the status of key against a limit of requestsPerMinute,
+// or the configured one when it is not positive.
+func (s *Server) keyStatus(r *http.Request, key string, requestsPerMinute int, now time.Time) (keyStatus, error) {
+	quota, err := s.rateLimiter.Quota(r.Context(), key, requestsPerMinute)
+	if err != nil {
+		return keyStatus{}, err
+	}
+	status := newKeyStatus(quota, now)
+	if quota.Blocked {
+		// Stores that cannot be inspected do not tell the reason.
+		if state, err := s.rateLimiter.Inspect(r.Context(), key); err == nil {
+			status.Reason = state.BlockReason
+		}
+	}
+	return status, nil
+}
+
+func newKeyStatus(q limiter.Quota, now time.Time) keyStatus {
+	var status keyStatus
+	var left time.Duration
+	switch {
+	case q.Blocked:
+		status.Status, left = statusBlocked, q.BlockRemaining
+	case q.Remaining <= 0:
+		status.Status, left = statusLimited, q.Reset
+	default:
+		status.Status = statusOK
+		return status
+	}
+	// Blocks without an expiry last until they are lifted.
+	if left > 0 {
+		// Rounded up, so that the answer stays the same while polling.
+		until := now.Add(left).Add(time.Second - 1).Truncate(time.Second).UTC()
+		status.Until = &until
+	}
+	return status
+}
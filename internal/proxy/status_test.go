@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+func TestNewKeyStatus(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 250e6, time.UTC)
+	tests := []struct {
+		name   string
+		quota  limiter.Quota
+		status string
+		until  time.Time
+	}{
+		{"within budget", limiter.Quota{Limit: 10, Remaining: 3, Reset: 30 * time.Second}, statusOK, time.Time{}},
+		{"budget used up", limiter.Quota{Limit: 10, Reset: 30 * time.Second}, statusLimited, time.Date(2024, 5, 1, 12, 0, 31, 0, time.UTC)},
+		{"blocked", limiter.Quota{Limit: 10, Remaining: 0, Reset: time.Second, Blocked: true, BlockRemaining: 10 * time.Minute}, statusBlocked, time.Date(2024, 5, 1, 12, 10, 1, 0, time.UTC)},
+		{"blocked until lifted", limiter.Quota{Limit: 10, Blocked: true}, statusBlocked, time.Time{}},
+	}
+	for _, tt := range tests {
+		got := newKeyStatus(tt.quota, now)
+		if got.Status != tt.status {
+			t.Errorf("%s: expected status %s, got %s", tt.name, tt.status, got.Status)
+		}
+		switch {
+		case tt.until.IsZero() && got.Until != nil:
+			t.Errorf("%s: expected no end, got %v", tt.name, got.Until)
+		case !tt.until.IsZero() && (got.Until == nil || !got.Until.Equal(tt.until)):
+			t.Errorf("%s: expected the status to end at %v, got %v", tt.name, tt.until, got.Until)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kinds of long-lived requests.
+const (
+	streamWebSocket = "websocket"
+	streamUpgrade   = "upgrade"
+	streamSSE       = "sse"
+	// streamRoute is any other request on a route marked streaming
+	streamRoute = "stream"
+)
+
+// streamKind returns the kind of long-lived request r is, or "" for
+// ordinary requests.
+func streamKind(route *Route, r *http.Request) string {
+	if hasToken(r.Header.Values("Connection"), "upgrade") && r.Header.Get("Upgrade") != "" {
+		if hasToken(r.Header.Values("Upgrade"), "websocket") {
+			return streamWebSocket
+		}
+		return streamUpgrade
+	}
+	if hasToken(r.Header.Values("Accept"), "text/event-stream") {
+		return streamSSE
+	}
+	if route.Streaming {
+		return streamRoute
+	}
+	return ""
+}
+
+// hasToken reports whether the comma-separated header values contain token,
+// ignoring case and parameters.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			element, _, _ = strings.Cut(element, ";")
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streaming lifts the read and write timeouts of the server for long-lived
+// requests when they are exempt, which would otherwise cut off WebSocket
+// connections and event streams after the timeout, and counts the open
+// ones.
+func (s *Server) streaming(route *Route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := streamKind(route, r)
+		if kind == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.exemptStreams {
+			// The zero deadline lifts the timeouts.
+			var deadline time.Time
+			if s.maxStreamDuration > 0 {
+				deadline = time.Now().Add(s.maxStreamDuration)
+			}
+			rc := http.NewResponseController(w)
+			err := rc.SetReadDeadline(deadline)
+			if err == nil {
+				err = rc.SetWriteDeadline(deadline)
+			}
+			if err != nil {
+				s.logger.WithError(err).WithField("route", route.Name).Warn("Error lifting timeouts of long-lived request")
+			}
+		}
+		s.metrics.AddOpenStreams(route.Name, kind, 1)
+		defer s.metrics.AddOpenStreams(route.Name, kind, -1)
+		next.ServeHTTP(w, r)
+	})
+}
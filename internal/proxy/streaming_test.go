@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestStreamKind(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    http.Header
+		streaming bool
+		want      string
+	}{
+		{"plain", http.Header{}, false, ""},
+		{"websocket", http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"WebSocket"}}, false, streamWebSocket},
+		{"other upgrade", http.Header{"Connection": {"upgrade"}, "Upgrade": {"h2c"}}, false, streamUpgrade},
+		{"upgrade without connection", http.Header{"Upgrade": {"websocket"}}, false, ""},
+		{"event stream", http.Header{"Accept": {"text/event-stream;q=1, */*"}}, false, streamSSE},
+		{"streaming route", http.Header{}, true, streamRoute},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header = tt.header
+		if got := streamKind(&Route{Streaming: tt.streaming}, r); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestStatusWriterHijack(t *testing.T) {
+	// The upstream switches protocols and echoes what it receives.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "echo")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, rw)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	statuses := make(chan int, 1)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(sw, r)
+		statuses <- sw.status
+	}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("expected the upgraded connection to echo, got %q, %v", echo, err)
+	}
+	conn.Close()
+
+	if status := <-statuses; status != http.StatusSwitchingProtocols {
+		t.Errorf("expected the status writer to record 101, got %d", status)
+	}
+}
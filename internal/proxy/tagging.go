@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+// Headers that describe flagged requests to the upstream of tagging routes.
+// They are removed from all incoming requests, so that clients cannot forge
+// them.
+const (
+	HeaderScore = "X-Shielder-Score"
+	HeaderRules = "X-Shielder-Rules"
+	HeaderBot   = "X-Shielder-Bot"
+)
+
+// Rules a request can be flagged by, besides the limiter reasons.
+const (
+	ruleFingerprint = "fingerprint"
+	ruleGreylisted  = "greylisted"
+	ruleUnderAttack = "under_attack"
+	ruleSuspended   = "suspended"
+)
+
+// ruleScores is how strongly each rule suggests that a request is abusive.
+var ruleScores = map[string]float64{
+	reasonBlocked:                   1,
+	reasonImportedBlock:             1,
+	reasonBlockedNetwork:            1,
+	reasonBlockedCountry:            1,
+	reasonEscalated:                 1,
+	limiter.ReasonRateLimitExceeded: 0.9,
+	ruleUnderAttack:                 0.5,
+	ruleSuspended:                   0.5,
+	ruleFingerprint:                 0.4,
+	ruleGreylisted:                  0.3,
+}
+
+// botScore is the score from which a request is reported as a likely bot.
+const botScore = 0.5
+
+type tagsKey struct{}
+
+// tags collects the rules that flagged a request on a tagging route.
+type tags struct {
+	mu    sync.Mutex
+	rules []string
+}
+
+// withTags marks r as belonging to a tagging route.
+func withTags(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tagsKey{}, &tags{}))
+}
+
+// tag flags r with rule if it belongs to a tagging route, and reports
+// whether it did. Requests that were not tagged have to be rejected or
+// challenged instead.
+func tag(r *http.Request, rule string) bool {
+	t, ok := r.Context().Value(tagsKey{}).(*tags)
+	if !ok {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, existing := range t.rules {
+		if existing == rule {
+			return true
+		}
+	}
+	t.rules = append(t.rules, rule)
+	return true
+}
+
+// tagged returns the rules r was flagged by.
+func tagged(r *http.Request) []string {
+	t, ok := r.Context().Value(tagsKey{}).(*tags)
+	if !ok {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.rules...)
+}
+
+// setTagHeaders replaces the tag headers of r with the rules it was flagged
+// by and their score.
+func setTagHeaders(r *http.Request) {
+	r.Header.Del(HeaderScore)
+	r.Header.Del(HeaderRules)
+	r.Header.Del(HeaderBot)
+
+	rules := tagged(r)
+	if len(rules) == 0 {
+		return
+	}
+	score := score(rules)
+	r.Header.Set(HeaderScore, strconv.FormatFloat(score, 'f', 2, 64))
+	r.Header.Set(HeaderRules, strings.Join(rules, ","))
+	if score >= botScore {
+		r.Header.Set(HeaderBot, "likely")
+	}
+}
+
+// score combines the scores of rules as independent signals.
+func score(rules []string) float64 {
+	clean := 1.0
+	for _, rule := range rules {
+		clean *= 1 - ruleScores[rule]
+	}
+	return 1 - clean
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+func TestTagHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/orders", nil)
+	r.Header.Set(HeaderBot, "no")
+	if tag(r, ruleGreylisted) {
+		t.Fatal("Expected requests outside tagging routes not to be tagged")
+	}
+	setTagHeaders(r)
+	if r.Header.Get(HeaderBot) != "" {
+		t.Error("Expected forged tag headers to be removed")
+	}
+
+	r = withTags(r)
+	tag(r, ruleGreylisted)
+	setTagHeaders(r)
+	if got := r.Header.Get(HeaderScore); got != "0.30" {
+		t.Errorf("Expected score 0.30, got %q", got)
+	}
+	if r.Header.Get(HeaderBot) != "" {
+		t.Error("Expected a greylisted request not to be reported as a bot")
+	}
+
+	tag(r, limiter.ReasonRateLimitExceeded)
+	tag(r, ruleGreylisted)
+	setTagHeaders(r)
+	if got := r.Header.Get(HeaderRules); got != "greylisted,rate_limit_exceeded" {
+		t.Errorf("Expected both rules once, got %q", got)
+	}
+	if got := r.Header.Get(HeaderScore); got != "0.93" {
+		t.Errorf("Expected score 0.93, got %q", got)
+	}
+	if got := r.Header.Get(HeaderBot); got != "likely" {
+		t.Errorf("Expected a likely bot, got %q", got)
+	}
+}
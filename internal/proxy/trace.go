@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/knakul853/shielder/internal/tracing"
+)
+
+func traceResult(hit bool, yes, no string) string {
+	if hit {
+		return yes
+	}
+	return no
+}
+
+// traceCounter records the outcome of a rate limit check with the counter
+// it left behind. Counters are read separately, so concurrent requests of the
+// same client may already be included.
+func (s *Server) traceCounter(ctx context.Context, trace *tracing.Trace, key string, allowed bool) {
+	result := traceResult(allowed, "allowed", "exceeded")
+	state, err := s.rateLimiter.Inspect(ctx, key)
+	switch {
+	case errors.Is(err, limiter.ErrInspectUnsupported):
+		trace.Add("rate_limit", result, "key "+key)
+	case err != nil:
+		trace.Add("rate_limit", result, "key "+key+" counter unavailable: "+err.Error())
+	default:
+		trace.Add("rate_limit", result, fmt.Sprintf("key %s count %d window remaining %s", key, state.Count, state.WindowRemaining))
+	}
+}
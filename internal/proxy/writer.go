@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// statusWriter records the status code of the response sent to the client.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	// bytes counts the body bytes written
+	bytes int64
+	// wroteHeader is when the final status was written
+	wroteHeader time.Time
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	// Informational responses are followed by the final status.
+	if w.status == 0 && code >= 200 {
+		w.status = code
+		w.wroteHeader = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.wroteHeader = time.Now()
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack records the switch of protocols of upgraded connections, whose
+// 101 response is written to the hijacked connection.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+		w.wroteHeader = time.Now()
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so that
+// flushing and deadlines keep working.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,241 @@
+// Package replication copies block decisions between regions that each run
+// their own Redis, using a Redis stream per region as the transport.
+//
+// Local events are published in the background, so that a slow Redis does
+// not hold up the requests that caused them, and dropped when the buffer is
+// full.
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/knakul853/shielder/internal/monitor"
+	"github.com/sirupsen/logrus"
+)
+
+// Peer is a remote region whose block events are replicated locally.
+type Peer struct {
+	Region string
+	Client *redis.Client
+}
+
+// Options configures a Replicator.
+type Options struct {
+	// Region is the name of the local region.
+	Region string
+	// Stream is the name of the stream events are written to in every region.
+	Stream string
+	// MaxLen approximately caps the length of the local stream.
+	MaxLen int64
+	// Lookback is how far back a peer stream is read when no offset has been
+	// stored yet, normally the longest block duration.
+	Lookback time.Duration
+	// BufferSize is how many events wait to be published, 1024 by default.
+	BufferSize int
+}
+
+// Replicator publishes local block events to the local region's stream and
+// applies events read from the streams of peer regions.
+type Replicator struct {
+	opts    Options
+	local   redis.UniversalClient
+	peers   []Peer
+	limiter *limiter.RateLimiter
+	metrics *monitor.MetricsCollector
+	logger  *logrus.Logger
+	wg      sync.WaitGroup
+
+	events    chan limiter.Event
+	publishWG sync.WaitGroup
+}
+
+// New creates a Replicator and starts publishing. Call Publish from a limiter
+// event handler, Run to start consuming peer streams and Close to stop
+// publishing.
+func New(opts Options, local redis.UniversalClient, peers []Peer, rl *limiter.RateLimiter, metrics *monitor.MetricsCollector, logger *logrus.Logger) *Replicator {
+	if opts.Stream == "" {
+		opts.Stream = "shielder:block-events"
+	}
+	if opts.MaxLen <= 0 {
+		opts.MaxLen = 100000
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1024
+	}
+	r := &Replicator{
+		opts:    opts,
+		local:   local,
+		peers:   peers,
+		limiter: rl,
+		metrics: metrics,
+		logger:  logger,
+		events:  make(chan limiter.Event, opts.BufferSize),
+	}
+	r.publishWG.Add(1)
+	go r.publishLoop()
+	return r
+}
+
+// Publish queues a locally decided event for the local stream. Events that
+// were themselves replicated are skipped so that they do not bounce between
+// regions.
+func (r *Replicator) Publish(ctx context.Context, event limiter.Event) {
+	if event.Origin != "" {
+		return
+	}
+	select {
+	case r.events <- event:
+	default:
+		r.metrics.IncReplicationEvents(r.opts.Region, "dropped")
+		r.logger.WithFields(logrus.Fields{
+			"type": event.Type,
+			"ip":   event.IP,
+		}).Warn("Replication buffer full, dropping event")
+	}
+}
+
+// Close stops accepting events and waits for queued events to be published.
+func (r *Replicator) Close() {
+	close(r.events)
+	r.publishWG.Wait()
+}
+
+func (r *Replicator) publishLoop() {
+	defer r.publishWG.Done()
+	for event := range r.events {
+		r.publish(event)
+	}
+}
+
+// publish appends event to the local stream.
+func (r *Replicator) publish(event limiter.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := r.local.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.opts.Stream,
+		MaxLen: r.opts.MaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"type":     string(event.Type),
+			"ip":       event.IP,
+			"reason":   event.Reason,
+			"duration": event.Duration.Milliseconds(),
+			"time":     event.Time.UnixMilli(),
+			"region":   r.opts.Region,
+		},
+	}).Err()
+	if err != nil {
+		r.logger.WithError(err).Error("Error publishing block event for replication")
+		return
+	}
+	r.metrics.IncReplicationEvents(r.opts.Region, "published")
+}
+
+// Run consumes the streams of all peers until ctx is cancelled.
+func (r *Replicator) Run(ctx context.Context) {
+	for _, peer := range r.peers {
+		r.wg.Add(1)
+		go func(peer Peer) {
+			defer r.wg.Done()
+			r.consume(ctx, peer)
+		}(peer)
+	}
+	r.wg.Wait()
+}
+
+// consume reads events from a peer stream, resuming from the last applied
+// entry, which is stored in the local Redis.
+func (r *Replicator) consume(ctx context.Context, peer Peer) {
+	logger := r.logger.WithField("peer", peer.Region)
+	offsetKey := "shielder:replication:offset:" + peer.Region
+
+	lastID, err := r.local.Get(ctx, offsetKey).Result()
+	if errors.Is(err, redis.Nil) || lastID == "" {
+		lastID = fmt.Sprintf("%d-0", time.Now().Add(-r.opts.Lookback).UnixMilli())
+	} else if err != nil {
+		logger.WithError(err).Warn("Error loading replication offset, starting from lookback window")
+		lastID = fmt.Sprintf("%d-0", time.Now().Add(-r.opts.Lookback).UnixMilli())
+	}
+
+	for ctx.Err() == nil {
+		streams, err := peer.Client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{r.opts.Stream, lastID},
+			Count:   100,
+			Block:   5 * time.Second,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Warn("Error reading peer stream, retrying")
+			sleep(ctx, time.Second)
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				event, err := decodeEvent(msg.Values)
+				if err != nil {
+					logger.WithError(err).WithField("id", msg.ID).Warn("Skipping malformed replication event")
+				} else if event.Origin != r.opts.Region {
+					if err := r.limiter.ApplyEvent(ctx, event); err != nil {
+						logger.WithError(err).Error("Error applying replicated event")
+						sleep(ctx, time.Second)
+						break
+					}
+					r.metrics.IncReplicationEvents(peer.Region, "applied")
+				}
+				lastID = msg.ID
+			}
+		}
+
+		if err := r.local.Set(ctx, offsetKey, lastID, 0).Err(); err != nil {
+			logger.WithError(err).Warn("Error storing replication offset")
+		}
+	}
+}
+
+func decodeEvent(values map[string]interface{}) (limiter.Event, error) {
+	field := func(name string) string {
+		s, _ := values[name].(string)
+		return s
+	}
+
+	durationMs, err := strconv.ParseInt(field("duration"), 10, 64)
+	if err != nil {
+		return limiter.Event{}, fmt.Errorf("invalid duration: %w", err)
+	}
+	timeMs, err := strconv.ParseInt(field("time"), 10, 64)
+	if err != nil {
+		return limiter.Event{}, fmt.Errorf("invalid time: %w", err)
+	}
+	if field("ip") == "" {
+		return limiter.Event{}, errors.New("missing ip")
+	}
+
+	return limiter.Event{
+		Type:     limiter.EventType(field("type")),
+		IP:       field("ip"),
+		Reason:   field("reason"),
+		Duration: time.Duration(durationMs) * time.Millisecond,
+		Time:     time.UnixMilli(timeMs),
+		Origin:   field("region"),
+	}, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
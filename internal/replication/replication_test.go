@@ -0,0 +1,291 @@
+package replication
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/knakul853/shielder/internal/monitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// The collector registers its metrics globally, so tests share one.
+var testMetrics = monitor.NewMetricsCollector()
+
+// region is a Redis with the limiter and replicator of one region. Peers
+// read its stream through peerClient.
+type region struct {
+	name       string
+	client     *redis.Client
+	peerClient *redis.Client
+	limiter    *limiter.RateLimiter
+	replicator *Replicator
+}
+
+func newRegion(t *testing.T, name string) *region {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	l := limiter.NewRateLimiter(limiter.NewRedisStore(client), limiter.Config{RequestsPerMinute: 10, BlockDuration: time.Hour}, logger)
+	return &region{name: name, client: client, peerClient: client, limiter: l}
+}
+
+// replicate connects the regions to each other and runs their replicators
+// until the test ends.
+func replicate(t *testing.T, regions ...*region) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, len(regions))
+	for _, r := range regions {
+		var peers []Peer
+		for _, peer := range regions {
+			if peer != r {
+				peers = append(peers, Peer{Region: peer.name, Client: peer.peerClient})
+			}
+		}
+		logger := logrus.New()
+		logger.SetOutput(io.Discard)
+		r.replicator = New(Options{Region: r.name, Lookback: time.Hour}, r.client, peers, r.limiter, testMetrics, logger)
+		r.limiter.OnEvent(r.replicator.Publish)
+		go func(r *region) {
+			r.replicator.Run(ctx)
+			done <- struct{}{}
+		}(r)
+	}
+	t.Cleanup(func() {
+		cancel()
+		for _, r := range regions {
+			<-done
+			r.replicator.Close()
+		}
+	})
+}
+
+// link relays connections to a Redis, so that tests can cut them like a
+// network failure would. miniredis itself does not answer blocking reads
+// after a restart.
+type link struct {
+	listener net.Listener
+	target   string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newLink(t *testing.T, target string) *link {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &link{listener: listener, target: target}
+	t.Cleanup(func() {
+		listener.Close()
+		l.cut()
+	})
+	go l.serve()
+	return l
+}
+
+func (l *link) addr() string {
+	return l.listener.Addr().String()
+}
+
+func (l *link) serve() {
+	for {
+		client, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", l.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		l.mu.Lock()
+		l.conns = append(l.conns, client, server)
+		l.mu.Unlock()
+		go func() {
+			io.Copy(server, client)
+			server.Close()
+		}()
+		go func() {
+			io.Copy(client, server)
+			client.Close()
+		}()
+	}
+}
+
+// cut closes the connections relayed so far.
+func (l *link) cut() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+// waitBlocked waits for ip to be blocked in r.
+func waitBlocked(t *testing.T, r *region, ip string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if blocked, _ := r.limiter.IsBlocked(context.Background(), ip); blocked {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s to be blocked in region %s", ip, r.name)
+}
+
+func TestReplicateBlocks(t *testing.T) {
+	ctx := context.Background()
+	a, b := newRegion(t, "a"), newRegion(t, "b")
+	replicate(t, a, b)
+
+	if err := a.limiter.Block(ctx, "203.0.113.1", time.Hour, limiter.ReasonManual); err != nil {
+		t.Fatal(err)
+	}
+	waitBlocked(t, b, "203.0.113.1")
+	if remaining := b.limiter.BlockRemaining(ctx, "203.0.113.1"); remaining <= 0 || remaining > time.Hour {
+		t.Errorf("Expected the block to be kept for what is left of its duration, got %v", remaining)
+	}
+
+	// Applied events are not published again, or they would bounce
+	// between the regions.
+	if n := b.client.XLen(ctx, "shielder:block-events").Val(); n != 0 {
+		t.Errorf("Expected region b to publish nothing, got %d events", n)
+	}
+	if n := a.client.XLen(ctx, "shielder:block-events").Val(); n != 1 {
+		t.Errorf("Expected region a to publish its block once, got %d events", n)
+	}
+}
+
+func TestReplicateIgnoresOwnEvents(t *testing.T) {
+	ctx := context.Background()
+	a, b := newRegion(t, "a"), newRegion(t, "b")
+	replicate(t, a, b)
+
+	// An event b decided itself, found on the stream of a, is not applied
+	// again.
+	now := time.Now().UnixMilli()
+	for _, values := range []map[string]interface{}{
+		{"type": "block", "ip": "203.0.113.1", "reason": "manual", "duration": time.Hour.Milliseconds(), "time": now, "region": "b"},
+		{"type": "block", "ip": "203.0.113.2", "reason": "manual", "duration": time.Hour.Milliseconds(), "time": now, "region": "a"},
+	} {
+		if err := a.client.XAdd(ctx, &redis.XAddArgs{Stream: "shielder:block-events", Values: values}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitBlocked(t, b, "203.0.113.2")
+	if blocked, _ := b.limiter.IsBlocked(ctx, "203.0.113.1"); blocked {
+		t.Error("Expected the event originating in region b to be ignored")
+	}
+}
+
+func TestReplicateAfterReconnect(t *testing.T) {
+	ctx := context.Background()
+	a, b := newRegion(t, "a"), newRegion(t, "b")
+	link := newLink(t, a.client.Options().Addr)
+	a.peerClient = redis.NewClient(&redis.Options{Addr: link.addr()})
+	t.Cleanup(func() { a.peerClient.Close() })
+	replicate(t, a, b)
+
+	if err := a.limiter.Block(ctx, "203.0.113.1", time.Hour, limiter.ReasonManual); err != nil {
+		t.Fatal(err)
+	}
+	waitBlocked(t, b, "203.0.113.1")
+
+	// The connection to region a drops, b retries and resumes after the
+	// last event it applied.
+	link.cut()
+	if err := a.limiter.Block(ctx, "203.0.113.2", time.Hour, limiter.ReasonManual); err != nil {
+		t.Fatal(err)
+	}
+	waitBlocked(t, b, "203.0.113.2")
+	if offset := b.client.Get(ctx, "shielder:replication:offset:a").Val(); offset == "" {
+		t.Error("Expected region b to store its offset in the stream of a")
+	}
+}
+
+// dropped returns how many events region dropped so far.
+func dropped(t *testing.T, region string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "shielder_replication_events_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["region"] == region && labels["direction"] == "dropped" {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestPublishDoesNotWaitForRedis(t *testing.T) {
+	// A Redis that accepts connections but never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	client := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), ReadTimeout: 200 * time.Millisecond, MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	r := New(Options{Region: "stalled", BufferSize: 1}, client, nil, nil, testMetrics, logger)
+	defer r.Close()
+
+	start := time.Now()
+	for i := range 10 {
+		r.Publish(context.Background(), limiter.Event{Type: limiter.EventBlock, IP: "203.0.113.1", Duration: time.Duration(i) * time.Second, Time: time.Now()})
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected publishing not to wait for Redis, took %v", elapsed)
+	}
+	// One event is being written, one waits in the buffer.
+	if n := dropped(t, "stalled"); n < 8 {
+		t.Errorf("Expected the events beyond the buffer to be dropped, got %v", n)
+	}
+}
@@ -0,0 +1,199 @@
+// Package review holds borderline clients for an operator's decision. A
+// client whose requests score in the borderline band, suspicious but short of
+// what Shielder blocks on its own, is suspended pending review: its limits
+// are tightened, or it is challenged, and it is listed in a queue until an
+// operator confirms a block or allows it.
+//
+// Suspensions live in Redis and are shared by all instances. Unreviewed
+// suspensions expire after a while, so the queue does not hold clients
+// forever when nobody looks at it. Allowed clients are not suspended again
+// for a longer while.
+package review
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+)
+
+// Verdicts an operator can reach on a suspended client.
+const (
+	VerdictBlock = "block"
+	VerdictAllow = "allow"
+)
+
+// ReasonConfirmed is the reason of blocks confirmed in review.
+const ReasonConfirmed = "review_confirmed"
+
+// ErrNotPending is returned when resolving a client that is not suspended.
+var ErrNotPending = errors.New("review: client is not pending review")
+
+const (
+	entryPrefix   = "review:entry:"
+	allowedPrefix = "review:allowed:"
+)
+
+// Options configures the review queue.
+type Options struct {
+	// MinScore and MaxScore bound the borderline band, 0.5 up to but not
+	// including 0.9 by default.
+	MinScore float64
+	MaxScore float64
+	// TightenFactor scales the rate limits of suspended clients.
+	TightenFactor float64
+	// Challenge challenges suspended clients instead of tightening their
+	// limits.
+	Challenge bool
+	// TTL is how long a suspension waits for review, 24 hours by default.
+	TTL time.Duration
+	// BlockDuration applies to confirmed blocks, 24 hours by default, and
+	// AllowDuration is how long allowed clients are not suspended again, 30
+	// days by default.
+	BlockDuration time.Duration
+	AllowDuration time.Duration
+	// Recorder, when set, counts verdicts.
+	Recorder Recorder
+}
+
+// Recorder counts verdicts, such as a metrics collector.
+type Recorder interface {
+	IncReviewVerdict(verdict string)
+}
+
+// Entry is a client pending review.
+type Entry struct {
+	// Client is the key the client is limited by, ClientIP its address.
+	Client   string    `json:"client"`
+	ClientIP string    `json:"clientIP"`
+	Score    float64   `json:"score"`
+	Rules    []string  `json:"rules"`
+	Route    string    `json:"route"`
+	Since    time.Time `json:"since"`
+}
+
+// Queue suspends borderline clients and resolves them.
+type Queue struct {
+	opts    Options
+	client  redis.UniversalClient
+	limiter *limiter.RateLimiter
+}
+
+// New creates a review queue that keeps suspensions in Redis and blocks
+// confirmed clients with l.
+func New(opts Options, client redis.UniversalClient, l *limiter.RateLimiter) *Queue {
+	if opts.MinScore <= 0 {
+		opts.MinScore = 0.5
+	}
+	if opts.MaxScore <= opts.MinScore {
+		opts.MaxScore = 0.9
+	}
+	if opts.TightenFactor <= 0 || opts.TightenFactor > 1 {
+		opts.TightenFactor = 1
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	if opts.BlockDuration <= 0 {
+		opts.BlockDuration = 24 * time.Hour
+	}
+	if opts.AllowDuration <= 0 {
+		opts.AllowDuration = 30 * 24 * time.Hour
+	}
+	return &Queue{opts: opts, client: client, limiter: l}
+}
+
+// Borderline reports whether score is in the borderline band.
+func (q *Queue) Borderline(score float64) bool {
+	return score >= q.opts.MinScore && score < q.opts.MaxScore
+}
+
+// Suspend puts a client in the queue. It reports false if the client was
+// already pending or was allowed in review.
+func (q *Queue) Suspend(ctx context.Context, entry Entry) (bool, error) {
+	allowed, err := q.client.Exists(ctx, allowedPrefix+entry.Client).Result()
+	if err != nil || allowed > 0 {
+		return false, err
+	}
+	if entry.Since.IsZero() {
+		entry.Since = time.Now().UTC()
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return false, err
+	}
+	return q.client.SetNX(ctx, entryPrefix+entry.Client, value, q.opts.TTL).Result()
+}
+
+// Suspended reports whether client is pending review.
+func (q *Queue) Suspended(ctx context.Context, client string) (bool, error) {
+	n, err := q.client.Exists(ctx, entryPrefix+client).Result()
+	return n > 0, err
+}
+
+// Pending returns the clients pending review, oldest first.
+func (q *Queue) Pending(ctx context.Context) ([]Entry, error) {
+	var entries []Entry
+	iter := q.client.Scan(ctx, 0, entryPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		value, err := q.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			// Expired between the scan and the read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry Entry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Since.Before(entries[j].Since) })
+	return entries, nil
+}
+
+// Resolve takes client out of the queue. VerdictBlock blocks it for the block
+// duration, VerdictAllow keeps it from being suspended again for the allow
+// duration.
+func (q *Queue) Resolve(ctx context.Context, client, verdict string) error {
+	if verdict != VerdictBlock && verdict != VerdictAllow {
+		return errors.New("review: verdict must be block or allow")
+	}
+	deleted, err := q.client.Del(ctx, entryPrefix+client).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotPending
+	}
+	if q.opts.Recorder != nil {
+		q.opts.Recorder.IncReviewVerdict(verdict)
+	}
+	if verdict == VerdictBlock {
+		return q.limiter.Block(ctx, client, q.opts.BlockDuration, ReasonConfirmed)
+	}
+	return q.client.Set(ctx, allowedPrefix+client, "1", q.opts.AllowDuration).Err()
+}
+
+// LimitFactor returns the factor the rate limits of suspended clients are
+// scaled by. It is 1 when suspended clients are challenged instead.
+func (q *Queue) LimitFactor() float64 {
+	if q.opts.Challenge {
+		return 1
+	}
+	return q.opts.TightenFactor
+}
+
+// Challenge reports whether suspended clients have to be challenged.
+func (q *Queue) Challenge() bool {
+	return q.opts.Challenge
+}
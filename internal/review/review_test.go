@@ -0,0 +1,86 @@
+package review
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/sirupsen/logrus"
+)
+
+func newQueue(t *testing.T) (*Queue, *limiter.RateLimiter, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	l := limiter.NewRateLimiter(limiter.NewRedisStore(client), limiter.Config{RequestsPerMinute: 10, BlockDuration: time.Minute}, logger)
+	return New(Options{TTL: time.Hour, BlockDuration: 2 * time.Hour, AllowDuration: 48 * time.Hour}, client, l), l, mr
+}
+
+func TestBorderline(t *testing.T) {
+	q := New(Options{}, nil, nil)
+	for score, want := range map[float64]bool{0.3: false, 0.5: true, 0.58: true, 0.9: false, 1: false} {
+		if got := q.Borderline(score); got != want {
+			t.Errorf("Borderline(%v): expected %v, got %v", score, want, got)
+		}
+	}
+}
+
+func TestSuspendAndResolve(t *testing.T) {
+	ctx := context.Background()
+	q, l, mr := newQueue(t)
+
+	for _, client := range []string{"10.0.0.1", "10.0.0.2"} {
+		added, err := q.Suspend(ctx, Entry{Client: client, Score: 0.58, Rules: []string{"fingerprint", "greylisted"}, Route: "api"})
+		if err != nil || !added {
+			t.Fatalf("Expected %s to be suspended, got %v %v", client, added, err)
+		}
+		mr.FastForward(time.Second)
+	}
+	if added, _ := q.Suspend(ctx, Entry{Client: "10.0.0.1"}); added {
+		t.Error("Expected pending clients not to be suspended twice")
+	}
+	entries, err := q.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Client != "10.0.0.1" || entries[0].Route != "api" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+
+	// Confirmed blocks go to the limiter.
+	if err := q.Resolve(ctx, "10.0.0.1", VerdictBlock); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, _ := l.IsBlocked(ctx, "10.0.0.1"); !blocked {
+		t.Error("Expected a confirmed block")
+	}
+	if suspended, _ := q.Suspended(ctx, "10.0.0.1"); suspended {
+		t.Error("Expected the client to leave the queue")
+	}
+
+	// Allowed clients are not suspended again.
+	if err := q.Resolve(ctx, "10.0.0.2", VerdictAllow); err != nil {
+		t.Fatal(err)
+	}
+	if added, _ := q.Suspend(ctx, Entry{Client: "10.0.0.2"}); added {
+		t.Error("Expected allowed clients not to be suspended")
+	}
+	if err := q.Resolve(ctx, "10.0.0.2", VerdictAllow); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Expected ErrNotPending, got %v", err)
+	}
+
+	// Unreviewed suspensions expire.
+	if _, err := q.Suspend(ctx, Entry{Client: "10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(2 * time.Hour)
+	if suspended, _ := q.Suspended(ctx, "10.0.0.3"); suspended {
+		t.Error("Expected the suspension to expire")
+	}
+}
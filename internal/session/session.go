@@ -0,0 +1,116 @@
+// Package session issues Shielder's own session cookies, so that browsers
+// sharing one IP address (behind a corporate NAT or a carrier-grade NAT) can
+// be rate limited individually instead of exhausting a single per-IP budget.
+//
+// Session IDs are random and HMAC signed, so clients cannot pick IDs of other
+// sessions. They can still drop the cookie to get a new session, which is why
+// requests with a session keep counting against a (more generous) per-IP
+// limit as well.
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options configures session tracking.
+type Options struct {
+	CookieName string
+	Secret     []byte
+	TTL        time.Duration
+	Secure     bool
+	Domain     string
+
+	// RequestsPerMinute is the limit applied to each session.
+	RequestsPerMinute int
+	// IPRequestsPerMinute is the limit shared by all sessions of one IP.
+	IPRequestsPerMinute int
+}
+
+// Manager issues and verifies session cookies.
+type Manager struct {
+	opts Options
+}
+
+// NewManager creates a session Manager.
+func NewManager(opts Options) (*Manager, error) {
+	if len(opts.Secret) < 16 {
+		return nil, errors.New("session: secret must be at least 16 bytes")
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = "shielder_session"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	return &Manager{opts: opts}, nil
+}
+
+// RequestsPerMinute returns the per-session limit.
+func (m *Manager) RequestsPerMinute() int {
+	return m.opts.RequestsPerMinute
+}
+
+// IPRequestsPerMinute returns the limit shared by the sessions of one IP.
+func (m *Manager) IPRequestsPerMinute() int {
+	return m.opts.IPRequestsPerMinute
+}
+
+// FromRequest returns the ID of the session r belongs to, or false if the
+// request carries no valid session cookie.
+func (m *Manager) FromRequest(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(m.opts.CookieName)
+	if err != nil {
+		return "", false
+	}
+	// The value is id.expiresUnix~signature
+	payload, signature, ok := strings.Cut(strings.TrimSpace(cookie.Value), "~")
+	if !ok || !hmac.Equal([]byte(signature), []byte(m.sign(payload))) {
+		return "", false
+	}
+	id, expires, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return "", false
+	}
+	return id, true
+}
+
+// New starts a session and returns its ID with the cookie that carries it.
+func (m *Manager) New() (string, *http.Cookie, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(raw)
+	expiresAt := time.Now().Add(m.opts.TTL)
+	payload := id + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+
+	return id, &http.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    payload + "~" + m.sign(payload),
+		Path:     "/",
+		Domain:   m.opts.Domain,
+		Expires:  expiresAt,
+		Secure:   m.opts.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}, nil
+}
+
+func (m *Manager) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.opts.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,51 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFromRequest(t *testing.T) {
+	m, err := NewManager(Options{Secret: []byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	expired, _ := NewManager(Options{Secret: []byte("0123456789abcdef"), TTL: time.Nanosecond})
+	other, _ := NewManager(Options{Secret: []byte("fedcba9876543210")})
+
+	id, cookie, err := m.New()
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	_, expiredCookie, _ := expired.New()
+	expiredCookie.Expires = time.Time{}
+	_, forgedCookie, _ := other.New()
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		wantID string
+		wantOK bool
+	}{
+		{name: "Valid", cookie: cookie, wantID: id, wantOK: true},
+		{name: "Missing", cookie: nil},
+		{name: "Forged", cookie: forgedCookie},
+		{name: "Tampered", cookie: &http.Cookie{Name: cookie.Name, Value: "0" + cookie.Value[1:]}},
+		{name: "Expired", cookie: expiredCookie},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cookie != nil {
+				req.AddCookie(&http.Cookie{Name: tt.cookie.Name, Value: tt.cookie.Value})
+			}
+			gotID, ok := m.FromRequest(req)
+			if ok != tt.wantOK || gotID != tt.wantID {
+				t.Errorf("Expected (%q, %v), got (%q, %v)", tt.wantID, tt.wantOK, gotID, ok)
+			}
+		})
+	}
+}
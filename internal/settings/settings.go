@@ -0,0 +1,221 @@
+// Package settings shares the runtime-adjustable part of the configuration
+// across the fleet. Changes made through the admin API of any instance are
+// written to Redis and announced on a channel; every instance watches the
+// channel, polls as a fallback, and swaps in the new settings atomically.
+package settings
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// settingsKey holds the current settings.
+	settingsKey = "shielder:settings"
+	// changedChannel announces new settings.
+	changedChannel = "shielder:settings:changed"
+)
+
+// ErrInvalid is returned by Update for settings that cannot be applied.
+var ErrInvalid = errors.New("invalid settings")
+
+// Settings are the parts of the configuration that can be changed at
+// runtime. Zero values keep the value from the configuration file.
+type Settings struct {
+	RequestsPerMinute int           `json:"requestsPerMinute,omitempty"`
+	BlockDuration     time.Duration `json:"blockDuration,omitempty"`
+	// Routes overrides the requests per minute of routes by name.
+	Routes map[string]int `json:"routes,omitempty"`
+}
+
+// Snapshot is a revision of the settings.
+type Snapshot struct {
+	Settings
+	// Revision increases with every update, zero means no settings were
+	// ever pushed.
+	Revision  int64     `json:"revision"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+}
+
+// Options configures the store.
+type Options struct {
+	// Instance is recorded as the author of updates made on this instance.
+	Instance string
+	// Routes lists the configured route names, updates naming other routes
+	// are rejected.
+	Routes []string
+	// PollInterval is how often the settings are read in case a change
+	// announcement was missed.
+	PollInterval time.Duration
+}
+
+// Store keeps the current settings in sync with Redis.
+type Store struct {
+	opts    Options
+	client  redis.UniversalClient
+	logger  *logrus.Logger
+	current atomic.Pointer[Snapshot]
+
+	// mu serializes applying revisions, so that handlers see them in order.
+	mu       sync.Mutex
+	handlers []func(Snapshot)
+}
+
+// New creates a store. Run must be called to pick up settings from Redis.
+func New(opts Options, client redis.UniversalClient, logger *logrus.Logger) *Store {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 10 * time.Second
+	}
+	s := &Store{opts: opts, client: client, logger: logger}
+	s.current.Store(&Snapshot{})
+	return s
+}
+
+// Current returns the settings in effect.
+func (s *Store) Current() Snapshot {
+	return *s.current.Load()
+}
+
+// OnChange registers a handler that is called with every new revision, one
+// revision at a time. Handlers must be registered before Run is called.
+func (s *Store) OnChange(handler func(Snapshot)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// Update replaces the settings for the whole fleet and applies them on this
+// instance right away.
+func (s *Store) Update(ctx context.Context, settings Settings) (Snapshot, error) {
+	if err := s.validate(settings); err != nil {
+		return Snapshot{}, err
+	}
+
+	var next Snapshot
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		prev, err := s.read(ctx, tx)
+		if err != nil {
+			return err
+		}
+		next = Snapshot{
+			Settings:  settings,
+			Revision:  prev.Revision + 1,
+			UpdatedAt: time.Now().UTC(),
+			UpdatedBy: s.opts.Instance,
+		}
+		payload, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, settingsKey, payload, 0)
+			pipe.Publish(ctx, changedChannel, next.Revision)
+			return nil
+		})
+		return err
+	}, settingsKey)
+	if err == redis.TxFailedErr {
+		return Snapshot{}, fmt.Errorf("settings were changed concurrently, retry")
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	s.apply(next)
+	return next, nil
+}
+
+func (s *Store) validate(settings Settings) error {
+	if settings.RequestsPerMinute < 0 || settings.BlockDuration < 0 {
+		return fmt.Errorf("%w: limits must not be negative", ErrInvalid)
+	}
+	for name, rpm := range settings.Routes {
+		known := false
+		for _, route := range s.opts.Routes {
+			known = known || route == name
+		}
+		if !known {
+			return fmt.Errorf("%w: unknown route %q", ErrInvalid, name)
+		}
+		if rpm < 0 {
+			return fmt.Errorf("%w: route %q limit must not be negative", ErrInvalid, name)
+		}
+	}
+	return nil
+}
+
+// Run applies the settings stored in Redis, then watches for changes until
+// ctx is done.
+func (s *Store) Run(ctx context.Context) {
+	pubsub := s.client.Subscribe(ctx, changedChannel)
+	defer pubsub.Close()
+	changes := pubsub.Channel()
+
+	ticker := time.NewTicker(s.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.refresh(ctx); err != nil && ctx.Err() == nil {
+			s.logger.WithError(err).Warn("Error reading shared settings")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh reads the settings and applies them if they are newer.
+func (s *Store) refresh(ctx context.Context) error {
+	snapshot, err := s.read(ctx, s.client)
+	if err != nil {
+		return err
+	}
+	if snapshot.Revision > s.Current().Revision {
+		s.apply(snapshot)
+	}
+	return nil
+}
+
+func (s *Store) read(ctx context.Context, client redis.Cmdable) (Snapshot, error) {
+	var snapshot Snapshot
+	payload, err := client.Get(ctx, settingsKey).Bytes()
+	if err == redis.Nil {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(payload, &snapshot)
+	return snapshot, err
+}
+
+// apply swaps in snapshot unless a newer revision is already in effect. The
+// handlers are called under the same lock, or an older revision applied
+// concurrently could reach them last and stay in effect.
+func (s *Store) apply(snapshot Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current.Load().Revision >= snapshot.Revision {
+		return
+	}
+	s.current.Store(&snapshot)
+	s.logger.WithFields(logrus.Fields{
+		"revision":   snapshot.Revision,
+		"updated_by": snapshot.UpdatedBy,
+	}).Info("Applying shared settings")
+
+	for _, handler := range s.handlers {
+		handler(snapshot)
+	}
+}
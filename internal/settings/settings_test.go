@@ -0,0 +1,146 @@
+package settings
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestStores(t *testing.T) (*Store, *Store) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	opts := Options{Routes: []string{"api", "login"}}
+
+	opts.Instance = "a"
+	first := New(opts, client, logger)
+	opts.Instance = "b"
+	second := New(opts, client, logger)
+	return first, second
+}
+
+func TestUpdateIsPickedUpByOtherInstances(t *testing.T) {
+	ctx := context.Background()
+	first, second := newTestStores(t)
+	var applied []Snapshot
+	second.OnChange(func(s Snapshot) { applied = append(applied, s) })
+
+	want := Settings{RequestsPerMinute: 50, BlockDuration: 2 * time.Hour, Routes: map[string]int{"login": 5}}
+	snapshot, err := first.Update(ctx, want)
+	if err != nil {
+		t.Fatalf("Failed to update settings: %v", err)
+	}
+	if snapshot.Revision != 1 || snapshot.UpdatedBy != "a" {
+		t.Errorf("Expected revision 1 by a, got %d by %q", snapshot.Revision, snapshot.UpdatedBy)
+	}
+	if first.Current().Revision != 1 {
+		t.Errorf("Expected the updating instance to apply the settings right away")
+	}
+
+	if err := second.refresh(ctx); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	got := second.Current()
+	if got.RequestsPerMinute != 50 || got.BlockDuration != 2*time.Hour || got.Routes["login"] != 5 {
+		t.Errorf("Expected the other instance to pick up %+v, got %+v", want, got.Settings)
+	}
+	if len(applied) != 1 {
+		t.Errorf("Expected one change notification, got %d", len(applied))
+	}
+
+	// An unchanged revision is not applied again.
+	if err := second.refresh(ctx); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	if len(applied) != 1 {
+		t.Errorf("Expected no notification without a new revision, got %d", len(applied))
+	}
+
+	if snapshot, _ := second.Update(ctx, Settings{}); snapshot.Revision != 2 {
+		t.Errorf("Expected revision 2, got %d", snapshot.Revision)
+	}
+}
+
+func TestRunWatchesForChanges(t *testing.T) {
+	first, second := newTestStores(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan Snapshot, 1)
+	second.OnChange(func(s Snapshot) { changed <- s })
+	go second.Run(ctx)
+
+	// Give the subscription time to be set up before publishing.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := first.Update(ctx, Settings{RequestsPerMinute: 10}); err != nil {
+		t.Fatalf("Failed to update settings: %v", err)
+	}
+	select {
+	case s := <-changed:
+		if s.RequestsPerMinute != 10 {
+			t.Errorf("Expected 10 requests per minute, got %d", s.RequestsPerMinute)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the change to be picked up")
+	}
+}
+
+func TestUpdateRejectsInvalidSettings(t *testing.T) {
+	first, _ := newTestStores(t)
+	tests := []struct {
+		name     string
+		settings Settings
+	}{
+		{"negative limit", Settings{RequestsPerMinute: -1}},
+		{"unknown route", Settings{Routes: map[string]int{"admin": 5}}},
+		{"negative route limit", Settings{Routes: map[string]int{"api": -5}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := first.Update(context.Background(), tt.settings); !errors.Is(err, ErrInvalid) {
+				t.Errorf("Expected ErrInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConcurrentRevisionsApplyInOrder(t *testing.T) {
+	store, _ := newTestStores(t)
+	var applied []int64
+	store.OnChange(func(s Snapshot) {
+		applied = append(applied, s.Revision)
+		// Give an older revision the chance to overtake this one.
+		time.Sleep(time.Millisecond)
+	})
+
+	var wg sync.WaitGroup
+	for revision := int64(20); revision > 0; revision-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.apply(Snapshot{Revision: revision, Settings: Settings{RequestsPerMinute: int(revision)}})
+		}()
+	}
+	wg.Wait()
+
+	if len(applied) == 0 || applied[len(applied)-1] != 20 {
+		t.Fatalf("Expected the handlers to see the newest revision last, got %v", applied)
+	}
+	for i := 1; i < len(applied); i++ {
+		if applied[i] <= applied[i-1] {
+			t.Errorf("Expected revisions to reach the handlers in order, got %v", applied)
+			break
+		}
+	}
+	if got := store.Current().RequestsPerMinute; got != 20 {
+		t.Errorf("Expected the newest settings to be in effect, got %d", got)
+	}
+}
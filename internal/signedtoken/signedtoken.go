@@ -0,0 +1,143 @@
+// Package signedtoken signs and verifies the tokens that Shielder hands out,
+// such as clearance cookies and bypass tokens.
+//
+// A token is the base64url JSON payload and its base64url HMAC-SHA256
+// signature, joined by a dot. The payload carries the ID of the signing key
+// in its kid field, so keys can be rotated by adding a new key in front of
+// the old ones and removing the old key once the tokens it signed have
+// expired.
+package signedtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalid is returned by Parse for tokens that are malformed, signed with
+// an unknown key or carry a wrong signature.
+var ErrInvalid = errors.New("signedtoken: invalid token")
+
+// Key is a signing key. Only the first configured key signs new tokens, the
+// others are accepted for verification.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Signer signs and verifies tokens with a set of keys.
+type Signer struct {
+	active string
+	keys   map[string][]byte
+}
+
+// New creates a Signer. Errors are prefixed with name, the component the
+// keys are configured for.
+func New(name string, keys []Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: at least one signing key is required", name)
+	}
+	s := &Signer{active: keys[0].ID, keys: make(map[string][]byte, len(keys))}
+	for _, key := range keys {
+		if key.ID == "" || strings.ContainsAny(key.ID, ".") {
+			return nil, fmt.Errorf("%s: invalid key id %q", name, key.ID)
+		}
+		if len(key.Secret) < 16 {
+			return nil, fmt.Errorf("%s: key %q is shorter than 16 bytes", name, key.ID)
+		}
+		if _, exists := s.keys[key.ID]; exists {
+			return nil, fmt.Errorf("%s: duplicate key id %q", name, key.ID)
+		}
+		s.keys[key.ID] = key.Secret
+	}
+	return s, nil
+}
+
+// KeyID returns the ID of the key new tokens are signed with, which belongs
+// in their kid field.
+func (s *Signer) KeyID() string {
+	return s.active
+}
+
+// Known reports whether keyID is a configured key.
+func (s *Signer) Known(keyID string) bool {
+	_, known := s.keys[keyID]
+	return known
+}
+
+// Sign encodes claims as a token signed with the active key, whose ID the
+// kid field of claims must hold.
+func (s *Signer) Sign(claims any) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + s.mac(s.active, encoded), nil
+}
+
+// Parse verifies the signature of token and decodes its payload into
+// claims. Expiry and revocation are left to the caller.
+func (s *Signer) Parse(token string, claims any) error {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrInvalid
+	}
+	var header struct {
+		KeyID string `json:"kid"`
+	}
+	if err := json.Unmarshal(payload, &header); err != nil || !s.Known(header.KeyID) {
+		return ErrInvalid
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.mac(header.KeyID, encoded))) {
+		return ErrInvalid
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// Seal signs value with the active key, so that other components can hand
+// out tamper-proof values, such as challenges, that any instance can check.
+func (s *Signer) Seal(value string) string {
+	return value + "." + s.active + "." + s.mac(s.active, value)
+}
+
+// Open verifies a value sealed by Seal with any configured key and returns it.
+func (s *Signer) Open(sealed string) (string, bool) {
+	rest, signature, ok := cutLast(sealed)
+	if !ok {
+		return "", false
+	}
+	value, kid, ok := cutLast(rest)
+	if !ok || !s.Known(kid) {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.mac(kid, value))) {
+		return "", false
+	}
+	return value, true
+}
+
+func cutLast(s string) (string, string, bool) {
+	i := strings.LastIndexByte(s, '.')
+	if i < 0 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+func (s *Signer) mac(keyID, value string) string {
+	mac := hmac.New(sha256.New, s.keys[keyID])
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
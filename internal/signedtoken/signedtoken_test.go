@@ -0,0 +1,81 @@
+package signedtoken
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	oldKey = Key{ID: "k1", Secret: []byte("0123456789abcdef-old")}
+	newKey = Key{ID: "k2", Secret: []byte("0123456789abcdef-new")}
+)
+
+type claims struct {
+	Subject string `json:"sub"`
+	KeyID   string `json:"kid"`
+}
+
+func newTestSigner(t *testing.T, keys ...Key) *Signer {
+	t.Helper()
+	s, err := New("test", keys)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return s
+}
+
+func TestParse(t *testing.T) {
+	issuer := newTestSigner(t, oldKey)
+	token, err := issuer.Sign(claims{Subject: "192.0.2.1", KeyID: issuer.KeyID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens of the old key stay valid after a new key is put in front.
+	rotated := newTestSigner(t, newKey, oldKey)
+	var got claims
+	if err := rotated.Parse(token, &got); err != nil || got.Subject != "192.0.2.1" {
+		t.Errorf("Expected the token to verify after rotation, got %+v %v", got, err)
+	}
+
+	encoded, signature, _ := strings.Cut(token, ".")
+	for name, token := range map[string]string{
+		"key removed":   token,
+		"tampered":      encoded + "x." + signature,
+		"no signature":  encoded,
+		"not base64":    "!!." + signature,
+		"empty payload": "." + signature,
+	} {
+		if err := newTestSigner(t, newKey).Parse(token, &got); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected ErrInvalid, got %v", name, err)
+		}
+	}
+}
+
+func TestSeal(t *testing.T) {
+	s := newTestSigner(t, newKey, oldKey)
+	sealed := s.Seal("nonce.1700000000")
+	if value, ok := newTestSigner(t, oldKey, newKey).Open(sealed); !ok || value != "nonce.1700000000" {
+		t.Errorf("Expected the value back, got %q %v", value, ok)
+	}
+	if _, ok := s.Open(sealed + "x"); ok {
+		t.Error("Expected a tampered value to be rejected")
+	}
+	if _, ok := newTestSigner(t, oldKey).Open(sealed); ok {
+		t.Error("Expected a value sealed with an unknown key to be rejected")
+	}
+}
+
+func TestNewRejectsBadKeys(t *testing.T) {
+	for name, keys := range map[string][]Key{
+		"no keys":   nil,
+		"dot in id": {{ID: "k.1", Secret: oldKey.Secret}},
+		"short":     {{ID: "k1", Secret: []byte("short")}},
+		"duplicate": {oldKey, {ID: "k1", Secret: newKey.Secret}},
+	} {
+		if _, err := New("test", keys); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
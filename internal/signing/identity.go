@@ -0,0 +1,145 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// Formats of identity signatures.
+const (
+	IdentityHMAC = "hmac"
+	IdentityJWT  = "jwt"
+)
+
+// IdentityOptions configures an IdentitySigner.
+type IdentityOptions struct {
+	// Headers are the identity headers the signature covers. Headers a
+	// request does not carry are signed as empty, so that the upstream can
+	// trust their absence as well.
+	Headers []string
+	// Format is IdentityHMAC (default) or IdentityJWT.
+	Format string
+	// Key is the shared key. JWTs are signed with HS256, which needs a key
+	// of at least 32 bytes.
+	Key   []byte
+	KeyID string
+	// Header carries the signature, X-Shielder-Identity-Signature by
+	// default.
+	Header string
+	// TTL is how long a JWT is valid, one minute by default.
+	TTL time.Duration
+}
+
+// IdentitySigner signs the identity headers Shielder sets for the upstream,
+// such as the client IP and the authenticated subject, so that the upstream
+// can tell them from headers sent by a client that bypassed the proxy.
+//
+// The HMAC format sets the header to
+//
+//	t=TIMESTAMP,kid=KEYID,h=HEADER;HEADER,sig=HEX
+//
+// where kid is left out without a key id and the signature is the hex
+// HMAC-SHA256 of
+//
+//	METHOD \n PATH \n TIMESTAMP \n header:value \n ...
+//
+// with one line per covered header, lowercased, in the order of h. The JWT
+// format sets the header to a JWT with the claims iat, exp, method, path and
+// hdr, a map from the lowercased header names to their values.
+type IdentitySigner struct {
+	opts   IdentityOptions
+	signer jose.Signer
+}
+
+// identityClaims are the claims of identity JWTs.
+type identityClaims struct {
+	jwt.Claims
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"hdr"`
+}
+
+// NewIdentitySigner creates an identity signer.
+func NewIdentitySigner(opts IdentityOptions) (*IdentitySigner, error) {
+	if len(opts.Key) == 0 {
+		return nil, errors.New("identity: key is required")
+	}
+	if opts.Header == "" {
+		opts.Header = "X-Shielder-Identity-Signature"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Minute
+	}
+	s := &IdentitySigner{opts: opts}
+	switch opts.Format {
+	case "", IdentityHMAC:
+	case IdentityJWT:
+		signerOpts := (&jose.SignerOptions{}).WithType("JWT")
+		if opts.KeyID != "" {
+			signerOpts = signerOpts.WithHeader("kid", opts.KeyID)
+		}
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: opts.Key}, signerOpts)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = signer
+	default:
+		return nil, errors.New("identity: format must be hmac or jwt")
+	}
+	return s, nil
+}
+
+// Headers returns the headers the signature covers.
+func (s *IdentitySigner) Headers() []string {
+	return s.opts.Headers
+}
+
+// Sign sets the signature header on r.
+func (s *IdentitySigner) Sign(r *http.Request) error {
+	now := time.Now()
+	if s.signer != nil {
+		claims := identityClaims{
+			Claims: jwt.Claims{
+				IssuedAt: jwt.NewNumericDate(now),
+				Expiry:   jwt.NewNumericDate(now.Add(s.opts.TTL)),
+			},
+			Method:  r.Method,
+			Path:    r.URL.EscapedPath(),
+			Headers: make(map[string]string, len(s.opts.Headers)),
+		}
+		for _, header := range s.opts.Headers {
+			claims.Headers[strings.ToLower(header)] = r.Header.Get(header)
+		}
+		token, err := jwt.Signed(s.signer).Claims(claims).Serialize()
+		if err != nil {
+			return err
+		}
+		r.Header.Set(s.opts.Header, token)
+		return nil
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	names := make([]string, len(s.opts.Headers))
+	lines := []string{r.Method, r.URL.EscapedPath(), timestamp}
+	for i, header := range s.opts.Headers {
+		names[i] = strings.ToLower(header)
+		lines = append(lines, names[i]+":"+r.Header.Get(header))
+	}
+	mac := hmac.New(sha256.New, s.opts.Key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	value := "t=" + timestamp
+	if s.opts.KeyID != "" {
+		value += ",kid=" + s.opts.KeyID
+	}
+	r.Header.Set(s.opts.Header, value+",h="+strings.Join(names, ";")+",sig="+hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
@@ -0,0 +1,79 @@
+// Package signing signs requests on their way to the upstream, so that
+// Shielder can front services that only accept signed requests, such as
+// S3-compatible storage (AWS Signature Version 4) or internal services
+// checking an HMAC.
+package signing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// Signer signs a request right before it is sent.
+type Signer interface {
+	Sign(r *http.Request) error
+}
+
+// Transport returns a round tripper that signs every request with signer
+// before passing it on to base.
+func Transport(base http.RoundTripper, signer Signer) http.RoundTripper {
+	return &transport{base: base, signer: signer}
+}
+
+type transport struct {
+	base   http.RoundTripper
+	signer Signer
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// A round tripper must not modify the request it was given.
+	r = r.Clone(r.Context())
+	if err := t.signer.Sign(r); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(r)
+}
+
+// emptyHash is the SHA-256 of an empty payload.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// payloadHash returns the hex SHA-256 of the request body. Bodies that cannot
+// be read again through GetBody are read into memory and replaced.
+func payloadHash(r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return emptyHash, nil
+	}
+
+	var body io.Reader
+	if r.GetBody != nil {
+		copy, err := r.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer copy.Close()
+		body = copy
+	} else {
+		payload, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(payload))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(payload)), nil
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
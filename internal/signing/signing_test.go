@@ -0,0 +1,198 @@
+package signing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestHMACTransport(t *testing.T) {
+	key := []byte("secret")
+	var verified bool
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		bodyHash := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(strings.Join([]string{
+			r.Method, r.URL.EscapedPath(), r.URL.RawQuery,
+			r.Header.Get("X-Signature-Timestamp"), hex.EncodeToString(bodyHash[:]),
+		}, "\n")))
+		verified = hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(r.Header.Get("X-Signature")))
+		if r.Header.Get("X-Signature-Key-Id") != "v1" {
+			t.Errorf("Expected key id v1, got %q", r.Header.Get("X-Signature-Key-Id"))
+		}
+	}))
+	defer upstream.Close()
+
+	signer, err := NewHMAC(HMACOptions{Key: key, KeyID: "v1"})
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	client := &http.Client{Transport: Transport(http.DefaultTransport, signer)}
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{"no body", nil},
+		{"buffered body", strings.NewReader(`{"item": "book"}`)},
+		// A reader without a known length has no GetBody.
+		{"streamed body", io.MultiReader(strings.NewReader(`{"item": "book"}`))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verified = false
+			req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/orders/a%2Fb?x=1", tt.body)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if !verified {
+				t.Error("Expected the signature to verify")
+			}
+			if tt.body != nil && gotBody != `{"item": "book"}` {
+				t.Errorf("Expected the body to be forwarded, got %q", gotBody)
+			}
+			if req.Header.Get("X-Signature") != "" {
+				t.Error("Expected the original request not to be modified")
+			}
+		})
+	}
+}
+
+func TestSigV4(t *testing.T) {
+	tests := []struct {
+		name     string
+		unsigned bool
+	}{
+		{"signed payload", false},
+		{"unsigned payload", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewSigV4(context.Background(), SigV4Options{
+				Region:          "us-east-1",
+				Service:         "s3",
+				AccessKeyID:     "AKIDEXAMPLE",
+				SecretAccessKey: "secret",
+				UnsignedPayload: tt.unsigned,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create signer: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "http://bucket.s3.amazonaws.com/photos/cat.jpg", strings.NewReader("meow"))
+			req.Host = "shielder.example"
+			if err := signer.Sign(req); err != nil {
+				t.Fatalf("Sign failed: %v", err)
+			}
+
+			auth := req.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+				t.Errorf("Unexpected Authorization header %q", auth)
+			}
+			if !strings.Contains(auth, ";host;x-amz-content-sha256;x-amz-date,") {
+				t.Errorf("Expected host and content hash to be signed, got %q", auth)
+			}
+			want := unsignedPayload
+			if !tt.unsigned {
+				sum := sha256.Sum256([]byte("meow"))
+				want = hex.EncodeToString(sum[:])
+			}
+			if got := req.Header.Get("X-Amz-Content-Sha256"); got != want {
+				t.Errorf("Expected payload hash %s, got %s", want, got)
+			}
+			if req.Host != "" {
+				t.Errorf("Expected the Host header to follow the URL, got %q", req.Host)
+			}
+			if body, _ := io.ReadAll(req.Body); string(body) != "meow" {
+				t.Errorf("Expected the body to be kept, got %q", body)
+			}
+		})
+	}
+}
+
+func TestSigV4RequiresRegionAndService(t *testing.T) {
+	if _, err := NewSigV4(context.Background(), SigV4Options{Service: "s3", AccessKeyID: "a"}); err == nil {
+		t.Error("Expected error without region")
+	}
+}
+
+func TestIdentitySigner(t *testing.T) {
+	// HS256 needs a key of at least 32 bytes.
+	key := []byte("0123456789abcdef0123456789abcdef")
+	headers := []string{"X-Shielder-Client-IP", "X-Shielder-Subject"}
+
+	t.Run("hmac", func(t *testing.T) {
+		signer, err := NewIdentitySigner(IdentityOptions{Headers: headers, Key: key, KeyID: "v1"})
+		if err != nil {
+			t.Fatalf("Failed to create signer: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("X-Shielder-Client-IP", "203.0.113.7")
+		if err := signer.Sign(req); err != nil {
+			t.Fatalf("Sign failed: %v", err)
+		}
+
+		fields := map[string]string{}
+		for _, field := range strings.Split(req.Header.Get("X-Shielder-Identity-Signature"), ",") {
+			name, value, _ := strings.Cut(field, "=")
+			fields[name] = value
+		}
+		if fields["kid"] != "v1" || fields["h"] != "x-shielder-client-ip;x-shielder-subject" {
+			t.Fatalf("Unexpected signature fields: %v", fields)
+		}
+		// The missing subject is signed as empty.
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(strings.Join([]string{
+			"GET", "/orders", fields["t"], "x-shielder-client-ip:203.0.113.7", "x-shielder-subject:",
+		}, "\n")))
+		if fields["sig"] != hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("Expected the signature to verify")
+		}
+	})
+
+	t.Run("jwt", func(t *testing.T) {
+		signer, err := NewIdentitySigner(IdentityOptions{Headers: headers, Format: IdentityJWT, Key: key, KeyID: "v1"})
+		if err != nil {
+			t.Fatalf("Failed to create signer: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+		req.Header.Set("X-Shielder-Client-IP", "203.0.113.7")
+		req.Header.Set("X-Shielder-Subject", "alice")
+		if err := signer.Sign(req); err != nil {
+			t.Fatalf("Sign failed: %v", err)
+		}
+
+		token, err := jwt.ParseSigned(req.Header.Get("X-Shielder-Identity-Signature"), []jose.SignatureAlgorithm{jose.HS256})
+		if err != nil {
+			t.Fatalf("Failed to parse token: %v", err)
+		}
+		if token.Headers[0].KeyID != "v1" {
+			t.Errorf("Expected key id v1, got %q", token.Headers[0].KeyID)
+		}
+		var claims identityClaims
+		if err := token.Claims(key, &claims); err != nil {
+			t.Fatalf("Failed to verify token: %v", err)
+		}
+		if claims.Method != "POST" || claims.Path != "/orders" ||
+			claims.Headers["x-shielder-client-ip"] != "203.0.113.7" || claims.Headers["x-shielder-subject"] != "alice" {
+			t.Errorf("Unexpected claims: %+v", claims)
+		}
+		if err := claims.Validate(jwt.Expected{}); err != nil {
+			t.Errorf("Expected a valid token: %v", err)
+		}
+	})
+}
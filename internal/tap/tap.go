@@ -0,0 +1,445 @@
+// Package tap captures full request and response details of a single client
+// for a bounded time, to debug reports of wrongly blocked clients.
+//
+// Taps are started through the admin API and match a client IP or the value
+// of a request header such as an API key. Captured exchanges are written to a
+// JSON lines file, streamed to admin API subscribers, or both. Credentials in
+// headers and query parameters are redacted before a record leaves the
+// process, and bodies are truncated. Taps are local to the instance they were
+// started on.
+package tap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted replaces redacted header and query parameter values.
+const Redacted = "[REDACTED]"
+
+var (
+	// ErrNoFilter is returned when a tap would match every client.
+	ErrNoFilter = errors.New("tap: a client IP or a header and value are required")
+	// ErrNoDir is returned when a file is requested but no directory is
+	// configured.
+	ErrNoDir = errors.New("tap: no directory configured for tap files")
+)
+
+// defaultRedactHeaders are always redacted.
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// Options configures the tapper.
+type Options struct {
+	// Dir is where tap files are written, empty allows streaming only.
+	Dir string
+	// MaxDuration bounds how long a tap runs.
+	MaxDuration time.Duration
+	// MaxBodyBytes is how much of each body is captured, 0 captures none.
+	MaxBodyBytes int
+	// RedactHeaders and RedactQuery name additional header and query
+	// parameters whose values are redacted.
+	RedactHeaders []string
+	RedactQuery   []string
+}
+
+// Filter selects the requests a tap captures. A request matches when it comes
+// from ClientIP, or carries Header with exactly Value.
+type Filter struct {
+	ClientIP string `json:"clientIP,omitempty"`
+	Header   string `json:"header,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+func (f Filter) matches(r *http.Request, clientIP string) bool {
+	if f.ClientIP != "" && f.ClientIP == clientIP {
+		return true
+	}
+	return f.Header != "" && r.Header.Get(f.Header) == f.Value
+}
+
+// Info describes a running tap.
+type Info struct {
+	ID       string    `json:"id"`
+	Filter   Filter    `json:"filter"`
+	Until    time.Time `json:"until"`
+	File     string    `json:"file,omitempty"`
+	Captured int64     `json:"captured"`
+}
+
+// Record is one captured exchange.
+type Record struct {
+	Tap             string      `json:"tap"`
+	Time            time.Time   `json:"time"`
+	ClientIP        string      `json:"clientIP"`
+	Route           string      `json:"route"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	Proto           string      `json:"proto"`
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	RequestBody     string      `json:"requestBody,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	ResponseBody    string      `json:"responseBody,omitempty"`
+	// Truncated is set when a body was longer than the captured part.
+	Truncated bool          `json:"truncated,omitempty"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// subscriberBuffer is how many records a slow subscriber may fall behind
+// before records are dropped for it.
+const subscriberBuffer = 64
+
+type tap struct {
+	info        Info
+	file        *os.File
+	mu          sync.Mutex
+	subscribers map[chan Record]struct{}
+	captured    atomic.Int64
+	done        chan struct{}
+}
+
+// Tapper manages the running taps.
+type Tapper struct {
+	opts        Options
+	logger      *logrus.Logger
+	redactQuery map[string]bool
+
+	mu     sync.RWMutex
+	taps   map[string]*tap
+	active atomic.Bool
+}
+
+// New creates a Tapper.
+func New(opts Options, logger *logrus.Logger) *Tapper {
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = time.Hour
+	}
+	opts.RedactHeaders = append(append([]string{}, defaultRedactHeaders...), opts.RedactHeaders...)
+	t := &Tapper{
+		opts:        opts,
+		logger:      logger,
+		redactQuery: make(map[string]bool),
+		taps:        make(map[string]*tap),
+	}
+	for _, name := range opts.RedactQuery {
+		t.redactQuery[strings.ToLower(name)] = true
+	}
+	return t
+}
+
+// Start starts a tap for d, capped at the configured maximum. With toFile
+// set, records are also appended to a file in the configured directory.
+func (t *Tapper) Start(f Filter, d time.Duration, toFile bool) (Info, error) {
+	if f.ClientIP == "" && (f.Header == "" || f.Value == "") {
+		return Info{}, ErrNoFilter
+	}
+	if d <= 0 || d > t.opts.MaxDuration {
+		d = t.opts.MaxDuration
+	}
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return Info{}, err
+	}
+	tp := &tap{
+		info:        Info{ID: hex.EncodeToString(raw), Filter: f, Until: time.Now().Add(d).UTC()},
+		subscribers: make(map[chan Record]struct{}),
+		done:        make(chan struct{}),
+	}
+	if toFile {
+		if t.opts.Dir == "" {
+			return Info{}, ErrNoDir
+		}
+		tp.info.File = filepath.Join(t.opts.Dir, "tap-"+tp.info.ID+".jsonl")
+		file, err := os.OpenFile(tp.info.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return Info{}, fmt.Errorf("tap: %w", err)
+		}
+		tp.file = file
+	}
+
+	t.mu.Lock()
+	t.taps[tp.info.ID] = tp
+	t.active.Store(true)
+	t.mu.Unlock()
+
+	time.AfterFunc(d, func() { t.Stop(tp.info.ID) })
+	t.logger.WithFields(logrus.Fields{"tap": tp.info.ID, "until": tp.info.Until}).Warn("Tap started")
+	return tp.info, nil
+}
+
+// Stop ends a tap, closing its file and subscriptions. It reports whether
+// the tap was running.
+func (t *Tapper) Stop(id string) bool {
+	t.mu.Lock()
+	tp, ok := t.taps[id]
+	delete(t.taps, id)
+	t.active.Store(len(t.taps) > 0)
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	tp.mu.Lock()
+	close(tp.done)
+	for ch := range tp.subscribers {
+		close(ch)
+		delete(tp.subscribers, ch)
+	}
+	if tp.file != nil {
+		tp.file.Close()
+		tp.file = nil
+	}
+	tp.mu.Unlock()
+	t.logger.WithFields(logrus.Fields{"tap": id, "captured": tp.captured.Load()}).Warn("Tap stopped")
+	return true
+}
+
+// List returns the running taps ordered by expiry.
+func (t *Tapper) List() []Info {
+	t.mu.RLock()
+	infos := make([]Info, 0, len(t.taps))
+	for _, tp := range t.taps {
+		info := tp.info
+		info.Captured = tp.captured.Load()
+		infos = append(infos, info)
+	}
+	t.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Until.Before(infos[j].Until) })
+	return infos
+}
+
+// Subscribe streams the records of a tap. The channel is closed when the tap
+// ends, cancel must be called when the subscriber goes away earlier.
+func (t *Tapper) Subscribe(id string) (records <-chan Record, cancel func(), ok bool) {
+	t.mu.RLock()
+	tp, ok := t.taps[id]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	ch := make(chan Record, subscriberBuffer)
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	select {
+	case <-tp.done:
+		return nil, nil, false
+	default:
+	}
+	tp.subscribers[ch] = struct{}{}
+	return ch, func() {
+		tp.mu.Lock()
+		defer tp.mu.Unlock()
+		if _, ok := tp.subscribers[ch]; ok {
+			delete(tp.subscribers, ch)
+			close(ch)
+		}
+	}, true
+}
+
+// Capture records one exchange for the taps that matched it. Writer and
+// Request replace the originals while the request is served.
+type Capture struct {
+	Writer  http.ResponseWriter
+	Request *http.Request
+
+	tapper   *Tapper
+	taps     []*tap
+	record   Record
+	body     *bodyRecorder
+	response *responseRecorder
+}
+
+// Begin starts capturing r if a running tap matches it, otherwise it returns
+// nil. This is cheap while no tap is running.
+func (t *Tapper) Begin(w http.ResponseWriter, r *http.Request, clientIP string) *Capture {
+	if !t.active.Load() {
+		return nil
+	}
+	var matched []*tap
+	t.mu.RLock()
+	for _, tp := range t.taps {
+		if tp.info.Filter.matches(r, clientIP) {
+			matched = append(matched, tp)
+		}
+	}
+	t.mu.RUnlock()
+	if len(matched) == 0 {
+		return nil
+	}
+
+	// The request is recorded as the client sent it, before plugins rewrite
+	// it on its way to the upstream.
+	c := &Capture{
+		tapper: t,
+		taps:   matched,
+		record: Record{
+			Time:           time.Now().UTC(),
+			ClientIP:       clientIP,
+			Method:         r.Method,
+			URL:            t.redactURL(r.URL),
+			Proto:          r.Proto,
+			RequestHeaders: t.redactHeaders(r.Header),
+		},
+		response: &responseRecorder{ResponseWriter: w, limit: t.opts.MaxBodyBytes},
+	}
+	c.Writer = c.response
+	c.Request = r
+	if r.Body != nil && r.Body != http.NoBody {
+		c.body = &bodyRecorder{ReadCloser: r.Body, limit: t.opts.MaxBodyBytes}
+		c.Request = r.WithContext(r.Context())
+		c.Request.Body = c.body
+	}
+	return c
+}
+
+// Finish emits the record of the exchange to the matched taps.
+func (c *Capture) Finish(route string) {
+	rec := c.record
+	rec.Route = route
+	rec.Status = c.response.status
+	rec.ResponseHeaders = c.tapper.redactHeaders(c.response.Header())
+	rec.ResponseBody = c.response.buf.String()
+	rec.Truncated = c.response.truncated
+	rec.Duration = time.Since(rec.Time)
+	if c.body != nil {
+		rec.RequestBody = c.body.buf.String()
+		rec.Truncated = rec.Truncated || c.body.truncated
+	}
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	for _, tp := range c.taps {
+		rec.Tap = tp.info.ID
+		c.tapper.emit(tp, rec)
+	}
+}
+
+func (t *Tapper) emit(tp *tap, rec Record) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	select {
+	case <-tp.done:
+		return
+	default:
+	}
+	tp.captured.Add(1)
+	if tp.file != nil {
+		line, err := json.Marshal(rec)
+		if err == nil {
+			_, err = tp.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			t.logger.WithError(err).WithField("tap", tp.info.ID).Error("Error writing tap record")
+		}
+	}
+	for ch := range tp.subscribers {
+		select {
+		case ch <- rec:
+		default:
+			// Never hold up requests for a slow subscriber.
+		}
+	}
+}
+
+func (t *Tapper) redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range t.opts.RedactHeaders {
+		if values, ok := out[http.CanonicalHeaderKey(name)]; ok {
+			for i := range values {
+				values[i] = Redacted
+			}
+		}
+	}
+	return out
+}
+
+func (t *Tapper) redactURL(u *url.URL) string {
+	if len(t.redactQuery) == 0 || u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	query := u.Query()
+	for name, values := range query {
+		if t.redactQuery[strings.ToLower(name)] {
+			for i := range values {
+				values[i] = Redacted
+			}
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
+
+// bodyRecorder keeps the first limit bytes read from a request body.
+type bodyRecorder struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.truncated = record(&b.buf, p[:n], b.limit) || b.truncated
+	return n, err
+}
+
+// responseRecorder keeps the status and the first limit bytes of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.truncated = record(&w.buf, b, w.limit) || w.truncated
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// record appends as much of p to buf as fits into limit and reports whether
+// anything was cut off.
+func record(buf *bytes.Buffer, p []byte, limit int) bool {
+	room := limit - buf.Len()
+	if room <= 0 {
+		return len(p) > 0
+	}
+	if len(p) > room {
+		buf.Write(p[:room])
+		return true
+	}
+	buf.Write(p)
+	return false
+}
@@ -0,0 +1,167 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestTapper(t *testing.T, opts Options) *Tapper {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(opts, logger)
+}
+
+// serve sends a request through a capture like the proxy does.
+func serve(tp *Tapper, clientIP string, r *http.Request) string {
+	w := httptest.NewRecorder()
+	var rw http.ResponseWriter = w
+	if c := tp.Begin(rw, r, clientIP); c != nil {
+		rw, r = c.Writer, c.Request
+		defer c.Finish("api")
+	}
+	body, _ := io.ReadAll(r.Body)
+	rw.Header().Set("Set-Cookie", "session=secret")
+	rw.WriteHeader(http.StatusTooManyRequests)
+	rw.Write([]byte("Too Many Requests"))
+	return string(body)
+}
+
+func TestCapture(t *testing.T) {
+	tp := newTestTapper(t, Options{MaxBodyBytes: 5, RedactQuery: []string{"token"}})
+	info, err := tp.Start(Filter{ClientIP: "192.0.2.1"}, time.Minute, false)
+	if err != nil {
+		t.Fatalf("Failed to start tap: %v", err)
+	}
+	records, cancel, ok := tp.Subscribe(info.ID)
+	if !ok {
+		t.Fatalf("Expected to subscribe to tap")
+	}
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/orders?token=abc&page=2", strings.NewReader("hello world"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("User-Agent", "curl/8.0")
+	if got := serve(tp, "192.0.2.1", req); got != "hello world" {
+		t.Errorf("Expected upstream to receive the full body, got %q", got)
+	}
+	serve(tp, "192.0.2.2", httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var rec Record
+	select {
+	case rec = <-records:
+	default:
+		t.Fatalf("Expected a record for the tapped client")
+	}
+	select {
+	case other := <-records:
+		t.Fatalf("Expected no record for other clients, got %+v", other)
+	default:
+	}
+
+	if rec.Tap != info.ID || rec.Route != "api" || rec.Status != http.StatusTooManyRequests {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+	if rec.URL != "/api/orders?page=2&token=%5BREDACTED%5D" {
+		t.Errorf("Expected token to be redacted, got %q", rec.URL)
+	}
+	if got := rec.RequestHeaders.Get("Authorization"); got != Redacted {
+		t.Errorf("Expected Authorization to be redacted, got %q", got)
+	}
+	if got := rec.RequestHeaders.Get("User-Agent"); got != "curl/8.0" {
+		t.Errorf("Expected User-Agent to be kept, got %q", got)
+	}
+	if got := rec.ResponseHeaders.Get("Set-Cookie"); got != Redacted {
+		t.Errorf("Expected Set-Cookie to be redacted, got %q", got)
+	}
+	if rec.RequestBody != "hello" || rec.ResponseBody != "Too M" || !rec.Truncated {
+		t.Errorf("Expected bodies to be truncated to 5 bytes, got %q and %q", rec.RequestBody, rec.ResponseBody)
+	}
+
+	if !tp.Stop(info.ID) {
+		t.Fatalf("Expected tap to be running")
+	}
+	if _, open := <-records; open {
+		t.Errorf("Expected subscription to be closed when the tap stops")
+	}
+	if c := tp.Begin(httptest.NewRecorder(), req, "192.0.2.1"); c != nil {
+		t.Errorf("Expected no capture after the tap stopped")
+	}
+}
+
+func TestCaptureByHeaderToFile(t *testing.T) {
+	dir := t.TempDir()
+	tp := newTestTapper(t, Options{Dir: dir})
+	info, err := tp.Start(Filter{Header: "X-Api-Key", Value: "customer-1"}, time.Minute, true)
+	if err != nil {
+		t.Fatalf("Failed to start tap: %v", err)
+	}
+
+	for _, key := range []string{"customer-1", "customer-2"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+		req.Header.Set("X-Api-Key", key)
+		serve(tp, "192.0.2.1", req)
+	}
+	tp.Stop(info.ID)
+
+	file, err := os.Open(info.File)
+	if err != nil {
+		t.Fatalf("Failed to open tap file: %v", err)
+	}
+	defer file.Close()
+	var lines []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Invalid record: %v", err)
+		}
+		lines = append(lines, rec)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(lines))
+	}
+	if got := lines[0].RequestHeaders.Get("X-Api-Key"); got != Redacted {
+		t.Errorf("Expected API key to be redacted, got %q", got)
+	}
+	if lines[0].RequestBody != "" || lines[0].ResponseBody != "" {
+		t.Errorf("Expected no bodies without maxBodyBytes")
+	}
+}
+
+func TestStartValidation(t *testing.T) {
+	tp := newTestTapper(t, Options{MaxDuration: time.Minute})
+
+	tests := []struct {
+		name   string
+		filter Filter
+		file   bool
+		want   error
+	}{
+		{"no filter", Filter{}, false, ErrNoFilter},
+		{"header without value", Filter{Header: "X-Api-Key"}, false, ErrNoFilter},
+		{"file without dir", Filter{ClientIP: "192.0.2.1"}, true, ErrNoDir},
+	}
+	for _, tt := range tests {
+		if _, err := tp.Start(tt.filter, 0, tt.file); err != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	info, err := tp.Start(Filter{ClientIP: "192.0.2.1"}, time.Hour, false)
+	if err != nil {
+		t.Fatalf("Failed to start tap: %v", err)
+	}
+	if time.Until(info.Until) > time.Minute {
+		t.Errorf("Expected duration to be capped at a minute, got until %v", info.Until)
+	}
+}
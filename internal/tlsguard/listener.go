@@ -0,0 +1,228 @@
+// Package tlsguard terminates TLS and protects the handshake path, which is
+// far more expensive for the server than for a client opening connections.
+// Each source IP may start a limited number of handshakes per second, and a
+// source whose handshakes keep failing is refused for a while. Refused
+// connections are closed right after they are accepted, before any
+// cryptography is done.
+package tlsguard
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Handshake results passed to the Recorder. Completed and failed handshakes are
+// recorded when their connection is closed.
+const (
+	ResultOK          = "ok"
+	ResultFailed      = "failed"
+	ResultRateLimited = "rate_limited"
+	ResultBlocked     = "blocked"
+)
+
+// Recorder receives handshake metrics.
+type Recorder interface {
+	IncTLSHandshake(result string)
+}
+
+// Options configures the handshake limits.
+type Options struct {
+	// HandshakesPerSecond is the rate at which a source IP may start
+	// handshakes, with bursts of up to HandshakeBurst. Zero disables the
+	// limit.
+	HandshakesPerSecond float64
+	HandshakeBurst      int
+	// MaxFailures failed handshakes within FailureWindow block the source
+	// for BlockDuration. Zero disables blocking.
+	MaxFailures   int
+	FailureWindow time.Duration
+	BlockDuration time.Duration
+	Recorder      Recorder
+}
+
+// Listener accepts TLS connections within the handshake limits.
+type Listener struct {
+	net.Listener
+	opts   Options
+	config *tls.Config
+	logger *logrus.Logger
+
+	mu        sync.Mutex
+	sources   map[string]*source
+	lastSweep time.Time
+}
+
+// source is what is known about the handshakes of one IP.
+type source struct {
+	limiter      *rate.Limiter
+	failures     int
+	windowStart  time.Time
+	blockedUntil time.Time
+	lastSeen     time.Time
+}
+
+// NewListener terminates TLS on the connections accepted from l using config.
+func NewListener(l net.Listener, config *tls.Config, opts Options, logger *logrus.Logger) *Listener {
+	if opts.HandshakeBurst <= 0 {
+		opts.HandshakeBurst = 1
+	}
+	if opts.FailureWindow <= 0 {
+		opts.FailureWindow = time.Minute
+	}
+	if opts.BlockDuration <= 0 {
+		opts.BlockDuration = 10 * time.Minute
+	}
+	g := &Listener{
+		Listener:  l,
+		opts:      opts,
+		logger:    logger,
+		sources:   make(map[string]*source),
+		lastSweep: time.Now(),
+	}
+	g.config = config.Clone()
+	g.config.GetConfigForClient = g.configForClient
+	return g
+}
+
+// Accept returns the next connection from a source within the limits. The
+// handshake itself happens when the server first reads from the connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(conn.RemoteAddr())
+		if result := l.admit(ip, time.Now()); result != "" {
+			conn.Close()
+			l.record(result)
+			continue
+		}
+		tracked := &trackedConn{Conn: conn, listener: l, ip: ip}
+		tracked.tls = tls.Server(tracked, l.config)
+		return tracked.tls, nil
+	}
+}
+
+// admit returns why a handshake from ip is refused, or an empty string if it
+// may go ahead.
+func (l *Listener) admit(ip string, now time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.source(ip, now)
+	if now.Before(s.blockedUntil) {
+		return ResultBlocked
+	}
+	if l.opts.HandshakesPerSecond > 0 && !s.limiter.AllowN(now, 1) {
+		return ResultRateLimited
+	}
+	return ""
+}
+
+// fail counts a failed handshake and blocks ip once it failed too often.
+func (l *Listener) fail(ip string, now time.Time) {
+	l.record(ResultFailed)
+	if l.opts.MaxFailures <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.source(ip, now)
+	if now.Sub(s.windowStart) > l.opts.FailureWindow {
+		s.failures = 0
+		s.windowStart = now
+	}
+	s.failures++
+	if s.failures >= l.opts.MaxFailures && !now.Before(s.blockedUntil) {
+		s.blockedUntil = now.Add(l.opts.BlockDuration)
+		l.logger.WithFields(logrus.Fields{
+			"ip":       ip,
+			"failures": s.failures,
+			"duration": l.opts.BlockDuration,
+		}).Warn("Blocking source after repeated TLS handshake failures")
+	}
+}
+
+// source returns the entry for ip, creating it if needed. Idle entries are
+// swept now and then. The caller must hold mu.
+func (l *Listener) source(ip string, now time.Time) *source {
+	idle := max(l.opts.FailureWindow, time.Minute)
+	if now.Sub(l.lastSweep) > idle {
+		for key, s := range l.sources {
+			if now.Sub(s.lastSeen) > idle && !now.Before(s.blockedUntil) {
+				delete(l.sources, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	s, ok := l.sources[ip]
+	if !ok {
+		s = &source{
+			limiter:     rate.NewLimiter(rate.Limit(l.opts.HandshakesPerSecond), l.opts.HandshakeBurst),
+			windowStart: now,
+		}
+		l.sources[ip] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// configForClient marks the handshake as started once the ClientHello has been
+// read.
+func (l *Listener) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if conn, ok := hello.Conn.(*trackedConn); ok {
+		conn.started.Store(true)
+	}
+	return nil, nil
+}
+
+func (l *Listener) record(result string) {
+	if l.opts.Recorder != nil {
+		l.opts.Recorder.IncTLSHandshake(result)
+	}
+}
+
+// trackedConn is the raw connection under a TLS connection. The handshake
+// result is recorded when it is closed: a handshake that was started but not
+// completed counts as failed. Connections that never sent a ClientHello, such
+// as TCP health checks, do not count.
+type trackedConn struct {
+	net.Conn
+	listener *Listener
+	ip       string
+	tls      *tls.Conn
+	started  atomic.Bool
+	once     sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	// Close first, so that a handshake still in progress fails and releases
+	// the TLS connection's state.
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if !c.started.Load() {
+			return
+		}
+		if c.tls.ConnectionState().HandshakeComplete {
+			c.listener.record(ResultOK)
+		} else {
+			c.listener.fail(c.ip, time.Now())
+		}
+	})
+	return err
+}
+
+func remoteIP(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
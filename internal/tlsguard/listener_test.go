@@ -0,0 +1,159 @@
+package tlsguard
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	results map[string]int
+}
+
+func (r *recorder) IncTLSHandshake(result string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[result]++
+}
+
+func (r *recorder) count(result string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.results[result]
+}
+
+// waitFor polls until the recorder saw n results, as the server side of a
+// handshake finishes independently of the client.
+func (r *recorder) waitFor(t *testing.T, result string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for r.count(result) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d %s handshakes, got %d", n, result, r.count(result))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestListener(t *testing.T, opts Options) (string, *recorder) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inner.Close() })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	rec := &recorder{results: make(map[string]int)}
+	opts.Recorder = rec
+	l := NewListener(inner, &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}, opts, logger)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return inner.Addr().String(), rec
+}
+
+func dial(addr string, verify bool) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, &tls.Config{InsecureSkipVerify: !verify})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestBlockAfterFailures(t *testing.T) {
+	addr, rec := newTestListener(t, Options{MaxFailures: 2, BlockDuration: time.Minute})
+
+	if err := dial(addr, false); err != nil {
+		t.Fatalf("Expected handshake to succeed, got %v", err)
+	}
+	rec.waitFor(t, ResultOK, 1)
+
+	// The client rejects the self-signed certificate, failing the handshake.
+	for i := 1; i <= 2; i++ {
+		if err := dial(addr, true); err == nil {
+			t.Fatal("Expected handshake to fail")
+		}
+		rec.waitFor(t, ResultFailed, i)
+	}
+
+	if err := dial(addr, false); err == nil {
+		t.Error("Expected blocked source to be refused")
+	}
+	rec.waitFor(t, ResultBlocked, 1)
+}
+
+func TestHandshakeRate(t *testing.T) {
+	addr, rec := newTestListener(t, Options{HandshakesPerSecond: 0.001, HandshakeBurst: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := dial(addr, false); err != nil {
+			t.Fatalf("Expected handshake %d to succeed, got %v", i+1, err)
+		}
+	}
+	if err := dial(addr, false); err == nil {
+		t.Error("Expected handshake over the rate to be refused")
+	}
+	rec.waitFor(t, ResultRateLimited, 1)
+	if got := rec.count(ResultFailed); got != 0 {
+		t.Errorf("Expected refused handshakes not to count as failed, got %d", got)
+	}
+}
+
+func TestConnectionWithoutHandshake(t *testing.T) {
+	addr, rec := newTestListener(t, Options{MaxFailures: 1})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if err := dial(addr, false); err != nil {
+		t.Fatalf("Expected a connection without ClientHello not to count as failure, got %v", err)
+	}
+	rec.waitFor(t, ResultOK, 1)
+}
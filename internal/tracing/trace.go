@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HeaderTrace carries the steps of a trace in the response, one header value
+// per step.
+const HeaderTrace = "X-Shielder-Trace"
+
+// Step is a single check of a traced request.
+type Step struct {
+	Check  string
+	Result string
+	// Detail holds what the check read or decided on, such as counters.
+	Detail string
+	// Elapsed is the time since the previous step.
+	Elapsed time.Duration
+}
+
+// Trace collects the steps of a request. A nil trace records nothing, so
+// callers need not check whether a request is traced.
+type Trace struct {
+	mu    sync.Mutex
+	last  time.Time
+	steps []Step
+}
+
+type traceKey struct{}
+
+// Start begins a trace.
+func Start() *Trace {
+	return &Trace{last: time.Now()}
+}
+
+// NewContext returns a copy of ctx carrying t.
+func NewContext(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// FromContext returns the trace of ctx, or nil if the request is not traced.
+func FromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// Add records a step.
+func (t *Trace) Add(check, result, detail string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.steps = append(t.steps, Step{Check: check, Result: result, Detail: detail, Elapsed: now.Sub(t.last)})
+	t.last = now
+}
+
+// Steps returns the steps recorded so far.
+func (t *Trace) Steps() []Step {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Step(nil), t.steps...)
+}
+
+// Writer returns a response writer that adds the trace headers to the
+// response before its headers are sent.
+func (t *Trace) Writer(w http.ResponseWriter) http.ResponseWriter {
+	return &traceWriter{ResponseWriter: w, trace: t}
+}
+
+type traceWriter struct {
+	http.ResponseWriter
+	trace   *Trace
+	written bool
+}
+
+func (w *traceWriter) WriteHeader(code int) {
+	// Informational responses are followed by the final headers.
+	if code >= 200 {
+		w.writeTrace()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	w.writeTrace()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *traceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *traceWriter) writeTrace() {
+	if w.written {
+		return
+	}
+	w.written = true
+	header := w.Header()
+	header.Del(HeaderTrace)
+	for _, step := range w.trace.Steps() {
+		header.Add(HeaderTrace, format(step))
+	}
+}
+
+// format renders a step as check=result; detail; 12us.
+func format(step Step) string {
+	value := step.Check + "=" + step.Result
+	if step.Detail != "" {
+		value += "; " + step.Detail
+	}
+	return value + "; " + strconv.FormatInt(step.Elapsed.Microseconds(), 10) + "us"
+}
@@ -0,0 +1,189 @@
+// Package tracing explains single protection decisions. Traced requests get
+// a breakdown of every check the proxy ran for them in their response
+// headers: what was evaluated, what it found, the counters it read and how
+// long it took. Operators can troubleshoot how policies interact without
+// searching the logs.
+//
+// Tracing is enabled per request with a signed header minted through the
+// admin API, or per client IP for a while. Traced IPs are kept in Redis and
+// read by every instance at most every few seconds.
+package tracing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrTTL is returned for TTLs beyond the maximum.
+var ErrTTL = errors.New("tracing: ttl exceeds the maximum")
+
+// clientsKey holds the traced IPs of all instances and when tracing them
+// ends, as unix seconds.
+const clientsKey = "debug:clients"
+
+// clientsRefresh is how long an instance uses the traced IPs it read.
+const clientsRefresh = 5 * time.Second
+
+// Options configures tracing.
+type Options struct {
+	// Header carries signed tokens, X-Shielder-Debug by default. It is
+	// removed before requests are forwarded.
+	Header string
+	// Key signs tokens, at least 32 bytes.
+	Key []byte
+	// MaxTTL bounds how long tokens are valid and IPs are traced, an hour
+	// by default.
+	MaxTTL time.Duration
+}
+
+// Client is a client IP whose requests are traced.
+type Client struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// Tracer decides which requests are traced.
+type Tracer struct {
+	opts   Options
+	client redis.UniversalClient
+
+	mu      sync.Mutex
+	clients map[string]time.Time
+	read    time.Time
+}
+
+// New creates a tracer that keeps traced IPs in Redis.
+func New(opts Options, client redis.UniversalClient) (*Tracer, error) {
+	if len(opts.Key) < 32 {
+		return nil, errors.New("tracing: key is shorter than 32 bytes")
+	}
+	if opts.Header == "" {
+		opts.Header = "X-Shielder-Debug"
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = time.Hour
+	}
+	return &Tracer{opts: opts, client: client}, nil
+}
+
+// Header returns the header tokens are presented in.
+func (t *Tracer) Header() string {
+	return t.opts.Header
+}
+
+// Issue mints a token that enables tracing for ttl.
+func (t *Tracer) Issue(ttl time.Duration) (string, time.Time, error) {
+	if ttl > t.opts.MaxTTL {
+		return "", time.Time{}, ErrTTL
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	payload := strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + t.sign(payload), expires, nil
+}
+
+// Enabled reports whether r is to be traced, because it carries a valid
+// token or comes from a traced IP. The token header is removed either way.
+func (t *Tracer) Enabled(ctx context.Context, r *http.Request, clientIP string) bool {
+	token := r.Header.Get(t.opts.Header)
+	r.Header.Del(t.opts.Header)
+	if token != "" && t.verify(token) {
+		return true
+	}
+	until, traced := t.readClients(ctx)[clientIP]
+	return traced && time.Now().Before(until)
+}
+
+// Trace traces the requests of ip for ttl on all instances.
+func (t *Tracer) Trace(ctx context.Context, ip string, ttl time.Duration) (time.Time, error) {
+	if ttl > t.opts.MaxTTL {
+		return time.Time{}, ErrTTL
+	}
+	until := time.Now().Add(ttl).Truncate(time.Second)
+	if err := t.client.HSet(ctx, clientsKey, ip, until.Unix()).Err(); err != nil {
+		return time.Time{}, err
+	}
+	t.invalidate()
+	return until, nil
+}
+
+// Untrace stops tracing the requests of ip.
+func (t *Tracer) Untrace(ctx context.Context, ip string) error {
+	if err := t.client.HDel(ctx, clientsKey, ip).Err(); err != nil {
+		return err
+	}
+	t.invalidate()
+	return nil
+}
+
+// Clients returns the traced IPs. Expired ones are removed.
+func (t *Tracer) Clients(ctx context.Context) ([]Client, error) {
+	values, err := t.client.HGetAll(ctx, clientsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	clients := make([]Client, 0, len(values))
+	for ip, value := range values {
+		seconds, _ := strconv.ParseInt(value, 10, 64)
+		until := time.Unix(seconds, 0)
+		if !now.Before(until) {
+			t.client.HDel(ctx, clientsKey, ip)
+			continue
+		}
+		clients = append(clients, Client{IP: ip, Until: until.UTC()})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].IP < clients[j].IP })
+	return clients, nil
+}
+
+// readClients returns the traced IPs, read from Redis at most every
+// clientsRefresh. Errors keep the IPs read last.
+func (t *Tracer) readClients(ctx context.Context) map[string]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.read) < clientsRefresh {
+		return t.clients
+	}
+	t.read = time.Now()
+	clients, err := t.Clients(ctx)
+	if err != nil {
+		return t.clients
+	}
+	t.clients = make(map[string]time.Time, len(clients))
+	for _, client := range clients {
+		t.clients[client.IP] = client.Until
+	}
+	return t.clients
+}
+
+func (t *Tracer) invalidate() {
+	t.mu.Lock()
+	t.read = time.Time{}
+	t.mu.Unlock()
+}
+
+func (t *Tracer) verify(token string) bool {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.sign(payload))) {
+		return false
+	}
+	expires, err := strconv.ParseInt(payload, 10, 64)
+	return err == nil && time.Now().Unix() < expires
+}
+
+func (t *Tracer) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.opts.Key)
+	mac.Write([]byte("shielder-debug:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
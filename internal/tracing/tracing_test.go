@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTracer(t *testing.T) *Tracer {
+	mr := miniredis.RunT(t)
+	tracer, err := New(Options{Key: []byte(strings.Repeat("k", 32)), MaxTTL: time.Hour}, redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracer
+}
+
+func TestEnabledByToken(t *testing.T) {
+	ctx := context.Background()
+	tracer := newTracer(t)
+
+	token, _, err := tracer.Issue(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tracer.Issue(2 * time.Hour); err != ErrTTL {
+		t.Errorf("Expected ErrTTL, got %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"valid", token, true},
+		{"tampered", token + "x", false},
+		{"expired", "1000." + tracer.sign("1000"), false},
+		{"missing", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.token != "" {
+			r.Header.Set(tracer.Header(), tt.token)
+		}
+		if got := tracer.Enabled(ctx, r, "10.0.0.1"); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+		if r.Header.Get(tracer.Header()) != "" {
+			t.Errorf("%s: expected the token header to be removed", tt.name)
+		}
+	}
+}
+
+func TestEnabledByIP(t *testing.T) {
+	ctx := context.Background()
+	tracer := newTracer(t)
+
+	if _, err := tracer.Trace(ctx, "10.0.0.1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	if !tracer.Enabled(ctx, r, "10.0.0.1") || tracer.Enabled(ctx, r, "10.0.0.2") {
+		t.Error("Expected only the traced IP to be traced")
+	}
+	clients, err := tracer.Clients(ctx)
+	if err != nil || len(clients) != 1 || clients[0].IP != "10.0.0.1" {
+		t.Errorf("Unexpected clients %+v %v", clients, err)
+	}
+
+	if err := tracer.Untrace(ctx, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if tracer.Enabled(ctx, r, "10.0.0.1") {
+		t.Error("Expected the IP not to be traced anymore")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	trace := Start()
+	trace.Add("route", "api", "")
+	trace.Add("rate_limit", "exceeded", "key 10.0.0.1 count 11")
+
+	rec := httptest.NewRecorder()
+	w := trace.Writer(rec)
+	w.Header().Set(HeaderTrace, "forged")
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	// Steps after the headers were sent are not reported.
+	trace.Add("late", "ignored", "")
+
+	values := rec.Result().Header.Values(HeaderTrace)
+	if len(values) != 2 || !strings.HasPrefix(values[0], "route=api; ") || !strings.HasPrefix(values[1], "rate_limit=exceeded; key 10.0.0.1 count 11; ") {
+		t.Errorf("Unexpected trace headers %q", values)
+	}
+
+	// Untraced requests record nothing.
+	var none *Trace
+	none.Add("route", "api", "")
+}
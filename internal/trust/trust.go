@@ -0,0 +1,113 @@
+// Package trust recognizes load balancer health checks and synthetic
+// monitoring, which bypass rate limits and filters and are kept out of the
+// traffic baselines.
+//
+// An identity matches a request when every criterion it sets matches: the
+// client address lies in one of its CIDRs, the User-Agent contains one of its
+// user agent strings, and the header carries its token. User agents are easy
+// to forge, so an identity needs CIDRs or a token besides them.
+package trust
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Identity describes trusted monitoring traffic.
+type Identity struct {
+	Name       string
+	CIDRs      []string
+	UserAgents []string
+	// Header and Token identify requests by a shared secret. The header is
+	// removed before requests are forwarded.
+	Header string
+	Token  string
+}
+
+type identity struct {
+	name       string
+	prefixes   []netip.Prefix
+	userAgents []string
+	header     string
+	token      []byte
+}
+
+// Matcher finds the trusted identity of a request.
+type Matcher struct {
+	identities []identity
+}
+
+// New compiles the identities.
+func New(identities []Identity) (*Matcher, error) {
+	m := &Matcher{}
+	for _, id := range identities {
+		if id.Name == "" {
+			return nil, errors.New("trust: identity name is required")
+		}
+		if len(id.CIDRs) == 0 && id.Header == "" {
+			return nil, fmt.Errorf("trust: identity %q needs cidrs or a header, userAgents alone can be forged", id.Name)
+		}
+		if (id.Header == "") != (id.Token == "") {
+			return nil, fmt.Errorf("trust: identity %q needs both header and token", id.Name)
+		}
+		compiled := identity{
+			name:       id.Name,
+			userAgents: id.UserAgents,
+			header:     id.Header,
+			token:      []byte(id.Token),
+		}
+		for _, cidr := range id.CIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("trust: identity %q: %w", id.Name, err)
+			}
+			compiled.prefixes = append(compiled.prefixes, prefix.Masked())
+		}
+		m.identities = append(m.identities, compiled)
+	}
+	return m, nil
+}
+
+// Match returns the name of the identity r belongs to. The token header of
+// the matched identity is removed from r.
+func (m *Matcher) Match(r *http.Request, clientIP string) (string, bool) {
+	addr, addrErr := netip.ParseAddr(clientIP)
+	for _, id := range m.identities {
+		if len(id.prefixes) > 0 && (addrErr != nil || !containsAddr(id.prefixes, addr.Unmap())) {
+			continue
+		}
+		if len(id.userAgents) > 0 && !containsAgent(id.userAgents, r.UserAgent()) {
+			continue
+		}
+		if id.header != "" {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(id.header)), id.token) != 1 {
+				continue
+			}
+			r.Header.Del(id.header)
+		}
+		return id.name, true
+	}
+	return "", false
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAgent(agents []string, userAgent string) bool {
+	for _, agent := range agents {
+		if strings.Contains(userAgent, agent) {
+			return true
+		}
+	}
+	return false
+}
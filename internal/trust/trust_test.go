@@ -0,0 +1,67 @@
+package trust
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	m, err := New([]Identity{
+		{Name: "elb", CIDRs: []string{"10.0.0.0/8"}, UserAgents: []string{"ELB-HealthChecker/"}},
+		{Name: "synthetics", Header: "X-Monitor-Token", Token: "s3cret"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		clientIP  string
+		userAgent string
+		token     string
+		want      string
+	}{
+		{"health check", "10.1.2.3", "ELB-HealthChecker/2.0", "", "elb"},
+		{"health check over IPv6 mapped address", "::ffff:10.1.2.3", "ELB-HealthChecker/2.0", "", "elb"},
+		{"forged user agent", "192.0.2.1", "ELB-HealthChecker/2.0", "", ""},
+		{"internal client", "10.1.2.3", "curl/8.0", "", ""},
+		{"monitor token", "192.0.2.1", "", "s3cret", "synthetics"},
+		{"wrong token", "192.0.2.1", "", "guess", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/health", nil)
+			r.Header.Set("User-Agent", tt.userAgent)
+			if tt.token != "" {
+				r.Header.Set("X-Monitor-Token", tt.token)
+			}
+			got, ok := m.Match(r, tt.clientIP)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Fatalf("Expected identity %q, got %q", tt.want, got)
+			}
+			if ok && r.Header.Get("X-Monitor-Token") != "" {
+				t.Errorf("Expected token header to be removed")
+			}
+		})
+	}
+}
+
+func TestNewValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity Identity
+	}{
+		{"no name", Identity{CIDRs: []string{"10.0.0.0/8"}}},
+		{"no criteria", Identity{Name: "x"}},
+		{"user agents only", Identity{Name: "x", UserAgents: []string{"ELB-HealthChecker/"}}},
+		{"header without token", Identity{Name: "x", Header: "X-Monitor-Token"}},
+		{"invalid cidr", Identity{Name: "x", CIDRs: []string{"10.0.0.1"}}},
+	}
+	for _, tt := range tests {
+		if _, err := New([]Identity{tt.identity}); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
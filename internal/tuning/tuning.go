@@ -0,0 +1,241 @@
+// Package tuning observes how fast legitimate clients send requests on each
+// route and recommends rate limits from it, so that limits do not have to be
+// guessed when Shielder is first deployed.
+//
+// Observation runs in shadow mode next to normal operation: every minute,
+// the request count of each client on each route is added to a per-route
+// histogram in Redis, which the whole fleet shares. Client-minutes in which
+// the client was rejected with 403 or 429 are left out, so that abusive
+// clients do not inflate the recommendation. Once the observation period has
+// passed, the recommended limit of a route is a high quantile of its
+// histogram with some headroom on top.
+package tuning
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	histogramPrefix = "tuning:hist:"
+	startedKey      = "tuning:started"
+)
+
+// bounds are the upper bounds of the histogram buckets in requests per
+// minute, growing by roughly 10% per bucket.
+var bounds = func() []int64 {
+	var b []int64
+	for v := int64(1); v <= 1000000; v = max(v+1, int64(math.Ceil(float64(v)*1.1))) {
+		b = append(b, v)
+	}
+	return b
+}()
+
+// Options configures observation and recommendations.
+type Options struct {
+	// Quantile of client rates the recommendation is based on.
+	Quantile float64
+	// Headroom multiplies the quantile to leave room for growth.
+	Headroom float64
+	// MinObservation is how long traffic has to be observed before
+	// recommendations are considered ready.
+	MinObservation time.Duration
+}
+
+// Recommendation is the proposed limit for one route.
+type Recommendation struct {
+	Route             string `json:"route"`
+	RequestsPerMinute int64  `json:"requestsPerMinute"`
+	// Samples is the number of client-minutes observed on the route.
+	Samples int64 `json:"samples"`
+}
+
+// Report holds the recommendations for all observed routes.
+type Report struct {
+	ObservingSince time.Time        `json:"observingSince"`
+	Ready          bool             `json:"ready"`
+	Quantile       float64          `json:"quantile"`
+	Routes         []Recommendation `json:"routes"`
+}
+
+type clientMinute struct {
+	requests int64
+	rejected bool
+}
+
+// Tuner collects client rates and computes recommendations.
+type Tuner struct {
+	opts   Options
+	client redis.UniversalClient
+	logger *logrus.Logger
+
+	mu     sync.Mutex
+	minute map[string]map[string]*clientMinute
+}
+
+// New creates a Tuner that keeps its histograms in Redis.
+func New(opts Options, client redis.UniversalClient, logger *logrus.Logger) *Tuner {
+	if opts.Quantile <= 0 || opts.Quantile >= 1 {
+		opts.Quantile = 0.999
+	}
+	if opts.Headroom < 1 {
+		opts.Headroom = 1.5
+	}
+	if opts.MinObservation <= 0 {
+		opts.MinObservation = 7 * 24 * time.Hour
+	}
+	return &Tuner{
+		opts:   opts,
+		client: client,
+		logger: logger,
+		minute: make(map[string]map[string]*clientMinute),
+	}
+}
+
+// Observe records a request of client on route that cost cost requests and
+// was answered with status.
+func (t *Tuner) Observe(route, client string, cost int, status int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clients, ok := t.minute[route]
+	if !ok {
+		clients = make(map[string]*clientMinute)
+		t.minute[route] = clients
+	}
+	c, ok := clients[client]
+	if !ok {
+		c = &clientMinute{}
+		clients[client] = c
+	}
+	c.requests += int64(cost)
+	if status == http.StatusTooManyRequests || status == http.StatusForbidden {
+		c.rejected = true
+	}
+}
+
+// Run flushes the observed client rates to Redis every minute until ctx is
+// done.
+func (t *Tuner) Run(ctx context.Context) {
+	if err := t.client.SetNX(ctx, startedKey, time.Now().Unix(), 0).Err(); err != nil {
+		t.logger.WithError(err).Warn("Error recording start of traffic observation")
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.flush(ctx); err != nil {
+				t.logger.WithError(err).Warn("Error flushing observed client rates")
+			}
+		}
+	}
+}
+
+func (t *Tuner) flush(ctx context.Context) error {
+	t.mu.Lock()
+	minute := t.minute
+	t.minute = make(map[string]map[string]*clientMinute)
+	t.mu.Unlock()
+
+	pipe := t.client.Pipeline()
+	for route, clients := range minute {
+		for _, c := range clients {
+			if c.rejected || c.requests <= 0 {
+				continue
+			}
+			pipe.HIncrBy(ctx, histogramPrefix+route, strconv.FormatInt(bucket(c.requests), 10), 1)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Recommend computes the recommended limit of every observed route.
+func (t *Tuner) Recommend(ctx context.Context) (*Report, error) {
+	report := &Report{Quantile: t.opts.Quantile, Routes: []Recommendation{}}
+
+	started, err := t.client.Get(ctx, startedKey).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if started > 0 {
+		report.ObservingSince = time.Unix(started, 0).UTC()
+		report.Ready = time.Since(report.ObservingSince) >= t.opts.MinObservation
+	}
+
+	var keys []string
+	iter := t.client.Scan(ctx, 0, histogramPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fields, err := t.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		histogram := make(map[int64]int64, len(fields))
+		for bound, count := range fields {
+			b, err1 := strconv.ParseInt(bound, 10, 64)
+			n, err2 := strconv.ParseInt(count, 10, 64)
+			if err1 == nil && err2 == nil {
+				histogram[b] = n
+			}
+		}
+		value, samples := quantile(histogram, t.opts.Quantile)
+		report.Routes = append(report.Routes, Recommendation{
+			Route:             strings.TrimPrefix(key, histogramPrefix),
+			RequestsPerMinute: int64(math.Ceil(float64(value) * t.opts.Headroom)),
+			Samples:           samples,
+		})
+	}
+	return report, nil
+}
+
+// bucket returns the upper bound of the histogram bucket requests falls in.
+func bucket(requests int64) int64 {
+	i := sort.Search(len(bounds), func(i int) bool { return bounds[i] >= requests })
+	if i == len(bounds) {
+		return bounds[len(bounds)-1]
+	}
+	return bounds[i]
+}
+
+// quantile returns the bucket bound below which the fraction q of samples
+// falls, and the total number of samples.
+func quantile(histogram map[int64]int64, q float64) (int64, int64) {
+	bucketBounds := make([]int64, 0, len(histogram))
+	var total int64
+	for bound, count := range histogram {
+		bucketBounds = append(bucketBounds, bound)
+		total += count
+	}
+	sort.Slice(bucketBounds, func(i, j int) bool { return bucketBounds[i] < bucketBounds[j] })
+
+	target := int64(math.Ceil(q * float64(total)))
+	var seen int64
+	for _, bound := range bucketBounds {
+		seen += histogram[bound]
+		if seen >= target {
+			return bound, total
+		}
+	}
+	return 0, total
+}
@@ -0,0 +1,55 @@
+package tuning
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRecommend(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+
+	tuner := New(Options{Quantile: 0.9, Headroom: 1, MinObservation: time.Hour}, client, logrus.New())
+	mr.Set(startedKey, fmt.Sprint(time.Now().Add(-2*time.Hour).Unix()))
+
+	// 100 clients sending 1 to 100 requests per minute on /api, plus a
+	// scraper that is rejected and must not count.
+	for i := 1; i <= 100; i++ {
+		for j := 0; j < i; j++ {
+			tuner.Observe("api", fmt.Sprintf("client-%d", i), 1, http.StatusOK)
+		}
+	}
+	for j := 0; j < 5000; j++ {
+		tuner.Observe("api", "scraper", 1, http.StatusTooManyRequests)
+	}
+	if err := tuner.flush(ctx); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	report, err := tuner.Recommend(ctx)
+	if err != nil {
+		t.Fatalf("Failed to recommend: %v", err)
+	}
+	if !report.Ready {
+		t.Error("Expected report to be ready after the observation period")
+	}
+	if len(report.Routes) != 1 {
+		t.Fatalf("Expected 1 route, got %d", len(report.Routes))
+	}
+	got := report.Routes[0]
+	if got.Samples != 100 {
+		t.Errorf("Expected 100 samples, got %d", got.Samples)
+	}
+	// The 90th client sends 90 requests, which falls in a bucket within 10%.
+	if got.RequestsPerMinute < 90 || got.RequestsPerMinute > 99 {
+		t.Errorf("Expected a limit between 90 and 99, got %d", got.RequestsPerMinute)
+	}
+}
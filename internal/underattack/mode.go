@@ -0,0 +1,295 @@
+// Package underattack implements a fleet-wide heightened security mode. While
+// it is active, rate limits are tightened, clients without a clearance cookie
+// are challenged, and clients cannot force cache misses upstream.
+//
+// The mode is active when any of these holds:
+//
+//   - it is switched on in the configuration
+//   - the current time falls into a scheduled window
+//   - it was activated through the admin API, or automatically when the
+//     request or block rates of the fleet crossed their thresholds
+//
+// Activations are stored in Redis with their expiry, so that the whole fleet
+// switches together and an activation survives restarts. The automatic
+// triggers count requests in Redis too, so that they see the traffic of all
+// instances rather than the share a load balancer hands to one.
+package underattack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// activationKey holds the current activation, if any.
+const activationKey = "shielder:under-attack"
+
+// countersKey prefixes the hashes the instances add their request and block
+// counts to, one per check interval.
+const countersKey = "shielder:under-attack:counters:"
+
+// Window is a scheduled period of heightened security.
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Options configures the mode.
+type Options struct {
+	// AlwaysOn forces the mode on.
+	AlwaysOn bool
+	Schedule []Window
+	// TightenFactor scales rate limits while the mode is active.
+	TightenFactor float64
+	// Challenge challenges clients without clearance.
+	Challenge bool
+
+	// AutoRequestsPerSecond and AutoBlocksPerSecond activate the mode for
+	// AutoDuration when the fleet sees more requests, or more rejected
+	// requests, per second. Zero disables the respective trigger.
+	AutoRequestsPerSecond float64
+	AutoBlocksPerSecond   float64
+	AutoDuration          time.Duration
+
+	// CheckInterval is how often the shared state and the auto triggers are
+	// evaluated.
+	CheckInterval time.Duration
+}
+
+// Status describes whether the mode is active and why.
+type Status struct {
+	Active bool   `json:"active"`
+	Reason string `json:"reason,omitempty"`
+	// Until is when a manual or automatic activation expires, zero if it
+	// does not.
+	Until time.Time `json:"until,omitempty"`
+}
+
+type activation struct {
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until,omitempty"`
+}
+
+// Mode tracks whether heightened security is in effect.
+type Mode struct {
+	opts   Options
+	client redis.UniversalClient
+	logger *logrus.Logger
+
+	active   atomic.Bool
+	mu       sync.RWMutex
+	status   Status
+	requests atomic.Int64
+	blocked  atomic.Int64
+}
+
+// New creates the mode. Run must be called to pick up activations from Redis.
+func New(opts Options, client redis.UniversalClient, logger *logrus.Logger) *Mode {
+	if opts.TightenFactor <= 0 || opts.TightenFactor > 1 {
+		opts.TightenFactor = 1
+	}
+	if opts.AutoDuration <= 0 {
+		opts.AutoDuration = 15 * time.Minute
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = 2 * time.Second
+	}
+	m := &Mode{opts: opts, client: client, logger: logger}
+	m.set(m.local(time.Now()))
+	return m
+}
+
+// Active reports whether the mode is in effect.
+func (m *Mode) Active() bool {
+	return m.active.Load()
+}
+
+// Status returns the current state of the mode.
+func (m *Mode) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// LimitFactor returns the factor rate limits are scaled by, which is below 1
+// while the mode is active.
+func (m *Mode) LimitFactor() float64 {
+	if m.Active() {
+		return m.opts.TightenFactor
+	}
+	return 1
+}
+
+// Challenge reports whether clients without clearance have to be challenged.
+func (m *Mode) Challenge() bool {
+	return m.opts.Challenge && m.Active()
+}
+
+// Observe counts a response towards the automatic triggers.
+func (m *Mode) Observe(status int) {
+	m.requests.Add(1)
+	if status == 429 || status == 403 {
+		m.blocked.Add(1)
+	}
+}
+
+// Activate switches the mode on for the whole fleet for d, or until it is
+// deactivated if d is zero.
+func (m *Mode) Activate(ctx context.Context, reason string, d time.Duration) error {
+	a := activation{Reason: reason}
+	if d > 0 {
+		a.Until = time.Now().Add(d).UTC()
+	}
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if err := m.client.Set(ctx, activationKey, payload, d).Err(); err != nil {
+		return err
+	}
+	m.set(Status{Active: true, Reason: a.Reason, Until: a.Until})
+	return nil
+}
+
+// Deactivate removes a manual or automatic activation. Configured and
+// scheduled activations stay in effect.
+func (m *Mode) Deactivate(ctx context.Context) error {
+	if err := m.client.Del(ctx, activationKey).Err(); err != nil {
+		return err
+	}
+	m.set(m.local(time.Now()))
+	return nil
+}
+
+// Run refreshes the state from Redis and evaluates the automatic triggers
+// every check interval until ctx is done.
+func (m *Mode) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.opts.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rps, bps, err := m.fleetRates(ctx, now, m.requests.Swap(0), m.blocked.Swap(0))
+			if err != nil {
+				m.logger.WithError(err).Warn("Error counting requests for under attack mode")
+			} else {
+				m.checkTriggers(ctx, rps, bps)
+			}
+			if err := m.refresh(ctx, now); err != nil {
+				m.logger.WithError(err).Warn("Error reading under attack mode state")
+			}
+		}
+	}
+}
+
+// fleetRates adds the requests and blocks counted since the last check to
+// the counters of the current interval, and returns the rates of the whole
+// fleet in the previous interval, which every instance has added to by then.
+func (m *Mode) fleetRates(ctx context.Context, now time.Time, requests, blocked int64) (float64, float64, error) {
+	interval := m.opts.CheckInterval
+	bucket := now.UnixMilli() / interval.Milliseconds()
+	key := countersKey + strconv.FormatInt(bucket, 10)
+
+	pipe := m.client.TxPipeline()
+	pipe.HIncrBy(ctx, key, "requests", requests)
+	pipe.HIncrBy(ctx, key, "blocked", blocked)
+	pipe.Expire(ctx, key, 3*interval)
+	previous := pipe.HMGet(ctx, countersKey+strconv.FormatInt(bucket-1, 10), "requests", "blocked")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+	var rates [2]float64
+	for i, value := range previous.Val() {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid under attack counter %q: %w", s, err)
+		}
+		rates[i] = float64(n) / interval.Seconds()
+	}
+	return rates[0], rates[1], nil
+}
+
+func (m *Mode) checkTriggers(ctx context.Context, rps, bps float64) {
+	var reason string
+	switch {
+	case m.opts.AutoRequestsPerSecond > 0 && rps > m.opts.AutoRequestsPerSecond:
+		reason = "auto: request rate"
+	case m.opts.AutoBlocksPerSecond > 0 && bps > m.opts.AutoBlocksPerSecond:
+		reason = "auto: block rate"
+	default:
+		return
+	}
+	if m.Active() {
+		return
+	}
+	m.logger.WithFields(logrus.Fields{
+		"requests_per_second": rps,
+		"blocks_per_second":   bps,
+		"duration":            m.opts.AutoDuration,
+	}).Warn("Activating under attack mode")
+	if err := m.Activate(ctx, reason, m.opts.AutoDuration); err != nil {
+		m.logger.WithError(err).Error("Error activating under attack mode")
+	}
+}
+
+// refresh combines the local state with the activation stored in Redis.
+func (m *Mode) refresh(ctx context.Context, now time.Time) error {
+	status := m.local(now)
+	if !status.Active {
+		payload, err := m.client.Get(ctx, activationKey).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			var a activation
+			if err := json.Unmarshal(payload, &a); err != nil {
+				return err
+			}
+			status = Status{Active: true, Reason: a.Reason, Until: a.Until}
+		}
+	}
+	m.set(status)
+	return nil
+}
+
+// local returns the state implied by configuration and schedule alone.
+func (m *Mode) local(now time.Time) Status {
+	if m.opts.AlwaysOn {
+		return Status{Active: true, Reason: "configuration"}
+	}
+	for _, w := range m.opts.Schedule {
+		if !now.Before(w.Start) && now.Before(w.End) {
+			return Status{Active: true, Reason: "schedule", Until: w.End}
+		}
+	}
+	return Status{}
+}
+
+func (m *Mode) set(status Status) {
+	m.mu.Lock()
+	changed := m.status.Active != status.Active
+	m.status = status
+	m.mu.Unlock()
+	m.active.Store(status.Active)
+
+	if changed {
+		m.logger.WithFields(logrus.Fields{
+			"active": status.Active,
+			"reason": status.Reason,
+		}).Warn("Under attack mode changed")
+	}
+}
@@ -0,0 +1,159 @@
+package underattack
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestMode(t *testing.T, opts Options) (*Mode, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(opts, client, logger), client
+}
+
+func TestActivateIsSharedAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	first, client := newTestMode(t, Options{TightenFactor: 0.5})
+	second := New(Options{TightenFactor: 0.5}, client, first.logger)
+
+	if first.Active() || first.LimitFactor() != 1 {
+		t.Fatalf("Expected mode to start inactive")
+	}
+	if err := first.Activate(ctx, "manual", time.Minute); err != nil {
+		t.Fatalf("Failed to activate: %v", err)
+	}
+	if !first.Active() || first.LimitFactor() != 0.5 {
+		t.Errorf("Expected activating instance to be active with factor 0.5, got %v", first.LimitFactor())
+	}
+
+	if err := second.refresh(ctx, time.Now()); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	status := second.Status()
+	if !status.Active || status.Reason != "manual" || status.Until.IsZero() {
+		t.Errorf("Expected other instance to pick up activation, got %+v", status)
+	}
+
+	if err := first.Deactivate(ctx); err != nil {
+		t.Fatalf("Failed to deactivate: %v", err)
+	}
+	if err := second.refresh(ctx, time.Now()); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	if first.Active() || second.Active() {
+		t.Errorf("Expected both instances to be inactive after deactivation")
+	}
+}
+
+func TestLocalState(t *testing.T) {
+	now := time.Date(2024, 11, 29, 12, 0, 0, 0, time.UTC)
+	window := Window{Start: now.Add(-time.Hour), End: now.Add(time.Hour)}
+
+	tests := []struct {
+		name   string
+		opts   Options
+		now    time.Time
+		active bool
+		reason string
+	}{
+		{"inactive", Options{}, now, false, ""},
+		{"configured", Options{AlwaysOn: true}, now, true, "configuration"},
+		{"inside window", Options{Schedule: []Window{window}}, now, true, "schedule"},
+		{"at window start", Options{Schedule: []Window{window}}, window.Start, true, "schedule"},
+		{"at window end", Options{Schedule: []Window{window}}, window.End, false, ""},
+		{"before window", Options{Schedule: []Window{window}}, now.Add(-2 * time.Hour), false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestMode(t, tt.opts)
+			status := m.local(tt.now)
+			if status.Active != tt.active || status.Reason != tt.reason {
+				t.Errorf("Expected active=%v reason=%q, got %+v", tt.active, tt.reason, status)
+			}
+		})
+	}
+}
+
+func TestChallengeOnlyWhileActive(t *testing.T) {
+	m, _ := newTestMode(t, Options{Challenge: true})
+	if m.Challenge() {
+		t.Errorf("Expected no challenge while inactive")
+	}
+	if err := m.Activate(context.Background(), "manual", 0); err != nil {
+		t.Fatalf("Failed to activate: %v", err)
+	}
+	if !m.Challenge() {
+		t.Errorf("Expected challenge while active")
+	}
+}
+
+func TestAutoTrigger(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		rps    float64
+		bps    float64
+		reason string
+	}{
+		{"below thresholds", Options{AutoRequestsPerSecond: 100, AutoBlocksPerSecond: 10}, 50, 5, ""},
+		{"request rate", Options{AutoRequestsPerSecond: 100}, 150, 0, "auto: request rate"},
+		{"block rate", Options{AutoBlocksPerSecond: 10}, 50, 20, "auto: block rate"},
+		{"disabled", Options{}, 1e6, 1e6, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			m, client := newTestMode(t, tt.opts)
+			m.checkTriggers(ctx, tt.rps, tt.bps)
+
+			status := m.Status()
+			if status.Reason != tt.reason || status.Active != (tt.reason != "") {
+				t.Errorf("Expected reason %q, got %+v", tt.reason, status)
+			}
+			ttl := client.TTL(ctx, activationKey).Val()
+			if tt.reason != "" && (ttl <= 0 || ttl > 15*time.Minute) {
+				t.Errorf("Expected activation to expire within the auto duration, got TTL %v", ttl)
+			}
+		})
+	}
+}
+
+func TestFleetRates(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{AutoRequestsPerSecond: 100, CheckInterval: 2 * time.Second}
+	first, client := newTestMode(t, opts)
+	second := New(opts, client, first.logger)
+	now := time.Unix(1700000000, 0)
+
+	// Each instance sees less than the threshold, the fleet more.
+	for _, m := range []*Mode{first, second} {
+		if rps, _, err := m.fleetRates(ctx, now, 150, 30); err != nil || rps != 0 {
+			t.Fatalf("Expected no rate before an interval completed, got %v (%v)", rps, err)
+		}
+	}
+	rps, bps, err := first.fleetRates(ctx, now.Add(2*time.Second), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rps != 150 || bps != 30 {
+		t.Errorf("Expected the rates of both instances, got %v requests and %v blocks per second", rps, bps)
+	}
+	first.checkTriggers(ctx, rps, bps)
+	if err := second.refresh(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if status := second.Status(); !status.Active || status.Reason != "auto: request rate" {
+		t.Errorf("Expected the fleet to be under attack, got %+v", status)
+	}
+}
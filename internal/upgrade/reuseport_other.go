@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package upgrade
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// Signal triggers an upgrade. It is nil where upgrades cannot be triggered
+// by a signal.
+var Signal os.Signal
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,272 @@
+// Package upgrade replaces the running binary without dropping connections.
+//
+// On request, the running process starts the new binary, which either
+// inherits the listening sockets (handoff) or binds the same addresses next
+// to the old process with SO_REUSEPORT (reusePort). Once the new process
+// reports that it is serving, the old one stops accepting and drains the
+// connections it already has.
+//
+// Handoff is the safer mode: with reusePort, connections that the kernel
+// already queued on the old process's socket are reset when it closes.
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Upgrade modes.
+const (
+	ModeHandoff   = "handoff"
+	ModeReusePort = "reusePort"
+)
+
+// Environment variables used to pass state to the new process. Inherited
+// sockets are passed as file descriptors 3 and up, in the order of
+// envListeners, followed by the readiness pipe.
+const (
+	envListeners = "SHIELDER_UPGRADE_LISTENERS"
+	envReady     = "SHIELDER_UPGRADE_READY"
+)
+
+// ErrUpgradeInProgress is returned by Upgrade while another upgrade runs.
+var ErrUpgradeInProgress = errors.New("upgrade already in progress")
+
+// Options configures the upgrader.
+type Options struct {
+	// Mode is ModeHandoff or ModeReusePort, empty means ModeHandoff.
+	Mode string
+	// ReadyTimeout is how long the new process has to become ready before
+	// it is killed and the old one keeps serving.
+	ReadyTimeout time.Duration
+}
+
+// Upgrader hands the listeners of this process over to its successor.
+type Upgrader struct {
+	opts   Options
+	logger *logrus.Logger
+
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	names     []string
+	listeners map[string]net.Listener
+	ready     *os.File
+	upgrading bool
+}
+
+// New creates an upgrader and picks up the sockets passed by a parent
+// process, if this process was started by an upgrade.
+func New(opts Options, logger *logrus.Logger) (*Upgrader, error) {
+	switch opts.Mode {
+	case "":
+		opts.Mode = ModeHandoff
+	case ModeHandoff:
+	case ModeReusePort:
+		if !reusePortSupported {
+			return nil, fmt.Errorf("upgrade mode %s is not supported on this platform", ModeReusePort)
+		}
+	default:
+		return nil, fmt.Errorf("unknown upgrade mode %q", opts.Mode)
+	}
+	if opts.ReadyTimeout <= 0 {
+		opts.ReadyTimeout = 30 * time.Second
+	}
+
+	u := &Upgrader{
+		opts:      opts,
+		logger:    logger,
+		inherited: make(map[string]*os.File),
+		listeners: make(map[string]net.Listener),
+	}
+	if names := os.Getenv(envListeners); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			u.inherited[name] = os.NewFile(uintptr(3+i), name)
+		}
+	}
+	if fd := os.Getenv(envReady); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envReady, err)
+		}
+		u.ready = os.NewFile(uintptr(n), "upgrade-ready")
+	}
+	// Keep the state away from processes this one starts.
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReady)
+	return u, nil
+}
+
+// Upgraded reports whether this process was started by an upgrade.
+func (u *Upgrader) Upgraded() bool {
+	return u.ready != nil
+}
+
+// Listen returns the TCP listener for name, which is inherited from the
+// parent process if it passed one, and bound to addr otherwise.
+func (u *Upgrader) Listen(name, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var l net.Listener
+	if f, ok := u.inherited[name]; ok {
+		delete(u.inherited, name)
+		var err error
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting listener %s: %w", name, err)
+		}
+	} else {
+		lc := net.ListenConfig{}
+		if u.opts.Mode == ModeReusePort {
+			lc.Control = reusePort
+		}
+		var err error
+		l, err = lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := u.listeners[name]; !ok {
+		u.names = append(u.names, name)
+	}
+	u.listeners[name] = l
+	return l, nil
+}
+
+// Ready tells the parent process that this one is serving, so that the
+// parent can drain. It does nothing if there is no parent.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// Sockets the parent passed but this process did not ask for.
+	for name, f := range u.inherited {
+		f.Close()
+		delete(u.inherited, name)
+	}
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+	return err
+}
+
+// Upgrade starts the current executable with the same arguments and waits
+// until it is ready. On success the caller should stop accepting and drain;
+// on failure the new process has been stopped and this one keeps serving.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return ErrUpgradeInProgress
+	}
+	u.upgrading = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files, names, err := u.files()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(names, ","),
+		envReady+"="+strconv.Itoa(3+len(files)),
+	)
+	cmd.ExtraFiles = append(files, readyW)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("starting new process: %w", err)
+	}
+	u.logger.WithField("pid", cmd.Process.Pid).Info("Started new process, waiting for it to become ready")
+
+	// The read fails with EOF if the new process exits before it is ready.
+	readyErr := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		readyErr <- err
+	}()
+	timer := time.NewTimer(u.opts.ReadyTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-readyErr:
+		if err != nil {
+			cmd.Wait()
+			return fmt.Errorf("new process exited before it was ready: %w", err)
+		}
+		// Reap the new process if it exits while this one drains.
+		go cmd.Wait()
+		return nil
+	case <-timer.C:
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process was not ready within %s", u.opts.ReadyTimeout)
+	}
+}
+
+// files duplicates the listening sockets to pass them to the new process.
+// In reusePort mode the new process binds its own sockets instead.
+func (u *Upgrader) files() ([]*os.File, []string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.opts.Mode == ModeReusePort {
+		return nil, nil, nil
+	}
+	var files []*os.File
+	var names []string
+	for _, name := range u.names {
+		l, ok := u.listeners[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := l.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("duplicating listener %s: %w", name, err)
+		}
+		files = append(files, f)
+		names = append(names, name)
+	}
+	return files, names, nil
+}
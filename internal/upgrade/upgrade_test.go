@@ -0,0 +1,130 @@
+package upgrade
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestMain runs the test binary as the new process when it is started by
+// an upgrade in TestUpgrade.
+func TestMain(m *testing.M) {
+	if os.Getenv(envReady) != "" {
+		os.Exit(runChild())
+	}
+	os.Exit(m.Run())
+}
+
+// runChild takes over the "proxy" listener, reports ready and answers one
+// connection.
+func runChild() int {
+	if os.Getenv("UPGRADE_TEST_HANG") != "" {
+		time.Sleep(time.Minute)
+	}
+	u, err := New(Options{}, quietLogger())
+	if err != nil {
+		return 1
+	}
+	l, err := u.Listen("proxy", "127.0.0.1:0")
+	if err != nil {
+		return 1
+	}
+	if err := u.Ready(); err != nil {
+		return 1
+	}
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		return 1
+	}
+	io.WriteString(conn, "new\n")
+	conn.Close()
+	return 0
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestUpgrade(t *testing.T) {
+	u, err := New(Options{ReadyTimeout: 10 * time.Second}, quietLogger())
+	if err != nil {
+		t.Fatalf("Failed to create upgrader: %v", err)
+	}
+	l, err := u.Listen("proxy", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+
+	if err := u.Upgrade(); err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	// The old process drains and closes its listener, the socket stays open
+	// in the new process.
+	l.Close()
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected the new process to accept on %s, got %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "new\n" {
+		t.Errorf("Expected the new process to answer, got %q (%v)", line, err)
+	}
+}
+
+func TestUpgradeTimeout(t *testing.T) {
+	u, err := New(Options{ReadyTimeout: 200 * time.Millisecond}, quietLogger())
+	if err != nil {
+		t.Fatalf("Failed to create upgrader: %v", err)
+	}
+	if _, err := u.Listen("proxy", "127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Setenv("UPGRADE_TEST_HANG", "1")
+
+	if err := u.Upgrade(); err == nil {
+		t.Error("Expected the upgrade to fail when the new process never becomes ready")
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	u, err := New(Options{Mode: ModeReusePort}, quietLogger())
+	if err != nil {
+		t.Fatalf("Failed to create upgrader: %v", err)
+	}
+	first, err := u.Listen("proxy", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer first.Close()
+
+	next, err := New(Options{Mode: ModeReusePort}, quietLogger())
+	if err != nil {
+		t.Fatalf("Failed to create upgrader: %v", err)
+	}
+	second, err := next.Listen("proxy", first.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected a second process to bind %s, got %v", first.Addr(), err)
+	}
+	second.Close()
+}
+
+func TestNewRejectsUnknownMode(t *testing.T) {
+	if _, err := New(Options{Mode: "fork"}, quietLogger()); err == nil {
+		t.Error("Expected an error for an unknown upgrade mode")
+	}
+}
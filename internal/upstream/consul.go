@@ -0,0 +1,136 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConsulOptions configures Consul catalog discovery.
+type ConsulOptions struct {
+	// Address of the Consul agent, http://127.0.0.1:8500 by default.
+	Address    string
+	Token      string
+	Datacenter string
+	// Service is the name of the upstream service, Tag optionally narrows
+	// its instances.
+	Service string
+	Tag     string
+	// Scheme of the target URLs, http by default.
+	Scheme string
+	// Wait bounds a blocking query, 5 minutes by default.
+	Wait   time.Duration
+	Client *http.Client
+}
+
+// ConsulDiscovery keeps the targets of a pool in sync with the passing
+// instances of a Consul service. It holds a blocking query open, so changes
+// reach the pool as soon as Consul knows about them.
+type ConsulDiscovery struct {
+	opts   ConsulOptions
+	pool   *Pool
+	logger *logrus.Logger
+	index  uint64
+}
+
+// consulEntry is the part of a /v1/health/service entry that is used.
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// NewConsulDiscovery creates a discovery for pool. Call Run to start
+// watching.
+func NewConsulDiscovery(opts ConsulOptions, pool *Pool, logger *logrus.Logger) *ConsulDiscovery {
+	if opts.Address == "" {
+		opts.Address = "http://127.0.0.1:8500"
+	}
+	if opts.Scheme == "" {
+		opts.Scheme = "http"
+	}
+	if opts.Wait <= 0 {
+		opts.Wait = 5 * time.Minute
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{}
+	}
+	return &ConsulDiscovery{opts: opts, pool: pool, logger: logger}
+}
+
+// Refresh fetches the instances once without blocking.
+func (d *ConsulDiscovery) Refresh(ctx context.Context) error {
+	d.index = 0
+	return d.query(ctx)
+}
+
+// Run watches the service until ctx is done, retrying with a backoff while
+// Consul is unavailable.
+func (d *ConsulDiscovery) Run(ctx context.Context) {
+	watch(ctx, d.logger, "consul", d.opts.Service, d.query)
+}
+
+// query runs a blocking query for changes after the last seen index.
+func (d *ConsulDiscovery) query(ctx context.Context) error {
+	params := url.Values{"passing": {"true"}}
+	if d.opts.Tag != "" {
+		params.Set("tag", d.opts.Tag)
+	}
+	if d.opts.Datacenter != "" {
+		params.Set("dc", d.opts.Datacenter)
+	}
+	if d.index > 0 {
+		params.Set("index", strconv.FormatUint(d.index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(d.opts.Wait.Seconds())))
+	}
+	endpoint := strings.TrimSuffix(d.opts.Address, "/") + "/v1/health/service/" + url.PathEscape(d.opts.Service) + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if d.opts.Token != "" {
+		req.Header.Set("X-Consul-Token", d.opts.Token)
+	}
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul: unexpected status %d", resp.StatusCode)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return fmt.Errorf("consul: %w", err)
+	}
+
+	// Indexes going backwards mean Consul was restored or restarted, the
+	// next query starts over.
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if index < d.index {
+		index = 0
+	}
+	d.index = index
+
+	hosts := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		hosts = append(hosts, net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)))
+	}
+	return updateTargets(d.pool, d.logger, d.opts.Service, d.opts.Scheme, hosts)
+}
@@ -0,0 +1,85 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Discovery keeps the targets of a pool in sync with a service registry.
+type Discovery interface {
+	// Refresh updates the targets once.
+	Refresh(ctx context.Context) error
+	// Run keeps updating the targets until ctx is done.
+	Run(ctx context.Context)
+}
+
+// watch calls query until ctx is done, backing off from one second to 30
+// seconds while it fails. Queries are expected to block until something
+// changed.
+func watch(ctx context.Context, logger *logrus.Logger, registry, name string, query func(context.Context) error) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := query(ctx)
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.WithError(err).WithFields(logrus.Fields{"registry": registry, "name": name}).Warn("Upstream discovery failed, keeping the current targets")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// updateTargets sets the targets of pool to hosts. Empty host lists leave the
+// pool alone, like failed resolutions.
+func updateTargets(pool *Pool, logger *logrus.Logger, name, scheme string, hosts []string) error {
+	if len(hosts) == 0 {
+		return fmt.Errorf("upstream: no targets found for %s", name)
+	}
+	sort.Strings(hosts)
+	targets := make([]*url.URL, 0, len(hosts))
+	for i, host := range hosts {
+		if i > 0 && host == hosts[i-1] {
+			continue
+		}
+		targets = append(targets, &url.URL{Scheme: scheme, Host: host})
+	}
+	if setTargets(pool, targets) {
+		logger.WithFields(logrus.Fields{"name": name, "targets": len(targets)}).Info("Upstream targets changed")
+	}
+	return nil
+}
+
+// setTargets replaces the targets of pool and reports whether they changed.
+func setTargets(pool *Pool, targets []*url.URL) bool {
+	current := pool.Targets()
+	changed := len(current) != len(targets)
+	if !changed {
+		known := make(map[string]bool, len(current))
+		for _, target := range current {
+			known[target.Address] = true
+		}
+		for _, target := range targets {
+			if !known[target.String()] {
+				changed = true
+				break
+			}
+		}
+	}
+	if changed {
+		pool.SetTargets(targets)
+	}
+	return changed
+}
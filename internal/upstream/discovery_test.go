@@ -0,0 +1,133 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConsulDiscovery(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	instances := `[{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"","Port":8080}},` +
+		`{"Node":{"Address":"10.0.0.9"},"Service":{"Address":"10.0.1.2","Port":8080}}]`
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		if r.URL.Path != "/v1/health/service/api" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "42")
+		fmt.Fprint(w, instances)
+	}))
+	defer server.Close()
+
+	pool := NewPool(Options{}, nil)
+	d := NewConsulDiscovery(ConsulOptions{Address: server.URL, Token: "secret", Service: "api", Tag: "v2"}, pool, logger)
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	targets := pool.Targets()
+	if len(targets) != 2 || targets[0].Address != "http://10.0.0.1:8080" || targets[1].Address != "http://10.0.1.2:8080" {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+
+	// The next query blocks on the last index.
+	instances = `[{"Node":{"Address":"10.0.0.1"},"Service":{"Port":8080}}]`
+	if err := d.query(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Targets()) != 1 {
+		t.Errorf("Unexpected targets %+v", pool.Targets())
+	}
+	if len(queries) != 2 || queries[1] != "index=42&passing=true&tag=v2&wait=300s" {
+		t.Errorf("Unexpected queries %q", queries)
+	}
+}
+
+func TestKubernetesDiscovery(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	endpoints := func(version string, ips ...string) string {
+		addresses := ""
+		for i, ip := range ips {
+			if i > 0 {
+				addresses += ","
+			}
+			addresses += `{"ip":"` + ip + `"}`
+		}
+		return `{"metadata":{"resourceVersion":"` + version + `"},"subsets":[{"addresses":[` + addresses + `],` +
+			`"ports":[{"name":"metrics","port":9090},{"name":"http","port":8080}]}]}`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v1/namespaces/shop/endpoints/api":
+			fmt.Fprint(w, endpoints("10", "10.0.0.1", "10.0.0.2"))
+		case r.URL.Path == "/api/v1/namespaces/shop/endpoints" && r.URL.Query().Get("watch") == "true":
+			if r.URL.Query().Get("resourceVersion") != "10" {
+				fmt.Fprint(w, `{"type":"ERROR","object":{"kind":"Status","code":410}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"type":"MODIFIED","object":%s}`+"\n", endpoints("11", "10.0.0.2"))
+			fmt.Fprint(w, `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}`+"\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	pool := NewPool(Options{}, nil)
+	d, err := NewKubernetesDiscovery(KubernetesOptions{
+		APIServer: server.URL,
+		Namespace: "shop",
+		Service:   "api",
+		PortName:  "http",
+		TokenFile: t.TempDir() + "/token",
+	}, pool, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	targets := pool.Targets()
+	if len(targets) != 2 || targets[0].Address != "http://10.0.0.1:8080" {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+
+	if err := d.watchOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	targets = pool.Targets()
+	if len(targets) != 1 || targets[0].Address != "http://10.0.0.2:8080" {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+	if d.resourceVersion != "12" {
+		t.Errorf("Expected the bookmark version, got %q", d.resourceVersion)
+	}
+
+	// Expired versions are listed again.
+	if err := d.watchOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d.resourceVersion != "" {
+		t.Errorf("Expected the version to be reset, got %q", d.resourceVersion)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.watchOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Targets()) != 1 || d.resourceVersion != "12" {
+		t.Errorf("Unexpected state after relisting %+v %q", pool.Targets(), d.resourceVersion)
+	}
+}
@@ -0,0 +1,125 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Discovery record types.
+const (
+	// DNSSRV resolves SRV records, which name the host and port of every
+	// target, such as _http._tcp.api.default.svc.cluster.local.
+	DNSSRV = "srv"
+	// DNSA resolves A and AAAA records, such as those of a headless
+	// Kubernetes service, and uses the configured port.
+	DNSA = "a"
+)
+
+// DNSOptions configures DNS discovery.
+type DNSOptions struct {
+	// Type is DNSSRV or DNSA.
+	Type string
+	Name string
+	// Port is the target port of DNSA records.
+	Port int
+	// Scheme of the target URLs, http by default.
+	Scheme string
+	// Interval between resolutions, 30 seconds by default.
+	Interval time.Duration
+	// Resolver, when set, replaces the default resolver.
+	Resolver *net.Resolver
+}
+
+// DNSDiscovery keeps the targets of a pool in sync with DNS records.
+type DNSDiscovery struct {
+	opts   DNSOptions
+	pool   *Pool
+	logger *logrus.Logger
+
+	lookupSRV func(ctx context.Context, name string) ([]*net.SRV, error)
+	lookupIP  func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewDNSDiscovery creates a discovery for pool. Call Run to start resolving.
+func NewDNSDiscovery(opts DNSOptions, pool *Pool, logger *logrus.Logger) *DNSDiscovery {
+	if opts.Scheme == "" {
+		opts.Scheme = "http"
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 30 * time.Second
+	}
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &DNSDiscovery{
+		opts:   opts,
+		pool:   pool,
+		logger: logger,
+		lookupSRV: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, records, err := resolver.LookupSRV(ctx, "", "", name)
+			return records, err
+		},
+		lookupIP: resolver.LookupIPAddr,
+	}
+}
+
+// Run refreshes the targets on every interval until ctx is done. Call
+// Refresh first to have targets before the first interval passed.
+func (d *DNSDiscovery) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := d.Refresh(ctx); err != nil && ctx.Err() == nil {
+			d.logger.WithError(err).WithField("name", d.opts.Name).Warn("Upstream discovery failed, keeping the current targets")
+		}
+	}
+}
+
+// Refresh resolves the targets once and updates the pool. Failed and empty
+// resolutions leave the pool alone, so that a DNS outage does not take the
+// upstream away.
+func (d *DNSDiscovery) Refresh(ctx context.Context) error {
+	hosts, err := d.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	return updateTargets(d.pool, d.logger, d.opts.Name, d.opts.Scheme, hosts)
+}
+
+// resolve returns the host:port of every target.
+func (d *DNSDiscovery) resolve(ctx context.Context) ([]string, error) {
+	var hosts []string
+	switch d.opts.Type {
+	case DNSSRV:
+		records, err := d.lookupSRV(ctx, d.opts.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+	case DNSA:
+		addrs, err := d.lookupIP(ctx, d.opts.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			hosts = append(hosts, net.JoinHostPort(addr.String(), strconv.Itoa(d.opts.Port)))
+		}
+	default:
+		return nil, errors.New("upstream: dns type must be srv or a")
+	}
+	return hosts, nil
+}
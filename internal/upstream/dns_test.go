@@ -0,0 +1,66 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDNSDiscovery(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	t.Run("srv", func(t *testing.T) {
+		pool := NewPool(Options{}, nil)
+		d := NewDNSDiscovery(DNSOptions{Type: DNSSRV, Name: "_http._tcp.api.local"}, pool, logger)
+		d.lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+			return []*net.SRV{
+				{Target: "api-1.api.local.", Port: 8080},
+				{Target: "api-0.api.local.", Port: 8080},
+			}, nil
+		}
+		if err := d.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		targets := pool.Targets()
+		if len(targets) != 2 || targets[0].Address != "http://api-0.api.local:8080" {
+			t.Errorf("Unexpected targets %+v", targets)
+		}
+
+		// Failed resolutions keep the targets.
+		d.lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+			return nil, errors.New("timeout")
+		}
+		if err := d.Refresh(context.Background()); err == nil {
+			t.Error("Expected an error")
+		}
+		if len(pool.Targets()) != 2 {
+			t.Error("Expected the targets to be kept")
+		}
+	})
+
+	t.Run("a", func(t *testing.T) {
+		pool := NewPool(Options{}, nil)
+		d := NewDNSDiscovery(DNSOptions{Type: DNSA, Name: "api-headless.local", Port: 3000, Scheme: "https"}, pool, logger)
+		d.lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}}, nil
+		}
+		if err := d.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		targets := pool.Targets()
+		if len(targets) != 2 || targets[0].Address != "https://10.0.0.1:3000" || targets[1].Address != "https://10.0.0.2:3000" {
+			t.Errorf("Unexpected targets %+v", targets)
+		}
+
+		// Empty answers keep the targets as well.
+		d.lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, error) { return nil, nil }
+		if err := d.Refresh(context.Background()); err == nil || len(pool.Targets()) != 2 {
+			t.Error("Expected an empty answer to keep the targets")
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Results of health checks.
+const (
+	CheckPassed = "passed"
+	CheckFailed = "failed"
+)
+
+// HealthRecorder receives health check results and target health.
+type HealthRecorder interface {
+	IncUpstreamHealthCheck(target, result string)
+	SetUpstreamHealthy(target string, healthy bool)
+	// DeleteUpstreamTarget forgets a target that left the pool.
+	DeleteUpstreamTarget(target string)
+}
+
+// HealthOptions configures active health checks.
+type HealthOptions struct {
+	// Path is requested with GET on every target, a 2xx status passes.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// HealthyThreshold consecutive passes bring an unhealthy target back,
+	// UnhealthyThreshold consecutive failures eject a healthy one.
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	Client             *http.Client
+	Recorder           HealthRecorder
+}
+
+// HealthChecker checks the targets of a pool and ejects those failing.
+type HealthChecker struct {
+	opts   HealthOptions
+	pool   *Pool
+	logger *logrus.Logger
+
+	// streaks counts consecutive results, positive for passes and negative
+	// for failures. Owned by Run.
+	streaks map[string]int
+}
+
+// NewHealthChecker creates a checker for pool. Call Run to start checking.
+func NewHealthChecker(opts HealthOptions, pool *Pool, logger *logrus.Logger) *HealthChecker {
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	if opts.HealthyThreshold <= 0 {
+		opts.HealthyThreshold = 2
+	}
+	if opts.UnhealthyThreshold <= 0 {
+		opts.UnhealthyThreshold = 3
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{}
+	}
+	return &HealthChecker{opts: opts, pool: pool, logger: logger, streaks: make(map[string]int)}
+}
+
+// Run checks every target on every interval until ctx is done.
+func (c *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		c.CheckAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks every target once, concurrently, and updates their health.
+func (c *HealthChecker) CheckAll(ctx context.Context) {
+	targets := c.pool.Targets()
+	passed := make([]bool, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			passed[i] = c.check(ctx, target)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	current := make(map[string]bool, len(targets))
+	for i, target := range targets {
+		current[target.Address] = true
+		c.record(target, passed[i])
+	}
+	for address := range c.streaks {
+		if !current[address] {
+			delete(c.streaks, address)
+			if c.opts.Recorder != nil {
+				c.opts.Recorder.DeleteUpstreamTarget(address)
+			}
+		}
+	}
+}
+
+func (c *HealthChecker) check(ctx context.Context, target Target) bool {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL.JoinPath(c.opts.Path).String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode/100 == 2
+}
+
+// record updates the streak of target and flips its health once a threshold
+// is reached.
+func (c *HealthChecker) record(target Target, passed bool) {
+	streak := c.streaks[target.Address]
+	result := CheckFailed
+	if passed {
+		result = CheckPassed
+		streak = max(streak, 0) + 1
+	} else {
+		streak = min(streak, 0) - 1
+	}
+	c.streaks[target.Address] = streak
+
+	healthy := target.Healthy
+	switch {
+	case !healthy && streak >= c.opts.HealthyThreshold:
+		healthy = true
+	case healthy && -streak >= c.opts.UnhealthyThreshold:
+		healthy = false
+	}
+	if healthy != target.Healthy && c.pool.SetHealthy(target.Address, healthy) {
+		entry := c.logger.WithField("target", target.Address)
+		if healthy {
+			entry.Info("Upstream target recovered")
+		} else {
+			entry.Warn("Upstream target ejected after failing health checks")
+		}
+	}
+	if c.opts.Recorder != nil {
+		c.opts.Recorder.IncUpstreamHealthCheck(target.Address, result)
+		c.opts.Recorder.SetUpstreamHealthy(target.Address, healthy)
+	}
+}
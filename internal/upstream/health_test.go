@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("Expected /healthz, got %s", r.URL.Path)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer backend.Close()
+	target := mustParse(t, backend.URL)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	pool := NewPool(Options{}, []*url.URL{target})
+	c := NewHealthChecker(HealthOptions{Path: "/healthz", HealthyThreshold: 2, UnhealthyThreshold: 2}, pool, logger)
+	healthy := func() bool { return pool.Targets()[0].Healthy }
+
+	status.Store(http.StatusServiceUnavailable)
+	c.CheckAll(context.Background())
+	if !healthy() {
+		t.Fatal("Expected a single failure to keep the target")
+	}
+	c.CheckAll(context.Background())
+	if healthy() {
+		t.Fatal("Expected the target to be ejected after two failures")
+	}
+
+	status.Store(http.StatusOK)
+	c.CheckAll(context.Background())
+	if healthy() {
+		t.Fatal("Expected a single pass to keep the target out")
+	}
+	c.CheckAll(context.Background())
+	if !healthy() {
+		t.Fatal("Expected the target to recover after two passes")
+	}
+
+	// Targets that left the pool are forgotten.
+	pool.SetTargets(nil)
+	c.CheckAll(context.Background())
+	if len(c.streaks) != 0 {
+		t.Errorf("Expected no streaks, got %v", c.streaks)
+	}
+}
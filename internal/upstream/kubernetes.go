@@ -0,0 +1,236 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Paths of the service account mounted into pods.
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	serviceAccountCA  = serviceAccountDir + "ca.crt"
+)
+
+// KubernetesOptions configures discovery from the Endpoints of a Kubernetes
+// service. Inside a cluster, the API server, namespace and credentials are
+// taken from the environment and the service account of the pod.
+type KubernetesOptions struct {
+	APIServer string
+	Namespace string
+	Service   string
+	// PortName picks the endpoint port, the first port by default.
+	PortName string
+	// Scheme of the target URLs, http by default.
+	Scheme    string
+	TokenFile string
+	CAFile    string
+	Client    *http.Client
+}
+
+// KubernetesDiscovery keeps the targets of a pool in sync with the ready
+// addresses of a service. It watches the Endpoints object, so pods that stop
+// being ready, such as terminating ones, leave the pool right away.
+type KubernetesDiscovery struct {
+	opts   KubernetesOptions
+	pool   *Pool
+	logger *logrus.Logger
+
+	// resourceVersion of the last seen Endpoints, owned by Run.
+	resourceVersion string
+}
+
+type kubernetesEndpoints struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+type kubernetesEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// NewKubernetesDiscovery creates a discovery for pool. Call Run to start
+// watching.
+func NewKubernetesDiscovery(opts KubernetesOptions, pool *Pool, logger *logrus.Logger) (*KubernetesDiscovery, error) {
+	if opts.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("kubernetes: api server is not set and not running in a cluster")
+		}
+		opts.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if opts.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountDir + "namespace")
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: namespace is not set: %w", err)
+		}
+		opts.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if opts.Scheme == "" {
+		opts.Scheme = "http"
+	}
+	if opts.TokenFile == "" {
+		opts.TokenFile = serviceAccountDir + "token"
+	}
+	if opts.CAFile == "" {
+		if _, err := os.Stat(serviceAccountCA); err == nil {
+			opts.CAFile = serviceAccountCA
+		}
+	}
+	if opts.Client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.CAFile != "" {
+			pem, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("kubernetes: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("kubernetes: no certificates in the CA file")
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		}
+		// No timeout, watches are long-lived.
+		opts.Client = &http.Client{Transport: transport}
+	}
+	return &KubernetesDiscovery{opts: opts, pool: pool, logger: logger}, nil
+}
+
+// Refresh lists the Endpoints of the service once.
+func (d *KubernetesDiscovery) Refresh(ctx context.Context) error {
+	resp, err := d.get(ctx, "/api/v1/namespaces/"+url.PathEscape(d.opts.Namespace)+"/endpoints/"+url.PathEscape(d.opts.Service))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var endpoints kubernetesEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	d.resourceVersion = endpoints.Metadata.ResourceVersion
+	return d.apply(endpoints)
+}
+
+// Run watches the Endpoints of the service until ctx is done, retrying with a
+// backoff while the API server is unavailable.
+func (d *KubernetesDiscovery) Run(ctx context.Context) {
+	watch(ctx, d.logger, "kubernetes", d.opts.Service, d.watchOnce)
+}
+
+// watchOnce streams changes after the last seen resource version until the
+// API server ends the watch.
+func (d *KubernetesDiscovery) watchOnce(ctx context.Context) error {
+	if d.resourceVersion == "" {
+		if err := d.Refresh(ctx); err != nil {
+			return err
+		}
+	}
+	params := url.Values{
+		"watch":               {"true"},
+		"fieldSelector":       {"metadata.name=" + d.opts.Service},
+		"resourceVersion":     {d.resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {"300"},
+	}
+	resp, err := d.get(ctx, "/api/v1/namespaces/"+url.PathEscape(d.opts.Namespace)+"/endpoints?"+params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event kubernetesEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("kubernetes: %w", err)
+		}
+		switch event.Type {
+		case "ERROR":
+			// Mostly 410 Gone for resource versions that are too old: list
+			// again and watch from there.
+			d.resourceVersion = ""
+			return nil
+		case "DELETED":
+			d.logger.WithField("service", d.opts.Service).Warn("Upstream endpoints deleted, keeping the current targets")
+			continue
+		}
+		var endpoints kubernetesEndpoints
+		if err := json.Unmarshal(event.Object, &endpoints); err != nil {
+			return fmt.Errorf("kubernetes: %w", err)
+		}
+		d.resourceVersion = endpoints.Metadata.ResourceVersion
+		if event.Type == "BOOKMARK" {
+			continue
+		}
+		if err := d.apply(endpoints); err != nil {
+			d.logger.WithError(err).Warn("Upstream discovery found no ready endpoints, keeping the current targets")
+		}
+	}
+}
+
+func (d *KubernetesDiscovery) apply(endpoints kubernetesEndpoints) error {
+	var hosts []string
+	for _, subset := range endpoints.Subsets {
+		port := 0
+		for _, p := range subset.Ports {
+			if d.opts.PortName == "" || p.Name == d.opts.PortName {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, address := range subset.Addresses {
+			hosts = append(hosts, net.JoinHostPort(address.IP, strconv.Itoa(port)))
+		}
+	}
+	return updateTargets(d.pool, d.logger, d.opts.Service, d.opts.Scheme, hosts)
+}
+
+func (d *KubernetesDiscovery) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(d.opts.APIServer, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Projected service account tokens are rotated, so the file is read
+	// for every request.
+	if token, err := os.ReadFile(d.opts.TokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes: unexpected status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
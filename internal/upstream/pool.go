@@ -0,0 +1,163 @@
+// Package upstream balances requests over the targets of the upstream
+// service. Targets that were just added, or that just recovered, start with
+// a small share of the traffic that grows over the slow start window, so
+// that a backend with cold caches and connection pools is not knocked over
+// by full load the moment it comes back.
+package upstream
+
+import (
+	"math/rand/v2"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// minWeight is the traffic share a target starts slow start with, relative
+// to a target at full weight.
+const minWeight = 0.1
+
+// Options configures a Pool.
+type Options struct {
+	// SlowStart is how long the traffic share of a new or recovered target
+	// takes to grow to full. Zero sends full load right away.
+	SlowStart time.Duration
+}
+
+// Target is the state of a target.
+type Target struct {
+	URL     *url.URL  `json:"-"`
+	Address string    `json:"url"`
+	Healthy bool      `json:"healthy"`
+	Since   time.Time `json:"since"`
+	// Weight is the current traffic share relative to a target at full
+	// weight, below 1 during slow start and 0 while unhealthy.
+	Weight float64 `json:"weight"`
+}
+
+type member struct {
+	url     *url.URL
+	healthy bool
+	// since is when the target was added or last became healthy
+	since time.Time
+}
+
+// Pool picks the target of every request, weighted by slow start.
+type Pool struct {
+	opts Options
+	now  func() time.Time
+
+	mu      sync.RWMutex
+	members []*member
+}
+
+// NewPool creates a pool of healthy targets at full weight.
+func NewPool(opts Options, targets []*url.URL) *Pool {
+	p := &Pool{opts: opts, now: time.Now}
+	for _, u := range targets {
+		p.members = append(p.members, &member{url: u, healthy: true})
+	}
+	return p
+}
+
+// Pick returns the target for the next request, nil if the pool is empty.
+// When no target is healthy, all of them are used, as a possibly dead target
+// beats none at all.
+func (p *Pool) Pick() *url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	switch len(p.members) {
+	case 0:
+		return nil
+	case 1:
+		return p.members[0].url
+	}
+
+	now := p.now()
+	weights := make([]float64, len(p.members))
+	var total float64
+	for i, m := range p.members {
+		weights[i] = p.weight(m, now)
+		total += weights[i]
+	}
+	if total == 0 {
+		return p.members[rand.IntN(len(p.members))].url
+	}
+	n := rand.Float64() * total
+	for i, w := range weights {
+		if n < w {
+			return p.members[i].url
+		}
+		n -= w
+	}
+	return p.members[len(p.members)-1].url
+}
+
+// SetTargets replaces the targets of the pool. Targets already in the pool
+// keep their state, new ones start slow start.
+func (p *Pool) SetTargets(targets []*url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing := make(map[string]*member, len(p.members))
+	for _, m := range p.members {
+		existing[m.url.String()] = m
+	}
+	members := make([]*member, 0, len(targets))
+	for _, u := range targets {
+		if m, ok := existing[u.String()]; ok {
+			members = append(members, m)
+			continue
+		}
+		members = append(members, &member{url: u, healthy: true, since: p.now()})
+	}
+	p.members = members
+}
+
+// SetHealthy records the health of the target with the given URL. A target
+// turning healthy starts slow start. It reports whether the health changed.
+func (p *Pool) SetHealthy(target string, healthy bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.members {
+		if m.url.String() != target || m.healthy == healthy {
+			continue
+		}
+		m.healthy = healthy
+		if healthy {
+			m.since = p.now()
+		}
+		return true
+	}
+	return false
+}
+
+// Targets returns the state of every target.
+func (p *Pool) Targets() []Target {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := p.now()
+	targets := make([]Target, len(p.members))
+	for i, m := range p.members {
+		targets[i] = Target{
+			URL:     m.url,
+			Address: m.url.String(),
+			Healthy: m.healthy,
+			Since:   m.since,
+			Weight:  p.weight(m, now),
+		}
+	}
+	return targets
+}
+
+func (p *Pool) weight(m *member, now time.Time) float64 {
+	if !m.healthy {
+		return 0
+	}
+	if p.opts.SlowStart <= 0 || m.since.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(m.since)
+	if elapsed >= p.opts.SlowStart {
+		return 1
+	}
+	return max(minWeight, float64(elapsed)/float64(p.opts.SlowStart))
+}
@@ -0,0 +1,74 @@
+package upstream
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSlowStart(t *testing.T) {
+	a, b := mustParse(t, "http://10.0.0.1:3000"), mustParse(t, "http://10.0.0.2:3000")
+	now := time.Now()
+	p := NewPool(Options{SlowStart: time.Minute}, []*url.URL{a, b})
+	p.now = func() time.Time { return now }
+
+	weights := func() map[string]float64 {
+		w := map[string]float64{}
+		for _, target := range p.Targets() {
+			w[target.Address] = target.Weight
+		}
+		return w
+	}
+	if w := weights(); w[a.String()] != 1 || w[b.String()] != 1 {
+		t.Fatalf("Expected initial targets at full weight, got %v", w)
+	}
+
+	p.SetHealthy(b.String(), false)
+	for i := 0; i < 100; i++ {
+		if got := p.Pick(); got != a {
+			t.Fatalf("Expected only the healthy target, got %s", got)
+		}
+	}
+
+	// Recovery starts at the minimum weight and ramps up.
+	if !p.SetHealthy(b.String(), true) {
+		t.Fatal("Expected the health to change")
+	}
+	if w := weights()[b.String()]; w != minWeight {
+		t.Errorf("Expected weight %v right after recovery, got %v", minWeight, w)
+	}
+	now = now.Add(30 * time.Second)
+	if w := weights()[b.String()]; w != 0.5 {
+		t.Errorf("Expected weight 0.5 halfway through, got %v", w)
+	}
+	now = now.Add(time.Minute)
+	if w := weights()[b.String()]; w != 1 {
+		t.Errorf("Expected full weight after slow start, got %v", w)
+	}
+
+	// Added targets start slow start, existing ones keep their state.
+	c := mustParse(t, "http://10.0.0.3:3000")
+	p.SetTargets([]*url.URL{a, c})
+	if w := weights(); len(w) != 2 || w[a.String()] != 1 || w[c.String()] != minWeight {
+		t.Errorf("Unexpected weights after adding a target: %v", w)
+	}
+}
+
+func TestPickWithoutHealthyTargets(t *testing.T) {
+	a, b := mustParse(t, "http://10.0.0.1:3000"), mustParse(t, "http://10.0.0.2:3000")
+	p := NewPool(Options{}, []*url.URL{a, b})
+	p.SetHealthy(a.String(), false)
+	p.SetHealthy(b.String(), false)
+	if got := p.Pick(); got != a && got != b {
+		t.Errorf("Expected a target even if none is healthy, got %v", got)
+	}
+}
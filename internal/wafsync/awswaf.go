@@ -0,0 +1,186 @@
+package wafsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/knakul853/shielder/internal/signing"
+)
+
+// AWSWAFOptions identifies an AWS WAF IP set.
+type AWSWAFOptions struct {
+	// Region of the IP set, us-east-1 for the CLOUDFRONT scope.
+	Region string
+	// Scope is REGIONAL or CLOUDFRONT.
+	Scope string
+	Name  string
+	ID    string
+	// Signer signs the API requests, see signing.NewSigV4 with the wafv2
+	// service.
+	Signer signing.Signer
+	// Endpoint overrides the API endpoint, for tests.
+	Endpoint string
+	Client   *http.Client
+}
+
+// AWSWAF keeps an AWS WAF (v2) IP set, which web ACL rules can reference.
+// IP sets are replaced as a whole, guarded by the lock token of the version
+// that was read.
+type AWSWAF struct {
+	opts   AWSWAFOptions
+	client *http.Client
+}
+
+// NewAWSWAF creates a provider for an AWS WAF IP set.
+func NewAWSWAF(opts AWSWAFOptions) *AWSWAF {
+	if opts.Endpoint == "" {
+		opts.Endpoint = "https://wafv2." + opts.Region + ".amazonaws.com/"
+	}
+	base := http.DefaultTransport
+	if opts.Client != nil && opts.Client.Transport != nil {
+		base = opts.Client.Transport
+	}
+	return &AWSWAF{opts: opts, client: &http.Client{Transport: signing.Transport(base, opts.Signer)}}
+}
+
+type ipSetRef struct {
+	Name  string `json:"Name"`
+	Scope string `json:"Scope"`
+	ID    string `json:"Id"`
+}
+
+type getIPSetOutput struct {
+	IPSet struct {
+		Addresses []string `json:"Addresses"`
+	} `json:"IPSet"`
+	LockToken string `json:"LockToken"`
+}
+
+type updateIPSetInput struct {
+	ipSetRef
+	Addresses []string `json:"Addresses"`
+	LockToken string   `json:"LockToken"`
+}
+
+// errLockConflict is returned when the IP set changed between reading and
+// updating it.
+var errLockConflict = errors.New("aws waf: ip set was modified concurrently")
+
+// Normalize returns p unchanged, IP sets accept any prefix length.
+func (a *AWSWAF) Normalize(p netip.Prefix) netip.Prefix {
+	return p
+}
+
+// List returns the addresses of the IP set.
+func (a *AWSWAF) List(ctx context.Context) ([]netip.Prefix, error) {
+	out, err := a.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]netip.Prefix, 0, len(out.IPSet.Addresses))
+	for _, address := range out.IPSet.Addresses {
+		if p, err := parsePrefix(address); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes, nil
+}
+
+// Update adds and removes addresses, retrying once if the IP set was
+// modified concurrently.
+func (a *AWSWAF) Update(ctx context.Context, add, remove []netip.Prefix) error {
+	err := a.update(ctx, add, remove)
+	if errors.Is(err, errLockConflict) {
+		err = a.update(ctx, add, remove)
+	}
+	return err
+}
+
+func (a *AWSWAF) update(ctx context.Context, add, remove []netip.Prefix) error {
+	out, err := a.get(ctx)
+	if err != nil {
+		return err
+	}
+	removed := make(map[netip.Prefix]bool, len(remove))
+	for _, p := range remove {
+		removed[p] = true
+	}
+	present := make(map[netip.Prefix]bool)
+	addresses := []string{}
+	for _, address := range out.IPSet.Addresses {
+		p, err := parsePrefix(address)
+		if err != nil || removed[p] {
+			continue
+		}
+		present[p] = true
+		addresses = append(addresses, address)
+	}
+	for _, p := range add {
+		if !present[p] {
+			addresses = append(addresses, p.String())
+		}
+	}
+	return a.call(ctx, "UpdateIPSet", updateIPSetInput{
+		ipSetRef:  a.ref(),
+		Addresses: addresses,
+		LockToken: out.LockToken,
+	}, nil)
+}
+
+func (a *AWSWAF) get(ctx context.Context) (*getIPSetOutput, error) {
+	var out getIPSetOutput
+	if err := a.call(ctx, "GetIPSet", a.ref(), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (a *AWSWAF) ref() ipSetRef {
+	return ipSetRef{Name: a.opts.Name, Scope: a.opts.Scope, ID: a.opts.ID}
+}
+
+// call invokes an operation of the WAFV2 JSON API.
+func (a *AWSWAF) call(ctx context.Context, operation string, in, out any) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.opts.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AWSWAF_20190729."+operation)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &apiErr)
+		if strings.HasSuffix(apiErr.Type, "WAFOptimisticLockException") {
+			return errLockConflict
+		}
+		return fmt.Errorf("aws waf: %s: %s: %s %s", operation, resp.Status, apiErr.Type, apiErr.Message)
+	}
+	if out != nil {
+		return json.Unmarshal(body, out)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package wafsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// cloudflareAPI is the base URL of the Cloudflare API.
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// CloudflareOptions identifies a Cloudflare IP list.
+type CloudflareOptions struct {
+	AccountID string
+	ListID    string
+	// APIToken needs the Account Filter Lists Edit permission, or Read for
+	// imports.
+	APIToken string
+	// BaseURL overrides the API endpoint, for tests.
+	BaseURL string
+	Client  *http.Client
+}
+
+// Cloudflare keeps an account-level IP list of Cloudflare, which WAF custom
+// rules can match with "ip.src in $list". Cloudflare does not accept single
+// IPv6 addresses, they are widened to their /64.
+type Cloudflare struct {
+	opts CloudflareOptions
+
+	mu  sync.Mutex
+	ids map[netip.Prefix]string
+}
+
+// NewCloudflare creates a provider for a Cloudflare IP list.
+func NewCloudflare(opts CloudflareOptions) *Cloudflare {
+	if opts.BaseURL == "" {
+		opts.BaseURL = cloudflareAPI
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	return &Cloudflare{opts: opts, ids: make(map[netip.Prefix]string)}
+}
+
+type cloudflareItem struct {
+	ID      string `json:"id,omitempty"`
+	IP      string `json:"ip"`
+	Comment string `json:"comment,omitempty"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Cursors struct {
+			After string `json:"after"`
+		} `json:"cursors"`
+	} `json:"result_info"`
+}
+
+// Normalize widens single IPv6 addresses to their /64.
+func (c *Cloudflare) Normalize(p netip.Prefix) netip.Prefix {
+	if p.Addr().Is6() && p.Bits() > 64 {
+		p, _ = p.Addr().Prefix(64)
+	}
+	return p
+}
+
+// List returns the entries of the list.
+func (c *Cloudflare) List(ctx context.Context) ([]netip.Prefix, error) {
+	ids := make(map[netip.Prefix]string)
+	var prefixes []netip.Prefix
+	cursor := ""
+	for {
+		path := c.itemsPath()
+		if cursor != "" {
+			path += "?cursor=" + url.QueryEscape(cursor)
+		}
+		resp, err := c.do(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		var items []cloudflareItem
+		if err := json.Unmarshal(resp.Result, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			p, err := parsePrefix(item.IP)
+			if err != nil {
+				continue
+			}
+			ids[p] = item.ID
+			prefixes = append(prefixes, p)
+		}
+		if cursor = resp.ResultInfo.Cursors.After; cursor == "" {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	c.ids = ids
+	c.mu.Unlock()
+	return prefixes, nil
+}
+
+// Update adds and removes entries. Entries to remove must have been seen by
+// the last List.
+func (c *Cloudflare) Update(ctx context.Context, add, remove []netip.Prefix) error {
+	if len(add) > 0 {
+		items := make([]cloudflareItem, 0, len(add))
+		for _, p := range add {
+			items = append(items, cloudflareItem{IP: formatPrefix(p), Comment: "shielder"})
+		}
+		if _, err := c.do(ctx, http.MethodPost, c.itemsPath(), items); err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		c.mu.Lock()
+		var items []cloudflareItem
+		for _, p := range remove {
+			if id, ok := c.ids[p]; ok {
+				items = append(items, cloudflareItem{ID: id})
+			}
+		}
+		c.mu.Unlock()
+		if len(items) > 0 {
+			body := map[string]any{"items": items}
+			if _, err := c.do(ctx, http.MethodDelete, c.itemsPath(), body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cloudflare) itemsPath() string {
+	return "/accounts/" + url.PathEscape(c.opts.AccountID) + "/rules/lists/" + url.PathEscape(c.opts.ListID) + "/items"
+}
+
+func (c *Cloudflare) do(ctx context.Context, method, path string, body any) (*cloudflareResponse, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.opts.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.opts.APIToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("cloudflare: %s %s: %s", method, path, resp.Status)
+	}
+	if !result.Success {
+		var messages []string
+		for _, e := range result.Errors {
+			messages = append(messages, e.Message)
+		}
+		return nil, fmt.Errorf("cloudflare: %s %s: %s: %s", method, path, resp.Status, strings.Join(messages, "; "))
+	}
+	return &result, nil
+}
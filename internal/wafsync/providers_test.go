@@ -0,0 +1,128 @@
+package wafsync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestCloudflare(t *testing.T) {
+	var added []cloudflareItem
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.URL.Path != "/accounts/acc/rules/lists/list/items" {
+			http.Error(w, `{"success":false,"errors":[{"message":"denied"}]}`, http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Get("cursor") == "" {
+				w.Write([]byte(`{"success":true,"result":[{"id":"a","ip":"10.0.0.1"}],"result_info":{"cursors":{"after":"next"}}}`))
+				return
+			}
+			w.Write([]byte(`{"success":true,"result":[{"id":"b","ip":"2001:db8::/64"}],"result_info":{"cursors":{}}}`))
+		case http.MethodPost:
+			json.NewDecoder(r.Body).Decode(&added)
+			w.Write([]byte(`{"success":true,"result":{"operation_id":"op"}}`))
+		case http.MethodDelete:
+			var body struct {
+				Items []cloudflareItem `json:"items"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			for _, item := range body.Items {
+				deleted = append(deleted, item.ID)
+			}
+			w.Write([]byte(`{"success":true,"result":{"operation_id":"op"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	cf := NewCloudflare(CloudflareOptions{AccountID: "acc", ListID: "list", APIToken: "token", BaseURL: srv.URL})
+	ctx := context.Background()
+	prefixes, err := cf.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0].String() != "10.0.0.1/32" || prefixes[1].String() != "2001:db8::/64" {
+		t.Fatalf("Expected both pages, got %v", prefixes)
+	}
+
+	single := cf.Normalize(netip.MustParsePrefix("2001:db8:1::5/128"))
+	if single.String() != "2001:db8:1::/64" {
+		t.Errorf("Expected IPv6 addresses to be widened to /64, got %s", single)
+	}
+	err = cf.Update(ctx, []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")}, []netip.Prefix{netip.MustParsePrefix("2001:db8::/64")})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if len(added) != 1 || added[0].IP != "10.0.0.2" || added[0].Comment != "shielder" {
+		t.Errorf("Unexpected added items %+v", added)
+	}
+	if len(deleted) != 1 || deleted[0] != "b" {
+		t.Errorf("Expected item b to be deleted, got %v", deleted)
+	}
+
+	bad := NewCloudflare(CloudflareOptions{AccountID: "acc", ListID: "list", APIToken: "wrong", BaseURL: srv.URL})
+	if _, err := bad.List(ctx); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("Expected the API error, got %v", err)
+	}
+}
+
+type nopSigner struct{}
+
+func (nopSigner) Sign(r *http.Request) error {
+	r.Header.Set("Authorization", "signed")
+	return nil
+}
+
+func TestAWSWAF(t *testing.T) {
+	addresses := []string{"10.0.0.1/32", "10.0.0.2/32"}
+	conflicts := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "signed" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "AWSWAF_20190729.GetIPSet":
+			json.NewEncoder(w).Encode(map[string]any{
+				"IPSet":     map[string]any{"Addresses": addresses},
+				"LockToken": "token",
+			})
+		case "AWSWAF_20190729.UpdateIPSet":
+			if conflicts > 0 {
+				conflicts--
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"WAFOptimisticLockException","message":"stale"}`))
+				return
+			}
+			var in updateIPSetInput
+			json.NewDecoder(r.Body).Decode(&in)
+			if in.LockToken != "token" || in.Name != "blocked" || in.Scope != "REGIONAL" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			addresses = in.Addresses
+			w.Write([]byte(`{"NextLockToken":"next"}`))
+		}
+	}))
+	defer srv.Close()
+
+	waf := NewAWSWAF(AWSWAFOptions{Scope: "REGIONAL", Name: "blocked", ID: "id", Signer: nopSigner{}, Endpoint: srv.URL})
+	ctx := context.Background()
+	prefixes, err := waf.List(ctx)
+	if err != nil || len(prefixes) != 2 {
+		t.Fatalf("Expected two addresses, got %v (%v)", prefixes, err)
+	}
+	err = waf.Update(ctx, []netip.Prefix{netip.MustParsePrefix("10.0.0.3/32")}, []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if len(addresses) != 2 || addresses[0] != "10.0.0.2/32" || addresses[1] != "10.0.0.3/32" {
+		t.Errorf("Unexpected addresses after update: %v", addresses)
+	}
+}
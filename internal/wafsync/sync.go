@@ -0,0 +1,262 @@
+// Package wafsync keeps the IP lists of cloud WAF providers consistent with
+// Shielder's blocks, for setups that are protected at the edge as well as at
+// the origin.
+//
+// Exports push the client IPs Shielder currently blocks to a provider list.
+// Blocks are collected from limiter events into a sorted set in Redis, so
+// that every instance contributes and a restart loses nothing, and one
+// instance at a time reconciles each export list with it. An export list is
+// owned by Shielder: entries that are not blocked are removed from it.
+//
+// Imports read a provider list on every instance, and requests from its
+// addresses and ranges are rejected like blocked clients. Imported entries are
+// never exported, so a list must not be used in both directions.
+package wafsync
+
+import (
+	"context"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	blocksKey = "wafsync:blocks"
+	lockKey   = "wafsync:lock:"
+)
+
+// Directions of a sync, as recorded in metrics.
+const (
+	DirectionExport = "export"
+	DirectionImport = "import"
+)
+
+// Provider is an IP list of a WAF provider.
+type Provider interface {
+	// List returns the entries of the list.
+	List(ctx context.Context) ([]netip.Prefix, error)
+	// Update adds and removes entries. Entries to remove are ones returned
+	// by the last List.
+	Update(ctx context.Context, add, remove []netip.Prefix) error
+	// Normalize returns the form in which the provider stores p.
+	Normalize(p netip.Prefix) netip.Prefix
+}
+
+// Target is a provider list that is synced in one direction.
+type Target struct {
+	Name     string
+	Provider Provider
+}
+
+// Recorder receives the outcome of every sync.
+type Recorder interface {
+	IncWAFSync(target, direction, result string)
+}
+
+// Options configures the syncer.
+type Options struct {
+	Exports []Target
+	Imports []Target
+	// Interval is how often lists are synced, one minute by default.
+	Interval time.Duration
+	Recorder Recorder
+}
+
+// Syncer exports blocks to and imports blocks from WAF provider lists.
+type Syncer struct {
+	opts   Options
+	client redis.UniversalClient
+	logger *logrus.Logger
+
+	imported atomic.Pointer[importedSet]
+}
+
+type importedSet struct {
+	// prefixes holds the entries of every import target by name.
+	prefixes map[string][]netip.Prefix
+}
+
+// New creates a syncer that collects blocks in Redis. Observe must be
+// registered as a limiter event handler and Run started.
+func New(opts Options, client redis.UniversalClient, logger *logrus.Logger) *Syncer {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	s := &Syncer{opts: opts, client: client, logger: logger}
+	s.imported.Store(&importedSet{prefixes: map[string][]netip.Prefix{}})
+	return s
+}
+
+// Observe records block and unblock events for export. Keys that are not
+// plain IP addresses, such as route or session keys, are not exported.
+func (s *Syncer) Observe(ctx context.Context, event limiter.Event) {
+	if len(s.opts.Exports) == 0 {
+		return
+	}
+	addr, err := netip.ParseAddr(event.IP)
+	if err != nil {
+		return
+	}
+	member := addr.Unmap().String()
+
+	switch event.Type {
+	case limiter.EventBlock:
+		expires := event.Time.Add(event.Duration)
+		err = s.client.ZAdd(ctx, blocksKey, &redis.Z{Score: float64(expires.Unix()), Member: member}).Err()
+	case limiter.EventUnblock:
+		err = s.client.ZRem(ctx, blocksKey, member).Err()
+	}
+	if err != nil {
+		s.logger.WithError(err).Warn("Error recording block for WAF export")
+	}
+}
+
+// Blocked reports whether ip is on an imported list, and which.
+func (s *Syncer) Blocked(ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	for name, prefixes := range s.imported.Load().prefixes {
+		for _, p := range prefixes {
+			if p.Contains(ip) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Run syncs all lists once per interval until ctx is done.
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		s.sync(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Syncer) sync(ctx context.Context, now time.Time) {
+	imported := &importedSet{prefixes: make(map[string][]netip.Prefix, len(s.opts.Imports))}
+	previous := s.imported.Load()
+	for _, target := range s.opts.Imports {
+		prefixes, err := target.Provider.List(ctx)
+		if err != nil {
+			s.logger.WithError(err).WithField("target", target.Name).Warn("Error importing WAF list, keeping the previous version")
+			s.record(target.Name, DirectionImport, err)
+			prefixes = previous.prefixes[target.Name]
+		} else {
+			s.record(target.Name, DirectionImport, nil)
+		}
+		imported.prefixes[target.Name] = prefixes
+	}
+	s.imported.Store(imported)
+
+	if len(s.opts.Exports) == 0 {
+		return
+	}
+	if err := s.client.ZRemRangeByScore(ctx, blocksKey, "-inf", strconv.FormatInt(now.Unix(), 10)).Err(); err != nil {
+		s.logger.WithError(err).Warn("Error expiring blocks for WAF export")
+		return
+	}
+	members, err := s.client.ZRange(ctx, blocksKey, 0, -1).Result()
+	if err != nil {
+		s.logger.WithError(err).Warn("Error reading blocks for WAF export")
+		return
+	}
+	for _, target := range s.opts.Exports {
+		// Only one instance exports to a target per interval.
+		acquired, err := s.client.SetNX(ctx, lockKey+target.Name, "1", s.opts.Interval*9/10).Result()
+		if err != nil || !acquired {
+			continue
+		}
+		err = s.export(ctx, target, members)
+		if err != nil {
+			s.logger.WithError(err).WithField("target", target.Name).Warn("Error exporting blocks to WAF list")
+		}
+		s.record(target.Name, DirectionExport, err)
+	}
+}
+
+// export reconciles the list of target with the blocked addresses.
+func (s *Syncer) export(ctx context.Context, target Target, members []string) error {
+	desired := make(map[netip.Prefix]bool, len(members))
+	for _, member := range members {
+		addr, err := netip.ParseAddr(member)
+		if err != nil {
+			continue
+		}
+		desired[target.Provider.Normalize(netip.PrefixFrom(addr, addr.BitLen()))] = true
+	}
+
+	current, err := target.Provider.List(ctx)
+	if err != nil {
+		return err
+	}
+	var add, remove []netip.Prefix
+	present := make(map[netip.Prefix]bool, len(current))
+	for _, p := range current {
+		present[p] = true
+		if !desired[p] {
+			remove = append(remove, p)
+		}
+	}
+	for p := range desired {
+		if !present[p] {
+			add = append(add, p)
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+	s.logger.WithFields(logrus.Fields{
+		"target":  target.Name,
+		"added":   len(add),
+		"removed": len(remove),
+	}).Info("Exporting blocks to WAF list")
+	return target.Provider.Update(ctx, add, remove)
+}
+
+func (s *Syncer) record(target, direction string, err error) {
+	if s.opts.Recorder == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	s.opts.Recorder.IncWAFSync(target, direction, result)
+}
+
+// parsePrefix parses an address or a prefix in CIDR notation.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+// formatPrefix formats single addresses without a prefix length.
+func formatPrefix(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
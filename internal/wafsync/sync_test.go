@@ -0,0 +1,119 @@
+package wafsync
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/knakul853/shielder/internal/limiter"
+	"github.com/sirupsen/logrus"
+)
+
+type fakeProvider struct {
+	mu      sync.Mutex
+	entries map[netip.Prefix]bool
+}
+
+func newFakeProvider(entries ...string) *fakeProvider {
+	f := &fakeProvider{entries: make(map[netip.Prefix]bool)}
+	for _, e := range entries {
+		f.entries[netip.MustParsePrefix(e)] = true
+	}
+	return f
+}
+
+func (f *fakeProvider) List(ctx context.Context) ([]netip.Prefix, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var prefixes []netip.Prefix
+	for p := range f.entries {
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func (f *fakeProvider) Update(ctx context.Context, add, remove []netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range add {
+		f.entries[p] = true
+	}
+	for _, p := range remove {
+		delete(f.entries, p)
+	}
+	return nil
+}
+
+func (f *fakeProvider) Normalize(p netip.Prefix) netip.Prefix { return p }
+
+func (f *fakeProvider) list() []string {
+	prefixes, _ := f.List(context.Background())
+	var out []string
+	for _, p := range prefixes {
+		out = append(out, p.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+func newTestSyncer(t *testing.T, opts Options) (*Syncer, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(opts, client, logger), mr
+}
+
+func TestExport(t *testing.T) {
+	edge := newFakeProvider("198.51.100.7/32")
+	s, mr := newTestSyncer(t, Options{Exports: []Target{{Name: "edge", Provider: edge}}})
+	ctx := context.Background()
+	now := time.Now()
+
+	s.Observe(ctx, limiter.Event{Type: limiter.EventBlock, IP: "10.0.0.1", Duration: time.Hour, Time: now})
+	s.Observe(ctx, limiter.Event{Type: limiter.EventBlock, IP: "10.0.0.2", Duration: time.Minute, Time: now})
+	s.Observe(ctx, limiter.Event{Type: limiter.EventBlock, IP: "route:api:10.0.0.3", Duration: time.Hour, Time: now})
+	s.sync(ctx, now)
+
+	if got := edge.list(); len(got) != 2 || got[0] != "10.0.0.1/32" || got[1] != "10.0.0.2/32" {
+		t.Fatalf("Expected the blocked IPs to replace the list, got %v", got)
+	}
+
+	// The next export happens once the lock of the previous one expired.
+	s.Observe(ctx, limiter.Event{Type: limiter.EventUnblock, IP: "10.0.0.1"})
+	mr.FastForward(time.Minute)
+	s.sync(ctx, now.Add(2*time.Minute))
+	if got := edge.list(); len(got) != 0 {
+		t.Errorf("Expected unblocked and expired IPs to be removed, got %v", got)
+	}
+}
+
+func TestImport(t *testing.T) {
+	edge := newFakeProvider("203.0.113.0/24", "2001:db8::/32")
+	s, _ := newTestSyncer(t, Options{Imports: []Target{{Name: "edge", Provider: edge}}})
+	s.sync(context.Background(), time.Now())
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"203.0.113.9", true},
+		{"::ffff:203.0.113.9", true},
+		{"2001:db8::1", true},
+		{"198.51.100.1", false},
+	}
+	for _, tt := range tests {
+		name, blocked := s.Blocked(netip.MustParseAddr(tt.ip))
+		if blocked != tt.blocked || (blocked && name != "edge") {
+			t.Errorf("Blocked(%s) = %q, %v, want %v", tt.ip, name, blocked, tt.blocked)
+		}
+	}
+}
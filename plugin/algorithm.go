@@ -0,0 +1,27 @@
+package plugin
+
+import "github.com/knakul853/shielder/internal/limiter"
+
+// Algorithm is a rate limiting algorithm. It counts the requests of client
+// keys against a limit of requests per minute.
+type Algorithm = limiter.Algorithm
+
+// AlgorithmFactory creates an algorithm that keeps its state in store, with
+// its keys under prefix.
+type AlgorithmFactory = limiter.AlgorithmFactory
+
+// Store is the state store algorithms keep their counters in.
+type Store = limiter.Store
+
+// LimiterConfig is the rate limiter configuration passed to algorithm
+// factories.
+type LimiterConfig = limiter.Config
+
+// RegisterAlgorithm makes a rate limiting algorithm available under name, so
+// that it can be selected as rateLimit.algorithm or rateLimit.shadowAlgorithm
+// in the configuration. Like Register it is meant to be called from an init
+// function, and it panics if name is taken, including by a built-in
+// algorithm.
+func RegisterAlgorithm(name string, factory AlgorithmFactory) {
+	limiter.RegisterAlgorithm(name, factory)
+}
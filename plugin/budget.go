@@ -0,0 +1,27 @@
+package plugin
+
+import (
+	"context"
+	"time"
+)
+
+type budgetKey struct{}
+
+// ContextWithBudget returns a copy of ctx carrying the deadline by which
+// Shielder's checks of the request have to be done.
+func ContextWithBudget(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, budgetKey{}, deadline)
+}
+
+// BudgetContext returns a context that expires when the check budget of the
+// request is used up, or ctx itself if the request has no budget. Plugins
+// should run their checks with it and apply their failure policy once it
+// expires, rather than delaying the request further. The request context
+// itself is not bounded by the budget, since it also covers the upstream.
+func BudgetContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Value(budgetKey{}).(time.Time)
+	if !ok {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline)
+}
@@ -0,0 +1,177 @@
+// Package cors is a built-in plugin that answers CORS preflight requests
+// locally and adds CORS headers to upstream responses.
+//
+//	plugins:
+//	  - name: cors
+//	    config:
+//	      allowOrigins: ["https://app.example.com"]
+//	      allowMethods: [GET, POST, PUT, DELETE]
+//	      allowHeaders: [Authorization, Content-Type]
+//	      exposeHeaders: [X-Request-Id]
+//	      allowCredentials: true
+//	      maxAge: 10m
+//
+// Preflights are answered after the protection checks passed, so they are
+// still rate limited but never reach the upstream. Combine the plugin with a
+// route that has preflight set to count preflights separately from the API
+// budget. Set passthrough to forward preflights to the upstream instead. An
+// origin of "*" allows every origin.
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+func init() {
+	plugin.Register("cors", New)
+}
+
+// CORS applies a CORS policy.
+type CORS struct {
+	origins          map[string]bool
+	anyOrigin        bool
+	allowMethods     string
+	allowHeaders     string
+	exposeHeaders    string
+	allowCredentials bool
+	maxAge           string
+	passthrough      bool
+}
+
+// New creates a cors plugin from its configuration.
+func New(config map[string]any) (plugin.Plugin, error) {
+	origins, err := stringList(config, "allowOrigins")
+	if err != nil {
+		return nil, err
+	}
+	if len(origins) == 0 {
+		return nil, fmt.Errorf("cors: allowOrigins is required")
+	}
+	methods, err := stringList(config, "allowMethods")
+	if err != nil {
+		return nil, err
+	}
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	headers, err := stringList(config, "allowHeaders")
+	if err != nil {
+		return nil, err
+	}
+	expose, err := stringList(config, "exposeHeaders")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CORS{
+		origins:          make(map[string]bool, len(origins)),
+		allowMethods:     strings.ToUpper(strings.Join(methods, ", ")),
+		allowHeaders:     strings.Join(headers, ", "),
+		exposeHeaders:    strings.Join(expose, ", "),
+		allowCredentials: config["allowCredentials"] == true,
+		passthrough:      config["passthrough"] == true,
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		c.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	if raw, ok := config["maxAge"].(string); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("cors: invalid maxAge %q", raw)
+		}
+		c.maxAge = strconv.Itoa(int(d.Seconds()))
+	}
+	return c, nil
+}
+
+// Middleware answers preflight requests right before they would be forwarded.
+func (c *CORS) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageUpstream || c.passthrough {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !plugin.IsPreflight(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		origin := r.Header.Get("Origin")
+		if !c.allowed(origin) {
+			// Without CORS headers the browser fails the actual request.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		c.setOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", c.allowMethods)
+		if c.allowHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", c.allowHeaders)
+		}
+		if c.maxAge != "" {
+			h.Set("Access-Control-Max-Age", c.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ModifyResponse adds CORS headers to responses for allowed origins.
+func (c *CORS) ModifyResponse(resp *http.Response) error {
+	if resp.Request == nil || (c.passthrough && plugin.IsPreflight(resp.Request)) {
+		return nil
+	}
+	resp.Header.Add("Vary", "Origin")
+	origin := resp.Request.Header.Get("Origin")
+	if !c.allowed(origin) {
+		return nil
+	}
+	c.setOrigin(resp.Header, origin)
+	if c.exposeHeaders != "" {
+		resp.Header.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+	}
+	return nil
+}
+
+func (c *CORS) allowed(origin string) bool {
+	return origin != "" && (c.anyOrigin || c.origins[origin])
+}
+
+// setOrigin echoes the origin, since "*" is not accepted for requests with
+// credentials.
+func (c *CORS) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin && !c.allowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func stringList(config map[string]any, key string) ([]string, error) {
+	raw, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	values, ok := raw.([]any)
+	if !ok {
+		return nil, fmt.Errorf("cors: %s must be a list", key)
+	}
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		result = append(result, fmt.Sprint(value))
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+func newTestPlugin(t *testing.T, config map[string]any) *CORS {
+	t.Helper()
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	return p.(*CORS)
+}
+
+func TestPreflight(t *testing.T) {
+	c := newTestPlugin(t, map[string]any{
+		"allowOrigins":     []any{"https://app.example.com"},
+		"allowMethods":     []any{"get", "put"},
+		"allowHeaders":     []any{"Authorization"},
+		"allowCredentials": true,
+		"maxAge":           "10m",
+	})
+
+	tests := []struct {
+		name      string
+		method    string
+		origin    string
+		forwarded bool
+		allowed   string
+	}{
+		{"allowed origin", http.MethodOptions, "https://app.example.com", false, "https://app.example.com"},
+		{"other origin", http.MethodOptions, "https://evil.example", false, ""},
+		{"not a preflight", http.MethodGet, "https://app.example.com", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded := false
+			h := c.Middleware(plugin.StageUpstream, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded = true
+			}))
+			req := httptest.NewRequest(tt.method, "/api/orders", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", "PUT")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if forwarded != tt.forwarded {
+				t.Fatalf("Expected forwarded=%v, got %v", tt.forwarded, forwarded)
+			}
+			if tt.forwarded {
+				return
+			}
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("Expected status 204, got %d", rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.allowed {
+				t.Errorf("Expected allowed origin %q, got %q", tt.allowed, got)
+			}
+			if tt.allowed == "" {
+				return
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, PUT" {
+				t.Errorf("Expected allowed methods %q, got %q", "GET, PUT", got)
+			}
+			if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+				t.Errorf("Expected max age 600, got %q", got)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+				t.Errorf("Expected credentials to be allowed, got %q", got)
+			}
+		})
+	}
+}
+
+func TestModifyResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]any
+		origin      string
+		allowOrigin string
+	}{
+		{"listed origin", map[string]any{"allowOrigins": []any{"https://app.example.com"}}, "https://app.example.com", "https://app.example.com"},
+		{"unlisted origin", map[string]any{"allowOrigins": []any{"https://app.example.com"}}, "https://evil.example", ""},
+		{"any origin", map[string]any{"allowOrigins": []any{"*"}}, "https://evil.example", "*"},
+		{"any origin with credentials", map[string]any{"allowOrigins": []any{"*"}, "allowCredentials": true}, "https://evil.example", "https://evil.example"},
+		{"no origin", map[string]any{"allowOrigins": []any{"*"}}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestPlugin(t, tt.config)
+			req := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp := &http.Response{Header: http.Header{}, Request: req}
+			if err := c.ModifyResponse(resp); err != nil {
+				t.Fatalf("ModifyResponse failed: %v", err)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Expected allowed origin %q, got %q", tt.allowOrigin, got)
+			}
+			if got := resp.Header.Get("Vary"); got != "Origin" {
+				t.Errorf("Expected Vary: Origin, got %q", got)
+			}
+		})
+	}
+}
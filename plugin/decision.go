@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"context"
+	"time"
+)
+
+// Outcomes of the protection checks.
+const (
+	OutcomeAllowed  = "allowed"
+	OutcomeRejected = "rejected"
+	OutcomeError    = "error"
+	// OutcomeTagged is the outcome of requests that were forwarded with tag
+	// headers instead of being rejected.
+	OutcomeTagged = "tagged"
+	// OutcomeTrusted is the outcome of health checks and monitoring, which
+	// bypass the protection checks.
+	OutcomeTrusted = "trusted"
+	// OutcomeBypassed is the outcome of requests presenting an emergency
+	// bypass token, which skip limits and challenges.
+	OutcomeBypassed = "bypassed"
+)
+
+// Decision is Shielder's verdict on a request. The proxy attaches an empty
+// decision to every request next to its Limit and fills it in once the
+// protection checks ran, so upstream-stage plugins, and the handlers of
+// applications embedding Shielder, can log and act on it. Request-stage
+// plugins run before the checks and see the verdict after calling next,
+// including for rejected requests.
+//
+// A decision must not be modified.
+type Decision struct {
+	ClientIP string
+	// Key is the client key the decision was taken for, see Limit.
+	Key   string
+	Route string
+	// Endpoint is the path template of the request, such as /users/{id},
+	// or its path when templating is not configured.
+	Endpoint string
+	// Outcome is one of the Outcome constants, empty until the checks ran.
+	Outcome string
+	// Reason explains the outcome, such as within_limit or
+	// rate_limit_exceeded, or names the identity of trusted requests.
+	Reason string
+	// Rules are the rules that flagged the request and Score how strongly
+	// they suggest it is abusive, from 0 to 1.
+	Rules []string
+	Score float64
+	// RequestsPerMinute is the limit that was applied to Key, after
+	// tightening by Factor, and Cost what the request counted as.
+	RequestsPerMinute int
+	Cost              int
+	Factor            float64
+	// Elapsed is how long the checks took.
+	Elapsed time.Duration
+}
+
+type decisionKey struct{}
+
+// ContextWithDecision returns a copy of ctx carrying decision.
+func ContextWithDecision(ctx context.Context, decision *Decision) context.Context {
+	return context.WithValue(ctx, decisionKey{}, decision)
+}
+
+// DecisionFromContext returns the decision attached to ctx, or nil if there
+// is none.
+func DecisionFromContext(ctx context.Context) *Decision {
+	decision, _ := ctx.Value(decisionKey{}).(*Decision)
+	return decision
+}
@@ -0,0 +1,110 @@
+// Package headers is a built-in plugin that sets and removes request and
+// response headers.
+//
+//	plugins:
+//	  - name: headers
+//	    config:
+//	      setRequest:
+//	        X-Forwarded-Proto: https
+//	      removeRequest: [X-Debug]
+//	      setResponse:
+//	        Strict-Transport-Security: max-age=31536000
+//	      removeResponse: [Server]
+package headers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+func init() {
+	plugin.Register("headers", New)
+}
+
+// Headers rewrites headers on the way to and from the upstream.
+type Headers struct {
+	setRequest     map[string]string
+	removeRequest  []string
+	setResponse    map[string]string
+	removeResponse []string
+}
+
+// New creates a headers plugin from its configuration.
+func New(config map[string]any) (plugin.Plugin, error) {
+	h := &Headers{}
+	var err error
+	if h.setRequest, err = stringMap(config, "setRequest"); err != nil {
+		return nil, err
+	}
+	if h.removeRequest, err = stringList(config, "removeRequest"); err != nil {
+		return nil, err
+	}
+	if h.setResponse, err = stringMap(config, "setResponse"); err != nil {
+		return nil, err
+	}
+	if h.removeResponse, err = stringList(config, "removeResponse"); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Middleware rewrites request headers right before the request is forwarded.
+func (h *Headers) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageUpstream {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range h.removeRequest {
+			r.Header.Del(name)
+		}
+		for name, value := range h.setRequest {
+			r.Header.Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ModifyResponse rewrites the upstream response headers.
+func (h *Headers) ModifyResponse(resp *http.Response) error {
+	for _, name := range h.removeResponse {
+		resp.Header.Del(name)
+	}
+	for name, value := range h.setResponse {
+		resp.Header.Set(name, value)
+	}
+	return nil
+}
+
+func stringMap(config map[string]any, key string) (map[string]string, error) {
+	raw, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	values, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("headers: %s must be a map", key)
+	}
+	result := make(map[string]string, len(values))
+	for name, value := range values {
+		result[name] = fmt.Sprint(value)
+	}
+	return result, nil
+}
+
+func stringList(config map[string]any, key string) ([]string, error) {
+	raw, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	values, ok := raw.([]any)
+	if !ok {
+		return nil, fmt.Errorf("headers: %s must be a list", key)
+	}
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		result = append(result, fmt.Sprint(value))
+	}
+	return result, nil
+}
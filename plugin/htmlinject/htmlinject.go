@@ -0,0 +1,221 @@
+// Package htmlinject is a built-in plugin that injects a snippet, such as a
+// bot-detection beacon or a maintenance banner, into proxied HTML pages.
+//
+//	plugins:
+//	  - name: htmlinject
+//	    config:
+//	      snippet: '<script src="/shielder/beacon.js" async></script>'
+//	      position: head
+//
+// The snippet is inserted right before </head> with position head, or right
+// before </body> with position body (the default). Pages without the marker
+// are passed through unchanged. Set snippetFile instead of snippet to read the
+// snippet from a file.
+//
+// Only uncompressed text/html responses are patched. To get those from
+// upstreams that compress, the plugin removes Accept-Encoding from requests
+// that accept HTML, and Go's transport negotiates and decodes compression
+// with the upstream on its own. Responses up to maxBufferBytes with a known
+// length are patched in memory and keep an exact Content-Length, larger or
+// chunked responses are patched while streaming and sent chunked.
+package htmlinject
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+func init() {
+	plugin.Register("htmlinject", New)
+}
+
+// Injector inserts a snippet into HTML responses.
+type Injector struct {
+	snippet        []byte
+	marker         []byte
+	maxBufferBytes int64
+}
+
+// New creates an htmlinject plugin from its configuration.
+func New(config map[string]any) (plugin.Plugin, error) {
+	snippet, _ := config["snippet"].(string)
+	if path, ok := config["snippetFile"].(string); ok && path != "" {
+		if snippet != "" {
+			return nil, errors.New("htmlinject: snippet and snippetFile are mutually exclusive")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("htmlinject: %w", err)
+		}
+		snippet = string(data)
+	}
+	if snippet == "" {
+		return nil, errors.New("htmlinject: snippet or snippetFile is required")
+	}
+
+	inj := &Injector{snippet: []byte(snippet), maxBufferBytes: 1 << 20}
+	switch position, _ := config["position"].(string); position {
+	case "", "body":
+		inj.marker = []byte("</body>")
+	case "head":
+		inj.marker = []byte("</head>")
+	default:
+		return nil, fmt.Errorf("htmlinject: position must be head or body, got %q", position)
+	}
+	switch v := config["maxBufferBytes"].(type) {
+	case int:
+		inj.maxBufferBytes = int64(v)
+	case float64:
+		inj.maxBufferBytes = int64(v)
+	}
+	return inj, nil
+}
+
+// Middleware asks the upstream for uncompressed pages, so that they can be
+// patched.
+func (inj *Injector) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageUpstream {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			r.Header.Del("Accept-Encoding")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ModifyResponse injects the snippet into HTML responses.
+func (inj *Injector) ModifyResponse(resp *http.Response) error {
+	if !inj.patchable(resp) {
+		return nil
+	}
+
+	// The representation changes, so a strong validator no longer holds.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+
+	if resp.ContentLength >= 0 && resp.ContentLength <= inj.maxBufferBytes {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if idx := indexFold(body, inj.marker); idx >= 0 {
+			body = append(body[:idx:idx], append(inj.snippet, body[idx:]...)...)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+
+	resp.Body = &streamInjector{src: resp.Body, marker: inj.marker, snippet: inj.snippet}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+func (inj *Injector) patchable(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/html"
+}
+
+// streamInjector inserts snippet before the first occurrence of marker while
+// the body is streamed. Up to len(marker)-1 bytes are held back between reads
+// so that markers split across reads are still found.
+type streamInjector struct {
+	src     io.ReadCloser
+	marker  []byte
+	snippet []byte
+
+	pending []byte // ready to be returned
+	carry   []byte // held back, may be the start of the marker
+	done    bool   // snippet was injected
+	eof     bool   // src is exhausted
+	buf     [32 << 10]byte
+}
+
+func (s *streamInjector) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		n, err := s.src.Read(s.buf[:])
+		data := append(s.carry, s.buf[:n]...)
+		s.carry = nil
+
+		switch {
+		case s.done:
+			s.pending = data
+		case indexFold(data, s.marker) >= 0:
+			idx := indexFold(data, s.marker)
+			s.pending = append(append(data[:idx:idx], s.snippet...), data[idx:]...)
+			s.done = true
+		case err != nil:
+			s.pending = data
+		default:
+			keep := len(s.marker) - 1
+			if keep > len(data) {
+				keep = len(data)
+			}
+			s.pending = data[:len(data)-keep]
+			s.carry = append([]byte(nil), data[len(data)-keep:]...)
+		}
+
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *streamInjector) Close() error {
+	return s.src.Close()
+}
+
+// indexFold returns the index of the first ASCII case-insensitive occurrence
+// of the lower-case marker in data, or -1.
+func indexFold(data, marker []byte) int {
+	for i := 0; i+len(marker) <= len(data); i++ {
+		match := true
+		for j, c := range marker {
+			d := data[i+j]
+			if 'A' <= d && d <= 'Z' {
+				d += 'a' - 'A'
+			}
+			if d != c {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
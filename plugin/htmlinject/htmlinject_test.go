@@ -0,0 +1,63 @@
+package htmlinject
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestModifyResponse(t *testing.T) {
+	const page = "<html><HEAD><title>t</title></HEAD><body>hello</BODY></html>"
+
+	tests := []struct {
+		name          string
+		position      string
+		contentType   string
+		contentLength int64
+		encoding      string
+		want          string
+	}{
+		{name: "Buffered body", position: "body", contentType: "text/html; charset=utf-8", contentLength: int64(len(page)),
+			want: "<html><HEAD><title>t</title></HEAD><body>hello<!--x--></BODY></html>"},
+		{name: "Streamed head", position: "head", contentType: "text/html", contentLength: -1,
+			want: "<html><HEAD><title>t</title><!--x--></HEAD><body>hello</BODY></html>"},
+		{name: "Not HTML", position: "body", contentType: "application/json", contentLength: -1, want: page},
+		{name: "Compressed", position: "body", contentType: "text/html", contentLength: -1, encoding: "gzip", want: page},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(map[string]any{"snippet": "<!--x-->", "position": tt.position})
+			if err != nil {
+				t.Fatalf("Failed to create plugin: %v", err)
+			}
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": {tt.contentType}},
+				ContentLength: tt.contentLength,
+				// One byte per read splits the marker across reads.
+				Body:    io.NopCloser(iotest.OneByteReader(strings.NewReader(page))),
+				Request: &http.Request{Method: http.MethodGet},
+			}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			if err := p.(*Injector).ModifyResponse(resp); err != nil {
+				t.Fatalf("ModifyResponse failed: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read body: %v", err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("Expected body %q, got %q", tt.want, body)
+			}
+			if resp.ContentLength >= 0 && resp.ContentLength != int64(len(body)) {
+				t.Errorf("Expected Content-Length %d, got %d", len(body), resp.ContentLength)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Package jsonbody is a built-in plugin that validates JSON request bodies
+// before they reach the upstream, so that malformed payloads are rejected
+// cheaply at the edge.
+//
+//	plugins:
+//	  - name: jsonbody
+//	    config:
+//	      maxBytes: 65536
+//	      maxDepth: 20
+//	      requireContentType: true
+//	      schema: /etc/shielder/schemas/orders.json
+//
+// Requests with a body must declare application/json, or a type ending in
+// +json, unless requireContentType is false; others are rejected with 415.
+// Bodies over maxBytes are rejected with 413. Bodies that are not a single
+// JSON value, nest deeper than maxDepth or do not match the JSON Schema are
+// rejected with 400. The schema is read once, when the plugin is created.
+//
+// Bodies are read into memory, so maxBytes should stay small. Requests
+// without a body are not checked. Validation runs in the upstream stage, so
+// that only requests which passed the rate limits get their bodies parsed.
+package jsonbody
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/knakul853/shielder/plugin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+func init() {
+	plugin.Register("jsonbody", New)
+}
+
+// Validator validates JSON request bodies.
+type Validator struct {
+	maxBytes           int64
+	maxDepth           int
+	requireContentType bool
+	schema             *jsonschema.Schema
+}
+
+// New creates a jsonbody plugin from its configuration.
+func New(config map[string]any) (plugin.Plugin, error) {
+	v := &Validator{
+		maxBytes:           int64(number(config, "maxBytes", 1<<20)),
+		maxDepth:           int(number(config, "maxDepth", 32)),
+		requireContentType: config["requireContentType"] != false,
+	}
+	if v.maxBytes <= 0 || v.maxDepth < 0 {
+		return nil, errors.New("jsonbody: maxBytes must be positive and maxDepth must not be negative")
+	}
+	if path, ok := config["schema"].(string); ok && path != "" {
+		schema, err := jsonschema.Compile(path)
+		if err != nil {
+			return nil, fmt.Errorf("jsonbody: %w", err)
+		}
+		v.schema = schema
+	}
+	return v, nil
+}
+
+// Middleware validates bodies after the protection checks.
+func (v *Validator) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageUpstream {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if v.requireContentType && !isJSON(r.Header.Get("Content-Type")) {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.ContentLength > v.maxBytes {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, v.maxBytes+1))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > v.maxBytes {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		r.ContentLength = int64(len(body))
+		r.TransferEncoding = nil
+
+		// Chunked requests can turn out to be empty only now.
+		if len(body) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := v.validate(body); err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validate checks that body is a single JSON value within the depth limit
+// that matches the schema.
+func (v *Validator) validate(body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New("malformed JSON")
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if v.maxDepth > 0 && depth > v.maxDepth {
+				return fmt.Errorf("JSON nested deeper than %d levels", v.maxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+			if depth == 0 && dec.More() {
+				return errors.New("more than one JSON value")
+			}
+		default:
+			if depth == 0 && dec.More() {
+				return errors.New("more than one JSON value")
+			}
+		}
+	}
+
+	if v.schema == nil {
+		return nil
+	}
+	dec = json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return errors.New("malformed JSON")
+	}
+	if err := v.schema.Validate(doc); err != nil {
+		var verr *jsonschema.ValidationError
+		if errors.As(err, &verr) {
+			return fmt.Errorf("schema validation failed: %s", leafError(verr))
+		}
+		return err
+	}
+	return nil
+}
+
+// leafError returns the most specific cause of a validation error, which is
+// what clients need to fix their payload.
+func leafError(err *jsonschema.ValidationError) string {
+	for len(err.Causes) > 0 {
+		err = err.Causes[0]
+	}
+	location := err.InstanceLocation
+	if location == "" {
+		location = "/"
+	}
+	return location + ": " + err.Message
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+func number(config map[string]any, key string, fallback float64) float64 {
+	switch v := config[key].(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return fallback
+}
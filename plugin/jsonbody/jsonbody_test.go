@@ -0,0 +1,94 @@
+package jsonbody
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["item", "quantity"],
+	"properties": {
+		"item": {"type": "string"},
+		"quantity": {"type": "integer", "minimum": 1}
+	}
+}`
+
+func TestValidator(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "order.json")
+	if err := os.WriteFile(schemaPath, []byte(orderSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(map[string]any{"maxBytes": 64, "maxDepth": 2, "schema": schemaPath})
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"valid", "application/json", `{"item": "book", "quantity": 2}`, http.StatusOK},
+		{"vendor type", "application/vnd.api+json; charset=utf-8", `{"item": "book", "quantity": 2}`, http.StatusOK},
+		{"no body", "", "", http.StatusOK},
+		{"wrong content type", "text/plain", `{"item": "book", "quantity": 2}`, http.StatusUnsupportedMediaType},
+		{"too large", "application/json", `{"item": "` + strings.Repeat("a", 64) + `", "quantity": 2}`, http.StatusRequestEntityTooLarge},
+		{"malformed", "application/json", `{"item": "book", "quantity": }`, http.StatusBadRequest},
+		{"trailing value", "application/json", `{"item": "book", "quantity": 2} {}`, http.StatusBadRequest},
+		{"too deep", "application/json", `{"item": [[1]], "quantity": 2}`, http.StatusBadRequest},
+		{"schema violation", "application/json", `{"item": "book", "quantity": 0}`, http.StatusBadRequest},
+		{"missing field", "application/json", `{"item": "book"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded string
+			h := p.Middleware(plugin.StageUpstream, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				forwarded = string(body)
+			}))
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/orders", body)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if tt.status == http.StatusOK && forwarded != tt.body {
+				t.Errorf("Expected the body to be forwarded unchanged, got %q", forwarded)
+			}
+		})
+	}
+}
+
+func TestSchemaErrorNamesField(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "order.json")
+	if err := os.WriteFile(schemaPath, []byte(orderSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(map[string]any{"schema": schemaPath})
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+
+	err = p.(*Validator).validate([]byte(`{"item": 5, "quantity": 1}`))
+	if err == nil || !strings.Contains(err.Error(), "/item") {
+		t.Errorf("Expected the error to point at /item, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package plugin
+
+import "context"
+
+// Limit describes how a request is accounted for by the rate limiter. The
+// proxy attaches one to every request before the request-stage plugins run,
+// keyed by the client address, or the attribute the configured key strategy
+// selects, with the configured cost of the request. Request-stage plugins may
+// change it to rate limit by a different key, such as an API token, or to
+// charge expensive requests more than cheap ones.
+type Limit struct {
+	// Key identifies the client the request is counted against.
+	Key string
+	// Cost is how many requests this request counts as.
+	Cost int
+	// RequestsPerMinute overrides the configured rate limit for Key when it
+	// is positive.
+	RequestsPerMinute int
+	// Extra are further limits the request is counted against besides the
+	// one of Key, such as a quota shared by all visitors of a site, and
+	// rejected when over any of them. An Extra without a Cost costs what the
+	// request does.
+	Extra []Limit
+}
+
+type limitKey struct{}
+
+// ContextWithLimit returns a copy of ctx carrying limit.
+func ContextWithLimit(ctx context.Context, limit *Limit) context.Context {
+	return context.WithValue(ctx, limitKey{}, limit)
+}
+
+// LimitFromContext returns the limit attached to ctx, or nil if there is none.
+func LimitFromContext(ctx context.Context) *Limit {
+	limit, _ := ctx.Value(limitKey{}).(*Limit)
+	return limit
+}
@@ -0,0 +1,310 @@
+// Package lua is a built-in plugin that runs a small Lua script against each
+// request. It sits between plain configuration and compiled plugins: the script
+// can pick the rate limit key, change the cost of a request, or reject it.
+//
+//	plugins:
+//	  - name: lua
+//	    config:
+//	      path: /etc/shielder/policy.lua
+//	      timeout: 5ms
+//
+// The script must define a global function policy(req). The req table holds
+// method, path, query, host, remote_addr, headers (lower-cased names, first
+// value only), key and cost. The function returns nil to leave the request
+// unchanged, or a table with any of:
+//
+//	key     string  rate limit the request under this key instead
+//	cost    number  count the request this many times, 0 makes it free
+//	deny    boolean reject the request
+//	status  number  status code for denied requests, 403 by default
+//	reason  string  logged reason for denied requests
+//
+// For example, to limit API clients by token and charge searches double:
+//
+//	function policy(req)
+//	  local token = req.headers["x-api-token"]
+//	  if token == nil then
+//	    return { deny = true, status = 401, reason = "missing token" }
+//	  end
+//	  local cost = 1
+//	  if string.find(req.path, "^/api/search") then cost = 2 end
+//	  return { key = "token:" .. token, cost = cost }
+//	end
+//
+// Scripts run in a sandbox with only the base, string, table and math
+// libraries, so they cannot touch files, the network or the environment.
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/knakul853/shielder/plugin"
+	"github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func init() {
+	plugin.Register("lua", New)
+}
+
+// policyFunc is the global the script has to define.
+const policyFunc = "policy"
+
+// Script evaluates a Lua policy against each request.
+type Script struct {
+	source   string
+	name     string
+	timeout  time.Duration
+	failOpen bool
+	states   chan *lua.LState
+}
+
+// decision is what a script returned for a request.
+type decision struct {
+	key    string
+	cost   int
+	deny   bool
+	status int
+	reason string
+}
+
+// New loads the script from path, or from the inline source option, and
+// prepares a pool of interpreters for it.
+func New(config map[string]any) (plugin.Plugin, error) {
+	s := &Script{
+		timeout:  duration(config, "timeout", 5*time.Millisecond),
+		failOpen: config["failOpen"] == true,
+	}
+
+	path, _ := config["path"].(string)
+	inline, _ := config["source"].(string)
+	switch {
+	case path != "" && inline != "":
+		return nil, errors.New("lua: path and source are mutually exclusive")
+	case path != "":
+		code, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("lua: %w", err)
+		}
+		s.source, s.name = string(code), path
+	case inline != "":
+		s.source, s.name = inline, "<inline>"
+	default:
+		return nil, errors.New("lua: path or source is required")
+	}
+
+	poolSize := int(number(config, "poolSize", float64(runtime.GOMAXPROCS(0))))
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	s.states = make(chan *lua.LState, poolSize)
+	for i := 0; i < poolSize; i++ {
+		L, err := s.newState()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.states <- L
+	}
+	return s, nil
+}
+
+// newState creates a sandboxed interpreter with the script loaded.
+func (s *Script) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// The base library can load code from files, which the sandbox forbids.
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	if err := L.DoString(s.source); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("lua: loading %s: %w", s.name, err)
+	}
+	if L.GetGlobal(policyFunc).Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("lua: %s does not define a %s function", s.name, policyFunc)
+	}
+	return L, nil
+}
+
+// Close releases all interpreters in the pool.
+func (s *Script) Close() {
+	for {
+		select {
+		case L := <-s.states:
+			L.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Middleware runs the script before the protection checks, so that the key
+// and cost it picks are the ones the rate limiter counts.
+func (s *Script) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageRequest {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := plugin.LimitFromContext(r.Context())
+		if limit == nil {
+			limit = &plugin.Limit{Key: r.RemoteAddr, Cost: 1}
+			r = r.WithContext(plugin.ContextWithLimit(r.Context(), limit))
+		}
+
+		d, err := s.evaluate(r, limit)
+		if err != nil {
+			logrus.WithError(err).WithField("script", s.name).Error("Lua policy failed")
+			if s.failOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if d.deny {
+			status := d.status
+			if status < 400 || status > 599 {
+				status = http.StatusForbidden
+			}
+			logrus.WithFields(logrus.Fields{
+				"script": s.name,
+				"key":    limit.Key,
+				"reason": d.reason,
+			}).Info("Request denied by Lua policy")
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if d.key != "" {
+			limit.Key = d.key
+		}
+		if d.cost >= 0 {
+			limit.Cost = d.cost
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Script) evaluate(r *http.Request, limit *plugin.Limit) (decision, error) {
+	budget, cancelBudget := plugin.BudgetContext(r.Context())
+	defer cancelBudget()
+	ctx, cancel := context.WithTimeout(budget, s.timeout)
+	defer cancel()
+
+	var L *lua.LState
+	select {
+	case L = <-s.states:
+	case <-ctx.Done():
+		return decision{}, ctx.Err()
+	}
+
+	L.SetContext(ctx)
+	d, err := s.call(L, r, limit)
+	L.RemoveContext()
+	if err != nil {
+		// An interrupted script may have left globals half updated, replace
+		// the interpreter rather than reusing it.
+		L.Close()
+		if fresh, stateErr := s.newState(); stateErr == nil {
+			s.states <- fresh
+		}
+		return decision{}, err
+	}
+	s.states <- L
+	return d, nil
+}
+
+func (s *Script) call(L *lua.LState, r *http.Request, limit *plugin.Limit) (decision, error) {
+	headers := L.NewTable()
+	for name, values := range r.Header {
+		if len(values) > 0 {
+			headers.RawSetString(strings.ToLower(name), lua.LString(values[0]))
+		}
+	}
+	req := L.NewTable()
+	req.RawSetString("method", lua.LString(r.Method))
+	req.RawSetString("path", lua.LString(r.URL.Path))
+	req.RawSetString("query", lua.LString(r.URL.RawQuery))
+	req.RawSetString("host", lua.LString(r.Host))
+	req.RawSetString("remote_addr", lua.LString(r.RemoteAddr))
+	req.RawSetString("headers", headers)
+	req.RawSetString("key", lua.LString(limit.Key))
+	req.RawSetString("cost", lua.LNumber(limit.Cost))
+
+	if err := L.CallByParam(lua.P{
+		Fn:      L.GetGlobal(policyFunc),
+		NRet:    1,
+		Protect: true,
+	}, req); err != nil {
+		return decision{}, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	d := decision{cost: -1}
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return d, nil
+	case *lua.LTable:
+		if key, ok := ret.RawGetString("key").(lua.LString); ok {
+			d.key = string(key)
+		}
+		if cost, ok := ret.RawGetString("cost").(lua.LNumber); ok {
+			if cost < 0 {
+				return decision{}, fmt.Errorf("lua: negative cost %v", cost)
+			}
+			d.cost = int(cost)
+		}
+		d.deny = lua.LVAsBool(ret.RawGetString("deny"))
+		if status, ok := ret.RawGetString("status").(lua.LNumber); ok {
+			d.status = int(status)
+		}
+		if reason, ok := ret.RawGetString("reason").(lua.LString); ok {
+			d.reason = string(reason)
+		}
+		return d, nil
+	default:
+		return decision{}, fmt.Errorf("lua: %s returned %s, expected a table or nil", policyFunc, ret.Type())
+	}
+}
+
+func number(config map[string]any, key string, fallback float64) float64 {
+	switch v := config[key].(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return fallback
+}
+
+func duration(config map[string]any, key string, fallback time.Duration) time.Duration {
+	if s, ok := config[key].(string); ok {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
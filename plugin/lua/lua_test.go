@@ -0,0 +1,92 @@
+package lua
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+const testScript = `
+function policy(req)
+  if req.headers["x-block"] ~= nil then
+    return { deny = true, status = 451, reason = "blocked" }
+  end
+  if req.path == "/search" then
+    return { key = "token:" .. (req.headers["x-api-token"] or "anon"), cost = 3 }
+  end
+  if req.path == "/loop" then
+    while true do end
+  end
+  return nil
+end
+`
+
+func TestScript(t *testing.T) {
+	p, err := New(map[string]any{"source": testScript, "poolSize": 1})
+	if err != nil {
+		t.Fatalf("Failed to load script: %v", err)
+	}
+	defer p.(*Script).Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		headers    map[string]string
+		wantStatus int
+		wantKey    string
+		wantCost   int
+		// expired runs the request with its check budget used up.
+		expired bool
+	}{
+		{name: "Unchanged", path: "/", wantStatus: http.StatusOK, wantKey: "192.0.2.1:1234", wantCost: 1},
+		{name: "Rekeyed", path: "/search", headers: map[string]string{"X-Api-Token": "abc"}, wantStatus: http.StatusOK, wantKey: "token:abc", wantCost: 3},
+		{name: "Denied", path: "/", headers: map[string]string{"X-Block": "1"}, wantStatus: 451},
+		{name: "Timeout", path: "/loop", wantStatus: http.StatusServiceUnavailable},
+		{name: "Recovered after timeout", path: "/", wantStatus: http.StatusOK, wantKey: "192.0.2.1:1234", wantCost: 1},
+		{name: "Budget exceeded", path: "/", expired: true, wantStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *plugin.Limit
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = plugin.LimitFromContext(r.Context())
+			})
+			h := p.Middleware(plugin.StageRequest, next)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if tt.expired {
+				req = req.WithContext(plugin.ContextWithBudget(req.Context(), time.Now().Add(-time.Millisecond)))
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got == nil {
+				t.Fatal("Expected a limit in the request context")
+			}
+			if got.Key != tt.wantKey || got.Cost != tt.wantCost {
+				t.Errorf("Expected key %q cost %d, got key %q cost %d", tt.wantKey, tt.wantCost, got.Key, got.Cost)
+			}
+		})
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	_, err := New(map[string]any{"source": `os.exit(1) function policy(req) end`})
+	if err == nil {
+		t.Error("Expected the os library to be unavailable")
+	}
+}
@@ -0,0 +1,199 @@
+// Package origin is a built-in plugin that filters and rate limits requests
+// by the site they were sent from, for APIs that partner sites embed.
+//
+//	plugins:
+//	  - name: origin
+//	    config:
+//	      allow: ["https://partner.example", "https://*.shop.example"]
+//	      deny: ["https://scraper.example"]
+//	      allowMissing: true
+//	      quotas:
+//	        - origin: "https://partner.example"
+//	          requestsPerMinute: 600
+//	      keyByOrigin: false
+//
+// The origin of a request is its Origin header, or the scheme and host of its
+// Referer. Requests from denied origins, and from origins missing from allow
+// if it is set, are rejected with 403 before the protection checks. Requests
+// without either header are let through unless allowMissing is false; a
+// non-browser client can leave both out, so filtering by origin only keeps
+// browsers on other sites from embedding the API.
+//
+// Origins with a quota are counted against their own limit, shared by all
+// their visitors, on top of the limit of the client. With keyByOrigin set,
+// every other origin is counted against a limit of its own as well, at the
+// limit of the route. The headers are up to the client, so the limit of the
+// client is kept: sending another origin does not start a fresh count.
+package origin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+func init() {
+	plugin.Register("origin", New)
+}
+
+// Origin applies an origin policy.
+type Origin struct {
+	allow        []pattern
+	deny         []pattern
+	allowMissing bool
+	quotas       map[string]int
+	keyByOrigin  bool
+}
+
+// pattern matches an origin exactly, or any subdomain if host starts with
+// "*.".
+type pattern struct {
+	scheme string
+	host   string
+}
+
+// New creates an origin plugin from its configuration.
+func New(config map[string]any) (plugin.Plugin, error) {
+	o := &Origin{
+		allowMissing: config["allowMissing"] != false,
+		keyByOrigin:  config["keyByOrigin"] == true,
+		quotas:       make(map[string]int),
+	}
+	var err error
+	if o.allow, err = patterns(config, "allow"); err != nil {
+		return nil, err
+	}
+	if o.deny, err = patterns(config, "deny"); err != nil {
+		return nil, err
+	}
+
+	if raw, ok := config["quotas"]; ok {
+		quotas, ok := raw.([]any)
+		if !ok {
+			return nil, fmt.Errorf("origin: quotas must be a list")
+		}
+		for _, q := range quotas {
+			quota, ok := q.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("origin: quotas must be a list of objects")
+			}
+			name, ok := normalize(fmt.Sprint(quota["origin"]))
+			if !ok {
+				return nil, fmt.Errorf("origin: invalid quota origin %v", quota["origin"])
+			}
+			rpm, ok := quota["requestsPerMinute"].(int)
+			if !ok || rpm <= 0 {
+				return nil, fmt.Errorf("origin: quota for %s needs a positive requestsPerMinute", name)
+			}
+			o.quotas[name] = rpm
+		}
+	}
+	return o, nil
+}
+
+// Middleware rejects forbidden origins and adds the limit of the origin to
+// requests before the protection checks.
+func (o *Origin) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageRequest {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin, ok := requestOrigin(r)
+		if !ok {
+			if !o.allowMissing {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !o.allowed(origin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if limit := plugin.LimitFromContext(r.Context()); limit != nil {
+			if rpm, ok := o.quotas[origin]; ok {
+				limit.Extra = append(limit.Extra, plugin.Limit{Key: "origin:" + origin, RequestsPerMinute: rpm})
+			} else if o.keyByOrigin {
+				limit.Extra = append(limit.Extra, plugin.Limit{Key: "origin:" + origin, RequestsPerMinute: limit.RequestsPerMinute})
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (o *Origin) allowed(origin string) bool {
+	for _, p := range o.deny {
+		if p.matches(origin) {
+			return false
+		}
+	}
+	if len(o.allow) == 0 {
+		return true
+	}
+	for _, p := range o.allow {
+		if p.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the normalized origin of r from its Origin header,
+// falling back to its Referer. Browsers send "null" for opaque origins,
+// which counts as missing.
+func requestOrigin(r *http.Request) (string, bool) {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return normalize(origin)
+	}
+	if referer := r.Referer(); referer != "" {
+		return normalize(referer)
+	}
+	return "", false
+}
+
+// normalize reduces a URL to its lowercased scheme and host.
+func normalize(raw string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), true
+}
+
+func (p pattern) matches(origin string) bool {
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok || scheme != p.scheme {
+		return false
+	}
+	if suffix, ok := strings.CutPrefix(p.host, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == p.host
+}
+
+func patterns(config map[string]any, key string) ([]pattern, error) {
+	raw, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	values, ok := raw.([]any)
+	if !ok {
+		return nil, fmt.Errorf("origin: %s must be a list", key)
+	}
+	result := make([]pattern, 0, len(values))
+	for _, value := range values {
+		scheme, host, ok := strings.Cut(strings.ToLower(fmt.Sprint(value)), "://")
+		host = strings.TrimSuffix(host, "/")
+		if !ok || scheme == "" || host == "" || strings.Contains(host, "/") ||
+			(strings.Contains(host, "*") && !strings.HasPrefix(host, "*.")) {
+			return nil, fmt.Errorf("origin: invalid origin %v in %s", value, key)
+		}
+		result = append(result, pattern{scheme: scheme, host: host})
+	}
+	return result, nil
+}
@@ -0,0 +1,125 @@
+package origin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+func newTestPlugin(t *testing.T, config map[string]any) *Origin {
+	t.Helper()
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	return p.(*Origin)
+}
+
+func TestOrigin(t *testing.T) {
+	o := newTestPlugin(t, map[string]any{
+		"allow": []any{"https://partner.example", "https://*.shop.example"},
+		"deny":  []any{"https://evil.shop.example"},
+		"quotas": []any{
+			map[string]any{"origin": "https://partner.example", "requestsPerMinute": 600},
+		},
+	})
+
+	tests := []struct {
+		name    string
+		origin  string
+		referer string
+		status  int
+		// extra is the key of the origin limit, counted besides the
+		// limit of the client
+		extra string
+		rpm   int
+	}{
+		{"quota origin", "https://partner.example", "", http.StatusOK, "origin:https://partner.example", 600},
+		{"quota origin from referer", "", "https://Partner.example/page?q=1", http.StatusOK, "origin:https://partner.example", 600},
+		{"allowed subdomain", "https://a.shop.example", "", http.StatusOK, "", 0},
+		{"denied subdomain", "https://evil.shop.example", "", http.StatusForbidden, "", 0},
+		{"not allowed", "https://other.example", "", http.StatusForbidden, "", 0},
+		{"wrong scheme", "http://partner.example", "", http.StatusForbidden, "", 0},
+		{"missing", "", "", http.StatusOK, "", 0},
+		{"opaque origin", "null", "", http.StatusOK, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded := false
+			h := o.Middleware(plugin.StageRequest, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded = true
+			}))
+			limit := &plugin.Limit{Key: "10.0.0.1", Cost: 1}
+			req := httptest.NewRequest(http.MethodGet, "/api/widgets", nil)
+			req = req.WithContext(plugin.ContextWithLimit(req.Context(), limit))
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				req.Header.Set("Referer", tt.referer)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+			if forwarded != (tt.status == http.StatusOK) {
+				t.Fatalf("Expected forwarded=%v, got %v", tt.status == http.StatusOK, forwarded)
+			}
+			if !forwarded {
+				return
+			}
+			if limit.Key != "10.0.0.1" || limit.RequestsPerMinute != 0 {
+				t.Errorf("Expected the limit of the client to be kept, got %q at %d", limit.Key, limit.RequestsPerMinute)
+			}
+			if tt.extra == "" {
+				if len(limit.Extra) != 0 {
+					t.Errorf("Expected no origin limit, got %+v", limit.Extra)
+				}
+			} else if len(limit.Extra) != 1 || limit.Extra[0].Key != tt.extra || limit.Extra[0].RequestsPerMinute != tt.rpm {
+				t.Errorf("Expected an origin limit %q at %d rpm, got %+v", tt.extra, tt.rpm, limit.Extra)
+			}
+		})
+	}
+}
+
+func TestOriginKeyByOriginAndMissing(t *testing.T) {
+	o := newTestPlugin(t, map[string]any{"keyByOrigin": true, "allowMissing": false})
+	h := o.Middleware(plugin.StageRequest, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	limit := &plugin.Limit{Key: "10.0.0.1", Cost: 1, RequestsPerMinute: 30}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(plugin.ContextWithLimit(req.Context(), limit))
+	req.Header.Set("Origin", "https://any.example")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if limit.Key != "10.0.0.1" {
+		t.Errorf("Expected the client key to be kept, got %q", limit.Key)
+	}
+	if len(limit.Extra) != 1 || limit.Extra[0].Key != "origin:https://any.example" || limit.Extra[0].RequestsPerMinute != 30 {
+		t.Errorf("Expected a limit of the origin at the route limit, got %+v", limit.Extra)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected requests without origin to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	configs := []map[string]any{
+		{"allow": "https://partner.example"},
+		{"allow": []any{"partner.example"}},
+		{"deny": []any{"https://evil.*.example"}},
+		{"quotas": []any{map[string]any{"origin": "https://partner.example"}}},
+	}
+	for _, config := range configs {
+		if _, err := New(config); err == nil {
+			t.Errorf("Expected an error for %v", config)
+		}
+	}
+}
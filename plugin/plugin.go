@@ -0,0 +1,102 @@
+// Package plugin is the extension API for injecting custom middleware into
+// Shielder's handler chain without forking the proxy.
+//
+// A plugin registers a factory under a unique name, usually from an init
+// function, and is enabled per route in the configuration:
+//
+//	routes:
+//	  - name: api
+//	    pathPrefix: /api/
+//	    plugins:
+//	      - name: my-auth
+//	        config:
+//	          header: X-Token
+//
+// To compile a plugin into the shielder binary, add a file to cmd/ guarded by
+// a build tag that blank-imports the plugin package, and build with that tag:
+//
+//	//go:build myauth
+//
+//	package main
+//
+//	import _ "example.com/shielder-plugins/myauth"
+//
+// Embedders running Shielder from their own main package can import their
+// plugin packages directly. Their handlers and plugins find Shielder's verdict
+// on a request with DecisionFromContext.
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Stage identifies where in the handler chain a plugin's middleware runs.
+type Stage string
+
+const (
+	// StageRequest runs before Shielder's protection checks. Use it for request
+	// mutation or custom authentication that should also apply to rejected
+	// requests.
+	StageRequest Stage = "request"
+	// StageUpstream runs after the protection checks passed, right before the
+	// request is forwarded to the upstream.
+	StageUpstream Stage = "upstream"
+)
+
+// Plugin is a custom middleware that participates in one or more stages.
+type Plugin interface {
+	// Middleware wraps next for the given stage. Plugins that do not take part
+	// in a stage return next unchanged.
+	Middleware(stage Stage, next http.Handler) http.Handler
+}
+
+// ResponseModifier is implemented by plugins that rewrite upstream responses
+// before they are sent to the client.
+type ResponseModifier interface {
+	ModifyResponse(resp *http.Response) error
+}
+
+// Factory creates a plugin instance from its per-route configuration.
+type Factory func(config map[string]any) (Plugin, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a plugin factory available under name. It panics if a
+// plugin with the same name is already registered.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("plugin: %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// New instantiates the plugin registered under name.
+func New(name string, config map[string]any) (Plugin, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("plugin: unknown plugin %q", name)
+	}
+	return factory(config)
+}
+
+// Registered returns the names of all registered plugins, sorted.
+func Registered() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
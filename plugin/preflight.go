@@ -0,0 +1,11 @@
+package plugin
+
+import "net/http"
+
+// IsPreflight reports whether r is a CORS preflight request, which browsers
+// send without cookies or credentials before cross-origin requests.
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
@@ -0,0 +1,140 @@
+// Package responsepolicy is a built-in plugin that checks upstream response
+// headers against a policy. Every violation is logged, and unless the policy
+// only reports, the offending headers are removed before the response reaches
+// the client.
+//
+//	plugins:
+//	  - name: responsepolicy
+//	    config:
+//	      stripCookiesOnCacheable: true
+//	      forbidWildcardCORS: true
+//	      removeHeaders: ["X-Debug-*", "X-Backend-Server"]
+//	      reportOnly: false
+package responsepolicy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/knakul853/shielder/plugin"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	plugin.Register("responsepolicy", New)
+}
+
+// Policy enforces rules on upstream response headers.
+type Policy struct {
+	stripCookiesOnCacheable bool
+	forbidWildcardCORS      bool
+	// removeHeaders holds canonical header names, or prefixes if they end
+	// in "*".
+	removeHeaders []string
+	reportOnly    bool
+}
+
+// New creates a response policy plugin from its configuration.
+func New(config map[string]any) (plugin.Plugin, error) {
+	p := &Policy{
+		stripCookiesOnCacheable: config["stripCookiesOnCacheable"] == true,
+		forbidWildcardCORS:      config["forbidWildcardCORS"] == true,
+		reportOnly:              config["reportOnly"] == true,
+	}
+	if raw, ok := config["removeHeaders"]; ok {
+		values, ok := raw.([]any)
+		if !ok {
+			return nil, fmt.Errorf("responsepolicy: removeHeaders must be a list")
+		}
+		for _, value := range values {
+			name := fmt.Sprint(value)
+			prefix, wildcard := strings.CutSuffix(name, "*")
+			if prefix == "" || strings.Contains(prefix, "*") {
+				return nil, fmt.Errorf("responsepolicy: invalid header %q in removeHeaders", name)
+			}
+			name = http.CanonicalHeaderKey(prefix)
+			if wildcard {
+				name += "*"
+			}
+			p.removeHeaders = append(p.removeHeaders, name)
+		}
+	}
+	return p, nil
+}
+
+// Middleware does not take part in any stage; the policy only applies to
+// responses.
+func (p *Policy) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	return next
+}
+
+// ModifyResponse checks the upstream response headers.
+func (p *Policy) ModifyResponse(resp *http.Response) error {
+	if p.stripCookiesOnCacheable && len(resp.Header.Values("Set-Cookie")) > 0 && cacheable(resp.Header) {
+		p.violation(resp, "Set-Cookie", "cookie on cacheable response")
+	}
+	if p.forbidWildcardCORS && strings.TrimSpace(resp.Header.Get("Access-Control-Allow-Origin")) == "*" {
+		p.violation(resp, "Access-Control-Allow-Origin", "wildcard CORS")
+	}
+	for name := range resp.Header {
+		if p.forbidden(name) {
+			p.violation(resp, name, "forbidden header")
+		}
+	}
+	return nil
+}
+
+func (p *Policy) violation(resp *http.Response, header, rule string) {
+	fields := logrus.Fields{
+		"header":      header,
+		"rule":        rule,
+		"status":      resp.StatusCode,
+		"report_only": p.reportOnly,
+	}
+	if resp.Request != nil {
+		fields["method"] = resp.Request.Method
+		fields["host"] = resp.Request.Host
+		fields["path"] = resp.Request.URL.Path
+	}
+	logrus.WithFields(fields).Warn("Upstream response violates header policy")
+	if !p.reportOnly {
+		resp.Header.Del(header)
+	}
+}
+
+func (p *Policy) forbidden(name string) bool {
+	for _, header := range p.removeHeaders {
+		if prefix, ok := strings.CutSuffix(header, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == header {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheable reports whether shared caches may store a response with these
+// headers.
+func cacheable(header http.Header) bool {
+	public := false
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "private", "no-store", "no-cache":
+				return false
+			case "public":
+				public = true
+			case "max-age", "s-maxage":
+				if seconds, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil && seconds > 0 {
+					public = true
+				}
+			}
+		}
+	}
+	return public || header.Get("Expires") != ""
+}
@@ -0,0 +1,115 @@
+package responsepolicy
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/knakul853/shielder/plugin"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestPlugin(t *testing.T, config map[string]any) plugin.ResponseModifier {
+	t.Helper()
+	logrus.SetOutput(io.Discard)
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	return p.(plugin.ResponseModifier)
+}
+
+func TestPolicy(t *testing.T) {
+	p := newTestPlugin(t, map[string]any{
+		"stripCookiesOnCacheable": true,
+		"forbidWildcardCORS":      true,
+		"removeHeaders":           []any{"x-debug-*", "X-Backend-Server"},
+	})
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		removed []string
+		kept    []string
+	}{
+		{
+			name:    "cookie on public response",
+			header:  http.Header{"Cache-Control": {"public, max-age=60"}, "Set-Cookie": {"a=1"}},
+			removed: []string{"Set-Cookie"},
+		},
+		{
+			name:    "cookie on shared max-age",
+			header:  http.Header{"Cache-Control": {"s-maxage=30"}, "Set-Cookie": {"a=1"}},
+			removed: []string{"Set-Cookie"},
+		},
+		{
+			name:   "cookie on private response",
+			header: http.Header{"Cache-Control": {"private, max-age=60"}, "Set-Cookie": {"a=1"}},
+			kept:   []string{"Set-Cookie"},
+		},
+		{
+			name:   "cookie without caching",
+			header: http.Header{"Set-Cookie": {"a=1"}},
+			kept:   []string{"Set-Cookie"},
+		},
+		{
+			name:    "wildcard CORS",
+			header:  http.Header{"Access-Control-Allow-Origin": {"*"}},
+			removed: []string{"Access-Control-Allow-Origin"},
+		},
+		{
+			name:   "specific CORS origin",
+			header: http.Header{"Access-Control-Allow-Origin": {"https://app.example"}},
+			kept:   []string{"Access-Control-Allow-Origin"},
+		},
+		{
+			name:    "debug headers",
+			header:  http.Header{"X-Debug-Query": {"select"}, "X-Backend-Server": {"db1"}, "X-Request-Id": {"1"}},
+			removed: []string{"X-Debug-Query", "X-Backend-Server"},
+			kept:    []string{"X-Request-Id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: tt.header}
+			if err := p.ModifyResponse(resp); err != nil {
+				t.Fatalf("ModifyResponse failed: %v", err)
+			}
+			for _, name := range tt.removed {
+				if resp.Header.Get(name) != "" {
+					t.Errorf("Expected %s to be removed", name)
+				}
+			}
+			for _, name := range tt.kept {
+				if resp.Header.Get(name) == "" {
+					t.Errorf("Expected %s to be kept", name)
+				}
+			}
+		})
+	}
+}
+
+func TestReportOnly(t *testing.T) {
+	p := newTestPlugin(t, map[string]any{"forbidWildcardCORS": true, "reportOnly": true})
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Access-Control-Allow-Origin": {"*"}}}
+	if err := p.ModifyResponse(resp); err != nil {
+		t.Fatalf("ModifyResponse failed: %v", err)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Expected header to be kept in report only mode, got %q", got)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, config := range []map[string]any{
+		{"removeHeaders": "X-Debug"},
+		{"removeHeaders": []any{"*"}},
+		{"removeHeaders": []any{"X-*-Debug"}},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("Expected error for %v", config)
+		}
+	}
+}
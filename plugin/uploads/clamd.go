@@ -0,0 +1,74 @@
+package uploads
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// errScanner is returned when a file could not be scanned.
+var errScanner = errors.New("uploads: scanner unavailable")
+
+// chunkSize is the size of the chunks files are streamed to clamd in, well
+// below clamd's default StreamMaxLength.
+const chunkSize = 32 << 10
+
+// clamd scans files with a clamd daemon.
+type clamd struct {
+	addr    string
+	timeout time.Duration
+}
+
+// scan streams r to clamd and returns the name of the signature it matched,
+// empty if the file is clean.
+func (c *clamd) scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errScanner, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", fmt.Errorf("%w: %v", errScanner, err)
+	}
+	buf := make([]byte, chunkSize+4)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return "", fmt.Errorf("%w: %v", errScanner, werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("%w: %v", errScanner, err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errScanner, err)
+	}
+	// "stream: OK", "stream: <signature> FOUND" or "... ERROR"
+	reply = strings.TrimPrefix(strings.TrimSuffix(reply, "\x00"), "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("%w: %s", errScanner, reply)
+	}
+}
@@ -0,0 +1,318 @@
+// Package uploads is a built-in plugin that enforces an upload policy on
+// multipart/form-data requests before they reach the upstream.
+//
+//	plugins:
+//	  - name: uploads
+//	    config:
+//	      maxFiles: 5
+//	      maxFileBytes: 10485760
+//	      maxTotalBytes: 52428800
+//	      allowedTypes: ["image/png", "image/jpeg", "application/pdf"]
+//	      scanner: "clamav.internal:3310"
+//	      scanTimeout: 30s
+//	      scanFailOpen: false
+//
+// File types are sniffed from the content of each file, the Content-Type the
+// client declared is ignored. A type ending in "/*" allows a whole family.
+// Requests with too many or too large files are rejected with 413, files of
+// other types with 415, and files the scanner flags with 403. Bodies are
+// limited to maxTotalBytes, 50 MiB unless configured, as they are spooled to
+// disk; 0 disables a limit.
+//
+// With scanner set, every file is streamed to a clamd daemon with the
+// INSTREAM command. Scanner errors reject the request with 503 unless
+// scanFailOpen is set.
+//
+// The body is spooled to a temporary file in tempDir while it is inspected and
+// forwarded from there, so large uploads do not sit in memory. Bodies that the
+// route already buffers are inspected in place. Uploads are inspected in the
+// upstream stage, once the client passed the protection checks, so blocked
+// and rate-limited clients cannot have them spooled and scanned.
+package uploads
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+func init() {
+	plugin.Register("uploads", New)
+}
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// defaultMaxTotalBytes limits the bodies spooled to disk when maxTotalBytes
+// is not configured.
+const defaultMaxTotalBytes = 50 << 20
+
+// Uploads enforces an upload policy.
+type Uploads struct {
+	maxFiles      int
+	maxFileBytes  int64
+	maxTotalBytes int64
+	allowedTypes  []string
+	scanner       *clamd
+	scanFailOpen  bool
+	tempDir       string
+}
+
+// rejection is an upload that violates the policy.
+type rejection struct {
+	status int
+	reason string
+}
+
+func (r *rejection) Error() string {
+	return r.reason
+}
+
+// New creates an uploads plugin from its configuration.
+func New(config map[string]any) (plugin.Plugin, error) {
+	u := &Uploads{
+		maxFiles:      int(number(config, "maxFiles", 0)),
+		maxFileBytes:  int64(number(config, "maxFileBytes", 0)),
+		maxTotalBytes: int64(number(config, "maxTotalBytes", defaultMaxTotalBytes)),
+		scanFailOpen:  config["scanFailOpen"] == true,
+	}
+	if u.maxFiles < 0 || u.maxFileBytes < 0 || u.maxTotalBytes < 0 {
+		return nil, errors.New("uploads: limits must not be negative")
+	}
+	u.tempDir, _ = config["tempDir"].(string)
+	if raw, ok := config["allowedTypes"]; ok {
+		types, ok := raw.([]any)
+		if !ok {
+			return nil, errors.New("uploads: allowedTypes must be a list")
+		}
+		for _, t := range types {
+			u.allowedTypes = append(u.allowedTypes, strings.ToLower(fmt.Sprint(t)))
+		}
+	}
+	if addr, ok := config["scanner"].(string); ok && addr != "" {
+		u.scanner = &clamd{addr: addr, timeout: duration(config, "scanTimeout", 30*time.Second)}
+	}
+	return u, nil
+}
+
+// Middleware inspects multipart bodies after the protection checks, so that
+// rejected uploads never reach the upstream.
+func (u *Uploads) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageUpstream {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if params["boundary"] == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if err := u.inspectRequest(r, params["boundary"]); err != nil {
+			var rej *rejection
+			switch {
+			case errors.As(err, &rej):
+				http.Error(w, rej.reason, rej.status)
+			case errors.Is(err, errScanner):
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			default:
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// inspectRequest checks the body of r and leaves r with a body that can be
+// forwarded.
+func (u *Uploads) inspectRequest(r *http.Request, boundary string) error {
+	// The route buffered the body already.
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = u.inspect(body, boundary)
+		return err
+	}
+
+	spool, err := os.CreateTemp(u.tempDir, "shielder-upload-*")
+	if err != nil {
+		return err
+	}
+	body := &spoolBody{File: spool}
+	size, err := u.inspect(io.TeeReader(r.Body, spool), boundary)
+	r.Body.Close()
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return err
+	}
+	r.Body = body
+	r.ContentLength = size
+	r.TransferEncoding = nil
+	return nil
+}
+
+// inspect reads the whole multipart body and checks every file in it. It
+// returns the size of the body.
+func (u *Uploads) inspect(body io.Reader, boundary string) (int64, error) {
+	counter := &countingReader{r: body}
+	var src io.Reader = counter
+	if u.maxTotalBytes > 0 {
+		src = io.LimitReader(counter, u.maxTotalBytes+1)
+	}
+	mr := multipart.NewReader(src, boundary)
+
+	files := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, u.tooLarge(counter, err)
+		}
+		if part.FileName() == "" {
+			_, err = io.Copy(io.Discard, part)
+		} else {
+			files++
+			if u.maxFiles > 0 && files > u.maxFiles {
+				return 0, &rejection{http.StatusRequestEntityTooLarge, "Too many files"}
+			}
+			err = u.inspectFile(part)
+		}
+		if err != nil {
+			return 0, u.tooLarge(counter, err)
+		}
+	}
+	// Read the epilogue so that all of the body gets spooled.
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return 0, err
+	}
+	if u.maxTotalBytes > 0 && counter.n > u.maxTotalBytes {
+		return 0, &rejection{http.StatusRequestEntityTooLarge, "Request Entity Too Large"}
+	}
+	return counter.n, nil
+}
+
+// tooLarge reports a body that was cut off at maxTotalBytes as too large
+// rather than malformed.
+func (u *Uploads) tooLarge(counter *countingReader, err error) error {
+	if u.maxTotalBytes > 0 && counter.n > u.maxTotalBytes {
+		return &rejection{http.StatusRequestEntityTooLarge, "Request Entity Too Large"}
+	}
+	return err
+}
+
+func (u *Uploads) inspectFile(part *multipart.Part) error {
+	var src io.Reader = part
+	if u.maxFileBytes > 0 {
+		src = io.LimitReader(part, u.maxFileBytes+1)
+	}
+	br := bufio.NewReaderSize(src, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return err
+	}
+	if !u.typeAllowed(http.DetectContentType(head)) {
+		return &rejection{http.StatusUnsupportedMediaType, "Unsupported Media Type"}
+	}
+
+	counter := &countingReader{r: br}
+	if u.scanner != nil {
+		found, err := u.scanner.scan(counter)
+		if err != nil && !u.scanFailOpen {
+			return err
+		}
+		if found != "" {
+			return &rejection{http.StatusForbidden, "Forbidden"}
+		}
+	}
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return err
+	}
+	if u.maxFileBytes > 0 && counter.n > u.maxFileBytes {
+		return &rejection{http.StatusRequestEntityTooLarge, "Request Entity Too Large"}
+	}
+	return nil
+}
+
+func (u *Uploads) typeAllowed(sniffed string) bool {
+	if len(u.allowedTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(sniffed)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range u.allowedTypes {
+		if family, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return true
+			}
+		} else if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// spoolBody is a request body read back from a temporary file, which is
+// removed once the body is closed.
+type spoolBody struct {
+	*os.File
+}
+
+func (b *spoolBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
+
+func number(config map[string]any, key string, fallback float64) float64 {
+	switch v := config[key].(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return fallback
+}
+
+func duration(config map[string]any, key string, fallback time.Duration) time.Duration {
+	if s, ok := config[key].(string); ok {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
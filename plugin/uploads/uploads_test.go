@@ -0,0 +1,220 @@
+package uploads
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+var pngHeader = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+
+type file struct {
+	name    string
+	content []byte
+}
+
+func multipartBody(t *testing.T, files ...file) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("title", "holiday")
+	for _, f := range files {
+		// The declared type is always a harmless image.
+		h := make(map[string][]string)
+		h["Content-Disposition"] = []string{`form-data; name="file"; filename="` + f.name + `"`}
+		h["Content-Type"] = []string{"image/png"}
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(f.content)
+	}
+	mw.Close()
+	return &buf, mw.FormDataContentType()
+}
+
+func newTestPlugin(t *testing.T, config map[string]any) *Uploads {
+	t.Helper()
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	return p.(*Uploads)
+}
+
+func TestUploads(t *testing.T) {
+	tempDir := t.TempDir()
+	u := newTestPlugin(t, map[string]any{
+		"maxFiles":      2,
+		"maxFileBytes":  64,
+		"maxTotalBytes": 1024,
+		"allowedTypes":  []any{"image/*"},
+		"tempDir":       tempDir,
+	})
+	png := file{"a.png", pngHeader}
+
+	tests := []struct {
+		name   string
+		files  []file
+		status int
+	}{
+		{"allowed files", []file{png, png}, http.StatusOK},
+		{"too many files", []file{png, png, png}, http.StatusRequestEntityTooLarge},
+		{"file too large", []file{{"big.png", append(pngHeader, bytes.Repeat([]byte{0}, 64)...)}}, http.StatusRequestEntityTooLarge},
+		{"body too large", []file{{"huge.png", append(pngHeader, bytes.Repeat([]byte{0}, 2048)...)}}, http.StatusRequestEntityTooLarge},
+		{"sniffed type not allowed", []file{{"fake.png", []byte("#!/bin/sh\nrm -rf /\n")}}, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, tt.files...)
+			sent := body.Bytes()
+			var forwarded []byte
+			h := u.Middleware(plugin.StageUpstream, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded, _ = io.ReadAll(r.Body)
+				r.Body.Close()
+				if r.ContentLength != int64(len(forwarded)) {
+					t.Errorf("Expected Content-Length %d, got %d", len(forwarded), r.ContentLength)
+				}
+			}))
+			// Without a length, as with chunked uploads.
+			req := httptest.NewRequest(http.MethodPost, "/upload", io.NopCloser(bytes.NewReader(sent)))
+			req.Header.Set("Content-Type", contentType)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+			if tt.status == http.StatusOK && !bytes.Equal(forwarded, sent) {
+				t.Errorf("Expected the body to be forwarded unchanged")
+			}
+			if spooled, _ := os.ReadDir(tempDir); len(spooled) != 0 {
+				t.Errorf("Expected the spooled body to be removed, found %d files", len(spooled))
+			}
+		})
+	}
+}
+
+func TestUploadsIgnoresOtherBodies(t *testing.T) {
+	u := newTestPlugin(t, map[string]any{"allowedTypes": []any{"image/png"}})
+	h := u.Middleware(plugin.StageUpstream, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(`{"a":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected JSON bodies to pass, got %d", rec.Code)
+	}
+}
+
+func TestUploadsDefaults(t *testing.T) {
+	u := newTestPlugin(t, map[string]any{})
+	if u.maxTotalBytes != defaultMaxTotalBytes {
+		t.Errorf("Expected bodies to be limited to %d bytes by default, got %d", defaultMaxTotalBytes, u.maxTotalBytes)
+	}
+	if u := newTestPlugin(t, map[string]any{"maxTotalBytes": 0}); u.maxTotalBytes != 0 {
+		t.Errorf("Expected 0 to disable the limit, got %d", u.maxTotalBytes)
+	}
+
+	// Uploads are inspected once the protection checks passed only.
+	u = newTestPlugin(t, map[string]any{"allowedTypes": []any{"application/pdf"}})
+	h := u.Middleware(plugin.StageRequest, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	body, contentType := multipartBody(t, file{"a.png", pngHeader})
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the request stage not to inspect uploads, got %d", rec.Code)
+	}
+}
+
+// fakeClamd answers INSTREAM requests, flagging streams that contain
+// "EICAR".
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if cmd, err := br.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(br, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				if bytes.Contains(data, []byte("EICAR")) {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestUploadsScanner(t *testing.T) {
+	addr := fakeClamd(t)
+	tests := []struct {
+		name    string
+		scanner string
+		failOk  bool
+		content string
+		status  int
+	}{
+		{"clean file", addr, false, "hello", http.StatusOK},
+		{"infected file", addr, false, "X5O!P%@AP EICAR test", http.StatusForbidden},
+		{"scanner down", "127.0.0.1:1", false, "hello", http.StatusServiceUnavailable},
+		{"scanner down, fail open", "127.0.0.1:1", true, "hello", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestPlugin(t, map[string]any{"scanner": tt.scanner, "scanTimeout": "1s", "scanFailOpen": tt.failOk})
+			h := u.Middleware(plugin.StageUpstream, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			body, contentType := multipartBody(t, file{"a.txt", []byte(tt.content)})
+			req := httptest.NewRequest(http.MethodPost, "/upload", body)
+			req.Header.Set("Content-Type", contentType)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Package wasm is a plugin that runs sandboxed WebAssembly request filters, so
+// operators can add custom filtering logic without rebuilding Shielder.
+//
+// The plugin depends on the wazero runtime and is only compiled in when
+// building with the shielder_wasm tag:
+//
+//	go build -tags shielder_wasm ./cmd
+//
+// It is enabled per route like any other plugin:
+//
+//	plugins:
+//	  - name: wasm
+//	    config:
+//	      path: /etc/shielder/filters/bad-bots.wasm
+//	      maxBodyBytes: 65536  # request body bytes passed to the filter, 0 = none
+//	      timeout: 10ms        # per-request execution budget
+//	      memoryLimitPages: 64 # 64KiB pages, caps guest memory
+//	      poolSize: 8          # concurrently usable module instances
+//	      scoreThreshold: 0.8  # block when the returned score reaches this
+//	      failOpen: false      # allow the request if the filter traps or times out
+//
+// # ABI (version 1)
+//
+// A filter module must export:
+//
+//	memory                                   the guest's linear memory
+//	shielder_alloc(size: i32) -> i32         returns a pointer to size free bytes
+//	shielder_filter(ptr: i32, len: i32) -> i64
+//
+// For every request the host calls shielder_alloc, writes a UTF-8 JSON
+// document describing the request into the returned buffer, and calls
+// shielder_filter with its location:
+//
+//	{
+//	  "method": "POST",
+//	  "path": "/api/login",
+//	  "query": "next=%2F",
+//	  "host": "example.com",
+//	  "remoteAddr": "203.0.113.7:51234",
+//	  "headers": {"User-Agent": ["curl/8.0"]},
+//	  "body": "base64, only when maxBodyBytes > 0"
+//	}
+//
+// shielder_filter returns the location of a JSON verdict in guest memory,
+// packed as (ptr << 32) | len:
+//
+//	{"action": "allow"}
+//	{"action": "block", "status": 403, "reason": "scanner user agent"}
+//	{"action": "score", "score": 0.93, "reason": "credential stuffing pattern"}
+//
+// A "score" verdict blocks the request when the score reaches the
+// configured scoreThreshold. Modules may import WASI (wasi_snapshot_preview1),
+// which is provided without access to the filesystem, environment or network.
+// The exports are resolved once per instance and instances are reused across
+// requests, so filters must not rely on per-request global state.
+package wasm
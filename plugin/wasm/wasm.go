@@ -0,0 +1,249 @@
+//go:build shielder_wasm
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/knakul853/shielder/plugin"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func init() {
+	plugin.Register("wasm", New)
+}
+
+// Filter runs a WebAssembly filter module against each request.
+type Filter struct {
+	runtime        wazero.Runtime
+	compiled       wazero.CompiledModule
+	instances      chan *instance
+	maxBodyBytes   int64
+	timeout        time.Duration
+	scoreThreshold float64
+	failOpen       bool
+}
+
+// instance is a single instantiated module with its resolved exports. An
+// instance must only be used by one request at a time.
+type instance struct {
+	module api.Module
+	alloc  api.Function
+	filter api.Function
+}
+
+type filterRequest struct {
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Query      string              `json:"query"`
+	Host       string              `json:"host"`
+	RemoteAddr string              `json:"remoteAddr"`
+	Headers    map[string][]string `json:"headers"`
+	Body       []byte              `json:"body,omitempty"`
+}
+
+type verdict struct {
+	Action string  `json:"action"`
+	Status int     `json:"status"`
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason"`
+}
+
+// New compiles the configured module and instantiates its instance pool.
+func New(config map[string]any) (plugin.Plugin, error) {
+	path, _ := config["path"].(string)
+	if path == "" {
+		return nil, errors.New("wasm: path is required")
+	}
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+
+	f := &Filter{
+		maxBodyBytes:   int64(number(config, "maxBodyBytes", 0)),
+		timeout:        duration(config, "timeout", 10*time.Millisecond),
+		scoreThreshold: number(config, "scoreThreshold", 1),
+		failOpen:       config["failOpen"] == true,
+	}
+	poolSize := int(number(config, "poolSize", float64(runtime.GOMAXPROCS(0))))
+	memoryPages := uint32(number(config, "memoryLimitPages", 64))
+
+	ctx := context.Background()
+	f.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(memoryPages).
+		WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, f.runtime)
+
+	f.compiled, err = f.runtime.CompileModule(ctx, code)
+	if err != nil {
+		f.runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm: compiling %s: %w", path, err)
+	}
+
+	f.instances = make(chan *instance, poolSize)
+	for i := 0; i < poolSize; i++ {
+		inst, err := f.instantiate(ctx)
+		if err != nil {
+			f.runtime.Close(ctx)
+			return nil, fmt.Errorf("wasm: instantiating %s: %w", path, err)
+		}
+		f.instances <- inst
+	}
+	return f, nil
+}
+
+func (f *Filter) instantiate(ctx context.Context) (*instance, error) {
+	// An empty name lets the same module be instantiated several times.
+	module, err := f.runtime.InstantiateModule(ctx, f.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return nil, err
+	}
+	inst := &instance{
+		module: module,
+		alloc:  module.ExportedFunction("shielder_alloc"),
+		filter: module.ExportedFunction("shielder_filter"),
+	}
+	if inst.alloc == nil || inst.filter == nil || module.Memory() == nil {
+		module.Close(ctx)
+		return nil, errors.New("module must export memory, shielder_alloc and shielder_filter")
+	}
+	return inst, nil
+}
+
+// Middleware evaluates the filter before the protection checks, so blocked
+// requests never consume rate limit budget.
+func (f *Filter) Middleware(stage plugin.Stage, next http.Handler) http.Handler {
+	if stage != plugin.StageRequest {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, err := f.evaluate(r)
+		if err != nil {
+			if f.failOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if v.Action == "block" || (v.Action == "score" && v.Score >= f.scoreThreshold) {
+			status := v.Status
+			if status < 400 || status > 599 {
+				status = http.StatusForbidden
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *Filter) evaluate(r *http.Request) (verdict, error) {
+	input := filterRequest{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Headers:    r.Header,
+	}
+	if f.maxBodyBytes > 0 && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, f.maxBodyBytes))
+		if err != nil {
+			return verdict{}, err
+		}
+		// Hand the inspected prefix back to the upstream followed by the rest.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		input.Body = body
+	}
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return verdict{}, err
+	}
+
+	budget, cancelBudget := plugin.BudgetContext(r.Context())
+	defer cancelBudget()
+	ctx, cancel := context.WithTimeout(budget, f.timeout)
+	defer cancel()
+
+	var inst *instance
+	select {
+	case inst = <-f.instances:
+	case <-ctx.Done():
+		return verdict{}, ctx.Err()
+	}
+
+	v, err := inst.call(ctx, payload)
+	if err != nil {
+		// A trapped or interrupted instance may hold corrupted state, replace it.
+		inst.module.Close(context.Background())
+		if fresh, instErr := f.instantiate(context.Background()); instErr == nil {
+			f.instances <- fresh
+		}
+		return verdict{}, err
+	}
+	f.instances <- inst
+	return v, nil
+}
+
+func (inst *instance) call(ctx context.Context, payload []byte) (verdict, error) {
+	res, err := inst.alloc.Call(ctx, uint64(len(payload)))
+	if err != nil {
+		return verdict{}, err
+	}
+	ptr := uint32(res[0])
+	if !inst.module.Memory().Write(ptr, payload) {
+		return verdict{}, errors.New("wasm: allocation out of range")
+	}
+
+	res, err = inst.filter.Call(ctx, uint64(ptr), uint64(len(payload)))
+	if err != nil {
+		return verdict{}, err
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	out, ok := inst.module.Memory().Read(outPtr, outLen)
+	if !ok {
+		return verdict{}, errors.New("wasm: verdict out of range")
+	}
+
+	var v verdict
+	if err := json.Unmarshal(out, &v); err != nil {
+		return verdict{}, fmt.Errorf("wasm: invalid verdict: %w", err)
+	}
+	return v, nil
+}
+
+func number(config map[string]any, key string, fallback float64) float64 {
+	switch v := config[key].(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return fallback
+}
+
+func duration(config map[string]any, key string, fallback time.Duration) time.Duration {
+	if s, ok := config[key].(string); ok {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,138 @@
+//go:build shielder_wasm
+
+package wasm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knakul853/shielder/plugin"
+)
+
+// The verdicts the test module returns, placed in its memory at
+// allowOffset and blockOffset.
+const (
+	allowVerdict = `{"action":"allow"}`
+	blockVerdict = `{"action":"block","status":429,"reason":"no posts"}`
+	allowOffset  = 16
+	blockOffset  = 64
+)
+
+func uleb(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+			continue
+		}
+		return append(out, b)
+	}
+}
+
+func sleb(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func section(id byte, items ...[]byte) []byte {
+	var content []byte
+	content = append(content, uleb(uint64(len(items)))...)
+	for _, item := range items {
+		content = append(content, item...)
+	}
+	return append(append([]byte{id}, uleb(uint64(len(content)))...), content...)
+}
+
+func name(s string) []byte {
+	return append(uleb(uint64(len(s))), s...)
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+// filterModule assembles a filter that blocks requests whose method starts
+// with P and allows all others. shielder_alloc always hands out offset 1024.
+func filterModule() []byte {
+	packed := func(offset, length int) []byte {
+		return sleb(int64(offset)<<32 | int64(length))
+	}
+	alloc := concat([]byte{0x00, 0x41}, sleb(1024), []byte{0x0b})
+	filter := concat(
+		[]byte{0x00},
+		// The method starts after `{"method":"`, 11 bytes into the request.
+		[]byte{0x20, 0x00, 0x2d, 0x00, 0x0b},
+		[]byte{0x41}, sleb('P'),
+		[]byte{0x46, 0x04, 0x7e, 0x42}, packed(blockOffset, len(blockVerdict)),
+		[]byte{0x05, 0x42}, packed(allowOffset, len(allowVerdict)),
+		[]byte{0x0b, 0x0b},
+	)
+	data := func(offset int, s string) []byte {
+		return concat([]byte{0x00, 0x41}, sleb(int64(offset)), []byte{0x0b}, name(s))
+	}
+	return concat(
+		[]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00},
+		section(1, []byte{0x60, 0x01, 0x7f, 0x01, 0x7f}, []byte{0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e}),
+		section(3, []byte{0x00}, []byte{0x01}),
+		section(5, []byte{0x00, 0x01}),
+		section(7,
+			concat(name("memory"), []byte{0x02, 0x00}),
+			concat(name("shielder_alloc"), []byte{0x00, 0x00}),
+			concat(name("shielder_filter"), []byte{0x00, 0x01}),
+		),
+		section(10, name(string(alloc)), name(string(filter))),
+		section(11, data(allowOffset, allowVerdict), data(blockOffset, blockVerdict)),
+	)
+}
+
+func TestFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.wasm")
+	if err := os.WriteFile(path, filterModule(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := plugin.New("wasm", map[string]any{"path": path, "poolSize": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reached := 0
+	h := p.Middleware(plugin.StageRequest, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	if rec.Code != http.StatusOK || reached != 1 {
+		t.Errorf("Expected the filter to allow GET, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/users", nil))
+	if rec.Code != http.StatusTooManyRequests || reached != 1 {
+		t.Errorf("Expected the filter to block POST with its status, got %d", rec.Code)
+	}
+}
+
+func TestFilterRejectsModulesWithoutExports(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.wasm")
+	if err := os.WriteFile(path, []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plugin.New("wasm", map[string]any{"path": path}); err == nil {
+		t.Error("Expected a module without the filter exports to be rejected")
+	}
+}